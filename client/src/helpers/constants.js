@@ -244,6 +244,7 @@ export const FILTERED_STATUS = {
     FILTERED_SAFE_SEARCH: 'FilteredSafeSearch',
     FILTERED_SAFE_BROWSING: 'FilteredSafeBrowsing',
     FILTERED_PARENTAL: 'FilteredParental',
+    FILTERED_NOT_IN_ALLOW_LIST: 'FilteredNotInAllowList',
 };
 
 export const FILTERED = 'Filtered';
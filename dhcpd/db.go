@@ -43,9 +43,11 @@ func ipInRange(start, stop, ip net.IP) bool {
 // Load lease table from DB
 func (s *Server) dbLoad() {
 	s.leases = nil
+	s.v6.leases = nil
 	s.IPpool = make(map[[4]byte]net.HardwareAddr)
 	dynLeases := []*Lease{}
 	staticLeases := []*Lease{}
+	leases6 := []*Lease{}
 
 	data, err := ioutil.ReadFile(s.conf.DBFilePath)
 	if err != nil {
@@ -66,8 +68,22 @@ func (s *Server) dbLoad() {
 	for i := range obj {
 		obj[i].IP = normalizeIP(obj[i].IP)
 
+		if len(obj[i].IP) == net.IPv6len {
+			if s.v6.prefix == nil || !s.v6.prefix.Contains(obj[i].IP) {
+				log.Tracef("Skipping a lease with IP %v: not within current IPv6 prefix", obj[i].IP)
+				continue
+			}
+			leases6 = append(leases6, &Lease{
+				HWAddr:   obj[i].HWAddr,
+				IP:       obj[i].IP,
+				Hostname: obj[i].Hostname,
+				Expiry:   time.Unix(obj[i].Expiry, 0),
+			})
+			continue
+		}
+
 		if obj[i].Expiry != leaseExpireStatic &&
-			!ipInRange(s.leaseStart, s.leaseStop, obj[i].IP) {
+			!ipInRange(s.leaseStart, s.leaseStop, obj[i].IP) && !s.inRelayRange(obj[i].IP) {
 
 			log.Tracef("Skipping a lease with IP %v: not within current IP range", obj[i].IP)
 			continue
@@ -88,12 +104,13 @@ func (s *Server) dbLoad() {
 	}
 
 	s.leases = normalizeLeases(staticLeases, dynLeases)
+	s.v6.leases = normalizeLeases(nil, leases6)
 
 	for _, lease := range s.leases {
 		s.reserveIP(lease.IP, lease.HWAddr)
 	}
 
-	log.Info("DHCP: loaded %d (%d) leases from DB", len(s.leases), numLeases)
+	log.Info("DHCP: loaded %d (%d) leases from DB", len(s.leases)+len(s.v6.leases), numLeases)
 }
 
 // Skip duplicate leases
@@ -127,15 +144,16 @@ func normalizeLeases(staticLeases, dynLeases []*Lease) []*Lease {
 func (s *Server) dbStore() {
 	var leases []leaseJSON
 
-	for i := range s.leases {
-		if s.leases[i].Expiry.Unix() == 0 {
+	all := append(append([]*Lease{}, s.leases...), s.v6.leases...)
+	for i := range all {
+		if all[i].Expiry.Unix() == 0 {
 			continue
 		}
 		lease := leaseJSON{
-			HWAddr:   s.leases[i].HWAddr,
-			IP:       s.leases[i].IP,
-			Hostname: s.leases[i].Hostname,
-			Expiry:   s.leases[i].Expiry.Unix(),
+			HWAddr:   all[i].HWAddr,
+			IP:       all[i].IP,
+			Hostname: all[i].Hostname,
+			Expiry:   all[i].Expiry.Unix(),
 		}
 		leases = append(leases, lease)
 	}
@@ -70,6 +70,10 @@ type dhcpServerConfigJSON struct {
 
 func (s *Server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 	newconfig := dhcpServerConfigJSON{}
+	// keep the current values of the settings which aren't present in the request
+	newconfig.LocalDomainName = s.conf.LocalDomainName
+	newconfig.Conf6 = s.conf.Conf6
+	newconfig.RelaySubnets = s.conf.RelaySubnets
 	err := json.NewDecoder(r.Body).Decode(&newconfig)
 	if err != nil {
 		httpError(r, w, http.StatusBadRequest, "Failed to parse new DHCP config json: %s", err)
@@ -295,6 +299,49 @@ func (s *Server) handleDHCPRemoveStaticLease(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+type dhcpOptionsJSON struct {
+	Options            []DHCPOption         `json:"options"`
+	StaticLeaseOptions []StaticLeaseOptions `json:"static_lease_options"`
+}
+
+func (s *Server) handleDHCPOptions(w http.ResponseWriter, r *http.Request) {
+	s.optionsLock.RLock()
+	resp := dhcpOptionsJSON{
+		Options:            s.conf.Options,
+		StaticLeaseOptions: s.conf.StaticLeaseOptions,
+	}
+	s.optionsLock.RUnlock()
+	if resp.Options == nil {
+		resp.Options = []DHCPOption{}
+	}
+	if resp.StaticLeaseOptions == nil {
+		resp.StaticLeaseOptions = []StaticLeaseOptions{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleDHCPSetOptions(w http.ResponseWriter, r *http.Request) {
+	req := dhcpOptionsJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = s.setOptions(req.Options, req.StaticLeaseOptions)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "Invalid DHCP options: %s", err)
+		return
+	}
+	s.conf.ConfigModified()
+}
+
 func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	err := s.Stop()
 	if err != nil {
@@ -310,10 +357,12 @@ func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	s.conf = ServerConfig{}
 	s.conf.LeaseDuration = 86400
 	s.conf.ICMPTimeout = 1000
+	s.conf.LocalDomainName = "lan"
 	s.conf.WorkDir = oldconf.WorkDir
 	s.conf.HTTPRegister = oldconf.HTTPRegister
 	s.conf.ConfigModified = oldconf.ConfigModified
 	s.conf.DBFilePath = oldconf.DBFilePath
+	_ = s.setOptions(nil, nil)
 	s.conf.ConfigModified()
 }
 
@@ -325,4 +374,8 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister("POST", "/control/dhcp/add_static_lease", s.handleDHCPAddStaticLease)
 	s.conf.HTTPRegister("POST", "/control/dhcp/remove_static_lease", s.handleDHCPRemoveStaticLease)
 	s.conf.HTTPRegister("POST", "/control/dhcp/reset", s.handleReset)
+	s.conf.HTTPRegister("GET", "/control/dhcp/options", s.handleDHCPOptions)
+	s.conf.HTTPRegister("POST", "/control/dhcp/options/set", s.handleDHCPSetOptions)
+	s.conf.HTTPRegister("GET", "/control/dhcp/leases/export", s.handleDHCPExportLeases)
+	s.conf.HTTPRegister("POST", "/control/dhcp/leases/import", s.handleDHCPImportLeases)
 }
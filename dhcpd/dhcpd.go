@@ -45,6 +45,23 @@ type ServerConfig struct {
 	// 0: disable
 	ICMPTimeout uint32 `json:"icmp_timeout_msec" yaml:"icmp_timeout_msec"`
 
+	// The host names of DHCP clients are resolved by DNS server in this domain ("host.lan").
+	// It's also sent to the clients in "Domain Name" option.
+	// "": disabled
+	LocalDomainName string `json:"local_domain_name" yaml:"local_domain_name"`
+
+	// The subnets which are served via DHCP relay agents
+	RelaySubnets []RelaySubnet `json:"relay_subnets" yaml:"relay_subnets"`
+
+	// DHCPv6 and router advertisements.
+	// If DHCPv6 is enabled and range_start is empty, only DHCPv6 is served.
+	Conf6 V6ServerConf `json:"v6" yaml:"dhcpv6"`
+
+	// Custom DHCP options: for all clients and for the clients with static leases.
+	// They are configured via /control/dhcp/options API.
+	Options            []DHCPOption         `json:"-" yaml:"options"`
+	StaticLeaseOptions []StaticLeaseOptions `json:"-" yaml:"static_lease_options"`
+
 	WorkDir    string `json:"-" yaml:"-"`
 	DBFilePath string `json:"-" yaml:"-"` // path to DB file
 
@@ -63,6 +80,7 @@ const (
 	LeaseChangedAddedStatic
 	LeaseChangedRemovedStatic
 	LeaseChangedBlacklisted
+	LeaseChangedReleased
 )
 
 // Server - the current state of the DHCP server
@@ -84,13 +102,24 @@ type Server struct {
 	leaseTime    time.Duration // parsed from config LeaseDuration
 	leaseOptions dhcp4.Options // parsed from config GatewayIP and SubnetMask
 
+	// custom options
+	options     dhcp4.Options            // parsed from config Options
+	leaseOpts   map[string]dhcp4.Options // MAC -> options;  parsed from config StaticLeaseOptions
+	optionsLock sync.RWMutex
+
+	relays []*addrPool // parsed from config RelaySubnets
+
 	// IP address pool -- if entry is in the pool, then it's attached to a lease
 	IPpool map[[4]byte]net.HardwareAddr
 
+	v6 v6Server // DHCPv6 server
+
 	conf ServerConfig
 
 	// Called when the leases DB is modified
-	onLeaseChanged onLeaseChangedT
+	onLeaseChanged []onLeaseChangedT
+
+	standby int32 // 1: don't answer DHCP requests (see SetStandby)
 }
 
 // Print information about the available network interfaces
@@ -114,8 +143,13 @@ func Create(config ServerConfig) *Server {
 	s := Server{}
 	s.conf = config
 	s.conf.DBFilePath = filepath.Join(config.WorkDir, dbFilename)
+	err := s.setOptions(config.Options, config.StaticLeaseOptions)
+	if err != nil {
+		log.Error("DHCP: custom options: %s", err)
+		return nil
+	}
 	if s.conf.Enabled {
-		err := s.setConfig(config)
+		err = s.setConfig(config)
 		if err != nil {
 			log.Error("DHCP: %s", err)
 			return nil
@@ -140,16 +174,43 @@ func (s *Server) Init(config ServerConfig) error {
 	return nil
 }
 
-// SetOnLeaseChanged - set callback
+// Reconfigure - stop the server, apply the new settings (including custom options)
+// and start the server again if it's enabled
+func (s *Server) Reconfigure(config ServerConfig) error {
+	err := s.Stop()
+	if err != nil {
+		log.Error("DHCP: stop: %s", err)
+	}
+
+	if config.Enabled {
+		err = s.setConfig(config)
+		if err != nil {
+			return err
+		}
+	} else {
+		s.applyConfig(config)
+	}
+
+	err = s.setOptions(config.Options, config.StaticLeaseOptions)
+	if err != nil {
+		return fmt.Errorf("options: %s", err)
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+	return s.Start()
+}
+
+// SetOnLeaseChanged - add callback
 func (s *Server) SetOnLeaseChanged(onLeaseChanged onLeaseChangedT) {
-	s.onLeaseChanged = onLeaseChanged
+	s.onLeaseChanged = append(s.onLeaseChanged, onLeaseChanged)
 }
 
 func (s *Server) notify(flags int) {
-	if s.onLeaseChanged == nil {
-		return
+	for _, f := range s.onLeaseChanged {
+		f(flags)
 	}
-	s.onLeaseChanged(flags)
 }
 
 // WriteDiskConfig - write configuration
@@ -164,6 +225,17 @@ func (s *Server) setConfig(config ServerConfig) error {
 		return wrapErrPrint(err, "Couldn't find interface by name %s", config.InterfaceName)
 	}
 
+	err = s.setConfigV6(iface, config.Conf6)
+	if err != nil {
+		return err
+	}
+	if config.Conf6.Enabled && len(config.RangeStart) == 0 {
+		// DHCPv6 only
+		s.ipnet = nil
+		s.applyConfig(config)
+		return nil
+	}
+
 	// get ipv4 address of an interface
 	s.ipnet = getIfaceIPv4(iface)
 	if s.ipnet == nil {
@@ -208,23 +280,49 @@ func (s *Server) setConfig(config ServerConfig) error {
 		dhcp4.OptionRouter:           router,
 		dhcp4.OptionDomainNameServer: s.ipnet.IP,
 	}
+	domain := strings.Trim(config.LocalDomainName, ".")
+	if len(domain) != 0 {
+		s.leaseOptions[dhcp4.OptionDomainName] = []byte(domain)
+	}
+
+	s.relays, err = s.parseRelaySubnets(config.RelaySubnets, domain)
+	if err != nil {
+		return wrapErrPrint(err, "DHCP")
+	}
+
+	s.applyConfig(config)
+	return nil
+}
 
+// Set the new configuration, keeping the fields which aren't set by user
+func (s *Server) applyConfig(config ServerConfig) {
 	oldconf := s.conf
 	s.conf = config
 	s.conf.WorkDir = oldconf.WorkDir
 	s.conf.HTTPRegister = oldconf.HTTPRegister
 	s.conf.ConfigModified = oldconf.ConfigModified
 	s.conf.DBFilePath = oldconf.DBFilePath
-	return nil
+	s.conf.Options = oldconf.Options
+	s.conf.StaticLeaseOptions = oldconf.StaticLeaseOptions
 }
 
 // Start will listen on port 67 and serve DHCP requests.
+// DHCPv6 server is started on port 547 if it's enabled.
 func (s *Server) Start() error {
 
 	// TODO: don't close if interface and addresses are the same
 	if s.conn != nil {
 		s.closeConn()
 	}
+	s.stopV6()
+
+	err := s.startV6()
+	if err != nil {
+		return err
+	}
+	if s.ipnet == nil {
+		return nil // DHCPv6 only
+	}
 
 	iface, err := net.InterfaceByName(s.conf.InterfaceName)
 	if err != nil {
@@ -236,6 +334,10 @@ func (s *Server) Start() error {
 		return wrapErrPrint(err, "Couldn't start listening socket on 0.0.0.0:67")
 	}
 	log.Info("DHCP: listening on 0.0.0.0:67")
+	if len(s.relays) != 0 {
+		c.isRelayed = s.isRelayedIP
+		log.Info("DHCP: serving relay subnets: %s", s.relayNames())
+	}
 
 	s.conn = c
 	s.cond = sync.NewCond(&s.mutex)
@@ -257,6 +359,8 @@ func (s *Server) Start() error {
 
 // Stop closes the listening UDP socket
 func (s *Server) Stop() error {
+	s.stopV6()
+
 	if s.conn == nil {
 		// nothing to do, return silently
 		return nil
@@ -303,12 +407,17 @@ func (s *Server) reserveLease(p dhcp4.Packet) (*Lease, error) {
 
 	log.Tracef("Lease not found for %s: creating new one", hwaddr)
 
+	pool := s.findPool(p)
+	if pool == nil {
+		return nil, fmt.Errorf("unknown relay agent %s", p.GIAddr())
+	}
+
 	s.leasesLock.Lock()
 	defer s.leasesLock.Unlock()
 
-	ip, err := s.findFreeIP(hwaddr)
+	ip, err := s.findFreeIP(pool, hwaddr)
 	if err != nil {
-		i := s.findExpiredLease()
+		i := s.findExpiredLease(pool)
 		if i < 0 {
 			return nil, wrapErrPrint(err, "Couldn't find free IP for the lease %s", hwaddr.String())
 		}
@@ -340,22 +449,23 @@ func (s *Server) findLease(p dhcp4.Packet) *Lease {
 	return nil
 }
 
-// Find an expired lease and return its index or -1
-func (s *Server) findExpiredLease() int {
+// Find an expired lease within the range of the subnet and return its index or -1
+func (s *Server) findExpiredLease(pool *addrPool) int {
 	now := time.Now().Unix()
 	for i, lease := range s.leases {
-		if lease.Expiry.Unix() <= now && lease.Expiry.Unix() != leaseExpireStatic {
+		if lease.Expiry.Unix() <= now && lease.Expiry.Unix() != leaseExpireStatic &&
+			ipInRange(pool.leaseStart, pool.leaseStop, lease.IP) {
 			return i
 		}
 	}
 	return -1
 }
 
-func (s *Server) findFreeIP(hwaddr net.HardwareAddr) (net.IP, error) {
+func (s *Server) findFreeIP(pool *addrPool, hwaddr net.HardwareAddr) (net.IP, error) {
 	// go from start to end, find unreserved IP
 	var foundIP net.IP
-	for i := 0; i < dhcp4.IPRange(s.leaseStart, s.leaseStop); i++ {
-		newIP := dhcp4.IPAdd(s.leaseStart, i)
+	for i := 0; i < dhcp4.IPRange(pool.leaseStart, pool.leaseStop); i++ {
+		newIP := dhcp4.IPAdd(pool.leaseStart, i)
 		foundHWaddr := s.findReservedHWaddr(newIP)
 		log.Tracef("tried IP %v, got hwaddr %v", newIP, foundHWaddr)
 		if foundHWaddr != nil && len(foundHWaddr) != 0 {
@@ -398,6 +508,9 @@ func (s *Server) unreserveIP(ip net.IP) {
 
 // ServeDHCP handles an incoming DHCP request
 func (s *Server) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	if s.isStandby() {
+		return nil
+	}
 	s.printLeases()
 
 	switch msgType {
@@ -507,7 +620,24 @@ func (s *Server) handleDiscover(p dhcp4.Packet, options dhcp4.Options) dhcp4.Pac
 		return nil
 	}
 
+	pool := s.findPool(p)
+	if pool == nil {
+		log.Debug("DHCP: unknown relay agent %s", p.GIAddr())
+		return nil
+	}
+
 	lease = s.findLease(p)
+	if lease != nil && !s.leaseInPool(pool, lease) {
+		if lease.Expiry.Unix() == leaseExpireStatic {
+			log.Debug("DHCP: static lease %s for %s is outside of the client's subnet", lease.IP, lease.HWAddr)
+			return nil
+		}
+		// the client has moved to another subnet
+		s.leasesLock.Lock()
+		_ = s.rmDynamicLeaseWithIP(lease.IP)
+		s.leasesLock.Unlock()
+		lease = nil
+	}
 	for lease == nil {
 		lease, err = s.reserveLease(p)
 		if err != nil {
@@ -524,7 +654,7 @@ func (s *Server) handleDiscover(p dhcp4.Packet, options dhcp4.Options) dhcp4.Pac
 		break
 	}
 
-	opt := s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+	opt := s.replyOptions(pool, lease).SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
 	reply := dhcp4.ReplyPacket(p, dhcp4.Offer, s.ipnet.IP, lease.IP, s.leaseTime, opt)
 	log.Tracef("Replying with offer: offered IP %v for %v with options %+v", lease.IP, s.leaseTime, reply.ParseOptions())
 	return reply
@@ -547,6 +677,12 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 		return nil // Message not for this dhcp server
 	}
 
+	pool := s.findPool(p)
+	if pool == nil {
+		log.Debug("DHCP: unknown relay agent %s", p.GIAddr())
+		return nil
+	}
+
 	if reqIP == nil {
 		reqIP = p.CIAddr()
 
@@ -567,6 +703,11 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, nil)
 	}
 
+	if !s.leaseInPool(pool, lease) {
+		log.Tracef("Lease %s for %s is outside of the client's subnet", lease.IP, lease.HWAddr)
+		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, nil)
+	}
+
 	if lease.Expiry.Unix() != leaseExpireStatic {
 		lease.Expiry = time.Now().Add(s.leaseTime)
 		s.leasesLock.Lock()
@@ -576,7 +717,7 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 	}
 	log.Tracef("Replying with ACK.  IP: %s  HW: %s  Expire: %s",
 		lease.IP, lease.HWAddr, lease.Expiry)
-	opt := s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+	opt := s.replyOptions(pool, lease).SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
 	return dhcp4.ReplyPacket(p, dhcp4.ACK, s.ipnet.IP, lease.IP, s.leaseTime, opt)
 }
 
@@ -591,6 +732,18 @@ func (s *Server) handleRelease(p dhcp4.Packet, options dhcp4.Options) dhcp4.Pack
 	log.Tracef("Message from client: Release.  IP: %s  HW: %s",
 		p.CIAddr(), p.CHAddr())
 
+	s.leasesLock.Lock()
+	lease := s.findLease(p)
+	if lease == nil || !lease.IP.Equal(p.CIAddr()) ||
+		lease.Expiry.Unix() == leaseExpireStatic {
+		s.leasesLock.Unlock()
+		return nil
+	}
+	// the lease expires now:  its IP address may be given to another client
+	lease.Expiry = time.Now()
+	s.dbStore()
+	s.leasesLock.Unlock()
+	s.notify(LeaseChangedReleased)
 	return nil
 }
 
@@ -709,6 +862,11 @@ func (s *Server) Leases(flags int) []Lease {
 			result = append(result, *lease)
 		}
 	}
+	for _, lease := range s.v6.leases {
+		if (flags&LeasesDynamic) != 0 && lease.Expiry.Unix() > now {
+			result = append(result, *lease)
+		}
+	}
 	s.leasesLock.RUnlock()
 
 	return result
@@ -745,6 +903,11 @@ func (s *Server) FindMACbyIP(ip net.IP) net.HardwareAddr {
 
 	ip4 := ip.To4()
 	if ip4 == nil {
+		for _, l := range s.v6.leases {
+			if l.IP.Equal(ip) && l.Expiry.Unix() > now {
+				return l.HWAddr
+			}
+		}
 		return nil
 	}
 
@@ -763,6 +926,7 @@ func (s *Server) FindMACbyIP(ip net.IP) net.HardwareAddr {
 func (s *Server) reset() {
 	s.leasesLock.Lock()
 	s.leases = nil
+	s.v6.leases = nil
 	s.IPpool = make(map[[4]byte]net.HardwareAddr)
 	s.leasesLock.Unlock()
 }
@@ -4,20 +4,29 @@ import (
 	"net"
 
 	"github.com/joomcode/errorx"
+	"github.com/krolaw/dhcp4"
 	"golang.org/x/net/ipv4"
 )
 
 // filterConn listens to 0.0.0.0:67, but accepts packets only from specific interface
 // This is necessary for DHCP daemon to work, since binding to IP address doesn't
 // us access to see Discover/Request packets from clients.
+// Packets from relay agents are accepted from any interface.
 //
 // TODO: on windows, controlmessage does not work, try to find out another way
 // https://github.com/golang/net/blob/master/ipv4/payload.go#L13
 type filterConn struct {
 	iface net.Interface
 	conn  *ipv4.PacketConn
+
+	// Return TRUE if the address belongs to a subnet behind a relay agent
+	// nil: relay agents aren't used
+	isRelayed func(ip net.IP) bool
 }
 
+// Minimal length of DHCP packet (the fixed part and the magic cookie)
+const minPacketLen = 240
+
 func newFilterConn(iface net.Interface, address string) (*filterConn, error) {
 	c, err := net.ListenPacket("udp4", address)
 	if err != nil {
@@ -47,11 +56,30 @@ func (f *filterConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		if cm.IfIndex == f.iface.Index {
 			return n, addr, nil
 		}
+		if f.isRelayed != nil && n >= minPacketLen {
+			p := dhcp4.Packet(b[:n])
+			if !p.GIAddr().Equal(net.IPv4zero) || f.isRelayed(p.CIAddr()) {
+				return n, addr, nil
+			}
+		}
 		// packet doesn't match criteria, drop it
 	}
 }
 
 func (f *filterConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if f.isRelayed != nil && len(b) >= minPacketLen {
+		p := dhcp4.Packet(b)
+		giaddr := p.GIAddr()
+		if !giaddr.Equal(net.IPv4zero) {
+			// the reply is sent to the relay agent, which is reachable via any interface
+			return f.conn.WriteTo(b, nil, &net.UDPAddr{IP: giaddr, Port: 67})
+		}
+		if f.isRelayed(p.YIAddr()) {
+			// the client renews its lease directly
+			return f.conn.WriteTo(b, nil, addr)
+		}
+	}
+
 	cm := ipv4.ControlMessage{
 		IfIndex: f.iface.Index,
 	}
@@ -0,0 +1,135 @@
+// Host names of DHCP clients in the local domain
+
+package dhcpd
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+)
+
+// Convert the host name received from the client to a DNS label:
+// "John's iPhone" -> "john-s-iphone", "host.example.org" -> "host"
+// "": the host name can't be used
+func hostLabel(hostname string) string {
+	i := strings.IndexByte(hostname, '.')
+	if i >= 0 {
+		hostname = hostname[:i]
+	}
+	label := []byte(strings.ToLower(hostname))
+	for i, c := range label {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			label[i] = '-'
+		}
+	}
+	s := strings.Trim(string(label), "-")
+	if len(s) > 63 {
+		s = strings.TrimRight(s[:63], "-")
+	}
+	return s
+}
+
+// Get the active leases with this host name.
+// If several clients have the same host name, the static lease is used, otherwise the most recent one.
+func (s *Server) findLeasesByHost(label string, now int64) []*Lease {
+	var found *Lease
+	for _, l := range s.leases {
+		static := l.Expiry.Unix() == leaseExpireStatic
+		if !static && l.Expiry.Unix() <= now {
+			continue
+		}
+		if hostLabel(l.Hostname) != label {
+			continue
+		}
+		if found == nil || static ||
+			(found.Expiry.Unix() != leaseExpireStatic && l.Expiry.After(found.Expiry)) {
+			found = l
+		}
+	}
+
+	var r []*Lease
+	if found != nil {
+		r = append(r, found)
+	}
+	// DHCPv6 lease of the same client
+	for _, l := range s.v6.leases {
+		if l.Expiry.Unix() <= now || hostLabel(l.Hostname) != label {
+			continue
+		}
+		if found == nil || bytes.Equal(found.HWAddr, l.HWAddr) {
+			r = append(r, l)
+			break
+		}
+	}
+	return r
+}
+
+// Get the local domain suffix: ".lan."  "": DNS registration is disabled.
+func (s *Server) localDomainSuffix() string {
+	if !s.conf.Enabled || len(s.conf.LocalDomainName) == 0 {
+		return ""
+	}
+	return "." + strings.Trim(strings.ToLower(s.conf.LocalDomainName), ".") + "."
+}
+
+// LookupHost returns the addresses of the DHCP client with the host name in the local domain ("host.lan.").
+// ok: the host is known.
+func (s *Server) LookupHost(fqdn string) (ips []net.IP, ok bool) {
+	suffix := s.localDomainSuffix()
+	fqdn = strings.ToLower(fqdn)
+	if len(suffix) == 0 || !strings.HasSuffix(fqdn, suffix) {
+		return nil, false
+	}
+	label := fqdn[:len(fqdn)-len(suffix)]
+	if len(label) == 0 || strings.Contains(label, ".") {
+		return nil, false
+	}
+
+	s.leasesLock.RLock()
+	leases := s.findLeasesByHost(label, time.Now().Unix())
+	s.leasesLock.RUnlock()
+	for _, l := range leases {
+		ips = append(ips, l.IP)
+	}
+	return ips, len(ips) != 0
+}
+
+// LookupAddr returns the host name in the local domain ("host.lan.") of the DHCP client with this address.
+// "": not found
+func (s *Server) LookupAddr(ip net.IP) string {
+	suffix := s.localDomainSuffix()
+	if len(suffix) == 0 {
+		return ""
+	}
+
+	now := time.Now().Unix()
+	s.leasesLock.RLock()
+	defer s.leasesLock.RUnlock()
+
+	leases := s.leases
+	ip4 := ip.To4()
+	if ip4 == nil {
+		leases = s.v6.leases
+	} else {
+		ip = ip4
+	}
+	for _, l := range leases {
+		if !l.IP.Equal(ip) ||
+			(l.Expiry.Unix() <= now && l.Expiry.Unix() != leaseExpireStatic) {
+			continue
+		}
+		label := hostLabel(l.Hostname)
+		if len(label) == 0 {
+			return ""
+		}
+		// the name must resolve back to this address
+		for _, hl := range s.findLeasesByHost(label, now) {
+			if hl == l {
+				return label + suffix
+			}
+		}
+		return ""
+	}
+	return ""
+}
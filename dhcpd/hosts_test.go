@@ -0,0 +1,75 @@
+package dhcpd
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostLabel(t *testing.T) {
+	assert.Equal(t, "john-s-iphone", hostLabel("John's iPhone"))
+	assert.Equal(t, "host", hostLabel("host.example.org"))
+	assert.Equal(t, "", hostLabel("---"))
+	assert.Equal(t, "", hostLabel(""))
+}
+
+func TestLookupHost(t *testing.T) {
+	s := Server{}
+	s.conf.DBFilePath = dbFilename
+	defer func() { _ = os.Remove(dbFilename) }()
+	s.reset()
+	s.conf.Enabled = true
+	s.conf.LocalDomainName = "lan"
+
+	now := time.Now()
+	mac1 := net.HardwareAddr{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+	mac2 := net.HardwareAddr{0xbb, 0xbb, 0xbb, 0xbb, 0xbb, 0xbb}
+	s.leases = []*Lease{
+		{HWAddr: mac1, IP: net.IP{192, 168, 0, 10}, Hostname: "NAS", Expiry: now.Add(time.Hour)},
+		{HWAddr: mac2, IP: net.IP{192, 168, 0, 11}, Hostname: "nas", Expiry: now.Add(2 * time.Hour)},
+		{HWAddr: net.HardwareAddr{0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc}, IP: net.IP{192, 168, 0, 12}, Hostname: "old", Expiry: now.Add(-time.Hour)},
+	}
+	s.v6.leases = []*Lease{
+		{HWAddr: mac2, IP: net.ParseIP("fd00::11"), Hostname: "nas", Expiry: now.Add(time.Hour)},
+	}
+
+	// the most recent lease is used
+	ips, ok := s.LookupHost("NAS.lan.")
+	assert.True(t, ok)
+	assert.Equal(t, []net.IP{{192, 168, 0, 11}, net.ParseIP("fd00::11")}, ips)
+	assert.Equal(t, "nas.lan.", s.LookupAddr(net.ParseIP("192.168.0.11")))
+	assert.Equal(t, "nas.lan.", s.LookupAddr(net.ParseIP("fd00::11")))
+	assert.Equal(t, "", s.LookupAddr(net.ParseIP("192.168.0.10")))
+
+	// the static lease has a priority
+	s.leases[0].Expiry = time.Unix(leaseExpireStatic, 0)
+	ips, _ = s.LookupHost("nas.lan.")
+	assert.Equal(t, []net.IP{{192, 168, 0, 10}}, ips)
+
+	// expired lease
+	_, ok = s.LookupHost("old.lan.")
+	assert.False(t, ok)
+	assert.Equal(t, "", s.LookupAddr(net.ParseIP("192.168.0.12")))
+
+	// another domain
+	_, ok = s.LookupHost("nas.example.org.")
+	assert.False(t, ok)
+	_, ok = s.LookupHost("x.nas.lan.")
+	assert.False(t, ok)
+
+	// the name disappears when the lease is released
+	s.reserveIP(s.leases[1].IP, mac2)
+	p := dhcp4.NewPacket(dhcp4.BootRequest)
+	p.SetCHAddr(mac2)
+	p.SetCIAddr(net.IP{192, 168, 0, 11})
+	s.handleRelease(p, dhcp4.Options{})
+	assert.Equal(t, "", s.LookupAddr(net.ParseIP("192.168.0.11")))
+
+	s.conf.LocalDomainName = ""
+	_, ok = s.LookupHost("nas.lan.")
+	assert.False(t, ok)
+}
@@ -0,0 +1,479 @@
+// Export of DHCP leases and bulk import of static leases
+
+package dhcpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const maxImportSize = 4 * 1024 * 1024
+
+// importedLease is a static lease read from the imported file
+type importedLease struct {
+	Line     int    `json:"line"` // line number in the imported file
+	HWAddr   string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Error    string `json:"error,omitempty"` // the reason why the lease is skipped
+}
+
+// importResult is the result of static leases import
+type importResult struct {
+	Added   int             `json:"added"`
+	Skipped []importedLease `json:"skipped"`
+}
+
+// Parse JSON array of static leases: [{"mac":"...","ip":"...","hostname":"..."}]
+func parseLeasesJSON(data []byte) ([]importedLease, error) {
+	var leases []importedLease
+	err := json.Unmarshal(data, &leases)
+	if err != nil {
+		return nil, err
+	}
+	for i := range leases {
+		leases[i].Line = i + 1
+		leases[i].Error = ""
+	}
+	return leases, nil
+}
+
+// Parse CSV file: "mac,ip,hostname" records, other fields are ignored.
+// The first line is skipped if it's a header.
+func parseLeasesCSV(data []byte) ([]importedLease, error) {
+	var leases []importedLease
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for sc.Scan() {
+		line++
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+		r := csv.NewReader(strings.NewReader(s))
+		r.TrimLeadingSpace = true
+		rec, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("line %d: expected at least 2 fields", line)
+		}
+		if len(leases) == 0 && strings.EqualFold(rec[0], "mac") {
+			continue
+		}
+		l := importedLease{Line: line, HWAddr: rec[0], IP: rec[1]}
+		if len(rec) > 2 {
+			l.Hostname = rec[2]
+		}
+		leases = append(leases, l)
+	}
+	return leases, sc.Err()
+}
+
+// Return TRUE if the string is dnsmasq lease time, e.g. "3600", "45m", "12h"
+func isLeaseTime(s string) bool {
+	s = strings.TrimRight(s, "smhdw")
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse dnsmasq files:
+// . leases file: "<expiry> <mac> <ip> <hostname|*> <client-id|*>"
+// . configuration: "dhcp-host=<mac>,<ip>,<hostname>[,<lease time>]"
+func parseLeasesDnsmasq(data []byte) ([]importedLease, error) {
+	var leases []importedLease
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for sc.Scan() {
+		line++
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		if strings.HasPrefix(s, "dhcp-host=") {
+			l := importedLease{Line: line}
+			for _, f := range strings.Split(s[len("dhcp-host="):], ",") {
+				f = strings.TrimSpace(f)
+				_, err := net.ParseMAC(f)
+				switch {
+				case err == nil:
+					l.HWAddr = f
+				case net.ParseIP(f) != nil:
+					l.IP = f
+				case strings.Contains(f, ":") || f == "ignore":
+					// tag, client ID, IPv6 address
+				case isLeaseTime(f) || f == "infinite":
+					// lease time
+				case len(l.Hostname) == 0:
+					l.Hostname = f
+				}
+			}
+			leases = append(leases, l)
+			continue
+		}
+
+		if strings.Contains(s, "=") || strings.HasPrefix(s, "duid ") {
+			continue // other configuration settings, DUID of the server
+		}
+		f := strings.Fields(s)
+		if len(f) < 4 {
+			return nil, fmt.Errorf("line %d: invalid dnsmasq lease", line)
+		}
+		l := importedLease{Line: line, HWAddr: f[1], IP: f[2]}
+		if f[3] != "*" {
+			l.Hostname = f[3]
+		}
+		leases = append(leases, l)
+	}
+	return leases, sc.Err()
+}
+
+type iscToken struct {
+	line int
+	text string
+}
+
+// Split ISC configuration into tokens: words, quoted strings, '{', '}', ';'
+func iscTokens(data []byte) ([]iscToken, error) {
+	var tokens []iscToken
+	line := 1
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, iscToken{line: line, text: string(c)})
+			i++
+		case c == '"':
+			j := bytes.IndexByte(data[i+1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			tokens = append(tokens, iscToken{line: line, text: string(data[i+1 : i+1+j])})
+			line += bytes.Count(data[i+1:i+1+j], []byte{'\n'})
+			i += j + 2
+		default:
+			j := i
+			for j < len(data) && bytes.IndexByte([]byte(" \t\r\n{};\"#"), data[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, iscToken{line: line, text: string(data[i:j])})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// Parse ISC DHCP server files:
+// . leases file: "lease <ip> { hardware ethernet <mac>; client-hostname "<hostname>"; }"
+// . configuration: "host <name> { hardware ethernet <mac>; fixed-address <ip>; }"
+// Only the last active lease for each IP address is used.
+func parseLeasesISC(data []byte) ([]importedLease, error) {
+	tokens, err := iscTokens(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []importedLease
+	index := map[string]int{} // IP -> index in leases
+	for i := 0; i < len(tokens); i++ {
+		decl := tokens[i].text
+		if (decl != "lease" && decl != "host") || i+2 >= len(tokens) || tokens[i+2].text != "{" {
+			continue
+		}
+
+		l := importedLease{Line: tokens[i].line}
+		active := true
+		if decl == "lease" {
+			l.IP = tokens[i+1].text
+		} else {
+			l.Hostname = tokens[i+1].text
+		}
+
+		// read the statements of the block
+		i += 3
+		var st []string
+		for ; i < len(tokens) && tokens[i].text != "}"; i++ {
+			if tokens[i].text != ";" {
+				st = append(st, tokens[i].text)
+				continue
+			}
+			switch {
+			case len(st) == 3 && st[0] == "hardware" && st[1] == "ethernet":
+				l.HWAddr = st[2]
+			case len(st) == 2 && st[0] == "fixed-address":
+				l.IP = st[1]
+			case len(st) == 2 && (st[0] == "client-hostname" || st[0] == "ddns-hostname"):
+				l.Hostname = st[1]
+			case len(st) == 3 && st[0] == "option" && st[1] == "host-name":
+				l.Hostname = st[2]
+			case len(st) == 3 && st[0] == "binding" && st[1] == "state":
+				active = (st[2] == "active")
+			}
+			st = nil
+		}
+		if i == len(tokens) {
+			return nil, fmt.Errorf("line %d: unterminated block", l.Line)
+		}
+
+		if decl == "host" {
+			leases = append(leases, l)
+			continue
+		}
+		if !active {
+			l.Error = "inactive"
+		}
+		n, ok := index[l.IP]
+		if ok {
+			leases[n] = l
+			continue
+		}
+		index[l.IP] = len(leases)
+		leases = append(leases, l)
+	}
+
+	// remove inactive leases
+	r := []importedLease{}
+	for _, l := range leases {
+		if len(l.Error) == 0 {
+			r = append(r, l)
+		}
+	}
+	return r, nil
+}
+
+func parseImportedLeases(format string, data []byte) ([]importedLease, error) {
+	switch format {
+	case "", "json":
+		return parseLeasesJSON(data)
+	case "csv":
+		return parseLeasesCSV(data)
+	case "dnsmasq":
+		return parseLeasesDnsmasq(data)
+	case "isc":
+		return parseLeasesISC(data)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// Check the host name: letters, digits, '-', '_', '.'
+func isValidHostname(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+	for _, c := range host {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the imported leases and add them as static leases.
+// The leases that can't be added (invalid data, conflicts with the existing static leases
+// and with the other imported leases) are skipped.
+// A dynamic lease with the same IP address is replaced.
+// dryRun: only check the leases
+func (s *Server) importStaticLeases(imported []importedLease, dryRun bool) importResult {
+	res := importResult{Skipped: []importedLease{}}
+	skip := func(l importedLease, format string, args ...interface{}) {
+		l.Error = fmt.Sprintf(format, args...)
+		res.Skipped = append(res.Skipped, l)
+	}
+
+	s.leasesLock.Lock()
+
+	staticMACs := map[string]*Lease{}
+	staticIPs := map[string]*Lease{}
+	for _, l := range s.leases {
+		if l.Expiry.Unix() == leaseExpireStatic {
+			staticMACs[l.HWAddr.String()] = l
+			staticIPs[l.IP.String()] = l
+		}
+	}
+
+	importedMACs := map[string]int{} // MAC -> line number
+	importedIPs := map[string]int{}  // IP -> line number
+	var leases []*Lease
+	for _, il := range imported {
+		mac, err := net.ParseMAC(strings.TrimSpace(il.HWAddr))
+		if err != nil || len(mac) != 6 {
+			skip(il, "invalid MAC")
+			continue
+		}
+		ip, err := parseIPv4(strings.TrimSpace(il.IP))
+		if err != nil {
+			skip(il, "invalid IP: %s", err)
+			continue
+		}
+		host := strings.TrimSpace(il.Hostname)
+		if !isValidHostname(host) {
+			skip(il, "invalid hostname")
+			continue
+		}
+		if s.ipnet != nil && !s.ipnet.Contains(ip) {
+			skip(il, "IP is outside of the subnet %s", s.ipnet)
+			continue
+		}
+
+		line, ok := importedMACs[mac.String()]
+		if ok {
+			skip(il, "duplicate MAC (line %d)", line)
+			continue
+		}
+		line, ok = importedIPs[ip.String()]
+		if ok {
+			skip(il, "duplicate IP (line %d)", line)
+			continue
+		}
+
+		sl, ok := staticMACs[mac.String()]
+		if ok {
+			if sl.IP.Equal(ip) {
+				skip(il, "static lease already exists")
+			} else {
+				skip(il, "static lease with this MAC already exists: %s", sl.IP)
+			}
+			continue
+		}
+		sl, ok = staticIPs[ip.String()]
+		if ok {
+			skip(il, "static lease with this IP already exists: %s", sl.HWAddr)
+			continue
+		}
+
+		importedMACs[mac.String()] = il.Line
+		importedIPs[ip.String()] = il.Line
+		leases = append(leases, &Lease{
+			HWAddr:   mac,
+			IP:       ip,
+			Hostname: host,
+			Expiry:   time.Unix(leaseExpireStatic, 0),
+		})
+	}
+	res.Added = len(leases)
+
+	if dryRun || len(leases) == 0 {
+		s.leasesLock.Unlock()
+		return res
+	}
+
+	for _, l := range leases {
+		if s.findReservedHWaddr(l.IP) != nil {
+			_ = s.rmDynamicLeaseWithIP(l.IP)
+		}
+		s.leases = append(s.leases, l)
+		s.reserveIP(l.IP, l.HWAddr)
+	}
+	s.dbStore()
+	s.leasesLock.Unlock()
+
+	log.Info("DHCP: imported %d static leases, skipped %d", res.Added, len(res.Skipped))
+	s.notify(LeaseChangedAddedStatic)
+	return res
+}
+
+// Write the leases in CSV format
+func writeLeasesCSV(w io.Writer, leases []Lease) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"mac", "ip", "hostname", "expires", "static"})
+	for _, l := range leases {
+		static := l.Expiry.Unix() == leaseExpireStatic
+		expires := ""
+		if !static {
+			expires = l.Expiry.Format(time.RFC3339)
+		}
+		_ = cw.Write([]string{l.HWAddr.String(), l.IP.String(), l.Hostname, expires, fmt.Sprintf("%t", static)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (s *Server) handleDHCPExportLeases(w http.ResponseWriter, r *http.Request) {
+	leases := s.Leases(LeasesAll)
+	format := r.URL.Query().Get("format")
+	var err error
+	switch format {
+	case "", "json":
+		data := convertLeases(leases, false)
+		for i, l := range leases {
+			static := l.Expiry.Unix() == leaseExpireStatic
+			data[i]["static"] = fmt.Sprintf("%t", static)
+			if !static {
+				data[i]["expires"] = l.Expiry.Format(time.RFC3339)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=leases.json")
+		err = json.NewEncoder(w).Encode(data)
+
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=leases.csv")
+		err = writeLeasesCSV(w, leases)
+
+	default:
+		httpError(r, w, http.StatusBadRequest, "unknown format %q", format)
+		return
+	}
+	if err != nil {
+		log.Error("DHCP: export leases: %s", err)
+	}
+}
+
+func (s *Server) handleDHCPImportLeases(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxImportSize+1))
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "failed to read request body: %s", err)
+		return
+	}
+	if len(data) > maxImportSize {
+		httpError(r, w, http.StatusBadRequest, "the file is too large")
+		return
+	}
+
+	q := r.URL.Query()
+	imported, err := parseImportedLeases(q.Get("format"), data)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "failed to parse leases: %s", err)
+		return
+	}
+
+	res := s.importStaticLeases(imported, q.Get("dry_run") == "1" || q.Get("dry_run") == "true")
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
@@ -0,0 +1,131 @@
+package dhcpd
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImportedLeases(t *testing.T) {
+	leases, err := parseImportedLeases("json", []byte(`[{"mac":"aa:aa:aa:aa:aa:aa","ip":"192.168.0.10","hostname":"h1"}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, []importedLease{{Line: 1, HWAddr: "aa:aa:aa:aa:aa:aa", IP: "192.168.0.10", Hostname: "h1"}}, leases)
+
+	csvData := `mac,ip,hostname,expires,static
+aa:aa:aa:aa:aa:aa,192.168.0.10,h1,,true
+
+# comment
+"bb:bb:bb:bb:bb:bb", 192.168.0.11`
+	leases, err = parseImportedLeases("csv", []byte(csvData))
+	assert.Nil(t, err)
+	assert.Equal(t, []importedLease{
+		{Line: 2, HWAddr: "aa:aa:aa:aa:aa:aa", IP: "192.168.0.10", Hostname: "h1"},
+		{Line: 5, HWAddr: "bb:bb:bb:bb:bb:bb", IP: "192.168.0.11"},
+	}, leases)
+
+	dnsmasqData := `1580000000 aa:aa:aa:aa:aa:aa 192.168.0.10 h1 01:aa:aa:aa:aa:aa:aa
+1580000000 bb:bb:bb:bb:bb:bb 192.168.0.11 * *
+duid 00:01:00:01:25:00:00:00:aa:aa:aa:aa:aa:aa
+dhcp-host=cc:cc:cc:cc:cc:cc,set:red,h3,192.168.0.12,12h`
+	leases, err = parseImportedLeases("dnsmasq", []byte(dnsmasqData))
+	assert.Nil(t, err)
+	assert.Equal(t, []importedLease{
+		{Line: 1, HWAddr: "aa:aa:aa:aa:aa:aa", IP: "192.168.0.10", Hostname: "h1"},
+		{Line: 2, HWAddr: "bb:bb:bb:bb:bb:bb", IP: "192.168.0.11"},
+		{Line: 4, HWAddr: "cc:cc:cc:cc:cc:cc", IP: "192.168.0.12", Hostname: "h3"},
+	}, leases)
+
+	iscData := `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.0.10 {
+  starts 3 2020/01/01 00:00:00;
+  binding state active;
+  hardware ethernet aa:aa:aa:aa:aa:aa;
+  client-hostname "h1";
+}
+lease 192.168.0.11 {
+  binding state active;
+  hardware ethernet bb:bb:bb:bb:bb:bb;
+}
+lease 192.168.0.11 {
+  binding state free;
+  hardware ethernet bb:bb:bb:bb:bb:bb;
+}
+group {
+  host printer {
+    hardware ethernet cc:cc:cc:cc:cc:cc;
+    fixed-address 192.168.0.12;
+  }
+}`
+	leases, err = parseImportedLeases("isc", []byte(iscData))
+	assert.Nil(t, err)
+	assert.Equal(t, []importedLease{
+		{Line: 2, HWAddr: "aa:aa:aa:aa:aa:aa", IP: "192.168.0.10", Hostname: "h1"},
+		{Line: 17, HWAddr: "cc:cc:cc:cc:cc:cc", IP: "192.168.0.12", Hostname: "printer"},
+	}, leases)
+
+	_, err = parseImportedLeases("isc", []byte("lease 1.2.3.4 {"))
+	assert.NotNil(t, err)
+	_, err = parseImportedLeases("unknown", nil)
+	assert.NotNil(t, err)
+}
+
+func TestImportStaticLeases(t *testing.T) {
+	s := Server{}
+	s.conf.DBFilePath = dbFilename
+	defer func() { _ = os.Remove(dbFilename) }()
+	s.reset()
+	s.ipnet = &net.IPNet{IP: net.IP{192, 168, 0, 1}, Mask: net.CIDRMask(24, 32)}
+
+	assert.Nil(t, s.AddStaticLease(Lease{
+		HWAddr: net.HardwareAddr{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa},
+		IP:     net.IP{192, 168, 0, 10},
+	}))
+	// dynamic lease is replaced
+	dyn := &Lease{
+		HWAddr: net.HardwareAddr{0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0xdd},
+		IP:     net.IP{192, 168, 0, 20},
+		Expiry: time.Now().Add(time.Hour),
+	}
+	s.leases = append(s.leases, dyn)
+	s.reserveIP(dyn.IP, dyn.HWAddr)
+
+	imported := []importedLease{
+		{Line: 1, HWAddr: "aa:aa:aa:aa:aa:aa", IP: "192.168.0.10"},
+		{Line: 2, HWAddr: "aa:aa:aa:aa:aa:aa", IP: "192.168.0.11"},
+		{Line: 3, HWAddr: "bb:bb:bb:bb:bb:bb", IP: "192.168.0.10"},
+		{Line: 4, HWAddr: "invalid", IP: "192.168.0.12"},
+		{Line: 5, HWAddr: "bb:bb:bb:bb:bb:bb", IP: "10.0.0.1"},
+		{Line: 6, HWAddr: "bb:bb:bb:bb:bb:bb", IP: "192.168.0.12", Hostname: "h2"},
+		{Line: 7, HWAddr: "bb:bb:bb:bb:bb:bb", IP: "192.168.0.13"},
+		{Line: 8, HWAddr: "cc:cc:cc:cc:cc:cc", IP: "192.168.0.12"},
+		{Line: 9, HWAddr: "cc:cc:cc:cc:cc:cc", IP: "192.168.0.20", Hostname: "bad host"},
+		{Line: 10, HWAddr: "cc:cc:cc:cc:cc:cc", IP: "192.168.0.20", Hostname: "h3"},
+	}
+
+	res := s.importStaticLeases(imported, true)
+	assert.Equal(t, 2, res.Added)
+	assert.Equal(t, 1, len(s.Leases(LeasesStatic)))
+
+	res = s.importStaticLeases(imported, false)
+	assert.Equal(t, 2, res.Added)
+	lines := []int{}
+	for _, l := range res.Skipped {
+		lines = append(lines, l.Line)
+	}
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 7, 8, 9}, lines)
+	assert.True(t, strings.Contains(res.Skipped[6].Error, "duplicate IP (line 6)"))
+
+	leases := s.Leases(LeasesStatic)
+	assert.Equal(t, 3, len(leases))
+	assert.Equal(t, "h3", leases[2].Hostname)
+	assert.Equal(t, "cc:cc:cc:cc:cc:cc", s.FindMACbyIP(net.IP{192, 168, 0, 20}).String())
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeLeasesCSV(buf, leases[:1]))
+	assert.Equal(t, "mac,ip,hostname,expires,static\naa:aa:aa:aa:aa:aa,192.168.0.10,,,true\n", buf.String())
+}
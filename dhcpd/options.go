@@ -0,0 +1,216 @@
+// Custom DHCP options
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// DHCPOption is a custom DHCPv4 option
+type DHCPOption struct {
+	Code uint8 `json:"code" yaml:"code"`
+
+	// Type of the value:
+	// text: string (e.g. option 66 "TFTP server name", option 67 "Bootfile name")
+	// ip: comma-separated list of IPv4 addresses (e.g. option 42 "NTP servers")
+	// hex: binary data, e.g. "01:04:c0:a8:00:01" (e.g. option 43 "Vendor-specific information")
+	// u8, u16, u32: unsigned integer
+	// bool: "true" or "false"
+	// domains: comma-separated list of domain names (e.g. option 119 "Domain search")
+	Type  string `json:"type" yaml:"type"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// StaticLeaseOptions - custom DHCP options for the static lease with this MAC address
+type StaticLeaseOptions struct {
+	HWAddr  string       `json:"mac" yaml:"mac"`
+	Options []DHCPOption `json:"options" yaml:"options"`
+}
+
+// The options that are set by the server itself and can't be overridden
+var reservedOptions = map[dhcp4.OptionCode]bool{
+	dhcp4.Pad:                          true,
+	dhcp4.End:                          true,
+	dhcp4.OptionRequestedIPAddress:     true,
+	dhcp4.OptionIPAddressLeaseTime:     true,
+	dhcp4.OptionOverload:               true,
+	dhcp4.OptionDHCPMessageType:        true,
+	dhcp4.OptionServerIdentifier:       true,
+	dhcp4.OptionParameterRequestList:   true,
+	dhcp4.OptionMaximumDHCPMessageSize: true,
+	dhcp4.OptionClientIdentifier:       true,
+	dhcp4.OptionRenewalTimeValue:       true,
+	dhcp4.OptionRebindingTimeValue:     true,
+}
+
+// Encode domain names in DNS wire format (RFC 1035 section 3.1) without compression
+func packDomains(value string) ([]byte, error) {
+	var buf []byte
+	for _, d := range strings.Split(value, ",") {
+		d = strings.TrimSuffix(strings.TrimSpace(d), ".")
+		if len(d) == 0 || len(d) > 253 {
+			return nil, fmt.Errorf("invalid domain name %q", d)
+		}
+		for _, label := range strings.Split(d, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %q", d)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+		buf = append(buf, 0)
+	}
+	return buf, nil
+}
+
+// Get the binary data of the option
+func (o DHCPOption) pack() ([]byte, error) {
+	var data []byte
+	switch o.Type {
+	case "text":
+		data = []byte(o.Value)
+
+	case "ip":
+		for _, s := range strings.Split(o.Value, ",") {
+			ip, err := parseIPv4(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, ip...)
+		}
+
+	case "hex":
+		s := strings.NewReplacer(":", "", " ", "").Replace(o.Value)
+		var err error
+		data, err = hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex value: %s", err)
+		}
+
+	case "u8", "u16", "u32":
+		bits, _ := strconv.Atoi(o.Type[1:])
+		n, err := strconv.ParseUint(o.Value, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %s", o.Type, err)
+		}
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(n))
+		data = data[4-bits/8:]
+
+	case "bool":
+		b, err := strconv.ParseBool(o.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bool value: %s", o.Value)
+		}
+		data = []byte{0}
+		if b {
+			data[0] = 1
+		}
+
+	case "domains":
+		var err error
+		data, err = packDomains(o.Value)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown type %q", o.Type)
+	}
+
+	if len(data) > 255 {
+		return nil, fmt.Errorf("value is too long: %d bytes", len(data))
+	}
+	return data, nil
+}
+
+// Convert the list of custom options
+func parseDHCPOptions(opts []DHCPOption) (dhcp4.Options, error) {
+	r := dhcp4.Options{}
+	for _, o := range opts {
+		code := dhcp4.OptionCode(o.Code)
+		if reservedOptions[code] {
+			return nil, fmt.Errorf("option %d can't be overridden", o.Code)
+		}
+		_, ok := r[code]
+		if ok {
+			return nil, fmt.Errorf("duplicate option %d", o.Code)
+		}
+		data, err := o.pack()
+		if err != nil {
+			return nil, fmt.Errorf("option %d: %s", o.Code, err)
+		}
+		r[code] = data
+	}
+	return r, nil
+}
+
+// CheckOptions - check custom options
+func CheckOptions(opts []DHCPOption, leaseOpts []StaticLeaseOptions) error {
+	tmpServer := Server{}
+	return tmpServer.setOptions(opts, leaseOpts)
+}
+
+// Check and set custom options
+func (s *Server) setOptions(opts []DHCPOption, leaseOpts []StaticLeaseOptions) error {
+	options, err := parseDHCPOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	perLease := map[string]dhcp4.Options{}
+	for _, lo := range leaseOpts {
+		mac, err := net.ParseMAC(lo.HWAddr)
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("invalid MAC %q", lo.HWAddr)
+		}
+		_, ok := perLease[mac.String()]
+		if ok {
+			return fmt.Errorf("duplicate options for %s", mac)
+		}
+		perLease[mac.String()], err = parseDHCPOptions(lo.Options)
+		if err != nil {
+			return fmt.Errorf("%s: %s", mac, err)
+		}
+	}
+
+	s.optionsLock.Lock()
+	s.options = options
+	s.leaseOpts = perLease
+	s.conf.Options = opts
+	s.conf.StaticLeaseOptions = leaseOpts
+	s.optionsLock.Unlock()
+	return nil
+}
+
+// Get the options for the reply to the client:
+// the default options of the subnet, overridden by the global custom options,
+// overridden by the custom options of the subnet, overridden by the options of the static lease
+func (s *Server) replyOptions(pool *addrPool, lease *Lease) dhcp4.Options {
+	r := dhcp4.Options{}
+	for code, data := range pool.options {
+		r[code] = data
+	}
+
+	s.optionsLock.RLock()
+	for code, data := range s.options {
+		r[code] = data
+	}
+	for code, data := range pool.custom {
+		r[code] = data
+	}
+	if lease.Expiry.Unix() == leaseExpireStatic {
+		for code, data := range s.leaseOpts[lease.HWAddr.String()] {
+			r[code] = data
+		}
+	}
+	s.optionsLock.RUnlock()
+	return r
+}
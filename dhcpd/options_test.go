@@ -0,0 +1,86 @@
+package dhcpd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDHCPOptionPack(t *testing.T) {
+	data, err := DHCPOption{Code: 66, Type: "text", Value: "tftp.lan"}.pack()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("tftp.lan"), data)
+
+	data, err = DHCPOption{Code: 42, Type: "ip", Value: "192.168.0.1, 192.168.0.2"}.pack()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{192, 168, 0, 1, 192, 168, 0, 2}, data)
+
+	data, err = DHCPOption{Code: 43, Type: "hex", Value: "01:04:c0:a8:00:01"}.pack()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 4, 192, 168, 0, 1}, data)
+
+	data, err = DHCPOption{Code: 26, Type: "u16", Value: "1400"}.pack()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x05, 0x78}, data)
+
+	data, err = DHCPOption{Code: 19, Type: "bool", Value: "true"}.pack()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, data)
+
+	data, err = DHCPOption{Code: 119, Type: "domains", Value: "lan,example.org."}.pack()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("\x03lan\x00\x07example\x03org\x00"), data)
+
+	_, err = DHCPOption{Code: 26, Type: "u8", Value: "256"}.pack()
+	assert.NotNil(t, err)
+	_, err = DHCPOption{Code: 42, Type: "ip", Value: "::1"}.pack()
+	assert.NotNil(t, err)
+	_, err = DHCPOption{Code: 119, Type: "domains", Value: "a..b"}.pack()
+	assert.NotNil(t, err)
+	_, err = DHCPOption{Code: 43, Type: "unknown"}.pack()
+	assert.NotNil(t, err)
+}
+
+func TestDHCPOptions(t *testing.T) {
+	s := Server{}
+	s.leaseOptions = dhcp4.Options{
+		dhcp4.OptionRouter:           []byte{192, 168, 0, 1},
+		dhcp4.OptionDomainNameServer: []byte{192, 168, 0, 1},
+	}
+
+	// reserved and duplicate options
+	assert.NotNil(t, s.setOptions([]DHCPOption{{Code: 51, Type: "u32", Value: "60"}}, nil))
+	assert.NotNil(t, s.setOptions([]DHCPOption{
+		{Code: 66, Type: "text", Value: "a"},
+		{Code: 66, Type: "text", Value: "b"},
+	}, nil))
+	assert.NotNil(t, s.setOptions(nil, []StaticLeaseOptions{{HWAddr: "invalid"}}))
+
+	err := s.setOptions([]DHCPOption{
+		{Code: 6, Type: "ip", Value: "192.168.0.2"},
+		{Code: 66, Type: "text", Value: "tftp.lan"},
+	}, []StaticLeaseOptions{{
+		HWAddr:  "AA:AA:AA:AA:AA:AA",
+		Options: []DHCPOption{{Code: 67, Type: "text", Value: "pxelinux.0"}},
+	}})
+	assert.Nil(t, err)
+
+	mac, _ := net.ParseMAC("aa:aa:aa:aa:aa:aa")
+	lease := &Lease{HWAddr: mac, Expiry: time.Now().Add(time.Hour)}
+	pool := &addrPool{options: s.leaseOptions}
+	opts := s.replyOptions(pool, lease)
+	assert.Equal(t, []byte{192, 168, 0, 1}, opts[dhcp4.OptionRouter])
+	assert.Equal(t, []byte{192, 168, 0, 2}, opts[dhcp4.OptionDomainNameServer])
+	assert.Equal(t, []byte("tftp.lan"), opts[dhcp4.OptionTFTPServerName])
+	assert.Nil(t, opts[dhcp4.OptionBootFileName]) // not a static lease
+
+	lease.Expiry = time.Unix(leaseExpireStatic, 0)
+	opts = s.replyOptions(pool, lease)
+	assert.Equal(t, []byte("pxelinux.0"), opts[dhcp4.OptionBootFileName])
+
+	// default options aren't modified
+	assert.Equal(t, []byte{192, 168, 0, 1}, s.leaseOptions[dhcp4.OptionDomainNameServer])
+}
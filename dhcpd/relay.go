@@ -0,0 +1,167 @@
+// Serving the subnets behind DHCP relay agents (RFC 2131 section 4.1)
+
+package dhcpd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// RelaySubnet is a subnet which is served via DHCP relay agent (e.g. a VLAN behind a router)
+type RelaySubnet struct {
+	Name       string `json:"name" yaml:"name"`
+	GatewayIP  string `json:"gateway_ip" yaml:"gateway_ip"` // router of the subnet
+	SubnetMask string `json:"subnet_mask" yaml:"subnet_mask"`
+	RangeStart string `json:"range_start" yaml:"range_start"`
+	RangeEnd   string `json:"range_end" yaml:"range_end"`
+
+	// Custom options for the clients of this subnet.
+	// They override the global custom options.
+	Options []DHCPOption `json:"options" yaml:"options"`
+}
+
+// addrPool is the range of addresses and the options for the clients of a subnet
+type addrPool struct {
+	relay      bool // the subnet is behind a relay agent
+	name       string
+	ipnet      *net.IPNet
+	leaseStart net.IP
+	leaseStop  net.IP
+	options    dhcp4.Options // default options
+	custom     dhcp4.Options // custom options of the subnet
+}
+
+// Return TRUE if the lease can be used in the subnet:
+// a dynamic lease must be within the range, a static lease - within the relay subnet.
+// A static lease is used in the interface subnet unless it belongs to a relay subnet.
+func (s *Server) leaseInPool(pool *addrPool, l *Lease) bool {
+	if l.Expiry.Unix() != leaseExpireStatic {
+		return ipInRange(pool.leaseStart, pool.leaseStop, l.IP)
+	}
+	if pool.relay {
+		return pool.ipnet.Contains(l.IP)
+	}
+	return !s.isRelayedIP(l.IP)
+}
+
+// Parse the settings of relay subnets
+func (s *Server) parseRelaySubnets(list []RelaySubnet, domain string) ([]*addrPool, error) {
+	var pools []*addrPool
+	for _, r := range list {
+		name := r.Name
+		if len(name) == 0 {
+			name = r.GatewayIP
+		}
+
+		gw, err := parseIPv4(r.GatewayIP)
+		if err != nil {
+			return nil, fmt.Errorf("relay subnet %s: invalid gateway IP: %s", name, err)
+		}
+		mask, err := parseIPv4(r.SubnetMask)
+		if err != nil || !isValidSubnetMask(mask) {
+			return nil, fmt.Errorf("relay subnet %s: invalid subnet mask %s", name, r.SubnetMask)
+		}
+		ipnet := &net.IPNet{IP: gw.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+
+		p := &addrPool{relay: true, name: name, ipnet: ipnet}
+		p.leaseStart, err = parseIPv4(r.RangeStart)
+		if err == nil {
+			p.leaseStop, err = parseIPv4(r.RangeEnd)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("relay subnet %s: invalid range: %s", name, err)
+		}
+		if dhcp4.IPRange(p.leaseStart, p.leaseStop) <= 0 ||
+			!ipnet.Contains(p.leaseStart) || !ipnet.Contains(p.leaseStop) {
+			return nil, fmt.Errorf("relay subnet %s: range must be within %s", name, ipnet)
+		}
+
+		if s.ipnet != nil && (ipnet.Contains(s.ipnet.IP) || s.ipnet.Contains(ipnet.IP)) {
+			return nil, fmt.Errorf("relay subnet %s: %s overlaps with the interface subnet %s", name, ipnet, s.ipnet)
+		}
+		for _, other := range pools {
+			if other.ipnet.Contains(ipnet.IP) || ipnet.Contains(other.ipnet.IP) {
+				return nil, fmt.Errorf("relay subnet %s: %s overlaps with %s", name, ipnet, other.name)
+			}
+		}
+
+		p.options = dhcp4.Options{
+			dhcp4.OptionSubnetMask: mask,
+			dhcp4.OptionRouter:     gw,
+		}
+		if s.ipnet != nil {
+			p.options[dhcp4.OptionDomainNameServer] = s.ipnet.IP
+		}
+		if len(domain) != 0 {
+			p.options[dhcp4.OptionDomainName] = []byte(domain)
+		}
+		p.custom, err = parseDHCPOptions(r.Options)
+		if err != nil {
+			return nil, fmt.Errorf("relay subnet %s: %s", name, err)
+		}
+
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// Find the subnet of the client:
+// . the request is received via a relay agent: the relay subnet which contains the relay agent's address (giaddr)
+// . the client renews its lease directly (ciaddr is set): the relay subnet which contains the client's address
+// . otherwise: the subnet of the interface
+// nil: the relay agent is unknown
+func (s *Server) findPool(p dhcp4.Packet) *addrPool {
+	giaddr := p.GIAddr()
+	relayed := !giaddr.Equal(net.IPv4zero)
+	ip := giaddr
+	if !relayed {
+		ip = p.CIAddr()
+	}
+	for _, pool := range s.relays {
+		if pool.ipnet.Contains(ip) {
+			return pool
+		}
+	}
+	if relayed {
+		return nil
+	}
+
+	return &addrPool{
+		ipnet:      s.ipnet,
+		leaseStart: s.leaseStart,
+		leaseStop:  s.leaseStop,
+		options:    s.leaseOptions,
+	}
+}
+
+// Return TRUE if the address belongs to a relay subnet
+func (s *Server) isRelayedIP(ip net.IP) bool {
+	for _, pool := range s.relays {
+		if pool.ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the address is within the range of a relay subnet
+func (s *Server) inRelayRange(ip net.IP) bool {
+	for _, pool := range s.relays {
+		if ipInRange(pool.leaseStart, pool.leaseStop, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the names of relay subnets for logging
+func (s *Server) relayNames() string {
+	var names []string
+	for _, pool := range s.relays {
+		names = append(names, fmt.Sprintf("%s (%s)", pool.name, pool.ipnet))
+	}
+	return strings.Join(names, ", ")
+}
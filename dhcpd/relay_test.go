@@ -0,0 +1,120 @@
+package dhcpd
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRelaySubnets(t *testing.T) {
+	s := Server{}
+	s.ipnet = &net.IPNet{IP: net.IP{192, 168, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+
+	vlan := RelaySubnet{
+		Name:       "vlan10",
+		GatewayIP:  "192.168.10.1",
+		SubnetMask: "255.255.255.0",
+		RangeStart: "192.168.10.100",
+		RangeEnd:   "192.168.10.200",
+		Options:    []DHCPOption{{Code: 66, Type: "text", Value: "tftp.vlan10"}},
+	}
+	pools, err := s.parseRelaySubnets([]RelaySubnet{vlan}, "lan")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pools))
+	assert.Equal(t, "192.168.10.0/24", pools[0].ipnet.String())
+	assert.Equal(t, []byte{192, 168, 10, 1}, pools[0].options[dhcp4.OptionRouter])
+	assert.Equal(t, []byte{192, 168, 0, 1}, pools[0].options[dhcp4.OptionDomainNameServer])
+	assert.Equal(t, []byte("lan"), pools[0].options[dhcp4.OptionDomainName])
+	assert.Equal(t, []byte("tftp.vlan10"), pools[0].custom[dhcp4.OptionTFTPServerName])
+
+	// the range is outside of the subnet
+	r := vlan
+	r.RangeEnd = "192.168.11.200"
+	_, err = s.parseRelaySubnets([]RelaySubnet{r}, "")
+	assert.NotNil(t, err)
+
+	// invalid mask
+	r = vlan
+	r.SubnetMask = "255.0.255.0"
+	_, err = s.parseRelaySubnets([]RelaySubnet{r}, "")
+	assert.NotNil(t, err)
+
+	// overlaps with the interface subnet
+	r = vlan
+	r.GatewayIP = "192.168.0.254"
+	r.SubnetMask = "255.255.0.0"
+	_, err = s.parseRelaySubnets([]RelaySubnet{r}, "")
+	assert.NotNil(t, err)
+
+	// overlaps with another relay subnet
+	r = vlan
+	r.Name = "vlan10-2"
+	_, err = s.parseRelaySubnets([]RelaySubnet{vlan, r}, "")
+	assert.NotNil(t, err)
+}
+
+func TestRelay(t *testing.T) {
+	s := Server{}
+	s.conf.DBFilePath = dbFilename
+	defer func() { _ = os.Remove(dbFilename) }()
+	s.reset()
+	s.leaseStart = net.IP{192, 168, 0, 100}
+	s.leaseStop = net.IP{192, 168, 0, 200}
+	s.leaseTime = time.Hour
+	s.ipnet = &net.IPNet{IP: net.IP{192, 168, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	s.leaseOptions = dhcp4.Options{dhcp4.OptionRouter: []byte{192, 168, 0, 1}}
+
+	var err error
+	s.relays, err = s.parseRelaySubnets([]RelaySubnet{{
+		Name:       "vlan10",
+		GatewayIP:  "192.168.10.1",
+		SubnetMask: "255.255.255.0",
+		RangeStart: "192.168.10.100",
+		RangeEnd:   "192.168.10.200",
+	}}, "")
+	assert.Nil(t, err)
+
+	p := dhcp4.NewPacket(dhcp4.BootRequest)
+	p.SetCHAddr(net.HardwareAddr{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa})
+
+	// the subnet is selected by the address of the relay agent
+	assert.Equal(t, "vlan10", s.findPool(withGIAddr(p, net.IP{192, 168, 10, 1})).name)
+	assert.Nil(t, s.findPool(withGIAddr(p, net.IP{192, 168, 20, 1})))
+	assert.False(t, s.findPool(p).relay)
+
+	// the client renews its lease directly
+	p2 := dhcp4.NewPacket(dhcp4.BootRequest)
+	p2.SetCIAddr(net.IP{192, 168, 10, 150})
+	assert.Equal(t, "vlan10", s.findPool(p2).name)
+
+	// the offer contains an address from the relay subnet
+	p.SetGIAddr(net.IP{192, 168, 10, 1})
+	resp := s.handleDiscover(p, dhcp4.Options{})
+	assert.Equal(t, net.IP{192, 168, 10, 100}, resp.YIAddr())
+	assert.Equal(t, net.IP{192, 168, 10, 1}, resp.GIAddr())
+	opts := resp.ParseOptions()
+	assert.Equal(t, []byte{192, 168, 10, 1}, opts[dhcp4.OptionRouter])
+	assert.Equal(t, []byte{255, 255, 255, 0}, opts[dhcp4.OptionSubnetMask])
+
+	// the client moves to the local subnet: a new address is offered
+	p.SetGIAddr(net.IPv4zero)
+	resp = s.handleDiscover(p, dhcp4.Options{})
+	assert.Equal(t, net.IP{192, 168, 0, 100}, resp.YIAddr())
+	assert.Equal(t, []byte{192, 168, 0, 1}, resp.ParseOptions()[dhcp4.OptionRouter])
+
+	// the request from an unknown relay agent is ignored
+	p.SetGIAddr(net.IP{192, 168, 20, 1})
+	assert.Nil(t, s.handleDiscover(p, dhcp4.Options{}))
+}
+
+// Get a copy of the packet with this relay agent address
+func withGIAddr(p dhcp4.Packet, ip net.IP) dhcp4.Packet {
+	p2 := make(dhcp4.Packet, len(p))
+	copy(p2, p)
+	p2.SetGIAddr(ip)
+	return p2
+}
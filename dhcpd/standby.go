@@ -0,0 +1,80 @@
+// High availability: standby mode and replication of dynamic leases
+
+package dhcpd
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// SetStandby - in standby mode the server doesn't answer DHCP requests,
+// so that only one server of a high-availability pair serves the clients
+func (s *Server) SetStandby(standby bool) {
+	var v int32
+	if standby {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.standby, v) != v {
+		log.Info("DHCP: standby mode: %v", standby)
+	}
+}
+
+func (s *Server) isStandby() bool {
+	return atomic.LoadInt32(&s.standby) != 0
+}
+
+// SetDynamicLeases replaces all dynamic IPv4 leases (thread-safe)
+// The leases which are expired, aren't within the current range
+// or conflict with static leases are skipped.
+func (s *Server) SetDynamicLeases(leases []Lease) {
+	now := time.Now().Unix()
+
+	s.leasesLock.Lock()
+	if s.IPpool == nil {
+		// not initialized
+		s.leasesLock.Unlock()
+		return
+	}
+
+	staticLeases := []*Lease{}
+	dynLeases := []*Lease{}
+	for _, l := range s.leases {
+		if l.Expiry.Unix() == leaseExpireStatic {
+			staticLeases = append(staticLeases, l)
+		}
+	}
+	for _, l := range leases {
+		ip := l.IP.To4()
+		if ip == nil || len(l.HWAddr) != 6 ||
+			l.Expiry.Unix() <= now || l.Expiry.Unix() == leaseExpireStatic {
+			continue
+		}
+		if !ipInRange(s.leaseStart, s.leaseStop, ip) && !s.inRelayRange(ip) {
+			continue
+		}
+		dynLeases = append(dynLeases, &Lease{
+			HWAddr:   l.HWAddr,
+			IP:       ip,
+			Hostname: l.Hostname,
+			Expiry:   l.Expiry,
+		})
+	}
+
+	s.leases = []*Lease{}
+	s.IPpool = make(map[[4]byte]net.HardwareAddr)
+	for _, l := range normalizeLeases(staticLeases, dynLeases) {
+		if s.findReservedHWaddr(l.IP) != nil {
+			// the IP address is used by a static lease
+			continue
+		}
+		s.leases = append(s.leases, l)
+		s.reserveIP(l.IP, l.HWAddr)
+	}
+	s.dbStore()
+	s.leasesLock.Unlock()
+
+	s.notify(LeaseChangedAdded)
+}
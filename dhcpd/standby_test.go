@@ -0,0 +1,79 @@
+package dhcpd
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStandby(t *testing.T) {
+	s := Server{}
+	s.reset()
+	s.leaseStart = []byte{1, 1, 1, 1}
+	s.leaseStop = []byte{1, 1, 1, 2}
+	s.leaseTime = 5 * time.Second
+	s.ipnet = &net.IPNet{
+		IP:   []byte{1, 2, 3, 4},
+		Mask: []byte{0xff, 0xff, 0xff, 0xff},
+	}
+
+	p := make(dhcp4.Packet, 241)
+	p.SetCHAddr([]byte{1, 2, 3, 4, 5, 6})
+	p.SetCIAddr([]byte{0, 0, 0, 0})
+
+	s.SetStandby(true)
+	assert.Nil(t, s.ServeDHCP(p, dhcp4.Discover, dhcp4.Options{}))
+	assert.Equal(t, 0, len(s.Leases(LeasesAll)))
+
+	s.SetStandby(false)
+	assert.NotNil(t, s.ServeDHCP(p, dhcp4.Discover, dhcp4.Options{}))
+}
+
+func TestSetDynamicLeases(t *testing.T) {
+	s := Server{}
+	s.conf.DBFilePath = dbFilename
+	defer func() { _ = os.Remove(dbFilename) }()
+	s.reset()
+	s.leaseStart = []byte{1, 1, 1, 1}
+	s.leaseStop = []byte{1, 1, 1, 10}
+
+	st := &Lease{
+		HWAddr: []byte{1, 1, 1, 1, 1, 1},
+		IP:     []byte{1, 1, 1, 5},
+		Expiry: time.Unix(leaseExpireStatic, 0),
+	}
+	s.leases = []*Lease{st, {
+		HWAddr: []byte{2, 2, 2, 2, 2, 2},
+		IP:     []byte{1, 1, 1, 2},
+		Expiry: time.Now().Add(time.Hour),
+	}}
+	s.reserveIP(st.IP, st.HWAddr)
+
+	exp := time.Now().Add(time.Hour)
+	s.SetDynamicLeases([]Lease{
+		// OK
+		{HWAddr: []byte{3, 3, 3, 3, 3, 3}, IP: net.ParseIP("1.1.1.3"), Hostname: "h3", Expiry: exp},
+		// expired
+		{HWAddr: []byte{4, 4, 4, 4, 4, 4}, IP: net.ParseIP("1.1.1.4"), Expiry: time.Now().Add(-time.Hour)},
+		// the IP address of a static lease
+		{HWAddr: []byte{5, 5, 5, 5, 5, 5}, IP: net.ParseIP("1.1.1.5"), Expiry: exp},
+		// out of range
+		{HWAddr: []byte{6, 6, 6, 6, 6, 6}, IP: net.ParseIP("2.2.2.2"), Expiry: exp},
+		// the MAC address of a static lease
+		{HWAddr: []byte{1, 1, 1, 1, 1, 1}, IP: net.ParseIP("1.1.1.6"), Expiry: exp},
+	})
+
+	ll := s.Leases(LeasesAll)
+	assert.Equal(t, 2, len(ll))
+	assert.Equal(t, "01:01:01:01:01:01", ll[0].HWAddr.String())
+	assert.Equal(t, "03:03:03:03:03:03", ll[1].HWAddr.String())
+	assert.Equal(t, "1.1.1.3", ll[1].IP.String())
+	assert.Equal(t, "h3", ll[1].Hostname)
+
+	assert.Equal(t, "03:03:03:03:03:03", s.FindMACbyIP(net.ParseIP("1.1.1.3")).String())
+	assert.Nil(t, s.FindMACbyIP(net.ParseIP("1.1.1.2")))
+}
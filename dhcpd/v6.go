@@ -0,0 +1,420 @@
+// DHCPv6 server
+
+package dhcpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	defaultV6LeaseDuration = 24 * 60 * 60 // seconds
+	opt6ClientFQDN         = 39
+)
+
+// V6ServerConf - DHCPv6 and router advertisement settings
+// field ordering is important -- yaml fields will mirror ordering from here
+type V6ServerConf struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// The first address of the pool, e.g. "2001:db8::1000".
+	// The pool ends at the address with the last byte 0xff (max 256 addresses).
+	// The prefix (/64) of this address is announced in router advertisements.
+	RangeStart    string `json:"range_start" yaml:"range_start"`
+	LeaseDuration uint32 `json:"lease_duration" yaml:"lease_duration"` // in seconds.  0: 1 day
+
+	// The clients configure their addresses via SLAAC;  DHCPv6 server only provides DNS server address (stateless DHCPv6)
+	RASLAACOnly bool `json:"ra_slaac_only" yaml:"ra_slaac_only"`
+
+	// The clients may configure their addresses both via SLAAC and via DHCPv6
+	RAAllowSLAAC bool `json:"ra_allow_slaac" yaml:"ra_allow_slaac"`
+}
+
+// v6Server is the state of DHCPv6 server
+type v6Server struct {
+	conf       V6ServerConf
+	iface      *net.Interface
+	rangeStart net.IP
+	prefix     *net.IPNet // /64 prefix of the pool
+	leaseTime  time.Duration
+	dnsIP      net.IP // IPv6 address of this server announced as DNS server
+	duid       []byte // server DUID
+
+	conn     *ipv6.PacketConn
+	ra       *raCtx
+	stopping bool
+	wg       sync.WaitGroup
+
+	// leases, protected by Server.leasesLock
+	leases []*Lease
+}
+
+// Get IPv6 address of the interface which is announced as DNS server:
+// global unicast or ULA address is preferred over link-local address
+func getIfaceIPv6(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var linkLocal net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil {
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() {
+			if linkLocal == nil {
+				linkLocal = ipnet.IP
+			}
+			continue
+		}
+		if ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP
+		}
+	}
+	return linkLocal
+}
+
+// Check DHCPv6 settings
+func (s *Server) setConfigV6(iface *net.Interface, conf V6ServerConf) error {
+	if !conf.Enabled {
+		s.v6.conf = conf
+		return nil
+	}
+
+	ip := net.ParseIP(conf.RangeStart)
+	if ip == nil || ip.To4() != nil {
+		return fmt.Errorf("DHCPv6: invalid range_start: %s", conf.RangeStart)
+	}
+	dnsIP := getIfaceIPv6(iface)
+	if dnsIP == nil {
+		return fmt.Errorf("DHCPv6: interface %s has no IPv6 address", iface.Name)
+	}
+	if len(iface.HardwareAddr) == 0 {
+		return fmt.Errorf("DHCPv6: interface %s has no hardware address", iface.Name)
+	}
+
+	s.v6.conf = conf
+	s.v6.iface = iface
+	s.v6.rangeStart = ip
+	s.v6.prefix = &net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	s.v6.dnsIP = dnsIP
+	s.v6.duid = makeDUIDLL(iface.HardwareAddr)
+	s.v6.leaseTime = time.Duration(conf.LeaseDuration) * time.Second
+	if conf.LeaseDuration == 0 {
+		s.v6.leaseTime = defaultV6LeaseDuration * time.Second
+	}
+	return nil
+}
+
+// Start DHCPv6 server and router advertisements
+func (s *Server) startV6() error {
+	if !s.v6.conf.Enabled {
+		return nil
+	}
+
+	c, err := net.ListenPacket("udp6", "[::]:547")
+	if err != nil {
+		return wrapErrPrint(err, "DHCPv6: couldn't listen on [::]:547")
+	}
+	p := ipv6.NewPacketConn(c)
+	err = p.SetControlMessage(ipv6.FlagInterface, true)
+	if err != nil {
+		c.Close()
+		return wrapErrPrint(err, "DHCPv6: couldn't set control message FlagInterface")
+	}
+	// All_DHCP_Relay_Agents_and_Servers
+	err = p.JoinGroup(s.v6.iface, &net.UDPAddr{IP: net.ParseIP("ff02::1:2")})
+	if err != nil {
+		c.Close()
+		return wrapErrPrint(err, "DHCPv6: couldn't join multicast group on %s", s.v6.iface.Name)
+	}
+
+	ra, err := newRA(s.v6.iface, s.raParams())
+	if err != nil {
+		c.Close()
+		return wrapErrPrint(err, "DHCPv6: couldn't start router advertisements")
+	}
+
+	s.v6.conn = p
+	s.v6.ra = ra
+	s.v6.stopping = false
+	s.v6.wg.Add(1)
+	go s.serveV6(p, s.v6.iface.Index)
+	ra.start()
+	log.Info("DHCPv6: listening on [::]:547 (%s)", s.v6.iface.Name)
+	return nil
+}
+
+// Stop DHCPv6 server and router advertisements
+func (s *Server) stopV6() {
+	if s.v6.conn == nil {
+		return
+	}
+	s.v6.stopping = true
+	s.v6.ra.stop()
+	_ = s.v6.conn.Close()
+	s.v6.wg.Wait()
+	s.v6.conn = nil
+	s.v6.ra = nil
+}
+
+func (s *Server) serveV6(c *ipv6.PacketConn, ifIndex int) {
+	defer s.v6.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, cm, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			if !s.v6.stopping {
+				log.Error("DHCPv6: read: %s", err)
+			}
+			return
+		}
+		if cm != nil && cm.IfIndex != ifIndex {
+			continue
+		}
+
+		if s.isStandby() {
+			continue
+		}
+
+		req, err := parseMsg6(buf[:n])
+		if err != nil {
+			log.Debug("DHCPv6: %s: %s", addr, err)
+			continue
+		}
+		resp := s.process6(req, time.Now())
+		if resp == nil {
+			continue
+		}
+		_, err = c.WriteTo(resp.pack(), &ipv6.ControlMessage{IfIndex: ifIndex}, addr)
+		if err != nil {
+			log.Debug("DHCPv6: write to %s: %s", addr, err)
+		}
+	}
+}
+
+// Process the request from the client.  nil: no response.
+func (s *Server) process6(req *dhcp6Msg, now time.Time) *dhcp6Msg {
+	clientID := req.option(opt6ClientID)
+	serverID := req.option(opt6ServerID)
+	switch req.msgType {
+	case dhcp6Solicit, dhcp6Rebind, dhcp6Confirm:
+		if len(clientID) == 0 || serverID != nil {
+			return nil
+		}
+	case dhcp6Request, dhcp6Renew, dhcp6Release, dhcp6Decline:
+		if len(clientID) == 0 || !bytes.Equal(serverID, s.v6.duid) {
+			return nil
+		}
+	case dhcp6InformationRequest:
+		if serverID != nil && !bytes.Equal(serverID, s.v6.duid) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	log.Tracef("DHCPv6: message %d from %x", req.msgType, clientID)
+
+	resp := &dhcp6Msg{msgType: dhcp6Reply, xid: req.xid}
+	if clientID != nil {
+		resp.addOption(opt6ClientID, clientID)
+	}
+	resp.addOption(opt6ServerID, s.v6.duid)
+
+	switch req.msgType {
+	case dhcp6Solicit:
+		if s.v6.conf.RASLAACOnly {
+			return nil // stateless: only Information-request messages are processed
+		}
+		commit := req.hasOption(opt6RapidCommit)
+		if commit {
+			resp.addOption(opt6RapidCommit, nil)
+		} else {
+			resp.msgType = dhcp6Advertise
+		}
+		s.assign6(req, resp, clientID, commit, now)
+
+	case dhcp6Request, dhcp6Renew, dhcp6Rebind:
+		if s.v6.conf.RASLAACOnly {
+			return nil
+		}
+		s.assign6(req, resp, clientID, true, now)
+
+	case dhcp6Release:
+		s.release6(clientID, false, now)
+		resp.addOption(opt6StatusCode, statusCode6(status6Success, ""))
+
+	case dhcp6Decline:
+		s.release6(clientID, true, now)
+		resp.addOption(opt6StatusCode, statusCode6(status6Success, ""))
+
+	case dhcp6Confirm:
+		n := 0
+		onLink := true
+		for _, ia := range req.iaNAs() {
+			for _, ip := range ia.addrs {
+				n++
+				onLink = onLink && s.v6.prefix.Contains(ip)
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		if onLink {
+			resp.addOption(opt6StatusCode, statusCode6(status6Success, ""))
+		} else {
+			resp.addOption(opt6StatusCode, statusCode6(status6NotOnLink, ""))
+		}
+		return resp
+	}
+
+	resp.addOption(opt6DNSServers, s.v6.dnsIP.To16())
+	return resp
+}
+
+// Assign the address to the first IA_NA of the client.
+// commit: the lease is committed, otherwise it's only reserved (Advertise message)
+func (s *Server) assign6(req, resp *dhcp6Msg, duid []byte, commit bool, now time.Time) {
+	iaList := req.iaNAs()
+	if len(iaList) == 0 {
+		return
+	}
+	lifetime := uint32(s.v6.leaseTime / time.Second)
+
+	s.leasesLock.Lock()
+	lease := s.findLease6(duid)
+	if lease == nil {
+		lease = s.reserveLease6(duid, now)
+	}
+	if lease == nil {
+		s.leasesLock.Unlock()
+		log.Info("DHCPv6: no free addresses for %x", duid)
+		resp.addOption(opt6StatusCode, statusCode6(status6NoAddrsAvail, ""))
+		for _, ia := range iaList {
+			resp.addOption(opt6IANA, packIANA(ia.iaid, nil, 0, status6NoAddrsAvail))
+		}
+		return
+	}
+
+	if host := parseClientFQDN(req.option(opt6ClientFQDN)); len(host) != 0 {
+		lease.Hostname = host
+	}
+	changed := false
+	if commit && lease.Expiry.Unix() != leaseExpireStatic {
+		lease.Expiry = now.Add(s.v6.leaseTime)
+		s.dbStore()
+		changed = true
+	}
+	ip := lease.IP
+	s.leasesLock.Unlock()
+	if changed {
+		s.notify(LeaseChangedAdded)
+	}
+
+	resp.addOption(opt6IANA, packIANA(iaList[0].iaid, ip, lifetime, 0))
+	for _, ia := range iaList[1:] {
+		resp.addOption(opt6IANA, packIANA(ia.iaid, nil, 0, status6NoAddrsAvail))
+	}
+}
+
+// Get the hardware address for the lease:  MAC from DUID if it's possible, otherwise DUID itself
+func leaseHWAddr6(duid []byte) net.HardwareAddr {
+	mac := duidMAC(duid)
+	if mac != nil {
+		return mac
+	}
+	return append(net.HardwareAddr{}, duid...)
+}
+
+func (s *Server) findLease6(duid []byte) *Lease {
+	hw := leaseHWAddr6(duid)
+	for _, l := range s.v6.leases {
+		if bytes.Equal(l.HWAddr, hw) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Reserve a free address from the pool (or the address of an expired lease)
+func (s *Server) reserveLease6(duid []byte, now time.Time) *Lease {
+	lease := &Lease{HWAddr: leaseHWAddr6(duid)}
+
+	used := map[string]bool{}
+	for _, l := range s.v6.leases {
+		used[l.IP.String()] = true
+	}
+	start := s.v6.rangeStart.To16()
+	for i := int(start[15]); i <= 0xff; i++ {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, start)
+		ip[15] = byte(i)
+		if !used[ip.String()] {
+			lease.IP = ip
+			s.v6.leases = append(s.v6.leases, lease)
+			return lease
+		}
+	}
+
+	for i, l := range s.v6.leases {
+		if l.Expiry.Unix() != leaseExpireStatic && !l.Expiry.After(now) {
+			lease.IP = l.IP
+			s.v6.leases[i] = lease
+			return lease
+		}
+	}
+	return nil
+}
+
+// Remove the client's lease.
+// declined: the address is used by another device, so it's blocked for the lease duration
+func (s *Server) release6(duid []byte, declined bool, now time.Time) {
+	s.leasesLock.Lock()
+	lease := s.findLease6(duid)
+	if lease == nil || lease.Expiry.Unix() == leaseExpireStatic {
+		s.leasesLock.Unlock()
+		return
+	}
+	if declined {
+		log.Info("DHCPv6: IP conflict: %s is already used by another device", lease.IP)
+		lease.HWAddr = make(net.HardwareAddr, 6)
+		lease.Hostname = ""
+		lease.Expiry = now.Add(s.v6.leaseTime)
+	} else {
+		lease.Expiry = now // the address may be assigned to another client
+	}
+	s.dbStore()
+	s.leasesLock.Unlock()
+	if declined {
+		s.notify(LeaseChangedBlacklisted)
+	} else {
+		s.notify(LeaseChangedReleased)
+	}
+}
+
+// Get the host name from Client FQDN option (RFC 4704): flags + the name in DNS wire format
+func parseClientFQDN(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	data = data[1:]
+	n := int(data[0])
+	if n == 0 || len(data) < 1+n {
+		return ""
+	}
+	host := strings.ToLower(string(data[1 : 1+n]))
+	for _, c := range host {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			return ""
+		}
+	}
+	return host
+}
@@ -0,0 +1,218 @@
+// DHCPv6 message format (RFC 8415)
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// DHCPv6 message types
+const (
+	dhcp6Solicit            = 1
+	dhcp6Advertise          = 2
+	dhcp6Request            = 3
+	dhcp6Confirm            = 4
+	dhcp6Renew              = 5
+	dhcp6Rebind             = 6
+	dhcp6Reply              = 7
+	dhcp6Release            = 8
+	dhcp6Decline            = 9
+	dhcp6InformationRequest = 11
+)
+
+// DHCPv6 options
+const (
+	opt6ClientID       = 1
+	opt6ServerID       = 2
+	opt6IANA           = 3
+	opt6IAAddr         = 5
+	opt6ORO            = 6
+	opt6Preference     = 7
+	opt6StatusCode     = 13
+	opt6RapidCommit    = 14
+	opt6DNSServers     = 23
+	opt6InfRefreshTime = 32
+)
+
+// DHCPv6 status codes
+const (
+	status6Success      = 0
+	status6NoAddrsAvail = 2
+	status6NoBinding    = 3
+	status6NotOnLink    = 4
+)
+
+// dhcp6Option is a DHCPv6 option
+type dhcp6Option struct {
+	code uint16
+	data []byte
+}
+
+// dhcp6Msg is a DHCPv6 client/server message
+type dhcp6Msg struct {
+	msgType byte
+	xid     [3]byte // transaction ID
+	options []dhcp6Option
+}
+
+// dhcp6IANA is Identity Association for Non-temporary Addresses
+type dhcp6IANA struct {
+	iaid  uint32
+	t1    uint32
+	t2    uint32
+	addrs []net.IP // the addresses from IAADDR options
+}
+
+func parseOptions6(data []byte) ([]dhcp6Option, error) {
+	var opts []dhcp6Option
+	for len(data) != 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated option header")
+		}
+		code := binary.BigEndian.Uint16(data)
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+n {
+			return nil, fmt.Errorf("option %d: truncated data", code)
+		}
+		opts = append(opts, dhcp6Option{code: code, data: data[4 : 4+n]})
+		data = data[4+n:]
+	}
+	return opts, nil
+}
+
+func packOptions6(buf []byte, opts []dhcp6Option) []byte {
+	for _, o := range opts {
+		var hdr [4]byte
+		binary.BigEndian.PutUint16(hdr[:], o.code)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(o.data)))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, o.data...)
+	}
+	return buf
+}
+
+// Parse DHCPv6 client/server message.  Relay messages aren't supported.
+func parseMsg6(data []byte) (*dhcp6Msg, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message is too short")
+	}
+	m := &dhcp6Msg{msgType: data[0]}
+	copy(m.xid[:], data[1:4])
+	var err error
+	m.options, err = parseOptions6(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *dhcp6Msg) pack() []byte {
+	buf := []byte{m.msgType, m.xid[0], m.xid[1], m.xid[2]}
+	return packOptions6(buf, m.options)
+}
+
+// Get the data of the first option with this code.  nil: not found.
+func (m *dhcp6Msg) option(code uint16) []byte {
+	for _, o := range m.options {
+		if o.code == code {
+			return o.data
+		}
+	}
+	return nil
+}
+
+func (m *dhcp6Msg) hasOption(code uint16) bool {
+	for _, o := range m.options {
+		if o.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *dhcp6Msg) addOption(code uint16, data []byte) {
+	m.options = append(m.options, dhcp6Option{code: code, data: data})
+}
+
+// Get IA_NA options
+func (m *dhcp6Msg) iaNAs() []dhcp6IANA {
+	var r []dhcp6IANA
+	for _, o := range m.options {
+		if o.code != opt6IANA || len(o.data) < 12 {
+			continue
+		}
+		ia := dhcp6IANA{
+			iaid: binary.BigEndian.Uint32(o.data),
+			t1:   binary.BigEndian.Uint32(o.data[4:]),
+			t2:   binary.BigEndian.Uint32(o.data[8:]),
+		}
+		opts, err := parseOptions6(o.data[12:])
+		if err != nil {
+			continue
+		}
+		for _, io := range opts {
+			if io.code == opt6IAAddr && len(io.data) >= 24 {
+				ia.addrs = append(ia.addrs, net.IP(io.data[:16]))
+			}
+		}
+		r = append(r, ia)
+	}
+	return r
+}
+
+func statusCode6(code uint16, text string) []byte {
+	buf := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(buf, code)
+	return append(buf, text...)
+}
+
+// Create IA_NA option.
+// ip == nil: IA_NA contains the status code instead of the address.
+func packIANA(iaid uint32, ip net.IP, lifetime uint32, status uint16) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf, iaid)
+	if ip == nil {
+		return packOptions6(buf, []dhcp6Option{{code: opt6StatusCode, data: statusCode6(status, "")}})
+	}
+
+	binary.BigEndian.PutUint32(buf[4:], lifetime/2)   // T1
+	binary.BigEndian.PutUint32(buf[8:], lifetime*4/5) // T2
+	addr := make([]byte, 24)
+	copy(addr, ip.To16())
+	binary.BigEndian.PutUint32(addr[16:], lifetime) // preferred lifetime
+	binary.BigEndian.PutUint32(addr[20:], lifetime) // valid lifetime
+	return packOptions6(buf, []dhcp6Option{{code: opt6IAAddr, data: addr}})
+}
+
+// Get the link-layer address from DUID-LLT or DUID-LL (RFC 8415 section 11).  nil: DUID doesn't contain it.
+func duidMAC(duid []byte) net.HardwareAddr {
+	if len(duid) < 4 {
+		return nil
+	}
+	duidType := binary.BigEndian.Uint16(duid)
+	hwType := binary.BigEndian.Uint16(duid[2:])
+	var addr []byte
+	switch duidType {
+	case 1: // DUID-LLT
+		if len(duid) < 8 {
+			return nil
+		}
+		addr = duid[8:]
+	case 3: // DUID-LL
+		addr = duid[4:]
+	default:
+		return nil
+	}
+	if hwType != 1 || len(addr) != 6 { // Ethernet
+		return nil
+	}
+	return net.HardwareAddr(addr)
+}
+
+// Create DUID-LL from the MAC address of the interface
+func makeDUIDLL(mac net.HardwareAddr) []byte {
+	duid := []byte{0, 3, 0, 1}
+	return append(duid, mac...)
+}
@@ -0,0 +1,201 @@
+// IPv6 router advertisements (RFC 4861)
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	raInterval = 200 * time.Second // unsolicited advertisements
+	// lifetime of the prefix and DNS server address:  the announcements may be lost a few times
+	raLifetime = 3600 // seconds
+)
+
+// raParams - the contents of router advertisements
+type raParams struct {
+	managed    bool // M flag:  the addresses are available via DHCPv6
+	other      bool // O flag:  other information (DNS servers) is available via DHCPv6
+	slaac      bool // A flag of the prefix:  the clients may configure their addresses via SLAAC
+	prefix     net.IP
+	sourceAddr net.HardwareAddr
+	mtu        uint32
+	dnsIP      net.IP
+}
+
+func (s *Server) raParams() raParams {
+	p := raParams{
+		managed:    !s.v6.conf.RASLAACOnly,
+		other:      true,
+		slaac:      s.v6.conf.RASLAACOnly || s.v6.conf.RAAllowSLAAC,
+		prefix:     s.v6.prefix.IP,
+		sourceAddr: s.v6.iface.HardwareAddr,
+		dnsIP:      s.v6.dnsIP,
+	}
+	if s.v6.iface.MTU > 0 {
+		p.mtu = uint32(s.v6.iface.MTU)
+	}
+	return p
+}
+
+// Create ICMPv6 Router Advertisement message.
+// Router lifetime is 0:  AdGuard Home isn't a default router, it only announces the prefix and DNS server.
+// Checksum is calculated by OS.
+func createRA(p raParams) []byte {
+	// type, code, checksum, cur hop limit, flags, router lifetime, reachable time, retrans timer
+	buf := make([]byte, 16)
+	buf[0] = 134
+	buf[4] = 64
+	if p.managed {
+		buf[5] |= 0x80
+	}
+	if p.other {
+		buf[5] |= 0x40
+	}
+
+	// Prefix Information
+	pi := make([]byte, 32)
+	pi[0] = 3
+	pi[1] = 4
+	pi[2] = 64   // prefix length
+	pi[3] = 0x80 // on-link
+	if p.slaac {
+		pi[3] |= 0x40 // autonomous address-configuration
+	}
+	binary.BigEndian.PutUint32(pi[4:], raLifetime) // valid lifetime
+	binary.BigEndian.PutUint32(pi[8:], raLifetime) // preferred lifetime
+	copy(pi[16:], p.prefix.To16())
+	buf = append(buf, pi...)
+
+	if p.mtu != 0 {
+		mtu := make([]byte, 8)
+		mtu[0] = 5
+		mtu[1] = 1
+		binary.BigEndian.PutUint32(mtu[4:], p.mtu)
+		buf = append(buf, mtu...)
+	}
+
+	if len(p.sourceAddr) == 6 {
+		buf = append(buf, 1, 1)
+		buf = append(buf, p.sourceAddr...)
+	}
+
+	// Recursive DNS Server (RFC 8106)
+	rdnss := make([]byte, 24)
+	rdnss[0] = 25
+	rdnss[1] = 3
+	binary.BigEndian.PutUint32(rdnss[4:], raLifetime)
+	copy(rdnss[8:], p.dnsIP.To16())
+	buf = append(buf, rdnss...)
+	return buf
+}
+
+// raCtx sends router advertisements periodically and in response to router solicitations
+type raCtx struct {
+	conn   *icmp.PacketConn
+	iface  *net.Interface
+	packet []byte
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newRA(iface *net.Interface, p raParams) (*raCtx, error) {
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, err
+	}
+	pc := c.IPv6PacketConn()
+	err = pc.SetMulticastHopLimit(255)
+	if err == nil {
+		err = pc.SetHopLimit(255)
+	}
+	if err == nil {
+		err = pc.SetMulticastInterface(iface)
+	}
+	if err == nil {
+		err = pc.SetControlMessage(ipv6.FlagInterface, true)
+	}
+	if err == nil {
+		// All-Routers:  router solicitations are sent to this address
+		err = pc.JoinGroup(iface, &net.IPAddr{IP: net.ParseIP("ff02::2")})
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &raCtx{
+		conn:   c,
+		iface:  iface,
+		packet: createRA(p),
+		stopCh: make(chan struct{}),
+	}, nil
+}
+
+func (ra *raCtx) start() {
+	ra.wg.Add(2)
+	go ra.sendLoop()
+	go ra.receiveLoop()
+}
+
+func (ra *raCtx) stop() {
+	close(ra.stopCh)
+	_ = ra.conn.Close()
+	ra.wg.Wait()
+}
+
+// Send the advertisement to all nodes
+func (ra *raCtx) send() {
+	dst := &net.IPAddr{IP: net.ParseIP("ff02::1"), Zone: ra.iface.Name}
+	_, err := ra.conn.WriteTo(ra.packet, dst)
+	if err != nil {
+		log.Debug("DHCPv6: RA: write: %s", err)
+	}
+}
+
+func (ra *raCtx) sendLoop() {
+	defer ra.wg.Done()
+	ra.send()
+	t := time.NewTicker(raInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ra.send()
+		case <-ra.stopCh:
+			return
+		}
+	}
+}
+
+// Respond to router solicitations
+func (ra *raCtx) receiveLoop() {
+	defer ra.wg.Done()
+	pc := ra.conn.IPv6PacketConn()
+	buf := make([]byte, 1500)
+	for {
+		n, cm, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-ra.stopCh:
+			default:
+				log.Error("DHCPv6: RA: read: %s", err)
+			}
+			return
+		}
+		if n == 0 || buf[0] != 133 { // Router Solicitation
+			continue
+		}
+		if cm != nil && cm.IfIndex != ra.iface.Index {
+			continue
+		}
+		ra.send()
+	}
+}
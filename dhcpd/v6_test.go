@@ -0,0 +1,171 @@
+package dhcpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testV6Server(t *testing.T) *Server {
+	s := &Server{}
+	s.conf.DBFilePath = dbFilename
+	s.reset()
+	iface := &net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{0xaa, 0, 0, 0, 0, 1}}
+	s.v6.conf = V6ServerConf{Enabled: true, RangeStart: "2001:db8::fe"}
+	s.v6.iface = iface
+	s.v6.rangeStart = net.ParseIP("2001:db8::fe")
+	s.v6.prefix = &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)}
+	s.v6.leaseTime = time.Hour
+	s.v6.dnsIP = net.ParseIP("2001:db8::1")
+	s.v6.duid = makeDUIDLL(iface.HardwareAddr)
+	return s
+}
+
+func TestV6Msg(t *testing.T) {
+	m := &dhcp6Msg{msgType: dhcp6Solicit, xid: [3]byte{1, 2, 3}}
+	m.addOption(opt6ClientID, []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6})
+	m.addOption(opt6IANA, packIANA(7, net.ParseIP("2001:db8::2"), 3600, 0))
+	m.addOption(opt6RapidCommit, nil)
+
+	m2, err := parseMsg6(m.pack())
+	assert.Nil(t, err)
+	assert.Equal(t, byte(dhcp6Solicit), m2.msgType)
+	assert.Equal(t, [3]byte{1, 2, 3}, m2.xid)
+	assert.True(t, m2.hasOption(opt6RapidCommit))
+	assert.Equal(t, "01:02:03:04:05:06", duidMAC(m2.option(opt6ClientID)).String())
+	ia := m2.iaNAs()
+	assert.Equal(t, 1, len(ia))
+	assert.Equal(t, uint32(7), ia[0].iaid)
+	assert.Equal(t, uint32(1800), ia[0].t1)
+	assert.Equal(t, "2001:db8::2", ia[0].addrs[0].String())
+
+	_, err = parseMsg6([]byte{1, 2, 3, 4, 0, 1, 0, 5, 1})
+	assert.NotNil(t, err)
+
+	assert.Nil(t, duidMAC([]byte{0, 2, 0, 0, 0, 1}))
+	assert.Equal(t, "kids-tablet", parseClientFQDN([]byte{0, 11, 'k', 'i', 'd', 's', '-', 't', 'a', 'b', 'l', 'e', 't', 0}))
+}
+
+func TestV6Leases(t *testing.T) {
+	s := testV6Server(t)
+	defer func() { _ = os.Remove(dbFilename) }()
+	now := time.Now()
+
+	duid1 := []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6}
+	solicit := &dhcp6Msg{msgType: dhcp6Solicit, xid: [3]byte{1, 2, 3}}
+	solicit.addOption(opt6ClientID, duid1)
+	solicit.addOption(opt6IANA, packIANA(1, nil, 0, 0))
+
+	// Solicit -> Advertise
+	resp := s.process6(solicit, now)
+	assert.Equal(t, byte(dhcp6Advertise), resp.msgType)
+	assert.True(t, bytes.Equal(s.v6.duid, resp.option(opt6ServerID)))
+	assert.True(t, bytes.Equal(duid1, resp.option(opt6ClientID)))
+	assert.Equal(t, "2001:db8::1", net.IP(resp.option(opt6DNSServers)).String())
+	ia := resp.iaNAs()
+	assert.Equal(t, "2001:db8::fe", ia[0].addrs[0].String())
+	assert.Equal(t, 0, len(s.Leases(LeasesAll))) // not committed
+
+	// Request without server ID is ignored
+	req := &dhcp6Msg{msgType: dhcp6Request, xid: [3]byte{1, 2, 4}}
+	req.addOption(opt6ClientID, duid1)
+	req.addOption(opt6IANA, packIANA(1, nil, 0, 0))
+	assert.Nil(t, s.process6(req, now))
+
+	// Request -> Reply
+	req.addOption(opt6ServerID, s.v6.duid)
+	resp = s.process6(req, now)
+	assert.Equal(t, byte(dhcp6Reply), resp.msgType)
+	ia = resp.iaNAs()
+	assert.Equal(t, "2001:db8::fe", ia[0].addrs[0].String())
+	assert.Equal(t, uint32(1800), ia[0].t1)
+	leases := s.Leases(LeasesAll)
+	assert.Equal(t, 1, len(leases))
+	assert.Equal(t, "01:02:03:04:05:06", leases[0].HWAddr.String())
+	assert.Equal(t, "01:02:03:04:05:06", s.FindMACbyIP(net.ParseIP("2001:db8::fe")).String())
+
+	// the second client with rapid commit gets the next address
+	duid2 := []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 7}
+	solicit2 := &dhcp6Msg{msgType: dhcp6Solicit, xid: [3]byte{1, 2, 5}}
+	solicit2.addOption(opt6ClientID, duid2)
+	solicit2.addOption(opt6IANA, packIANA(1, nil, 0, 0))
+	solicit2.addOption(opt6RapidCommit, nil)
+	resp = s.process6(solicit2, now)
+	assert.Equal(t, byte(dhcp6Reply), resp.msgType)
+	assert.Equal(t, "2001:db8::ff", resp.iaNAs()[0].addrs[0].String())
+
+	// the pool is exhausted
+	duid3 := []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 8}
+	solicit3 := &dhcp6Msg{msgType: dhcp6Solicit, xid: [3]byte{1, 2, 6}}
+	solicit3.addOption(opt6ClientID, duid3)
+	solicit3.addOption(opt6IANA, packIANA(1, nil, 0, 0))
+	resp = s.process6(solicit3, now)
+	st := resp.option(opt6StatusCode)
+	assert.Equal(t, uint16(status6NoAddrsAvail), binary.BigEndian.Uint16(st))
+
+	// Release: the address may be assigned to another client
+	rel := &dhcp6Msg{msgType: dhcp6Release, xid: [3]byte{1, 2, 7}}
+	rel.addOption(opt6ClientID, duid1)
+	rel.addOption(opt6ServerID, s.v6.duid)
+	resp = s.process6(rel, now)
+	assert.Equal(t, uint16(status6Success), binary.BigEndian.Uint16(resp.option(opt6StatusCode)))
+	resp = s.process6(solicit3, now.Add(time.Second))
+	assert.Equal(t, "2001:db8::fe", resp.iaNAs()[0].addrs[0].String())
+
+	// stored leases are loaded
+	s2 := testV6Server(t)
+	s2.dbLoad()
+	assert.Equal(t, 1, len(s2.Leases(LeasesAll)))
+}
+
+func TestV6Stateless(t *testing.T) {
+	s := testV6Server(t)
+	s.v6.conf.RASLAACOnly = true
+
+	solicit := &dhcp6Msg{msgType: dhcp6Solicit}
+	solicit.addOption(opt6ClientID, []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6})
+	solicit.addOption(opt6IANA, packIANA(1, nil, 0, 0))
+	assert.Nil(t, s.process6(solicit, time.Now()))
+
+	info := &dhcp6Msg{msgType: dhcp6InformationRequest}
+	resp := s.process6(info, time.Now())
+	assert.Equal(t, byte(dhcp6Reply), resp.msgType)
+	assert.Equal(t, "2001:db8::1", net.IP(resp.option(opt6DNSServers)).String())
+
+	confirm := &dhcp6Msg{msgType: dhcp6Confirm}
+	confirm.addOption(opt6ClientID, []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6})
+	confirm.addOption(opt6IANA, packIANA(1, net.ParseIP("2001:db9::1"), 3600, 0))
+	resp = s.process6(confirm, time.Now())
+	assert.Equal(t, uint16(status6NotOnLink), binary.BigEndian.Uint16(resp.option(opt6StatusCode)))
+}
+
+func TestCreateRA(t *testing.T) {
+	s := testV6Server(t)
+	s.v6.conf.RAAllowSLAAC = true
+	p := createRA(s.raParams())
+	assert.Equal(t, byte(134), p[0])
+	assert.Equal(t, byte(0xc0), p[5])     // M and O flags
+	assert.Equal(t, []byte{0, 0}, p[6:8]) // router lifetime
+
+	// Prefix Information
+	pi := p[16:48]
+	assert.Equal(t, byte(3), pi[0])
+	assert.Equal(t, byte(64), pi[2])
+	assert.Equal(t, byte(0xc0), pi[3]) // on-link, autonomous
+	assert.Equal(t, "2001:db8::", net.IP(pi[16:32]).String())
+
+	// Source link-layer address, RDNSS
+	assert.Equal(t, []byte{1, 1, 0xaa, 0, 0, 0, 0, 1}, p[48:56])
+	assert.Equal(t, byte(25), p[56])
+	assert.Equal(t, "2001:db8::1", net.IP(p[64:80]).String())
+	assert.Equal(t, 80, len(p))
+
+	s.v6.conf.RASLAACOnly = true
+	p = createRA(s.raParams())
+	assert.Equal(t, byte(0x40), p[5]) // O flag
+}
@@ -0,0 +1,247 @@
+// Persistent storage for SB/PC caches
+
+package dnsfilter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// How often the caches are saved to disk
+const cacheSaveInterval = 1 * time.Hour
+
+// IDs of the caches in file
+const (
+	cacheIDSafeBrowsing = 1
+	cacheIDParental     = 2
+)
+
+// keysCache is a cache which knows the keys it stores, so that its entries can be saved to disk
+type keysCache struct {
+	cache.Cache
+	lock sync.Mutex
+	keys map[string]bool
+}
+
+func newKeysCache(c cache.Cache) *keysCache {
+	return &keysCache{
+		Cache: c,
+		keys:  make(map[string]bool),
+	}
+}
+
+func (c *keysCache) Set(key []byte, val []byte) bool {
+	c.lock.Lock()
+	c.keys[string(key)] = true
+	c.lock.Unlock()
+	return c.Cache.Set(key, val)
+}
+
+func (c *keysCache) Del(key []byte) {
+	c.lock.Lock()
+	delete(c.keys, string(key))
+	c.lock.Unlock()
+	c.Cache.Del(key)
+}
+
+func (c *keysCache) Clear() {
+	c.lock.Lock()
+	c.keys = make(map[string]bool)
+	c.lock.Unlock()
+	c.Cache.Clear()
+}
+
+// Get the list of the keys which are still in cache.
+// The keys that were removed from cache due to its size limit are forgotten.
+func (c *keysCache) getKeys() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := make([]string, 0, len(c.keys))
+	for k := range c.keys {
+		if c.Cache.Get([]byte(k)) == nil {
+			delete(c.keys, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+/*
+File format (all numbers are big-endian):
+	cache_id byte[1]
+	key_len  byte[2]
+	key      byte[key_len]
+	val_len  byte[4]
+	val      byte[val_len]  (the same data as stored in cache: expire byte[4] + Result)
+	...
+*/
+
+// Get the caches which are stored on disk
+func (d *Dnsfilter) persistentCaches() map[byte]cache.Cache {
+	return map[byte]cache.Cache{
+		cacheIDSafeBrowsing: d.safebrowsingCache,
+		cacheIDParental:     d.parentalCache,
+	}
+}
+
+// Write the entries of a cache
+func writeCacheEntries(w io.Writer, id byte, c *keysCache) (int, error) {
+	n := 0
+	for _, k := range c.getKeys() {
+		val := c.Cache.Get([]byte(k))
+		if val == nil || len(k) > 0xffff {
+			continue
+		}
+
+		hdr := make([]byte, 3)
+		hdr[0] = id
+		binary.BigEndian.PutUint16(hdr[1:], uint16(len(k)))
+		vlen := make([]byte, 4)
+		binary.BigEndian.PutUint32(vlen, uint32(len(val)))
+		for _, b := range [][]byte{hdr, []byte(k), vlen, val} {
+			_, err := w.Write(b)
+			if err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Save SB/PC caches to file
+func (d *Dnsfilter) saveCaches() {
+	if len(d.Config.CacheFilePath) == 0 {
+		return
+	}
+
+	fn := d.Config.CacheFilePath + ".tmp"
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Error("Filtering: save caches: %s", err)
+		return
+	}
+
+	w := bufio.NewWriter(f)
+	n := 0
+	for id, c := range d.persistentCaches() {
+		kc, ok := c.(*keysCache)
+		if !ok {
+			continue
+		}
+		var nc int
+		nc, err = writeCacheEntries(w, id, kc)
+		n += nc
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	_ = f.Close()
+	if err == nil {
+		err = os.Rename(fn, d.Config.CacheFilePath)
+	}
+	if err != nil {
+		log.Error("Filtering: save caches: %s: %s", fn, err)
+		_ = os.Remove(fn)
+		return
+	}
+
+	log.Debug("Filtering: saved %d cache entries to %s", n, d.Config.CacheFilePath)
+}
+
+// Read the next entry from file
+func readCacheEntry(r io.Reader) (byte, []byte, []byte, error) {
+	hdr := make([]byte, 3)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	key := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+	_, err = io.ReadFull(r, key)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	vlen := make([]byte, 4)
+	_, err = io.ReadFull(r, vlen)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	n := binary.BigEndian.Uint32(vlen)
+	if n < 4 || n > 64*1024 {
+		return 0, nil, nil, fmt.Errorf("invalid value length: %d", n)
+	}
+	val := make([]byte, n)
+	_, err = io.ReadFull(r, val)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return hdr[0], key, val, nil
+}
+
+// Load SB/PC caches from file.  Expired entries are skipped.
+func (d *Dnsfilter) loadCaches() {
+	if len(d.Config.CacheFilePath) == 0 {
+		return
+	}
+
+	f, err := os.Open(d.Config.CacheFilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Filtering: load caches: %s", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	caches := d.persistentCaches()
+	now := uint32(time.Now().Unix())
+	r := bufio.NewReader(f)
+	n := 0
+	for {
+		id, key, val, err := readCacheEntry(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Error("Filtering: load caches: %s: %s", d.Config.CacheFilePath, err)
+			}
+			break
+		}
+
+		c, ok := caches[id]
+		if !ok || c == nil || binary.BigEndian.Uint32(val[:4]) <= now {
+			continue
+		}
+		c.Set(key, val)
+		n++
+	}
+
+	log.Debug("Filtering: loaded %d cache entries from %s", n, d.Config.CacheFilePath)
+}
+
+// Periodically save SB/PC caches to file
+func (d *Dnsfilter) periodicCacheSave(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(cacheSaveInterval):
+			d.saveCaches()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Client tags expressions
+
+package dnsfilter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ctagFactor is a single tag in an expression: "tag" or "~tag"
+type ctagFactor struct {
+	tag string
+	not bool
+}
+
+// ctagExpr is a client tags expression.
+// It's a list of AND-terms joined by OR: "a&~b|c" is (a AND NOT b) OR c.
+type ctagExpr [][]ctagFactor
+
+// Return TRUE if the string is a valid tag name
+func isValidTag(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Return TRUE if the expression can't be handled by urlfilter (which supports only "a|b")
+func isComplexCtagExpr(s string) bool {
+	return strings.ContainsAny(s, "&~")
+}
+
+// Parse client tags expression
+func parseCtagExpr(s string) (ctagExpr, error) {
+	var expr ctagExpr
+	for _, t := range strings.Split(s, "|") {
+		var term []ctagFactor
+		for _, f := range strings.Split(t, "&") {
+			f = strings.TrimSpace(f)
+			fac := ctagFactor{}
+			if strings.HasPrefix(f, "~") {
+				fac.not = true
+				f = f[1:]
+			}
+			if !isValidTag(f) {
+				return nil, fmt.Errorf("invalid client tag: '%s'", f)
+			}
+			fac.tag = f
+			term = append(term, fac)
+		}
+		expr = append(expr, term)
+	}
+	return expr, nil
+}
+
+// Return TRUE if the client's tags satisfy the expression
+// ctags: sorted list of client tags
+func (e ctagExpr) match(ctags []string) bool {
+	for _, term := range e {
+		ok := true
+		for _, f := range term {
+			i := sort.SearchStrings(ctags, f.tag)
+			found := i != len(ctags) && ctags[i] == f.tag
+			if found == f.not {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
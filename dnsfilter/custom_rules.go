@@ -0,0 +1,327 @@
+// Rules with modifiers that urlfilter doesn't support:
+// . $dnstype
+// . $ctag with complex expressions (negation and AND semantics)
+
+package dnsfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsTypeModifier = "dnstype="
+	ctagModifier    = "ctag="
+
+	maxRuleLineLength = 1 * 1024 * 1024 // lines in filter data may be longer than bufio.Scanner allows by default
+)
+
+// customRule is a filtering rule which is handled by us rather than by urlfilter
+type customRule struct {
+	text      string             // original rule text
+	rule      *rules.NetworkRule // rule without custom modifiers.  nil: the rule matches any host
+	listID    int                // filter list ID
+	whitelist bool               // "@@" rule
+	host      string             // "||host^" pattern: the rule matches only this host name and its subdomains
+	index     int                // position in the list of rules
+
+	types   map[uint16]bool // DNS record types.  nil: the rule matches any type
+	exclude bool            // "~TYPE": the rule matches all types except the specified ones
+
+	ctags ctagExpr // client tags expression.  nil: the rule matches any client
+}
+
+// Return TRUE if the rule matches this DNS record type
+func (r *customRule) matchType(qtype uint16) bool {
+	if r.types == nil {
+		return true
+	}
+	_, ok := r.types[qtype]
+	return ok != r.exclude
+}
+
+// Return TRUE if the rule matches this DNS record type and client tags
+func (r *customRule) matchParams(qtype uint16, ctags []string) bool {
+	if !r.matchType(qtype) {
+		return false
+	}
+	return r.ctags == nil || r.ctags.match(ctags)
+}
+
+// customRuleSet is the list of rules with custom modifiers indexed by host name
+type customRuleSet struct {
+	byHost map[string][]*customRule // rules with "||host^" pattern
+	other  []*customRule            // rules which are checked for every request
+	count  int
+}
+
+func newCustomRuleSet(list []*customRule) *customRuleSet {
+	s := &customRuleSet{
+		byHost: map[string][]*customRule{},
+		count:  len(list),
+	}
+	for i, r := range list {
+		r.index = i
+		if len(r.host) == 0 {
+			s.other = append(s.other, r)
+			continue
+		}
+		s.byHost[r.host] = append(s.byHost[r.host], r)
+	}
+	return s
+}
+
+// Call f() for each rule which matches the request until f() returns FALSE
+// Only the rules for the host name and its parent domains are checked, plus the rules without "||host^" pattern.
+// The urlfilter request is created once and only if a rule needs it.
+func (s *customRuleSet) forEachMatch(host string, qtype uint16, ctags []string, f func(r *customRule) bool) {
+	if s == nil || s.count == 0 {
+		return
+	}
+
+	var req *rules.Request
+	check := func(list []*customRule) bool {
+		for _, r := range list {
+			if !r.matchParams(qtype, ctags) {
+				continue
+			}
+			if r.rule != nil {
+				if req == nil {
+					req = rules.NewRequestForHostname(host)
+				}
+				if !r.rule.Match(req) {
+					continue
+				}
+			}
+			if !f(r) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !check(s.other) || len(s.byHost) == 0 {
+		return
+	}
+	h := strings.ToLower(host)
+	for {
+		list, ok := s.byHost[h]
+		if ok && !check(list) {
+			return
+		}
+		pos := strings.IndexByte(h, '.')
+		if pos < 0 {
+			break
+		}
+		h = h[pos+1:]
+	}
+}
+
+// Parse DNS record type: "AAAA", "HTTPS", "65" or "TYPE65"
+func parseDNSType(s string) (uint16, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	t, ok := dns.StringToType[s]
+	if ok {
+		return t, nil
+	}
+	if s == "HTTPS" {
+		return 65, nil
+	}
+	if s == "SVCB" {
+		return 64, nil
+	}
+
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid DNS type: %s", s)
+	}
+	return uint16(n), nil
+}
+
+// Parse "$dnstype" modifier value: "A|AAAA" or "~A|~AAAA"
+func parseDNSTypeModifier(r *customRule, val string) error {
+	r.types = map[uint16]bool{}
+	for i, s := range strings.Split(val, "|") {
+		exclude := strings.HasPrefix(s, "~")
+		if i == 0 {
+			r.exclude = exclude
+		} else if r.exclude != exclude {
+			return fmt.Errorf("mixed negated and non-negated DNS types")
+		}
+
+		t, err := parseDNSType(strings.TrimPrefix(s, "~"))
+		if err != nil {
+			return err
+		}
+		r.types[t] = true
+	}
+	return nil
+}
+
+// Return TRUE if the rule pattern matches any host name
+func isAnyHostPattern(pattern string) bool {
+	return pattern == "" || pattern == "*" || pattern == "||*^" || pattern == "|*^"
+}
+
+// Get the host name from "||host^" pattern.  "": the pattern is more complex
+func patternHost(pattern string) string {
+	if !strings.HasPrefix(pattern, "||") || !strings.HasSuffix(pattern, "^") {
+		return ""
+	}
+	host := strings.ToLower(pattern[2 : len(pattern)-1])
+	if len(host) == 0 || host[0] == '.' || host[len(host)-1] == '.' {
+		return ""
+	}
+	for _, c := range host {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_') {
+			return ""
+		}
+	}
+	return host
+}
+
+// Return TRUE if the rule must be handled by us
+func isCustomRule(text string) bool {
+	if strings.Contains(text, "$"+dnsTypeModifier) || strings.Contains(text, ","+dnsTypeModifier) {
+		return true
+	}
+
+	pos := strings.Index(text, ctagModifier)
+	if pos < 0 {
+		return false
+	}
+	val := text[pos+len(ctagModifier):]
+	end := strings.IndexByte(val, ',')
+	if end >= 0 {
+		val = val[:end]
+	}
+	return isComplexCtagExpr(val)
+}
+
+// Parse a rule with custom modifiers
+// Return nil if the rule doesn't need to be handled by us
+func newCustomRule(text string, listID int) (*customRule, error) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 || text[0] == '!' || text[0] == '#' ||
+		!isCustomRule(text) {
+		return nil, nil
+	}
+
+	pos := strings.LastIndexByte(text, '$')
+	if pos < 0 {
+		return nil, nil
+	}
+
+	r := &customRule{
+		text:   text,
+		listID: listID,
+	}
+
+	var opts []string
+	for _, opt := range strings.Split(text[pos+1:], ",") {
+		var err error
+		if strings.HasPrefix(opt, dnsTypeModifier) {
+			err = parseDNSTypeModifier(r, opt[len(dnsTypeModifier):])
+		} else if strings.HasPrefix(opt, ctagModifier) {
+			r.ctags, err = parseCtagExpr(opt[len(ctagModifier):])
+		} else {
+			opts = append(opts, opt)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pattern := text[:pos]
+	if strings.HasPrefix(pattern, "@@") {
+		r.whitelist = true
+		pattern = pattern[2:]
+	}
+	if isAnyHostPattern(pattern) && len(opts) == 0 {
+		return r, nil
+	}
+	r.host = patternHost(pattern)
+
+	ruleText := text[:pos]
+	if len(opts) != 0 {
+		ruleText += "$" + strings.Join(opts, ",")
+	}
+	rule, err := rules.NewNetworkRule(ruleText, listID)
+	if err != nil {
+		return nil, err
+	}
+	r.rule = rule
+	return r, nil
+}
+
+// Get the list of rules with custom modifiers from filter data
+func readCustomRules(listID int, rd io.Reader) ([]*customRule, error) {
+	var list []*customRule
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(nil, maxRuleLineLength)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.Contains(line, dnsTypeModifier) && !strings.Contains(line, ctagModifier) {
+			continue
+		}
+		r, err := newCustomRule(line, listID)
+		if err != nil {
+			log.Info("Filtering: list %d: invalid rule '%s': %s", listID, line, err)
+			continue
+		}
+		if r != nil {
+			list = append(list, r)
+		}
+	}
+	err := sc.Err()
+	if err != nil {
+		return nil, fmt.Errorf("list %d: %s", listID, err)
+	}
+	return list, nil
+}
+
+// Match the request against the rules with custom modifiers.
+// Whitelist rules have higher priority.  Of the blocking rules the first one in the list is used.
+// Note: engineLock must be held by the caller.
+func (d *Dnsfilter) matchCustomRules(host string, qtype uint16, ctags []string) (Result, bool) {
+	var block, allow *customRule
+	d.customRules.forEachMatch(host, qtype, ctags, func(r *customRule) bool {
+		if r.whitelist {
+			allow = r
+			return false
+		}
+		if block == nil || r.index < block.index {
+			block = r
+		}
+		return true
+	})
+
+	if allow != nil {
+		return customRuleResult(allow), true
+	}
+	if block == nil {
+		return Result{}, false
+	}
+	return customRuleResult(block), true
+}
+
+func customRuleResult(r *customRule) Result {
+	res := Result{}
+	res.FilterID = int64(r.listID)
+	res.Rule = r.text
+	res.Reason = FilteredBlackList
+	res.IsFiltered = true
+	if r.whitelist {
+		res.Reason = NotFilteredWhiteList
+		res.IsFiltered = false
+	}
+	log.Debug("Filtering: matched custom rule: '%s'  list_id: %d", r.text, r.listID)
+	return res
+}
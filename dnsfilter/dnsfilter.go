@@ -1,14 +1,15 @@
 package dnsfilter
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/cache"
@@ -31,8 +32,26 @@ type RequestFilteringSettings struct {
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
+	AllowlistOnly       bool // block all host names except those matched by whitelist rules
 	ClientTags          []string
+	ClientName          string // client's name (used by the scripts).  "": unknown client
 	ServicesRules       []ServiceEntry
+
+	ClientIP     string  // client IP address (used to match the pauses)
+	ClientSubnet string  // client subnet from EDNS Client Subnet option ("1.2.3.0/24").  "": not set
+	Pauses       []Pause // active pauses of filtering
+
+	Rewrites []RewriteEntry // rewrites of the client's view (see PrepareRewrites), they take precedence over the global rewrites
+
+	// Called when a filtering stage (TraceStage*) is completed (may be nil)
+	OnStageDone func(stage string, start time.Time)
+}
+
+// Report the duration of a filtering stage
+func (s *RequestFilteringSettings) stageDone(stage string, start time.Time) {
+	if s.OnStageDone != nil {
+		s.OnStageDone(stage, start)
+	}
 }
 
 // Config allows you to configure DNS filtering with New() or just change variables directly.
@@ -46,22 +65,55 @@ type Config struct {
 	SafeSearchCacheSize   uint `yaml:"safesearch_cache_size"`   // (in bytes)
 	ParentalCacheSize     uint `yaml:"parental_cache_size"`     // (in bytes)
 	CacheTime             uint `yaml:"cache_time"`              // Element's TTL (in minutes)
+	ResultCacheSize       uint `yaml:"result_cache_size"`       // Max. number of cached results of rules matching.  0: disabled
+
+	// Check host names against the bloom filter of the simple host rules ("||host^" and hosts file syntax),
+	//  and match the host names which aren't there only against the other rules.
+	// It speeds up matching for the filter lists with millions of host rules.
+	HostPrefilter bool `yaml:"host_prefilter"`
+
+	// Memory budget for the filter lists (in megabytes, estimated).
+	// The lists which don't fit into it aren't loaded.  0: unlimited
+	EngineMemoryLimit uint `yaml:"engine_memory_limit"`
+
+	// Wait for the other safebrowsing/parental lookups for this time (in milliseconds)
+	//  and send their hashes in one request.  0: send every lookup immediately
+	LookupBatchWindow uint `yaml:"lookup_batch_window"`
+
+	// Store SB/PC caches on disk, so they aren't lost on restart
+	PersistentCacheEnabled bool   `yaml:"persistent_cache_enabled"`
+	CacheFilePath          string `yaml:"-"` // File for SB/PC caches.  "": caches aren't stored
 
 	Rewrites []RewriteEntry `yaml:"rewrites"`
 
+	// Custom filtering scripts (evaluated in this order before the filter lists)
+	Scripts []ScriptEntry `yaml:"scripts"`
+
+	// External verdict provider which is consulted for the domains not matched by filters
+	VerdictURL        string          `yaml:"verdict_url"`         // URL of HTTP JSON API or "grpc[s]://host:port" of gRPC service.  "": disabled
+	VerdictTimeout    uint            `yaml:"verdict_timeout"`     // Request timeout (in milliseconds)
+	VerdictFailClosed bool            `yaml:"verdict_fail_closed"` // Block the request if the provider isn't available
+	VerdictCacheSize  uint            `yaml:"verdict_cache_size"`  // (in bytes)
+	VerdictProvider   VerdictProvider `yaml:"-"`                   // Custom provider (overrides VerdictURL)
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func() `yaml:"-"`
 
+	// Called when the user rules expire (see SetRulesExpiry())
+	UserRulesExpired func(rules []string) `yaml:"-"`
+
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request)) `yaml:"-"`
 }
 
 // LookupStats store stats collected during safebrowsing or parental checks
 type LookupStats struct {
-	Requests   uint64 // number of HTTP requests that were sent
-	CacheHits  uint64 // number of lookups that didn't need HTTP requests
-	Pending    int64  // number of currently pending HTTP requests
-	PendingMax int64  // maximum number of pending HTTP requests
+	Requests   uint64 // number of lookups that weren't found in cache
+	CacheHits  uint64 // number of lookups that didn't need network requests
+	Coalesced  uint64 // number of lookups that used the result of the same pending lookup
+	Upstream   uint64 // number of requests sent to the server (one request may serve several lookups)
+	Pending    int64  // number of currently pending requests to the server
+	PendingMax int64  // maximum number of pending requests to the server
 }
 
 // Stats store LookupStats for safebrowsing, parental and safesearch
@@ -69,6 +121,23 @@ type Stats struct {
 	Safebrowsing LookupStats
 	Parental     LookupStats
 	Safesearch   LookupStats
+
+	// Per-client counters: client IP -> stats
+	// Only Requests and CacheHits values are set.
+	Clients map[string]Stats
+}
+
+// EngineStats store the information about filtering engine reloads
+type EngineStats struct {
+	Reloads      uint64        // number of times the filtering engine was initialized
+	LastDuration time.Duration // the time it took to initialize the engine last time
+	TotalTime    time.Duration // the time spent on initializing the engine since startup
+
+	PrefilterHosts int    // number of host names in the prefilter.  0: the prefilter is disabled
+	PrefilterRules int    // number of rules which are matched by the engine for the rejected host names
+	PrefilterSkips uint64 // number of host names rejected by the prefilter
+
+	MemoryUsage uint64 // estimated memory usage of the loaded filter lists (in bytes)
 }
 
 // Parameters to pass to filters-initializer goroutine
@@ -80,12 +149,36 @@ type filtersInitializerParams struct {
 type Dnsfilter struct {
 	rulesStorage    *filterlist.RuleStorage
 	filteringEngine *urlfilter.DNSEngine
+	customRules     *customRuleSet // rules with modifiers that urlfilter doesn't support
+	prefilter       *hostPrefilter // nil: disabled
+	prefilterSkips  uint64         // number of host names rejected by the prefilter (atomic)
+	snapshots       []string       // copies of the filter files which are used by rulesStorage
 	engineLock      sync.RWMutex
+	reloadLock      sync.Mutex // only one filtering engine is built at a time
+	releasingMemory uint32     // the memory is being returned to OS (atomic)
+	filtersGen      uint64       // incremented after filters are updated (atomic)
+	resultCache     *resultCache // cached results of rules matching.  nil: disabled
 
 	parentalServer       string // access via methods
 	safeBrowsingServer   string // access via methods
 	parentalUpstream     upstream.Upstream
 	safeBrowsingUpstream upstream.Upstream
+	parentalLookups      *hashLookups // pending parental lookups
+	safeBrowsingLookups  *hashLookups // pending safebrowsing lookups
+
+	stats             Stats
+	clientStats       clientStats // per-client counters
+	safebrowsingCache cache.Cache
+	parentalCache     cache.Cache
+	safeSearchCache   cache.Cache
+	verdictCache      cache.Cache // cached results from external verdict provider
+	cacheSaveStop     chan bool   // stop periodic saving of caches
+
+	engineStats   EngineStats            // protected by engineLock
+	filtersMemory map[int64]FilterMemory // filter ID -> memory usage.  Protected by engineLock
+	reloadStatus  reloadStatus           // status of filters re-initialization
+	pauses        pauses                 // temporary pauses of filtering
+	rulesExpiry   rulesExpiry            // user rules which will expire
 
 	Config   // for direct access by library users, even a = assignment
 	confLock sync.RWMutex
@@ -132,6 +225,23 @@ const (
 
 	// ReasonRewrite - rewrite rule was applied
 	ReasonRewrite
+
+	// FilteredExternal - the host was blocked by external verdict provider
+	FilteredExternal
+	// FilteredRebind - the response was blocked by DNS rebinding protection
+	FilteredRebind
+
+	// NotFilteredPaused - filtering is temporarily paused for the client or the host
+	NotFilteredPaused
+
+	// FilteredNotInAllowList - the host isn't whitelisted while only whitelisted hosts are allowed
+	FilteredNotInAllowList
+
+	// FilteredRecordType - the records of blocked types were removed from the response
+	FilteredRecordType
+
+	// FilteredScript - the host was blocked by a custom filtering script
+	FilteredScript
 )
 
 var reasonNames = []string{
@@ -147,6 +257,17 @@ var reasonNames = []string{
 	"FilteredBlockedService",
 
 	"Rewrite",
+
+	"FilteredExternal",
+	"FilteredRebind",
+
+	"NotFilteredPaused",
+
+	"FilteredNotInAllowList",
+
+	"FilteredRecordType",
+
+	"FilteredScript",
 }
 
 func (r Reason) String() string {
@@ -159,14 +280,24 @@ func (r Reason) String() string {
 // GetConfig - get configuration
 func (d *Dnsfilter) GetConfig() RequestFilteringSettings {
 	c := RequestFilteringSettings{}
-	// d.confLock.RLock()
+	d.confLock.RLock()
 	c.SafeSearchEnabled = d.Config.SafeSearchEnabled
 	c.SafeBrowsingEnabled = d.Config.SafeBrowsingEnabled
 	c.ParentalEnabled = d.Config.ParentalEnabled
-	// d.confLock.RUnlock()
+	d.confLock.RUnlock()
+	c.Pauses = d.getPauses()
 	return c
 }
 
+// SetProtection - enable or disable safe browsing, parental control and safe search
+func (d *Dnsfilter) SetProtection(safeBrowsing, parental, safeSearch bool) {
+	d.confLock.Lock()
+	d.Config.SafeBrowsingEnabled = safeBrowsing
+	d.Config.ParentalEnabled = parental
+	d.Config.SafeSearchEnabled = safeSearch
+	d.confLock.Unlock()
+}
+
 // WriteDiskConfig - write configuration
 func (d *Dnsfilter) WriteDiskConfig(c *Config) {
 	d.confLock.Lock()
@@ -201,7 +332,7 @@ func (d *Dnsfilter) SetFilters(filters map[int]string, async bool) error {
 		return nil
 	}
 
-	err := d.initFiltering(filters)
+	err := d.reloadFilters(filters)
 	if err != nil {
 		log.Error("Can't initialize filtering subsystem: %s", err)
 		return err
@@ -214,7 +345,7 @@ func (d *Dnsfilter) SetFilters(filters map[int]string, async bool) error {
 func (d *Dnsfilter) filtersInitializer() {
 	for {
 		params := <-d.filtersInitializerChan
-		err := d.initFiltering(params.filters)
+		err := d.reloadFilters(params.filters)
 		if err != nil {
 			log.Error("Can't initialize filtering subsystem: %s", err)
 			continue
@@ -227,16 +358,32 @@ func (d *Dnsfilter) Close() {
 	if d.rulesStorage != nil {
 		_ = d.rulesStorage.Close()
 	}
-}
+	if d.prefilter != nil {
+		d.prefilter.close()
+	}
+	removeSnapshots(d.snapshots)
+	d.snapshots = nil
 
-type dnsFilterContext struct {
-	stats             Stats
-	safebrowsingCache cache.Cache
-	parentalCache     cache.Cache
-	safeSearchCache   cache.Cache
-}
+	if d.cacheSaveStop != nil {
+		close(d.cacheSaveStop)
+		d.cacheSaveStop = nil
+	}
+	d.saveCaches()
+
+	d.pauses.lock.Lock()
+	if d.pauses.timer != nil {
+		d.pauses.timer.Stop()
+		d.pauses.timer = nil
+	}
+	d.pauses.lock.Unlock()
 
-var gctx dnsFilterContext // global dnsfilter context
+	d.rulesExpiry.lock.Lock()
+	if d.rulesExpiry.timer != nil {
+		d.rulesExpiry.timer.Stop()
+		d.rulesExpiry.timer = nil
+	}
+	d.rulesExpiry.lock.Unlock()
+}
 
 // Result holds state of hostname check
 type Result struct {
@@ -249,6 +396,7 @@ type Result struct {
 	// for ReasonRewrite:
 	CanonName string   `json:",omitempty"` // CNAME value
 	IPList    []net.IP `json:",omitempty"` // list of IP addresses
+	TTL       uint32   `json:",omitempty"` // TTL of the answer: the minimum TTL set for the used entries.  0: default
 
 	// for FilteredBlockedService:
 	ServiceName string `json:",omitempty"` // Name of the blocked service
@@ -265,12 +413,23 @@ func (d *Dnsfilter) CheckHostRules(host string, qtype uint16, setts *RequestFilt
 		return Result{}, nil
 	}
 
-	return d.matchHost(host, qtype, setts.ClientTags)
+	return d.matchHostCached(host, qtype, setts.ClientTags)
 }
 
 // CheckHost tries to match the host against filtering rules,
 // then safebrowsing and parental if they are enabled
 func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFilteringSettings) (Result, error) {
+	return d.checkHost(context.Background(), host, qtype, setts, nil)
+}
+
+// CheckHostCtx is CheckHost which stops when the context is canceled or its deadline is exceeded.
+// In this case ctx.Err() is returned.
+func (d *Dnsfilter) CheckHostCtx(ctx context.Context, host string, qtype uint16, setts *RequestFilteringSettings) (Result, error) {
+	return d.checkHost(ctx, host, qtype, setts, nil)
+}
+
+// checkHost is CheckHostCtx which optionally stores the information about every evaluated stage
+func (d *Dnsfilter) checkHost(ctx context.Context, host string, qtype uint16, setts *RequestFilteringSettings, trace *Trace) (Result, error) {
 	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
 	if host == "" {
 		return Result{Reason: NotFilteredNotFound}, nil
@@ -280,61 +439,150 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 	var result Result
 	var err error
 
-	result = d.processRewrites(host, qtype)
+	start := time.Now()
+	if len(setts.Rewrites) != 0 {
+		result = matchRewrites(setts.Rewrites, host, qtype)
+	}
+	if result.Reason != ReasonRewrite {
+		result = d.processRewrites(host, qtype)
+	}
+	setts.stageDone(TraceStageRewrites, start)
+	trace.add(TraceStageRewrites, len(d.Rewrites) != 0 || len(setts.Rewrites) != 0, result, nil)
 	if result.Reason == ReasonRewrite {
 		return result, nil
 	}
 
+	for i := range setts.Pauses {
+		if setts.Pauses[i].match(host, setts.ClientIP) {
+			return Result{Reason: NotFilteredPaused}, nil
+		}
+	}
+
+	// the scripts stage is traced only when there are scripts
+	if setts.FilteringEnabled && len(d.Config.Scripts) != 0 {
+		start = time.Now()
+		result = d.processScripts(host, qtype, setts)
+		setts.stageDone(TraceStageScripts, start)
+		trace.add(TraceStageScripts, true, result, nil)
+		if result.Reason.Matched() {
+			return result, nil
+		}
+	} else if len(d.Config.Scripts) != 0 {
+		trace.add(TraceStageScripts, false, Result{}, nil)
+	}
+
 	// try filter lists first
-	if setts.FilteringEnabled {
-		result, err = d.matchHost(host, qtype, setts.ClientTags)
+	if setts.FilteringEnabled || setts.AllowlistOnly {
+		start = time.Now()
+		result, err = d.matchHostCached(host, qtype, setts.ClientTags)
+		setts.stageDone(TraceStageBlacklist, start)
 		if err != nil {
 			return result, err
 		}
+		if trace != nil {
+			d.traceFilters(trace, host, qtype, setts.ClientTags, result)
+		}
+		if setts.AllowlistOnly && result.Reason != NotFilteredWhiteList {
+			// block everything that isn't explicitly allowed
+			return Result{IsFiltered: true, Reason: FilteredNotInAllowList}, nil
+		}
 		if result.Reason.Matched() {
 			return result, nil
 		}
+	} else {
+		trace.add(TraceStageWhitelist, false, Result{}, nil)
+		trace.add(TraceStageBlacklist, false, Result{}, nil)
 	}
 
 	if len(setts.ServicesRules) != 0 {
+		start = time.Now()
 		result = matchBlockedServicesRules(host, setts.ServicesRules)
+		setts.stageDone(TraceStageServices, start)
+		trace.add(TraceStageServices, true, result, nil)
+		if result.Reason.Matched() {
+			return result, nil
+		}
+	} else {
+		trace.add(TraceStageServices, false, Result{}, nil)
+	}
+
+	// the following stages may send network requests
+	if ctx.Err() != nil {
+		return Result{}, ctx.Err()
+	}
+
+	if d.Config.VerdictProvider != nil {
+		start = time.Now()
+		result = d.checkExternalVerdict(ctx, host, qtype)
+		setts.stageDone(TraceStageExternal, start)
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		trace.add(TraceStageExternal, true, result, nil)
 		if result.Reason.Matched() {
 			return result, nil
 		}
 	}
 
 	if setts.SafeSearchEnabled {
-		result, err = d.checkSafeSearch(host)
+		start = time.Now()
+		result, err = d.checkSafeSearch(ctx, host, setts.ClientIP)
+		setts.stageDone(TraceStageSafeSearch, start)
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
 		if err != nil {
 			log.Info("SafeSearch: failed: %v", err)
+			trace.addError(TraceStageSafeSearch, err)
 			return Result{}, nil
 		}
+		trace.add(TraceStageSafeSearch, true, result, nil)
 
 		if result.Reason.Matched() {
 			return result, nil
 		}
+	} else {
+		trace.add(TraceStageSafeSearch, false, Result{}, nil)
 	}
 
 	if setts.SafeBrowsingEnabled {
-		result, err = d.checkSafeBrowsing(host)
+		start = time.Now()
+		result, err = d.checkSafeBrowsing(ctx, host, setts.ClientIP)
+		setts.stageDone(TraceStageSafeBrowsing, start)
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
 		if err != nil {
 			log.Info("SafeBrowsing: failed: %v", err)
+			trace.addError(TraceStageSafeBrowsing, err)
 			return Result{}, nil
 		}
+		trace.add(TraceStageSafeBrowsing, true, result, nil)
 		if result.Reason.Matched() {
 			return result, nil
 		}
+	} else {
+		trace.add(TraceStageSafeBrowsing, false, Result{}, nil)
 	}
 
 	if setts.ParentalEnabled {
-		result, err = d.checkParental(host)
+		start = time.Now()
+		result, err = d.checkParental(ctx, host, setts.ClientIP)
+		setts.stageDone(TraceStageParental, start)
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
 		if err != nil {
 			log.Printf("Parental: failed: %v", err)
+			trace.addError(TraceStageParental, err)
 			return Result{}, nil
 		}
+		trace.add(TraceStageParental, true, result, nil)
 		if result.Reason.Matched() {
 			return result, nil
 		}
+	} else {
+		trace.add(TraceStageParental, false, Result{}, nil)
 	}
 
 	return Result{}, nil
@@ -347,12 +595,23 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 // . Find A or AAAA record for a domain name (exact match or by wildcard)
 //  . if found, return IP addresses
 func (d *Dnsfilter) processRewrites(host string, qtype uint16) Result {
-	var res Result
-
 	d.confLock.RLock()
 	defer d.confLock.RUnlock()
+	return matchRewrites(d.Rewrites, host, qtype)
+}
 
-	rr := findRewrites(d.Rewrites, host)
+// Set TTL of the rewritten answer: the minimum of TTL values set for the used entries
+func (res *Result) setRewriteTTL(ttl uint32) {
+	if ttl != 0 && (res.TTL == 0 || ttl < res.TTL) {
+		res.TTL = ttl
+	}
+}
+
+// Process the list of rewrites (see processRewrites)
+func matchRewrites(a []RewriteEntry, host string, qtype uint16) Result {
+	var res Result
+
+	rr := findRewrites(a, host)
 	if len(rr) != 0 {
 		res.Reason = ReasonRewrite
 	}
@@ -369,12 +628,14 @@ func (d *Dnsfilter) processRewrites(host string, qtype uint16) Result {
 		}
 		cnames[host] = false
 		res.CanonName = rr[0].Answer
-		rr = findRewrites(d.Rewrites, host)
+		res.setRewriteTTL(rr[0].TTL)
+		rr = findRewrites(a, host)
 	}
 
 	for _, r := range rr {
 		if r.Type != dns.TypeCNAME && r.Type == qtype {
 			res.IPList = append(res.IPList, r.IP)
+			res.setRewriteTTL(r.TTL)
 			log.Debug("Rewrite: A/AAAA for %s is %s", host, r.IP)
 		}
 	}
@@ -417,60 +678,82 @@ func fileExists(fn string) bool {
 
 // Initialize urlfilter objects
 func (d *Dnsfilter) initFiltering(filters map[int]string) error {
-	listArray := []filterlist.RuleList{}
-	for id, dataOrFilePath := range filters {
-		var list filterlist.RuleList
-
-		if id == 0 {
-			list = &filterlist.StringRuleList{
-				ID:             0,
-				RulesText:      dataOrFilePath,
-				IgnoreCosmetic: true,
-			}
+	// only one engine is built at a time:
+	// a synchronous reload waits until the running one completes
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
 
-		} else if !fileExists(dataOrFilePath) {
-			list = &filterlist.StringRuleList{
-				ID:             id,
-				IgnoreCosmetic: true,
-			}
+	start := time.Now()
+	filters, filtersMemory, memoryUsage := d.applyMemoryBudget(filters)
 
-		} else if runtime.GOOS == "windows" {
-			// On Windows we don't pass a file to urlfilter because
-			//  it's difficult to update this file while it's being used.
-			data, err := ioutil.ReadFile(dataOrFilePath)
-			if err != nil {
-				return fmt.Errorf("ioutil.ReadFile(): %s: %s", dataOrFilePath, err)
-			}
-			list = &filterlist.StringRuleList{
-				ID:             id,
-				RulesText:      string(data),
-				IgnoreCosmetic: true,
-			}
-
-		} else {
-			var err error
-			list, err = filterlist.NewFileRuleList(id, dataOrFilePath, true)
-			if err != nil {
-				return fmt.Errorf("filterlist.NewFileRuleList(): %s: %s", dataOrFilePath, err)
-			}
-		}
-		listArray = append(listArray, list)
+	// stage 1: open the lists and parse the rules with custom modifiers
+	lists, err := loadRuleLists(filters)
+	if err != nil {
+		return err
 	}
+	ok := false
+	defer func() {
+		if !ok {
+			removeSnapshots(lists.snapshots)
+		}
+	}()
 
-	rulesStorage, err := filterlist.NewRuleStorage(listArray)
+	// stage 2: build the filtering engine
+	collectGarbage()
+	rulesStorage, err := filterlist.NewRuleStorage(lists.lists)
 	if err != nil {
 		return fmt.Errorf("filterlist.NewRuleStorage(): %s", err)
 	}
 	filteringEngine := urlfilter.NewDNSEngine(rulesStorage)
 
+	// stage 3: build the prefilter
+	var prefilter *hostPrefilter
+	if d.Config.HostPrefilter {
+		collectGarbage()
+		prefilter, err = newHostPrefilter(filters)
+		if err != nil {
+			log.Error("Filtering: %s", err)
+		} else {
+			log.Debug("Filtering: prefilter: %d host names, %d other rules", prefilter.hosts, prefilter.rules)
+		}
+	}
+
 	d.engineLock.Lock()
 	if d.rulesStorage != nil {
 		d.rulesStorage.Close()
 	}
+	if d.prefilter != nil {
+		d.prefilter.close()
+	}
+	oldSnapshots := d.snapshots
+	d.snapshots = lists.snapshots
+	ok = true
 	d.rulesStorage = rulesStorage
 	d.filteringEngine = filteringEngine
+	d.customRules = newCustomRuleSet(lists.customRules)
+	d.prefilter = prefilter
+	d.filtersMemory = filtersMemory
+	d.engineStats.MemoryUsage = memoryUsage
+	d.engineStats.PrefilterHosts = 0
+	d.engineStats.PrefilterRules = 0
+	if prefilter != nil {
+		d.engineStats.PrefilterHosts = prefilter.hosts
+		d.engineStats.PrefilterRules = prefilter.rules
+	}
+	gen := atomic.AddUint64(&d.filtersGen, 1)
+	elapsed := time.Since(start)
+	d.engineStats.Reloads++
+	d.engineStats.LastDuration = elapsed
+	d.engineStats.TotalTime += elapsed
 	d.engineLock.Unlock()
-	log.Debug("initialized filtering engine")
+	log.Debug("initialized filtering engine (%d custom rules) in %s", len(lists.customRules), elapsed)
+
+	removeSnapshots(oldSnapshots)
+	d.releaseMemory()
+
+	if d.resultCache != nil {
+		go d.revalidateResultCache(d.resultCache, gen)
+	}
 
 	return nil
 }
@@ -485,11 +768,40 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result
 		return Result{}, nil
 	}
 
-	rr, ok := d.filteringEngine.Match(host, ctags)
+	customRes, customMatched := d.matchCustomRules(host, qtype, ctags)
+	if customMatched && !customRes.IsFiltered {
+		return customRes, nil
+	}
+
+	engine := d.filteringEngine
+	if d.prefilter != nil && !d.prefilter.mayMatch(host) {
+		// none of the simple rules matches this host name
+		engine = d.prefilter.engine
+		atomic.AddUint64(&d.prefilterSkips, 1)
+	}
+
+	rr, ok := engine.Match(host, ctags)
 	if !ok {
+		if customMatched {
+			return customRes, nil
+		}
 		return Result{}, nil
 	}
 
+	if rr.NetworkRule != nil && rr.NetworkRule.Whitelist {
+		log.Debug("Filtering: found whitelist rule for host '%s': '%s'  list_id: %d",
+			host, rr.NetworkRule.Text(), rr.NetworkRule.GetFilterListID())
+		res := Result{}
+		res.FilterID = int64(rr.NetworkRule.GetFilterListID())
+		res.Rule = rr.NetworkRule.Text()
+		res.Reason = NotFilteredWhiteList
+		return res, nil
+	}
+
+	if customMatched {
+		return customRes, nil
+	}
+
 	if rr.NetworkRule != nil {
 		log.Debug("Filtering: found rule for host '%s': '%s'  list_id: %d",
 			host, rr.NetworkRule.Text(), rr.NetworkRule.GetFilterListID())
@@ -550,33 +862,25 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result
 }
 
 // New creates properly initialized DNS Filter that is ready to be used
+// It's NewWithOptions() without options.
 func New(c *Config, filters map[int]string) *Dnsfilter {
+	return NewWithOptions(c, filters)
+}
 
-	if c != nil {
-		cacheConf := cache.Config{
-			EnableLRU: true,
-		}
-
-		// initialize objects only once
-
-		if gctx.safebrowsingCache == nil {
-			cacheConf.MaxSize = c.SafeBrowsingCacheSize
-			gctx.safebrowsingCache = cache.New(cacheConf)
-		}
-
-		if gctx.safeSearchCache == nil {
-			cacheConf.MaxSize = c.SafeSearchCacheSize
-			gctx.safeSearchCache = cache.New(cacheConf)
-		}
-
-		if gctx.parentalCache == nil {
-			cacheConf.MaxSize = c.ParentalCacheSize
-			gctx.parentalCache = cache.New(cacheConf)
-		}
+// NewWithOptions creates DNS Filter with the specified options (e.g. WithCacheSizes())
+func NewWithOptions(c *Config, filters map[int]string, opts ...Option) *Dnsfilter {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
 	d := new(Dnsfilter)
 
+	d.initCaches(c, &o)
+	if c != nil && c.ResultCacheSize != 0 {
+		d.resultCache = newResultCache(int(c.ResultCacheSize))
+	}
+
 	err := d.initSecurityServices()
 	if err != nil {
 		log.Error("dnsfilter: initialize services: %s", err)
@@ -586,10 +890,13 @@ func New(c *Config, filters map[int]string) *Dnsfilter {
 	if c != nil {
 		d.Config = *c
 		d.prepareRewrites()
+		d.prepareScripts()
+		d.initVerdictProvider()
+		d.loadCaches()
 	}
 
 	if filters != nil {
-		err := d.initFiltering(filters)
+		err := d.reloadFilters(filters)
 		if err != nil {
 			log.Error("Can't initialize filtering subsystem: %s", err)
 			d.Close()
@@ -607,9 +914,18 @@ func (d *Dnsfilter) Start() {
 	d.filtersInitializerChan = make(chan filtersInitializerParams, 1)
 	go d.filtersInitializer()
 
+	if len(d.Config.CacheFilePath) != 0 {
+		d.cacheSaveStop = make(chan bool)
+		go d.periodicCacheSave(d.cacheSaveStop)
+	}
+
 	if d.Config.HTTPRegister != nil { // for tests
 		d.registerSecurityHandlers()
 		d.registerRewritesHandlers()
+		d.registerScriptsHandlers()
+		d.registerPauseHandlers()
+		d.registerLookupStatsHandlers()
+		d.registerReloadStatusHandlers()
 	}
 }
 
@@ -619,5 +935,19 @@ func (d *Dnsfilter) Start() {
 
 // GetStats return dns filtering stats since startup
 func (d *Dnsfilter) GetStats() Stats {
-	return gctx.stats
+	return Stats{
+		Safebrowsing: d.stats.Safebrowsing.load(),
+		Parental:     d.stats.Parental.load(),
+		Safesearch:   d.stats.Safesearch.load(),
+		Clients:      d.getClientStats(),
+	}
+}
+
+// GetEngineStats return the information about filtering engine reloads
+func (d *Dnsfilter) GetEngineStats() EngineStats {
+	d.engineLock.RLock()
+	st := d.engineStats
+	d.engineLock.RUnlock()
+	st.PrefilterSkips = atomic.LoadUint64(&d.prefilterSkips)
+	return st
 }
@@ -1,15 +1,31 @@
 package dnsfilter
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var setts RequestFilteringSettings
@@ -18,23 +34,13 @@ var setts RequestFilteringSettings
 // SAFE BROWSING
 // SAFE SEARCH
 // PARENTAL
+// EXTERNAL VERDICT
 // FILTERING
+// SCRIPTS
 // BENCHMARKS
 
 // HELPERS
 
-func purgeCaches() {
-	if gctx.safebrowsingCache != nil {
-		gctx.safebrowsingCache.Clear()
-	}
-	if gctx.parentalCache != nil {
-		gctx.parentalCache.Clear()
-	}
-	if gctx.safeSearchCache != nil {
-		gctx.safeSearchCache.Clear()
-	}
-}
-
 func _Func() string {
 	pc := make([]uintptr, 10) // at least 1 entry needed
 	runtime.Callers(2, pc)
@@ -54,9 +60,7 @@ func NewForTest(c *Config, filters map[int]string) *Dnsfilter {
 		setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
 		setts.ParentalEnabled = c.ParentalEnabled
 	}
-	d := New(c, filters)
-	purgeCaches()
-	return d
+	return New(c, filters)
 }
 
 func (d *Dnsfilter) checkMatch(t *testing.T, hostname string) {
@@ -147,7 +151,6 @@ func TestEtcHostsMatching(t *testing.T) {
 func TestSafeBrowsing(t *testing.T) {
 	d := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
 	defer d.Close()
-	gctx.stats.Safebrowsing.Requests = 0
 	d.checkMatch(t, "wmconvirus.narod.ru")
 	d.checkMatch(t, "test.wmconvirus.narod.ru")
 	d.checkMatchEmpty(t, "yandex.ru")
@@ -160,6 +163,297 @@ func TestSafeBrowsing(t *testing.T) {
 	d.safeBrowsingServer = defaultSafebrowsingServer
 }
 
+func TestSeparateInstances(t *testing.T) {
+	d1 := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
+	defer d1.Close()
+	d2 := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
+	defer d2.Close()
+
+	d1.setCacheResult(d1.safebrowsingCache, "example.org", Result{IsFiltered: true, Reason: FilteredSafeBrowsing})
+	_, ok := getCachedResult(d2.safebrowsingCache, "example.org")
+	assert.False(t, ok)
+
+	r, err := d1.checkSafeBrowsing(context.Background(), "example.org", "")
+	assert.Nil(t, err)
+	assert.True(t, r.IsFiltered)
+	assert.Equal(t, uint64(1), d1.GetStats().Safebrowsing.CacheHits)
+	assert.Equal(t, uint64(0), d2.GetStats().Safebrowsing.CacheHits)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	// the caches are created without Config
+	d := New(nil, nil)
+	defer d.Close()
+	assert.NotNil(t, d.safebrowsingCache)
+	assert.NotNil(t, d.safeSearchCache)
+	assert.NotNil(t, d.parentalCache)
+	d.setCacheResult(d.safeSearchCache, "example.org", Result{IsFiltered: true})
+	assert.NotNil(t, d.safeSearchCache.Get([]byte("example.org")))
+
+	// shared caches
+	d1 := NewWithOptions(&Config{}, nil, WithCacheSizes(1000, 1000, 1000))
+	defer d1.Close()
+	d2 := NewWithOptions(&Config{}, nil, WithCaches(d1.safebrowsingCache, nil, nil))
+	defer d2.Close()
+	_ = d1.safebrowsingCache.Set([]byte("example.org"), []byte("value"))
+	assert.NotNil(t, d2.safebrowsingCache.Get([]byte("example.org")))
+	_ = d1.parentalCache.Set([]byte("example.org"), []byte("value"))
+	assert.Nil(t, d2.parentalCache.Get([]byte("example.org")))
+
+	assert.Equal(t, uint(1000), cacheSize(1000, 2000))
+	assert.Equal(t, uint(2000), cacheSize(0, 2000))
+	assert.Equal(t, uint(0), cacheSize(0, 0))
+}
+
+func TestClientLookupStats(t *testing.T) {
+	d := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
+	defer d.Close()
+
+	d.setCacheResult(d.safebrowsingCache, "example.org", Result{IsFiltered: true, Reason: FilteredSafeBrowsing})
+	_, _ = d.checkSafeBrowsing(context.Background(), "example.org", "1.2.3.4")
+	_, _ = d.checkSafeBrowsing(context.Background(), "example.org", "1.2.3.4")
+	_, _ = d.checkSafeBrowsing(context.Background(), "example.org", "1.1.1.1")
+	d.countLookup(svcParental, "1.1.1.1", false)
+
+	st := d.GetStats()
+	assert.Equal(t, uint64(3), st.Safebrowsing.CacheHits)
+	assert.Equal(t, uint64(1), st.Parental.Requests)
+	assert.Equal(t, 2, len(st.Clients))
+	assert.Equal(t, uint64(2), st.Clients["1.2.3.4"].Safebrowsing.CacheHits)
+	assert.Equal(t, uint64(1), st.Clients["1.1.1.1"].Safebrowsing.CacheHits)
+	assert.Equal(t, uint64(1), st.Clients["1.1.1.1"].Parental.Requests)
+
+	d.ResetStats()
+	st = d.GetStats()
+	assert.Equal(t, uint64(0), st.Safebrowsing.CacheHits)
+	assert.Equal(t, 0, len(st.Clients))
+}
+
+// Returns TXT record with the full hash of "bad.example.org" for every request
+type sbUpstream struct {
+	lock      sync.Mutex
+	questions []string
+	unblock   chan struct{} // the requests wait until it's closed
+}
+
+func (u *sbUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	<-u.unblock
+	u.lock.Lock()
+	u.questions = append(u.questions, m.Question[0].Name)
+	u.lock.Unlock()
+
+	sum := sha256.Sum256([]byte("bad.example.org"))
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{hex.EncodeToString(sum[:])},
+	})
+	return resp, nil
+}
+
+func (u *sbUpstream) Address() string {
+	return "test"
+}
+
+func TestSafeBrowsingCoalescing(t *testing.T) {
+	d := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
+	defer d.Close()
+	u := &sbUpstream{unblock: make(chan struct{})}
+	d.safeBrowsingUpstream = u
+
+	const n = 5
+	results := make(chan Result, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			r, _ := d.checkSafeBrowsing(context.Background(), "bad.example.org", "")
+			results <- r
+		}()
+	}
+	for atomic.LoadUint64(&d.stats.Safebrowsing.Coalesced) != n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(u.unblock)
+	for i := 0; i < n; i++ {
+		r := <-results
+		assert.True(t, r.IsFiltered)
+		assert.Equal(t, FilteredSafeBrowsing, r.Reason)
+	}
+
+	st := d.GetStats()
+	assert.Equal(t, uint64(n), st.Safebrowsing.Requests)
+	assert.Equal(t, uint64(1), st.Safebrowsing.Upstream)
+	assert.Equal(t, int64(1), st.Safebrowsing.PendingMax)
+	assert.Equal(t, int64(0), st.Safebrowsing.Pending)
+	assert.Equal(t, 1, len(u.questions))
+
+	// cached result
+	r, _ := d.checkSafeBrowsing(context.Background(), "bad.example.org", "")
+	assert.True(t, r.IsFiltered)
+	assert.Equal(t, uint64(1), d.GetStats().Safebrowsing.CacheHits)
+}
+
+func TestSafeBrowsingBatching(t *testing.T) {
+	d := NewForTest(&Config{SafeBrowsingEnabled: true, LookupBatchWindow: 100}, nil)
+	defer d.Close()
+	u := &sbUpstream{unblock: make(chan struct{})}
+	close(u.unblock)
+	d.safeBrowsingUpstream = u
+
+	hosts := []string{"bad.example.org", "good.example.org", "example.org"}
+	results := make(chan Result, len(hosts))
+	for _, host := range hosts {
+		go func(host string) {
+			r, _ := d.checkSafeBrowsing(context.Background(), host, "")
+			if r.IsFiltered {
+				r.Rule = host
+			}
+			results <- r
+		}(host)
+	}
+	filtered := []string{}
+	for range hosts {
+		r := <-results
+		if r.IsFiltered {
+			filtered = append(filtered, r.Rule)
+		}
+	}
+	assert.Equal(t, []string{"bad.example.org"}, filtered)
+
+	// one request with 3 hash prefixes: bad.example.org, good.example.org, example.org
+	assert.Equal(t, 1, len(u.questions))
+	prefixes := strings.Split(strings.TrimSuffix(u.questions[0], "."+sbTXTSuffix), ".")
+	assert.Equal(t, 3, len(prefixes))
+	assert.Equal(t, uint64(1), d.GetStats().Safebrowsing.Upstream)
+}
+
+func TestPersistentCache(t *testing.T) {
+	fn := "sbpc_cache_test.db"
+	defer func() { _ = os.Remove(fn) }()
+
+	d := NewForTest(&Config{CacheFilePath: fn}, nil)
+	d.setCacheResult(d.safebrowsingCache, "sb.example.org", Result{IsFiltered: true, Reason: FilteredSafeBrowsing})
+	d.setCacheResult(d.parentalCache, "pc.example.org", Result{IsFiltered: true, Reason: FilteredParental})
+	d.Close()
+
+	d = NewForTest(&Config{CacheFilePath: fn}, nil)
+	defer d.Close()
+	r, ok := getCachedResult(d.safebrowsingCache, "sb.example.org")
+	assert.True(t, ok && r.Reason == FilteredSafeBrowsing)
+	r, ok = getCachedResult(d.parentalCache, "pc.example.org")
+	assert.True(t, ok && r.Reason == FilteredParental)
+	_, ok = getCachedResult(d.safebrowsingCache, "pc.example.org")
+	assert.False(t, ok)
+}
+
+func TestCheckHostCtx(t *testing.T) {
+	filters := map[int]string{0: "||example.org^\n"}
+	d := NewForTest(&Config{SafeBrowsingEnabled: true}, filters)
+	defer d.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// local filters don't need network requests
+	r, err := d.CheckHostCtx(ctx, "example.org", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.True(t, r.IsFiltered)
+
+	_, err = d.CheckHostCtx(ctx, "wmconvirus.narod.ru", dns.TypeA, &setts)
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = d.CheckHostCtx(ctx, "wmconvirus.narod.ru", dns.TypeA, &setts)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestPause(t *testing.T) {
+	filters := map[int]string{0: "||example.org^\n||example.com^\n"}
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	d.addPause(Pause{Client: "1.2.3.4", Until: time.Now().Add(time.Hour)})
+	d.addPause(Pause{Host: "example.com", Until: time.Now().Add(100 * time.Millisecond)})
+	assert.Equal(t, 2, len(d.GetConfig().Pauses))
+
+	s := d.GetConfig()
+	s.FilteringEnabled = true
+	s.ClientIP = "1.2.3.4"
+	r, _ := d.CheckHost("example.org", dns.TypeA, &s)
+	assert.False(t, r.IsFiltered)
+	assert.Equal(t, NotFilteredPaused, r.Reason)
+
+	s.ClientIP = "1.1.1.1"
+	r, _ = d.CheckHost("example.org", dns.TypeA, &s)
+	assert.True(t, r.IsFiltered)
+	r, _ = d.CheckHost("www.example.com", dns.TypeA, &s)
+	assert.Equal(t, NotFilteredPaused, r.Reason)
+
+	// the pause for the host has expired and is removed by the scheduler
+	time.Sleep(200 * time.Millisecond)
+	d.pauses.lock.Lock()
+	assert.Equal(t, 1, len(d.pauses.list))
+	d.pauses.lock.Unlock()
+	s = d.GetConfig()
+	s.FilteringEnabled = true
+	s.ClientIP = "1.1.1.1"
+	r, _ = d.CheckHost("www.example.com", dns.TypeA, &s)
+	assert.True(t, r.IsFiltered)
+
+	assert.True(t, d.delPause("1.2.3.4", ""))
+	assert.False(t, d.delPause("1.2.3.4", ""))
+	assert.Equal(t, 0, len(d.GetConfig().Pauses))
+}
+
+func TestAllowlistOnly(t *testing.T) {
+	filters := map[int]string{0: "@@||allowed.org^\n||blocked.org^\n@@||both.org^\n||both.org^\n"}
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	s := d.GetConfig()
+	s.AllowlistOnly = true
+	r, _ := d.CheckHost("allowed.org", dns.TypeA, &s)
+	assert.False(t, r.IsFiltered)
+	assert.Equal(t, NotFilteredWhiteList, r.Reason)
+	r, _ = d.CheckHost("both.org", dns.TypeA, &s)
+	assert.False(t, r.IsFiltered)
+	r, _ = d.CheckHost("blocked.org", dns.TypeA, &s)
+	assert.True(t, r.IsFiltered)
+	r, _ = d.CheckHost("example.org", dns.TypeA, &s)
+	assert.True(t, r.IsFiltered)
+	assert.Equal(t, FilteredNotInAllowList, r.Reason)
+
+	s.AllowlistOnly = false
+	s.FilteringEnabled = true
+	r, _ = d.CheckHost("example.org", dns.TypeA, &s)
+	assert.False(t, r.IsFiltered)
+}
+
+func TestRulesExpiry(t *testing.T) {
+	expiredCh := make(chan []string, 1)
+	d := NewForTest(&Config{UserRulesExpired: func(rules []string) { expiredCh <- rules }}, nil)
+	defer d.Close()
+
+	d.SetRulesExpiry([]RuleExpiry{
+		{Rule: "||example.org^", Until: time.Now().Add(100 * time.Millisecond)},
+		{Rule: "||example.com^", Until: time.Now().Add(time.Hour)},
+	})
+
+	select {
+	case expired := <-expiredCh:
+		assert.Equal(t, []string{"||example.org^"}, expired)
+	case <-time.After(time.Second):
+		t.Fatalf("rules didn't expire")
+	}
+
+	d.rulesExpiry.lock.Lock()
+	assert.Equal(t, 1, len(d.rulesExpiry.list))
+	assert.NotNil(t, d.rulesExpiry.timer)
+	d.rulesExpiry.lock.Unlock()
+}
+
 func TestParallelSB(t *testing.T) {
 	d := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
 	defer d.Close()
@@ -261,7 +555,7 @@ func TestSafeSearchCacheYandex(t *testing.T) {
 	}
 
 	// Check cache
-	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, domain)
+	cachedValue, isFound := getCachedResult(d.safeSearchCache, domain)
 
 	if !isFound {
 		t.Fatalf("Safesearch cache doesn't work for %s!", domain)
@@ -318,7 +612,7 @@ func TestSafeSearchCacheGoogle(t *testing.T) {
 	}
 
 	// Check cache
-	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, domain)
+	cachedValue, isFound := getCachedResult(d.safeSearchCache, domain)
 
 	if !isFound {
 		t.Fatalf("Safesearch cache doesn't work for %s!", domain)
@@ -347,6 +641,144 @@ func TestParentalControl(t *testing.T) {
 	d.parentalServer = defaultParentalServer
 }
 
+// EXTERNAL VERDICT
+
+type testVerdictProvider struct {
+	requests int
+	err      error
+}
+
+func (p *testVerdictProvider) Verdict(ctx context.Context, host string, qtype uint16) (ExternalVerdict, error) {
+	p.requests++
+	if p.err != nil {
+		return ExternalVerdict{}, p.err
+	}
+	return ExternalVerdict{Block: host == "bad.example.org", Category: "malware"}, nil
+}
+
+func TestExternalVerdict(t *testing.T) {
+	p := &testVerdictProvider{}
+	filters := map[int]string{0: "@@||bad.example.org^$important\n||blocked.example.org^\n"}
+	d := NewForTest(&Config{VerdictProvider: p}, filters)
+	defer d.Close()
+
+	// not checked: the hosts are matched by filters
+	d.checkMatch(t, "blocked.example.org")
+	d.checkMatchEmpty(t, "bad.example.org")
+	assert.Equal(t, 0, p.requests)
+
+	setts.FilteringEnabled = false
+	r, _ := d.CheckHost("bad.example.org", dns.TypeA, &setts)
+	assert.True(t, r.IsFiltered && r.Reason == FilteredExternal && r.Rule == "malware")
+	assert.Equal(t, 1, p.requests)
+
+	// cached result
+	r, _ = d.CheckHost("bad.example.org", dns.TypeA, &setts)
+	assert.True(t, r.IsFiltered && r.Reason == FilteredExternal)
+	assert.Equal(t, 1, p.requests)
+
+	d.checkMatchEmpty(t, "good.example.org")
+	assert.Equal(t, 2, p.requests)
+
+	// fail open
+	p.err = errors.New("unavailable")
+	d.checkMatchEmpty(t, "other.example.org")
+
+	// fail closed
+	d.Config.VerdictFailClosed = true
+	d.checkMatch(t, "another.example.org")
+}
+
+func TestHTTPVerdictProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/verdict" {
+			http.NotFound(w, r)
+			return
+		}
+		req := verdictRequest{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		v := ExternalVerdict{Block: req.Host == "bad.example.org" && req.QType == dns.TypeA, Score: 100}
+		_ = json.NewEncoder(w).Encode(v)
+	}))
+	defer srv.Close()
+
+	p := NewHTTPVerdictProvider(srv.URL+"/verdict", time.Second)
+	v, err := p.Verdict(context.Background(), "bad.example.org", dns.TypeA)
+	assert.Nil(t, err)
+	assert.True(t, v.Block && v.Score == 100)
+
+	v, err = p.Verdict(context.Background(), "good.example.org", dns.TypeA)
+	assert.Nil(t, err)
+	assert.False(t, v.Block)
+
+	p = NewHTTPVerdictProvider(srv.URL+"/unknown", time.Second)
+	_, err = p.Verdict(context.Background(), "bad.example.org", dns.TypeA)
+	assert.NotNil(t, err)
+}
+
+func TestGRPCVerdictProvider(t *testing.T) {
+	var grpcStatus string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcVerdictMethod || r.Header.Get("Content-Type") != "application/grpc" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		if grpcStatus != "0" {
+			w.Header().Set("Grpc-Status", grpcStatus)
+			w.Header().Set("Grpc-Message", "unavailable%20now")
+			return
+		}
+
+		// CheckRequest{host:"bad.example.org", qtype:1}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := append([]byte{0, 0, 0, 0, 19, 0x0a, 15}, "bad.example.org"...)
+		req = append(req, 0x10, 1)
+
+		resp := []byte{}
+		if bytes.Equal(body, req) {
+			// CheckResponse{block:true, category:"malware", score:-1}
+			resp = append([]byte{0x08, 1, 0x12, 7}, "malware"...)
+			resp = append(resp, 0x18, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)
+		}
+		_, _ = w.Write([]byte{0, 0, 0, 0, byte(len(resp))})
+		_, _ = w.Write(resp)
+		w.Header().Set("Grpc-Status", "0")
+	})
+	srv := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+	defer srv.Close()
+
+	addr, useTLS, ok := parseGRPCVerdictURL("grpc://" + srv.Listener.Addr().String())
+	assert.True(t, ok && !useTLS)
+	p := NewGRPCVerdictProvider(addr, useTLS, time.Second)
+
+	grpcStatus = "0"
+	v, err := p.Verdict(context.Background(), "bad.example.org", dns.TypeA)
+	assert.Nil(t, err)
+	assert.True(t, v.Block)
+	assert.Equal(t, "malware", v.Category)
+	assert.Equal(t, -1, v.Score)
+
+	v, err = p.Verdict(context.Background(), "good.example.org", dns.TypeA)
+	assert.Nil(t, err)
+	assert.False(t, v.Block)
+
+	grpcStatus = "14"
+	_, err = p.Verdict(context.Background(), "bad.example.org", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unavailable now")
+
+	_, _, ok = parseGRPCVerdictURL("https://example.org/verdict")
+	assert.False(t, ok)
+	addr, useTLS, ok = parseGRPCVerdictURL("grpcs://verdict.example.org:443")
+	assert.True(t, ok && useTLS)
+	assert.Equal(t, "verdict.example.org:443", addr)
+
+	_, err = decodeGRPCVerdict([]byte{0x12, 10, 'a'})
+	assert.NotNil(t, err)
+}
+
 // FILTERING
 
 var blockingRules = "||example.org^\n"
@@ -423,6 +855,350 @@ func TestMatching(t *testing.T) {
 	}
 }
 
+func TestDNSTypeRules(t *testing.T) {
+	filters := make(map[int]string)
+	filters[0] = `||example.org^$dnstype=AAAA
+||example.com^$dnstype=~A|~CNAME
+@@||test.example.org^$dnstype=AAAA
+$dnstype=HTTPS
+`
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	r, _ := d.CheckHost("example.org", dns.TypeA, &setts)
+	assert.False(t, r.IsFiltered)
+
+	r, _ = d.CheckHost("www.example.org", dns.TypeAAAA, &setts)
+	assert.True(t, r.IsFiltered && r.Reason == FilteredBlackList)
+	assert.Equal(t, "||example.org^$dnstype=AAAA", r.Rule)
+
+	r, _ = d.CheckHost("test.example.org", dns.TypeAAAA, &setts)
+	assert.True(t, !r.IsFiltered && r.Reason == NotFilteredWhiteList)
+
+	r, _ = d.CheckHost("example.com", dns.TypeA, &setts)
+	assert.False(t, r.IsFiltered)
+	r, _ = d.CheckHost("example.com", dns.TypeMX, &setts)
+	assert.True(t, r.IsFiltered)
+
+	// any host
+	r, _ = d.CheckHost("host.net", 65, &setts)
+	assert.True(t, r.IsFiltered && r.Rule == "$dnstype=HTTPS")
+	r, _ = d.CheckHost("host.net", dns.TypeA, &setts)
+	assert.False(t, r.IsFiltered)
+
+	_, err := newCustomRule("||example.org^$dnstype=A|~AAAA", 0)
+	assert.NotNil(t, err)
+	_, err = newCustomRule("||example.org^$dnstype=BADTYPE", 0)
+	assert.NotNil(t, err)
+}
+
+func TestCustomRuleSet(t *testing.T) {
+	var list []*customRule
+	for _, text := range []string{
+		"||example.org^$dnstype=AAAA",
+		"||Sub.Example.org^$dnstype=AAAA",
+		"@@||allow.example.org^$dnstype=AAAA",
+		"/ads[0-9]/$dnstype=AAAA",
+		"$dnstype=HTTPS",
+	} {
+		r, err := newCustomRule(text, 1)
+		assert.Nil(t, err)
+		list = append(list, r)
+	}
+	assert.Equal(t, "example.org", list[0].host)
+	assert.Equal(t, "sub.example.org", list[1].host)
+	assert.Equal(t, "", list[3].host)
+	assert.Equal(t, "", list[4].host)
+
+	s := newCustomRuleSet(list)
+	assert.Equal(t, 3, len(s.byHost))
+	assert.Equal(t, 2, len(s.other))
+
+	matched := func(host string, qtype uint16) []string {
+		var texts []string
+		s.forEachMatch(host, qtype, nil, func(r *customRule) bool {
+			texts = append(texts, r.text)
+			return true
+		})
+		return texts
+	}
+	assert.Equal(t, []string{"||Sub.Example.org^$dnstype=AAAA", "||example.org^$dnstype=AAAA"},
+		matched("www.sub.example.org", dns.TypeAAAA))
+	assert.Equal(t, []string{"/ads[0-9]/$dnstype=AAAA"}, matched("ads1.example.net", dns.TypeAAAA))
+	assert.Nil(t, matched("notexample.org", dns.TypeAAAA))
+	assert.Nil(t, matched("www.example.org", dns.TypeA))
+
+	// the first blocking rule in the list is used, whitelist rules have higher priority
+	d := NewForTest(nil, map[int]string{0: "||example.org^$dnstype=AAAA\n||sub.example.org^$dnstype=AAAA\n" +
+		"@@||allow.example.org^$dnstype=AAAA\n"})
+	defer d.Close()
+	r, _ := d.CheckHost("www.sub.example.org", dns.TypeAAAA, &setts)
+	assert.True(t, r.IsFiltered)
+	assert.Equal(t, "||example.org^$dnstype=AAAA", r.Rule)
+	r, _ = d.CheckHost("allow.example.org", dns.TypeAAAA, &setts)
+	assert.Equal(t, NotFilteredWhiteList, r.Reason)
+}
+
+func TestReadCustomRules(t *testing.T) {
+	// lines longer than the default bufio.Scanner limit are read
+	long := "! " + strings.Repeat("x", 100*1024) + "\n||example.org^$dnstype=AAAA\n"
+	list, err := readCustomRules(1, strings.NewReader(long))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+
+	// a line which is too long is an error rather than the end of data
+	tooLong := "! " + strings.Repeat("x", maxRuleLineLength) + "\n||example.org^$dnstype=AAAA\n"
+	_, err = readCustomRules(1, strings.NewReader(tooLong))
+	assert.NotNil(t, err)
+}
+
+func TestCtagExpressions(t *testing.T) {
+	filters := make(map[int]string)
+	filters[0] = `||pc.example.org^$ctag=device_pc&~user_admin
+||phone.example.org^$ctag=device_phone&os_android|device_tablet
+||any.example.org^$ctag=~user_child
+`
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	check := func(host string, ctags []string) bool {
+		s := setts
+		s.ClientTags = ctags
+		r, _ := d.CheckHost(host, dns.TypeA, &s)
+		return r.IsFiltered
+	}
+
+	assert.True(t, check("pc.example.org", []string{"device_pc"}))
+	assert.False(t, check("pc.example.org", []string{"device_pc", "user_admin"}))
+	assert.False(t, check("pc.example.org", nil))
+
+	assert.True(t, check("phone.example.org", []string{"device_phone", "os_android"}))
+	assert.False(t, check("phone.example.org", []string{"device_phone", "os_ios"}))
+	assert.True(t, check("phone.example.org", []string{"device_tablet"}))
+
+	assert.True(t, check("any.example.org", nil))
+	assert.False(t, check("any.example.org", []string{"user_child"}))
+
+	_, err := parseCtagExpr("device_pc&")
+	assert.NotNil(t, err)
+	_, err = parseCtagExpr("Device-PC")
+	assert.NotNil(t, err)
+}
+
+func TestCheckHostTrace(t *testing.T) {
+	filters := make(map[int]string)
+	filters[0] = "||example.org^\n@@||test.example.org^\n"
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	r, trace, err := d.CheckHostTrace(context.Background(), "test.example.org", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, NotFilteredWhiteList, r.Reason)
+	assert.Equal(t, 3, len(trace.Entries))
+	assert.Equal(t, TraceStageRewrites, trace.Entries[0].Stage)
+	assert.False(t, trace.Entries[0].Matched)
+	assert.Equal(t, TraceStageWhitelist, trace.Entries[1].Stage)
+	assert.True(t, trace.Entries[1].Matched)
+	assert.Equal(t, []string{"@@||test.example.org^"}, trace.Entries[1].Rules)
+	assert.Equal(t, TraceStageBlacklist, trace.Entries[2].Stage)
+	assert.False(t, trace.Entries[2].Matched)
+
+	r, trace, err = d.CheckHostTrace(context.Background(), "example.com", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.False(t, r.Reason.Matched())
+	assert.Equal(t, 7, len(trace.Entries))
+	for _, e := range trace.Entries {
+		assert.False(t, e.Matched)
+	}
+	assert.Equal(t, TraceStageParental, trace.Entries[6].Stage)
+	assert.False(t, trace.Entries[6].Enabled)
+}
+
+func TestResultCacheRevalidation(t *testing.T) {
+	filters := map[int]string{0: "||a.example.org^\n||b.example.org^\n"}
+	d := NewForTest(&Config{ResultCacheSize: 100}, filters)
+	defer d.Close()
+
+	for i := 0; i != 3; i++ {
+		d.checkMatch(t, "a.example.org")
+		d.checkMatch(t, "b.example.org")
+		d.checkMatchEmpty(t, "c.example.org")
+	}
+	assert.Equal(t, 3, len(d.resultCache.entries))
+
+	// the revalidation is also started in background, but it makes the same changes
+	assert.Nil(t, d.SetFilters(map[int]string{0: "||a.example.org^\n||c.example.org^\n"}, false))
+	d.revalidateResultCache(d.resultCache, atomic.LoadUint64(&d.filtersGen))
+
+	// a.example.org is still valid, the others are evicted
+	assert.Equal(t, 1, len(d.resultCache.entries))
+	_, ok := d.resultCache.get(resultCacheKey("a.example.org", dns.TypeA, nil), atomic.LoadUint64(&d.filtersGen))
+	assert.True(t, ok)
+
+	d.checkMatch(t, "a.example.org")
+	d.checkMatchEmpty(t, "b.example.org")
+	d.checkMatch(t, "c.example.org")
+}
+
+func TestHostPrefilter(t *testing.T) {
+	hosts, simple := parsePrefilterRule("||Example.org^")
+	assert.True(t, simple)
+	assert.Equal(t, []string{"example.org"}, hosts)
+	hosts, simple = parsePrefilterRule("0.0.0.0 a.example.com b.example.com # comment")
+	assert.True(t, simple)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, hosts)
+	_, simple = parsePrefilterRule("! comment")
+	assert.True(t, simple)
+	for _, rule := range []string{"||example.org", "||example.org^$important", "@@||example.org^",
+		"||*.example.org^", "/example/", "example.org", "||.example.org^"} {
+		_, simple = parsePrefilterRule(rule)
+		assert.False(t, simple, rule)
+	}
+
+	filters := map[int]string{0: "||example.org^\n@@||allowed.example.org^\n" +
+		"0.0.0.0 host.example.com\n||example.net^\n/regex[0-9]\\./\n"}
+	d := NewForTest(&Config{HostPrefilter: true}, filters)
+	defer d.Close()
+	d2 := NewForTest(nil, filters)
+	defer d2.Close()
+	assert.Equal(t, 3, d.GetEngineStats().PrefilterHosts)
+	assert.Equal(t, 2, d.GetEngineStats().PrefilterRules)
+
+	// the results are the same as without the prefilter
+	for _, host := range []string{"example.org", "sub.example.org", "allowed.example.org",
+		"host.example.com", "sub.host.example.com", "example.net", "regex1.com", "example.com"} {
+		r, err := d.matchHost(host, dns.TypeA, nil)
+		assert.Nil(t, err)
+		r2, err := d2.matchHost(host, dns.TypeA, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, r2, r, host)
+	}
+	assert.True(t, d.GetEngineStats().PrefilterSkips >= 2)
+}
+
+func TestEngineMemoryBudget(t *testing.T) {
+	big := strings.Builder{}
+	for i := 0; i != 5000; i++ {
+		big.WriteString(fmt.Sprintf("||host%d.example.org^\n", i))
+	}
+	files := map[int]string{
+		1: "! comment\nexample.org##.banner\n0.0.0.0 b.example.org c.example.org\n",
+		2: big.String(),
+		3: "||d.example.org^\n",
+	}
+	filters := map[int]string{0: "||a.example.org^\n"}
+	for id, data := range files {
+		fn := fmt.Sprintf("memory_test_%d.txt", id)
+		assert.Nil(t, ioutil.WriteFile(fn, []byte(data), 0644))
+		defer func(fn string) { _ = os.Remove(fn) }(fn)
+		filters[id] = fn
+	}
+
+	d := NewForTest(&Config{EngineMemoryLimit: 1}, filters)
+	defer d.Close()
+
+	d.checkMatch(t, "a.example.org")
+	d.checkMatch(t, "b.example.org")
+	d.checkMatchEmpty(t, "host1.example.org")
+	d.checkMatch(t, "d.example.org")
+
+	m := d.GetFiltersMemory()
+	assert.Equal(t, 4, len(m))
+	assert.Equal(t, uint64(17+networkRuleMemory+16), m[0].Bytes)
+	assert.Equal(t, uint64(2*hostRuleMemory), m[1].Bytes)
+	assert.Equal(t, 1, m[1].Rules)
+	assert.Equal(t, 5000, m[2].Rules)
+	assert.Contains(t, m[2].Error, "memory budget exceeded")
+	assert.Equal(t, "", m[3].Error)
+	assert.Equal(t, m[0].Bytes+m[1].Bytes+m[3].Bytes, d.GetEngineStats().MemoryUsage)
+}
+
+func TestSnapshotFilterFile(t *testing.T) {
+	fn := "snapshot_test.txt"
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("||example.org^\n"), 0644))
+	defer func() { _ = os.Remove(fn) }()
+
+	copyFn, err := snapshotFilterFile(fn)
+	assert.Nil(t, err)
+	assert.NotEqual(t, fn, copyFn)
+	data, err := ioutil.ReadFile(copyFn)
+	assert.Nil(t, err)
+	assert.Equal(t, "||example.org^\n", string(data))
+
+	removeSnapshots([]string{copyFn})
+	assert.False(t, fileExists(copyFn))
+
+	_, err = snapshotFilterFile("nonexistent.txt")
+	assert.NotNil(t, err)
+}
+
+func TestLoadRuleLists(t *testing.T) {
+	fn := "load_rule_lists_test.txt"
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("||example.org^\n||example.net^$dnstype=AAAA\n"), 0644))
+	defer func() { _ = os.Remove(fn) }()
+
+	lists, err := loadRuleLists(map[int]string{
+		0: "||example.com^$dnstype=A\n",
+		1: fn,
+		2: "nonexistent.txt",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(lists.lists))
+	assert.Equal(t, 2, len(lists.customRules))
+	for _, l := range lists.lists {
+		_ = l.Close()
+	}
+	removeSnapshots(lists.snapshots)
+}
+
+func TestFilteringStatus(t *testing.T) {
+	d := NewForTest(nil, map[int]string{0: "! comment\n||a.example.org^\n||b.example.org^\n"})
+	defer d.Close()
+
+	st := d.GetFilteringStatus()
+	assert.False(t, st.Reloading)
+	assert.False(t, st.LastReload.IsZero())
+	assert.Equal(t, 1, st.Lists)
+	assert.Equal(t, 2, st.Rules)
+	assert.Equal(t, "", st.LastError)
+
+	err := d.runReload(func() error { return errors.New("test error") })
+	assert.NotNil(t, err)
+	err = d.runReload(func() error { panic("test panic") })
+	assert.NotNil(t, err)
+	st = d.GetFilteringStatus()
+	assert.Equal(t, "panic: test panic", st.LastError)
+	assert.Equal(t, uint64(2), st.Failures)
+	assert.Equal(t, 2, st.Rules)
+
+	// the initializer works after a failure
+	assert.Nil(t, d.SetFilters(map[int]string{0: "||c.example.org^\n"}, false))
+	d.checkMatch(t, "c.example.org")
+	st = d.GetFilteringStatus()
+	assert.Equal(t, "", st.LastError)
+	assert.Equal(t, 1, st.Rules)
+	assert.Equal(t, uint64(2), st.Failures)
+
+	// overlapping reloads: the status is "reloading" until the last one finishes
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = d.runReload(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+		close(done)
+	}()
+	<-started
+	_ = d.runReload(func() error { return nil })
+	assert.True(t, d.GetFilteringStatus().Reloading)
+	close(release)
+	<-done
+	assert.False(t, d.GetFilteringStatus().Reloading)
+}
+
 // CLIENT SETTINGS
 
 func applyClientSettings(setts *RequestFilteringSettings) {
@@ -500,13 +1276,13 @@ func TestRewrites(t *testing.T) {
 	d := Dnsfilter{}
 	// CNAME, A, AAAA
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"somecname", "somehost.com", 0, nil},
-		RewriteEntry{"somehost.com", "0.0.0.0", 0, nil},
+		RewriteEntry{Domain: "somecname", Answer: "somehost.com"},
+		RewriteEntry{Domain: "somehost.com", Answer: "0.0.0.0"},
 
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"host.com", "1.2.3.5", 0, nil},
-		RewriteEntry{"host.com", "1:2:3::4", 0, nil},
-		RewriteEntry{"www.host.com", "host.com", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.5"},
+		RewriteEntry{Domain: "host.com", Answer: "1:2:3::4"},
+		RewriteEntry{Domain: "www.host.com", Answer: "host.com"},
 	}
 	d.prepareRewrites()
 	r := d.processRewrites("host2.com", dns.TypeA)
@@ -526,8 +1302,8 @@ func TestRewrites(t *testing.T) {
 
 	// wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "1.2.3.5", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "1.2.3.5"},
 	}
 	d.prepareRewrites()
 	r = d.processRewrites("host.com", dns.TypeA)
@@ -543,8 +1319,8 @@ func TestRewrites(t *testing.T) {
 
 	// override a wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"a.host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "1.2.3.5", 0, nil},
+		RewriteEntry{Domain: "a.host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "1.2.3.5"},
 	}
 	d.prepareRewrites()
 	r = d.processRewrites("a.host.com", dns.TypeA)
@@ -554,8 +1330,8 @@ func TestRewrites(t *testing.T) {
 
 	// wildcard + CNAME
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "host.com", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "host.com"},
 	}
 	d.prepareRewrites()
 	r = d.processRewrites("www.host.com", dns.TypeA)
@@ -565,9 +1341,9 @@ func TestRewrites(t *testing.T) {
 
 	// 2 CNAMEs
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"b.host.com", "a.host.com", 0, nil},
-		RewriteEntry{"a.host.com", "host.com", 0, nil},
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
+		RewriteEntry{Domain: "b.host.com", Answer: "a.host.com"},
+		RewriteEntry{Domain: "a.host.com", Answer: "host.com"},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
 	}
 	d.prepareRewrites()
 	r = d.processRewrites("b.host.com", dns.TypeA)
@@ -578,9 +1354,9 @@ func TestRewrites(t *testing.T) {
 
 	// 2 CNAMEs + wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"b.host.com", "a.host.com", 0, nil},
-		RewriteEntry{"a.host.com", "x.somehost.com", 0, nil},
-		RewriteEntry{"*.somehost.com", "1.2.3.4", 0, nil},
+		RewriteEntry{Domain: "b.host.com", Answer: "a.host.com"},
+		RewriteEntry{Domain: "a.host.com", Answer: "x.somehost.com"},
+		RewriteEntry{Domain: "*.somehost.com", Answer: "1.2.3.4"},
 	}
 	d.prepareRewrites()
 	r = d.processRewrites("b.host.com", dns.TypeA)
@@ -590,6 +1366,277 @@ func TestRewrites(t *testing.T) {
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
 }
 
+func TestRewritesView(t *testing.T) {
+	d := NewForTest(nil, nil)
+	defer d.Close()
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "nas.host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "www.host.com", Answer: "1.2.3.5"},
+	}
+	d.prepareRewrites()
+
+	s := RequestFilteringSettings{
+		Rewrites: PrepareRewrites([]RewriteEntry{
+			RewriteEntry{Domain: "NAS.host.com", Answer: "10.8.0.10"},
+		}),
+	}
+	r, err := d.CheckHost("nas.host.com", dns.TypeA, &s)
+	assert.Nil(t, err)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("10.8.0.10")))
+
+	// the global rewrites are used for the other hosts
+	r, err = d.CheckHost("www.host.com", dns.TypeA, &s)
+	assert.Nil(t, err)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.5")))
+}
+
+func TestRewritesBulk(t *testing.T) {
+	d := NewForTest(nil, nil)
+	defer d.Close()
+	modified := 0
+	d.Config.ConfigModified = func() { modified++ }
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+	}
+	d.prepareRewrites()
+
+	put := func(body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/control/rewrite/bulk", strings.NewReader(body))
+		d.handleRewriteBulkPut(w, r)
+		return w.Code
+	}
+
+	// the table isn't changed if any entry is invalid
+	assert.Equal(t, http.StatusBadRequest, put(`[{"domain":"a.lan","answer":"1.1.1.1"},{"domain":"b lan","answer":"1.1.1.1"}]`))
+	assert.Equal(t, http.StatusBadRequest, put(`[{"domain":"a.lan","answer":"bad host!"}]`))
+	assert.Equal(t, http.StatusBadRequest, put(`[{"domain":"a.lan","answer":"1.1.1.1"},{"domain":"A.lan","answer":"1.1.1.1"}]`))
+	assert.Equal(t, http.StatusBadRequest, put(`{}`))
+	assert.Equal(t, 0, modified)
+	assert.Equal(t, 1, len(d.Rewrites))
+
+	assert.Equal(t, http.StatusOK, put(`[{"domain":"*.LAN","answer":"192.168.1.1"},{"domain":"nas.lan","answer":"nas.example.org"}]`))
+	assert.Equal(t, 1, modified)
+	r := d.processRewrites("www.lan", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("192.168.1.1")))
+	r = d.processRewrites("host.com", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+
+	w := httptest.NewRecorder()
+	d.handleRewriteList(w, httptest.NewRequest("GET", "/control/rewrite/bulk", nil))
+	assert.JSONEq(t, `[{"domain":"*.lan","answer":"192.168.1.1","priority":0,"exception":false,"ttl":0},`+
+		`{"domain":"nas.lan","answer":"nas.example.org","priority":0,"exception":false,"ttl":0}]`, w.Body.String())
+
+	// exceptions can't have an answer
+	assert.Equal(t, http.StatusBadRequest, put(`[{"domain":"nas.lan","answer":"1.1.1.1","exception":true}]`))
+	assert.Equal(t, http.StatusBadRequest, put(`[{"domain":"nas.lan","answer":"1.1.1.1","ttl":4294967295}]`))
+	assert.Equal(t, http.StatusOK, put(`[{"domain":"nas.lan","answer":"","exception":true,"priority":1}]`))
+	assert.True(t, d.Rewrites[0].Exception)
+	assert.Equal(t, 1, d.Rewrites[0].Priority)
+
+	// empty table
+	assert.Equal(t, http.StatusOK, put(`[]`))
+	assert.Equal(t, 0, len(d.Rewrites))
+}
+
+func TestRewritesPriority(t *testing.T) {
+	d := Dnsfilter{}
+
+	// exception overrides a wildcard
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "*.lan", Answer: "192.168.1.1"},
+		RewriteEntry{Domain: "nas.lan", Exception: true},
+	}
+	d.prepareRewrites()
+	r := d.processRewrites("nas.lan", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	r = d.processRewrites("www.lan", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("192.168.1.1")))
+
+	// the most specific wildcard is used
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "*.lan", Answer: "192.168.1.1"},
+		RewriteEntry{Domain: "*.home.lan", Answer: "192.168.2.1"},
+		RewriteEntry{Domain: "*.guest.home.lan", Exception: true},
+	}
+	d.prepareRewrites()
+	r = d.processRewrites("pc.home.lan", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, len(r.IPList) == 1)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("192.168.2.1")))
+	r = d.processRewrites("pc.guest.home.lan", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+
+	// an entry with higher priority overrides an exact match
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "nas.lan", Answer: "192.168.1.2"},
+		RewriteEntry{Domain: "*.lan", Answer: "192.168.1.1", Priority: 10},
+	}
+	d.prepareRewrites()
+	r = d.processRewrites("nas.lan", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, len(r.IPList) == 1)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("192.168.1.1")))
+
+	// an exception with higher priority
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "nas.lan", Answer: "192.168.1.2"},
+		RewriteEntry{Domain: "*.lan", Exception: true, Priority: 1},
+	}
+	d.prepareRewrites()
+	r = d.processRewrites("nas.lan", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+}
+
+func TestRewritesTTL(t *testing.T) {
+	d := Dnsfilter{}
+	d.Rewrites = []RewriteEntry{
+		RewriteEntry{Domain: "a.lan", Answer: "192.168.1.1"},
+		RewriteEntry{Domain: "b.lan", Answer: "192.168.1.2", TTL: 300},
+		RewriteEntry{Domain: "c.lan", Answer: "b.lan", TTL: 60},
+		RewriteEntry{Domain: "d.lan", Answer: "b.lan"},
+	}
+	d.prepareRewrites()
+
+	// 0: the global setting is used
+	r := d.processRewrites("a.lan", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, uint32(0), r.TTL)
+
+	r = d.processRewrites("b.lan", dns.TypeA)
+	assert.Equal(t, uint32(300), r.TTL)
+
+	// the minimum TTL of CNAME and A entries
+	r = d.processRewrites("c.lan", dns.TypeA)
+	assert.Equal(t, "b.lan", r.CanonName)
+	assert.Equal(t, uint32(60), r.TTL)
+
+	r = d.processRewrites("d.lan", dns.TypeA)
+	assert.Equal(t, uint32(300), r.TTL)
+}
+
+// SCRIPTS
+
+func TestScriptExpr(t *testing.T) {
+	env := &scriptEnv{
+		host:       "www.roblox.com",
+		qtype:      "A",
+		client:     "192.168.1.5",
+		clientName: "kids-tablet",
+		tags:       []string{"device_tablet", "user_child"},
+		now:        time.Date(2020, 9, 14, 16, 30, 0, 0, time.Local), // Monday
+	}
+
+	check := func(expr string, exp bool) {
+		n, err := compileExpr(expr)
+		assert.Nil(t, err, expr)
+		if err == nil {
+			assert.Equal(t, exp, n.eval(env).b, expr)
+		}
+	}
+	check(`qname == "www.roblox.com"`, true)
+	check(`domain(qname, "fortnite.com", "roblox.com.")`, true)
+	check(`domain(qname, "blox.com")`, false)
+	check(`qtype in ["A", "AAAA"] && client_name == 'kids-tablet'`, true)
+	check(`"user_child" in tags && !("user_admin" in tags)`, true)
+	check(`hour >= 16 && hour < 18 || weekday in ["sat", "sun"]`, true)
+	check(`time >= "16:00" && time < "16:30"`, false)
+	check(`date == "2020-09-14" && minute == 30`, true)
+	check(`cidr(client, "10.0.0.0/8", "192.168.1.0/24")`, true)
+	check(`matches(qname, "^www\.") && contains(qname, "blox")`, true)
+	check(`true != false`, true)
+
+	for _, expr := range []string{
+		``,
+		`qname`,
+		`hour == "16"`,
+		`qname < tags`,
+		`unknown == 1`,
+		`qname == "a" &&`,
+		`(qname == "a"`,
+		`qname == "a`,
+		`qname in "a"`,
+		`domain(qname)`,
+		`domain(qname, client)`,
+		`matches(qname, "(")`,
+		`cidr(client, "1.2.3.4")`,
+		`true < false`,
+		`qname == "a" #`,
+	} {
+		_, err := compileExpr(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestScripts(t *testing.T) {
+	scripts, err := PrepareScripts([]ScriptEntry{
+		{Name: "homework", Enabled: true, Action: ScriptBlock,
+			Expr: `"user_child" in tags && domain(qname, "roblox.com") && hour < 18`},
+		{Name: "disabled", Enabled: false, Action: ScriptBlock, Expr: `true`},
+		{Name: "admin", Enabled: true, Action: ScriptAllow, Expr: `client_name == "admin"`},
+		{Name: "portal", Enabled: true, Action: ScriptRewrite, Rewrite: "192.168.1.1", Expr: `qname == "portal.lan"`},
+	})
+	assert.Nil(t, err)
+
+	env := &scriptEnv{
+		host: "www.roblox.com",
+		tags: []string{"user_child"},
+		now:  time.Date(2020, 9, 14, 16, 30, 0, 0, time.Local),
+	}
+	r := matchScripts(scripts, env, dns.TypeA)
+	assert.True(t, r.IsFiltered)
+	assert.Equal(t, FilteredScript, r.Reason)
+	assert.Equal(t, "script: homework", r.Rule)
+
+	env.now = time.Date(2020, 9, 14, 18, 30, 0, 0, time.Local)
+	r = matchScripts(scripts, env, dns.TypeA)
+	assert.False(t, r.Reason.Matched())
+
+	env.clientName = "admin"
+	r = matchScripts(scripts, env, dns.TypeA)
+	assert.False(t, r.IsFiltered)
+	assert.Equal(t, NotFilteredWhiteList, r.Reason)
+
+	env.host = "portal.lan"
+	r = matchScripts(scripts, env, dns.TypeA)
+	assert.Equal(t, NotFilteredWhiteList, r.Reason)
+	env.clientName = ""
+	r = matchScripts(scripts, env, dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "192.168.1.1", r.IPList[0].String())
+
+	_, err = PrepareScripts([]ScriptEntry{{Name: "a", Action: "drop", Expr: "true"}})
+	assert.NotNil(t, err)
+	_, err = PrepareScripts([]ScriptEntry{{Name: "a", Action: ScriptRewrite, Expr: "true"}})
+	assert.NotNil(t, err)
+	_, err = PrepareScripts([]ScriptEntry{{Name: "a", Action: ScriptBlock, Expr: "true"}, {Name: "a", Action: ScriptBlock, Expr: "true"}})
+	assert.NotNil(t, err)
+}
+
+func TestCheckHostScripts(t *testing.T) {
+	conf := Config{Scripts: []ScriptEntry{
+		{Name: "block", Enabled: true, Action: ScriptBlock, Expr: `client == "192.168.1.2" && domain(qname, "example.org")`},
+		{Name: "invalid", Enabled: true, Action: ScriptBlock, Expr: `qname ==`},
+	}}
+	d := NewForTest(&conf, map[int]string{0: "@@||example.org^\n"})
+	defer d.Close()
+	assert.False(t, d.Config.Scripts[1].Enabled)
+
+	s := RequestFilteringSettings{FilteringEnabled: true, ClientIP: "192.168.1.2"}
+	r, err := d.CheckHost("www.example.org", dns.TypeA, &s)
+	assert.Nil(t, err)
+	assert.True(t, r.IsFiltered)
+	assert.Equal(t, FilteredScript, r.Reason)
+
+	s.ClientIP = "192.168.1.3"
+	r, err = d.CheckHost("www.example.org", dns.TypeA, &s)
+	assert.Nil(t, err)
+	assert.False(t, r.IsFiltered)
+}
+
 // BENCHMARKS
 
 func BenchmarkSafeBrowsing(b *testing.B) {
@@ -0,0 +1,116 @@
+// Estimation of the memory used by the filter lists in the filtering engine
+
+package dnsfilter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Approximate memory usage of the compiled rules (in bytes)
+const (
+	hostRuleMemory    = 64  // lookup table entry for a host name from hosts file syntax
+	networkRuleMemory = 320 // parsed network rule (plus its text)
+)
+
+// FilterMemory is the estimated memory usage of a filter list in the filtering engine
+type FilterMemory struct {
+	Bytes uint64 // estimated memory usage
+	Rules int    // number of rules
+
+	// The reason why the list isn't loaded.  "": the list is loaded
+	Error string
+}
+
+// Return TRUE if the rule is a cosmetic one (it's ignored by the engine)
+func isCosmeticRule(line string) bool {
+	for _, m := range []string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(line, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Estimate how much memory the filter list will use in the engine
+func estimateFilterMemory(id int, dataOrFilePath string) (FilterMemory, error) {
+	m := FilterMemory{}
+	if id == 0 {
+		// the text is stored in memory
+		m.Bytes = uint64(len(dataOrFilePath))
+	}
+
+	err := scanFilterData(id, dataOrFilePath, func(line string) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '!' || line[0] == '#' || isCosmeticRule(line) {
+			return
+		}
+		m.Rules++
+
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			m.Bytes += uint64(len(fields)-1) * hostRuleMemory
+			return
+		}
+		m.Bytes += networkRuleMemory + uint64(len(line))
+	})
+	return m, err
+}
+
+// Check the filter lists against the memory budget.
+// The lists are checked in the order of their IDs;  the lists that don't fit into the budget aren't loaded.
+// The user rules (id=0) are always loaded.
+// Return the lists to load, their estimated memory usage and the total memory usage.
+func (d *Dnsfilter) applyMemoryBudget(filters map[int]string) (map[int]string, map[int64]FilterMemory, uint64) {
+	ids := []int{}
+	for id := range filters {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	limit := uint64(d.Config.EngineMemoryLimit) * 1024 * 1024
+	loaded := map[int]string{}
+	memory := map[int64]FilterMemory{}
+	total := uint64(0)
+	for _, id := range ids {
+		m, err := estimateFilterMemory(id, filters[id])
+		if err != nil {
+			log.Debug("Filtering: list %d: %s", id, err)
+		}
+
+		if limit != 0 && id != 0 && total+m.Bytes > limit {
+			m.Error = fmt.Sprintf("memory budget exceeded: the list needs %d KB, but %d KB of %d KB is available",
+				m.Bytes/1024, (limit-min64(total, limit))/1024, limit/1024)
+			log.Error("Filtering: list %d isn't loaded: %s", id, m.Error)
+			memory[int64(id)] = m
+			continue
+		}
+
+		total += m.Bytes
+		loaded[id] = filters[id]
+		memory[int64(id)] = m
+	}
+	return loaded, memory, total
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// GetFiltersMemory returns the estimated memory usage of the filter lists:  filter ID -> memory usage
+func (d *Dnsfilter) GetFiltersMemory() map[int64]FilterMemory {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+	m := make(map[int64]FilterMemory, len(d.filtersMemory))
+	for id, fm := range d.filtersMemory {
+		m[id] = fm
+	}
+	return m
+}
@@ -0,0 +1,162 @@
+// Reducing the memory usage while the filtering engine is re-initialized.
+// The engine is built in stages with the garbage collected in between:
+// the rule lists and the rules with custom modifiers, the filtering engine, the prefilter.
+//
+// The filter files are streamed: they are read line by line, one list at a time,
+// and only the rules with custom modifiers are kept.  The rules for the engine are read from the files by urlfilter.
+// The allowlist and blocklist rules are built into one engine, not one after another,
+// because $important and $badfilter rules apply across both of them.
+
+package dnsfilter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+)
+
+// ruleLists is the result of the first stage of initialization
+type ruleLists struct {
+	lists       []filterlist.RuleList // urlfilter reads the rules from the files by itself
+	customRules []*customRule         // rules with modifiers that urlfilter doesn't support
+	snapshots   []string              // copies of the filter files
+}
+
+// Open the rule lists and parse the rules with custom modifiers.
+// The filter files are read line by line and are never loaded into memory as a whole.
+func loadRuleLists(filters map[int]string) (*ruleLists, error) {
+	r := &ruleLists{}
+	for id, dataOrFilePath := range filters {
+		list, err := r.load(id, dataOrFilePath)
+		if err != nil {
+			for _, l := range r.lists {
+				_ = l.Close()
+			}
+			removeSnapshots(r.snapshots)
+			return nil, err
+		}
+		r.lists = append(r.lists, list)
+	}
+	return r, nil
+}
+
+func (r *ruleLists) load(id int, dataOrFilePath string) (filterlist.RuleList, error) {
+	if id == 0 {
+		custom, err := readCustomRules(id, strings.NewReader(dataOrFilePath))
+		if err != nil {
+			return nil, err
+		}
+		r.customRules = append(r.customRules, custom...)
+		return &filterlist.StringRuleList{
+			ID:             0,
+			RulesText:      dataOrFilePath,
+			IgnoreCosmetic: true,
+		}, nil
+	}
+
+	if !fileExists(dataOrFilePath) {
+		return &filterlist.StringRuleList{
+			ID:             id,
+			IgnoreCosmetic: true,
+		}, nil
+	}
+
+	fn := dataOrFilePath
+	if runtime.GOOS == "windows" {
+		// On Windows we don't pass a file to urlfilter because
+		//  it's difficult to update this file while it's being used.
+		// We pass a copy of the file rather than its contents, so the rules aren't kept in memory.
+		var err error
+		fn, err = snapshotFilterFile(dataOrFilePath)
+		if err != nil {
+			return nil, err
+		}
+		r.snapshots = append(r.snapshots, fn)
+	}
+
+	list, err := filterlist.NewFileRuleList(id, fn, true)
+	if err != nil {
+		return nil, fmt.Errorf("filterlist.NewFileRuleList(): %s: %s", fn, err)
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		_ = list.Close()
+		return nil, fmt.Errorf("os.Open(): %s: %s", fn, err)
+	}
+	custom, err := readCustomRules(id, f)
+	_ = f.Close()
+	if err != nil {
+		_ = list.Close()
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	r.customRules = append(r.customRules, custom...)
+	return list, nil
+}
+
+// Copy the filter file, so urlfilter reads the rules from the copy
+// while the original file may be replaced by the filters updater.
+// Return the name of the copy.
+func snapshotFilterFile(fn string) (string, error) {
+	src, err := os.Open(fn)
+	if err != nil {
+		return "", fmt.Errorf("os.Open(): %s: %s", fn, err)
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("ioutil.TempFile(): %s: %s", fn, err)
+	}
+	_, err = io.Copy(dst, src)
+	err2 := dst.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", fmt.Errorf("copy: %s: %s", fn, err)
+	}
+	return dst.Name(), nil
+}
+
+// Remove the copies of the filter files which aren't used anymore
+func removeSnapshots(files []string) {
+	for _, fn := range files {
+		err := os.Remove(fn)
+		if err != nil {
+			log.Debug("Filtering: %s", err)
+		}
+	}
+}
+
+// Collect the garbage left after parsing the rules,
+// so it doesn't add up with the memory allocated by the next stage of initialization
+func collectGarbage() {
+	runtime.GC()
+}
+
+// Return the memory used by the previous filtering engine to OS in background,
+// so the next re-initialization starts with less memory.
+// It's skipped if the memory is being released already.
+func (d *Dnsfilter) releaseMemory() {
+	if !atomic.CompareAndSwapUint32(&d.releasingMemory, 0, 1) {
+		return
+	}
+	go func() {
+		start := time.Now()
+		debug.FreeOSMemory()
+		log.Debug("Filtering: released memory in %s", time.Since(start))
+		atomic.StoreUint32(&d.releasingMemory, 0)
+	}()
+}
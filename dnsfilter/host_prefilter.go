@@ -0,0 +1,225 @@
+// Bloom filter of the host names from the simple blocking rules:
+// the host names which can't match any of these rules are matched only against the other rules,
+// so the large engine isn't consulted for the most of the requests
+
+package dnsfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+)
+
+const (
+	bloomBitsPerHost = 10 // ~1% false positives
+	bloomHashes      = 7
+)
+
+// bloomFilter is a set of strings which may report false positives but never false negatives
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+}
+
+func newBloomFilter(n int) *bloomFilter {
+	m := uint64(n)*bloomBitsPerHost + 64
+	m -= m % 64
+	return &bloomFilter{
+		bits: make([]uint64, m/64),
+		m:    m,
+	}
+}
+
+// FNV-1a hash split into two halves (Kirsch-Mitzenmacher double hashing)
+func bloomHash(s string) (uint64, uint64) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h & 0xffffffff, h>>32 | 1
+}
+
+func (b *bloomFilter) add(s string) {
+	h1, h2 := bloomHash(s)
+	for i := uint64(0); i < bloomHashes; i++ {
+		n := (h1 + i*h2) % b.m
+		b.bits[n/64] |= 1 << (n % 64)
+	}
+}
+
+func (b *bloomFilter) has(s string) bool {
+	h1, h2 := bloomHash(s)
+	for i := uint64(0); i < bloomHashes; i++ {
+		n := (h1 + i*h2) % b.m
+		if b.bits[n/64]&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hostPrefilter holds the bloom filter of the host names from the simple rules
+// and the filtering engine with all the other rules
+type hostPrefilter struct {
+	bloom        *bloomFilter
+	hosts        int // number of host names in the bloom filter
+	rules        int // number of rules in the engine
+	rulesStorage *filterlist.RuleStorage
+	engine       *urlfilter.DNSEngine
+}
+
+// Return TRUE if the host name may be matched by a simple rule:
+// the host name or one of its parent domains is in the bloom filter
+func (p *hostPrefilter) mayMatch(host string) bool {
+	host = strings.ToLower(host)
+	for {
+		if p.bloom.has(host) {
+			return true
+		}
+		pos := strings.IndexByte(host, '.')
+		if pos < 0 {
+			return false
+		}
+		host = host[pos+1:]
+	}
+}
+
+func (p *hostPrefilter) close() {
+	_ = p.rulesStorage.Close()
+}
+
+// Return TRUE if the string is a valid host name for the simple rules
+func isPrefilterHost(s string) bool {
+	if len(s) == 0 || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+			c != '.' && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the host names from the simple rule:
+// "||host^" (matches the host name and its subdomains) or "IP host1 host2 ..." (hosts file syntax)
+// simple: FALSE if the rule must be passed to the engine
+func parsePrefilterRule(line string) (hosts []string, simple bool) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '!' || line[0] == '#' {
+		return nil, true
+	}
+
+	if strings.HasPrefix(line, "||") && strings.HasSuffix(line, "^") {
+		host := line[2 : len(line)-1]
+		if !isPrefilterHost(host) {
+			return nil, false
+		}
+		return []string{strings.ToLower(host)}, true
+	}
+
+	pos := strings.IndexByte(line, '#')
+	if pos >= 0 {
+		line = line[:pos]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, false
+	}
+	for _, f := range fields[1:] {
+		if !isPrefilterHost(f) {
+			return nil, false
+		}
+		hosts = append(hosts, strings.ToLower(f))
+	}
+	return hosts, true
+}
+
+// Read the filter data: the rules text for the custom rules list (id=0) or a file
+func openFilterData(id int, dataOrFilePath string) (io.ReadCloser, error) {
+	if id == 0 {
+		return ioutil.NopCloser(strings.NewReader(dataOrFilePath)), nil
+	}
+	if !fileExists(dataOrFilePath) {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	return os.Open(dataOrFilePath)
+}
+
+// Pass all lines of the filter data to the function
+func scanFilterData(id int, dataOrFilePath string, f func(line string)) error {
+	rd, err := openFilterData(id, dataOrFilePath)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		f(sc.Text())
+	}
+	return sc.Err()
+}
+
+// Create the prefilter from the filter lists.
+// The data is read twice:  the first pass counts the host names and collects the other rules,
+// the second one fills the bloom filter.
+func newHostPrefilter(filters map[int]string) (*hostPrefilter, error) {
+	p := &hostPrefilter{}
+	other := map[int]*strings.Builder{}
+	for id, dataOrFilePath := range filters {
+		sb := &strings.Builder{}
+		other[id] = sb
+		err := scanFilterData(id, dataOrFilePath, func(line string) {
+			hosts, simple := parsePrefilterRule(line)
+			if !simple {
+				sb.WriteString(line)
+				sb.WriteByte('\n')
+				p.rules++
+			}
+			p.hosts += len(hosts)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("prefilter: list %d: %s", id, err)
+		}
+	}
+
+	p.bloom = newBloomFilter(p.hosts)
+	for id, dataOrFilePath := range filters {
+		err := scanFilterData(id, dataOrFilePath, func(line string) {
+			hosts, _ := parsePrefilterRule(line)
+			for _, h := range hosts {
+				p.bloom.add(h)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("prefilter: list %d: %s", id, err)
+		}
+	}
+
+	listArray := []filterlist.RuleList{}
+	for id, sb := range other {
+		listArray = append(listArray, &filterlist.StringRuleList{
+			ID:             id,
+			RulesText:      sb.String(),
+			IgnoreCosmetic: true,
+		})
+	}
+	var err error
+	p.rulesStorage, err = filterlist.NewRuleStorage(listArray)
+	if err != nil {
+		return nil, fmt.Errorf("filterlist.NewRuleStorage(): %s", err)
+	}
+	p.engine = urlfilter.NewDNSEngine(p.rulesStorage)
+	return p, nil
+}
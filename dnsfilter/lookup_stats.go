@@ -0,0 +1,207 @@
+// Per-client counters of safebrowsing, parental and safesearch lookups
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const maxStatsClients = 10000 // max. number of clients for which the counters are kept
+
+// Security services
+const (
+	svcSafeBrowsing = iota
+	svcParental
+	svcSafeSearch
+)
+
+// Per-client counters
+type clientStats struct {
+	lock sync.Mutex
+	m    map[string]*Stats // client IP -> counters
+}
+
+// Get the counters for the service
+func (s *Stats) service(svc int) *LookupStats {
+	switch svc {
+	case svcSafeBrowsing:
+		return &s.Safebrowsing
+	case svcParental:
+		return &s.Parental
+	}
+	return &s.Safesearch
+}
+
+// Count a lookup for the client
+// cacheHit: the result was found in cache (otherwise a request was sent)
+func (d *Dnsfilter) countLookup(svc int, clientIP string, cacheHit bool) {
+	global := d.stats.service(svc)
+	if cacheHit {
+		atomic.AddUint64(&global.CacheHits, 1)
+	} else {
+		atomic.AddUint64(&global.Requests, 1)
+	}
+
+	if len(clientIP) == 0 {
+		return
+	}
+
+	d.clientStats.lock.Lock()
+	if d.clientStats.m == nil {
+		d.clientStats.m = make(map[string]*Stats)
+	}
+	cs, ok := d.clientStats.m[clientIP]
+	if !ok && len(d.clientStats.m) < maxStatsClients {
+		cs = &Stats{}
+		d.clientStats.m[clientIP] = cs
+	}
+	if cs != nil {
+		if cacheHit {
+			cs.service(svc).CacheHits++
+		} else {
+			cs.service(svc).Requests++
+		}
+	}
+	d.clientStats.lock.Unlock()
+}
+
+// Get a copy of per-client counters
+func (d *Dnsfilter) getClientStats() map[string]Stats {
+	m := map[string]Stats{}
+	d.clientStats.lock.Lock()
+	for ip, cs := range d.clientStats.m {
+		m[ip] = *cs
+	}
+	d.clientStats.lock.Unlock()
+	return m
+}
+
+// ResetStats resets the lookup counters
+func (d *Dnsfilter) ResetStats() {
+	for _, svc := range []int{svcSafeBrowsing, svcParental, svcSafeSearch} {
+		st := d.stats.service(svc)
+		atomic.StoreUint64(&st.Requests, 0)
+		atomic.StoreUint64(&st.CacheHits, 0)
+		atomic.StoreUint64(&st.Coalesced, 0)
+		atomic.StoreUint64(&st.Upstream, 0)
+		atomic.StoreInt64(&st.PendingMax, 0)
+	}
+
+	d.clientStats.lock.Lock()
+	d.clientStats.m = nil
+	d.clientStats.lock.Unlock()
+}
+
+// Get a copy of the counters which are concurrently updated by the lookups
+func (s *LookupStats) load() LookupStats {
+	return LookupStats{
+		Requests:   atomic.LoadUint64(&s.Requests),
+		CacheHits:  atomic.LoadUint64(&s.CacheHits),
+		Coalesced:  atomic.LoadUint64(&s.Coalesced),
+		Upstream:   atomic.LoadUint64(&s.Upstream),
+		Pending:    atomic.LoadInt64(&s.Pending),
+		PendingMax: atomic.LoadInt64(&s.PendingMax),
+	}
+}
+
+type lookupStatsJSON struct {
+	Requests  uint64 `json:"requests"`
+	CacheHits uint64 `json:"cache_hits"`
+}
+
+type serviceLookupStatsJSON struct {
+	lookupStatsJSON
+	Coalesced        uint64 `json:"coalesced"`
+	UpstreamRequests uint64 `json:"upstream_requests"`
+	PendingMax       int64  `json:"pending_max"`
+}
+
+type clientLookupStatsJSON struct {
+	Client       string          `json:"client"`
+	Safebrowsing lookupStatsJSON `json:"safebrowsing"`
+	Parental     lookupStatsJSON `json:"parental"`
+	Safesearch   lookupStatsJSON `json:"safesearch"`
+}
+
+type lookupStatsRespJSON struct {
+	Safebrowsing serviceLookupStatsJSON  `json:"safebrowsing"`
+	Parental     serviceLookupStatsJSON  `json:"parental"`
+	Safesearch   lookupStatsJSON         `json:"safesearch"`
+	Clients      []clientLookupStatsJSON `json:"clients"`
+}
+
+func toLookupStatsJSON(s *LookupStats) lookupStatsJSON {
+	return lookupStatsJSON{
+		Requests:  atomic.LoadUint64(&s.Requests),
+		CacheHits: atomic.LoadUint64(&s.CacheHits),
+	}
+}
+
+func toServiceLookupStatsJSON(s *LookupStats) serviceLookupStatsJSON {
+	return serviceLookupStatsJSON{
+		lookupStatsJSON:  toLookupStatsJSON(s),
+		Coalesced:        atomic.LoadUint64(&s.Coalesced),
+		UpstreamRequests: atomic.LoadUint64(&s.Upstream),
+		PendingMax:       atomic.LoadInt64(&s.PendingMax),
+	}
+}
+
+// Get the total number of lookups
+func (s *Stats) total() uint64 {
+	return s.Safebrowsing.Requests + s.Safebrowsing.CacheHits +
+		s.Parental.Requests + s.Parental.CacheHits +
+		s.Safesearch.Requests + s.Safesearch.CacheHits
+}
+
+func (d *Dnsfilter) handleLookupStats(w http.ResponseWriter, r *http.Request) {
+	st := d.GetStats()
+	resp := lookupStatsRespJSON{
+		Safebrowsing: toServiceLookupStatsJSON(&st.Safebrowsing),
+		Parental:     toServiceLookupStatsJSON(&st.Parental),
+		Safesearch:   toLookupStatsJSON(&st.Safesearch),
+		Clients:      []clientLookupStatsJSON{},
+	}
+
+	ips := []string{}
+	for ip := range st.Clients {
+		ips = append(ips, ip)
+	}
+	// the clients with the most number of lookups go first
+	sort.Slice(ips, func(i, j int) bool {
+		ci := st.Clients[ips[i]]
+		cj := st.Clients[ips[j]]
+		if ci.total() != cj.total() {
+			return ci.total() > cj.total()
+		}
+		return ips[i] < ips[j]
+	})
+	for _, ip := range ips {
+		cs := st.Clients[ip]
+		resp.Clients = append(resp.Clients, clientLookupStatsJSON{
+			Client:       ip,
+			Safebrowsing: toLookupStatsJSON(&cs.Safebrowsing),
+			Parental:     toLookupStatsJSON(&cs.Parental),
+			Safesearch:   toLookupStatsJSON(&cs.Safesearch),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) handleLookupStatsReset(w http.ResponseWriter, r *http.Request) {
+	d.ResetStats()
+}
+
+func (d *Dnsfilter) registerLookupStatsHandlers() {
+	d.Config.HTTPRegister("GET", "/control/filtering/lookup_stats", d.handleLookupStats)
+	d.Config.HTTPRegister("POST", "/control/filtering/lookup_stats/reset", d.handleLookupStatsReset)
+}
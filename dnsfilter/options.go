@@ -0,0 +1,62 @@
+// Constructor options
+
+package dnsfilter
+
+import (
+	"github.com/AdguardTeam/golibs/cache"
+)
+
+const defaultCacheSize = 1 * 1024 * 1024 // the default size of Safe Browsing, Safe Search and Parental caches (in bytes)
+
+// Option changes the settings of a new Dnsfilter object (see NewWithOptions)
+type Option func(o *options)
+
+type options struct {
+	safeBrowsingCacheSize uint
+	safeSearchCacheSize   uint
+	parentalCacheSize     uint
+
+	safeBrowsingCache cache.Cache
+	safeSearchCache   cache.Cache
+	parentalCache     cache.Cache
+}
+
+// WithCacheSizes sets the sizes of Safe Browsing, Safe Search and Parental caches (in bytes).
+// They override the sizes from Config.  0: the value from Config is used.
+func WithCacheSizes(safeBrowsing, safeSearch, parental uint) Option {
+	return func(o *options) {
+		o.safeBrowsingCacheSize = safeBrowsing
+		o.safeSearchCacheSize = safeSearch
+		o.parentalCacheSize = parental
+	}
+}
+
+// WithCaches sets the caches for Safe Browsing, Safe Search and Parental results,
+// e.g. to share them between several Dnsfilter objects.  nil: a new cache is created.
+func WithCaches(safeBrowsing, safeSearch, parental cache.Cache) Option {
+	return func(o *options) {
+		o.safeBrowsingCache = safeBrowsing
+		o.safeSearchCache = safeSearch
+		o.parentalCache = parental
+	}
+}
+
+// Get the cache size: the value from options or Config.
+// 0 in Config: the cache size is not limited.
+func cacheSize(opt, conf uint) uint {
+	if opt != 0 {
+		return opt
+	}
+	return conf
+}
+
+// Create the cache or use the one from options
+func newCache(c cache.Cache, size uint) cache.Cache {
+	if c != nil {
+		return c
+	}
+	return cache.New(cache.Config{
+		EnableLRU: true,
+		MaxSize:   size,
+	})
+}
@@ -0,0 +1,202 @@
+// Temporary pauses of filtering ("pause filtering for 15 minutes")
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const maxPauseDuration = 24 * 60 * 60 // in seconds
+
+// Pause is a temporary exception from filtering
+type Pause struct {
+	Client string    `json:"client"` // client IP address.  "": all clients
+	Host   string    `json:"host"`   // host name (and its subdomains).  "": all host names
+	Until  time.Time `json:"until"`  // filtering is re-enabled at this time
+}
+
+// Return TRUE if the pause applies to the request
+func (p *Pause) match(host string, clientIP string) bool {
+	if len(p.Client) != 0 && p.Client != clientIP {
+		return false
+	}
+	return len(p.Host) == 0 || host == p.Host || strings.HasSuffix(host, "."+p.Host)
+}
+
+// The list of active pauses
+type pauses struct {
+	lock  sync.Mutex
+	list  []Pause
+	timer *time.Timer // removes expired pauses
+}
+
+// Add a pause or update the existing one for the same client and host
+func (d *Dnsfilter) addPause(p Pause) {
+	d.pauses.lock.Lock()
+	found := false
+	for i := range d.pauses.list {
+		if d.pauses.list[i].Client == p.Client && d.pauses.list[i].Host == p.Host {
+			d.pauses.list[i].Until = p.Until
+			found = true
+			break
+		}
+	}
+	if !found {
+		d.pauses.list = append(d.pauses.list, p)
+	}
+	d.schedulePausesPurge()
+	d.pauses.lock.Unlock()
+
+	log.Debug("Filtering: paused for client:%q  host:%q  until %s", p.Client, p.Host, p.Until)
+}
+
+// Remove a pause
+// Return FALSE if not found
+func (d *Dnsfilter) delPause(client string, host string) bool {
+	d.pauses.lock.Lock()
+	defer d.pauses.lock.Unlock()
+	for i, p := range d.pauses.list {
+		if p.Client == client && p.Host == host {
+			d.pauses.list = append(d.pauses.list[:i], d.pauses.list[i+1:]...)
+			log.Debug("Filtering: resumed for client:%q  host:%q", client, host)
+			return true
+		}
+	}
+	return false
+}
+
+// Get the active pauses
+func (d *Dnsfilter) getPauses() []Pause {
+	now := time.Now()
+	d.pauses.lock.Lock()
+	list := []Pause{}
+	for _, p := range d.pauses.list {
+		if p.Until.After(now) {
+			list = append(list, p)
+		}
+	}
+	d.pauses.lock.Unlock()
+	return list
+}
+
+// Remove expired pauses and schedule the next purge (and does not lock anything)
+func (d *Dnsfilter) schedulePausesPurge() {
+	now := time.Now()
+	list := []Pause{}
+	var next time.Time
+	for _, p := range d.pauses.list {
+		if !p.Until.After(now) {
+			log.Debug("Filtering: pause expired for client:%q  host:%q", p.Client, p.Host)
+			continue
+		}
+		list = append(list, p)
+		if next.IsZero() || p.Until.Before(next) {
+			next = p.Until
+		}
+	}
+	d.pauses.list = list
+
+	if d.pauses.timer != nil {
+		d.pauses.timer.Stop()
+		d.pauses.timer = nil
+	}
+	if !next.IsZero() {
+		d.pauses.timer = time.AfterFunc(next.Sub(now), func() {
+			d.pauses.lock.Lock()
+			d.schedulePausesPurge()
+			d.pauses.lock.Unlock()
+		})
+	}
+}
+
+type pauseJSON struct {
+	Client   string `json:"client"`
+	Host     string `json:"host"`
+	Duration uint32 `json:"duration"` // in seconds
+}
+
+func (d *Dnsfilter) handlePause(w http.ResponseWriter, r *http.Request) {
+	req := pauseJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	p, ok := parsePauseRequest(w, r, req)
+	if !ok {
+		return
+	}
+	if req.Duration == 0 || req.Duration > maxPauseDuration {
+		httpError(r, w, http.StatusBadRequest, "duration must be in range [1..%d]", maxPauseDuration)
+		return
+	}
+	p.Until = time.Now().Add(time.Duration(req.Duration) * time.Second)
+	d.addPause(p)
+}
+
+func (d *Dnsfilter) handleResume(w http.ResponseWriter, r *http.Request) {
+	req := pauseJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	p, ok := parsePauseRequest(w, r, req)
+	if !ok {
+		return
+	}
+	if !d.delPause(p.Client, p.Host) {
+		httpError(r, w, http.StatusBadRequest, "pause not found")
+		return
+	}
+}
+
+// Validate client and host values
+func parsePauseRequest(w http.ResponseWriter, r *http.Request, req pauseJSON) (Pause, bool) {
+	p := Pause{
+		Client: strings.TrimSpace(req.Client),
+		Host:   strings.ToLower(strings.TrimSuffix(strings.TrimSpace(req.Host), ".")),
+	}
+
+	if len(p.Client) != 0 {
+		ip := net.ParseIP(p.Client)
+		if ip == nil {
+			httpError(r, w, http.StatusBadRequest, "invalid client IP address: %s", p.Client)
+			return p, false
+		}
+		p.Client = ip.String()
+	}
+
+	if len(p.Host) != 0 {
+		if _, ok := dns.IsDomainName(p.Host); !ok {
+			httpError(r, w, http.StatusBadRequest, "invalid host name: %s", p.Host)
+			return p, false
+		}
+	}
+	return p, true
+}
+
+func (d *Dnsfilter) handlePauseList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(d.getPauses())
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) registerPauseHandlers() {
+	d.Config.HTTPRegister("GET", "/control/filtering/pause/list", d.handlePauseList)
+	d.Config.HTTPRegister("POST", "/control/filtering/pause", d.handlePause)
+	d.Config.HTTPRegister("POST", "/control/filtering/resume", d.handleResume)
+}
@@ -0,0 +1,142 @@
+// Status of filters re-initialization
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// FilteringStatus is the status of filters re-initialization
+type FilteringStatus struct {
+	Reloading    bool          // the filters are being initialized now
+	LastReload   time.Time     // the time when the filters were initialized successfully.  Zero: never
+	LastDuration time.Duration // the time it took to initialize the filters last time
+	Lists        int           // number of the loaded filter lists
+	Rules        int           // number of rules in the loaded filter lists
+
+	LastError     string    // the error of the last attempt.  "": the last attempt succeeded
+	LastErrorTime time.Time // the time of the last failed attempt
+	Failures      uint64    // number of failed attempts since startup
+}
+
+type reloadStatus struct {
+	lock    sync.Mutex
+	st      FilteringStatus
+	running int // number of reloads in progress (they may overlap)
+}
+
+// Initialize the filters and update the status
+func (d *Dnsfilter) reloadFilters(filters map[int]string) error {
+	return d.runReload(func() error {
+		return d.initFiltering(filters)
+	})
+}
+
+// Run the initialization function and update the status.
+// A panic during initialization is reported as an error, so the filters initializer keeps working.
+func (d *Dnsfilter) runReload(init func() error) (err error) {
+	d.reloadStatus.lock.Lock()
+	d.reloadStatus.running++
+	d.reloadStatus.st.Reloading = true
+	d.reloadStatus.lock.Unlock()
+
+	start := time.Now()
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			log.Error("Filtering: panic while initializing filters: %v\n%s", r, debug.Stack())
+		}
+		d.setReloadStatus(start, err)
+	}()
+
+	return init()
+}
+
+func (d *Dnsfilter) setReloadStatus(start time.Time, err error) {
+	lists := 0
+	rules := 0
+	if err == nil {
+		for _, m := range d.GetFiltersMemory() {
+			if len(m.Error) == 0 {
+				lists++
+				rules += m.Rules
+			}
+		}
+	}
+
+	d.reloadStatus.lock.Lock()
+	defer d.reloadStatus.lock.Unlock()
+	d.reloadStatus.running--
+	st := &d.reloadStatus.st
+	st.Reloading = d.reloadStatus.running != 0
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorTime = time.Now()
+		st.Failures++
+		return
+	}
+	st.LastError = ""
+	st.LastReload = time.Now()
+	st.LastDuration = time.Since(start)
+	st.Lists = lists
+	st.Rules = rules
+}
+
+// GetFilteringStatus returns the status of filters re-initialization
+func (d *Dnsfilter) GetFilteringStatus() FilteringStatus {
+	d.reloadStatus.lock.Lock()
+	defer d.reloadStatus.lock.Unlock()
+	return d.reloadStatus.st
+}
+
+type filteringStatusJSON struct {
+	Reloading    bool   `json:"reloading"`
+	LastReload   string `json:"last_reload"`      // "": never
+	LastDuration uint64 `json:"last_duration_ms"` // in milliseconds
+	Lists        int    `json:"lists"`
+	Rules        int    `json:"rules"`
+
+	LastError     string `json:"last_error"`
+	LastErrorTime string `json:"last_error_time"` // "": no errors
+	Failures      uint64 `json:"failures"`
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (d *Dnsfilter) handleReloadStatus(w http.ResponseWriter, r *http.Request) {
+	st := d.GetFilteringStatus()
+	resp := filteringStatusJSON{
+		Reloading:     st.Reloading,
+		LastReload:    formatStatusTime(st.LastReload),
+		LastDuration:  uint64(st.LastDuration / time.Millisecond),
+		Lists:         st.Lists,
+		Rules:         st.Rules,
+		LastError:     st.LastError,
+		LastErrorTime: formatStatusTime(st.LastErrorTime),
+		Failures:      st.Failures,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) registerReloadStatusHandlers() {
+	d.Config.HTTPRegister("GET", "/control/filtering/reload_status", d.handleReloadStatus)
+}
@@ -0,0 +1,181 @@
+// Cache for the results of filtering rules matching
+
+package dnsfilter
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The number of the most frequently requested entries which are re-evaluated after filters update
+const resultCacheRevalidateMax = 1000
+
+type resultCacheEntry struct {
+	res  Result
+	gen  uint64 // filters generation the result was obtained for
+	hits uint64 // number of cache hits (atomic)
+
+	host  string
+	qtype uint16
+	ctags []string
+}
+
+// resultCache stores the results of matchHost().
+// When filters are updated, all entries become stale.
+// The hot entries are re-evaluated in background and remain valid if their results haven't changed.
+type resultCache struct {
+	lock    sync.Mutex
+	entries map[string]*resultCacheEntry
+	maxSize int
+}
+
+func newResultCache(maxSize int) *resultCache {
+	return &resultCache{
+		entries: make(map[string]*resultCacheEntry),
+		maxSize: maxSize,
+	}
+}
+
+func resultCacheKey(host string, qtype uint16, ctags []string) string {
+	return host + "#" + strconv.Itoa(int(qtype)) + "#" + strings.Join(ctags, ",")
+}
+
+// Get the result which was obtained for the specified filters generation
+func (c *resultCache) get(key string, gen uint64) (Result, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.gen != gen {
+		return Result{}, false
+	}
+	atomic.AddUint64(&e.hits, 1)
+	return e.res, true
+}
+
+func (c *resultCache) set(key string, e *resultCacheEntry) {
+	c.lock.Lock()
+	old, ok := c.entries[key]
+	if ok {
+		e.hits = atomic.LoadUint64(&old.hits)
+	} else if len(c.entries) >= c.maxSize {
+		// remove an arbitrary entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = e
+	c.lock.Unlock()
+}
+
+// Get the most frequently requested entries obtained for the specified filters generation
+func (c *resultCache) hot(gen uint64, max int) map[string]*resultCacheEntry {
+	c.lock.Lock()
+	list := make([]string, 0, len(c.entries))
+	for k, e := range c.entries {
+		if e.gen == gen {
+			list = append(list, k)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return atomic.LoadUint64(&c.entries[list[i]].hits) > atomic.LoadUint64(&c.entries[list[j]].hits)
+	})
+	if len(list) > max {
+		list = list[:max]
+	}
+	hot := make(map[string]*resultCacheEntry, len(list))
+	for _, k := range list {
+		hot[k] = c.entries[k]
+	}
+	c.lock.Unlock()
+	return hot
+}
+
+// Mark the entry as valid for the new filters generation
+// Return FALSE if the entry was changed by another goroutine
+func (c *resultCache) revalidate(key string, e *resultCacheEntry, gen uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[key] != e {
+		return false
+	}
+	e.gen = gen
+	return true
+}
+
+func (c *resultCache) del(key string, e *resultCacheEntry) {
+	c.lock.Lock()
+	if c.entries[key] == e {
+		delete(c.entries, key)
+	}
+	c.lock.Unlock()
+}
+
+// Return TRUE if the results are the same
+func resultsEqual(a, b Result) bool {
+	return a.IsFiltered == b.IsFiltered &&
+		a.Reason == b.Reason &&
+		a.Rule == b.Rule &&
+		a.FilterID == b.FilterID &&
+		a.IP.Equal(b.IP) &&
+		len(a.IP) == len(b.IP)
+}
+
+// matchHost with the results cache
+func (d *Dnsfilter) matchHostCached(host string, qtype uint16, ctags []string) (Result, error) {
+	if d.resultCache == nil {
+		return d.matchHost(host, qtype, ctags)
+	}
+
+	key := resultCacheKey(host, qtype, ctags)
+	gen := atomic.LoadUint64(&d.filtersGen)
+	res, ok := d.resultCache.get(key, gen)
+	if ok {
+		return res, nil
+	}
+
+	res, err := d.matchHost(host, qtype, ctags)
+	if err != nil {
+		return res, err
+	}
+	// If filters were updated while we were matching, the result is stored with the old generation
+	//  and won't be used.
+	d.resultCache.set(key, &resultCacheEntry{
+		res:   res,
+		gen:   gen,
+		host:  host,
+		qtype: qtype,
+		ctags: ctags,
+	})
+	return res, nil
+}
+
+// Re-evaluate the hot entries of the results cache against the new filters.
+// The entries whose results haven't changed remain in cache, the others are removed.
+func (d *Dnsfilter) revalidateResultCache(c *resultCache, gen uint64) {
+	hot := c.hot(gen-1, resultCacheRevalidateMax)
+	valid := 0
+	evicted := 0
+	for key, e := range hot {
+		if atomic.LoadUint64(&d.filtersGen) != gen {
+			log.Debug("Filtering: results cache: filters were updated again, stop revalidation")
+			return
+		}
+
+		res, err := d.matchHost(e.host, e.qtype, e.ctags)
+		if err == nil && resultsEqual(res, e.res) {
+			if c.revalidate(key, e, gen) {
+				valid++
+			}
+			continue
+		}
+		c.del(key, e)
+		evicted++
+	}
+	log.Debug("Filtering: results cache: revalidated %d entries, evicted %d entries", valid, evicted)
+}
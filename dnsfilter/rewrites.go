@@ -4,21 +4,34 @@ package dnsfilter
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"sort"
 	"strings"
 
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
 	"github.com/miekg/dns"
 )
 
 // RewriteEntry is a rewrite array element
 type RewriteEntry struct {
-	Domain string `yaml:"domain"`
-	Answer string `yaml:"answer"` // IP address or canonical name
-	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A or AAAA
-	IP     net.IP `yaml:"-"`      // Parsed IP address (if Type is A or AAAA)
+	Domain string `yaml:"domain" json:"domain"`
+	Answer string `yaml:"answer" json:"answer"` // IP address or canonical name
+	Type   uint16 `yaml:"-" json:"-"`           // DNS record type: CNAME, A or AAAA
+	IP     net.IP `yaml:"-" json:"-"`           // Parsed IP address (if Type is A or AAAA)
+
+	// The matched entries with the highest priority are used.  Default: 0
+	Priority int `yaml:"priority,omitempty" json:"priority"`
+
+	// The requests for the domain aren't rewritten, e.g. a host name excluded from a wildcard.
+	// The answer must be empty.
+	Exception bool `yaml:"exception,omitempty" json:"exception"`
+
+	// TTL of the answer (in seconds).  0: the global setting is used
+	TTL uint32 `yaml:"ttl,omitempty" json:"ttl"`
 }
 
 func (r *RewriteEntry) equals(b RewriteEntry) bool {
@@ -42,7 +55,7 @@ func (a rewritesArray) Len() int { return len(a) }
 
 func (a rewritesArray) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
-// Priority: CNAME, A/AAAA;  exact, wildcard.
+// Priority: A/AAAA, CNAME;  exact, wildcard.
 func (a rewritesArray) Less(i, j int) bool {
 	if a[i].Type == dns.TypeCNAME && a[j].Type != dns.TypeCNAME {
 		return false
@@ -61,6 +74,12 @@ func (a rewritesArray) Less(i, j int) bool {
 
 // Prepare entry for use
 func (r *RewriteEntry) prepare() {
+	if r.Exception {
+		r.Type = 0
+		r.IP = nil
+		return
+	}
+
 	ip := net.ParseIP(r.Answer)
 	if ip == nil {
 		r.Type = dns.TypeCNAME
@@ -77,41 +96,91 @@ func (r *RewriteEntry) prepare() {
 	}
 }
 
+// Check the domain, the answer and TTL of the entry
+func (r *RewriteEntry) check() error {
+	if utils.IsValidHostname(strings.TrimPrefix(r.Domain, "*.")) != nil {
+		return fmt.Errorf("invalid domain: %q", r.Domain)
+	}
+	if r.TTL > math.MaxInt32 {
+		return fmt.Errorf("%s: invalid TTL: %d", r.Domain, r.TTL)
+	}
+	if r.Exception {
+		if len(r.Answer) != 0 {
+			return fmt.Errorf("%s: the answer of an exception must be empty", r.Domain)
+		}
+		return nil
+	}
+	if net.ParseIP(r.Answer) == nil && utils.IsValidHostname(r.Answer) != nil {
+		return fmt.Errorf("invalid answer: %q: must be an IP address or a domain name", r.Answer)
+	}
+	return nil
+}
+
 func (d *Dnsfilter) prepareRewrites() {
 	for i := range d.Rewrites {
 		d.Rewrites[i].prepare()
 	}
 }
 
+// PrepareRewrites returns the copy of the rewrites list ready for use in RequestFilteringSettings
+func PrepareRewrites(a []RewriteEntry) []RewriteEntry {
+	a2 := rewriteArrayDup(a)
+	for i := range a2 {
+		a2[i].Domain = strings.ToLower(a2[i].Domain)
+		a2[i].prepare()
+	}
+	return a2
+}
+
 // Get the list of matched rewrite entries.
-// Priority: CNAME, A/AAAA;  exact, wildcard.
-// If matched exactly, don't return wildcard entries.
+// Only the matched entries with the highest priority are used.  Of them:
+// if matched exactly, don't return wildcard entries;
+// otherwise return the entries of the most specific wildcard ("*.b.host.com" before "*.host.com").
+// If an exception is selected, nothing is returned.
+// Priority of the returned entries: A/AAAA, CNAME.
 func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
-	rr := rewritesArray{}
+	matched := []RewriteEntry{}
 	for _, r := range a {
 		if r.Domain != host {
 			if !matchDomainWildcard(host, r.Domain) {
 				continue
 			}
 		}
-		rr = append(rr, r)
+		matched = append(matched, r)
 	}
 
-	if len(rr) == 0 {
+	if len(matched) == 0 {
 		return nil
 	}
 
-	sort.Sort(rr)
-
-	isWC := isWildcard(rr[0].Domain)
-	if !isWC {
-		for i, r := range rr {
-			if isWildcard(r.Domain) {
-				rr = rr[:i]
-				break
+	// find the domain of the selected entries
+	best := matched[0]
+	for _, r := range matched[1:] {
+		if r.Priority != best.Priority {
+			if r.Priority > best.Priority {
+				best = r
 			}
+			continue
+		}
+		if isWildcard(best.Domain) &&
+			(!isWildcard(r.Domain) || len(r.Domain) > len(best.Domain)) {
+			best = r
 		}
 	}
+
+	rr := rewritesArray{}
+	for _, r := range matched {
+		if r.Priority != best.Priority || r.Domain != best.Domain {
+			continue
+		}
+		if r.Exception {
+			log.Debug("Rewrite: %s: matched exception %s", host, r.Domain)
+			return nil
+		}
+		rr = append(rr, r)
+	}
+
+	sort.Stable(rr)
 	return rr
 }
 
@@ -121,9 +190,24 @@ func rewriteArrayDup(a []RewriteEntry) []RewriteEntry {
 	return a2
 }
 
+// SetRewrites replaces the list of rewrites
+func (d *Dnsfilter) SetRewrites(a []RewriteEntry) {
+	a = rewriteArrayDup(a)
+	for i := range a {
+		a[i].prepare()
+	}
+	d.confLock.Lock()
+	d.Config.Rewrites = a
+	d.confLock.Unlock()
+	log.Debug("Rewrites: set %d elements", len(a))
+}
+
 type rewriteEntryJSON struct {
-	Domain string `json:"domain"`
-	Answer string `json:"answer"`
+	Domain    string `json:"domain"`
+	Answer    string `json:"answer"`
+	Priority  int    `json:"priority"`
+	Exception bool   `json:"exception"`
+	TTL       uint32 `json:"ttl"`
 }
 
 func (d *Dnsfilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
@@ -133,8 +217,11 @@ func (d *Dnsfilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
 	d.confLock.Lock()
 	for _, ent := range d.Config.Rewrites {
 		jsent := rewriteEntryJSON{
-			Domain: ent.Domain,
-			Answer: ent.Answer,
+			Domain:    ent.Domain,
+			Answer:    ent.Answer,
+			Priority:  ent.Priority,
+			Exception: ent.Exception,
+			TTL:       ent.TTL,
 		}
 		arr = append(arr, &jsent)
 	}
@@ -158,8 +245,11 @@ func (d *Dnsfilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ent := RewriteEntry{
-		Domain: jsent.Domain,
-		Answer: jsent.Answer,
+		Domain:    jsent.Domain,
+		Answer:    jsent.Answer,
+		Priority:  jsent.Priority,
+		Exception: jsent.Exception,
+		TTL:       jsent.TTL,
 	}
 	ent.prepare()
 	d.confLock.Lock()
@@ -199,8 +289,59 @@ func (d *Dnsfilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 	d.Config.ConfigModified()
 }
 
+// Replace the full rewrites table
+// All entries are checked before the table is replaced: if any entry is invalid, nothing is changed.
+func (d *Dnsfilter) handleRewriteBulkPut(w http.ResponseWriter, r *http.Request) {
+	list := []rewriteEntryJSON{}
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	arr := []RewriteEntry{}
+	errs := []string{}
+	for i, jsent := range list {
+		ent := RewriteEntry{
+			Domain:    strings.ToLower(jsent.Domain),
+			Answer:    jsent.Answer,
+			Priority:  jsent.Priority,
+			Exception: jsent.Exception,
+			TTL:       jsent.TTL,
+		}
+		err = ent.check()
+		if err == nil {
+			for _, prev := range arr {
+				if prev.equals(ent) {
+					err = fmt.Errorf("duplicate entry: %s -> %s", ent.Domain, ent.Answer)
+					break
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%d: %s", i, err))
+			continue
+		}
+		ent.prepare()
+		arr = append(arr, ent)
+	}
+	if len(errs) != 0 {
+		httpError(r, w, http.StatusBadRequest, "invalid rewrites: %s", strings.Join(errs, "; "))
+		return
+	}
+
+	d.confLock.Lock()
+	d.Config.Rewrites = arr
+	d.confLock.Unlock()
+	log.Debug("Rewrites: replaced with %d elements", len(arr))
+
+	d.Config.ConfigModified()
+}
+
 func (d *Dnsfilter) registerRewritesHandlers() {
 	d.Config.HTTPRegister("GET", "/control/rewrite/list", d.handleRewriteList)
 	d.Config.HTTPRegister("POST", "/control/rewrite/add", d.handleRewriteAdd)
 	d.Config.HTTPRegister("POST", "/control/rewrite/delete", d.handleRewriteDelete)
+	d.Config.HTTPRegister("GET", "/control/rewrite/bulk", d.handleRewriteList) // the full table, the same as "list"
+	d.Config.HTTPRegister("PUT", "/control/rewrite/bulk", d.handleRewriteBulkPut)
 }
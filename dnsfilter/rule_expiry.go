@@ -0,0 +1,77 @@
+// Expiration of user rules ("block twitter.com until Monday")
+
+package dnsfilter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// RuleExpiry is the time when a user rule is removed automatically
+type RuleExpiry struct {
+	Rule  string    `yaml:"rule" json:"rule"`
+	Until time.Time `yaml:"until" json:"until"`
+}
+
+// The list of user rules which will expire
+type rulesExpiry struct {
+	lock  sync.Mutex
+	list  []RuleExpiry
+	timer *time.Timer // removes expired rules
+}
+
+// SetRulesExpiry sets the expiration time of user rules.
+// Config.UserRulesExpired is called when the rules expire.
+func (d *Dnsfilter) SetRulesExpiry(list []RuleExpiry) {
+	d.rulesExpiry.lock.Lock()
+	d.rulesExpiry.list = append([]RuleExpiry{}, list...)
+	d.scheduleRulesExpiry()
+	d.rulesExpiry.lock.Unlock()
+}
+
+// Start the timer for the nearest expiration time (and does not lock anything)
+func (d *Dnsfilter) scheduleRulesExpiry() {
+	if d.rulesExpiry.timer != nil {
+		d.rulesExpiry.timer.Stop()
+		d.rulesExpiry.timer = nil
+	}
+
+	var next time.Time
+	for _, e := range d.rulesExpiry.list {
+		if next.IsZero() || e.Until.Before(next) {
+			next = e.Until
+		}
+	}
+	if !next.IsZero() {
+		d.rulesExpiry.timer = time.AfterFunc(time.Until(next), d.expireRules)
+	}
+}
+
+// Remove the expired rules from the list and notify the owner of the user rules
+func (d *Dnsfilter) expireRules() {
+	now := time.Now()
+	expired := []string{}
+	list := []RuleExpiry{}
+
+	d.rulesExpiry.lock.Lock()
+	for _, e := range d.rulesExpiry.list {
+		if e.Until.After(now) {
+			list = append(list, e)
+			continue
+		}
+		expired = append(expired, e.Rule)
+	}
+	d.rulesExpiry.list = list
+	d.scheduleRulesExpiry()
+	d.rulesExpiry.lock.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	log.Debug("Filtering: %d user rules expired: %v", len(expired), expired)
+	if d.UserRulesExpired != nil {
+		d.UserRulesExpired(expired)
+	}
+}
@@ -0,0 +1,596 @@
+// Expression language of the filtering scripts
+
+package dnsfilter
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The data available to the script
+type scriptEnv struct {
+	host       string    // host name (lowercase, without the trailing dot)
+	qtype      string    // "A", "AAAA", etc.
+	client     string    // client's IP address
+	clientName string    // client's name.  "": unknown client
+	tags       []string  // client's tags
+	now        time.Time // local time
+}
+
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprInt
+	exprString
+	exprList
+)
+
+var exprTypeNames = []string{"bool", "int", "string", "list"}
+
+func (t exprType) String() string {
+	return exprTypeNames[t]
+}
+
+type exprValue struct {
+	b    bool
+	num  int
+	str  string
+	list []string
+}
+
+// Compiled expression.  The types are checked on compilation, so the evaluation can't fail.
+type exprNode interface {
+	typ() exprType
+	eval(env *scriptEnv) exprValue
+}
+
+// Variables: name -> type
+var exprVars = map[string]exprType{
+	"qname":       exprString,
+	"qtype":       exprString,
+	"client":      exprString,
+	"client_name": exprString,
+	"tags":        exprList,
+	"hour":        exprInt,
+	"minute":      exprInt,
+	"weekday":     exprString,
+	"time":        exprString,
+	"date":        exprString,
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type varNode struct {
+	name string
+}
+
+func (n *varNode) typ() exprType {
+	return exprVars[n.name]
+}
+
+func (n *varNode) eval(env *scriptEnv) exprValue {
+	switch n.name {
+	case "qname":
+		return exprValue{str: env.host}
+	case "qtype":
+		return exprValue{str: env.qtype}
+	case "client":
+		return exprValue{str: env.client}
+	case "client_name":
+		return exprValue{str: env.clientName}
+	case "tags":
+		return exprValue{list: env.tags}
+	case "hour":
+		return exprValue{num: env.now.Hour()}
+	case "minute":
+		return exprValue{num: env.now.Minute()}
+	case "weekday":
+		return exprValue{str: weekdays[env.now.Weekday()]}
+	case "time":
+		return exprValue{str: env.now.Format("15:04")}
+	case "date":
+		return exprValue{str: env.now.Format("2006-01-02")}
+	}
+	return exprValue{}
+}
+
+type literalNode struct {
+	t exprType
+	v exprValue
+}
+
+func (n *literalNode) typ() exprType                 { return n.t }
+func (n *literalNode) eval(env *scriptEnv) exprValue { return n.v }
+
+type notNode struct {
+	x exprNode
+}
+
+func (n *notNode) typ() exprType { return exprBool }
+
+func (n *notNode) eval(env *scriptEnv) exprValue {
+	return exprValue{b: !n.x.eval(env).b}
+}
+
+// "&&" and "||"
+type logicNode struct {
+	and  bool
+	l, r exprNode
+}
+
+func (n *logicNode) typ() exprType { return exprBool }
+
+func (n *logicNode) eval(env *scriptEnv) exprValue {
+	l := n.l.eval(env).b
+	if l != n.and {
+		return exprValue{b: l}
+	}
+	return n.r.eval(env)
+}
+
+// "==", "!=", "<", "<=", ">", ">="
+type cmpNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *cmpNode) typ() exprType { return exprBool }
+
+func (n *cmpNode) eval(env *scriptEnv) exprValue {
+	l := n.l.eval(env)
+	r := n.r.eval(env)
+	c := 0
+	switch n.l.typ() {
+	case exprBool:
+		if l.b != r.b {
+			c = 1
+		}
+	case exprInt:
+		c = l.num - r.num
+	case exprString:
+		c = strings.Compare(l.str, r.str)
+	}
+
+	var res bool
+	switch n.op {
+	case "==":
+		res = c == 0
+	case "!=":
+		res = c != 0
+	case "<":
+		res = c < 0
+	case "<=":
+		res = c <= 0
+	case ">":
+		res = c > 0
+	case ">=":
+		res = c >= 0
+	}
+	return exprValue{b: res}
+}
+
+// "x in list"
+type inNode struct {
+	x    exprNode
+	list exprNode
+}
+
+func (n *inNode) typ() exprType { return exprBool }
+
+func (n *inNode) eval(env *scriptEnv) exprValue {
+	x := n.x.eval(env).str
+	for _, s := range n.list.eval(env).list {
+		if s == x {
+			return exprValue{b: true}
+		}
+	}
+	return exprValue{}
+}
+
+// "[a, b, c]"
+type listNode struct {
+	items []exprNode
+}
+
+func (n *listNode) typ() exprType { return exprList }
+
+func (n *listNode) eval(env *scriptEnv) exprValue {
+	v := exprValue{list: make([]string, len(n.items))}
+	for i, it := range n.items {
+		v.list[i] = it.eval(env).str
+	}
+	return v
+}
+
+// Function call.  The arguments after the first one must be literal strings.
+type callNode struct {
+	name    string
+	x       exprNode
+	args    []string
+	re      *regexp.Regexp
+	subnets []*net.IPNet
+}
+
+func (n *callNode) typ() exprType { return exprBool }
+
+func (n *callNode) eval(env *scriptEnv) exprValue {
+	x := n.x.eval(env).str
+	switch n.name {
+	case "domain":
+		for _, d := range n.args {
+			if x == d || strings.HasSuffix(x, "."+d) {
+				return exprValue{b: true}
+			}
+		}
+	case "contains":
+		for _, s := range n.args {
+			if strings.Contains(x, s) {
+				return exprValue{b: true}
+			}
+		}
+	case "matches":
+		return exprValue{b: n.re.MatchString(x)}
+	case "cidr":
+		ip := net.ParseIP(x)
+		for _, s := range n.subnets {
+			if ip != nil && s.Contains(ip) {
+				return exprValue{b: true}
+			}
+		}
+	}
+	return exprValue{}
+}
+
+var exprFuncs = map[string]bool{
+	"domain":   true, // domain(qname, "example.org", ...): the host name is equal to or is a subdomain of any of the domains
+	"contains": true, // contains(s, "sub", ...): the string contains any of the substrings
+	"matches":  true, // matches(s, "regexp"): the string matches the regular expression
+	"cidr":     true, // cidr(client, "192.168.1.0/24", ...): the IP address is within any of the subnets
+}
+
+// Tokens
+type exprToken struct {
+	kind byte   // 'i': identifier;  's': string;  'n': number;  'p': punctuation;  0: end
+	text string // the token text (the unquoted value for strings)
+	pos  int
+}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			j := i
+			for j < len(s) && (s[j] == '_' || (s[j] >= 'a' && s[j] <= 'z') ||
+				(s[j] >= 'A' && s[j] <= 'Z') || (s[j] >= '0' && s[j] <= '9')) {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: 'i', text: s[i:j], pos: i})
+			i = j
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: 'n', text: s[i:j], pos: i})
+			i = j
+
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("%d: unterminated string", i)
+			}
+			tokens = append(tokens, exprToken{kind: 's', text: s[i+1 : i+1+j], pos: i})
+			i += j + 2
+
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if len(op) == 0 {
+				return nil, fmt.Errorf("%d: unexpected character %q", i, c)
+			}
+			tokens = append(tokens, exprToken{kind: 'p', text: op, pos: i})
+			i += len(op)
+		}
+	}
+	tokens = append(tokens, exprToken{pos: len(s)})
+	return tokens, nil
+}
+
+// Recursive descent parser:
+//
+//	or      = and { "||" and }
+//	and     = not { "&&" not }
+//	not     = "!" not | cmp
+//	cmp     = primary [ ("==" | "!=" | "<" | "<=" | ">" | ">=" | "in") primary ]
+//	primary = "(" or ")" | "[" [ primary { "," primary } ] "]" | func "(" primary { "," string } ")"
+//	          | variable | string | number | "true" | "false"
+type exprParser struct {
+	tokens []exprToken
+	i      int
+}
+
+// compileExpr parses the boolean expression
+func compileExpr(s string) (exprNode, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != 0 {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	if n.typ() != exprBool {
+		return nil, fmt.Errorf("the result must be bool, not %s", n.typ())
+	}
+	return n, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) accept(op string) bool {
+	t := p.peek()
+	if (t.kind == 'p' || t.kind == 'i') && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		return p.errorf("expected %q", op)
+	}
+	return nil
+}
+
+func (p *exprParser) parseBool(parse func() (exprNode, error)) (exprNode, error) {
+	n, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if n.typ() != exprBool {
+		return nil, p.errorf("expected bool, not %s", n.typ())
+	}
+	return n, nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	l, err := p.parseBool(p.parseAnd)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseBool(p.parseAnd)
+		if err != nil {
+			return nil, err
+		}
+		l = &logicNode{and: false, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	l, err := p.parseBool(p.parseNot)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseBool(p.parseNot)
+		if err != nil {
+			return nil, err
+		}
+		l = &logicNode{and: true, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.accept("!") {
+		x, err := p.parseBool(p.parseNot)
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *exprParser) parseCmp() (exprNode, error) {
+	l, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == 'i' && t.text == "in" {
+		p.next()
+		r, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if l.typ() != exprString || r.typ() != exprList {
+			return nil, fmt.Errorf("%d: 'in' requires string and list, not %s and %s", t.pos, l.typ(), r.typ())
+		}
+		return &inNode{x: l, list: r}, nil
+	}
+
+	if t.kind != 'p' {
+		return l, nil
+	}
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+	default:
+		return l, nil
+	}
+
+	r, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if l.typ() != r.typ() {
+		return nil, fmt.Errorf("%d: can't compare %s and %s", t.pos, l.typ(), r.typ())
+	}
+	if l.typ() == exprList || (l.typ() == exprBool && t.text != "==" && t.text != "!=") {
+		return nil, fmt.Errorf("%d: operator %s isn't supported for %s", t.pos, t.text, l.typ())
+	}
+	return &cmpNode{op: t.text, l: l, r: r}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return &literalNode{t: exprString, v: exprValue{str: t.text}}, nil
+
+	case 'n':
+		n, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", t.pos, err)
+		}
+		return &literalNode{t: exprInt, v: exprValue{num: n}}, nil
+
+	case 'p':
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			return p.parseList()
+		}
+
+	case 'i':
+		switch {
+		case t.text == "true" || t.text == "false":
+			return &literalNode{t: exprBool, v: exprValue{b: t.text == "true"}}, nil
+		case exprFuncs[t.text]:
+			return p.parseCall(t.text)
+		}
+		_, ok := exprVars[t.text]
+		if !ok {
+			return nil, fmt.Errorf("%d: unknown variable %q", t.pos, t.text)
+		}
+		return &varNode{name: t.text}, nil
+
+	case 0:
+		return nil, fmt.Errorf("%d: unexpected end of expression", t.pos)
+	}
+	return nil, fmt.Errorf("%d: unexpected %q", t.pos, t.text)
+}
+
+func (p *exprParser) parseList() (exprNode, error) {
+	n := &listNode{}
+	if p.accept("]") {
+		return n, nil
+	}
+	for {
+		it, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if it.typ() != exprString {
+			return nil, p.errorf("list items must be strings, not %s", it.typ())
+		}
+		n.items = append(n.items, it)
+		if p.accept("]") {
+			return n, nil
+		}
+		err = p.expect(",")
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	err := p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != exprString {
+		return nil, p.errorf("%s(): the first argument must be string, not %s", name, x.typ())
+	}
+
+	n := &callNode{name: name, x: x}
+	for p.accept(",") {
+		t := p.next()
+		if t.kind != 's' {
+			return nil, fmt.Errorf("%d: %s(): the arguments must be string literals", t.pos, name)
+		}
+		n.args = append(n.args, t.text)
+	}
+	err = p.expect(")")
+	if err != nil {
+		return nil, err
+	}
+	if len(n.args) == 0 {
+		return nil, p.errorf("%s(): not enough arguments", name)
+	}
+
+	switch name {
+	case "domain":
+		for i, d := range n.args {
+			n.args[i] = strings.ToLower(strings.TrimSuffix(d, "."))
+		}
+	case "matches":
+		if len(n.args) != 1 {
+			return nil, p.errorf("matches(): too many arguments")
+		}
+		n.re, err = regexp.Compile(n.args[0])
+		if err != nil {
+			return nil, p.errorf("matches(): %s", err)
+		}
+	case "cidr":
+		for _, s := range n.args {
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, p.errorf("cidr(): %s", err)
+			}
+			n.subnets = append(n.subnets, subnet)
+		}
+	}
+	return n, nil
+}
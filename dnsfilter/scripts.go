@@ -0,0 +1,194 @@
+// Custom filtering scripts
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Script actions
+const (
+	ScriptAllow   = "allow"
+	ScriptBlock   = "block"
+	ScriptRewrite = "rewrite"
+)
+
+// ScriptEntry is a custom filtering script:
+// when the expression is true for a request, the action is applied.
+type ScriptEntry struct {
+	Name    string `yaml:"name" json:"name"`
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Expr    string `yaml:"expr" json:"expr"`       // boolean expression
+	Action  string `yaml:"action" json:"action"`   // "allow", "block" or "rewrite"
+	Rewrite string `yaml:"rewrite" json:"rewrite"` // IP address or canonical name (for "rewrite" action)
+
+	expr    exprNode     // compiled expression
+	rewrite RewriteEntry // prepared rewrite (for "rewrite" action)
+}
+
+// Compile the script
+func (s *ScriptEntry) prepare() error {
+	if len(s.Name) == 0 {
+		return fmt.Errorf("name is empty")
+	}
+
+	var err error
+	s.expr, err = compileExpr(s.Expr)
+	if err != nil {
+		return fmt.Errorf("%s: expr: %s", s.Name, err)
+	}
+
+	switch s.Action {
+	case ScriptAllow, ScriptBlock:
+		// ok
+	case ScriptRewrite:
+		if len(s.Rewrite) == 0 {
+			return fmt.Errorf("%s: rewrite is empty", s.Name)
+		}
+		s.rewrite = RewriteEntry{Answer: s.Rewrite}
+		s.rewrite.prepare()
+	default:
+		return fmt.Errorf("%s: invalid action %q", s.Name, s.Action)
+	}
+	return nil
+}
+
+// PrepareScripts compiles the scripts.
+// Returns a copy of the array.
+func PrepareScripts(a []ScriptEntry) ([]ScriptEntry, error) {
+	a2 := make([]ScriptEntry, len(a))
+	copy(a2, a)
+	names := map[string]bool{}
+	for i := range a2 {
+		err := a2[i].prepare()
+		if err != nil {
+			return nil, err
+		}
+		if names[a2[i].Name] {
+			return nil, fmt.Errorf("%s: duplicate name", a2[i].Name)
+		}
+		names[a2[i].Name] = true
+	}
+	return a2, nil
+}
+
+// Compile the scripts from configuration.  Invalid scripts are disabled.
+func (d *Dnsfilter) prepareScripts() {
+	names := map[string]bool{}
+	for i := range d.Config.Scripts {
+		s := &d.Config.Scripts[i]
+		err := s.prepare()
+		if err == nil && names[s.Name] {
+			err = fmt.Errorf("%s: duplicate name", s.Name)
+		}
+		if err != nil {
+			log.Error("Scripts: %s", err)
+			s.Enabled = false
+			s.expr = nil
+		}
+		names[s.Name] = true
+	}
+}
+
+// SetScripts replaces the list of scripts
+func (d *Dnsfilter) SetScripts(a []ScriptEntry) error {
+	a, err := PrepareScripts(a)
+	if err != nil {
+		return err
+	}
+	d.confLock.Lock()
+	d.Config.Scripts = a
+	d.confLock.Unlock()
+	log.Debug("Scripts: set %d elements", len(a))
+	return nil
+}
+
+// Evaluate the scripts for the request
+func (d *Dnsfilter) processScripts(host string, qtype uint16, setts *RequestFilteringSettings) Result {
+	d.confLock.RLock()
+	scripts := d.Config.Scripts
+	d.confLock.RUnlock()
+
+	env := scriptEnv{
+		host:       host,
+		qtype:      dns.TypeToString[qtype],
+		client:     setts.ClientIP,
+		clientName: setts.ClientName,
+		tags:       setts.ClientTags,
+		now:        time.Now(),
+	}
+	return matchScripts(scripts, &env, qtype)
+}
+
+// Process the list of scripts: the first one which matches takes the decision
+func matchScripts(scripts []ScriptEntry, env *scriptEnv, qtype uint16) Result {
+	host := env.host
+	for i := range scripts {
+		s := &scripts[i]
+		if !s.Enabled || s.expr == nil || !s.expr.eval(env).b {
+			continue
+		}
+
+		log.Debug("Scripts: %s: matched %s (%s)  action: %s", s.Name, host, env.qtype, s.Action)
+		rule := "script: " + s.Name
+		switch s.Action {
+		case ScriptAllow:
+			return Result{Reason: NotFilteredWhiteList, Rule: rule}
+		case ScriptBlock:
+			return Result{IsFiltered: true, Reason: FilteredScript, Rule: rule}
+		case ScriptRewrite:
+			r := s.rewrite
+			r.Domain = host
+			res := matchRewrites([]RewriteEntry{r}, host, qtype)
+			res.Rule = rule
+			return res
+		}
+	}
+	return Result{}
+}
+
+type scriptsJSON struct {
+	Scripts []ScriptEntry `json:"scripts"`
+}
+
+func (d *Dnsfilter) handleScriptsList(w http.ResponseWriter, r *http.Request) {
+	resp := scriptsJSON{}
+	d.confLock.RLock()
+	resp.Scripts = append([]ScriptEntry{}, d.Config.Scripts...)
+	d.confLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) handleScriptsSet(w http.ResponseWriter, r *http.Request) {
+	req := scriptsJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = d.SetScripts(req.Scripts)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	d.Config.ConfigModified()
+}
+
+func (d *Dnsfilter) registerScriptsHandlers() {
+	d.Config.HTTPRegister("GET", "/control/scripts/list", d.handleScriptsList)
+	d.Config.HTTPRegister("POST", "/control/scripts/set", d.handleScriptsSet)
+}
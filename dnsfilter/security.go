@@ -4,6 +4,7 @@ package dnsfilter
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
@@ -31,6 +32,30 @@ const defaultParentalServer = "https://dns-family.adguard.com/dns-query"
 const sbTXTSuffix = "sb.dns.adguard.com."
 const pcTXTSuffix = "pc.dns.adguard.com."
 
+// Create SB/PC/SafeSearch caches.
+// Every Dnsfilter object has its own caches (unless they are passed with WithCaches()),
+// so objects with different cache sizes may be used simultaneously.
+// c may be nil: the default cache sizes are used.
+func (d *Dnsfilter) initCaches(c *Config, o *options) {
+	conf := Config{
+		SafeBrowsingCacheSize: defaultCacheSize,
+		SafeSearchCacheSize:   defaultCacheSize,
+		ParentalCacheSize:     defaultCacheSize,
+	}
+	if c != nil {
+		conf = *c
+	}
+
+	d.safebrowsingCache = newCache(o.safeBrowsingCache, cacheSize(o.safeBrowsingCacheSize, conf.SafeBrowsingCacheSize))
+	d.safeSearchCache = newCache(o.safeSearchCache, cacheSize(o.safeSearchCacheSize, conf.SafeSearchCacheSize))
+	d.parentalCache = newCache(o.parentalCache, cacheSize(o.parentalCacheSize, conf.ParentalCacheSize))
+
+	if len(conf.CacheFilePath) != 0 {
+		d.safebrowsingCache = newKeysCache(d.safebrowsingCache)
+		d.parentalCache = newKeysCache(d.parentalCache)
+	}
+}
+
 func (d *Dnsfilter) initSecurityServices() error {
 	var err error
 	d.safeBrowsingServer = defaultSafebrowsingServer
@@ -47,6 +72,12 @@ func (d *Dnsfilter) initSecurityServices() error {
 		return err
 	}
 
+	d.safeBrowsingLookups = newHashLookups(d, svcSafeBrowsing, "SafeBrowsing", sbTXTSuffix,
+		Result{IsFiltered: true, Reason: FilteredSafeBrowsing, Rule: "adguard-malware-shavar"},
+		&d.safebrowsingCache, &d.safeBrowsingUpstream)
+	d.parentalLookups = newHashLookups(d, svcParental, "Parental", pcTXTSuffix,
+		Result{IsFiltered: true, Reason: FilteredParental, Rule: "parental CATEGORY_BLACKLISTED"},
+		&d.parentalCache, &d.parentalUpstream)
 	return nil
 }
 
@@ -105,16 +136,16 @@ func (d *Dnsfilter) SafeSearchDomain(host string) (string, bool) {
 	return val, ok
 }
 
-func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
+func (d *Dnsfilter) checkSafeSearch(ctx context.Context, host string, clientIP string) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("SafeSearch: lookup for %s", host)
 	}
 
 	// Check cache. Return cached result if it was found
-	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, host)
+	cachedValue, isFound := getCachedResult(d.safeSearchCache, host)
 	if isFound {
-		// atomic.AddUint64(&gctx.stats.Safesearch.CacheHits, 1)
+		d.countLookup(svcSafeSearch, clientIP, true)
 		log.Tracef("SafeSearch: found in cache: %s", host)
 		return cachedValue, nil
 	}
@@ -127,20 +158,20 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 	res := Result{IsFiltered: true, Reason: FilteredSafeSearch}
 	if ip := net.ParseIP(safeHost); ip != nil {
 		res.IP = ip
-		valLen := d.setCacheResult(gctx.safeSearchCache, host, res)
+		valLen := d.setCacheResult(d.safeSearchCache, host, res)
 		log.Debug("SafeSearch: stored in cache: %s (%d bytes)", host, valLen)
 		return res, nil
 	}
 
 	// TODO this address should be resolved with upstream that was configured in dnsforward
-	addrs, err := net.LookupIP(safeHost)
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, safeHost)
 	if err != nil {
 		log.Tracef("SafeSearchDomain for %s was found but failed to lookup for %s cause %s", host, safeHost, err)
 		return Result{}, err
 	}
 
 	for _, i := range addrs {
-		if ipv4 := i.To4(); ipv4 != nil {
+		if ipv4 := i.IP.To4(); ipv4 != nil {
 			res.IP = ipv4
 			break
 		}
@@ -151,7 +182,7 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 	}
 
 	// Cache result
-	valLen := d.setCacheResult(gctx.safeSearchCache, host, res)
+	valLen := d.setCacheResult(d.safeSearchCache, host, res)
 	log.Debug("SafeSearch: stored in cache: %s (%d bytes)", host, valLen)
 	return res, nil
 }
@@ -210,82 +241,42 @@ func (d *Dnsfilter) processTXT(svc, host string, resp *dns.Msg, hashes map[strin
 
 // Disabling "dupl": the algorithm of SB/PC is similar, but it uses different data
 // nolint:dupl
-func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
+func (d *Dnsfilter) checkSafeBrowsing(ctx context.Context, host string, clientIP string) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("SafeBrowsing lookup for %s", host)
 	}
 
 	// check cache
-	cachedValue, isFound := getCachedResult(gctx.safebrowsingCache, host)
+	cachedValue, isFound := getCachedResult(d.safebrowsingCache, host)
 	if isFound {
-		// atomic.AddUint64(&gctx.stats.Safebrowsing.CacheHits, 1)
+		d.countLookup(svcSafeBrowsing, clientIP, true)
 		log.Tracef("SafeBrowsing: found in cache: %s", host)
 		return cachedValue, nil
 	}
 
-	result := Result{}
-	question, hashes := hostnameToHashParam(host)
-	question = question + sbTXTSuffix
-
-	log.Tracef("SafeBrowsing: checking %s: %s", host, question)
-
-	req := dns.Msg{}
-	req.SetQuestion(question, dns.TypeTXT)
-	resp, err := d.safeBrowsingUpstream.Exchange(&req)
-	if err != nil {
-		return result, err
-	}
-
-	if d.processTXT("SafeBrowsing", host, resp, hashes) {
-		result.IsFiltered = true
-		result.Reason = FilteredSafeBrowsing
-		result.Rule = "adguard-malware-shavar"
-	}
-
-	valLen := d.setCacheResult(gctx.safebrowsingCache, host, result)
-	log.Debug("SafeBrowsing: stored in cache: %s (%d bytes)", host, valLen)
-	return result, nil
+	d.countLookup(svcSafeBrowsing, clientIP, false)
+	return d.safeBrowsingLookups.lookup(ctx, host)
 }
 
 // Disabling "dupl": the algorithm of SB/PC is similar, but it uses different data
 // nolint:dupl
-func (d *Dnsfilter) checkParental(host string) (Result, error) {
+func (d *Dnsfilter) checkParental(ctx context.Context, host string, clientIP string) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("Parental lookup for %s", host)
 	}
 
 	// check cache
-	cachedValue, isFound := getCachedResult(gctx.parentalCache, host)
+	cachedValue, isFound := getCachedResult(d.parentalCache, host)
 	if isFound {
-		// atomic.AddUint64(&gctx.stats.Parental.CacheHits, 1)
+		d.countLookup(svcParental, clientIP, true)
 		log.Tracef("Parental: found in cache: %s", host)
 		return cachedValue, nil
 	}
 
-	result := Result{}
-	question, hashes := hostnameToHashParam(host)
-	question = question + pcTXTSuffix
-
-	log.Tracef("Parental: checking %s: %s", host, question)
-
-	req := dns.Msg{}
-	req.SetQuestion(question, dns.TypeTXT)
-	resp, err := d.parentalUpstream.Exchange(&req)
-	if err != nil {
-		return result, err
-	}
-
-	if d.processTXT("Parental", host, resp, hashes) {
-		result.IsFiltered = true
-		result.Reason = FilteredParental
-		result.Rule = "parental CATEGORY_BLACKLISTED"
-	}
-
-	valLen := d.setCacheResult(gctx.parentalCache, host, result)
-	log.Debug("Parental: stored in cache: %s (%d bytes)", host, valLen)
-	return result, err
+	d.countLookup(svcParental, clientIP, false)
+	return d.parentalLookups.lookup(ctx, host)
 }
 
 func httpError(r *http.Request, w http.ResponseWriter, code int, format string, args ...interface{}) {
@@ -295,12 +286,16 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 }
 
 func (d *Dnsfilter) handleSafeBrowsingEnable(w http.ResponseWriter, r *http.Request) {
+	d.confLock.Lock()
 	d.Config.SafeBrowsingEnabled = true
+	d.confLock.Unlock()
 	d.Config.ConfigModified()
 }
 
 func (d *Dnsfilter) handleSafeBrowsingDisable(w http.ResponseWriter, r *http.Request) {
+	d.confLock.Lock()
 	d.Config.SafeBrowsingEnabled = false
+	d.confLock.Unlock()
 	d.Config.ConfigModified()
 }
 
@@ -322,12 +317,16 @@ func (d *Dnsfilter) handleSafeBrowsingStatus(w http.ResponseWriter, r *http.Requ
 }
 
 func (d *Dnsfilter) handleParentalEnable(w http.ResponseWriter, r *http.Request) {
+	d.confLock.Lock()
 	d.Config.ParentalEnabled = true
+	d.confLock.Unlock()
 	d.Config.ConfigModified()
 }
 
 func (d *Dnsfilter) handleParentalDisable(w http.ResponseWriter, r *http.Request) {
+	d.confLock.Lock()
 	d.Config.ParentalEnabled = false
+	d.confLock.Unlock()
 	d.Config.ConfigModified()
 }
 
@@ -350,12 +349,16 @@ func (d *Dnsfilter) handleParentalStatus(w http.ResponseWriter, r *http.Request)
 }
 
 func (d *Dnsfilter) handleSafeSearchEnable(w http.ResponseWriter, r *http.Request) {
+	d.confLock.Lock()
 	d.Config.SafeSearchEnabled = true
+	d.confLock.Unlock()
 	d.Config.ConfigModified()
 }
 
 func (d *Dnsfilter) handleSafeSearchDisable(w http.ResponseWriter, r *http.Request) {
+	d.confLock.Lock()
 	d.Config.SafeSearchEnabled = false
+	d.confLock.Unlock()
 	d.Config.ConfigModified()
 }
 
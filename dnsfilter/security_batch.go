@@ -0,0 +1,200 @@
+// Coalescing and batching of safebrowsing/parental lookups
+
+package dnsfilter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The maximum number of hash prefixes in one TXT request:
+// every prefix takes 9 bytes of the question name which can't be longer than 255 bytes
+const maxBatchPrefixes = 24
+
+// A lookup of a host name which isn't completed yet
+type hashLookup struct {
+	host     string
+	hashes   map[string]bool // full hashes of the host name and its parent domains
+	prefixes []string        // hash prefixes to send
+	done     chan struct{}   // closed when the result is ready
+	res      Result
+	err      error
+}
+
+// hashLookups coalesces the concurrent lookups of the same host name
+// and combines the lookups of different host names into one TXT request
+type hashLookups struct {
+	d        *Dnsfilter
+	svc      int                // svcSafeBrowsing or svcParental
+	name     string             // service name for the log messages
+	suffix   string             // TXT question suffix
+	result   Result             // the result for the matched host names
+	cache    *cache.Cache       // the cache of results
+	upstream *upstream.Upstream // the server which handles TXT requests
+
+	lock          sync.Mutex
+	pending       map[string]*hashLookup // host -> lookup
+	batch         []*hashLookup          // the lookups which aren't sent yet
+	batchPrefixes map[string]bool        // the hash prefixes of the batch
+	timer         *time.Timer            // sends the batch.  nil: not started
+}
+
+func newHashLookups(d *Dnsfilter, svc int, name, suffix string, result Result,
+	c *cache.Cache, u *upstream.Upstream) *hashLookups {
+
+	return &hashLookups{
+		d:             d,
+		svc:           svc,
+		name:          name,
+		suffix:        suffix,
+		result:        result,
+		cache:         c,
+		upstream:      u,
+		pending:       map[string]*hashLookup{},
+		batchPrefixes: map[string]bool{},
+	}
+}
+
+// Get the result for the host name which isn't in cache.
+// If the same host name is being checked already, wait for the result of that lookup.
+// Return immediately when the context is canceled or its deadline is exceeded
+// (the lookup is still in progress, and its result will be stored in cache).
+func (l *hashLookups) lookup(ctx context.Context, host string) (Result, error) {
+	l.lock.Lock()
+	lk, ok := l.pending[host]
+	if ok {
+		l.lock.Unlock()
+		atomic.AddUint64(&l.d.stats.service(l.svc).Coalesced, 1)
+		log.Tracef("%s: waiting for the pending lookup: %s", l.name, host)
+	} else {
+		question, hashes := hostnameToHashParam(host)
+		lk = &hashLookup{
+			host:   host,
+			hashes: hashes,
+			done:   make(chan struct{}),
+		}
+		if len(question) != 0 {
+			lk.prefixes = strings.Split(strings.TrimSuffix(question, "."), ".")
+		}
+		l.pending[host] = lk
+		l.add(lk)
+		l.lock.Unlock()
+	}
+
+	select {
+	case <-lk.done:
+		return lk.res, lk.err
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+}
+
+// Add the lookup to the batch
+// l.lock must be held
+func (l *hashLookups) add(lk *hashLookup) {
+	n := 0
+	for _, p := range lk.prefixes {
+		if !l.batchPrefixes[p] {
+			n++
+		}
+	}
+	if len(l.batch) != 0 && len(l.batchPrefixes)+n > maxBatchPrefixes {
+		l.flush()
+	}
+
+	l.batch = append(l.batch, lk)
+	for _, p := range lk.prefixes {
+		l.batchPrefixes[p] = true
+	}
+
+	window := time.Duration(l.d.Config.LookupBatchWindow) * time.Millisecond
+	if window == 0 || len(l.batchPrefixes) >= maxBatchPrefixes {
+		l.flush()
+		return
+	}
+	if l.timer == nil {
+		l.timer = time.AfterFunc(window, l.onTimer)
+	}
+}
+
+func (l *hashLookups) onTimer() {
+	l.lock.Lock()
+	l.timer = nil
+	if len(l.batch) != 0 {
+		l.flush()
+	}
+	l.lock.Unlock()
+}
+
+// Send the batch
+// l.lock must be held
+func (l *hashLookups) flush() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+
+	prefixes := []string{}
+	for p := range l.batchPrefixes {
+		prefixes = append(prefixes, p)
+	}
+	go l.send(l.batch, prefixes)
+
+	l.batch = nil
+	l.batchPrefixes = map[string]bool{}
+}
+
+// Send TXT request and pass the result to the lookups
+func (l *hashLookups) send(batch []*hashLookup, prefixes []string) {
+	question := l.suffix
+	if len(prefixes) != 0 {
+		question = strings.Join(prefixes, ".") + "." + l.suffix
+	}
+	log.Tracef("%s: checking %d host names: %s", l.name, len(batch), question)
+
+	req := dns.Msg{}
+	req.SetQuestion(question, dns.TypeTXT)
+	st := l.d.stats.service(l.svc)
+	atomic.AddUint64(&st.Upstream, 1)
+	pending := atomic.AddInt64(&st.Pending, 1)
+	for {
+		max := atomic.LoadInt64(&st.PendingMax)
+		if pending <= max || atomic.CompareAndSwapInt64(&st.PendingMax, max, pending) {
+			break
+		}
+	}
+	resp, err := (*l.upstream).Exchange(&req)
+	atomic.AddInt64(&st.Pending, -1)
+
+	for _, lk := range batch {
+		lk.err = err
+		if err != nil {
+			continue
+		}
+
+		if l.d.processTXT(l.name, lk.host, resp, lk.hashes) {
+			lk.res = l.result
+		}
+		valLen := l.d.setCacheResult(*l.cache, lk.host, lk.res)
+		log.Debug("%s: stored in cache: %s (%d bytes)", l.name, lk.host, valLen)
+	}
+
+	// the results are in cache already: the new lookups won't wait for these ones
+	l.lock.Lock()
+	for _, lk := range batch {
+		delete(l.pending, lk.host)
+	}
+	l.lock.Unlock()
+
+	for _, lk := range batch {
+		close(lk.done)
+	}
+}
@@ -0,0 +1,131 @@
+// Tracing of the filtering stages
+
+package dnsfilter
+
+import (
+	"context"
+	"strings"
+)
+
+// Filtering stages in the order of evaluation
+const (
+	TraceStageRewrites     = "rewrites"
+	TraceStageScripts      = "scripts"
+	TraceStageWhitelist    = "whitelist"
+	TraceStageBlacklist    = "blacklist"
+	TraceStageServices     = "blocked_services"
+	TraceStageExternal     = "external_verdict"
+	TraceStageSafeSearch   = "safesearch"
+	TraceStageSafeBrowsing = "safebrowsing"
+	TraceStageParental     = "parental"
+)
+
+// TraceEntry holds the information about a filtering stage
+type TraceEntry struct {
+	Stage    string   `json:"stage"`
+	Enabled  bool     `json:"enabled"`         // FALSE: the stage was skipped because it's disabled
+	Matched  bool     `json:"matched"`         // TRUE: the stage has taken the final decision
+	Reason   string   `json:"reason"`          // Reason returned by the stage
+	Rules    []string `json:"rules,omitempty"` // Rules which were matched by the stage
+	FilterID int64    `json:"filter_id,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Trace is the list of filtering stages evaluated by CheckHostTrace
+type Trace struct {
+	Entries []TraceEntry
+}
+
+// Add the stage's result.  A nil trace is a no-op.
+func (t *Trace) add(stage string, enabled bool, res Result, rules []string) {
+	if t == nil {
+		return
+	}
+
+	e := TraceEntry{
+		Stage:    stage,
+		Enabled:  enabled,
+		Matched:  res.Reason.Matched(),
+		Reason:   res.Reason.String(),
+		Rules:    rules,
+		FilterID: res.FilterID,
+	}
+	if len(rules) == 0 && len(res.Rule) != 0 {
+		e.Rules = []string{res.Rule}
+	}
+	t.Entries = append(t.Entries, e)
+}
+
+// Add the stage that has failed.  A nil trace is a no-op.
+func (t *Trace) addError(stage string, err error) {
+	if t == nil {
+		return
+	}
+
+	t.Entries = append(t.Entries, TraceEntry{
+		Stage:   stage,
+		Enabled: true,
+		Reason:  NotFilteredError.String(),
+		Error:   err.Error(),
+	})
+}
+
+// Add whitelist and blacklist stages.
+// All rules matched by the filtering engine are stored, not just the one that has taken the decision.
+func (d *Dnsfilter) traceFilters(t *Trace, host string, qtype uint16, ctags []string, res Result) {
+	var wl, bl []string
+	for _, text := range d.matchedRules(host, qtype, ctags) {
+		if strings.HasPrefix(text, "@@") {
+			wl = append(wl, text)
+		} else {
+			bl = append(bl, text)
+		}
+	}
+
+	wlRes := Result{}
+	blRes := Result{}
+	if res.Reason == NotFilteredWhiteList {
+		wlRes = res
+	} else {
+		blRes = res
+	}
+	t.add(TraceStageWhitelist, true, wlRes, wl)
+	t.add(TraceStageBlacklist, true, blRes, bl)
+}
+
+// Get the texts of all rules that match the host name
+func (d *Dnsfilter) matchedRules(host string, qtype uint16, ctags []string) []string {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+	if d.filteringEngine == nil {
+		return nil
+	}
+
+	var list []string
+	d.customRules.forEachMatch(host, qtype, ctags, func(r *customRule) bool {
+		list = append(list, r.text)
+		return true
+	})
+
+	rr, ok := d.filteringEngine.Match(host, ctags)
+	if !ok {
+		return list
+	}
+	if rr.NetworkRule != nil {
+		list = append(list, rr.NetworkRule.Text())
+	}
+	for _, r := range rr.HostRulesV4 {
+		list = append(list, r.Text())
+	}
+	for _, r := range rr.HostRulesV6 {
+		list = append(list, r.Text())
+	}
+	return list
+}
+
+// CheckHostTrace is CheckHostCtx which also returns the information about every evaluated stage
+func (d *Dnsfilter) CheckHostTrace(ctx context.Context, host string, qtype uint16, setts *RequestFilteringSettings) (Result, Trace, error) {
+	t := Trace{}
+	res, err := d.checkHost(ctx, host, qtype, setts, &t)
+	return res, t, err
+}
@@ -0,0 +1,155 @@
+// External verdict provider
+
+package dnsfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const defaultVerdictTimeout = 1000 // in milliseconds
+
+// ExternalVerdict is the result of a domain check by an external provider
+type ExternalVerdict struct {
+	Block    bool   `json:"block"`              // TRUE: the domain must be blocked
+	Category string `json:"category,omitempty"` // Category assigned by the provider (optional)
+	Score    int    `json:"score,omitempty"`    // Reputation score assigned by the provider (optional)
+}
+
+// VerdictProvider is an external service that decides whether a domain must be blocked.
+// It's consulted only for the domains that weren't matched by the local filters.
+// Library users may set their own implementation (e.g. gRPC client) via Config.VerdictProvider.
+type VerdictProvider interface {
+	// Verdict returns the verdict for the host name.
+	// The provider must return when the context is canceled or its deadline is exceeded.
+	Verdict(ctx context.Context, host string, qtype uint16) (ExternalVerdict, error)
+}
+
+// Request body which is sent to HTTP verdict provider
+type verdictRequest struct {
+	Host  string `json:"host"`
+	QType uint16 `json:"qtype"`
+}
+
+// httpVerdictProvider sends JSON requests to an HTTP(S) server:
+// POST <url>
+// {"host":"...","qtype":1}
+// 200 OK
+// {"block":true,"category":"...","score":100}
+type httpVerdictProvider struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPVerdictProvider creates a verdict provider that uses HTTP JSON API
+func NewHTTPVerdictProvider(url string, timeout time.Duration) VerdictProvider {
+	return &httpVerdictProvider{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (p *httpVerdictProvider) Verdict(ctx context.Context, host string, qtype uint16) (ExternalVerdict, error) {
+	req := verdictRequest{
+		Host:  host,
+		QType: qtype,
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return ExternalVerdict{}, err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return ExternalVerdict{}, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(hreq)
+	if err != nil {
+		return ExternalVerdict{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ExternalVerdict{}, fmt.Errorf("%s: status code %d", p.url, resp.StatusCode)
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ExternalVerdict{}, err
+	}
+
+	v := ExternalVerdict{}
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		return ExternalVerdict{}, fmt.Errorf("%s: invalid JSON: %s", p.url, err)
+	}
+	return v, nil
+}
+
+// Initialize external verdict provider
+func (d *Dnsfilter) initVerdictProvider() {
+	if d.Config.VerdictProvider == nil && len(d.Config.VerdictURL) != 0 {
+		timeout := d.Config.VerdictTimeout
+		if timeout == 0 {
+			timeout = defaultVerdictTimeout
+		}
+		addr, useTLS, ok := parseGRPCVerdictURL(d.Config.VerdictURL)
+		if ok {
+			d.Config.VerdictProvider = NewGRPCVerdictProvider(addr, useTLS,
+				time.Duration(timeout)*time.Millisecond)
+		} else {
+			d.Config.VerdictProvider = NewHTTPVerdictProvider(d.Config.VerdictURL,
+				time.Duration(timeout)*time.Millisecond)
+		}
+	}
+
+	if d.Config.VerdictProvider != nil {
+		d.verdictCache = cache.New(cache.Config{
+			EnableLRU: true,
+			MaxSize:   d.Config.VerdictCacheSize,
+		})
+	}
+}
+
+// Check the host name with the external verdict provider
+func (d *Dnsfilter) checkExternalVerdict(ctx context.Context, host string, qtype uint16) Result {
+	cachedValue, isFound := getCachedResult(d.verdictCache, host)
+	if isFound {
+		log.Tracef("External verdict: found in cache: %s", host)
+		return cachedValue
+	}
+
+	v, err := d.Config.VerdictProvider.Verdict(ctx, host, qtype)
+	if err != nil {
+		log.Info("External verdict: %s: %s", host, err)
+		if d.Config.VerdictFailClosed {
+			// don't store the result in cache:
+			//  the provider may become available on the next request
+			return Result{IsFiltered: true, Reason: FilteredExternal}
+		}
+		return Result{}
+	}
+
+	res := Result{}
+	if v.Block {
+		res.IsFiltered = true
+		res.Reason = FilteredExternal
+		res.Rule = v.Category
+	}
+	valLen := d.setCacheResult(d.verdictCache, host, res)
+	log.Debug("External verdict: stored in cache: %s (%d bytes)  block:%t  category:%s  score:%d",
+		host, valLen, v.Block, v.Category, v.Score)
+	return res
+}
@@ -0,0 +1,208 @@
+// gRPC client of external verdict provider
+
+package dnsfilter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// gRPC method which is called by grpcVerdictProvider:
+//
+//	syntax = "proto3";
+//	package adguardhome.verdict.v1;
+//
+//	service VerdictService {
+//	  rpc Check(CheckRequest) returns (CheckResponse);
+//	}
+//	message CheckRequest {
+//	  string host = 1;
+//	  uint32 qtype = 2;
+//	}
+//	message CheckResponse {
+//	  bool block = 1;
+//	  string category = 2;
+//	  int32 score = 3;
+//	}
+const grpcVerdictMethod = "/adguardhome.verdict.v1.VerdictService/Check"
+
+// grpcVerdictProvider calls the unary gRPC method over HTTP/2
+type grpcVerdictProvider struct {
+	url    string
+	client *http.Client
+}
+
+// NewGRPCVerdictProvider creates a verdict provider that uses gRPC API.
+// addr: "host:port"
+// useTLS: TRUE: use TLS connection; FALSE: use plain-text HTTP/2 (h2c)
+func NewGRPCVerdictProvider(addr string, useTLS bool, timeout time.Duration) VerdictProvider {
+	t := &http2.Transport{}
+	scheme := "https"
+	if !useTLS {
+		scheme = "http"
+		t.AllowHTTP = true
+		t.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		}
+	}
+	return &grpcVerdictProvider{
+		url: scheme + "://" + addr + grpcVerdictMethod,
+		client: &http.Client{
+			Transport: t,
+			Timeout:   timeout,
+		},
+	}
+}
+
+func (p *grpcVerdictProvider) Verdict(ctx context.Context, host string, qtype uint16) (ExternalVerdict, error) {
+	msg := protoAppendString(nil, 1, host)
+	msg = protoAppendVarint(msg, 2, uint64(qtype))
+
+	// Length-Prefixed-Message: Compressed-Flag(1) Message-Length(4) Message
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	hreq, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return ExternalVerdict{}, err
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+	deadline, ok := ctx.Deadline()
+	if ok && time.Until(deadline) > time.Millisecond {
+		hreq.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", time.Until(deadline)/time.Millisecond))
+	}
+
+	resp, err := p.client.Do(hreq)
+	if err != nil {
+		return ExternalVerdict{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ExternalVerdict{}, fmt.Errorf("%s: status code %d", p.url, resp.StatusCode)
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ExternalVerdict{}, err
+	}
+
+	// the status is sent in trailers, or in headers if the response has no body
+	status := resp.Trailer.Get("Grpc-Status")
+	errMsg := resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status = resp.Header.Get("Grpc-Status")
+		errMsg = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		errMsg, _ = url.PathUnescape(errMsg)
+		return ExternalVerdict{}, fmt.Errorf("%s: grpc status %q: %s", p.url, status, errMsg)
+	}
+
+	if len(body) < 5 || body[0] != 0 ||
+		int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+		return ExternalVerdict{}, fmt.Errorf("%s: invalid gRPC message", p.url)
+	}
+
+	v, err := decodeGRPCVerdict(body[5:])
+	if err != nil {
+		return ExternalVerdict{}, fmt.Errorf("%s: %s", p.url, err)
+	}
+	return v, nil
+}
+
+// Parse "grpc://host:port" or "grpcs://host:port" verdict URL
+// ok: the URL has gRPC scheme
+func parseGRPCVerdictURL(s string) (addr string, useTLS bool, ok bool) {
+	if strings.HasPrefix(s, "grpc://") {
+		return strings.TrimPrefix(s, "grpc://"), false, true
+	} else if strings.HasPrefix(s, "grpcs://") {
+		return strings.TrimPrefix(s, "grpcs://"), true, true
+	}
+	return "", false, false
+}
+
+// Decode CheckResponse message
+func decodeGRPCVerdict(b []byte) (ExternalVerdict, error) {
+	v := ExternalVerdict{}
+	for len(b) != 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return v, fmt.Errorf("invalid protobuf field key")
+		}
+		b = b[n:]
+		field := key >> 3
+
+		switch key & 7 {
+		case 0: // varint
+			val, n := binary.Uvarint(b)
+			if n <= 0 {
+				return v, fmt.Errorf("invalid protobuf varint")
+			}
+			b = b[n:]
+			switch field {
+			case 1:
+				v.Block = val != 0
+			case 3:
+				v.Score = int(int32(val))
+			}
+
+		case 2: // length-delimited
+			ln, n := binary.Uvarint(b)
+			if n <= 0 || ln > uint64(len(b)-n) {
+				return v, fmt.Errorf("invalid protobuf length")
+			}
+			val := b[n : n+int(ln)]
+			b = b[n+int(ln):]
+			if field == 2 {
+				v.Category = string(val)
+			}
+
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return v, fmt.Errorf("invalid protobuf fixed64")
+			}
+			b = b[8:]
+
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return v, fmt.Errorf("invalid protobuf fixed32")
+			}
+			b = b[4:]
+
+		default:
+			return v, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+	}
+	return v, nil
+}
+
+func protoAppendVarint(b []byte, field int, val uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, val)
+}
+
+func protoAppendString(b []byte, field int, val string) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(val)))
+	return append(b, val...)
+}
+
+func appendUvarint(b []byte, val uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, val)
+	return append(b, buf[:n]...)
+}
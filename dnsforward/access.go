@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 )
@@ -18,11 +19,31 @@ type accessCtx struct {
 	allowedClientsIPNet    []net.IPNet // CIDRs of whitelist clients
 	disallowedClientsIPNet []net.IPNet // CIDRs of clients that should be blocked
 
+	allowedCountries    map[string]bool // country codes of whitelist clients
+	disallowedCountries map[string]bool
+	allowedASNs         map[uint32]bool // AS numbers of whitelist clients
+	disallowedASNs      map[uint32]bool
+	geoip               *geoipDB // nil: countries and ASNs never match
+
 	blockedHosts map[string]bool // hosts that should be blocked
+
+	rejected map[string]time.Time // client IP -> the time when the rejected request was logged
 }
 
+// The rejected requests from the same IP address are logged once per this interval
+const accessRejectLogInterval = time.Hour
+
 func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []string) error {
-	err := processIPCIDRArray(&a.allowedClients, &a.allowedClientsIPNet, allowedClients)
+	allowedClients, err := processGeoIPArray(&a.allowedCountries, &a.allowedASNs, allowedClients)
+	if err != nil {
+		return err
+	}
+	disallowedClients, err = processGeoIPArray(&a.disallowedCountries, &a.disallowedASNs, disallowedClients)
+	if err != nil {
+		return err
+	}
+
+	err = processIPCIDRArray(&a.allowedClients, &a.allowedClientsIPNet, allowedClients)
 	if err != nil {
 		return err
 	}
@@ -43,6 +64,35 @@ func convertArrayToMap(dst *map[string]bool, src []string) {
 	}
 }
 
+// Move country and ASN entries from the array into the containers.
+// Return the remaining entries.
+func processGeoIPArray(countries *map[string]bool, asns *map[uint32]bool, src []string) ([]string, error) {
+	*countries = make(map[string]bool)
+	*asns = make(map[uint32]bool)
+
+	var r []string
+	for _, s := range src {
+		country, asn, ok, err := parseGeoIPEntry(s)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			r = append(r, s)
+		} else if asn != 0 {
+			(*asns)[asn] = true
+		} else {
+			(*countries)[country] = true
+		}
+	}
+	return r, nil
+}
+
+// Return TRUE if there are country or ASN entries
+func (a *accessCtx) hasGeoIP() bool {
+	return len(a.allowedCountries) != 0 || len(a.disallowedCountries) != 0 ||
+		len(a.allowedASNs) != 0 || len(a.disallowedASNs) != 0
+}
+
 // Split array of IP or CIDR into 2 containers for fast search
 func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []string) error {
 	*dst = make(map[string]bool)
@@ -69,11 +119,22 @@ func (a *accessCtx) IsBlockedIP(ip string) bool {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	if len(a.allowedClients) != 0 || len(a.allowedClientsIPNet) != 0 {
+	var country string
+	var asn uint32
+	if a.hasGeoIP() {
+		country, asn = a.geoip.lookup(net.ParseIP(ip))
+	}
+
+	if len(a.allowedClients) != 0 || len(a.allowedClientsIPNet) != 0 ||
+		len(a.allowedCountries) != 0 || len(a.allowedASNs) != 0 {
 		_, ok := a.allowedClients[ip]
 		if ok {
 			return false
 		}
+		if (len(country) != 0 && a.allowedCountries[country]) ||
+			(asn != 0 && a.allowedASNs[asn]) {
+			return false
+		}
 
 		if len(a.allowedClientsIPNet) != 0 {
 			ipAddr := net.ParseIP(ip)
@@ -91,6 +152,10 @@ func (a *accessCtx) IsBlockedIP(ip string) bool {
 	if ok {
 		return true
 	}
+	if (len(country) != 0 && a.disallowedCountries[country]) ||
+		(asn != 0 && a.disallowedASNs[asn]) {
+		return true
+	}
 
 	if len(a.disallowedClientsIPNet) != 0 {
 		ipAddr := net.ParseIP(ip)
@@ -104,6 +169,30 @@ func (a *accessCtx) IsBlockedIP(ip string) bool {
 	return false
 }
 
+// Log the rejected request.  The requests from the same IP address are logged once per hour.
+func (a *accessCtx) logRejected(ip string) {
+	now := time.Now()
+	a.lock.Lock()
+	if a.rejected == nil || len(a.rejected) >= 10000 {
+		a.rejected = map[string]time.Time{}
+	}
+	last, ok := a.rejected[ip]
+	if ok && now.Sub(last) < accessRejectLogInterval {
+		a.lock.Unlock()
+		return
+	}
+	a.rejected[ip] = now
+	geoip := a.geoip
+	a.lock.Unlock()
+
+	country, asn := geoip.lookup(net.ParseIP(ip))
+	if len(country) != 0 || asn != 0 {
+		log.Info("Access: rejected requests from %s (country: %s, AS%d)", ip, country, asn)
+	} else {
+		log.Info("Access: rejected requests from %s", ip)
+	}
+}
+
 // IsBlockedDomain - return TRUE if this domain should be blocked
 func (a *accessCtx) IsBlockedDomain(host string) bool {
 	a.lock.Lock()
@@ -142,7 +231,15 @@ func checkIPCIDRArray(src []string) error {
 			continue
 		}
 
-		_, _, err := net.ParseCIDR(s)
+		_, _, ok, err := parseGeoIPEntry(s)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+
+		_, _, err = net.ParseCIDR(s)
 		if err != nil {
 			return err
 		}
@@ -176,6 +273,7 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.Lock()
+	a.geoip = s.geoip
 	s.conf.AllowedClients = j.AllowedClients
 	s.conf.DisallowedClients = j.DisallowedClients
 	s.conf.BlockedHosts = j.BlockedHosts
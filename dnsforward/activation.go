@@ -0,0 +1,241 @@
+// Serving the listening sockets passed by the service manager (systemd socket activation)
+
+package dnsforward
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const activatedTCPIdleTimeout = 10 * time.Second
+
+// The sockets can't be re-opened, so they are never closed:
+// the loops are interrupted by setting the deadline in the past
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// activatedServer processes the requests received on the activated sockets
+type activatedServer struct {
+	srv     *Server
+	proxy   *proxy.Proxy // DNS proxy which was started with these sockets
+	udp     []net.PacketConn
+	tcp     []net.Listener
+	stopped int32 // atomic
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]bool // TCP connections in progress
+
+	wg sync.WaitGroup
+}
+
+// Start serving the activated sockets if they are configured
+func (s *Server) startActivated() {
+	if len(s.conf.ActivatedUDP) == 0 && len(s.conf.ActivatedTCP) == 0 {
+		return
+	}
+
+	a := &activatedServer{
+		srv:   s,
+		proxy: s.dnsProxy,
+		udp:   s.conf.ActivatedUDP,
+		tcp:   s.conf.ActivatedTCP,
+		conns: map[net.Conn]bool{},
+	}
+	for _, c := range a.udp {
+		_ = c.SetReadDeadline(time.Time{})
+		a.wg.Add(1)
+		go a.serveUDP(c)
+		log.Info("DNS: listening for DNS requests on activated socket udp://%s", c.LocalAddr())
+	}
+	for _, l := range a.tcp {
+		if d, ok := l.(deadliner); ok {
+			_ = d.SetDeadline(time.Time{})
+		}
+		a.wg.Add(1)
+		go a.serveTCP(l)
+		log.Info("DNS: listening for DNS requests on activated socket tcp://%s", l.Addr())
+	}
+	s.activated = a
+}
+
+// Stop serving the activated sockets and wait until the requests in progress are completed
+func (s *Server) stopActivated() {
+	a := s.activated
+	if a == nil {
+		return
+	}
+	s.activated = nil
+
+	atomic.StoreInt32(&a.stopped, 1)
+	now := time.Now()
+	for _, c := range a.udp {
+		_ = c.SetReadDeadline(now)
+	}
+	for _, l := range a.tcp {
+		if d, ok := l.(deadliner); ok {
+			_ = d.SetDeadline(now)
+		}
+	}
+	a.connsLock.Lock()
+	for c := range a.conns {
+		_ = c.SetReadDeadline(now)
+	}
+	a.connsLock.Unlock()
+	a.wg.Wait()
+}
+
+func (a *activatedServer) isStopped() bool {
+	return atomic.LoadInt32(&a.stopped) != 0
+}
+
+func (a *activatedServer) serveUDP(c net.PacketConn) {
+	defer a.wg.Done()
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			if a.isStopped() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Error("DNS: activated socket udp://%s: %s", c.LocalAddr(), err)
+			return
+		}
+
+		req := &dns.Msg{}
+		err = req.Unpack(buf[:n])
+		if err != nil || len(req.Question) != 1 {
+			log.Debug("DNS: activated socket udp://%s: %s: invalid request", c.LocalAddr(), addr)
+			continue
+		}
+
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.handleUDP(c, addr, req)
+		}()
+	}
+}
+
+func (a *activatedServer) handleUDP(c net.PacketConn, addr net.Addr, req *dns.Msg) {
+	resp := a.srv.handleOwnRequest(a.proxy, &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		Addr:      addr,
+		StartTime: time.Now(),
+	})
+	if resp == nil {
+		return
+	}
+
+	size := dns.MinMsgSize
+	opt := req.IsEdns0()
+	if opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	resp.Truncate(size)
+
+	data, err := resp.Pack()
+	if err != nil {
+		log.Debug("DNS: pack: %s", err)
+		return
+	}
+	_, err = c.WriteTo(data, addr)
+	if err != nil {
+		log.Debug("DNS: activated socket udp://%s: %s: write: %s", c.LocalAddr(), addr, err)
+	}
+}
+
+func (a *activatedServer) serveTCP(l net.Listener) {
+	defer a.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if a.isStopped() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Error("DNS: activated socket tcp://%s: %s", l.Addr(), err)
+			return
+		}
+
+		a.connsLock.Lock()
+		a.conns[conn] = true
+		a.connsLock.Unlock()
+		a.wg.Add(1)
+		go a.handleTCPConn(conn)
+	}
+}
+
+// Process the requests of a TCP connection until it's closed by client or it's idle.
+// Both messages are prefixed with 2-byte length field.
+func (a *activatedServer) handleTCPConn(conn net.Conn) {
+	defer a.wg.Done()
+	defer func() {
+		a.connsLock.Lock()
+		delete(a.conns, conn)
+		a.connsLock.Unlock()
+		_ = conn.Close()
+	}()
+
+	for {
+		// the deadline is set before the check, so it isn't overwritten after stopActivated() has set it
+		_ = conn.SetReadDeadline(time.Now().Add(activatedTCPIdleTimeout))
+		if a.isStopped() {
+			return
+		}
+		var length uint16
+		err := binary.Read(conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+		buf := make([]byte, length)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			log.Debug("DNS: activated socket tcp://%s: %s: read: %s", conn.LocalAddr(), conn.RemoteAddr(), err)
+			return
+		}
+
+		req := &dns.Msg{}
+		err = req.Unpack(buf)
+		if err != nil || len(req.Question) != 1 {
+			log.Debug("DNS: activated socket tcp://%s: %s: invalid request", conn.LocalAddr(), conn.RemoteAddr())
+			return
+		}
+
+		resp := a.srv.handleOwnRequest(a.proxy, &proxy.DNSContext{
+			Proto:     proxy.ProtoTCP,
+			Req:       req,
+			Addr:      conn.RemoteAddr(),
+			StartTime: time.Now(),
+		})
+		if resp == nil {
+			return
+		}
+
+		data, err := resp.Pack()
+		if err != nil {
+			log.Debug("DNS: pack: %s", err)
+			return
+		}
+		data = append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+		_, err = conn.Write(data)
+		if err != nil {
+			log.Debug("DNS: activated socket tcp://%s: %s: write: %s", conn.LocalAddr(), conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
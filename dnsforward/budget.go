@@ -0,0 +1,327 @@
+// Upstream query budget for metered connections
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const defaultBudgetPeriod = 60 * 60 // in seconds
+
+// What to do with a request when the budget is exceeded
+const (
+	budgetOverflowServFail = "servfail" // respond with SERVFAIL
+	budgetOverflowStale    = "stale"    // respond with the last response received from upstream (even if it's expired)
+)
+
+// tokenBucket allows a number of events per period.
+// The tokens are added continuously, so the budget isn't reset at once when a period ends.
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func newTokenBucket(capacity uint32, period time.Duration, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		rate:     float64(capacity) / period.Seconds(),
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.last = now
+}
+
+// Return TRUE if there's a token left
+func (b *tokenBucket) available(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// Spend a token
+func (b *tokenBucket) take(now time.Time) {
+	b.refill(now)
+	b.tokens--
+	if b.tokens < 0 {
+		b.tokens = 0
+	}
+}
+
+// upstreamBudget limits the number of queries sent to upstream servers per period
+// (e.g. when the primary WAN fails over to a cellular backup link).
+// Responses from cache don't spend the budget.
+type upstreamBudget struct {
+	lock            sync.Mutex
+	bucket          *tokenBucket // nil: unlimited
+	overflow        string
+	blockedServices []string
+
+	exceeded uint64 // number of requests that weren't sent upstream (atomic)
+
+	gates sync.Map // *dns.Msg -> *budgetGate: the requests being resolved
+}
+
+// Apply the settings.  The budget is refilled if the limits are changed.
+func (b *upstreamBudget) configure(c *FilteringConfig) {
+	period := c.UpstreamBudgetPeriod
+	if period == 0 {
+		period = defaultBudgetPeriod
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c.UpstreamBudget == 0 {
+		b.bucket = nil
+	} else if b.bucket == nil || b.bucket.capacity != float64(c.UpstreamBudget) ||
+		b.bucket.rate != float64(c.UpstreamBudget)/float64(period) {
+		b.bucket = newTokenBucket(c.UpstreamBudget, time.Duration(period)*time.Second, time.Now())
+	}
+
+	b.overflow = c.UpstreamBudgetOverflow
+	b.blockedServices = stringArrayDup(c.UpstreamBudgetBlockedServices)
+}
+
+// Return TRUE if a request may be sent upstream
+func (b *upstreamBudget) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bucket == nil || b.bucket.available(time.Now())
+}
+
+// Return TRUE if the budget is exceeded
+func (b *upstreamBudget) isExceeded() bool {
+	return !b.allow()
+}
+
+// Spend the budget for the request which is going to be sent upstream.
+// Return FALSE if the budget is exceeded.
+// The check and the spending is one operation, so the concurrent requests can't overspend the budget.
+func (b *upstreamBudget) reserve() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.bucket == nil {
+		return true
+	}
+	now := time.Now()
+	if !b.bucket.available(now) {
+		return false
+	}
+	b.bucket.take(now)
+	return true
+}
+
+// Return TRUE if the budget is limited
+func (b *upstreamBudget) limited() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bucket != nil
+}
+
+var errBudgetExceeded = errors.New("upstream budget is exceeded")
+
+// budgetGate spends the budget for one request when the request is actually sent upstream
+// (i.e. it isn't answered from cache), and only once even if it's sent to several upstreams
+type budgetGate struct {
+	budget   *upstreamBudget
+	lock     sync.Mutex
+	reserved bool
+	exceeded bool
+}
+
+// Return TRUE if the request may be sent upstream
+func (g *budgetGate) pass() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.reserved && !g.exceeded {
+		g.reserved = g.budget.reserve()
+		g.exceeded = !g.reserved
+	}
+	return g.reserved
+}
+
+// Return TRUE if the request wasn't sent upstream because the budget is exceeded
+func (g *budgetGate) isExceeded() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.exceeded
+}
+
+// Start resolving the request which spends the budget.
+// Return nil if the budget is unlimited.
+func (b *upstreamBudget) begin(req *dns.Msg) *budgetGate {
+	if !b.limited() {
+		return nil
+	}
+	g := &budgetGate{budget: b}
+	b.gates.Store(req, g)
+	return g
+}
+
+// Finish resolving the request
+func (b *upstreamBudget) end(req *dns.Msg, g *budgetGate) {
+	if g != nil {
+		b.gates.Delete(req)
+	}
+}
+
+// budgetUpstream sends the request upstream only if the budget allows it.
+// The requests which aren't started with begin() (e.g. internal requests) are always sent.
+type budgetUpstream struct {
+	upstream.Upstream
+	budget *upstreamBudget
+}
+
+func (u *budgetUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	g, ok := u.budget.gates.Load(req)
+	if ok && !g.(*budgetGate).pass() {
+		return nil, errBudgetExceeded
+	}
+	return u.Upstream.Exchange(req)
+}
+
+// Wrap the upstreams so they are used only if the budget allows it.
+// The default upstreams of the DNS proxy are wrapped once, so the responses from cache don't spend the budget.
+func (b *upstreamBudget) wrap(upstreams []upstream.Upstream) []upstream.Upstream {
+	if len(upstreams) == 0 {
+		return upstreams
+	}
+	list := []upstream.Upstream{}
+	for _, u := range upstreams {
+		list = append(list, &budgetUpstream{Upstream: u, budget: b})
+	}
+	return list
+}
+
+// Get the upstream which has sent the response (not the wrapper)
+func unwrapBudgetUpstream(u upstream.Upstream) upstream.Upstream {
+	if bu, ok := u.(*budgetUpstream); ok {
+		return bu.Upstream
+	}
+	return u
+}
+
+// Return TRUE if the requests must be answered with stale responses when the budget is exceeded
+func (b *upstreamBudget) overflowStale() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.overflow == budgetOverflowStale
+}
+
+// BudgetBlockedServices returns the names of the services which must be blocked
+// because the upstream budget is exceeded
+func (s *Server) BudgetBlockedServices() []string {
+	if !s.budget.isExceeded() {
+		return nil
+	}
+	s.budget.lock.Lock()
+	list := s.budget.blockedServices
+	s.budget.lock.Unlock()
+	return list
+}
+
+// Respond to the request which can't be sent upstream because the budget is exceeded.
+// The stale responses are shared by all clients, so they aren't used if useStale is FALSE.
+func processBudgetExceeded(ctx *dnsContext, useStale bool) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+
+	atomic.AddUint64(&s.budget.exceeded, 1)
+
+	if useStale && s.budget.overflowStale() {
+		resp := s.stale.getLast(d.Upstreams, d.Req)
+		if resp != nil {
+			log.Debug("DNS: upstream budget is exceeded: stale response for %s", d.Req.Question[0].Name)
+			d.Res = resp
+			ctx.responseFromUpstream = true // the response is filtered in the same way
+			return resultDone
+		}
+	}
+
+	log.Debug("DNS: upstream budget is exceeded: %s", d.Req.Question[0].Name)
+	d.Res = s.genServerFailure(d.Req)
+	return resultDone
+}
+
+type budgetJSON struct {
+	Budget          uint32   `json:"budget"`
+	Period          uint32   `json:"period"`
+	Overflow        string   `json:"overflow"`
+	BlockedServices []string `json:"blocked_services"`
+
+	// status
+	Left     uint32 `json:"left"`     // the number of requests left
+	Exceeded uint64 `json:"exceeded"` // number of requests that weren't sent upstream since startup
+}
+
+func (s *Server) handleBudgetStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := budgetJSON{
+		Budget:          s.conf.UpstreamBudget,
+		Period:          s.conf.UpstreamBudgetPeriod,
+		Overflow:        s.conf.UpstreamBudgetOverflow,
+		BlockedServices: stringArrayDup(s.conf.UpstreamBudgetBlockedServices),
+	}
+	s.RUnlock()
+
+	s.budget.lock.Lock()
+	if s.budget.bucket != nil {
+		s.budget.bucket.refill(time.Now())
+		j.Left = uint32(s.budget.bucket.tokens)
+	}
+	s.budget.lock.Unlock()
+	j.Exceeded = atomic.LoadUint64(&s.budget.exceeded)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleBudgetSet(w http.ResponseWriter, r *http.Request) {
+	j := budgetJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if !(j.Overflow == "" || j.Overflow == budgetOverflowServFail || j.Overflow == budgetOverflowStale) {
+		httpError(r, w, http.StatusBadRequest, "overflow: incorrect value")
+		return
+	}
+
+	s.Lock()
+	s.conf.UpstreamBudget = j.Budget
+	s.conf.UpstreamBudgetPeriod = j.Period
+	s.conf.UpstreamBudgetOverflow = j.Overflow
+	s.conf.UpstreamBudgetBlockedServices = j.BlockedServices
+	s.budget.configure(&s.conf.FilteringConfig)
+	s.stale.configure(&s.conf.FilteringConfig)
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	log.Debug("DNS: upstream budget: %d requests per %d seconds  overflow:%s",
+		j.Budget, j.Period, j.Overflow)
+}
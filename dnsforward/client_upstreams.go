@@ -0,0 +1,64 @@
+// Per-client upstream servers
+
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// ClientUpstreams is the upstream configuration of a client.
+// The same syntax as for the global upstreams is used:
+// "upstream", "[/domain1/domain2/]upstream" and "[/domain/]#" (use the global upstreams for the domain).
+type ClientUpstreams struct {
+	upstreams []upstream.Upstream // empty: the global upstreams are used
+	domains   *domainTrie         // domain-specific upstreams
+}
+
+// NewClientUpstreams creates upstream objects from the client's settings
+func NewClientUpstreams(list []string, bootstrap []string) (*ClientUpstreams, error) {
+	conf, err := proxy.ParseUpstreamsConfig(list, bootstrap, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cu := &ClientUpstreams{
+		upstreams: conf.Upstreams,
+		domains:   &domainTrie{},
+	}
+	for domain, l := range conf.DomainReservedUpstreams {
+		cu.domains.add(domain, l)
+	}
+	return cu, nil
+}
+
+// Get the upstreams for the host name.
+// nil: the global upstreams must be used.
+func (cu *ClientUpstreams) forHost(host string) []upstream.Upstream {
+	if cu.domains != nil {
+		list, ok := cu.domains.match(host)
+		if ok {
+			if len(list) == 0 {
+				return nil // "[/domain/]#"
+			}
+			return list
+		}
+	}
+	if len(cu.upstreams) == 0 {
+		return nil
+	}
+	return cu.upstreams
+}
+
+// ValidateClientUpstreams validates each upstream of a client.
+// Unlike the global settings, the default upstreams are optional:
+// the global upstreams are used for the domains which don't match any domain-specific entry.
+func ValidateClientUpstreams(upstreams []string) error {
+	for _, u := range upstreams {
+		_, err := validateUpstream(u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
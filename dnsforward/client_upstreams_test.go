@@ -0,0 +1,33 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientUpstreams(t *testing.T) {
+	list := []string{"1.1.1.1", "[/corp.example/]10.0.0.1", "[/public.corp.example/]#"}
+	assert.Nil(t, ValidateClientUpstreams(list))
+	cu, err := NewClientUpstreams(list, nil)
+	assert.Nil(t, err)
+
+	u := cu.forHost("example.org.")
+	assert.Equal(t, 1, len(u))
+	assert.Equal(t, "1.1.1.1:53", u[0].Address())
+
+	u = cu.forHost("host.corp.example.")
+	assert.Equal(t, 1, len(u))
+	assert.Equal(t, "10.0.0.1:53", u[0].Address())
+
+	// the global upstreams
+	assert.Nil(t, cu.forHost("www.public.corp.example."))
+
+	// only domain-specific upstreams
+	list = []string{"[/corp.example/]10.0.0.1"}
+	assert.Nil(t, ValidateClientUpstreams(list))
+	assert.NotNil(t, ValidateUpstreams(list))
+	cu, err = NewClientUpstreams(list, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, cu.forHost("example.org."))
+}
@@ -0,0 +1,115 @@
+// Client IDs: identification of the clients by DoH path or by DoT server name
+
+package dnsforward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+const (
+	dohPath           = "/dns-query"
+	clientIDParam     = "client_id" // DoH query parameter
+	maxClientIDLength = 63
+)
+
+// ValidateClientID checks the client ID:
+// 1..63 characters: lowercase letters, digits and hyphens (so that it can be used as a DNS label)
+func ValidateClientID(id string) error {
+	if len(id) == 0 || len(id) > maxClientIDLength {
+		return fmt.Errorf("invalid client ID %q: length must be 1..%d", id, maxClientIDLength)
+	}
+	for _, c := range id {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			return fmt.Errorf("invalid client ID %q: invalid character %q", id, c)
+		}
+	}
+	if id[0] == '-' || id[len(id)-1] == '-' {
+		return fmt.Errorf("invalid client ID %q: must not start or end with a hyphen", id)
+	}
+	return nil
+}
+
+// Get client ID from DoH request: "/dns-query/ID" or "/dns-query?client_id=ID".  "": not set.
+func clientIDFromDoHRequest(urlPath, param string) (string, error) {
+	id := ""
+	p := path.Clean(urlPath)
+	if strings.HasPrefix(p, dohPath+"/") {
+		id = p[len(dohPath+"/"):]
+		if strings.Contains(id, "/") {
+			return "", fmt.Errorf("invalid DoH path %s", urlPath)
+		}
+	} else if p != dohPath {
+		return "", fmt.Errorf("invalid DoH path %s", urlPath)
+	}
+
+	if len(param) != 0 {
+		if len(id) != 0 && id != param {
+			return "", fmt.Errorf("client ID in path (%s) and in query (%s) don't match", id, param)
+		}
+		id = param
+	}
+	if len(id) == 0 {
+		return "", nil
+	}
+	id = strings.ToLower(id)
+	return id, ValidateClientID(id)
+}
+
+// Get client ID from TLS server name "ID.dns.example" when the certificate is issued for "*.dns.example".
+// "": not set.
+func clientIDFromServerName(dnsNames []string, sni string) (string, error) {
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	for _, dn := range dnsNames {
+		if !strings.HasPrefix(dn, "*.") {
+			continue
+		}
+		base := strings.ToLower(dn[1:]) // ".dns.example"
+		if !strings.HasSuffix(sni, base) {
+			continue
+		}
+		id := sni[:len(sni)-len(base)]
+		if len(id) == 0 || strings.Contains(id, ".") {
+			continue
+		}
+		return id, ValidateClientID(id)
+	}
+	return "", nil
+}
+
+// tlsConn is the connection which provides the TLS state (e.g. *tls.Conn)
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// Get client ID of the request.  "": the client is identified by IP address.
+func (s *Server) clientIDFromDNSContext(d *proxy.DNSContext) (string, error) {
+	switch d.Proto {
+	case proxy.ProtoHTTPS:
+		r := d.HTTPRequest
+		if r == nil || r.URL == nil {
+			return "", nil
+		}
+		return clientIDFromDoHRequest(r.URL.Path, r.URL.Query().Get(clientIDParam))
+
+	case proxy.ProtoTLS:
+		tc, ok := d.Conn.(tlsConn)
+		if !ok {
+			return "", nil
+		}
+		return clientIDFromServerName(s.conf.dnsNames, tc.ConnectionState().ServerName)
+	}
+	return "", nil
+}
+
+// Get the key for per-client settings:  client ID if it's set, otherwise IP address
+func (ctx *dnsContext) clientKey() string {
+	if len(ctx.clientID) != 0 {
+		return ctx.clientID
+	}
+	return ctx.clientIP
+}
@@ -0,0 +1,74 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateClientID(t *testing.T) {
+	assert.Nil(t, ValidateClientID("kids-tablet"))
+	assert.Nil(t, ValidateClientID("a1"))
+	assert.NotNil(t, ValidateClientID(""))
+	assert.NotNil(t, ValidateClientID("Kids"))
+	assert.NotNil(t, ValidateClientID("kids_tablet"))
+	assert.NotNil(t, ValidateClientID("-kids"))
+	assert.NotNil(t, ValidateClientID("1.2.3.4"))
+	assert.NotNil(t, ValidateClientID("aa:bb:cc:dd:ee:ff"))
+	long := ""
+	for i := 0; i != 64; i++ {
+		long += "a"
+	}
+	assert.NotNil(t, ValidateClientID(long))
+	assert.Nil(t, ValidateClientID(long[1:]))
+}
+
+func TestClientIDFromDoHRequest(t *testing.T) {
+	id, err := clientIDFromDoHRequest("/dns-query", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+
+	id, err = clientIDFromDoHRequest("/dns-query/kids-tablet", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "kids-tablet", id)
+
+	id, err = clientIDFromDoHRequest("/dns-query/Kids-Tablet/", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "kids-tablet", id)
+
+	id, err = clientIDFromDoHRequest("/dns-query", "phone")
+	assert.Nil(t, err)
+	assert.Equal(t, "phone", id)
+
+	_, err = clientIDFromDoHRequest("/dns-query/phone", "tablet")
+	assert.NotNil(t, err)
+	_, err = clientIDFromDoHRequest("/dns-query/a/b", "")
+	assert.NotNil(t, err)
+	_, err = clientIDFromDoHRequest("/other", "")
+	assert.NotNil(t, err)
+	_, err = clientIDFromDoHRequest("/dns-query/a_b", "")
+	assert.NotNil(t, err)
+}
+
+func TestClientIDFromServerName(t *testing.T) {
+	dnsNames := []string{"*.dns.example", "dns.example"}
+
+	id, err := clientIDFromServerName(dnsNames, "kids-tablet.dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, "kids-tablet", id)
+
+	id, err = clientIDFromServerName(dnsNames, "dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+
+	id, err = clientIDFromServerName(dnsNames, "a.b.dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+
+	id, err = clientIDFromServerName([]string{"dns.example"}, "kids-tablet.dns.example")
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+
+	_, err = clientIDFromServerName(dnsNames, "-kids.dns.example")
+	assert.NotNil(t, err)
+}
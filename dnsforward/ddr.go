@@ -0,0 +1,393 @@
+// Discovery of Designated Resolvers (RFC 9462):
+// plain DNS upstream servers are upgraded to the encrypted protocols they advertise
+
+package dnsforward
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	ddrName     = "_dns.resolver.arpa."
+	ddrTimeout  = 2 * time.Second
+	ddrMinTTL   = 5 * 60       // in seconds
+	ddrMaxTTL   = 24 * 60 * 60 // in seconds
+	ddrRetryTTL = 60 * 60      // in seconds: probe again after this time if the upstream wasn't upgraded
+
+	typeSVCB = 64 // RFC 9460
+)
+
+// Upgrade status of an upstream server
+const (
+	ddrUpgraded     = "upgraded"      // the upstream is replaced with the designated encrypted resolver
+	ddrNotSupported = "not_supported" // the upstream doesn't advertise encrypted resolvers
+	ddrUnverified   = "unverified"    // the certificate of the designated resolver doesn't match the upstream address
+	ddrError        = "error"         // the upstream didn't respond to the probe
+)
+
+// SvcParamKeys (RFC 9460, RFC 9461)
+const (
+	svcParamALPN    = 1
+	svcParamPort    = 3
+	svcParamDoHPath = 7
+)
+
+// svcbRecord is a parsed SVCB record
+type svcbRecord struct {
+	priority uint16 // 0: AliasMode
+	target   string
+	alpn     []string
+	port     uint16 // 0: default port of the protocol
+	dohPath  string // URI template without "{?dns}" suffix
+}
+
+// ddrStatus is the result of probing a plain DNS upstream server
+type ddrStatus struct {
+	Upstream   string   `json:"upstream"`
+	Status     string   `json:"status"`
+	Designated []string `json:"designated"`  // encrypted resolvers advertised by the upstream
+	UpgradedTo string   `json:"upgraded_to"` // the upstream which is used instead of the plain one
+	Error      string   `json:"error,omitempty"`
+
+	expire time.Time // the time when the upstream must be probed again
+}
+
+// ddrCtx keeps the results of probing the upstream servers
+type ddrCtx struct {
+	lock     sync.Mutex
+	statuses map[string]*ddrStatus // "IP:port" -> status
+
+	// these functions are replaced in tests
+	exchange func(addr string, req *dns.Msg) (*dns.Msg, error)
+	verify   func(addr string, ip net.IP) error
+}
+
+// Parse SVCB record which is received as an unknown RR type
+func parseSVCB(rr dns.RR) (*svcbRecord, error) {
+	unk, ok := rr.(*dns.RFC3597)
+	if !ok {
+		return nil, fmt.Errorf("unexpected record type %T", rr)
+	}
+	data, err := hex.DecodeString(unk.Rdata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rdata: %s", err)
+	}
+	if len(data) < 2 {
+		return nil, fmt.Errorf("invalid rdata: too short")
+	}
+
+	rec := &svcbRecord{}
+	rec.priority = binary.BigEndian.Uint16(data)
+	var off int
+	rec.target, off, err = dns.UnpackDomainName(data, 2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target name: %s", err)
+	}
+
+	for off < len(data) {
+		if off+4 > len(data) {
+			return nil, fmt.Errorf("invalid SvcParam at %d", off)
+		}
+		key := binary.BigEndian.Uint16(data[off:])
+		n := int(binary.BigEndian.Uint16(data[off+2:]))
+		off += 4
+		if off+n > len(data) {
+			return nil, fmt.Errorf("invalid SvcParam %d: value is too long", key)
+		}
+		val := data[off : off+n]
+		off += n
+
+		switch key {
+		case svcParamALPN:
+			for len(val) != 0 {
+				l := int(val[0])
+				if l == 0 || 1+l > len(val) {
+					return nil, fmt.Errorf("invalid alpn value")
+				}
+				rec.alpn = append(rec.alpn, string(val[1:1+l]))
+				val = val[1+l:]
+			}
+
+		case svcParamPort:
+			if n != 2 {
+				return nil, fmt.Errorf("invalid port value")
+			}
+			rec.port = binary.BigEndian.Uint16(val)
+
+		case svcParamDoHPath:
+			rec.dohPath = strings.TrimSuffix(string(val), "{?dns}")
+		}
+	}
+	return rec, nil
+}
+
+func ddrHostPort(ip net.IP, port, defaultPort uint16) string {
+	if port == 0 {
+		port = defaultPort
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// Get the addresses of the encrypted resolvers designated by the record.
+// The IP address of the plain upstream is used instead of the target name:
+// the designated resolver is verified by this address.
+func (rec *svcbRecord) addresses(ip net.IP) []string {
+	var addrs []string
+	doh := false
+	for _, alpn := range rec.alpn {
+		switch alpn {
+		case "dot":
+			addrs = append(addrs, "tls://"+ddrHostPort(ip, rec.port, 853))
+
+		case "doq":
+			addrs = append(addrs, "quic://"+ddrHostPort(ip, rec.port, 853))
+
+		case "h2", "h3":
+			if !doh && len(rec.dohPath) != 0 {
+				addrs = append(addrs, "https://"+ddrHostPort(ip, rec.port, 443)+rec.dohPath)
+				doh = true
+			}
+		}
+	}
+	return addrs
+}
+
+// Return "IP:port" if the upstream is a plain DNS server specified by IP address
+func ddrPlainAddr(upstream string) (string, bool) {
+	u, _, err := separateUpstream(upstream)
+	if err != nil || checkPlainDNS(u) != nil {
+		return "", false
+	}
+	if net.ParseIP(u) != nil {
+		return net.JoinHostPort(u, "53"), true
+	}
+	return u, true
+}
+
+// Replace the server address in the upstream string, preserving "[/domains/]" prefix
+func ddrReplace(upstream, addr string) string {
+	if strings.HasPrefix(upstream, "[/") {
+		i := strings.LastIndex(upstream, "/]")
+		return upstream[:i+2] + addr
+	}
+	return addr
+}
+
+func ddrExchange(addr string, req *dns.Msg) (*dns.Msg, error) {
+	c := dns.Client{Net: "udp", Timeout: ddrTimeout}
+	resp, _, err := c.Exchange(req, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(req, addr)
+	}
+	return resp, err
+}
+
+// Connect to the designated resolver and check that its certificate is valid for the IP address
+func ddrVerify(addr string, ip net.IP) error {
+	dialer := &net.Dialer{Timeout: ddrTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: ip.String()})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Query the upstream for its designated resolvers and choose the one to use instead
+func (d *ddrCtx) probe(addr string) *ddrStatus {
+	st := &ddrStatus{
+		Upstream:   addr,
+		Status:     ddrNotSupported,
+		Designated: []string{},
+		expire:     time.Now().Add(ddrRetryTTL * time.Second),
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+
+	exchange := d.exchange
+	if exchange == nil {
+		exchange = ddrExchange
+	}
+	req := &dns.Msg{}
+	req.SetQuestion(ddrName, typeSVCB)
+	req.SetEdns0(4096, false)
+	resp, err := exchange(addr, req)
+	if err != nil {
+		st.Status = ddrError
+		st.Error = err.Error()
+		return st
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return st
+	}
+
+	var records []*svcbRecord
+	ttl := uint32(ddrMaxTTL)
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != typeSVCB {
+			continue
+		}
+		rec, err := parseSVCB(rr)
+		if err != nil {
+			log.Debug("DNS: DDR: %s: %s", addr, err)
+			continue
+		}
+		if rec.priority == 0 {
+			continue // AliasMode isn't used for DDR
+		}
+		records = append(records, rec)
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].priority < records[j].priority
+	})
+
+	for _, rec := range records {
+		st.Designated = append(st.Designated, rec.addresses(ip)...)
+	}
+	if len(st.Designated) == 0 {
+		return st
+	}
+
+	verify := d.verify
+	if verify == nil {
+		verify = ddrVerify
+	}
+	st.Status = ddrUnverified
+	for _, u := range st.Designated {
+		var tlsAddr string
+		if strings.HasPrefix(u, "tls://") {
+			tlsAddr = u[len("tls://"):]
+		} else if strings.HasPrefix(u, "https://") {
+			tlsAddr = strings.SplitN(u[len("https://"):], "/", 2)[0]
+		} else {
+			continue // DNS-over-QUIC upstreams aren't supported
+		}
+
+		err = verify(tlsAddr, ip)
+		if err != nil {
+			log.Debug("DNS: DDR: %s: %s: %s", addr, u, err)
+			st.Error = err.Error()
+			continue
+		}
+
+		if ttl < ddrMinTTL {
+			ttl = ddrMinTTL
+		}
+		st.Status = ddrUpgraded
+		st.UpgradedTo = u
+		st.Error = ""
+		st.expire = time.Now().Add(time.Duration(ttl) * time.Second)
+		break
+	}
+	return st
+}
+
+// Get the list of upstreams where plain DNS servers are replaced with their designated encrypted resolvers.
+// The servers are probed concurrently;  the results are cached according to TTL of SVCB records.
+func (d *ddrCtx) upgrade(upstreams []string) []string {
+	now := time.Now()
+	var probe []string
+	d.lock.Lock()
+	if d.statuses == nil {
+		d.statuses = map[string]*ddrStatus{}
+	}
+	used := map[string]bool{}
+	for _, u := range upstreams {
+		addr, ok := ddrPlainAddr(u)
+		if !ok || used[addr] {
+			continue
+		}
+		used[addr] = true
+		st, ok := d.statuses[addr]
+		if !ok || now.After(st.expire) {
+			probe = append(probe, addr)
+		}
+	}
+	for addr := range d.statuses {
+		if !used[addr] {
+			delete(d.statuses, addr)
+		}
+	}
+	d.lock.Unlock()
+
+	results := make([]*ddrStatus, len(probe))
+	wg := sync.WaitGroup{}
+	for i, addr := range probe {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i] = d.probe(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	var r []string
+	d.lock.Lock()
+	for _, st := range results {
+		d.statuses[st.Upstream] = st
+		log.Debug("DNS: DDR: %s: %s %s", st.Upstream, st.Status, st.UpgradedTo)
+	}
+	for _, u := range upstreams {
+		addr, ok := ddrPlainAddr(u)
+		if ok && d.statuses[addr].Status == ddrUpgraded {
+			u = ddrReplace(u, d.statuses[addr].UpgradedTo)
+		}
+		r = append(r, u)
+	}
+	d.lock.Unlock()
+	return r
+}
+
+// Remove the results of probing
+func (d *ddrCtx) clear() {
+	d.lock.Lock()
+	d.statuses = nil
+	d.lock.Unlock()
+}
+
+type ddrStatusJSON struct {
+	Enabled   bool        `json:"enabled"`
+	Upstreams []ddrStatus `json:"upstreams"`
+}
+
+func (s *Server) handleDDRStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := ddrStatusJSON{
+		Enabled:   s.conf.UpstreamDDR,
+		Upstreams: []ddrStatus{},
+	}
+	s.RUnlock()
+
+	s.ddr.lock.Lock()
+	for _, st := range s.ddr.statuses {
+		j.Upstreams = append(j.Upstreams, *st)
+	}
+	s.ddr.lock.Unlock()
+	sort.Slice(j.Upstreams, func(i, k int) bool {
+		return j.Upstreams[i].Upstream < j.Upstreams[k].Upstream
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
@@ -0,0 +1,125 @@
+package dnsforward
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Build SVCB record in wire format:
+// priority, target "dns.example.", alpn, port (if non-zero), dohpath (if not empty)
+func testSVCB(priority uint16, alpn []string, port uint16, dohPath string, ttl uint32) dns.RR {
+	data := []byte{byte(priority >> 8), byte(priority)}
+	data = append(data, 3, 'd', 'n', 's', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0)
+
+	var v []byte
+	for _, a := range alpn {
+		v = append(v, byte(len(a)))
+		v = append(v, a...)
+	}
+	data = append(data, 0, svcParamALPN, 0, byte(len(v)))
+	data = append(data, v...)
+	if port != 0 {
+		data = append(data, 0, svcParamPort, 0, 2, byte(port>>8), byte(port))
+	}
+	if len(dohPath) != 0 {
+		data = append(data, 0, svcParamDoHPath, 0, byte(len(dohPath)))
+		data = append(data, dohPath...)
+	}
+
+	return &dns.RFC3597{
+		Hdr: dns.RR_Header{
+			Name:     ddrName,
+			Rrtype:   typeSVCB,
+			Class:    dns.ClassINET,
+			Ttl:      ttl,
+			Rdlength: uint16(len(data)),
+		},
+		Rdata: hex.EncodeToString(data),
+	}
+}
+
+func TestParseSVCB(t *testing.T) {
+	rec, err := parseSVCB(testSVCB(1, []string{"h2", "h3"}, 8443, "/dns-query{?dns}", 300))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1), rec.priority)
+	assert.Equal(t, "dns.example.", rec.target)
+	assert.Equal(t, []string{"h2", "h3"}, rec.alpn)
+	assert.Equal(t, uint16(8443), rec.port)
+	assert.Equal(t, "/dns-query", rec.dohPath)
+
+	ip := net.ParseIP("1.2.3.4")
+	assert.Equal(t, []string{"https://1.2.3.4:8443/dns-query"}, rec.addresses(ip))
+
+	rec, err = parseSVCB(testSVCB(2, []string{"dot", "doq"}, 0, "", 300))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tls://1.2.3.4:853", "quic://1.2.3.4:853"}, rec.addresses(ip))
+
+	// truncated value
+	rr := testSVCB(1, []string{"dot"}, 0, "", 300).(*dns.RFC3597)
+	rr.Rdata = rr.Rdata[:len(rr.Rdata)-2]
+	_, err = parseSVCB(rr)
+	assert.NotNil(t, err)
+}
+
+func TestDDRUpgrade(t *testing.T) {
+	d := ddrCtx{}
+	d.exchange = func(addr string, req *dns.Msg) (*dns.Msg, error) {
+		assert.Equal(t, ddrName, req.Question[0].Name)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		switch addr {
+		case "1.1.1.1:53":
+			resp.Answer = append(resp.Answer,
+				testSVCB(2, []string{"h2"}, 0, "/dns-query{?dns}", 600),
+				testSVCB(1, []string{"dot"}, 0, "", 60))
+		case "2.2.2.2:53":
+			resp.Answer = append(resp.Answer, testSVCB(1, []string{"dot"}, 0, "", 600))
+		case "3.3.3.3:5353":
+			return nil, fmt.Errorf("timeout")
+		}
+		return resp, nil
+	}
+	d.verify = func(addr string, ip net.IP) error {
+		if ip.String() == "2.2.2.2" {
+			return fmt.Errorf("certificate is not valid for %s", ip)
+		}
+		return nil
+	}
+
+	upstreams := []string{
+		"1.1.1.1",
+		"[/example.org/]2.2.2.2",
+		"3.3.3.3:5353",
+		"4.4.4.4",
+		"[/local/]1.1.1.1:53",
+		"tls://dns.adguard.com",
+	}
+	r := d.upgrade(upstreams)
+	assert.Equal(t, []string{
+		"tls://1.1.1.1:853",
+		"[/example.org/]2.2.2.2",
+		"3.3.3.3:5353",
+		"4.4.4.4",
+		"[/local/]tls://1.1.1.1:853",
+		"tls://dns.adguard.com",
+	}, r)
+
+	assert.Equal(t, 4, len(d.statuses))
+	st := d.statuses["1.1.1.1:53"]
+	assert.Equal(t, ddrUpgraded, st.Status)
+	assert.Equal(t, []string{"tls://1.1.1.1:853", "https://1.1.1.1:443/dns-query"}, st.Designated)
+	assert.Equal(t, ddrUnverified, d.statuses["2.2.2.2:53"].Status)
+	assert.Equal(t, ddrError, d.statuses["3.3.3.3:5353"].Status)
+	assert.Equal(t, ddrNotSupported, d.statuses["4.4.4.4:53"].Status)
+
+	// the results are cached;  statuses of the removed upstreams are deleted
+	d.exchange = nil
+	r = d.upgrade([]string{"1.1.1.1"})
+	assert.Equal(t, []string{"tls://1.1.1.1:853"}, r)
+	assert.Equal(t, 1, len(d.statuses))
+}
@@ -0,0 +1,105 @@
+// Resolution of the host names of DHCP clients ("host.lan") and of their addresses
+
+package dnsforward
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dhcpHostTTL = 60 // TTL of the records:  the lease may be released or given to another client
+
+// Get IP address from the reverse lookup name:
+// "4.3.2.1.in-addr.arpa." -> 1.2.3.4, "1.0.0.0. ... .8.b.d.0.1.0.0.2.ip6.arpa." -> 2001:db8::1
+// nil: invalid name
+func ipFromReverseName(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil || (len(l) > 1 && l[0] == '0') {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(n)
+		}
+		return ip
+
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return nil
+			}
+			j := net.IPv6len*2 - 1 - i
+			if j%2 == 0 {
+				ip[j/2] |= byte(n) << 4
+			} else {
+				ip[j/2] |= byte(n)
+			}
+		}
+		return ip
+	}
+	return nil
+}
+
+// Respond to the requests for the host names of DHCP clients and to the reverse lookups of their addresses.
+// The requests for the unknown names are processed as usual.
+func processDHCPHosts(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil || s.conf.ResolveDHCPHost == nil || s.conf.ResolveDHCPAddr == nil {
+		return resultDone
+	}
+	q := d.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return resultDone
+	}
+
+	resp := s.makeResponse(d.Req)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: dhcpHostTTL}
+
+	if q.Qtype == dns.TypePTR {
+		ip := ipFromReverseName(q.Name)
+		if ip == nil {
+			return resultDone
+		}
+		host := s.conf.ResolveDHCPAddr(ip)
+		if len(host) == 0 {
+			return resultDone
+		}
+		resp.Answer = append(resp.Answer, &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(host)})
+		d.Res = resp
+		return resultDone
+	}
+
+	ips, ok := s.conf.ResolveDHCPHost(strings.ToLower(q.Name))
+	if !ok {
+		return resultDone
+	}
+	for _, ip := range ips {
+		if q.Qtype == dns.TypeA && ip.To4() != nil {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		} else if q.Qtype == dns.TypeAAAA && ip.To4() == nil {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = s.genSOA(d.Req) // the host exists, but there are no records of this type
+	}
+	d.Res = resp
+	return resultDone
+}
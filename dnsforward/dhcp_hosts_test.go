@@ -0,0 +1,71 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFromReverseName(t *testing.T) {
+	assert.Equal(t, "192.168.1.20", ipFromReverseName("20.1.168.192.in-addr.arpa.").String())
+	assert.Equal(t, "192.168.1.20", ipFromReverseName("20.1.168.192.IN-ADDR.ARPA").String())
+	assert.Equal(t, "2001:db8::1", ipFromReverseName("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.").String())
+
+	assert.Nil(t, ipFromReverseName("1.168.192.in-addr.arpa."))
+	assert.Nil(t, ipFromReverseName("256.1.168.192.in-addr.arpa."))
+	assert.Nil(t, ipFromReverseName("01.1.168.192.in-addr.arpa."))
+	assert.Nil(t, ipFromReverseName("10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."))
+	assert.Nil(t, ipFromReverseName("example.org."))
+}
+
+func TestProcessDHCPHosts(t *testing.T) {
+	s := &Server{}
+	s.conf.ResolveDHCPHost = func(host string) ([]net.IP, bool) {
+		if host == "nas.lan." {
+			return []net.IP{net.ParseIP("192.168.1.20"), net.ParseIP("fd00::20")}, true
+		}
+		if host == "printer.lan." {
+			return []net.IP{net.ParseIP("192.168.1.30")}, true
+		}
+		return nil, false
+	}
+	s.conf.ResolveDHCPAddr = func(ip net.IP) string {
+		if ip.Equal(net.ParseIP("192.168.1.20")) {
+			return "nas.lan."
+		}
+		return ""
+	}
+
+	process := func(name string, qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		ctx := &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req}}
+		assert.Equal(t, resultDone, processDHCPHosts(ctx))
+		return ctx.proxyCtx.Res
+	}
+
+	resp := process("NAS.lan.", dns.TypeA)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "192.168.1.20", resp.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, "NAS.lan.", resp.Answer[0].Header().Name)
+
+	resp = process("nas.lan.", dns.TypeAAAA)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "fd00::20", resp.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// the host exists, but it has no IPv6 address
+	resp = process("printer.lan.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+	assert.Equal(t, 1, len(resp.Ns))
+
+	resp = process("20.1.168.192.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, "nas.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	// unknown names are processed as usual
+	assert.Nil(t, process("unknown.lan.", dns.TypeA))
+	assert.Nil(t, process("30.1.168.192.in-addr.arpa.", dns.TypePTR))
+}
@@ -0,0 +1,338 @@
+// DNS64: synthesis of AAAA records from A records for IPv6-only clients behind NAT64 (RFC 6147)
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	dns64WellKnownPrefix = "64:ff9b::/96" // RFC 6052
+	dns64DefaultExclude  = "::ffff:0:0/96"
+)
+
+// dns64Ctx is the prepared DNS64 configuration
+type dns64Ctx struct {
+	prefix         *net.IPNet   // NAT64 prefix.  nil: DNS64 is disabled
+	wellKnown      bool         // the prefix is the Well-Known Prefix:  the addresses which aren't global can't be translated
+	nonGlobal      []*net.IPNet // private, loopback and link-local networks
+	excludeNets    []*net.IPNet // AAAA records with these addresses are treated as nonexistent
+	excludeDomains []string     // AAAA records aren't synthesized for these domains and their subdomains
+}
+
+// Parse DNS64 settings
+func newDNS64(conf *FilteringConfig) (*dns64Ctx, error) {
+	c := &dns64Ctx{}
+	if !conf.DNS64Enabled {
+		return c, nil
+	}
+
+	prefix := conf.DNS64Prefix
+	if len(prefix) == 0 {
+		prefix = dns64WellKnownPrefix
+	}
+	_, subnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("dns64_prefix: %s", err)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits != 128 {
+		return nil, fmt.Errorf("dns64_prefix: %s isn't an IPv6 prefix", prefix)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("dns64_prefix: invalid prefix length %d:  must be 32, 40, 48, 56, 64 or 96", ones)
+	}
+	c.prefix = subnet
+	c.wellKnown = subnet.String() == dns64WellKnownPrefix
+	for _, s := range rebindingNets {
+		_, n, _ := net.ParseCIDR(s)
+		c.nonGlobal = append(c.nonGlobal, n)
+	}
+
+	exclude := conf.DNS64ExcludeNets
+	if len(exclude) == 0 {
+		exclude = []string{dns64DefaultExclude}
+	}
+	for _, s := range exclude {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("dns64_exclude_nets: %s", err)
+		}
+		c.excludeNets = append(c.excludeNets, n)
+	}
+
+	for _, d := range conf.DNS64ExcludeDomains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if _, ok := dns.IsDomainName(d); !ok || len(d) == 0 {
+			return nil, fmt.Errorf("dns64_exclude_domains: invalid domain name: %s", d)
+		}
+		c.excludeDomains = append(c.excludeDomains, d)
+	}
+	return c, nil
+}
+
+func (c *dns64Ctx) enabled() bool {
+	return c != nil && c.prefix != nil
+}
+
+// Embed IPv4 address into the prefix (RFC 6052 section 2.2).
+// Bits 64..71 are reserved and must be zero.
+func (c *dns64Ctx) synthesize(ip4 net.IP) net.IP {
+	ones, _ := c.prefix.Mask.Size()
+	r := make(net.IP, net.IPv6len)
+	copy(r, c.prefix.IP.To16())
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		r[pos] = b
+		pos++
+	}
+	return r
+}
+
+// Extract IPv4 address from the address within the prefix.  nil: the address isn't within the prefix.
+func (c *dns64Ctx) extract(ip6 net.IP) net.IP {
+	if !c.prefix.Contains(ip6) {
+		return nil
+	}
+	ones, _ := c.prefix.Mask.Size()
+	r := make(net.IP, net.IPv4len)
+	pos := ones / 8
+	for i := range r {
+		if pos == 8 {
+			pos++
+		}
+		r[i] = ip6[pos]
+		pos++
+	}
+	return r
+}
+
+// Return TRUE if the IPv4 address can be translated
+func (c *dns64Ctx) translatable(ip4 net.IP) bool {
+	if !c.wellKnown {
+		return true
+	}
+	// RFC 6052 section 3.1
+	for _, n := range c.nonGlobal {
+		if n.Contains(ip4) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *dns64Ctx) excludedDomain(host string) bool {
+	for _, d := range c.excludeDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the response has AAAA records which aren't excluded
+func (c *dns64Ctx) hasAAAA(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		a, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		excluded := false
+		for _, n := range c.excludeNets {
+			if n.Contains(a.AAAA) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse "ip6.arpa" name of a full IPv6 address
+func ip6ArpaToIP(name string) net.IP {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if !strings.HasSuffix(name, ".ip6.arpa") {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+	if len(labels) != 32 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, l := range labels {
+		if len(l) != 1 {
+			return nil
+		}
+		var v byte
+		switch {
+		case l[0] >= '0' && l[0] <= '9':
+			v = l[0] - '0'
+		case l[0] >= 'a' && l[0] <= 'f':
+			v = l[0] - 'a' + 10
+		default:
+			return nil
+		}
+		pos := 31 - i // the first label is the last nibble
+		if pos%2 == 0 {
+			v <<= 4
+		}
+		ip[pos/2] |= v
+	}
+	return ip
+}
+
+// Translate PTR requests for the addresses within NAT64 prefix into the requests for IPv4 addresses
+func processDNS64Request(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	q := d.Req.Question[0]
+	if d.Res != nil || q.Qtype != dns.TypePTR {
+		return resultDone
+	}
+
+	s.RLock()
+	c := s.dns64
+	s.RUnlock()
+	if !c.enabled() {
+		return resultDone
+	}
+
+	ip6 := ip6ArpaToIP(q.Name)
+	if ip6 == nil {
+		return resultDone
+	}
+	ip4 := c.extract(ip6)
+	if ip4 == nil {
+		return resultDone
+	}
+
+	name, err := dns.ReverseAddr(ip4.String())
+	if err != nil {
+		return resultDone
+	}
+	ctx.dns64Question = q
+	d.Req.Question[0].Name = name
+	log.Debug("DNS64: %s -> %s", q.Name, name)
+	return resultDone
+}
+
+// Synthesize AAAA records if the domain has no AAAA records;
+// restore the question of the translated PTR request
+func processDNS64Response(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+
+	if len(ctx.dns64Question.Name) != 0 {
+		target := d.Req.Question[0].Name
+		d.Req.Question[0] = ctx.dns64Question
+		if d.Res != nil {
+			d.Res.Question[0] = ctx.dns64Question
+			cname := &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: ctx.dns64Question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: s.conf.BlockedResponseTTL},
+				Target: target,
+			}
+			d.Res.Answer = append([]dns.RR{cname}, d.Res.Answer...)
+		}
+		return resultDone
+	}
+
+	q := d.Req.Question[0]
+	if d.Res == nil || !ctx.responseFromUpstream || ctx.result.IsFiltered ||
+		q.Qtype != dns.TypeAAAA || d.Res.Rcode != dns.RcodeSuccess ||
+		d.Req.CheckingDisabled { // the client validates DNSSEC itself (RFC 6147 section 5.5)
+		return resultDone
+	}
+
+	s.RLock()
+	c := s.dns64
+	s.RUnlock()
+	if !c.enabled() || c.hasAAAA(d.Res) ||
+		c.excludedDomain(strings.ToLower(strings.TrimSuffix(q.Name, "."))) {
+		return resultDone
+	}
+
+	resp := s.dns64Synthesize(ctx, c)
+	if resp != nil {
+		d.Res = resp
+	}
+	return resultDone
+}
+
+// Get A records and create the response with AAAA records.  nil: there are no A records.
+func (s *Server) dns64Synthesize(ctx *dnsContext, c *dns64Ctx) *dns.Msg {
+	d := ctx.proxyCtx
+	q := d.Req.Question[0]
+
+	req := d.Req.Copy()
+	req.Question[0].Qtype = dns.TypeA
+	aCtx := &proxy.DNSContext{
+		Proto:     d.Proto,
+		Addr:      d.Addr,
+		StartTime: time.Now(),
+		Req:       req,
+		Upstreams: d.Upstreams,
+	}
+	err := s.dnsProxy.Resolve(aCtx)
+	if err != nil {
+		log.Debug("DNS64: %s: %s", q.Name, err)
+		return nil
+	}
+	if aCtx.Res == nil || aCtx.Res.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	// TTL of the synthesized records:  min(A TTL, negative TTL of AAAA response)
+	var negTTL uint32
+	for _, rr := range d.Res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			negTTL = soa.Minttl
+			if soa.Hdr.Ttl < negTTL {
+				negTTL = soa.Hdr.Ttl
+			}
+		}
+	}
+
+	resp := d.Res.Copy()
+	resp.Answer = nil
+	resp.Ns = nil
+	n := 0
+	for _, rr := range aCtx.Res.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			resp.Answer = append(resp.Answer, dns.Copy(v))
+		case *dns.A:
+			if !c.translatable(v.A) {
+				continue
+			}
+			ttl := v.Hdr.Ttl
+			if negTTL != 0 && negTTL < ttl {
+				ttl = negTTL
+			}
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: v.Hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: c.synthesize(v.A),
+			})
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	log.Debug("DNS64: %s: synthesized %d AAAA records", q.Name, n)
+	return resp
+}
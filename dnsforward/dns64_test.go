@@ -0,0 +1,107 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNS64Prefix(t *testing.T) {
+	c, err := newDNS64(&FilteringConfig{DNS64Enabled: true})
+	assert.Nil(t, err)
+	assert.True(t, c.wellKnown)
+	ip := c.synthesize(net.ParseIP("192.0.2.33"))
+	assert.Equal(t, "64:ff9b::c000:221", ip.String())
+	assert.Equal(t, "192.0.2.33", c.extract(ip).String())
+	assert.Nil(t, c.extract(net.ParseIP("2001:db8::1")))
+	assert.True(t, c.translatable(net.ParseIP("192.0.2.33")))
+	assert.False(t, c.translatable(net.ParseIP("192.168.1.1")))
+
+	// examples from RFC 6052 section 2.4
+	tests := []struct {
+		prefix string
+		ip     string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	for _, tc := range tests {
+		c, err = newDNS64(&FilteringConfig{DNS64Enabled: true, DNS64Prefix: tc.prefix})
+		assert.Nil(t, err)
+		assert.False(t, c.wellKnown)
+		ip = c.synthesize(net.ParseIP("192.0.2.33"))
+		assert.Equal(t, tc.ip, ip.String(), tc.prefix)
+		assert.Equal(t, "192.0.2.33", c.extract(ip).String(), tc.prefix)
+		assert.True(t, c.translatable(net.ParseIP("192.168.1.1")))
+	}
+
+	_, err = newDNS64(&FilteringConfig{DNS64Enabled: true, DNS64Prefix: "2001:db8::/33"})
+	assert.NotNil(t, err)
+	_, err = newDNS64(&FilteringConfig{DNS64Enabled: true, DNS64Prefix: "192.0.2.0/24"})
+	assert.NotNil(t, err)
+	_, err = newDNS64(&FilteringConfig{DNS64Enabled: true, DNS64ExcludeDomains: []string{"a..b"}})
+	assert.NotNil(t, err)
+
+	c, err = newDNS64(&FilteringConfig{DNS64Prefix: "invalid"})
+	assert.Nil(t, err)
+	assert.False(t, c.enabled())
+}
+
+func TestDNS64Exclude(t *testing.T) {
+	c, err := newDNS64(&FilteringConfig{DNS64Enabled: true, DNS64ExcludeDomains: []string{"example.org"}})
+	assert.Nil(t, err)
+	assert.True(t, c.excludedDomain("www.example.org"))
+	assert.False(t, c.excludedDomain("example.com"))
+
+	resp := &dns.Msg{}
+	resp.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("::ffff:1.2.3.4")}}
+	assert.False(t, c.hasAAAA(resp))
+	resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("2001:db8::1")})
+	assert.True(t, c.hasAAAA(resp))
+}
+
+func TestDNS64PTR(t *testing.T) {
+	ip := ip6ArpaToIP("1.2.2.0.0.0.0.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.b.9.f.f.4.6.0.0.ip6.arpa.")
+	assert.Equal(t, "64:ff9b::c000:221", ip.String())
+	assert.Nil(t, ip6ArpaToIP("2.0.0.0.ip6.arpa."))
+	assert.Nil(t, ip6ArpaToIP("example.org."))
+
+	s := &Server{}
+	s.conf.BlockedResponseTTL = 10
+	s.dns64, _ = newDNS64(&FilteringConfig{DNS64Enabled: true})
+
+	req := &dns.Msg{}
+	req.SetQuestion("1.2.2.0.0.0.0.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.b.9.f.f.4.6.0.0.ip6.arpa.", dns.TypePTR)
+	ctx := &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req}, result: &dnsfilter.Result{}}
+	assert.Equal(t, resultDone, processDNS64Request(ctx))
+	assert.Equal(t, "33.2.0.192.in-addr.arpa.", req.Question[0].Name)
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: "33.2.0.192.in-addr.arpa.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+		Ptr: "host.example.",
+	}}
+	ctx.proxyCtx.Res = resp
+	assert.Equal(t, resultDone, processDNS64Response(ctx))
+	assert.Equal(t, ctx.dns64Question.Name, req.Question[0].Name)
+	assert.Equal(t, ctx.dns64Question.Name, resp.Question[0].Name)
+	assert.Equal(t, 2, len(resp.Answer))
+	cname, ok := resp.Answer[0].(*dns.CNAME)
+	assert.True(t, ok)
+	assert.Equal(t, "33.2.0.192.in-addr.arpa.", cname.Target)
+
+	// the address isn't within the prefix
+	req.SetQuestion("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR)
+	ctx = &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req}, result: &dnsfilter.Result{}}
+	assert.Equal(t, resultDone, processDNS64Request(ctx))
+	assert.Equal(t, "", ctx.dns64Question.Name)
+}
@@ -1,8 +1,10 @@
 package dnsforward
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -26,6 +28,11 @@ import (
 // DefaultTimeout is the default upstream timeout
 const DefaultTimeout = 10 * time.Second
 
+// Default time limit for filtering a request (including SB/PC lookups).
+// DNS clients usually don't wait longer than this.
+// If the limit is exceeded, the client gets SERVFAIL.
+const defaultFilteringTimeout = 5 * time.Second
+
 const (
 	safeBrowsingBlockHost = "standard-block.dns.adguard.com"
 	parentalBlockHost     = "family-block.dns.adguard.com"
@@ -54,11 +61,40 @@ type Server struct {
 	queryLog  querylog.QueryLog    // Query log instance
 	stats     stats.Stats
 	access    *accessCtx
+	rebinding rebindingCtx
+	budget    upstreamBudget
+	stale     staleCache
+	prefetch  prefetchCtx
+	ratelimit ratelimiter
+	outbound  outboundCtx
+	mdns      mdnsCtx
+	dnssec    dnssecValidator
+	ddr       ddrCtx
+	selector  upstreamSelector
+	metrics   metrics
+	tracer    *tracer    // nil: tracing is disabled
+	doq       *doqServer // nil: DNS-over-QUIC is disabled
+	drain     drainCtx
+	health    healthCtx
+	activated *activatedServer // nil: there are no activated sockets
+
+	domainUpstreams *domainTrie // domain-specific upstreams
+	ptrUpstreams    *domainTrie // upstreams for the reverse zones of local subnets.  nil: not set
+
+	localZones map[string]*localZone // zone name -> zone served authoritatively
+	views      []*view               // split-horizon views
+	listeners  []*listener           // additional listeners
+	dns64      *dns64Ctx             // DNS64 settings
+	geoip      *geoipDB              // nil: not loaded
+
+	recordTypeRules []recordTypeRule // the records of blocked types are removed from the responses
 
 	// DNS proxy instance for internal usage
 	// We don't Start() it and so no listen port is required.
 	internalProxy *proxy.Proxy
 
+	ecsPolicies []ecsPolicy // parsed EDNS Client Subnet policies
+
 	isRunning bool
 
 	sync.RWMutex
@@ -72,6 +108,10 @@ func NewServer(dnsFilter *dnsfilter.Dnsfilter, stats stats.Stats, queryLog query
 	s.dnsFilter = dnsFilter
 	s.stats = stats
 	s.queryLog = queryLog
+	s.rebinding.init()
+	s.selector.observe = s.metrics.observeUpstream
+	s.prefetch.exchange = s.internalExchange
+	s.dnssec.exchange = s.internalExchange
 
 	if runtime.GOARCH == "mips" || runtime.GOARCH == "mipsle" {
 		// Use plain DNS on MIPS, encryption is too slow
@@ -87,6 +127,8 @@ func (s *Server) Close() {
 	s.stats = nil
 	s.queryLog = nil
 	s.dnsProxy = nil
+	s.tracer.close()
+	s.tracer = nil
 	s.Unlock()
 }
 
@@ -106,7 +148,21 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	c.AllowedClients = stringArrayDup(sc.AllowedClients)
 	c.DisallowedClients = stringArrayDup(sc.DisallowedClients)
 	c.BlockedHosts = stringArrayDup(sc.BlockedHosts)
+	c.RebindingAllowedHosts = stringArrayDup(sc.RebindingAllowedHosts)
+	c.UpstreamBudgetBlockedServices = stringArrayDup(sc.UpstreamBudgetBlockedServices)
+	c.EDNSClientSubnetPolicies = stringArrayDup(sc.EDNSClientSubnetPolicies)
 	c.UpstreamDNS = stringArrayDup(sc.UpstreamDNS)
+	c.UpstreamDomainLists = append([]UpstreamDomainList(nil), sc.UpstreamDomainLists...)
+	c.DNSSECTrustAnchors = stringArrayDup(sc.DNSSECTrustAnchors)
+	c.PTRForwarding = append([]PTRForwarding(nil), sc.PTRForwarding...)
+	c.LocalZones = append([]LocalZone(nil), sc.LocalZones...)
+	c.Views = append([]View(nil), sc.Views...)
+	c.Listeners = append([]Listener(nil), sc.Listeners...)
+	c.MDNSInterfaces = stringArrayDup(sc.MDNSInterfaces)
+	c.DNS64ExcludeNets = stringArrayDup(sc.DNS64ExcludeNets)
+	c.DNS64ExcludeDomains = stringArrayDup(sc.DNS64ExcludeDomains)
+	c.BlockedRecordTypes = stringArrayDup(sc.BlockedRecordTypes)
+	c.UpstreamSources = append([]UpstreamSource(nil), sc.UpstreamSources...)
 	s.RUnlock()
 }
 
@@ -116,8 +172,20 @@ type FilteringConfig struct {
 	// Filtering callback function
 	FilterHandler func(clientAddr string, settings *dnsfilter.RequestFilteringSettings) `yaml:"-"`
 
-	// This callback function returns the list of upstream servers for a client specified by IP address
-	GetUpstreamsByClient func(clientAddr string) []upstream.Upstream `yaml:"-"`
+	// This callback function returns the upstream servers for a client specified by IP address.
+	// nil: the global upstreams are used.
+	GetUpstreamsByClient func(clientAddr string) *ClientUpstreams `yaml:"-"`
+
+	// This callback function returns DNSSEC validation mode for a client specified by IP address.
+	// "": use the global setting.
+	GetDNSSECModeByClient func(clientAddr string) string `yaml:"-"`
+
+	// This callback function returns the rate limit (requests per second) for a client specified by IP address.
+	// 0: use the global setting.
+	GetRatelimitByClient func(clientAddr string) uint32 `yaml:"-"`
+
+	// This callback function returns the record type rules for a client specified by IP address (see BlockedRecordTypes)
+	GetBlockedRecordTypesByClient func(clientAddr string) []string `yaml:"-"`
 
 	ProtectionEnabled bool `yaml:"protection_enabled"` // whether or not use any of dnsfilter features
 
@@ -127,15 +195,39 @@ type FilteringConfig struct {
 	BlockingIPAddrv4 net.IP `yaml:"-"`
 	BlockingIPAddrv6 net.IP `yaml:"-"`
 
+	// Respond with NXDOMAIN to blocked AAAA requests regardless of the blocking mode
+	BlockingIPv6NXDomain bool `yaml:"blocking_ipv6_nxdomain"`
+
+	// TTL of the rewritten answers (in seconds), unless it's set for the rewrite entry.  0: blocked_response_ttl is used
+	RewriteTTL uint32 `yaml:"rewrite_ttl"`
+
 	BlockedResponseTTL uint32   `yaml:"blocked_response_ttl"` // if 0, then default is used (3600)
-	Ratelimit          uint32   `yaml:"ratelimit"`            // max number of requests per second from a given IP (0 to disable)
+	FilteringTimeout   uint32   `yaml:"filtering_timeout"`    // time limit for filtering a request (in milliseconds).  0: default (5000)
+	Ratelimit          uint32   `yaml:"ratelimit"`            // max number of UDP requests per second from a given IP (0 to disable)
 	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`  // a list of whitelisted client IP addresses
 	RefuseAny          bool     `yaml:"refuse_any"`           // if true, refuse ANY requests
 	BootstrapDNS       []string `yaml:"bootstrap_dns"`        // a list of bootstrap DNS for DoH and DoT (plain DNS only)
 	AllServers         bool     `yaml:"all_servers"`          // if true, parallel queries to all configured upstream servers are enabled
 
+	// Source IP address or network interface for the requests to upstream servers (e.g. on multi-WAN routers).  "": chosen by OS
+	UpstreamSource  string           `yaml:"upstream_source"`
+	UpstreamSources []UpstreamSource `yaml:"upstream_sources"` // the sources for specific upstream servers
+
+	UpstreamPool UpstreamPoolConfig `yaml:"upstream_pool"` // reuse of TCP, TLS and HTTPS connections to upstream servers
+
+	RatelimitTCP    uint32 `yaml:"ratelimit_tcp"`    // max number of requests per second over TCP, DoT, DoH and DoQ from a given IP (0 to disable)
+	RatelimitBurst  uint32 `yaml:"ratelimit_burst"`  // number of requests allowed above the limit in a short burst
+	RatelimitAction string `yaml:"ratelimit_action"` // action for the requests exceeding the limit: "drop" (default), "truncate", "refuse"
+
 	EnableEDNSClientSubnet bool `yaml:"edns_client_subnet"` // Enable EDNS Client Subnet option
 
+	// Identify clients by the subnet from EDNS Client Subnet option rather than by the sender's IP address
+	// (when AdGuard Home is behind another DNS forwarder).
+	// EDNS Client Subnet policies for the requests sent upstream:
+	// "[/domain1/domain2/]forward|strip|synthesize[:subnet]".  The policy without domains is the default one.
+	EDNSClientSubnetIdentify bool     `yaml:"edns_client_subnet_identify"`
+	EDNSClientSubnetPolicies []string `yaml:"edns_client_subnet_policies"`
+
 	// Respond with an empty answer to all AAAA requests
 	AAAADisabled bool `yaml:"aaaa_disabled"`
 
@@ -143,17 +235,110 @@ type FilteringConfig struct {
 	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses of clients that should be blocked
 	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked
 
+	// IP address ranges database in ip2asn format for "country:" and "asn:" access settings entries.  "": not used
+	GeoIPDB string `yaml:"geoip_db"`
+
+	// Remove the records of these types from the responses:
+	// "TYPE" (for all domains) or "[/domain1/domain2/]TYPE" (e.g. "HTTPS", "[/example.org/]AAAA")
+	BlockedRecordTypes []string `yaml:"blocked_record_types"`
+
+	// Block the responses with private IP addresses for public domain names
+	RebindingProtectionEnabled bool     `yaml:"rebinding_protection_enabled"`
+	RebindingAllowedHosts      []string `yaml:"rebinding_allowed_hosts"`     // hosts that may be resolved to private IP addresses
+	RebindingProtectionAction  string   `yaml:"rebinding_protection_action"` // "block" (default, the blocking mode is applied), "strip", "refuse"
+
 	// IP (or domain name) which is used to respond to DNS requests blocked by parental control or safe-browsing
 	ParentalBlockHost     string `yaml:"parental_block_host"`
 	SafeBrowsingBlockHost string `yaml:"safebrowsing_block_host"`
 
+	// Modes how to answer the requests blocked by parental control or safe-browsing.
+	// Values: "default" (or empty), "nxdomain", "refused", "null_ip", "custom_ip".
+	// In default mode the IP address of ParentalBlockHost/SafeBrowsingBlockHost is returned.
+	ParentalBlockingMode       string `yaml:"parental_blocking_mode"`
+	ParentalBlockingIP         string `yaml:"parental_blocking_ip"` // IP address to be returned in "custom_ip" mode
+	ParentalBlockingIPAddr     net.IP `yaml:"-"`
+	SafeBrowsingBlockingMode   string `yaml:"safebrowsing_blocking_mode"`
+	SafeBrowsingBlockingIP     string `yaml:"safebrowsing_blocking_ip"` // IP address to be returned in "custom_ip" mode
+	SafeBrowsingBlockingIPAddr net.IP `yaml:"-"`
+
 	CacheSize   uint     `yaml:"cache_size"` // DNS cache size (in bytes)
 	UpstreamDNS []string `yaml:"upstream_dns"`
+
+	// Upstream query budget for metered connections.
+	// When the budget is exceeded, the requests are answered according to UpstreamBudgetOverflow:
+	// "servfail" (or empty): respond with SERVFAIL;  "stale": respond with the last received response.
+	UpstreamBudget                uint32   `yaml:"upstream_budget"`                  // max number of upstream requests per period.  0: unlimited
+	UpstreamBudgetPeriod          uint32   `yaml:"upstream_budget_period"`           // in seconds.  0: default (3600)
+	UpstreamBudgetOverflow        string   `yaml:"upstream_budget_overflow"`         // what to do when the budget is exceeded
+	UpstreamBudgetBlockedServices []string `yaml:"upstream_budget_blocked_services"` // services that are blocked when the budget is exceeded
+
+	// Upgrade plain DNS upstream servers to the encrypted resolvers which they designate (RFC 9462)
+	UpstreamDDR bool `yaml:"upstream_ddr"`
+
+	// Upstream selection strategy: "" (default), "parallel", "fastest", "failover", "weighted".
+	// The health thresholds are set per strategy;  the weights are set per upstream address (default: 1).
+	UpstreamStrategy   string                        `yaml:"upstream_strategy"`
+	UpstreamThresholds map[string]UpstreamThresholds `yaml:"upstream_thresholds"`
+	UpstreamWeights    map[string]uint32             `yaml:"upstream_weights"`
+
+	// Active health checks of upstream servers: failing upstreams are quarantined until they respond to a probe
+	UpstreamHealthCheckInterval uint32 `yaml:"upstream_health_check_interval"` // in seconds.  0: disabled
+	UpstreamHealthCheckDomain   string `yaml:"upstream_health_check_domain"`   // the name for NS probe requests.  "": root zone
+
+	// Respond with expired data when upstream servers don't respond (RFC 8767)
+	ServeStale       bool   `yaml:"serve_stale"`
+	ServeStaleMaxAge uint32 `yaml:"serve_stale_max_age"` // how long (in seconds) an expired response may be used.  0: default (1 day)
+
+	// Refresh the responses for popular domains before they expire
+	Prefetch        bool   `yaml:"prefetch"`
+	PrefetchSize    uint32 `yaml:"prefetch_size"`     // max number of tracked questions.  0: default (1000)
+	PrefetchMinHits uint32 `yaml:"prefetch_min_hits"` // a question is popular if it's requested at least this number of times per minute.  0: default (5)
+	PrefetchBudget  uint32 `yaml:"prefetch_budget"`   // max number of prefetch requests per minute.  0: default (600)
+
+	// Local DNSSEC validation of the responses: "" (disabled), "permissive" (only write the result to the query log),
+	// "enforce" (respond with SERVFAIL to bogus responses)
+	DNSSECValidation   string   `yaml:"dnssec_validation"`
+	DNSSECTrustAnchors []string `yaml:"dnssec_trust_anchors"` // DS records for the root zone.  Empty: the default IANA trust anchors
+
+	// Files with domain-specific upstreams (e.g. for split DNS)
+	UpstreamDomainLists []UpstreamDomainList `yaml:"upstream_domain_lists"`
+
+	// Forward reverse DNS requests for local subnets to the router or domain controller
+	PTRForwarding []PTRForwarding `yaml:"ptr_forwarding"`
+
+	// Zones answered authoritatively by AdGuard Home (e.g. "home.lan")
+	LocalZones []LocalZone `yaml:"local_zones"`
+
+	// Rewrites, local zones and upstreams for the clients from specific subnets (split-horizon DNS)
+	Views []View `yaml:"views"`
+
+	// Additional listen addresses with their own filtering and access settings
+	Listeners []Listener `yaml:"listeners"`
+
+	// Resolve ".local" names via multicast DNS on these network interfaces.  Empty: disabled
+	MDNSInterfaces []string `yaml:"mdns_interfaces"`
+	MDNSReflector  bool     `yaml:"mdns_reflector"` // forward mDNS packets between the interfaces
+
+	// DNS64: synthesize AAAA records from A records for IPv6-only clients behind NAT64
+	DNS64Enabled        bool     `yaml:"dns64_enabled"`
+	DNS64Prefix         string   `yaml:"dns64_prefix"`          // NAT64 prefix.  "": "64:ff9b::/96"
+	DNS64ExcludeNets    []string `yaml:"dns64_exclude_nets"`    // AAAA records with these addresses are ignored.  Empty: "::ffff:0:0/96"
+	DNS64ExcludeDomains []string `yaml:"dns64_exclude_domains"` // AAAA records aren't synthesized for these domains
+
+	// OTLP/HTTP endpoint of OpenTelemetry collector ("http://localhost:4318/v1/traces").  "": tracing is disabled
+	TracingURL string `yaml:"tracing_url"`
+
+	// On shutdown, wait for the requests in progress for this time (in milliseconds).  0: default (2000)
+	DrainTimeout uint32 `yaml:"drain_timeout"`
+
+	// The name (e.g. "health.adguardhome.local") to which the DNS server responds with the health status.  "": disabled
+	HealthProbeName string `yaml:"health_probe_name"`
 }
 
 // TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, and DNS-over-TLS
 type TLSConfig struct {
 	TLSListenAddr    *net.TCPAddr `yaml:"-" json:"-"`
+	QUICListenAddr   *net.UDPAddr `yaml:"-" json:"-"`                                 // DNS-over-QUIC listen address.  nil: DNS-over-QUIC is disabled
 	StrictSNICheck   bool         `yaml:"strict_sni_check" json:"-"`                  // Reject connection if the client uses server name (in SNI) that doesn't match the certificate
 	CertificateChain string       `yaml:"certificate_chain" json:"certificate_chain"` // PEM-encoded certificates chain
 	PrivateKey       string       `yaml:"private_key" json:"private_key"`             // PEM-encoded private key
@@ -166,6 +351,8 @@ type TLSConfig struct {
 
 	cert     tls.Certificate // nolint(structcheck) - linter thinks that this field is unused, while TLSConfig is directly included into ServerConfig
 	dnsNames []string        // nolint(structcheck) // DNS names from certificate (SAN) or CN value from Subject
+
+	quicTLSConfig *tls.Config // nolint(structcheck) // TLS configuration for DNS-over-QUIC listener
 }
 
 // ServerConfig represents server configuration.
@@ -173,10 +360,38 @@ type TLSConfig struct {
 type ServerConfig struct {
 	UDPListenAddr            *net.UDPAddr                   // UDP listen address
 	TCPListenAddr            *net.TCPAddr                   // TCP listen address
+	ActivatedUDP             []net.PacketConn               // UDP sockets passed by the service manager.  If set, UDPListenAddr and TCPListenAddr aren't used
+	ActivatedTCP             []net.Listener                 // TCP sockets passed by the service manager
 	Upstreams                []upstream.Upstream            // Configured upstreams
 	DomainsReservedUpstreams map[string][]upstream.Upstream // Map of domains and lists of configured upstreams
 	OnDNSRequest             func(d *proxy.DNSContext)
 
+	// Called when the response for a DNS request is ready (may be nil)
+	OnDNSResponse func(d *proxy.DNSContext, result *dnsfilter.Result)
+
+	// Called when the address of a host is received via mDNS (may be nil)
+	OnMDNSHost func(ip, host string)
+
+	// Called when an upstream server is quarantined (up=false) or is back online (may be nil).
+	// Must not block.
+	OnUpstreamStatus func(addr string, up bool, lastError string)
+
+	// Check the health of AdGuard Home for the health probe requests (may be nil)
+	HealthCheck func() error
+
+	// Plugins which are called for every DNS request (in this order)
+	Plugins []Plugin
+
+	// Get the addresses of the DHCP client by its host name ("host.lan.").
+	// ok: the host is known.  May be nil.
+	ResolveDHCPHost func(host string) (ips []net.IP, ok bool)
+
+	// Get the host name of the DHCP client by its address.  "": not found.  May be nil.
+	ResolveDHCPAddr func(ip net.IP) string
+
+	// Log the result of every DNS query (as a JSON object)
+	LogQueries bool
+
 	FilteringConfig
 	TLSConfig
 
@@ -217,6 +432,12 @@ func (s *Server) Exchange(req *dns.Msg) (*dns.Msg, error) {
 		Req:       req,
 		StartTime: time.Now(),
 	}
+	z := findLocalZone(s.localZones, req.Question[0].Name)
+	if z != nil {
+		return z.answer(req), nil
+	}
+
+	s.setDomainUpstreams(ctx)
 	err := s.internalProxy.Resolve(ctx)
 	if err != nil {
 		return nil, err
@@ -234,10 +455,35 @@ func (s *Server) Start() error {
 // startInternal starts without locking
 func (s *Server) startInternal() error {
 	err := s.dnsProxy.Start()
-	if err == nil {
-		s.isRunning = true
+	if err != nil {
+		return err
 	}
-	return err
+
+	err = s.startDoQ()
+	if err != nil {
+		_ = s.dnsProxy.Stop()
+		return err
+	}
+
+	err = s.startListeners()
+	if err != nil {
+		s.stopDoQ()
+		_ = s.dnsProxy.Stop()
+		return err
+	}
+
+	s.startActivated()
+
+	err = s.mdns.start(s.conf.MDNSInterfaces, s.conf.MDNSReflector, s.conf.OnMDNSHost)
+	if err != nil {
+		log.Error("%s", err) // DNS server works without mDNS
+	}
+
+	s.selector.startHealthCheck()
+	s.prefetch.start()
+
+	s.isRunning = true
+	return nil
 }
 
 // Prepare the object
@@ -248,10 +494,45 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		if s.conf.BlockingMode == "custom_ip" {
 			s.conf.BlockingIPAddrv4 = net.ParseIP(s.conf.BlockingIPv4)
 			s.conf.BlockingIPAddrv6 = net.ParseIP(s.conf.BlockingIPv6)
-			if s.conf.BlockingIPAddrv4 == nil || s.conf.BlockingIPAddrv6 == nil {
+			if s.conf.BlockingIPAddrv4 == nil ||
+				(s.conf.BlockingIPAddrv6 == nil && !s.conf.BlockingIPv6NXDomain) {
 				return fmt.Errorf("DNS: invalid custom blocking IP address specified")
 			}
 		}
+		if s.conf.ParentalBlockingMode == "custom_ip" {
+			s.conf.ParentalBlockingIPAddr = net.ParseIP(s.conf.ParentalBlockingIP)
+			if s.conf.ParentalBlockingIPAddr == nil {
+				return fmt.Errorf("DNS: invalid parental blocking IP address specified")
+			}
+		}
+		if s.conf.SafeBrowsingBlockingMode == "custom_ip" {
+			s.conf.SafeBrowsingBlockingIPAddr = net.ParseIP(s.conf.SafeBrowsingBlockingIP)
+			if s.conf.SafeBrowsingBlockingIPAddr == nil {
+				return fmt.Errorf("DNS: invalid safe-browsing blocking IP address specified")
+			}
+		}
+	}
+
+	s.budget.configure(&s.conf.FilteringConfig)
+	s.stale.configure(&s.conf.FilteringConfig)
+	s.prefetch.configure(&s.conf.FilteringConfig, time.Now())
+	err := s.dnssec.configure(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+
+	ecsPolicies, err := parseECSPolicies(s.conf.EDNSClientSubnetPolicies)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	s.ecsPolicies = ecsPolicies
+
+	if s.tracer == nil || s.tracer.url != s.conf.TracingURL {
+		s.tracer.close()
+		s.tracer = nil
+		if len(s.conf.TracingURL) != 0 {
+			s.tracer = newTracer(s.conf.TracingURL)
+		}
 	}
 
 	if len(s.conf.UpstreamDNS) == 0 {
@@ -261,12 +542,62 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		s.conf.BootstrapDNS = defaultBootstrap
 	}
 
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(s.conf.UpstreamDNS, s.conf.BootstrapDNS, DefaultTimeout)
+	upstreams := s.conf.UpstreamDNS
+	if s.conf.UpstreamDDR {
+		upstreams = s.ddr.upgrade(upstreams)
+	} else {
+		s.ddr.clear()
+	}
+
+	upstreamConfig, err := proxy.ParseUpstreamsConfig(upstreams, s.conf.BootstrapDNS, DefaultTimeout)
 	if err != nil {
 		return fmt.Errorf("DNS: proxy.ParseUpstreamsConfig: %s", err)
 	}
-	s.conf.Upstreams = upstreamConfig.Upstreams
-	s.conf.DomainsReservedUpstreams = upstreamConfig.DomainReservedUpstreams
+	err = checkUpstreamStrategy(s.conf.UpstreamStrategy)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	err = s.outbound.configure(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	upstreamConfig.Upstreams = s.outbound.bind(upstreamConfig.Upstreams)
+	for domain, list := range upstreamConfig.DomainReservedUpstreams {
+		upstreamConfig.DomainReservedUpstreams[domain] = s.outbound.bind(list)
+	}
+	all := upstreamConfig.Upstreams
+	for _, list := range upstreamConfig.DomainReservedUpstreams {
+		all = append(all, list...)
+	}
+	s.selector.configure(&s.conf.FilteringConfig, all)
+	s.selector.setOnStatus(s.conf.OnUpstreamStatus)
+	s.conf.Upstreams = s.selector.wrap(upstreamConfig.Upstreams)
+	s.conf.DomainsReservedUpstreams = map[string][]upstream.Upstream{}
+	for domain, list := range upstreamConfig.DomainReservedUpstreams {
+		s.conf.DomainsReservedUpstreams[domain] = s.selector.wrap(list)
+	}
+	s.domainUpstreams = s.prepareDomainUpstreams(s.conf.DomainsReservedUpstreams)
+	s.ptrUpstreams, err = s.preparePTRForwarding(s.conf.PTRForwarding)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	s.localZones = loadLocalZones(s.conf.LocalZones)
+	s.views, err = s.prepareViews(s.conf.Views)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	s.recordTypeRules, err = parseRecordTypeRules(s.conf.BlockedRecordTypes)
+	if err != nil {
+		return fmt.Errorf("DNS: blocked_record_types: %s", err)
+	}
+	err = checkListeners(s.conf.Listeners, s.conf.Views)
+	if err != nil {
+		return fmt.Errorf("DNS: listeners: %s", err)
+	}
+	s.dns64, err = newDNS64(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
 
 	if len(s.conf.ParentalBlockHost) == 0 {
 		s.conf.ParentalBlockHost = parentalBlockHost
@@ -274,23 +605,28 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	if len(s.conf.SafeBrowsingBlockHost) == 0 {
 		s.conf.SafeBrowsingBlockHost = safeBrowsingBlockHost
 	}
-	if s.conf.UDPListenAddr == nil {
+	activated := len(s.conf.ActivatedUDP) != 0 || len(s.conf.ActivatedTCP) != 0
+	if s.conf.UDPListenAddr == nil && !activated {
 		s.conf.UDPListenAddr = defaultValues.UDPListenAddr
 	}
-	if s.conf.TCPListenAddr == nil {
+	if s.conf.TCPListenAddr == nil && !activated {
 		s.conf.TCPListenAddr = defaultValues.TCPListenAddr
 	}
+	if activated {
+		// the requests are received on the activated sockets
+		s.conf.UDPListenAddr = nil
+		s.conf.TCPListenAddr = nil
+	}
 
 	proxyConfig := proxy.Config{
 		UDPListenAddr:            s.conf.UDPListenAddr,
 		TCPListenAddr:            s.conf.TCPListenAddr,
-		Ratelimit:                int(s.conf.Ratelimit),
-		RatelimitWhitelist:       s.conf.RatelimitWhitelist,
+		Ratelimit:                0, // the requests are limited by beforeRequestHandler
 		RefuseAny:                s.conf.RefuseAny,
 		CacheEnabled:             true,
 		CacheSizeBytes:           int(s.conf.CacheSize),
-		Upstreams:                s.conf.Upstreams,
-		DomainsReservedUpstreams: s.conf.DomainsReservedUpstreams,
+		Upstreams:                s.budget.wrap(s.conf.Upstreams),
+		DomainsReservedUpstreams: nil, // domain-specific upstreams are set for each request
 		BeforeRequestHandler:     s.beforeRequestHandler,
 		RequestHandler:           s.handleDNSRequest,
 		AllServers:               s.conf.AllServers,
@@ -305,13 +641,19 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	}
 	s.internalProxy = &proxy.Proxy{Config: intlProxyConfig}
 
-	s.access = &accessCtx{}
+	s.geoip = reloadGeoIPDB(s.geoip, s.conf.GeoIPDB)
+	s.access = &accessCtx{geoip: s.geoip}
 	err = s.access.Init(s.conf.AllowedClients, s.conf.DisallowedClients, s.conf.BlockedHosts)
 	if err != nil {
 		return err
 	}
+	if s.access.hasGeoIP() && s.geoip == nil {
+		log.Error("DNS: access settings: country and ASN entries don't match any clients, because GeoIP database isn't set")
+	}
 
-	if s.conf.TLSListenAddr != nil && len(s.conf.CertificateChainData) != 0 && len(s.conf.PrivateKeyData) != 0 {
+	s.conf.quicTLSConfig = nil
+	if (s.conf.TLSListenAddr != nil || s.conf.QUICListenAddr != nil) &&
+		len(s.conf.CertificateChainData) != 0 && len(s.conf.PrivateKeyData) != 0 {
 		proxyConfig.TLSListenAddr = s.conf.TLSListenAddr
 		s.conf.cert, err = tls.X509KeyPair(s.conf.CertificateChainData, s.conf.PrivateKeyData)
 		if err != nil {
@@ -337,6 +679,14 @@ func (s *Server) Prepare(config *ServerConfig) error {
 			GetCertificate: s.onGetCertificate,
 			MinVersion:     tls.VersionTLS12,
 		}
+
+		if s.conf.QUICListenAddr != nil {
+			s.conf.quicTLSConfig = &tls.Config{
+				GetCertificate: s.onGetCertificate,
+				NextProtos:     []string{doqALPN},
+				MinVersion:     tls.VersionTLS13,
+			}
+		}
 	}
 
 	if len(proxyConfig.Upstreams) == 0 {
@@ -350,6 +700,10 @@ func (s *Server) Prepare(config *ServerConfig) error {
 
 	// Initialize and start the DNS proxy
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
+	s.listeners, err = s.prepareListeners(s.conf.Listeners, proxyConfig)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
 	return nil
 }
 
@@ -409,6 +763,13 @@ func (s *Server) Stop() error {
 
 // stopInternal stops without locking
 func (s *Server) stopInternal() error {
+	s.selector.stopHealthCheck()
+	s.prefetch.close()
+	s.stopDoQ()
+	s.stopActivated()
+	s.stopListeners()
+	s.mdns.stop()
+
 	if s.dnsProxy != nil {
 		err := s.dnsProxy.Stop()
 		if err != nil {
@@ -479,20 +840,30 @@ func ipFromAddr(a net.Addr) string {
 }
 
 func (s *Server) beforeRequestHandler(p *proxy.Proxy, d *proxy.DNSContext) (bool, error) {
+	access := s.access
+	l := s.findListener(p)
+	if l != nil && l.access != nil {
+		access = l.access
+	}
+
 	ip := ipFromAddr(d.Addr)
-	if s.access.IsBlockedIP(ip) {
+	if access.IsBlockedIP(ip) {
 		log.Tracef("Client IP %s is blocked by settings", ip)
+		access.logRejected(ip)
 		return false, nil
 	}
 
 	if len(d.Req.Question) == 1 {
 		host := strings.TrimSuffix(d.Req.Question[0].Name, ".")
-		if s.access.IsBlockedDomain(host) {
+		if access.IsBlockedDomain(host) {
 			log.Tracef("Domain %s is blocked by settings", host)
 			return false, nil
 		}
 	}
 
+	if s.processRatelimit(d) {
+		return false, nil
+	}
 	return true, nil
 }
 
@@ -506,8 +877,18 @@ type dnsContext struct {
 	origResp             *dns.Msg     // response received from upstream servers.  Set when response is modified by filtering
 	origQuestion         dns.Question // question received from client.  Set when Rewrites are used.
 	err                  error        // error returned from the module
+	clientIP             string       // client's IP address (or the address from EDNS Client Subnet option)
+	clientID             string       // client ID from DoH path or DoT server name.  "": not set
+	clientSubnet         *net.IPNet   // subnet from EDNS Client Subnet option.  nil: not set
+	span                 *span        // tracing span of the request.  nil: tracing is disabled
 	protectionEnabled    bool         // filtering is enabled, dnsfilter object is ready
 	responseFromUpstream bool         // response is received from upstream servers
+	dnssecResult         string       // result of DNSSEC validation.  "": not validated
+	view                 *view        // split-horizon view of the client.  nil: not set
+	listener             *listener    // the listener which has received the request.  nil: the main server
+	dns64Question        dns.Question // question received from client.  Set when DNS64 PTR request is translated
+	plugin               string       // the name of the plugin which has set the response.  "": not set
+	pluginReq            *PluginRequest
 }
 
 const (
@@ -529,6 +910,24 @@ func processInitial(ctx *dnsContext) int {
 		s.conf.OnDNSRequest(d)
 	}
 
+	ctx.clientIP = ipFromAddr(d.Addr)
+	ctx.clientSubnet = ecsSubnet(d.Req)
+	if ctx.clientSubnet != nil && s.conf.EDNSClientSubnetIdentify {
+		ctx.clientIP = ctx.clientSubnet.IP.String()
+	}
+	clientID, err := s.clientIDFromDNSContext(d)
+	if err == nil {
+		ctx.clientID = clientID
+	} else {
+		log.Debug("DNS: %s: %s", ctx.clientIP, err)
+	}
+	if ctx.listener != nil && len(ctx.listener.conf.View) != 0 {
+		ctx.view = s.findViewByName(ctx.listener.conf.View)
+	}
+	if ctx.view == nil {
+		ctx.view = s.findView(ctx.clientIP)
+	}
+
 	// disable Mozilla DoH
 	if (d.Req.Question[0].Qtype == dns.TypeA || d.Req.Question[0].Qtype == dns.TypeAAAA) &&
 		d.Req.Question[0].Name == "use-application-dns.net." {
@@ -542,7 +941,9 @@ func processInitial(ctx *dnsContext) int {
 // Apply filtering logic
 func processFilteringBeforeRequest(ctx *dnsContext) int {
 	s := ctx.srv
-	d := ctx.proxyCtx
+	if len(ctx.plugin) != 0 {
+		return resultDone // response is already set by a plugin
+	}
 
 	s.RLock()
 	// Synchronize access to s.dnsFilter so it won't be suddenly uninitialized while in use.
@@ -553,14 +954,19 @@ func processFilteringBeforeRequest(ctx *dnsContext) int {
 	//  (to prevent from hanging while waiting for unresponsive DNS server to respond).
 
 	var err error
-	ctx.protectionEnabled = s.conf.ProtectionEnabled && s.dnsFilter != nil
+	ctx.protectionEnabled = s.conf.ProtectionEnabled && s.dnsFilter != nil &&
+		(ctx.listener == nil || ctx.listener.conf.FilteringEnabled)
 	if ctx.protectionEnabled {
-		ctx.setts = s.getClientRequestFilteringSettings(d)
+		ctx.setts = s.getClientRequestFilteringSettings(ctx)
+		traceFilteringStages(ctx)
 		ctx.result, err = s.filterDNSRequest(ctx)
 	}
 	s.RUnlock()
 
 	if err != nil {
+		// the filtering deadline is exceeded or the filter has failed:
+		//  the client gets SERVFAIL rather than the response which isn't checked
+		ctx.proxyCtx.Res = s.genServerFailure(ctx.proxyCtx.Req)
 		ctx.err = err
 		return resultError
 	}
@@ -575,21 +981,150 @@ func processUpstream(ctx *dnsContext) int {
 		return resultDone // response is already set - nothing to do
 	}
 
+	clientUpstreams := false
 	if d.Addr != nil && s.conf.GetUpstreamsByClient != nil {
-		clientIP := ipFromAddr(d.Addr)
-		upstreams := s.conf.GetUpstreamsByClient(clientIP)
+		var upstreams []upstream.Upstream
+		if cu := s.conf.GetUpstreamsByClient(ctx.clientKey()); cu != nil {
+			upstreams = cu.forHost(d.Req.Question[0].Name)
+		}
+		if len(upstreams) > 0 {
+			log.Debug("Using custom upstreams for %s", ctx.clientKey())
+			d.Upstreams = s.wrapUpstreams(upstreams)
+			clientUpstreams = true
+		}
+	}
+	if !clientUpstreams && ctx.view != nil && ctx.view.upstreams != nil {
+		upstreams := ctx.view.upstreams.forHost(d.Req.Question[0].Name)
 		if len(upstreams) > 0 {
-			log.Debug("Using custom upstreams for %s", clientIP)
-			d.Upstreams = upstreams
+			log.Debug("Using upstreams of view %s for %s", ctx.view.name, ctx.clientIP)
+			d.Upstreams = s.wrapUpstreams(upstreams)
+			clientUpstreams = true // the responses are specific to the view
+		}
+	}
+	if d.Upstreams == nil {
+		s.setDomainUpstreams(d)
+	}
+
+	// the zones served by domain-specific upstreams are usually private and unsigned
+	dnssecMode := ""
+	if (clientUpstreams || d.Upstreams == nil) && !d.Req.CheckingDisabled {
+		clientMode := ""
+		if s.conf.GetDNSSECModeByClient != nil {
+			clientMode = s.conf.GetDNSSECModeByClient(ctx.clientKey())
+		}
+		dnssecMode = s.dnssec.getMode(clientMode)
+	}
+
+	// the prefetched responses aren't validated
+	if !clientUpstreams && len(dnssecMode) == 0 {
+		resp := s.prefetch.get(d.Req, time.Now())
+		if resp != nil {
+			s.prefetch.record(d.Req, nil, false, time.Now())
+			d.Res = resp
+			ctx.responseFromUpstream = true // the response is filtered in the same way
+			return resultDone
+		}
+	}
+
+	doAdded, optAdded := false, false
+	if opt := d.Req.IsEdns0(); len(dnssecMode) != 0 && (opt == nil || !opt.Do()) {
+		// RRSIG records are returned only if DO bit is set
+		doAdded = true
+		optAdded = setDO(d.Req)
+	}
+	ecsAdded := s.applyECSPolicy(ctx)
+	restoreReq := func() {
+		if ecsAdded {
+			removeECS(d.Req)
+		}
+		if doAdded {
+			clearDO(d.Req, optAdded)
 		}
 	}
 
+	// the stale responses are shared by all clients,
+	// so the responses from the client's upstreams and for the client's subnet aren't stored or served
+	useStale := !clientUpstreams && getECS(d.Req) == nil
+
+	if useStale && s.stale.recentlyFailed(d.Upstreams, d.Req, time.Now()) && s.serveStale(ctx) {
+		restoreReq()
+		return resultDone
+	}
+
+	// the budget is spent only if the response isn't in cache
+	upstreams := d.Upstreams
+	d.Upstreams = s.budget.wrap(upstreams)
+	gate := s.budget.begin(d.Req)
+
 	// request was not filtered so let it be processed further
+	start := time.Now()
+	sp := ctx.span.child("upstream.exchange", spanKindClient, start)
 	err := s.dnsProxy.Resolve(d)
+	s.budget.end(d.Req, gate)
+	d.Upstreams = upstreams
+	d.Upstream = unwrapBudgetUpstream(d.Upstream)
+	if gate != nil && gate.isExceeded() {
+		sp.setError(errBudgetExceeded)
+		sp.finish()
+		restoreReq()
+		return processBudgetExceeded(ctx, useStale)
+	}
 	if err != nil {
+		sp.setError(err)
+		sp.finish()
+		restoreReq()
+		if useStale {
+			s.stale.setFailed(d.Upstreams, d.Req, time.Now())
+			if s.serveStale(ctx) {
+				return resultDone
+			}
+		}
 		ctx.err = err
 		return resultError
 	}
+	sp.setAttr("cached", d.Upstream == nil)
+	if d.Upstream != nil {
+		sp.setAttr("upstream", d.Upstream.Address())
+		if _, ok := d.Upstream.(*upstreamGroup); !ok {
+			// the responses from the upstreams in a group are counted by the selector
+			s.metrics.observeUpstream(d.Upstream.Address(), time.Since(start))
+		}
+	}
+	sp.finish()
+
+	if ecsAdded {
+		// the client didn't ask for it
+		removeECS(d.Req)
+		if d.Res != nil {
+			removeECS(d.Res)
+		}
+	}
+
+	if len(dnssecMode) != 0 {
+		sp = ctx.span.child("dnssec.validate", spanKindInternal, time.Now())
+		s.dnssecValidate(ctx, dnssecMode, doAdded, optAdded)
+		sp.setAttr("result", ctx.dnssecResult)
+		sp.finish()
+	}
+
+	if d.Upstream != nil {
+		// the response isn't from cache
+		if useStale && d.Res != nil && d.Res.Rcode == dns.RcodeServerFailure {
+			s.stale.setFailed(d.Upstreams, d.Req, time.Now())
+			if s.serveStale(ctx) {
+				return resultDone
+			}
+		} else if useStale {
+			// store the response for the case when upstream servers are unavailable
+			sp = ctx.span.child("cache.write", spanKindInternal, time.Now())
+			s.stale.set(d.Upstreams, d.Req, d.Res, time.Now())
+			sp.finish()
+		}
+	}
+
+	if !clientUpstreams && !ecsAdded && len(dnssecMode) == 0 {
+		s.prefetch.record(d.Req, d.Res, d.Upstream != nil, time.Now())
+	}
 
 	ctx.responseFromUpstream = true
 	return resultDone
@@ -612,7 +1147,7 @@ func processFilteringAfterResponse(ctx *dnsContext) int {
 
 		if len(d.Res.Answer) != 0 {
 			answer := []dns.RR{}
-			answer = append(answer, s.genCNAMEAnswer(d.Req, res.CanonName))
+			answer = append(answer, s.genCNAMEAnswer(d.Req, res.CanonName, s.rewriteTTL(res)))
 			answer = append(answer, d.Res.Answer...) // host -> IP
 			d.Res.Answer = answer
 		}
@@ -621,6 +1156,7 @@ func processFilteringAfterResponse(ctx *dnsContext) int {
 		origResp2 := d.Res
 		ctx.result, err = s.filterDNSResponse(ctx)
 		if err != nil {
+			d.Res = s.genServerFailure(d.Req)
 			ctx.err = err
 			return resultError
 		}
@@ -659,6 +1195,8 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 			Result:     ctx.result,
 			Elapsed:    elapsed,
 			ClientIP:   getIP(d.Addr),
+			ClientID:   ctx.clientID,
+			DNSSEC:     ctx.dnssecResult,
 		}
 		if d.Upstream != nil {
 			p.Upstream = d.Upstream.Address()
@@ -666,25 +1204,97 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 		s.queryLog.Add(p)
 	}
 
-	s.updateStats(d, elapsed, *ctx.result)
+	s.updateStats(d, ctx.clientID, elapsed, *ctx.result)
 	s.RUnlock()
+	s.metrics.countQuery(ctx.result)
+	if s.conf.LogQueries {
+		logQuery(ctx, elapsed)
+	}
+
+	if s.conf.OnDNSResponse != nil {
+		s.conf.OnDNSResponse(d, ctx.result)
+	}
 
 	return resultDone
 }
 
+// The result of a DNS query written to the log
+type queryLogEntry struct {
+	Client   string  `json:"client"`
+	ClientID string  `json:"client_id,omitempty"`
+	QName    string  `json:"qname"`
+	QType    string  `json:"qtype"`
+	Rcode    string  `json:"rcode,omitempty"`
+	Reason   string  `json:"reason"`
+	Rule     string  `json:"rule,omitempty"`
+	FilterID int64   `json:"filter_id,omitempty"`
+	Upstream string  `json:"upstream,omitempty"`
+	Elapsed  float64 `json:"elapsed"` // in milliseconds
+}
+
+// Write the result of a DNS query to the log
+func logQuery(ctx *dnsContext, elapsed time.Duration) {
+	d := ctx.proxyCtx
+	e := queryLogEntry{
+		Client:   ctx.clientIP,
+		ClientID: ctx.clientID,
+		QName:    strings.TrimSuffix(d.Req.Question[0].Name, "."),
+		QType:    dns.TypeToString[d.Req.Question[0].Qtype],
+		Elapsed:  float64(elapsed) / float64(time.Millisecond),
+	}
+	if d.Res != nil {
+		e.Rcode = dns.RcodeToString[d.Res.Rcode]
+	}
+	if ctx.result != nil {
+		e.Reason = ctx.result.Reason.String()
+		e.Rule = ctx.result.Rule
+		e.FilterID = ctx.result.FilterID
+	}
+	if d.Upstream != nil {
+		e.Upstream = d.Upstream.Address()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	log.Info("%s", data)
+}
+
 // handleDNSRequest filters the incoming DNS requests and writes them to the query log
 // nolint (gocyclo)
 func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
+	if !s.drain.begin() {
+		// the server is shutting down: the client retries the request with another server right away
+		d.Res = s.genRefused(d.Req)
+		return nil
+	}
+	defer s.drain.end()
+
 	ctx := &dnsContext{srv: s, proxyCtx: d}
+	ctx.listener = s.findListener(p)
 	ctx.result = &dnsfilter.Result{}
 	ctx.startTime = time.Now()
+	s.startRequestSpan(ctx)
+	defer finishRequestSpan(ctx)
 
 	type modProcessFunc func(ctx *dnsContext) int
 	mods := []modProcessFunc{
+		processHealthProbe,
 		processInitial,
+		processPluginsBeforeFilter,
 		processFilteringBeforeRequest,
+		processPluginsAfterFilter,
+		processLocalZones,
+		processDHCPHosts,
+		processMDNS,
+		processDNS64Request,
 		processUpstream,
 		processFilteringAfterResponse,
+		processDNS64Response,
+		processRecordTypeFiltering,
+		processRebindingProtection,
+		processPluginsOnResponse,
 		processQueryLogsAndStats,
 	}
 	for _, process := range mods {
@@ -693,6 +1303,10 @@ func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 		case resultFinish:
 			return nil
 		case resultError:
+			if d.Res == nil {
+				// DNS proxy expects a response
+				d.Res = s.genServerFailure(d.Req)
+			}
 			return ctx.err
 		}
 	}
@@ -714,7 +1328,7 @@ func getIP(addr net.Addr) net.IP {
 	return nil
 }
 
-func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dnsfilter.Result) {
+func (s *Server) updateStats(d *proxy.DNSContext, clientID string, elapsed time.Duration, res dnsfilter.Result) {
 	if s.stats == nil {
 		return
 	}
@@ -728,6 +1342,7 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 	case *net.TCPAddr:
 		e.Client = addr.IP
 	}
+	e.ClientID = clientID
 	e.Time = uint32(elapsed / 1000)
 	switch res.Reason {
 
@@ -736,33 +1351,57 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 	case dnsfilter.NotFilteredWhiteList:
 		fallthrough
 	case dnsfilter.NotFilteredError:
+		fallthrough
+	case dnsfilter.NotFilteredPaused:
 		e.Result = stats.RNotFiltered
 
 	case dnsfilter.FilteredSafeBrowsing:
 		e.Result = stats.RSafeBrowsing
+		e.Category = res.Rule
 	case dnsfilter.FilteredParental:
 		e.Result = stats.RParental
+		e.Category = res.Rule
 	case dnsfilter.FilteredSafeSearch:
 		e.Result = stats.RSafeSearch
 
 	case dnsfilter.FilteredBlackList:
-		fallthrough
+		e.FilterID = res.FilterID
+		e.FilterMatched = true
+		e.Result = stats.RFiltered
+	case dnsfilter.FilteredBlockedService:
+		e.Service = res.ServiceName
+		e.Result = stats.RFiltered
+	case dnsfilter.FilteredExternal:
+		e.Category = res.Rule
+		e.Result = stats.RFiltered
 	case dnsfilter.FilteredInvalid:
 		fallthrough
-	case dnsfilter.FilteredBlockedService:
+	case dnsfilter.FilteredRebind:
+		fallthrough
+	case dnsfilter.FilteredRecordType:
+		fallthrough
+	case dnsfilter.FilteredScript:
+		fallthrough
+	case dnsfilter.FilteredNotInAllowList:
 		e.Result = stats.RFiltered
 	}
 	s.stats.Update(e)
 }
 
 // getClientRequestFilteringSettings lookups client filtering settings
-// using the client's IP address from the DNSContext
-func (s *Server) getClientRequestFilteringSettings(d *proxy.DNSContext) *dnsfilter.RequestFilteringSettings {
+// using the client ID or the client's IP address from the DNSContext
+func (s *Server) getClientRequestFilteringSettings(ctx *dnsContext) *dnsfilter.RequestFilteringSettings {
 	setts := s.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
+	if ctx.clientSubnet != nil {
+		setts.ClientSubnet = ctx.clientSubnet.String()
+	}
 	if s.conf.FilterHandler != nil {
-		clientAddr := ipFromAddr(d.Addr)
-		s.conf.FilterHandler(clientAddr, &setts)
+		setts.ClientIP = ctx.clientIP
+		s.conf.FilterHandler(ctx.clientKey(), &setts)
+	}
+	if ctx.view != nil {
+		setts.Rewrites = ctx.view.rewrites
 	}
 	return &setts
 }
@@ -772,7 +1411,17 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 	d := ctx.proxyCtx
 	req := d.Req
 	host := strings.TrimSuffix(req.Question[0].Name, ".")
-	res, err := s.dnsFilter.CheckHost(host, d.Req.Question[0].Qtype, ctx.setts)
+
+	// the deadline is counted from the time the request was received:
+	//  don't waste time on filtering if the client is not going to wait for the response
+	timeout := defaultFilteringTimeout
+	if s.conf.FilteringTimeout != 0 {
+		timeout = time.Duration(s.conf.FilteringTimeout) * time.Millisecond
+	}
+	reqCtx, cancel := context.WithDeadline(context.Background(), ctx.startTime.Add(timeout))
+	defer cancel()
+
+	res, err := s.dnsFilter.CheckHostCtx(reqCtx, host, d.Req.Question[0].Qtype, ctx.setts)
 	if err != nil {
 		// Return immediately if there's an error
 		return nil, errorx.Decorate(err, "dnsfilter failed to check host '%s'", host)
@@ -785,8 +1434,9 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 		resp := s.makeResponse(req)
 
 		name := host
+		ttl := s.rewriteTTL(&res)
 		if len(res.CanonName) != 0 {
-			resp.Answer = append(resp.Answer, s.genCNAMEAnswer(req, res.CanonName))
+			resp.Answer = append(resp.Answer, s.genCNAMEAnswer(req, res.CanonName, ttl))
 			name = res.CanonName
 		}
 
@@ -794,10 +1444,12 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 			if req.Question[0].Qtype == dns.TypeA {
 				a := s.genAAnswer(req, ip)
 				a.Hdr.Name = dns.Fqdn(name)
+				a.Hdr.Ttl = ttl
 				resp.Answer = append(resp.Answer, a)
 			} else if req.Question[0].Qtype == dns.TypeAAAA {
 				a := s.genAAAAAnswer(req, ip)
 				a.Hdr.Name = dns.Fqdn(name)
+				a.Hdr.Ttl = ttl
 				resp.Answer = append(resp.Answer, a)
 			}
 		}
@@ -879,8 +1531,16 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 
 	switch result.Reason {
 	case dnsfilter.FilteredSafeBrowsing:
+		resp := s.genBlockingModeResponse(m, s.conf.SafeBrowsingBlockingMode, s.conf.SafeBrowsingBlockingIPAddr)
+		if resp != nil {
+			return resp
+		}
 		return s.genBlockedHost(m, s.conf.SafeBrowsingBlockHost, d)
 	case dnsfilter.FilteredParental:
+		resp := s.genBlockingModeResponse(m, s.conf.ParentalBlockingMode, s.conf.ParentalBlockingIPAddr)
+		if resp != nil {
+			return resp
+		}
 		return s.genBlockedHost(m, s.conf.ParentalBlockHost, d)
 	default:
 		// If the query was filtered by "Safe search", dnsfilter also must return
@@ -890,6 +1550,10 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 			return s.genResponseWithIP(m, result.IP)
 		}
 
+		if m.Question[0].Qtype == dns.TypeAAAA && s.conf.BlockingIPv6NXDomain {
+			return s.genNXDomain(m)
+		}
+
 		if s.conf.BlockingMode == "null_ip" {
 			// it means that we should return 0.0.0.0 or :: for any blocked request
 
@@ -914,6 +1578,11 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 			// means that we should return NXDOMAIN for any blocked request
 
 			return s.genNXDomain(m)
+
+		} else if s.conf.BlockingMode == "refused" {
+			// means that we should return REFUSED for any blocked request
+
+			return s.genRefused(m)
 		}
 
 		// Default blocking mode
@@ -926,6 +1595,26 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 	}
 }
 
+// Generate a response for the request blocked by parental control or safe-browsing
+// Return nil in default mode
+func (s *Server) genBlockingModeResponse(m *dns.Msg, mode string, ip net.IP) *dns.Msg {
+	switch mode {
+	case "nxdomain":
+		return s.genNXDomain(m)
+	case "refused":
+		return s.genRefused(m)
+	case "null_ip":
+		if m.Question[0].Qtype == dns.TypeA {
+			return s.genARecord(m, []byte{0, 0, 0, 0})
+		}
+		return s.genAAAARecord(m, net.IPv6zero)
+	case "custom_ip":
+		// an empty response is returned if the address family doesn't match
+		return s.genResponseWithIP(m, ip)
+	}
+	return nil
+}
+
 func (s *Server) genServerFailure(request *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, dns.RcodeServerFailure)
@@ -1019,13 +1708,24 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 	return resp
 }
 
+// Get TTL of the rewritten answer
+func (s *Server) rewriteTTL(res *dnsfilter.Result) uint32 {
+	if res.TTL != 0 {
+		return res.TTL
+	}
+	if s.conf.RewriteTTL != 0 {
+		return s.conf.RewriteTTL
+	}
+	return s.conf.BlockedResponseTTL
+}
+
 // Make a CNAME response
-func (s *Server) genCNAMEAnswer(req *dns.Msg, cname string) *dns.CNAME {
+func (s *Server) genCNAMEAnswer(req *dns.Msg, cname string, ttl uint32) *dns.CNAME {
 	answer := new(dns.CNAME)
 	answer.Hdr = dns.RR_Header{
 		Name:   req.Question[0].Name,
 		Rrtype: dns.TypeCNAME,
-		Ttl:    s.conf.BlockedResponseTTL,
+		Ttl:    ttl,
 		Class:  dns.ClassINET,
 	}
 	answer.Target = dns.Fqdn(cname)
@@ -1040,6 +1740,13 @@ func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+func (s *Server) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+	return &resp
+}
+
 func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 	zone := ""
 	if len(request.Question) > 0 {
@@ -3,10 +3,12 @@ package dnsforward
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/jsonutil"
@@ -22,13 +24,48 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 }
 
 type dnsConfigJSON struct {
-	ProtectionEnabled bool   `json:"protection_enabled"`
-	RateLimit         uint32 `json:"ratelimit"`
-	BlockingMode      string `json:"blocking_mode"`
-	BlockingIPv4      string `json:"blocking_ipv4"`
-	BlockingIPv6      string `json:"blocking_ipv6"`
-	EDNSCSEnabled     bool   `json:"edns_cs_enabled"`
-	DisableIPv6       bool   `json:"disable_ipv6"`
+	ProtectionEnabled    bool   `json:"protection_enabled"`
+	RateLimit            uint32 `json:"ratelimit"`
+	RateLimitTCP         uint32 `json:"ratelimit_tcp"`
+	RateLimitBurst       uint32 `json:"ratelimit_burst"`
+	RateLimitAction      string `json:"ratelimit_action"`
+	BlockingMode         string `json:"blocking_mode"`
+	BlockingIPv4         string `json:"blocking_ipv4"`
+	BlockingIPv6         string `json:"blocking_ipv6"`
+	BlockingIPv6NXDomain bool   `json:"blocking_ipv6_nxdomain"`
+	EDNSCSEnabled        bool   `json:"edns_cs_enabled"`
+	DisableIPv6          bool   `json:"disable_ipv6"`
+
+	BlockedResponseTTL uint32 `json:"blocked_response_ttl"`
+	RewriteTTL         uint32 `json:"rewrite_ttl"`
+
+	ParentalBlockingMode     string `json:"parental_blocking_mode"`
+	ParentalBlockingIP       string `json:"parental_blocking_ip"`
+	SafeBrowsingBlockingMode string `json:"safebrowsing_blocking_mode"`
+	SafeBrowsingBlockingIP   string `json:"safebrowsing_blocking_ip"`
+
+	EDNSCSIdentify bool     `json:"edns_cs_identify"`
+	EDNSCSPolicies []string `json:"edns_cs_policies"`
+
+	UpstreamDDR bool `json:"upstream_ddr"`
+
+	ServeStale       bool   `json:"serve_stale"`
+	ServeStaleMaxAge uint32 `json:"serve_stale_max_age"`
+
+	Prefetch       bool   `json:"prefetch"`
+	PrefetchBudget uint32 `json:"prefetch_budget"`
+
+	DNSSECValidation string `json:"dnssec_validation"`
+
+	BlockedRecordTypes []string `json:"blocked_record_types"`
+
+	UpstreamSource  string           `json:"upstream_source"`
+	UpstreamSources []UpstreamSource `json:"upstream_sources"`
+
+	DNS64Enabled        bool     `json:"dns64_enabled"`
+	DNS64Prefix         string   `json:"dns64_prefix"`
+	DNS64ExcludeNets    []string `json:"dns64_exclude_nets"`
+	DNS64ExcludeDomains []string `json:"dns64_exclude_domains"`
 }
 
 func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
@@ -38,9 +75,34 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	resp.BlockingMode = s.conf.BlockingMode
 	resp.BlockingIPv4 = s.conf.BlockingIPv4
 	resp.BlockingIPv6 = s.conf.BlockingIPv6
+	resp.BlockingIPv6NXDomain = s.conf.BlockingIPv6NXDomain
+	resp.BlockedResponseTTL = s.conf.BlockedResponseTTL
+	resp.RewriteTTL = s.conf.RewriteTTL
 	resp.RateLimit = s.conf.Ratelimit
+	resp.RateLimitTCP = s.conf.RatelimitTCP
+	resp.RateLimitBurst = s.conf.RatelimitBurst
+	resp.RateLimitAction = s.conf.RatelimitAction
 	resp.EDNSCSEnabled = s.conf.EnableEDNSClientSubnet
 	resp.DisableIPv6 = s.conf.AAAADisabled
+	resp.ParentalBlockingMode = s.conf.ParentalBlockingMode
+	resp.ParentalBlockingIP = s.conf.ParentalBlockingIP
+	resp.SafeBrowsingBlockingMode = s.conf.SafeBrowsingBlockingMode
+	resp.SafeBrowsingBlockingIP = s.conf.SafeBrowsingBlockingIP
+	resp.EDNSCSIdentify = s.conf.EDNSClientSubnetIdentify
+	resp.EDNSCSPolicies = stringArrayDup(s.conf.EDNSClientSubnetPolicies)
+	resp.UpstreamDDR = s.conf.UpstreamDDR
+	resp.ServeStale = s.conf.ServeStale
+	resp.ServeStaleMaxAge = s.conf.ServeStaleMaxAge
+	resp.Prefetch = s.conf.Prefetch
+	resp.PrefetchBudget = s.conf.PrefetchBudget
+	resp.DNSSECValidation = s.conf.DNSSECValidation
+	resp.BlockedRecordTypes = stringArrayDup(s.conf.BlockedRecordTypes)
+	resp.UpstreamSource = s.conf.UpstreamSource
+	resp.UpstreamSources = append([]UpstreamSource{}, s.conf.UpstreamSources...)
+	resp.DNS64Enabled = s.conf.DNS64Enabled
+	resp.DNS64Prefix = s.conf.DNS64Prefix
+	resp.DNS64ExcludeNets = stringArrayDup(s.conf.DNS64ExcludeNets)
+	resp.DNS64ExcludeDomains = stringArrayDup(s.conf.DNS64ExcludeDomains)
 	s.RUnlock()
 
 	js, err := json.Marshal(resp)
@@ -54,18 +116,18 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 
 func checkBlockingMode(req dnsConfigJSON) bool {
 	bm := req.BlockingMode
-	if !(bm == "default" || bm == "nxdomain" || bm == "null_ip" || bm == "custom_ip") {
+	if !(bm == "default" || bm == "nxdomain" || bm == "refused" || bm == "null_ip" || bm == "custom_ip") {
 		return false
 	}
 
 	if bm == "custom_ip" {
-		ip := net.ParseIP(req.BlockingIPv4)
-		if ip == nil || ip.To4() == nil {
+		if !checkBlockingIPv4(req.BlockingIPv4) {
 			return false
 		}
 
-		ip = net.ParseIP(req.BlockingIPv6)
-		if ip == nil {
+		// an IPv6 address isn't required if AAAA requests are blocked with NXDOMAIN
+		if !(req.BlockingIPv6NXDomain && len(req.BlockingIPv6) == 0) &&
+			!checkBlockingIPv6(req.BlockingIPv6) {
 			return false
 		}
 	}
@@ -73,6 +135,37 @@ func checkBlockingMode(req dnsConfigJSON) bool {
 	return true
 }
 
+// Check the blocking mode for parental control or safe-browsing
+func checkReasonBlockingMode(mode string, ip string) bool {
+	switch mode {
+	case "", "default", "nxdomain", "refused", "null_ip":
+		return true
+	case "custom_ip":
+		return net.ParseIP(ip) != nil
+	}
+	return false
+}
+
+// Return TRUE if the string is a valid IPv4 address
+func checkBlockingIPv4(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil
+}
+
+// Return TRUE if the string is a valid IPv6 address
+func checkBlockingIPv6(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() == nil
+}
+
+// Check TTL value (in seconds): RFC 2181 allows only the values from 0 to 2^31 - 1
+func checkTTL(ttl uint32) error {
+	if ttl > math.MaxInt32 {
+		return fmt.Errorf("TTL must not be greater than %d", math.MaxInt32)
+	}
+	return nil
+}
+
 func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	req := dnsConfigJSON{}
 	js, err := jsonutil.DecodeObject(&req, r.Body)
@@ -86,6 +179,113 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if js.Exists("blocking_ipv4") && !checkBlockingIPv4(req.BlockingIPv4) {
+		httpError(r, w, http.StatusBadRequest, "blocking_ipv4: incorrect value")
+		return
+	}
+
+	if js.Exists("blocking_ipv6") && len(req.BlockingIPv6) != 0 && !checkBlockingIPv6(req.BlockingIPv6) {
+		httpError(r, w, http.StatusBadRequest, "blocking_ipv6: incorrect value")
+		return
+	}
+
+	if js.Exists("blocked_response_ttl") && checkTTL(req.BlockedResponseTTL) != nil {
+		httpError(r, w, http.StatusBadRequest, "blocked_response_ttl: incorrect value")
+		return
+	}
+
+	if js.Exists("rewrite_ttl") && checkTTL(req.RewriteTTL) != nil {
+		httpError(r, w, http.StatusBadRequest, "rewrite_ttl: incorrect value")
+		return
+	}
+
+	if js.Exists("parental_blocking_mode") &&
+		!checkReasonBlockingMode(req.ParentalBlockingMode, req.ParentalBlockingIP) {
+		httpError(r, w, http.StatusBadRequest, "parental_blocking_mode: incorrect value")
+		return
+	}
+
+	if js.Exists("safebrowsing_blocking_mode") &&
+		!checkReasonBlockingMode(req.SafeBrowsingBlockingMode, req.SafeBrowsingBlockingIP) {
+		httpError(r, w, http.StatusBadRequest, "safebrowsing_blocking_mode: incorrect value")
+		return
+	}
+
+	if js.Exists("ratelimit_action") && checkRatelimitAction(req.RateLimitAction) != nil {
+		httpError(r, w, http.StatusBadRequest, "ratelimit_action: incorrect value")
+		return
+	}
+
+	if js.Exists("dnssec_validation") && checkDNSSECMode(req.DNSSECValidation, false) != nil {
+		httpError(r, w, http.StatusBadRequest, "dnssec_validation: incorrect value")
+		return
+	}
+
+	var recordTypeRules []recordTypeRule
+	if js.Exists("blocked_record_types") {
+		recordTypeRules, err = parseRecordTypeRules(req.BlockedRecordTypes)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "blocked_record_types: %s", err)
+			return
+		}
+	}
+
+	if js.Exists("upstream_source") && len(req.UpstreamSource) != 0 {
+		err = checkUpstreamSource(req.UpstreamSource)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "upstream_source: %s", err)
+			return
+		}
+	}
+	if js.Exists("upstream_sources") {
+		for _, us := range req.UpstreamSources {
+			_, err = validateUpstream(us.Upstream)
+			if err == nil {
+				err = checkUpstreamSource(us.Source)
+			}
+			if err != nil {
+				httpError(r, w, http.StatusBadRequest, "upstream_sources: %s: %s", us.Upstream, err)
+				return
+			}
+		}
+	}
+
+	// the settings not present in the request are unchanged
+	dns64Changed := js.Exists("dns64_enabled") || js.Exists("dns64_prefix") ||
+		js.Exists("dns64_exclude_nets") || js.Exists("dns64_exclude_domains")
+	var dns64 *dns64Ctx
+	if dns64Changed {
+		s.RLock()
+		c := s.conf.FilteringConfig
+		s.RUnlock()
+		if js.Exists("dns64_enabled") {
+			c.DNS64Enabled = req.DNS64Enabled
+		}
+		if js.Exists("dns64_prefix") {
+			c.DNS64Prefix = req.DNS64Prefix
+		}
+		if js.Exists("dns64_exclude_nets") {
+			c.DNS64ExcludeNets = req.DNS64ExcludeNets
+		}
+		if js.Exists("dns64_exclude_domains") {
+			c.DNS64ExcludeDomains = req.DNS64ExcludeDomains
+		}
+		dns64, err = newDNS64(&c)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+
+	var ecsPolicies []ecsPolicy
+	if js.Exists("edns_cs_policies") {
+		ecsPolicies, err = parseECSPolicies(req.EDNSCSPolicies)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "edns_cs_policies: %s", err)
+			return
+		}
+	}
+
 	restart := false
 	s.Lock()
 
@@ -93,36 +293,133 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		s.conf.ProtectionEnabled = req.ProtectionEnabled
 	}
 
+	// blocking addresses may be changed separately for each address family;
+	//  the new values are used for the next requests, listeners aren't restarted
 	if js.Exists("blocking_mode") {
 		s.conf.BlockingMode = req.BlockingMode
-		if req.BlockingMode == "custom_ip" {
-			if js.Exists("blocking_ipv4") {
-				s.conf.BlockingIPv4 = req.BlockingIPv4
-				s.conf.BlockingIPAddrv4 = net.ParseIP(req.BlockingIPv4)
-			}
-			if js.Exists("blocking_ipv6") {
-				s.conf.BlockingIPv6 = req.BlockingIPv6
-				s.conf.BlockingIPAddrv6 = net.ParseIP(req.BlockingIPv6)
-			}
-		}
+	}
+	if js.Exists("blocking_ipv4") {
+		s.conf.BlockingIPv4 = req.BlockingIPv4
+		s.conf.BlockingIPAddrv4 = net.ParseIP(req.BlockingIPv4)
+	}
+	if js.Exists("blocking_ipv6") {
+		s.conf.BlockingIPv6 = req.BlockingIPv6
+		s.conf.BlockingIPAddrv6 = net.ParseIP(req.BlockingIPv6)
+	}
+	if js.Exists("blocking_ipv6_nxdomain") {
+		s.conf.BlockingIPv6NXDomain = req.BlockingIPv6NXDomain
+	}
+	if js.Exists("blocked_response_ttl") {
+		s.conf.BlockedResponseTTL = req.BlockedResponseTTL
+	}
+	if js.Exists("rewrite_ttl") {
+		s.conf.RewriteTTL = req.RewriteTTL
+	}
+
+	if js.Exists("parental_blocking_mode") {
+		s.conf.ParentalBlockingMode = req.ParentalBlockingMode
+		s.conf.ParentalBlockingIP = req.ParentalBlockingIP
+		s.conf.ParentalBlockingIPAddr = net.ParseIP(req.ParentalBlockingIP)
+	}
+	if js.Exists("safebrowsing_blocking_mode") {
+		s.conf.SafeBrowsingBlockingMode = req.SafeBrowsingBlockingMode
+		s.conf.SafeBrowsingBlockingIP = req.SafeBrowsingBlockingIP
+		s.conf.SafeBrowsingBlockingIPAddr = net.ParseIP(req.SafeBrowsingBlockingIP)
 	}
 
+	// the new limits are used for the next requests
 	if js.Exists("ratelimit") {
-		if s.conf.Ratelimit != req.RateLimit {
-			restart = true
-		}
 		s.conf.Ratelimit = req.RateLimit
 	}
+	if js.Exists("ratelimit_tcp") {
+		s.conf.RatelimitTCP = req.RateLimitTCP
+	}
+	if js.Exists("ratelimit_burst") {
+		s.conf.RatelimitBurst = req.RateLimitBurst
+	}
+	if js.Exists("ratelimit_action") {
+		s.conf.RatelimitAction = req.RateLimitAction
+	}
 
 	if js.Exists("edns_cs_enabled") {
 		s.conf.EnableEDNSClientSubnet = req.EDNSCSEnabled
 		restart = true
 	}
 
+	if js.Exists("edns_cs_identify") {
+		s.conf.EDNSClientSubnetIdentify = req.EDNSCSIdentify
+	}
+	if js.Exists("edns_cs_policies") {
+		s.conf.EDNSClientSubnetPolicies = req.EDNSCSPolicies
+		s.ecsPolicies = ecsPolicies
+	}
+
 	if js.Exists("disable_ipv6") {
 		s.conf.AAAADisabled = req.DisableIPv6
 	}
 
+	if js.Exists("upstream_ddr") {
+		if s.conf.UpstreamDDR != req.UpstreamDDR {
+			restart = true
+		}
+		s.conf.UpstreamDDR = req.UpstreamDDR
+	}
+
+	if js.Exists("serve_stale") {
+		s.conf.ServeStale = req.ServeStale
+	}
+	if js.Exists("serve_stale_max_age") {
+		s.conf.ServeStaleMaxAge = req.ServeStaleMaxAge
+	}
+	s.stale.configure(&s.conf.FilteringConfig)
+
+	if js.Exists("prefetch") {
+		if s.conf.Prefetch != req.Prefetch {
+			restart = true
+		}
+		s.conf.Prefetch = req.Prefetch
+	}
+	if js.Exists("prefetch_budget") {
+		s.conf.PrefetchBudget = req.PrefetchBudget
+		s.prefetch.configure(&s.conf.FilteringConfig, time.Now())
+	}
+
+	if js.Exists("dnssec_validation") {
+		s.conf.DNSSECValidation = req.DNSSECValidation
+		s.dnssec.setMode(req.DNSSECValidation)
+	}
+
+	if js.Exists("blocked_record_types") {
+		s.conf.BlockedRecordTypes = req.BlockedRecordTypes
+		s.recordTypeRules = recordTypeRules
+	}
+
+	if js.Exists("dns64_enabled") {
+		s.conf.DNS64Enabled = req.DNS64Enabled
+	}
+	if js.Exists("dns64_prefix") {
+		s.conf.DNS64Prefix = req.DNS64Prefix
+	}
+	if js.Exists("dns64_exclude_nets") {
+		s.conf.DNS64ExcludeNets = req.DNS64ExcludeNets
+	}
+	if js.Exists("dns64_exclude_domains") {
+		s.conf.DNS64ExcludeDomains = req.DNS64ExcludeDomains
+	}
+	if dns64Changed {
+		s.dns64 = dns64
+	}
+
+	// the upstream objects are re-created
+	if js.Exists("upstream_source") {
+		s.conf.UpstreamSource = req.UpstreamSource
+		restart = true
+	}
+	if js.Exists("upstream_sources") {
+		s.conf.UpstreamSources = req.UpstreamSources
+		restart = true
+	}
+
 	s.Unlock()
 	s.conf.ConfigModified()
 
@@ -253,7 +550,8 @@ func separateUpstream(upstream string) (string, bool, error) {
 		// split domains list and validate each one
 		for _, host := range strings.Split(domainsAndUpstream[0], "/") {
 			if host != "" {
-				if err := utils.IsValidHostname(host); err != nil {
+				// "*.domain" matches only subdomains
+				if err := utils.IsValidHostname(strings.TrimPrefix(host, "*.")); err != nil {
 					return "", defaultUpstream, err
 				}
 			}
@@ -384,4 +682,35 @@ func (s *Server) registerHandlers() {
 
 	s.conf.HTTPRegister("GET", "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister("POST", "/control/access/set", s.handleAccessSet)
+
+	s.conf.HTTPRegister("GET", "/control/rebinding/status", s.handleRebindingStatus)
+	s.conf.HTTPRegister("POST", "/control/rebinding/set", s.handleRebindingSet)
+
+	s.conf.HTTPRegister("GET", "/control/upstream_budget/status", s.handleBudgetStatus)
+	s.conf.HTTPRegister("POST", "/control/upstream_budget/set", s.handleBudgetSet)
+
+	s.conf.HTTPRegister("GET", "/control/ddr/status", s.handleDDRStatus)
+
+	s.conf.HTTPRegister("GET", "/control/upstream_strategy/status", s.handleUpstreamStrategyStatus)
+	s.conf.HTTPRegister("POST", "/control/upstream_strategy/set", s.handleUpstreamStrategySet)
+
+	s.conf.HTTPRegister("GET", "/control/upstream_health/status", s.handleUpstreamHealthStatus)
+	s.conf.HTTPRegister("POST", "/control/upstream_health/set", s.handleUpstreamHealthSet)
+
+	s.conf.HTTPRegister("GET", "/control/upstream_domains/list", s.handleUpstreamDomainsList)
+	s.conf.HTTPRegister("POST", "/control/upstream_domains/set", s.handleUpstreamDomainsSet)
+	s.conf.HTTPRegister("GET", "/control/upstream_domains/lookup", s.handleUpstreamDomainsLookup)
+
+	s.conf.HTTPRegister("GET", "/control/ptr_forwarding/list", s.handlePTRForwardingList)
+	s.conf.HTTPRegister("POST", "/control/ptr_forwarding/set", s.handlePTRForwardingSet)
+	s.conf.HTTPRegister("GET", "/control/local_zones/list", s.handleLocalZonesList)
+	s.conf.HTTPRegister("POST", "/control/local_zones/set", s.handleLocalZonesSet)
+	s.conf.HTTPRegister("GET", "/control/views/list", s.handleViewsList)
+	s.conf.HTTPRegister("POST", "/control/views/set", s.handleViewsSet)
+	s.conf.HTTPRegister("GET", "/control/listeners/list", s.handleListenersList)
+	s.conf.HTTPRegister("POST", "/control/listeners/set", s.handleListenersSet)
+	s.conf.HTTPRegister("GET", "/control/mdns/status", s.handleMDNSStatus)
+	s.conf.HTTPRegister("POST", "/control/mdns/config", s.handleMDNSConfig)
+	s.conf.HTTPRegister("GET", "/control/upstream_pool/status", s.handleUpstreamPoolStatus)
+	s.conf.HTTPRegister("POST", "/control/upstream_pool/config", s.handleUpstreamPoolConfig)
 }
@@ -1,17 +1,24 @@
 package dnsforward
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -502,6 +509,253 @@ func TestBlockedCustomIP(t *testing.T) {
 	}
 }
 
+func TestRewriteTTL(t *testing.T) {
+	c := dnsfilter.Config{}
+	c.Rewrites = []dnsfilter.RewriteEntry{
+		{Domain: "a.lan", Answer: "192.168.1.1"},
+		{Domain: "b.lan", Answer: "192.168.1.2", TTL: 60},
+	}
+	filters := map[int]string{}
+	filters[0] = "||null.example.org^\n"
+	f := dnsfilter.New(&c, filters)
+	s := NewServer(f, nil, nil)
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.ProtectionEnabled = true
+	conf.BlockingMode = "null_ip"
+	conf.BlockedResponseTTL = 10
+	conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	err := s.Prepare(&conf)
+	assert.Nil(t, err)
+	err = s.Start()
+	assert.Nil(t, err)
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	ttl := func(host string) uint32 {
+		reply, err := dns.Exchange(createTestMessageWithType(host, dns.TypeA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(reply.Answer))
+		return reply.Answer[0].Header().Ttl
+	}
+
+	// blocked_response_ttl is used by default
+	assert.Equal(t, uint32(10), ttl("null.example.org."))
+	assert.Equal(t, uint32(10), ttl("a.lan."))
+	assert.Equal(t, uint32(60), ttl("b.lan."))
+
+	err = s.Stop()
+	assert.Nil(t, err)
+
+	s.conf.RewriteTTL = 300
+	assert.Equal(t, uint32(300), s.rewriteTTL(&dnsfilter.Result{}))
+	assert.Equal(t, uint32(60), s.rewriteTTL(&dnsfilter.Result{TTL: 60})) // the entry's TTL takes precedence
+}
+
+func TestBlockingIPPerFamily(t *testing.T) {
+	s := NewServer(nil, nil, nil)
+	s.conf.BlockingMode = "custom_ip"
+	s.conf.BlockingIPAddrv4 = net.ParseIP("1.2.3.4")
+	s.conf.BlockingIPv6NXDomain = true
+	res := &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	resp := s.genDNSFilterMessage(&proxy.DNSContext{Req: req}, res)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+
+	req = &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeAAAA)
+	resp = s.genDNSFilterMessage(&proxy.DNSContext{Req: req}, res)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// hot-swap
+	s.conf.BlockingIPAddrv4 = net.ParseIP("4.3.2.1")
+	s.conf.BlockingIPAddrv6 = net.ParseIP("::1")
+	s.conf.BlockingIPv6NXDomain = false
+	resp = s.genDNSFilterMessage(&proxy.DNSContext{Req: req}, res)
+	assert.Equal(t, "::1", resp.Answer[0].(*dns.AAAA).AAAA.String())
+
+	assert.True(t, checkBlockingMode(dnsConfigJSON{BlockingMode: "custom_ip", BlockingIPv4: "1.2.3.4", BlockingIPv6NXDomain: true}))
+	assert.False(t, checkBlockingMode(dnsConfigJSON{BlockingMode: "custom_ip", BlockingIPv4: "1.2.3.4"}))
+	assert.False(t, checkBlockingMode(dnsConfigJSON{BlockingMode: "custom_ip", BlockingIPv4: "1.2.3.4", BlockingIPv6: "1.2.3.4"}))
+	assert.True(t, checkBlockingMode(dnsConfigJSON{BlockingMode: "custom_ip", BlockingIPv4: "1.2.3.4", BlockingIPv6: "::1"}))
+}
+
+func TestBlockingModePerReason(t *testing.T) {
+	s := NewServer(nil, nil, nil)
+	s.conf.BlockingMode = "refused"
+	s.conf.ParentalBlockingMode = "custom_ip"
+	s.conf.ParentalBlockingIPAddr = net.ParseIP("192.168.1.1")
+	s.conf.SafeBrowsingBlockingMode = "nxdomain"
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	d := &proxy.DNSContext{Req: req}
+
+	resp := s.genDNSFilterMessage(d, &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList})
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	resp = s.genDNSFilterMessage(d, &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredParental})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, "192.168.1.1", resp.Answer[0].(*dns.A).A.String())
+
+	resp = s.genDNSFilterMessage(d, &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredSafeBrowsing})
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// address family doesn't match: empty response
+	req = &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeAAAA)
+	resp = s.genDNSFilterMessage(&proxy.DNSContext{Req: req}, &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredParental})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+
+	assert.True(t, checkReasonBlockingMode("", ""))
+	assert.True(t, checkReasonBlockingMode("refused", ""))
+	assert.True(t, checkReasonBlockingMode("custom_ip", "::1"))
+	assert.False(t, checkReasonBlockingMode("custom_ip", ""))
+	assert.False(t, checkReasonBlockingMode("unknown", ""))
+}
+
+func TestUpstreamBudget(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 10*time.Second, now)
+	assert.True(t, b.available(now))
+	b.take(now)
+	b.take(now)
+	assert.False(t, b.available(now))
+	// 1 token per 5 seconds
+	assert.False(t, b.available(now.Add(4*time.Second)))
+	assert.True(t, b.available(now.Add(5*time.Second)))
+	// not more than capacity
+	b.refill(now.Add(time.Hour))
+	assert.Equal(t, float64(2), b.tokens)
+
+	s := NewServer(nil, nil, nil)
+	s.conf.UpstreamBudget = 1
+	s.conf.UpstreamBudgetOverflow = budgetOverflowStale
+	s.conf.UpstreamBudgetBlockedServices = []string{"youtube"}
+	s.budget.configure(&s.conf.FilteringConfig)
+	s.stale.configure(&s.conf.FilteringConfig)
+	assert.True(t, s.budget.allow())
+	assert.Nil(t, s.BudgetBlockedServices())
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+	assert.True(t, s.budget.reserve())
+	assert.False(t, s.budget.reserve())
+	s.stale.set(nil, req, resp, time.Now())
+	assert.False(t, s.budget.allow())
+	assert.Equal(t, []string{"youtube"}, s.BudgetBlockedServices())
+
+	// stale response
+	req2 := &dns.Msg{}
+	req2.SetQuestion("Example.org.", dns.TypeA)
+	ctx := &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req2}}
+	assert.Equal(t, resultDone, processBudgetExceeded(ctx, true))
+	assert.Equal(t, req2.Id, ctx.proxyCtx.Res.Id)
+	assert.Equal(t, "1.2.3.4", ctx.proxyCtx.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(staleTTL), ctx.proxyCtx.Res.Answer[0].Header().Ttl)
+	assert.True(t, ctx.responseFromUpstream) // the stale response is filtered
+
+	// the stale responses aren't used for the responses specific to the client
+	ctx = &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req2}}
+	processBudgetExceeded(ctx, false)
+	assert.Equal(t, dns.RcodeServerFailure, ctx.proxyCtx.Res.Rcode)
+
+	// no stale response
+	req2 = &dns.Msg{}
+	req2.SetQuestion("example.com.", dns.TypeA)
+	ctx = &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req2}}
+	processBudgetExceeded(ctx, true)
+	assert.Equal(t, dns.RcodeServerFailure, ctx.proxyCtx.Res.Rcode)
+	assert.Equal(t, uint64(3), s.budget.exceeded)
+
+	// unlimited
+	s.conf.UpstreamBudget = 0
+	s.budget.configure(&s.conf.FilteringConfig)
+	assert.True(t, s.budget.allow())
+
+	// the concurrent requests don't overspend the budget
+	s.conf.UpstreamBudget = 10
+	s.budget.configure(&s.conf.FilteringConfig)
+	var reserved uint32
+	wg := sync.WaitGroup{}
+	for i := 0; i != 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.budget.reserve() {
+				atomic.AddUint32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint32(10), reserved)
+}
+
+// budgetTestUpstream counts the requests and responds with a cacheable answer
+type budgetTestUpstream struct {
+	requests uint32
+}
+
+func (u *budgetTestUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.requests, 1)
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.IP{1, 2, 3, 4},
+	})
+	return resp, nil
+}
+
+func (u *budgetTestUpstream) Address() string {
+	return "budget"
+}
+
+func TestUpstreamBudgetCache(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.ProtectionEnabled = false
+	s.conf.UpstreamBudget = 1
+	u := &budgetTestUpstream{}
+	s.Lock()
+	err := s.Prepare(nil)
+	assert.Nil(t, err)
+	s.dnsProxy.Upstreams = s.budget.wrap([]upstream.Upstream{u})
+	err = s.dnsProxy.Start()
+	s.Unlock()
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	reply, err := dns.Exchange(createTestMessage("budget.example.org."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.False(t, s.budget.allow())
+
+	// the cached response is served when the budget is exceeded
+	reply, err = dns.Exchange(createTestMessage("budget.example.org."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 1, len(reply.Answer))
+
+	// the response isn't in cache
+	reply, err = dns.Exchange(createTestMessage("budget2.example.org."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.requests))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&s.budget.exceeded))
+}
+
 func TestBlockedByHosts(t *testing.T) {
 	s := createTestServer(t)
 	err := s.Start()
@@ -792,6 +1046,35 @@ func TestIsBlockedIPDisallowed(t *testing.T) {
 	assert.True(t, !a.IsBlockedIP("2.3.1.1"))
 }
 
+func TestIsBlockedIPGeoIP(t *testing.T) {
+	db, err := parseGeoIPDB(strings.NewReader("1.1.1.0\t1.1.1.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"2.2.0.0\t2.2.255.255\t3215\tFR\tOrange\n"))
+	assert.Nil(t, err)
+
+	a := &accessCtx{geoip: db}
+	assert.Nil(t, a.Init([]string{"country:fr", "asn:AS13335"}, nil, nil))
+	assert.False(t, a.IsBlockedIP("1.1.1.1"))
+	assert.False(t, a.IsBlockedIP("2.2.1.1"))
+	assert.True(t, a.IsBlockedIP("3.3.3.3"))
+
+	a = &accessCtx{geoip: db}
+	assert.Nil(t, a.Init(nil, []string{"country:US", "3.3.3.3"}, nil))
+	assert.True(t, a.IsBlockedIP("1.1.1.1"))
+	assert.False(t, a.IsBlockedIP("2.2.1.1"))
+	assert.True(t, a.IsBlockedIP("3.3.3.3"))
+	assert.False(t, a.IsBlockedIP("4.4.4.4"))
+
+	// the database isn't loaded
+	a = &accessCtx{}
+	assert.Nil(t, a.Init(nil, []string{"country:US"}, nil))
+	assert.False(t, a.IsBlockedIP("1.1.1.1"))
+
+	assert.NotNil(t, a.Init([]string{"country:USA"}, nil, nil))
+	assert.NotNil(t, a.Init([]string{"asn:x"}, nil, nil))
+	assert.NotNil(t, checkIPCIDRArray([]string{"asn:0"}))
+	assert.Nil(t, checkIPCIDRArray([]string{"asn:3320", "country:DE", "1.2.3.0/24"}))
+}
+
 func TestIsBlockedIPBlockedDomain(t *testing.T) {
 	a := &accessCtx{}
 	assert.True(t, a.Init(nil, nil, []string{"host1", "host2"}) == nil)
@@ -801,6 +1084,74 @@ func TestIsBlockedIPBlockedDomain(t *testing.T) {
 	assert.True(t, !a.IsBlockedDomain("host3"))
 }
 
+func TestRebindingProtection(t *testing.T) {
+	s := NewServer(nil, nil, nil)
+	s.conf.RebindingAllowedHosts = []string{"plex.direct", "*.example.net"}
+
+	resp := func(ip string) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetQuestion("host.", dns.TypeA)
+		m.Answer = append(m.Answer, &dns.A{A: net.ParseIP(ip)})
+		return m
+	}
+
+	assert.Equal(t, "192.168.1.1", s.checkRebinding("example.org", resp("192.168.1.1")).String())
+	assert.Equal(t, "127.0.0.1", s.checkRebinding("example.org", resp("127.0.0.1")).String())
+	assert.Nil(t, s.checkRebinding("example.org", resp("1.2.3.4")))
+	assert.Nil(t, s.checkRebinding("example.org", resp("0.0.0.0")))
+
+	// local domains
+	assert.Nil(t, s.checkRebinding("router", resp("192.168.1.1")))
+	assert.Nil(t, s.checkRebinding("nas.lan", resp("192.168.1.1")))
+	assert.Nil(t, s.checkRebinding("192.168.1.1", resp("192.168.1.1")))
+
+	// allowed hosts
+	assert.Nil(t, s.checkRebinding("a.plex.direct", resp("10.0.0.1")))
+	assert.Nil(t, s.checkRebinding("a.example.net", resp("10.0.0.1")))
+	assert.NotNil(t, s.checkRebinding("example.net", resp("10.0.0.1")))
+
+	m := &dns.Msg{}
+	m.Answer = append(m.Answer, &dns.AAAA{AAAA: net.ParseIP("fe80::1")})
+	assert.NotNil(t, s.checkRebinding("example.org", m))
+}
+
+func TestRebindingProtectionAction(t *testing.T) {
+	s := NewServer(nil, nil, nil)
+	s.conf.RebindingProtectionEnabled = true
+
+	process := func() *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", dns.TypeA)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA}, A: net.ParseIP("1.2.3.4")},
+			&dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA}, A: net.ParseIP("192.168.1.1")},
+		}
+		ctx := &dnsContext{
+			srv:                  s,
+			proxyCtx:             &proxy.DNSContext{Req: req, Res: resp},
+			result:               &dnsfilter.Result{},
+			responseFromUpstream: true,
+		}
+		assert.Equal(t, resultDone, processRebindingProtection(ctx))
+		assert.Equal(t, dnsfilter.FilteredRebind, ctx.result.Reason)
+		assert.Equal(t, 2, len(ctx.origResp.Answer))
+		return ctx.proxyCtx.Res
+	}
+
+	s.conf.RebindingProtectionAction = rebindingActionStrip
+	resp := process()
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+
+	s.conf.RebindingProtectionAction = rebindingActionRefuse
+	resp = process()
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	assert.NotNil(t, checkRebindingAction("drop"))
+}
+
 func TestValidateUpstream(t *testing.T) {
 	invalidUpstreams := []string{"1.2.3.4.5",
 		"123.3.7m",
@@ -900,3 +1251,127 @@ func TestMatchDNSName(t *testing.T) {
 	assert.True(t, !matchDNSName(dnsNames, ""))
 	assert.True(t, !matchDNSName(dnsNames, "*.host2"))
 }
+
+func TestECSPolicies(t *testing.T) {
+	_, err := parseECSPolicies([]string{"unknown"})
+	assert.NotNil(t, err)
+	_, err = parseECSPolicies([]string{"strip:1.2.3.0/24"})
+	assert.NotNil(t, err)
+	_, err = parseECSPolicies([]string{"[//]strip"})
+	assert.NotNil(t, err)
+
+	policies, err := parseECSPolicies([]string{
+		"strip",
+		"[/example.org/]synthesize",
+		"[/cdn.example.org/example.net/]synthesize:203.0.113.0/24",
+		"[/forward.example.org/]forward",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ecsModeStrip, matchECSPolicy(policies, "example.com").mode)
+	assert.Equal(t, ecsModeSynthesize, matchECSPolicy(policies, "www.example.org").mode)
+	assert.Nil(t, matchECSPolicy(policies, "www.example.org").subnet)
+	assert.Equal(t, "203.0.113.0/24", matchECSPolicy(policies, "a.cdn.example.org").subnet.String())
+	assert.Equal(t, ecsModeForward, matchECSPolicy(policies, "forward.example.org").mode)
+
+	s := &Server{ecsPolicies: policies}
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	ctx := &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req}, clientIP: "192.168.10.20"}
+	assert.True(t, s.applyECSPolicy(ctx))
+	assert.Equal(t, "192.168.10.0/24", ecsSubnet(req).String())
+
+	// the option from client is kept
+	assert.False(t, s.applyECSPolicy(ctx))
+
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.False(t, s.applyECSPolicy(ctx))
+	assert.Nil(t, ecsSubnet(req))
+}
+
+func TestMetrics(t *testing.T) {
+	s := &Server{}
+	s.metrics.countQuery(&dnsfilter.Result{Reason: dnsfilter.NotFilteredNotFound})
+	s.metrics.countQuery(&dnsfilter.Result{Reason: dnsfilter.FilteredBlackList, Rule: "||example.org^", FilterID: 1})
+	s.metrics.countQuery(&dnsfilter.Result{Reason: dnsfilter.FilteredBlackList, Rule: "||example.com^", FilterID: 1})
+	s.metrics.observeUpstream("8.8.8.8:53", 20*time.Millisecond)
+	s.metrics.observeUpstream("8.8.8.8:53", 3*time.Second)
+
+	buf := &bytes.Buffer{}
+	s.WriteMetrics(buf)
+	out := buf.String()
+	assert.True(t, strings.Contains(out, "adguard_dns_queries_total 3\n"))
+	assert.True(t, strings.Contains(out, "adguard_dns_queries_by_reason_total{reason=\"FilteredBlackList\"} 2\n"))
+	assert.True(t, strings.Contains(out, "adguard_dns_queries_by_reason_total{reason=\"NotFilteredNotFound\"} 1\n"))
+	assert.True(t, strings.Contains(out, "adguard_filter_matches_total{filter_id=\"1\"} 2\n"))
+	assert.True(t, strings.Contains(out, "adguard_upstream_latency_seconds_bucket{upstream=\"8.8.8.8:53\",le=\"0.01\"} 0\n"))
+	assert.True(t, strings.Contains(out, "adguard_upstream_latency_seconds_bucket{upstream=\"8.8.8.8:53\",le=\"0.025\"} 1\n"))
+	assert.True(t, strings.Contains(out, "adguard_upstream_latency_seconds_bucket{upstream=\"8.8.8.8:53\",le=\"2.5\"} 1\n"))
+	assert.True(t, strings.Contains(out, "adguard_upstream_latency_seconds_bucket{upstream=\"8.8.8.8:53\",le=\"+Inf\"} 2\n"))
+	assert.True(t, strings.Contains(out, "adguard_upstream_latency_seconds_count{upstream=\"8.8.8.8:53\"} 2\n"))
+}
+
+func TestTracing(t *testing.T) {
+	var reqs []otlpRequest
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := otlpRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		assert.Nil(t, err)
+		lock.Lock()
+		reqs = append(reqs, req)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	tr := newTracer(srv.URL)
+	root := tr.startSpan("dns.query", spanKindServer, nil, time.Now())
+	root.setAttr("dns.qname", "example.org")
+	sp := root.child("upstream.exchange", spanKindClient, time.Now())
+	sp.setError(errors.New("timeout"))
+	sp.finish()
+	root.finish()
+	tr.close()
+
+	assert.Equal(t, 1, len(reqs))
+	spans := reqs[0].ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "upstream.exchange", spans[0].Name)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, 2, spans[0].Status.Code)
+	assert.Equal(t, "", spans[1].ParentSpanID)
+	assert.Equal(t, "dns.qname", spans[1].Attributes[0].Key)
+	assert.Equal(t, "example.org", *spans[1].Attributes[0].Value.StringValue)
+
+	// nil tracer
+	tr = nil
+	root = tr.startSpan("dns.query", spanKindServer, nil, time.Now())
+	assert.Nil(t, root)
+	root.child("upstream.exchange", spanKindClient, time.Now()).finish()
+	root.finish()
+}
+
+func TestFilteringDeadline(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.FilteringTimeout = 100
+
+	req := createTestMessage("example.org.")
+	d := &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+	ctx := &dnsContext{
+		srv:       s,
+		proxyCtx:  d,
+		result:    &dnsfilter.Result{},
+		startTime: time.Now().Add(-time.Second), // the deadline is already exceeded
+	}
+	assert.Equal(t, resultError, processFilteringBeforeRequest(ctx))
+	assert.NotNil(t, ctx.err)
+	assert.NotNil(t, d.Res)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+
+	// the request is blocked before the deadline is checked
+	req = createTestMessage("nxdomain.example.org.")
+	d = &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}}
+	ctx = &dnsContext{srv: s, proxyCtx: d, result: &dnsfilter.Result{}, startTime: time.Now().Add(-time.Second)}
+	assert.Equal(t, resultDone, processFilteringBeforeRequest(ctx))
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+}
@@ -0,0 +1,649 @@
+// Local DNSSEC validation: the chain of trust (DS -> DNSKEY -> RRSIG) is checked from the root zone
+
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation modes
+const (
+	dnssecModeOff        = "off"        // don't validate (per-client setting only)
+	dnssecModePermissive = "permissive" // validate and write the result to the query log
+	dnssecModeEnforce    = "enforce"    // respond with SERVFAIL when the response is bogus
+)
+
+// DNSSEC validation results
+const (
+	dnssecSecure   = "secure"   // the chain of trust is verified
+	dnssecInsecure = "insecure" // the domain isn't signed (there's a proof that there's no DS record)
+	dnssecBogus    = "bogus"    // the signatures are missing or invalid
+)
+
+const (
+	dnssecMinTTL    = time.Minute // validated keys and delegations are cached for their TTL within these limits
+	dnssecMaxTTL    = time.Hour
+	dnssecCacheSize = 10000 // max number of cached entries;  expired entries are removed when it's exceeded
+)
+
+// The root zone trust anchors (KSK-2017 and KSK-2024)
+var defaultDNSSECTrustAnchors = []string{
+	". 86400 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 86400 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// dnssecKeys is a validated DNSKEY RRset of a zone
+type dnssecKeys struct {
+	result string // dnssecSecure, dnssecInsecure
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// dnssecDelegation is the result of DS lookup
+type dnssecDelegation struct {
+	result string // dnssecSecure, dnssecInsecure
+	cut    bool   // the name is a secure zone cut (ds is set)
+	ds     []*dns.DS
+	expire time.Time
+}
+
+// dnssecValidator checks DNSSEC signatures of the responses
+type dnssecValidator struct {
+	lock        sync.Mutex
+	mode        string // the default mode.  "": validation is disabled
+	anchors     []*dns.DS
+	keys        map[string]*dnssecKeys       // zone -> keys
+	delegations map[string]*dnssecDelegation // name -> DS lookup result
+
+	// send the request upstream
+	exchange func(req *dns.Msg) (*dns.Msg, error)
+}
+
+// Check DNSSEC validation mode
+func checkDNSSECMode(mode string, perClient bool) error {
+	switch mode {
+	case "", dnssecModePermissive, dnssecModeEnforce:
+		return nil
+	case dnssecModeOff:
+		if perClient {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid DNSSEC validation mode: %s", mode)
+}
+
+// ValidateClientDNSSECMode checks per-client DNSSEC validation mode:
+// "" (global setting), "off", "permissive" or "enforce"
+func ValidateClientDNSSECMode(mode string) error {
+	return checkDNSSECMode(mode, true)
+}
+
+// Parse trust anchors (DS records)
+func parseDNSSECTrustAnchors(list []string) ([]*dns.DS, error) {
+	var anchors []*dns.DS
+	for _, s := range list {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor: %s: %s", s, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok || ds.Hdr.Name != "." {
+			return nil, fmt.Errorf("invalid trust anchor: %s: DS record for the root zone is expected", s)
+		}
+		anchors = append(anchors, ds)
+	}
+	return anchors, nil
+}
+
+func (v *dnssecValidator) configure(conf *FilteringConfig) error {
+	err := checkDNSSECMode(conf.DNSSECValidation, false)
+	if err != nil {
+		return err
+	}
+	list := conf.DNSSECTrustAnchors
+	if len(list) == 0 {
+		list = defaultDNSSECTrustAnchors
+	}
+	anchors, err := parseDNSSECTrustAnchors(list)
+	if err != nil {
+		return err
+	}
+
+	v.lock.Lock()
+	v.mode = conf.DNSSECValidation
+	v.anchors = anchors
+	v.keys = map[string]*dnssecKeys{}
+	v.delegations = map[string]*dnssecDelegation{}
+	v.lock.Unlock()
+	return nil
+}
+
+func (v *dnssecValidator) setMode(mode string) {
+	v.lock.Lock()
+	v.mode = mode
+	v.lock.Unlock()
+}
+
+// Get the validation mode for a client
+func (v *dnssecValidator) getMode(clientMode string) string {
+	if clientMode == dnssecModeOff {
+		return ""
+	} else if len(clientMode) != 0 {
+		return clientMode
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.mode
+}
+
+// Send a request with DO and CD bits set
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, true)
+	req.CheckingDisabled = true
+	resp, err := v.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: got %s response", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// Group the records by name and type.  RRSIG records are grouped by the type they cover.
+func splitRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	sets := map[rrsetKey][]dns.RR{}
+	sigs := map[rrsetKey][]*dns.RRSIG{}
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name, sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey{name, rr.Header().Rrtype}
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+// Get the minimum TTL of the records within the limits
+func dnssecTTL(rrs []dns.RR) time.Duration {
+	ttl := dnssecMaxTTL
+	for _, rr := range rrs {
+		t := time.Duration(rr.Header().Ttl) * time.Second
+		if t < ttl {
+			ttl = t
+		}
+	}
+	if ttl < dnssecMinTTL {
+		ttl = dnssecMinTTL
+	}
+	return ttl
+}
+
+// Check that the RRset is signed by one of the keys
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("no signatures")
+	}
+	err := fmt.Errorf("no matching keys")
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			err = fmt.Errorf("signature has expired")
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm ||
+				!strings.EqualFold(k.Hdr.Name, sig.SignerName) {
+				continue
+			}
+			err = sig.Verify(k, rrset)
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// Get the signer of the RRset
+func rrsetSigner(sigs []*dns.RRSIG) string {
+	if len(sigs) == 0 {
+		return ""
+	}
+	return strings.ToLower(sigs[0].SignerName)
+}
+
+func (v *dnssecValidator) getKeys(zone string, now time.Time) *dnssecKeys {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	k, ok := v.keys[zone]
+	if !ok || !now.Before(k.expire) {
+		return nil
+	}
+	return k
+}
+
+func (v *dnssecValidator) getDelegation(name string, now time.Time) *dnssecDelegation {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	d, ok := v.delegations[name]
+	if !ok || !now.Before(d.expire) {
+		return nil
+	}
+	return d
+}
+
+// Store the entries in cache;  remove the expired entries if the cache is full
+func (v *dnssecValidator) store(zone string, k *dnssecKeys, name string, d *dnssecDelegation, now time.Time) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.keys)+len(v.delegations) >= dnssecCacheSize {
+		for key, e := range v.keys {
+			if !now.Before(e.expire) {
+				delete(v.keys, key)
+			}
+		}
+		for key, e := range v.delegations {
+			if !now.Before(e.expire) {
+				delete(v.delegations, key)
+			}
+		}
+		if len(v.keys)+len(v.delegations) >= dnssecCacheSize {
+			return
+		}
+	}
+	if k != nil {
+		v.keys[zone] = k
+	}
+	if d != nil {
+		v.delegations[name] = d
+	}
+}
+
+// Get the validated keys of the zone.
+// The DNSKEY RRset must be signed by a key which matches a DS record from the parent zone
+// (or a trust anchor for the root zone).
+func (v *dnssecValidator) zoneKeys(zone string, now time.Time) (*dnssecKeys, error) {
+	k := v.getKeys(zone, now)
+	if k != nil {
+		return k, nil
+	}
+
+	var ds []*dns.DS
+	if zone == "." {
+		v.lock.Lock()
+		ds = v.anchors
+		v.lock.Unlock()
+	} else {
+		d, err := v.delegation(zone, now)
+		if err != nil {
+			return nil, err
+		}
+		if d.result == dnssecInsecure {
+			return &dnssecKeys{result: dnssecInsecure}, nil
+		}
+		if !d.cut {
+			return nil, fmt.Errorf("%s: signer isn't a zone cut", zone)
+		}
+		ds = d.ds
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	sets, sigs := splitRRsets(resp.Answer)
+	key := rrsetKey{zone, dns.TypeDNSKEY}
+	set := sets[key]
+
+	var all, trusted []*dns.DNSKEY
+	for _, rr := range set {
+		dk := rr.(*dns.DNSKEY)
+		all = append(all, dk)
+		for _, d := range ds {
+			if dk.KeyTag() != d.KeyTag || dk.Algorithm != d.Algorithm {
+				continue
+			}
+			kds := dk.ToDS(d.DigestType)
+			if kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+				trusted = append(trusted, dk)
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("%s: no DNSKEY matching DS", zone)
+	}
+	err = verifyRRset(set, sigs[key], trusted, now)
+	if err != nil {
+		return nil, fmt.Errorf("%s DNSKEY: %s", zone, err)
+	}
+
+	k = &dnssecKeys{
+		result: dnssecSecure,
+		keys:   all,
+		expire: now.Add(dnssecTTL(set)),
+	}
+	v.store(zone, k, "", nil, now)
+	return k, nil
+}
+
+// Verify the RRset signed by the zone.
+// Return dnssecInsecure if the zone isn't signed.
+func (v *dnssecValidator) verifySigned(rrset []dns.RR, sigs []*dns.RRSIG, now time.Time) (string, error) {
+	signer := rrsetSigner(sigs)
+	owner := rrset[0].Header().Name
+	if len(signer) == 0 || !dns.IsSubDomain(signer, owner) {
+		return "", fmt.Errorf("%s: invalid signer", owner)
+	}
+	k, err := v.zoneKeys(signer, now)
+	if err != nil {
+		return "", err
+	}
+	if k.result == dnssecInsecure {
+		return dnssecInsecure, nil
+	}
+	err = verifyRRset(rrset, sigs, k.keys, now)
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %s", owner, dns.TypeToString[rrset[0].Header().Rrtype], err)
+	}
+	return dnssecSecure, nil
+}
+
+// Look up DS records for the name.
+// The DS RRset or the proof of its absence must be signed by the parent zone.
+func (v *dnssecValidator) delegation(name string, now time.Time) (*dnssecDelegation, error) {
+	d := v.getDelegation(name, now)
+	if d != nil {
+		return d, nil
+	}
+
+	resp, err := v.query(name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	sets, sigs := splitRRsets(resp.Answer)
+	key := rrsetKey{name, dns.TypeDS}
+	if set := sets[key]; len(set) != 0 {
+		signer := rrsetSigner(sigs[key])
+		if signer == name {
+			return nil, fmt.Errorf("%s DS: signed by the zone itself", name)
+		}
+		result, err := v.verifySigned(set, sigs[key], now)
+		if err != nil {
+			return nil, err
+		}
+		d = &dnssecDelegation{result: result, expire: now.Add(dnssecTTL(set))}
+		if result == dnssecSecure {
+			d.cut = true
+			for _, rr := range set {
+				d.ds = append(d.ds, rr.(*dns.DS))
+			}
+		}
+		v.store("", nil, name, d, now)
+		return d, nil
+	}
+
+	d, err = v.denial(name, resp, now)
+	if err != nil {
+		return nil, err
+	}
+	v.store("", nil, name, d, now)
+	return d, nil
+}
+
+// Check the proof that there's no DS record for the name.
+// The delegation is insecure if NSEC/NSEC3 record for the name has NS bit without SOA and DS bits,
+// or if the name is covered by opt-out NSEC3 record.
+func (v *dnssecValidator) denial(name string, resp *dns.Msg, now time.Time) (*dnssecDelegation, error) {
+	sets, sigs := splitRRsets(resp.Ns)
+	d := &dnssecDelegation{result: dnssecSecure, expire: now.Add(dnssecMaxTTL)}
+	verified := false
+	insecure := false
+	for key, set := range sets {
+		if key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 && key.rtype != dns.TypeSOA {
+			continue
+		}
+		result, err := v.verifySigned(set, sigs[key], now)
+		if err != nil {
+			return nil, err
+		}
+		if result == dnssecInsecure {
+			d.result = dnssecInsecure
+		}
+		if ttl := now.Add(dnssecTTL(set)); ttl.Before(d.expire) {
+			d.expire = ttl
+		}
+		if key.rtype == dns.TypeSOA {
+			continue
+		}
+		verified = true
+
+		for _, rr := range set {
+			var bitmap []uint16
+			switch n := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(n.Hdr.Name, name) {
+					bitmap = n.TypeBitMap
+				}
+			case *dns.NSEC3:
+				if n.Match(name) {
+					bitmap = n.TypeBitMap
+				} else if n.Flags&1 != 0 && n.Cover(name) {
+					insecure = true // opt-out
+				}
+			}
+			if len(bitmap) != 0 && hasType(bitmap, dns.TypeNS) &&
+				!hasType(bitmap, dns.TypeSOA) && !hasType(bitmap, dns.TypeDS) {
+				insecure = true
+			}
+		}
+	}
+
+	if d.result == dnssecInsecure {
+		return d, nil
+	}
+	if !verified {
+		return nil, fmt.Errorf("%s DS: no signed denial of existence", name)
+	}
+	if insecure {
+		d.result = dnssecInsecure
+	}
+	return d, nil
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the name belongs to a signed zone:
+// look up DS records from the top-level domain down to the name.
+func (v *dnssecValidator) chain(name string, now time.Time) (string, error) {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		d, err := v.delegation(dns.Fqdn(strings.Join(labels[i:], ".")), now)
+		if err != nil {
+			return "", err
+		}
+		if d.result == dnssecInsecure {
+			return dnssecInsecure, nil
+		}
+	}
+	return dnssecSecure, nil
+}
+
+// Verify the signed RRsets.
+// The unsigned RRsets are allowed only in the insecure zones.
+func (v *dnssecValidator) verifySets(sets map[rrsetKey][]dns.RR, sigs map[rrsetKey][]*dns.RRSIG, now time.Time) (string, bool, error) {
+	result := dnssecSecure
+	signed := false
+	for key, set := range sets {
+		if key.rtype == dns.TypeOPT {
+			continue
+		}
+		var r string
+		var err error
+		if len(sigs[key]) != 0 {
+			signed = true
+			r, err = v.verifySigned(set, sigs[key], now)
+		} else {
+			r, err = v.chain(key.name, now)
+			if err == nil && r == dnssecSecure {
+				err = fmt.Errorf("%s %s: no signatures in the signed zone", key.name, dns.TypeToString[key.rtype])
+			}
+		}
+		if err != nil {
+			return "", signed, err
+		}
+		if r == dnssecInsecure {
+			result = dnssecInsecure
+		}
+	}
+	return result, signed, nil
+}
+
+// Validate the response.
+// Return "" if the response can't be validated (e.g. SERVFAIL).
+func (v *dnssecValidator) validate(req, resp *dns.Msg, now time.Time) string {
+	if len(req.Question) != 1 ||
+		!(resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError) {
+		return ""
+	}
+	name := req.Question[0].Name
+
+	var result string
+	var err error
+	if len(resp.Answer) != 0 {
+		sets, sigs := splitRRsets(resp.Answer)
+		for key := range sets {
+			if key.rtype == dns.TypeDNAME {
+				// CNAME records synthesized from DNAME aren't signed
+				for k := range sets {
+					if k.rtype == dns.TypeCNAME && len(sigs[k]) == 0 {
+						delete(sets, k)
+					}
+				}
+				break
+			}
+		}
+		result, _, err = v.verifySets(sets, sigs, now)
+
+	} else {
+		sets, sigs := splitRRsets(resp.Ns)
+		for key := range sets {
+			if key.rtype != dns.TypeSOA && key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 {
+				delete(sets, key)
+			}
+		}
+		var signed bool
+		result, signed, err = v.verifySets(sets, sigs, now)
+		if err == nil && !signed {
+			// there's no SOA record or it isn't signed
+			result, err = v.chain(name, now)
+			if err == nil && result == dnssecSecure {
+				err = fmt.Errorf("%s: no signed denial of existence in the signed zone", name)
+			}
+		}
+	}
+
+	if err != nil {
+		log.Debug("DNSSEC: %s: bogus: %s", name, err)
+		return dnssecBogus
+	}
+	return result
+}
+
+// Set DO bit in the request.
+// Return TRUE if OPT record is added.
+func setDO(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if opt != nil {
+		opt.SetDo()
+		return false
+	}
+	req.SetEdns0(4096, true)
+	return true
+}
+
+// Remove DO bit (or OPT record) from the message
+func clearDO(m *dns.Msg, optAdded bool) {
+	if optAdded {
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+		return
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+}
+
+// Remove DNSSEC records which the client didn't ask for
+func stripDNSSEC(m *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		r := rrs[:0]
+		for _, rr := range rrs {
+			t := rr.Header().Rrtype
+			if t != qtype && (t == dns.TypeRRSIG || t == dns.TypeNSEC || t == dns.TypeNSEC3) {
+				continue
+			}
+			r = append(r, rr)
+		}
+		return r
+	}
+	m.Answer = strip(m.Answer)
+	m.Ns = strip(m.Ns)
+	m.Extra = strip(m.Extra)
+}
+
+// Validate the response from upstream;  respond with SERVFAIL if it's bogus and the mode is "enforce".
+// doAdded: the client hasn't set DO bit, so DNSSEC records are removed from the response.
+// optAdded: the client hasn't sent OPT record.
+func (s *Server) dnssecValidate(ctx *dnsContext, mode string, doAdded, optAdded bool) {
+	d := ctx.proxyCtx
+	if doAdded {
+		clearDO(d.Req, optAdded)
+	}
+	if d.Res == nil {
+		return
+	}
+
+	ctx.dnssecResult = s.dnssec.validate(d.Req, d.Res, time.Now())
+	if ctx.dnssecResult == dnssecBogus && mode == dnssecModeEnforce {
+		log.Debug("DNSSEC: %s: responding with SERVFAIL", d.Req.Question[0].Name)
+		ctx.origResp = d.Res
+		d.Res = s.genServerFailure(d.Req)
+		return
+	}
+
+	if doAdded {
+		stripDNSSEC(d.Res, d.Req.Question[0].Qtype)
+		clearDO(d.Res, optAdded)
+	}
+	// AD bit is set only if the client understands it (RFC 6840)
+	d.Res.AuthenticatedData = ctx.dnssecResult == dnssecSecure && (!doAdded || d.Req.AuthenticatedData)
+}
@@ -0,0 +1,170 @@
+package dnsforward
+
+import (
+	"crypto"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type dnssecTestZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newDNSSECTestZone(t *testing.T, name string) *dnssecTestZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	assert.Nil(t, err)
+	return &dnssecTestZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *dnssecTestZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  z.key.Algorithm,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+	}
+	assert.Nil(t, sig.Sign(z.priv, rrset))
+	return append(rrset, sig)
+}
+
+func dnssecTestA(name, ip string) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.ParseIP(ip),
+	}
+}
+
+func dnssecTestNSEC(name, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// Create a validator for the tree: "." -> "example." (signed), "insecure." (not signed)
+func newDNSSECTestValidator(t *testing.T) (*dnssecValidator, *dnssecTestZone) {
+	root := newDNSSECTestZone(t, ".")
+	example := newDNSSECTestZone(t, "example.")
+
+	answers := map[string][]dns.RR{
+		". DNSKEY":        root.sign(t, root.key),
+		"example. DNSKEY": example.sign(t, example.key),
+		"example. DS":     root.sign(t, example.key.ToDS(dns.SHA256)),
+	}
+	denials := map[string][]dns.RR{
+		"insecure. DS":     root.sign(t, dnssecTestNSEC("insecure.", "z.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)),
+		"www.example. DS":  example.sign(t, dnssecTestNSEC("www.example.", "z.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+		"www.insecure. DS": nil,
+	}
+
+	v := &dnssecValidator{}
+	assert.Nil(t, v.configure(&FilteringConfig{
+		DNSSECValidation:   dnssecModeEnforce,
+		DNSSECTrustAnchors: []string{root.key.ToDS(dns.SHA256).String()},
+	}))
+	v.exchange = func(req *dns.Msg) (*dns.Msg, error) {
+		q := req.Question[0]
+		key := fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype])
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		if a, ok := answers[key]; ok {
+			resp.Answer = a
+		} else if ns, ok := denials[key]; ok {
+			resp.Ns = ns
+		} else {
+			return nil, fmt.Errorf("unexpected request: %s", key)
+		}
+		return resp, nil
+	}
+	return v, example
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	v, example := newDNSSECTestValidator(t)
+	now := time.Now()
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.", dns.TypeA)
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = example.sign(t, dnssecTestA("www.example.", "1.2.3.4"))
+	assert.Equal(t, dnssecSecure, v.validate(req, resp, now))
+
+	// modified data
+	resp.Answer[0].(*dns.A).A = net.ParseIP("1.2.3.5")
+	assert.Equal(t, dnssecBogus, v.validate(req, resp, now))
+
+	// signatures are stripped
+	resp.Answer = resp.Answer[:1]
+	assert.Equal(t, dnssecBogus, v.validate(req, resp, now))
+
+	// the zone isn't signed
+	req.SetQuestion("www.insecure.", dns.TypeA)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{dnssecTestA("www.insecure.", "1.2.3.4")}
+	assert.Equal(t, dnssecInsecure, v.validate(req, resp, now))
+
+	// SERVFAIL isn't validated
+	resp.Rcode = dns.RcodeServerFailure
+	assert.Equal(t, "", v.validate(req, resp, now))
+
+	// the validated keys are cached
+	assert.NotNil(t, v.getKeys("example.", now))
+	assert.Nil(t, v.getKeys("example.", now.Add(2*time.Hour)))
+}
+
+func TestDNSSECMode(t *testing.T) {
+	v := &dnssecValidator{}
+	assert.Nil(t, v.configure(&FilteringConfig{DNSSECValidation: dnssecModePermissive}))
+	assert.Equal(t, 2, len(v.anchors))
+	assert.Equal(t, dnssecModePermissive, v.getMode(""))
+	assert.Equal(t, dnssecModeEnforce, v.getMode(dnssecModeEnforce))
+	assert.Equal(t, "", v.getMode(dnssecModeOff))
+
+	assert.NotNil(t, v.configure(&FilteringConfig{DNSSECValidation: dnssecModeOff}))
+	assert.Nil(t, ValidateClientDNSSECMode(dnssecModeOff))
+	assert.NotNil(t, ValidateClientDNSSECMode("strict"))
+	assert.NotNil(t, v.configure(&FilteringConfig{DNSSECTrustAnchors: []string{"example. IN DS 1 8 2 00"}}))
+}
+
+func TestDNSSECStrip(t *testing.T) {
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	assert.True(t, setDO(req))
+	assert.True(t, req.IsEdns0().Do())
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		dnssecTestA("example.org.", "1.2.3.4"),
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET}},
+	}
+	resp.SetEdns0(4096, true)
+	stripDNSSEC(resp, dns.TypeA)
+	clearDO(resp, true)
+	clearDO(req, true)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Nil(t, resp.IsEdns0())
+	assert.Nil(t, req.IsEdns0())
+
+	req.SetEdns0(4096, false)
+	assert.False(t, setDO(req))
+	clearDO(req, false)
+	assert.False(t, req.IsEdns0().Do())
+}
@@ -0,0 +1,329 @@
+// Domain-specific upstreams: "[/domain/]upstream" entries and domain lists loaded from files
+
+package dnsforward
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+)
+
+// UpstreamDomainList is a file with domain-specific upstreams.
+// Each line is one of:
+// "[/domain1/domain2/]upstream";
+// "server=/domain1/domain2/upstream" (dnsmasq format, e.g. chinalist);
+// "domain" (the list's Upstream is used).
+// "*.domain" matches only subdomains;  "domain" matches the domain and its subdomains.
+// "#" instead of upstream means the default upstreams.
+type UpstreamDomainList struct {
+	Path     string `yaml:"path" json:"path"`
+	Upstream string `yaml:"upstream" json:"upstream"` // upstream for the lines that contain only a domain name
+}
+
+// domainTrie is a tree of domain labels (from the top-level domain)
+type domainTrie struct {
+	children map[string]*domainTrie
+
+	set       bool // upstreams for this domain and its subdomains are set
+	upstreams []upstream.Upstream
+
+	wildcardSet       bool // upstreams for subdomains only ("*.domain") are set
+	wildcardUpstreams []upstream.Upstream
+}
+
+// Add the upstreams for the domain.  Existing entries aren't replaced.
+func (t *domainTrie) add(domain string, upstreams []upstream.Upstream) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	wildcard := false
+	if strings.HasPrefix(domain, "*.") {
+		wildcard = true
+		domain = domain[2:]
+	}
+
+	node := t
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = map[string]*domainTrie{}
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainTrie{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	if wildcard {
+		if !node.wildcardSet {
+			node.wildcardSet = true
+			node.wildcardUpstreams = upstreams
+		}
+	} else if !node.set {
+		node.set = true
+		node.upstreams = upstreams
+	}
+}
+
+// Find the upstreams for the most specific entry matching the host name.
+// Return FALSE if there's no such entry.
+// Empty list means that the default upstreams must be used.
+func (t *domainTrie) match(host string) ([]upstream.Upstream, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	labels := strings.Split(host, ".")
+
+	var r []upstream.Upstream
+	found := false
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			break
+		}
+		if i != 0 && node.wildcardSet {
+			r, found = node.wildcardUpstreams, true
+		} else if node.set {
+			r, found = node.upstreams, true
+		}
+	}
+	return r, found
+}
+
+// Parse a line from the domain list file.
+// Return the domains and the upstream address.
+func parseDomainListLine(line, defaultUpstream string) ([]string, string, error) {
+	var domains, u string
+	if strings.HasPrefix(line, "[/") {
+		i := strings.LastIndex(line, "/]")
+		if i < 0 {
+			return nil, "", fmt.Errorf("invalid line: %s", line)
+		}
+		domains = line[2:i]
+		u = strings.TrimSpace(line[i+2:])
+
+	} else if strings.HasPrefix(line, "server=/") {
+		i := strings.LastIndex(line, "/")
+		domains = line[len("server=/"):i]
+		u = line[i+1:]
+		// dnsmasq uses "IP#port"
+		u = strings.Replace(u, "#", ":", 1)
+		if len(u) == 0 {
+			u = "#"
+		}
+
+	} else {
+		domains = line
+		u = defaultUpstream
+	}
+
+	if len(u) == 0 {
+		return nil, "", fmt.Errorf("no upstream for %s", line)
+	}
+
+	var r []string
+	for _, d := range strings.Split(domains, "/") {
+		if len(d) == 0 {
+			continue
+		}
+		err := utils.IsValidHostname(strings.TrimPrefix(d, "*."))
+		if err != nil {
+			return nil, "", err
+		}
+		r = append(r, d)
+	}
+	if len(r) == 0 {
+		return nil, "", fmt.Errorf("no domains: %s", line)
+	}
+	return r, u, nil
+}
+
+// Load domain-specific upstreams from file.
+// newUpstream returns the upstream objects for the address.
+func loadDomainList(t *domainTrie, l UpstreamDomainList, newUpstream func(addr string) ([]upstream.Upstream, error)) (int, error) {
+	f, err := os.Open(l.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		domains, addr, err := parseDomainListLine(line, l.Upstream)
+		if err != nil {
+			log.Debug("DNS: %s: %s", l.Path, err)
+			continue
+		}
+		upstreams, err := newUpstream(addr)
+		if err != nil {
+			log.Debug("DNS: %s: %s", l.Path, err)
+			continue
+		}
+		for _, d := range domains {
+			t.add(d, upstreams)
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
+
+// Build the tree of domain-specific upstreams.
+// The entries from upstream_dns setting take precedence over the entries from the files.
+func (s *Server) prepareDomainUpstreams(reserved map[string][]upstream.Upstream) *domainTrie {
+	t := &domainTrie{}
+	for domain, list := range reserved {
+		t.add(domain, list)
+	}
+
+	objects := map[string][]upstream.Upstream{}
+	newUpstream := func(addr string) ([]upstream.Upstream, error) {
+		if addr == "#" {
+			return nil, nil
+		}
+		list, ok := objects[addr]
+		if ok {
+			return list, nil
+		}
+		u, err := upstream.AddressToUpstream(addr, upstream.Options{Bootstrap: s.conf.BootstrapDNS, Timeout: DefaultTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %s: %s", addr, err)
+		}
+		list = s.wrapUpstreams([]upstream.Upstream{u})
+		objects[addr] = list
+		return list, nil
+	}
+
+	for _, l := range s.conf.UpstreamDomainLists {
+		n, err := loadDomainList(t, l, newUpstream)
+		if err != nil {
+			log.Error("DNS: domain list %s: %s", l.Path, err)
+			continue
+		}
+		log.Debug("DNS: domain list %s: loaded %d entries", l.Path, n)
+	}
+	return t
+}
+
+// Find domain-specific upstreams for the host name.
+// Reverse zones from PTR forwarding settings take precedence.
+func (s *Server) matchDomainUpstreams(host string) ([]upstream.Upstream, bool) {
+	if s.ptrUpstreams != nil {
+		list, ok := s.ptrUpstreams.match(host)
+		if ok {
+			return list, true
+		}
+	}
+	if s.domainUpstreams == nil {
+		return nil, false
+	}
+	return s.domainUpstreams.match(host)
+}
+
+// Use domain-specific upstreams for the request
+func (s *Server) setDomainUpstreams(d *proxy.DNSContext) {
+	if len(d.Req.Question) != 1 {
+		return
+	}
+	list, ok := s.matchDomainUpstreams(d.Req.Question[0].Name)
+	if ok && len(list) != 0 {
+		d.Upstreams = list
+	}
+}
+
+type upstreamDomainsJSON struct {
+	Lists []UpstreamDomainList `json:"lists"`
+}
+
+func (s *Server) handleUpstreamDomainsList(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := upstreamDomainsJSON{
+		Lists: append([]UpstreamDomainList{}, s.conf.UpstreamDomainLists...),
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleUpstreamDomainsSet(w http.ResponseWriter, r *http.Request) {
+	j := upstreamDomainsJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	for _, l := range j.Lists {
+		_, err = os.Stat(l.Path)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		if len(l.Upstream) != 0 && l.Upstream != "#" {
+			_, err = validateUpstream(l.Upstream)
+			if err != nil {
+				httpError(r, w, http.StatusBadRequest, "%s: invalid upstream: %s", l.Path, err)
+				return
+			}
+		}
+	}
+
+	s.Lock()
+	s.conf.UpstreamDomainLists = j.Lists
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	err = s.Reconfigure(nil)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
+
+type upstreamDomainLookupJSON struct {
+	Found     bool     `json:"found"`
+	Upstreams []string `json:"upstreams"` // empty: the default upstreams
+}
+
+// Get the upstreams which are used for a domain
+func (s *Server) handleUpstreamDomainsLookup(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("domain")
+	if _, ok := dns.IsDomainName(host); !ok || len(host) == 0 {
+		httpError(r, w, http.StatusBadRequest, "domain: invalid value")
+		return
+	}
+
+	j := upstreamDomainLookupJSON{Upstreams: []string{}}
+	s.RLock()
+	var list []upstream.Upstream
+	list, j.Found = s.matchDomainUpstreams(host)
+	for _, u := range list {
+		j.Upstreams = append(j.Upstreams, u.Address())
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
@@ -0,0 +1,89 @@
+package dnsforward
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func matchAddr(t *domainTrie, host string) string {
+	list, ok := t.match(host)
+	if !ok {
+		return "none"
+	}
+	if len(list) == 0 {
+		return "#"
+	}
+	return list[0].Address()
+}
+
+func TestDomainTrie(t *testing.T) {
+	u1 := &strategyUpstream{addr: "1"}
+	u2 := &strategyUpstream{addr: "2"}
+	u3 := &strategyUpstream{addr: "3"}
+	tr := &domainTrie{}
+	tr.add("example.org.", []upstream.Upstream{u1})
+	tr.add("*.sub.example.org", []upstream.Upstream{u2})
+	tr.add("local.example.org", nil)
+	tr.add("Example.com", []upstream.Upstream{u3})
+	tr.add("example.com", []upstream.Upstream{u1}) // isn't replaced
+
+	assert.Equal(t, "1", matchAddr(tr, "example.org."))
+	assert.Equal(t, "1", matchAddr(tr, "www.example.org."))
+	assert.Equal(t, "1", matchAddr(tr, "sub.example.org."))
+	assert.Equal(t, "2", matchAddr(tr, "a.sub.example.org."))
+	assert.Equal(t, "2", matchAddr(tr, "a.b.sub.example.org."))
+	assert.Equal(t, "#", matchAddr(tr, "host.local.example.org."))
+	assert.Equal(t, "3", matchAddr(tr, "WWW.example.com."))
+	assert.Equal(t, "none", matchAddr(tr, "example.net."))
+	assert.Equal(t, "none", matchAddr(tr, "org."))
+}
+
+func TestDomainListFile(t *testing.T) {
+	domains, u, err := parseDomainListLine("server=/baidu.com/qq.com/114.114.114.114#5353", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"baidu.com", "qq.com"}, domains)
+	assert.Equal(t, "114.114.114.114:5353", u)
+
+	domains, u, err = parseDomainListLine("[/*.lan/]192.168.1.1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"*.lan"}, domains)
+	assert.Equal(t, "192.168.1.1", u)
+
+	_, _, err = parseDomainListLine("example.org", "")
+	assert.NotNil(t, err)
+	_, _, err = parseDomainListLine("[/exa mple.org/]1.1.1.1", "")
+	assert.NotNil(t, err)
+
+	f, _ := ioutil.TempFile("", "domains")
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`# comment
+server=/baidu.com/114.114.114.114
+[/*.corp.example/]10.0.0.1
+bad!domain
+example.cn
+server=/direct.example.cn/
+`)
+	_ = f.Close()
+
+	tr := &domainTrie{}
+	tr.add("baidu.com", []upstream.Upstream{&strategyUpstream{addr: "config"}})
+	n, err := loadDomainList(tr, UpstreamDomainList{Path: f.Name(), Upstream: "223.5.5.5"},
+		func(addr string) ([]upstream.Upstream, error) {
+			if addr == "#" {
+				return nil, nil
+			}
+			return []upstream.Upstream{&strategyUpstream{addr: addr}}, nil
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+
+	assert.Equal(t, "config", matchAddr(tr, "www.baidu.com."))
+	assert.Equal(t, "10.0.0.1", matchAddr(tr, "host.corp.example."))
+	assert.Equal(t, "none", matchAddr(tr, "corp.example."))
+	assert.Equal(t, "223.5.5.5", matchAddr(tr, "www.example.cn."))
+	assert.Equal(t, "#", matchAddr(tr, "direct.example.cn."))
+}
@@ -0,0 +1,218 @@
+// DNS-over-QUIC server (RFC 9250)
+
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	doqALPN        = "doq"  // ALPN token for DNS-over-QUIC
+	doqProto       = "quic" // protocol name in proxy.DNSContext
+	doqIdleTimeout = 30 * time.Second
+	doqReadTimeout = 5 * time.Second // time limit for reading a request from the stream
+)
+
+// quicSession is a QUIC connection
+type quicSession interface {
+	AcceptStream(ctx context.Context) (io.ReadWriteCloser, error)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// quicListener accepts QUIC connections
+type quicListener interface {
+	Accept(ctx context.Context) (quicSession, error)
+	Close() error
+}
+
+// listenQUIC creates QUIC listener.
+// It's set only if QUIC support is compiled in (built with "-tags quic").
+var listenQUIC func(addr *net.UDPAddr, conf *tls.Config, idleTimeout time.Duration) (quicListener, error)
+
+// CheckDoQ returns an error if DNS-over-QUIC support isn't compiled in
+func CheckDoQ() error {
+	if listenQUIC == nil {
+		return fmt.Errorf("DNS-over-QUIC support isn't compiled in (build with \"-tags quic\")")
+	}
+	return nil
+}
+
+// doqServer accepts DNS-over-QUIC connections and processes the requests
+type doqServer struct {
+	srv      *Server
+	proxy    *proxy.Proxy // DNS proxy which was started with this listener
+	listener quicListener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// Start DNS-over-QUIC listener if it's configured
+func (s *Server) startDoQ() error {
+	if s.conf.QUICListenAddr == nil || s.conf.quicTLSConfig == nil {
+		return nil
+	}
+	err := CheckDoQ()
+	if err != nil {
+		return err
+	}
+
+	l, err := listenQUIC(s.conf.QUICListenAddr, s.conf.quicTLSConfig, doqIdleTimeout)
+	if err != nil {
+		return fmt.Errorf("DNS-over-QUIC: %s", err)
+	}
+
+	d := &doqServer{
+		srv:      s,
+		proxy:    s.dnsProxy,
+		listener: l,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.wg.Add(1)
+	go d.serve()
+	s.doq = d
+	log.Info("DNS: listening for DNS-over-QUIC requests on udp://%s", s.conf.QUICListenAddr)
+	return nil
+}
+
+// Stop DNS-over-QUIC listener and wait until all connections are closed
+func (s *Server) stopDoQ() {
+	d := s.doq
+	if d == nil {
+		return
+	}
+	s.doq = nil
+	d.cancel()
+	_ = d.listener.Close()
+	d.wg.Wait()
+}
+
+func (d *doqServer) serve() {
+	defer d.wg.Done()
+	for {
+		sess, err := d.listener.Accept(d.ctx)
+		if err != nil {
+			if d.ctx.Err() == nil {
+				log.Error("DNS-over-QUIC: accept: %s", err)
+			}
+			return
+		}
+
+		d.wg.Add(1)
+		go d.handleSession(sess)
+	}
+}
+
+// Process the requests of a connection: every request is sent in a separate stream
+func (d *doqServer) handleSession(sess quicSession) {
+	defer d.wg.Done()
+	m := &d.srv.metrics
+	m.countDoQConnection(1)
+	defer m.countDoQConnection(-1)
+
+	streams := sync.WaitGroup{}
+	for {
+		stream, err := sess.AcceptStream(d.ctx)
+		if err != nil {
+			// the connection is closed by client or it's idle
+			break
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			d.handleStream(sess, stream)
+		}()
+	}
+	streams.Wait()
+	_ = sess.Close()
+}
+
+// Read the request from the stream, process it and write the response.
+// Both messages are prefixed with 2-byte length field.
+func (d *doqServer) handleStream(sess quicSession, stream io.ReadWriteCloser) {
+	defer stream.Close()
+
+	if c, ok := stream.(interface{ SetReadDeadline(time.Time) error }); ok {
+		_ = c.SetReadDeadline(time.Now().Add(doqReadTimeout))
+	}
+
+	var length uint16
+	err := binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		log.Debug("DNS-over-QUIC: %s: read: %s", sess.RemoteAddr(), err)
+		return
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(stream, buf)
+	if err != nil {
+		log.Debug("DNS-over-QUIC: %s: read: %s", sess.RemoteAddr(), err)
+		return
+	}
+
+	req := &dns.Msg{}
+	err = req.Unpack(buf)
+	if err != nil || len(req.Question) != 1 {
+		log.Debug("DNS-over-QUIC: %s: invalid request", sess.RemoteAddr())
+		return
+	}
+	if req.Id != 0 {
+		// RFC 9250 4.2.1: message ID must be 0
+		log.Debug("DNS-over-QUIC: %s: non-zero message ID", sess.RemoteAddr())
+		return
+	}
+	d.srv.metrics.countDoQQuery()
+
+	resp := d.srv.handleOwnRequest(d.proxy, &proxy.DNSContext{
+		Proto:     doqProto,
+		Req:       req,
+		Addr:      sess.RemoteAddr(),
+		StartTime: time.Now(),
+	})
+	if resp == nil {
+		return
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		log.Debug("DNS-over-QUIC: pack: %s", err)
+		return
+	}
+	data = append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+	_, err = stream.Write(data)
+	if err != nil {
+		log.Debug("DNS-over-QUIC: %s: write: %s", sess.RemoteAddr(), err)
+	}
+}
+
+// Process the request received by our own listener (DNS-over-QUIC, socket activation)
+// in the same way as the requests received by DNS proxy.
+// Return nil if the request must be dropped.
+// Server's lock isn't used, because the server waits for the requests to complete when it's stopped.
+func (s *Server) handleOwnRequest(p *proxy.Proxy, d *proxy.DNSContext) *dns.Msg {
+	ok, err := s.beforeRequestHandler(p, d)
+	if err != nil || !ok {
+		return nil
+	}
+	if d.Res != nil {
+		return d.Res // the request is refused by rate limiting
+	}
+
+	err = s.handleDNSRequest(p, d)
+	if err != nil {
+		log.Debug("DNS: %s: %s", d.Proto, err)
+		return s.genServerFailure(d.Req)
+	}
+	return d.Res
+}
@@ -0,0 +1,66 @@
+// +build quic
+
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC transport for DNS-over-QUIC server
+func init() {
+	listenQUIC = func(addr *net.UDPAddr, conf *tls.Config, idleTimeout time.Duration) (quicListener, error) {
+		lc := net.ListenConfig{Control: reusePortControl}
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		l, err := quic.Listen(conn, conf, &quic.Config{MaxIdleTimeout: idleTimeout})
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return &quicGoListener{l: l, conn: conn}, nil
+	}
+}
+
+type quicGoListener struct {
+	l    *quic.Listener
+	conn net.PacketConn // quic-go doesn't close the connection which it hasn't created
+}
+
+func (l *quicGoListener) Accept(ctx context.Context) (quicSession, error) {
+	conn, err := l.l.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicGoSession{s: conn}, nil
+}
+
+func (l *quicGoListener) Close() error {
+	err := l.l.Close()
+	_ = l.conn.Close()
+	return err
+}
+
+type quicGoSession struct {
+	s quic.Connection
+}
+
+func (s *quicGoSession) AcceptStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return s.s.AcceptStream(ctx)
+}
+
+func (s *quicGoSession) RemoteAddr() net.Addr {
+	return s.s.RemoteAddr()
+}
+
+// Close the connection with DOQ_NO_ERROR code
+func (s *quicGoSession) Close() error {
+	return s.s.CloseWithError(0, "")
+}
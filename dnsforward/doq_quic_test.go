@@ -0,0 +1,64 @@
+// +build quic
+
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoQServerQUIC(t *testing.T) {
+	assert.Nil(t, CheckDoQ())
+
+	// get a free UDP port
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := c.LocalAddr().(*net.UDPAddr)
+	_ = c.Close()
+
+	_, certPem, keyPem := createServerTLSConfig(t)
+	s := createTestServer(t)
+	s.conf.TLSConfig = TLSConfig{
+		QUICListenAddr:       addr,
+		CertificateChainData: certPem,
+		PrivateKeyData:       keyPem,
+	}
+	assert.Nil(t, s.Prepare(nil))
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{doqALPN}}
+	conn, err := quic.DialAddr(ctx, addr.String(), tlsConf, nil)
+	assert.Nil(t, err)
+	defer func() { _ = conn.CloseWithError(0, "") }()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	assert.Nil(t, err)
+	req := createTestMessage("nxdomain.example.org.")
+	req.Id = 0
+	data, err := req.Pack()
+	assert.Nil(t, err)
+	_, err = stream.Write(append([]byte{byte(len(data) >> 8), byte(len(data))}, data...))
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Close())
+
+	var length uint16
+	assert.Nil(t, binary.Read(stream, binary.BigEndian, &length))
+	buf := make([]byte, length)
+	_, err = io.ReadFull(stream, buf)
+	assert.Nil(t, err)
+	resp := &dns.Msg{}
+	assert.Nil(t, resp.Unpack(buf))
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
@@ -0,0 +1,150 @@
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// In-memory QUIC transport: every stream is a pipe
+type testQUICListener struct {
+	sessions chan quicSession
+	closed   chan bool
+}
+
+func (l *testQUICListener) Accept(ctx context.Context) (quicSession, error) {
+	select {
+	case sess := <-l.sessions:
+		return sess, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("closed")
+	}
+}
+
+func (l *testQUICListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+type testQUICSession struct {
+	streams chan io.ReadWriteCloser
+}
+
+func (s *testQUICSession) AcceptStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	select {
+	case st, ok := <-s.streams:
+		if !ok {
+			return nil, fmt.Errorf("closed")
+		}
+		return st, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *testQUICSession) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 12345}
+}
+
+func (s *testQUICSession) Close() error {
+	return nil
+}
+
+// Send the request in a new stream and read the response
+func exchangeDoQ(t *testing.T, sess *testQUICSession, req *dns.Msg) *dns.Msg {
+	client, server := net.Pipe()
+	defer client.Close()
+	sess.streams <- server
+
+	data, err := req.Pack()
+	assert.Nil(t, err)
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Write(append([]byte{byte(len(data) >> 8), byte(len(data))}, data...))
+	assert.Nil(t, err)
+
+	var length uint16
+	err = binary.Read(client, binary.BigEndian, &length)
+	if err != nil {
+		return nil
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(client, buf)
+	assert.Nil(t, err)
+	resp := &dns.Msg{}
+	assert.Nil(t, resp.Unpack(buf))
+	return resp
+}
+
+func TestDoQServer(t *testing.T) {
+	l := &testQUICListener{
+		sessions: make(chan quicSession, 1),
+		closed:   make(chan bool),
+	}
+	prev := listenQUIC
+	listenQUIC = func(addr *net.UDPAddr, conf *tls.Config, idleTimeout time.Duration) (quicListener, error) {
+		assert.Equal(t, []string{doqALPN}, conf.NextProtos)
+		return l, nil
+	}
+	defer func() { listenQUIC = prev }()
+
+	_, certPem, keyPem := createServerTLSConfig(t)
+	s := createTestServer(t)
+	s.conf.TLSConfig = TLSConfig{
+		QUICListenAddr:       &net.UDPAddr{Port: 0},
+		CertificateChainData: certPem,
+		PrivateKeyData:       keyPem,
+	}
+	assert.Nil(t, s.Prepare(nil))
+	assert.Nil(t, s.Start())
+	assert.NotNil(t, s.doq)
+
+	sess := &testQUICSession{streams: make(chan io.ReadWriteCloser)}
+	l.sessions <- sess
+
+	req := createTestMessage("nxdomain.example.org.")
+	req.Id = 0
+	resp := exchangeDoQ(t, sess, req)
+	assert.NotNil(t, resp)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// message ID must be 0
+	req.Id = 1
+	resp = exchangeDoQ(t, sess, req)
+	assert.Nil(t, resp)
+
+	close(sess.streams)
+	assert.Nil(t, s.Stop())
+	assert.Nil(t, s.doq)
+
+	s.metrics.lock.Lock()
+	assert.Equal(t, uint64(1), s.metrics.doqConnections)
+	assert.Equal(t, int64(0), s.metrics.doqActive)
+	assert.Equal(t, uint64(1), s.metrics.doqQueries)
+	s.metrics.lock.Unlock()
+}
+
+func TestDoQNotCompiledIn(t *testing.T) {
+	prev := listenQUIC
+	listenQUIC = nil
+	defer func() { listenQUIC = prev }()
+	assert.NotNil(t, CheckDoQ())
+
+	_, certPem, keyPem := createServerTLSConfig(t)
+	s := createTestServer(t)
+	s.conf.TLSConfig = TLSConfig{
+		QUICListenAddr:       &net.UDPAddr{Port: 0},
+		CertificateChainData: certPem,
+		PrivateKeyData:       keyPem,
+	}
+	assert.Nil(t, s.Prepare(nil))
+	assert.NotNil(t, s.Start())
+	assert.Nil(t, s.doq)
+}
@@ -0,0 +1,83 @@
+// Graceful shutdown: the requests in progress are completed before the listening sockets are closed
+
+package dnsforward
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	defaultDrainTimeout = 2000 // in milliseconds
+	drainPollInterval   = 10 * time.Millisecond
+)
+
+// drainCtx counts the requests in progress
+type drainCtx struct {
+	inflight int32 // number of requests in progress (atomic)
+	draining int32 // 1: the server is shutting down, the new requests are refused (atomic)
+	refused  uint64
+}
+
+// Begin processing of the request
+// Return FALSE if the server is shutting down and the request must be refused.
+func (c *drainCtx) begin() bool {
+	if atomic.LoadInt32(&c.draining) != 0 {
+		atomic.AddUint64(&c.refused, 1)
+		return false
+	}
+	atomic.AddInt32(&c.inflight, 1)
+	return true
+}
+
+func (c *drainCtx) end() {
+	atomic.AddInt32(&c.inflight, -1)
+}
+
+// Stop accepting the new requests and wait until the requests in progress are completed
+// Return the number of requests which haven't been completed in time.
+func (c *drainCtx) drain(timeout time.Duration) int {
+	atomic.StoreInt32(&c.draining, 1)
+	deadline := time.Now().Add(timeout)
+	for {
+		n := int(atomic.LoadInt32(&c.inflight))
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+func (c *drainCtx) reset() {
+	atomic.StoreInt32(&c.draining, 0)
+	atomic.StoreUint64(&c.refused, 0)
+}
+
+// Shutdown stops the DNS server gracefully:
+// the new requests are refused, the requests in progress are completed (with a time limit),
+// and then the listening sockets are closed.
+func (s *Server) Shutdown() error {
+	s.RLock()
+	timeout := time.Duration(s.conf.DrainTimeout) * time.Millisecond
+	running := s.isRunning
+	s.RUnlock()
+	if timeout == 0 {
+		timeout = defaultDrainTimeout * time.Millisecond
+	}
+
+	if running {
+		start := time.Now()
+		n := s.drain.drain(timeout)
+		if n != 0 {
+			log.Info("DNS: shutdown: %d requests haven't been completed in %s", n, timeout)
+		}
+		log.Debug("DNS: shutdown: drained in %s, refused %d requests",
+			time.Since(start), atomic.LoadUint64(&s.drain.refused))
+	}
+
+	err := s.Stop()
+	s.drain.reset()
+	return err
+}
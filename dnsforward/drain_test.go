@@ -0,0 +1,35 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	c := drainCtx{}
+	assert.True(t, c.begin())
+	assert.True(t, c.begin())
+	c.end()
+
+	// one request is in progress
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.end()
+	}()
+	assert.Equal(t, 0, c.drain(time.Second))
+
+	// the new requests are refused
+	assert.False(t, c.begin())
+	assert.Equal(t, uint64(1), c.refused)
+
+	// timeout
+	c.reset()
+	assert.True(t, c.begin())
+	assert.Equal(t, 1, c.drain(20*time.Millisecond))
+	c.end()
+	c.reset()
+	assert.True(t, c.begin())
+	c.end()
+}
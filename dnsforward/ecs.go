@@ -0,0 +1,224 @@
+// EDNS Client Subnet: client identification and per-domain policies towards upstream servers
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// What to do with EDNS Client Subnet option in the requests sent upstream
+const (
+	ecsModeForward    = "forward"    // pass the option from client as is (default)
+	ecsModeStrip      = "strip"      // remove the option
+	ecsModeSynthesize = "synthesize" // add the option with client's subnet (or a fixed subnet) if it's not set
+)
+
+const (
+	ecsDefaultMaskV4 = 24
+	ecsDefaultMaskV6 = 56
+)
+
+// ecsPolicy is a parsed EDNS Client Subnet policy:
+// "[/domain1/domain2/]mode" or "[/domain1/domain2/]synthesize:1.2.3.0/24"
+type ecsPolicy struct {
+	domains []string   // empty: default policy for all domains
+	mode    string     // ecsMode*
+	subnet  *net.IPNet // fixed subnet for "synthesize" mode.  nil: use client's IP address
+}
+
+// Parse EDNS Client Subnet policies
+func parseECSPolicies(list []string) ([]ecsPolicy, error) {
+	policies := []ecsPolicy{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+
+		p := ecsPolicy{}
+		if strings.HasPrefix(s, "[/") {
+			end := strings.Index(s, "/]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid ECS policy: %s", s)
+			}
+			for _, d := range strings.Split(s[2:end], "/") {
+				d = strings.ToLower(strings.TrimSuffix(d, "."))
+				if len(d) == 0 {
+					continue
+				}
+				p.domains = append(p.domains, d)
+			}
+			if len(p.domains) == 0 {
+				return nil, fmt.Errorf("invalid ECS policy: no domains: %s", s)
+			}
+			s = s[end+2:]
+		}
+
+		mode := s
+		i := strings.IndexByte(s, ':')
+		if i >= 0 {
+			mode = s[:i]
+			_, subnet, err := net.ParseCIDR(s[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid ECS policy: %s", err)
+			}
+			p.subnet = subnet
+		}
+
+		if !(mode == ecsModeForward || mode == ecsModeStrip || mode == ecsModeSynthesize) {
+			return nil, fmt.Errorf("invalid ECS policy: unknown mode %s", mode)
+		}
+		if p.subnet != nil && mode != ecsModeSynthesize {
+			return nil, fmt.Errorf("invalid ECS policy: subnet is allowed only in %s mode", ecsModeSynthesize)
+		}
+		p.mode = mode
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// Get the policy for the host name: the longest matching domain wins
+func matchECSPolicy(policies []ecsPolicy, host string) *ecsPolicy {
+	var found *ecsPolicy
+	foundLen := -1
+	for i := range policies {
+		p := &policies[i]
+		if len(p.domains) == 0 {
+			if foundLen < 0 {
+				found = p
+				foundLen = 0
+			}
+			continue
+		}
+		for _, d := range p.domains {
+			if (host == d || strings.HasSuffix(host, "."+d)) && len(d) > foundLen {
+				found = p
+				foundLen = len(d)
+			}
+		}
+	}
+	return found
+}
+
+// Get EDNS Client Subnet option from DNS message
+func getECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// Get the client subnet from EDNS Client Subnet option ("1.2.3.0/24")
+// Return nil if it's not set
+func ecsSubnet(m *dns.Msg) *net.IPNet {
+	ecs := getECS(m)
+	if ecs == nil || ecs.Address == nil || ecs.Address.IsUnspecified() {
+		return nil
+	}
+	bits := 32
+	if ecs.Family == 2 {
+		bits = 128
+	}
+	mask := net.CIDRMask(int(ecs.SourceNetmask), bits)
+	return &net.IPNet{IP: ecs.Address.Mask(mask), Mask: mask}
+}
+
+// Remove EDNS Client Subnet option from DNS message
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// Add EDNS Client Subnet option to DNS message
+func setECS(m *dns.Msg, subnet *net.IPNet) {
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		SourceScope:   0,
+	}
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	} else {
+		ecs.Family = 2
+		ecs.Address = subnet.IP
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(4096, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, ecs)
+}
+
+// Get the subnet of client's IP address
+func clientSubnet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(ecsDefaultMaskV4, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(ecsDefaultMaskV6, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// Apply EDNS Client Subnet policy to the request which is sent upstream
+// Return TRUE if the option has been added by us
+func (s *Server) applyECSPolicy(ctx *dnsContext) bool {
+	s.RLock()
+	policies := s.ecsPolicies
+	s.RUnlock()
+	if len(policies) == 0 {
+		return false
+	}
+
+	req := ctx.proxyCtx.Req
+	host := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	p := matchECSPolicy(policies, host)
+	if p == nil {
+		return false
+	}
+
+	switch p.mode {
+	case ecsModeStrip:
+		removeECS(req)
+
+	case ecsModeSynthesize:
+		if getECS(req) != nil {
+			return false
+		}
+		subnet := p.subnet
+		if subnet == nil {
+			ip := net.ParseIP(ctx.clientIP)
+			if ip == nil || ip.IsLoopback() {
+				return false
+			}
+			subnet = clientSubnet(ip)
+		}
+		log.Tracef("ECS: adding %s for %s", subnet, host)
+		setECS(req, subnet)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+// Country and ASN of IP addresses for the access settings
+
+package dnsforward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Prefixes of access settings entries
+const (
+	accessCountryPrefix = "country:" // "country:DE"
+	accessASNPrefix     = "asn:"     // "asn:3320", "asn:AS3320"
+)
+
+type geoipRange struct {
+	start   net.IP // 16-byte form
+	end     net.IP
+	country string // ISO 3166-1 alpha-2 code in upper case.  "": unknown
+	asn     uint32 // 0: unknown
+}
+
+// geoipDB is an IP address ranges database
+type geoipDB struct {
+	path    string
+	modTime time.Time
+	ranges  []geoipRange // sorted by start address
+}
+
+// Load the database in ip2asn format (https://iptoasn.com/, plain or gzip-compressed).
+// The fields of a line: range_start, range_end, AS_number, country_code, AS_description (separated by TAB).
+func loadGeoIPDB(path string) (*geoipDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	db, err := parseGeoIPDB(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	db.path = path
+	db.modTime = st.ModTime()
+	return db, nil
+}
+
+func parseGeoIPDB(r io.Reader) (*geoipDB, error) {
+	db := &geoipDB{}
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := sc.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: invalid format", n)
+		}
+		rng := geoipRange{
+			start: net.ParseIP(fields[0]),
+			end:   net.ParseIP(fields[1]),
+		}
+		if rng.start == nil || rng.end == nil {
+			return nil, fmt.Errorf("line %d: invalid IP address", n)
+		}
+		rng.start = rng.start.To16()
+		rng.end = rng.end.To16()
+
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid AS number: %s", n, fields[2])
+		}
+		rng.asn = uint32(asn)
+		if len(fields[3]) == 2 {
+			rng.country = strings.ToUpper(fields[3]) // "None" for the unallocated ranges
+		}
+		if rng.asn == 0 && len(rng.country) == 0 {
+			continue
+		}
+		db.ranges = append(db.ranges, rng)
+	}
+	err := sc.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	return db, nil
+}
+
+// Get the country and ASN of the IP address
+func (db *geoipDB) lookup(ip net.IP) (string, uint32) {
+	if db == nil {
+		return "", 0
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return "", 0
+	}
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, ip) > 0
+	})
+	if i == 0 {
+		return "", 0
+	}
+	rng := db.ranges[i-1]
+	if bytes.Compare(ip, rng.end) > 0 {
+		return "", 0
+	}
+	return rng.country, rng.asn
+}
+
+// Load the database if it isn't loaded yet or if the file was modified
+func reloadGeoIPDB(db *geoipDB, path string) *geoipDB {
+	if len(path) == 0 {
+		return nil
+	}
+	if db != nil && db.path == path {
+		st, err := os.Stat(path)
+		if err == nil && st.ModTime().Equal(db.modTime) {
+			return db
+		}
+	}
+
+	start := time.Now()
+	newDB, err := loadGeoIPDB(path)
+	if err != nil {
+		log.Error("DNS: GeoIP database: %s", err)
+		if db != nil && db.path == path {
+			return db // keep using the previous version
+		}
+		return nil
+	}
+	log.Debug("DNS: GeoIP database: loaded %d ranges in %v", len(newDB.ranges), time.Since(start))
+	return newDB
+}
+
+// Parse the country or ASN entry.  Return ok=false if it's not such entry.
+func parseGeoIPEntry(s string) (country string, asn uint32, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(s, accessCountryPrefix):
+		country = strings.ToUpper(s[len(accessCountryPrefix):])
+		if len(country) != 2 {
+			return "", 0, true, fmt.Errorf("invalid country code: %s", s)
+		}
+		return country, 0, true, nil
+
+	case strings.HasPrefix(s, accessASNPrefix):
+		v := strings.TrimPrefix(strings.ToUpper(s[len(accessASNPrefix):]), "AS")
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return "", 0, true, fmt.Errorf("invalid AS number: %s", s)
+		}
+		return "", uint32(n), true, nil
+	}
+	return "", 0, false, nil
+}
@@ -0,0 +1,66 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoIPDB(t *testing.T) {
+	data := `2001:db8::	2001:db8:ffff:ffff:ffff:ffff:ffff:ffff	64496	DE	EXAMPLE-NET
+1.1.1.0	1.1.1.255	13335	US	CLOUDFLARENET
+1.1.2.0	1.1.3.255	0	None	Not routed
+1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+`
+	db, err := parseGeoIPDB(strings.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(db.ranges))
+
+	country, asn := db.lookup(net.ParseIP("1.1.1.1"))
+	assert.Equal(t, "US", country)
+	assert.Equal(t, uint32(13335), asn)
+
+	country, asn = db.lookup(net.ParseIP("1.0.0.255"))
+	assert.Equal(t, "US", country)
+	assert.Equal(t, uint32(13335), asn)
+
+	country, asn = db.lookup(net.ParseIP("2001:db8::1"))
+	assert.Equal(t, "DE", country)
+	assert.Equal(t, uint32(64496), asn)
+
+	country, asn = db.lookup(net.ParseIP("1.1.2.1"))
+	assert.Equal(t, "", country)
+	assert.Equal(t, uint32(0), asn)
+
+	country, _ = db.lookup(net.ParseIP("0.0.0.1"))
+	assert.Equal(t, "", country)
+
+	var nilDB *geoipDB
+	country, _ = nilDB.lookup(net.ParseIP("1.1.1.1"))
+	assert.Equal(t, "", country)
+
+	_, err = parseGeoIPDB(strings.NewReader("1.1.1.0\t1.1.1.255\n"))
+	assert.NotNil(t, err)
+	_, err = parseGeoIPDB(strings.NewReader("1.1.1.0\t1.1.1.x\t1\tUS\n"))
+	assert.NotNil(t, err)
+}
+
+func TestParseGeoIPEntry(t *testing.T) {
+	country, _, ok, err := parseGeoIPEntry("country:de")
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, "DE", country)
+
+	_, asn, ok, err := parseGeoIPEntry("asn:AS3320")
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3320), asn)
+
+	_, asn, _, _ = parseGeoIPEntry("asn:3320")
+	assert.Equal(t, uint32(3320), asn)
+
+	_, _, ok, _ = parseGeoIPEntry("1.2.3.4")
+	assert.False(t, ok)
+}
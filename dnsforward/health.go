@@ -0,0 +1,118 @@
+// Health status for container orchestrators: DNS-based health probe and upstream reachability check
+
+package dnsforward
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+const upstreamsCheckCacheTime = 10 * time.Second // the result of upstreams check is reused for this time
+
+// healthCtx keeps the result of the last upstreams check
+type healthCtx struct {
+	lock      sync.Mutex
+	lastCheck time.Time
+	lastErr   error
+}
+
+// CheckUpstreams checks that at least one of the upstream servers responds.
+// The result is cached, so the health probes don't send too many requests to upstream servers.
+func (s *Server) CheckUpstreams() error {
+	s.health.lock.Lock()
+	defer s.health.lock.Unlock()
+	if !s.health.lastCheck.IsZero() && time.Since(s.health.lastCheck) < upstreamsCheckCacheTime {
+		return s.health.lastErr
+	}
+
+	s.RLock()
+	upstreams := s.conf.Upstreams
+	domain := dns.Fqdn(s.conf.UpstreamHealthCheckDomain)
+	s.RUnlock()
+
+	s.health.lastErr = probeUpstreams(upstreams, domain)
+	s.health.lastCheck = time.Now()
+	return s.health.lastErr
+}
+
+// Send the probe requests to all upstreams at once.
+// Return nil as soon as any upstream responds, or the last error if none of them does.
+func probeUpstreams(upstreams []upstream.Upstream, domain string) error {
+	if len(upstreams) == 0 {
+		return errors.New("no upstream servers")
+	}
+
+	ch := make(chan error, len(upstreams))
+	for _, u := range upstreams {
+		go func(u upstream.Upstream) {
+			ch <- probeUpstream(u, domain)
+		}(u)
+	}
+
+	var err error
+	for range upstreams {
+		err = <-ch
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Respond to the health probe request (HealthProbeName):
+// NOERROR with the loopback address (or "OK" TXT record) if AdGuard Home is healthy, SERVFAIL otherwise.
+// The probe requests are neither filtered nor written to the query log.
+func processHealthProbe(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	s.RLock()
+	name := s.conf.HealthProbeName
+	check := s.conf.HealthCheck
+	s.RUnlock()
+	if len(name) == 0 || !strings.EqualFold(d.Req.Question[0].Name, dns.Fqdn(name)) {
+		return resultDone
+	}
+
+	if check != nil {
+		err := check()
+		if err != nil {
+			d.Res = s.genServerFailure(d.Req)
+			d.Res.Extra = append(d.Res.Extra, genHealthTXT(d.Req, err.Error()))
+			return resultFinish
+		}
+	}
+
+	d.Res = s.makeResponse(d.Req)
+	hdr := dns.RR_Header{
+		Name:   d.Req.Question[0].Name,
+		Rrtype: d.Req.Question[0].Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    0, // the status must not be cached
+	}
+	switch d.Req.Question[0].Qtype {
+	case dns.TypeA:
+		d.Res.Answer = append(d.Res.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1).To4()})
+	case dns.TypeAAAA:
+		d.Res.Answer = append(d.Res.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+	case dns.TypeTXT:
+		d.Res.Answer = append(d.Res.Answer, genHealthTXT(d.Req, "OK"))
+	}
+	return resultFinish
+}
+
+func genHealthTXT(req *dns.Msg, text string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+		},
+		Txt: []string{text},
+	}
+}
@@ -0,0 +1,68 @@
+package dnsforward
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessHealthProbe(t *testing.T) {
+	s := &Server{}
+	s.conf.HealthProbeName = "health.adguardhome.local"
+	var healthErr error
+	s.conf.HealthCheck = func() error {
+		return healthErr
+	}
+
+	process := func(name string, qtype uint16) (int, *dns.Msg) {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		ctx := &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req}}
+		r := processHealthProbe(ctx)
+		return r, ctx.proxyCtx.Res
+	}
+
+	r, resp := process("Health.AdGuardHome.local.", dns.TypeA)
+	assert.Equal(t, resultFinish, r)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, "127.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(0), resp.Answer[0].Header().Ttl)
+
+	_, resp = process("health.adguardhome.local.", dns.TypeTXT)
+	assert.Equal(t, []string{"OK"}, resp.Answer[0].(*dns.TXT).Txt)
+
+	_, resp = process("health.adguardhome.local.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+
+	// unhealthy
+	healthErr = errors.New("upstreams: timeout")
+	_, resp = process("health.adguardhome.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, []string{"upstreams: timeout"}, resp.Extra[0].(*dns.TXT).Txt)
+
+	// the other names are processed as usual
+	r, resp = process("example.org.", dns.TypeA)
+	assert.Equal(t, resultDone, r)
+	assert.Nil(t, resp)
+
+	s.conf.HealthProbeName = ""
+	r, _ = process("health.adguardhome.local.", dns.TypeA)
+	assert.Equal(t, resultDone, r)
+}
+
+func TestProbeUpstreams(t *testing.T) {
+	u1 := &strategyUpstream{addr: "1", fail: true}
+	u2 := &strategyUpstream{addr: "2", fail: true}
+	upstreams := []upstream.Upstream{u1, u2}
+	assert.NotNil(t, probeUpstreams(upstreams, "."))
+
+	u2.fail = false
+	assert.Nil(t, probeUpstreams(upstreams, "."))
+
+	assert.NotNil(t, probeUpstreams(nil, "."))
+}
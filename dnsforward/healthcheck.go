@@ -0,0 +1,207 @@
+// Active health checks of upstream servers
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	minRecoveryBackoff = 10 * time.Second // the first recovery probe of a quarantined upstream is sent after this time
+	maxRecoveryBackoff = 10 * time.Minute
+	healthCheckTick    = time.Second
+)
+
+// Temporarily remove the upstream:
+// it isn't used for the requests until it responds to a recovery probe.
+func (sel *upstreamSelector) quarantine(st *upstreamStats, now time.Time) {
+	log.Info("DNS: upstream %s is quarantined: %s", st.Address, st.LastError)
+	st.Quarantined = true
+	st.backoff = minRecoveryBackoff
+	st.nextProbe = now.Add(st.backoff)
+	if sel.onStatus != nil {
+		sel.onStatus(st.Address, false, st.LastError)
+	}
+}
+
+// Return the upstream to service
+func (sel *upstreamSelector) release(st *upstreamStats, now time.Time) {
+	log.Info("DNS: upstream %s is back online", st.Address)
+	st.Quarantined = false
+	st.backoff = 0
+	st.nextProbe = now.Add(sel.healthInterval)
+	if sel.onStatus != nil {
+		sel.onStatus(st.Address, true, "")
+	}
+}
+
+// Update the upstream state according to the result of a probe request.
+// The interval between recovery probes is doubled after every failure.
+func (sel *upstreamSelector) probeResult(st *upstreamStats, err error, now time.Time) {
+	st.probing = false
+	if err == nil {
+		st.Failures = 0
+		if st.Quarantined {
+			sel.release(st, now)
+		} else {
+			st.nextProbe = now.Add(sel.healthInterval)
+		}
+		return
+	}
+
+	log.Debug("DNS: health check: %s: %s", st.Address, err)
+	st.Failures++
+	st.LastError = err.Error()
+	if st.Quarantined {
+		st.backoff *= 2
+		if st.backoff > maxRecoveryBackoff {
+			st.backoff = maxRecoveryBackoff
+		}
+		st.nextProbe = now.Add(st.backoff)
+		return
+	}
+
+	if !sel.isHealthy(st) {
+		sel.quarantine(st, now)
+		return
+	}
+	st.nextProbe = now.Add(sel.healthInterval)
+}
+
+// Send a probe request to the upstream.
+// Any response except SERVFAIL and REFUSED means that the upstream works.
+func probeUpstream(u upstream.Upstream, domain string) error {
+	req := &dns.Msg{}
+	req.SetQuestion(domain, dns.TypeNS)
+	resp, err := u.Exchange(req)
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("got %s response", dns.RcodeToString[resp.Rcode])
+	}
+	return err
+}
+
+func (sel *upstreamSelector) probe(u upstream.Upstream, domain string) {
+	err := probeUpstream(u, domain)
+
+	sel.lock.Lock()
+	sel.probeResult(sel.getStats(u.Address()), err, time.Now())
+	sel.lock.Unlock()
+}
+
+// Send probe requests to the upstreams which are due for it
+func (sel *upstreamSelector) probeDue(now time.Time) {
+	var due []upstream.Upstream
+	sel.lock.Lock()
+	domain := sel.healthDomain
+	for _, u := range sel.upstreams {
+		st := sel.getStats(u.Address())
+		if st.probing || now.Before(st.nextProbe) {
+			continue
+		}
+		st.probing = true
+		due = append(due, u)
+	}
+	sel.lock.Unlock()
+
+	for _, u := range due {
+		go sel.probe(u, domain)
+	}
+}
+
+func (sel *upstreamSelector) startHealthCheck() {
+	sel.lock.Lock()
+	defer sel.lock.Unlock()
+	if sel.healthInterval == 0 || sel.healthStop != nil {
+		return
+	}
+
+	sel.healthStop = make(chan bool)
+	sel.healthDone = make(chan bool)
+	go func(stop, done chan bool) {
+		ticker := time.NewTicker(healthCheckTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				sel.probeDue(now)
+
+			case <-stop:
+				close(done)
+				return
+			}
+		}
+	}(sel.healthStop, sel.healthDone)
+}
+
+func (sel *upstreamSelector) stopHealthCheck() {
+	sel.lock.Lock()
+	stop, done := sel.healthStop, sel.healthDone
+	sel.healthStop = nil
+	sel.healthDone = nil
+	sel.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+type upstreamHealthJSON struct {
+	Interval uint32 `json:"interval"` // in seconds.  0: disabled
+	Domain   string `json:"domain"`
+
+	// status
+	Upstreams []upstreamStats `json:"upstreams,omitempty"`
+}
+
+func (s *Server) handleUpstreamHealthStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := upstreamHealthJSON{
+		Interval: s.conf.UpstreamHealthCheckInterval,
+		Domain:   s.conf.UpstreamHealthCheckDomain,
+	}
+	s.RUnlock()
+	j.Upstreams = s.selector.getStatsList()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleUpstreamHealthSet(w http.ResponseWriter, r *http.Request) {
+	j := upstreamHealthJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if len(j.Domain) != 0 {
+		if _, ok := dns.IsDomainName(j.Domain); !ok {
+			httpError(r, w, http.StatusBadRequest, "domain: invalid value")
+			return
+		}
+	}
+
+	s.Lock()
+	s.conf.UpstreamHealthCheckInterval = j.Interval
+	s.conf.UpstreamHealthCheckDomain = j.Domain
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	err = s.Reconfigure(nil)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
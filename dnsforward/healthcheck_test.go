@@ -0,0 +1,62 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	u1 := &strategyUpstream{addr: "1", fail: true}
+	u2 := &strategyUpstream{addr: "2"}
+	upstreams := []upstream.Upstream{u1, u2}
+	sel := &upstreamSelector{}
+	sel.configure(&FilteringConfig{UpstreamHealthCheckInterval: 60}, upstreams)
+	assert.Equal(t, ".", sel.healthDomain)
+
+	// the upstreams are wrapped even with the default strategy
+	g := sel.wrap(upstreams)
+	assert.Equal(t, 1, len(g))
+
+	// the upstream is quarantined after 3 failed probes
+	for i := 0; i != 3; i++ {
+		sel.probe(u1, ".")
+	}
+	st := sel.stats["1"]
+	assert.True(t, st.Quarantined)
+	assert.Equal(t, minRecoveryBackoff, st.backoff)
+	assert.False(t, sel.stats["2"].Quarantined)
+
+	// quarantined upstream isn't queried
+	assert.Equal(t, "2", strategyExchange(t, g[0]))
+	assert.Equal(t, 3, u1.count)
+	list := sel.getStatsList()
+	assert.True(t, list[0].Quarantined)
+	assert.False(t, list[0].Healthy)
+	assert.NotEqual(t, "", list[0].NextProbe)
+
+	// recovery probes are sent with exponential backoff
+	sel.probe(u1, ".")
+	assert.Equal(t, 2*minRecoveryBackoff, st.backoff)
+	assert.True(t, st.nextProbe.After(time.Now().Add(minRecoveryBackoff)))
+
+	u1.fail = false
+	sel.probe(u1, ".")
+	assert.False(t, st.Quarantined)
+	assert.Equal(t, uint32(0), st.Failures)
+	assert.Equal(t, "1", strategyExchange(t, g[0]))
+
+	// failed requests quarantine the upstream too
+	u1.fail = true
+	for i := 0; i != 3; i++ {
+		assert.Equal(t, "2", strategyExchange(t, g[0]))
+	}
+	assert.True(t, st.Quarantined)
+
+	// quarantine is lifted when health checks are disabled
+	sel.configure(&FilteringConfig{}, upstreams)
+	assert.False(t, st.Quarantined)
+	assert.Equal(t, 2, len(sel.wrap(upstreams)))
+}
@@ -0,0 +1,266 @@
+// Additional DNS listeners with their own settings
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Listener is an additional endpoint of DNS server,
+// e.g. port 53 on LAN with filtering and port 5353 on the VPN interface without filtering
+type Listener struct {
+	Name             string   `yaml:"name" json:"name"`
+	Address          string   `yaml:"address" json:"address"`                     // "10.8.0.1:53", ":5353"
+	Protocols        []string `yaml:"protocols" json:"protocols"`                 // "udp", "tcp", "tls".  Empty: "udp" and "tcp"
+	FilteringEnabled bool     `yaml:"filtering_enabled" json:"filtering_enabled"` // false: the requests aren't filtered
+	View             string   `yaml:"view" json:"view"`                           // the view for all clients of the listener.  "": selected by client subnet
+
+	// Access settings which replace the global ones.  Both empty: the global settings are used
+	AllowedClients    []string `yaml:"allowed_clients" json:"allowed_clients"`
+	DisallowedClients []string `yaml:"disallowed_clients" json:"disallowed_clients"`
+}
+
+// listener is a prepared Listener
+type listener struct {
+	conf   Listener
+	proxy  *proxy.Proxy
+	access *accessCtx // nil: the global access settings are used
+}
+
+const (
+	listenerProtoUDP = "udp"
+	listenerProtoTCP = "tcp"
+	listenerProtoTLS = "tls"
+)
+
+// Parse the listen address: "IP:port" or ":port"
+func parseListenAddr(addr string) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, 0, fmt.Errorf("invalid port: %s", portStr)
+	}
+	var ip net.IP
+	if len(host) != 0 {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid IP address: %s", host)
+		}
+	}
+	return ip, port, nil
+}
+
+func listenerProtocols(l Listener) []string {
+	if len(l.Protocols) == 0 {
+		return []string{listenerProtoUDP, listenerProtoTCP}
+	}
+	return l.Protocols
+}
+
+// Check the settings of listeners
+func checkListeners(list []Listener, views []View) error {
+	names := map[string]bool{}
+	addrs := map[string]bool{}
+	for _, l := range list {
+		if len(l.Name) == 0 {
+			return fmt.Errorf("listener name is required")
+		}
+		if names[l.Name] {
+			return fmt.Errorf("duplicate listener name: %s", l.Name)
+		}
+		names[l.Name] = true
+
+		_, _, err := parseListenAddr(l.Address)
+		if err != nil {
+			return fmt.Errorf("%s: %s", l.Name, err)
+		}
+		for _, p := range listenerProtocols(l) {
+			switch p {
+			case listenerProtoUDP, listenerProtoTCP, listenerProtoTLS:
+			default:
+				return fmt.Errorf("%s: invalid protocol: %s", l.Name, p)
+			}
+			// TCP and TLS can't share the port
+			key := p + "|" + l.Address
+			if p == listenerProtoTLS {
+				key = listenerProtoTCP + "|" + l.Address
+			}
+			if addrs[key] {
+				return fmt.Errorf("%s: address %s is already used", l.Name, l.Address)
+			}
+			addrs[key] = true
+		}
+
+		if len(l.View) != 0 {
+			found := false
+			for _, v := range views {
+				if v.Name == l.View {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s: unknown view: %s", l.Name, l.View)
+			}
+		}
+
+		a := accessCtx{}
+		err = a.Init(l.AllowedClients, l.DisallowedClients, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %s", l.Name, err)
+		}
+	}
+	return nil
+}
+
+// Create the proxy objects for the listeners.
+// The settings of the main proxy are used except for the listen addresses.
+func (s *Server) prepareListeners(list []Listener, proxyConfig proxy.Config) ([]*listener, error) {
+	var listeners []*listener
+	for _, l := range list {
+		ip, port, err := parseListenAddr(l.Address)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %s", l.Name, err)
+		}
+
+		conf := proxyConfig
+		conf.UDPListenAddr = nil
+		conf.TCPListenAddr = nil
+		conf.TLSListenAddr = nil
+		for _, p := range listenerProtocols(l) {
+			switch p {
+			case listenerProtoUDP:
+				conf.UDPListenAddr = &net.UDPAddr{IP: ip, Port: port}
+			case listenerProtoTCP:
+				conf.TCPListenAddr = &net.TCPAddr{IP: ip, Port: port}
+			case listenerProtoTLS:
+				if conf.TLSConfig == nil {
+					return nil, fmt.Errorf("listener %s: encryption isn't configured", l.Name)
+				}
+				conf.TLSListenAddr = &net.TCPAddr{IP: ip, Port: port}
+			}
+		}
+
+		pl := &listener{
+			conf:  l,
+			proxy: &proxy.Proxy{Config: conf},
+		}
+		if len(l.AllowedClients) != 0 || len(l.DisallowedClients) != 0 {
+			pl.access = &accessCtx{geoip: s.geoip}
+			err = pl.access.Init(l.AllowedClients, l.DisallowedClients, s.conf.BlockedHosts)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %s", l.Name, err)
+			}
+		}
+		listeners = append(listeners, pl)
+	}
+	return listeners, nil
+}
+
+// Start the listeners.  If any of them can't be started, all of them are stopped.
+func (s *Server) startListeners() error {
+	for i, l := range s.listeners {
+		err := l.proxy.Start()
+		if err != nil {
+			for _, started := range s.listeners[:i] {
+				_ = started.proxy.Stop()
+			}
+			return fmt.Errorf("listener %s: %s", l.conf.Name, err)
+		}
+		log.Debug("DNS: listener %s: started on %s %v", l.conf.Name, l.conf.Address, listenerProtocols(l.conf))
+	}
+	return nil
+}
+
+func (s *Server) stopListeners() {
+	for _, l := range s.listeners {
+		err := l.proxy.Stop()
+		if err != nil {
+			log.Debug("DNS: listener %s: %s", l.conf.Name, err)
+		}
+	}
+}
+
+// Find the listener which has received the request.  nil: the main server
+func (s *Server) findListener(p *proxy.Proxy) *listener {
+	if p == nil {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for _, l := range s.listeners {
+		if l.proxy == p {
+			return l
+		}
+	}
+	return nil
+}
+
+// Find the view by name
+func (s *Server) findViewByName(name string) *view {
+	s.RLock()
+	defer s.RUnlock()
+	for _, v := range s.views {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+type listenersJSON struct {
+	Listeners []Listener `json:"listeners"`
+}
+
+func (s *Server) handleListenersList(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := listenersJSON{
+		Listeners: append([]Listener{}, s.conf.Listeners...),
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleListenersSet(w http.ResponseWriter, r *http.Request) {
+	j := listenersJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	s.RLock()
+	err = checkListeners(j.Listeners, s.conf.Views)
+	s.RUnlock()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	s.Lock()
+	s.conf.Listeners = j.Listeners
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	err = s.Reconfigure(nil)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
@@ -0,0 +1,73 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckListeners(t *testing.T) {
+	views := []View{{Name: "vpn", Subnets: []string{"10.8.0.0/24"}}}
+
+	assert.Nil(t, checkListeners([]Listener{
+		{Name: "lan", Address: "192.168.1.1:53", FilteringEnabled: true},
+		{Name: "vpn", Address: "10.8.0.1:5353", Protocols: []string{"udp"}, View: "vpn"},
+		{Name: "vpn-tls", Address: "10.8.0.1:5353", Protocols: []string{"tls"}},
+	}, views))
+
+	assert.NotNil(t, checkListeners([]Listener{{Address: ":53"}}, views))
+	assert.NotNil(t, checkListeners([]Listener{{Name: "a", Address: "53"}}, views))
+	assert.NotNil(t, checkListeners([]Listener{{Name: "a", Address: "1.2.3:53"}}, views))
+	assert.NotNil(t, checkListeners([]Listener{{Name: "a", Address: ":53", Protocols: []string{"quic"}}}, views))
+	assert.NotNil(t, checkListeners([]Listener{{Name: "a", Address: ":53", View: "lan"}}, views))
+	assert.NotNil(t, checkListeners([]Listener{{Name: "a", Address: ":53", AllowedClients: []string{"1.2.3"}}}, views))
+	assert.NotNil(t, checkListeners([]Listener{
+		{Name: "a", Address: ":53", Protocols: []string{"tcp"}},
+		{Name: "b", Address: ":53", Protocols: []string{"tls"}},
+	}, views))
+	assert.NotNil(t, checkListeners([]Listener{
+		{Name: "a", Address: ":53"},
+		{Name: "a", Address: ":54"},
+	}, views))
+}
+
+func TestListeners(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.Listeners = []Listener{
+		{Name: "vpn", Address: "127.0.0.1:0", Protocols: []string{"udp"}, DisallowedClients: []string{"127.0.0.2"}},
+	}
+	assert.Nil(t, s.Prepare(nil))
+	assert.Equal(t, 1, len(s.listeners))
+	l := s.listeners[0]
+	assert.NotNil(t, l.proxy.UDPListenAddr)
+	assert.Nil(t, l.proxy.TCPListenAddr)
+	assert.True(t, s.findListener(l.proxy) == l)
+	assert.Nil(t, s.findListener(s.dnsProxy))
+
+	// access settings
+	req := &dns.Msg{}
+	req.SetQuestion("nxdomain.example.org.", dns.TypeA)
+	d := &proxy.DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}}
+	ok, _ := s.beforeRequestHandler(l.proxy, d)
+	assert.False(t, ok)
+	ok, _ = s.beforeRequestHandler(s.dnsProxy, d)
+	assert.True(t, ok)
+
+	// the requests received by the listener aren't filtered
+	ctx := &dnsContext{srv: s, proxyCtx: d, result: &dnsfilter.Result{}}
+	assert.Equal(t, resultDone, processFilteringBeforeRequest(ctx))
+	assert.True(t, ctx.result.IsFiltered)
+
+	ctx = &dnsContext{srv: s, proxyCtx: d, result: &dnsfilter.Result{}, listener: l}
+	assert.Equal(t, resultDone, processFilteringBeforeRequest(ctx))
+	assert.False(t, ctx.protectionEnabled)
+	assert.False(t, ctx.result.IsFiltered)
+
+	// TLS requires the certificate
+	s.conf.Listeners[0].Protocols = []string{"tls"}
+	assert.NotNil(t, s.Prepare(nil))
+}
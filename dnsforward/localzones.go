@@ -0,0 +1,332 @@
+// Authoritative serving of local zones (e.g. "home.lan") from zone files
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	localZoneTTL       = 3600 // TTL of the generated SOA and NS records
+	localZoneNegTTL    = 60   // negative TTL in the generated SOA record
+	maxLocalCNAMEChain = 8
+)
+
+// LocalZone is a zone served by AdGuard Home.
+// The records are loaded either from a zone file (BIND format) or from the list of records.
+type LocalZone struct {
+	Name    string   `yaml:"name" json:"name"`       // "home.lan"
+	File    string   `yaml:"file" json:"file"`       // zone file
+	Records []string `yaml:"records" json:"records"` // zone file lines, the names are relative to the zone name ("nas 3600 IN A 192.168.1.10")
+}
+
+// localZone is a loaded zone
+type localZone struct {
+	name    string // FQDN in lowercase
+	soa     *dns.SOA
+	records map[string][]dns.RR // lowercase owner name -> records
+}
+
+// Load the zone.
+// SOA and NS records are generated if they aren't set.
+func loadLocalZone(z LocalZone) (*localZone, error) {
+	if _, ok := dns.IsDomainName(z.Name); !ok || len(z.Name) == 0 {
+		return nil, fmt.Errorf("invalid zone name: %s", z.Name)
+	}
+	origin := dns.Fqdn(strings.ToLower(z.Name))
+
+	var r io.Reader
+	if len(z.File) != 0 {
+		f, err := os.Open(z.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	} else {
+		r = strings.NewReader(strings.Join(z.Records, "\n"))
+	}
+
+	lz := &localZone{
+		name:    origin,
+		records: map[string][]dns.RR{},
+	}
+	zp := dns.NewZoneParser(r, origin, z.File)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("%s: the record is out of zone %s", rr, origin)
+		}
+		if soa, ok := rr.(*dns.SOA); ok {
+			if name != origin {
+				return nil, fmt.Errorf("%s: SOA record must be at the zone apex", rr)
+			}
+			lz.soa = soa
+		}
+		lz.records[name] = append(lz.records[name], rr)
+	}
+	err := zp.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if lz.soa == nil {
+		lz.soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: localZoneTTL},
+			Ns:      "localhost.",
+			Mbox:    "nobody.invalid.",
+			Serial:  1,
+			Refresh: localZoneTTL,
+			Retry:   localZoneTTL,
+			Expire:  86400,
+			Minttl:  localZoneNegTTL,
+		}
+		lz.records[origin] = append(lz.records[origin], lz.soa)
+	}
+	if !lz.hasType(origin, dns.TypeNS) {
+		lz.records[origin] = append(lz.records[origin], &dns.NS{
+			Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: localZoneTTL},
+			Ns:  lz.soa.Ns,
+		})
+	}
+	return lz, nil
+}
+
+func (z *localZone) hasType(name string, qtype uint16) bool {
+	for _, rr := range z.records[name] {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the name exists in the zone:
+// it has records or it's an empty non-terminal (there are records for its subdomains)
+func (z *localZone) exists(name string) bool {
+	if _, ok := z.records[name]; ok {
+		return true
+	}
+	suffix := "." + name
+	for n := range z.records {
+		if strings.HasSuffix(n, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the records for the name.
+// If the name doesn't exist, the records of the closest wildcard ("*.parent") are used.
+func (z *localZone) lookup(name string) ([]dns.RR, bool) {
+	rrs, ok := z.records[name]
+	if ok {
+		return rrs, true
+	}
+	if z.exists(name) {
+		return nil, true
+	}
+
+	for parent := name; parent != z.name; {
+		i := strings.Index(parent, ".")
+		parent = parent[i+1:]
+		wildcard, ok := z.records["*."+parent]
+		if ok {
+			var r []dns.RR
+			for _, rr := range wildcard {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				r = append(r, rr)
+			}
+			return r, true
+		}
+		if z.exists(parent) {
+			break // the closest encloser has no wildcard
+		}
+	}
+	return nil, false
+}
+
+// Create the authoritative response
+func (z *localZone) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		resp.Rcode = dns.RcodeRefused // zone transfers are disabled
+		return resp
+	}
+
+	name := strings.ToLower(q.Name)
+	for i := 0; i != maxLocalCNAMEChain; i++ {
+		rrs, ok := z.lookup(name)
+		if !ok {
+			if len(resp.Answer) == 0 {
+				resp.Rcode = dns.RcodeNameError
+			}
+			break
+		}
+
+		var cname *dns.CNAME
+		found := false
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, dns.Copy(rr))
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if found || cname == nil {
+			break
+		}
+
+		resp.Answer = append(resp.Answer, dns.Copy(cname))
+		name = strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.name, name) {
+			break // the client resolves the target itself
+		}
+	}
+
+	if len(resp.Answer) == 0 || resp.Rcode == dns.RcodeNameError {
+		soa := dns.Copy(z.soa).(*dns.SOA)
+		if soa.Hdr.Ttl > soa.Minttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+		resp.Ns = []dns.RR{soa}
+	}
+	return resp
+}
+
+// Load the local zones.  The zones which can't be loaded are skipped.
+func loadLocalZones(list []LocalZone) map[string]*localZone {
+	if len(list) == 0 {
+		return nil
+	}
+	zones := map[string]*localZone{}
+	for _, z := range list {
+		lz, err := loadLocalZone(z)
+		if err != nil {
+			log.Error("DNS: local zone %s: %s", z.Name, err)
+			continue
+		}
+		zones[lz.name] = lz
+		log.Debug("DNS: local zone %s: loaded %d names", lz.name, len(lz.records))
+	}
+	return zones
+}
+
+// Find the most specific local zone for the name
+func findLocalZone(zones map[string]*localZone, name string) *localZone {
+	if len(zones) == 0 {
+		return nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		z, ok := zones[name]
+		if ok {
+			return z
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+	}
+}
+
+// Respond to the requests for local zones
+func processLocalZones(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone
+	}
+
+	var z *localZone
+	if ctx.view != nil {
+		z = findLocalZone(ctx.view.localZones, d.Req.Question[0].Name)
+	}
+	if z == nil {
+		s.RLock()
+		z = findLocalZone(s.localZones, d.Req.Question[0].Name)
+		s.RUnlock()
+	}
+	if z == nil {
+		return resultDone
+	}
+	d.Res = z.answer(d.Req)
+
+	res := ctx.result
+	if res != nil && res.Reason == dnsfilter.ReasonRewrite && len(res.CanonName) != 0 {
+		// the request was rewritten to a name in the local zone
+		d.Req.Question[0] = ctx.origQuestion
+		d.Res.Question[0] = ctx.origQuestion
+		d.Res.Answer = append([]dns.RR{s.genCNAMEAnswer(d.Req, res.CanonName, s.rewriteTTL(res))}, d.Res.Answer...)
+	}
+	return resultDone
+}
+
+type localZoneJSON struct {
+	LocalZone
+	Loaded bool `json:"loaded"` // status
+}
+
+type localZonesJSON struct {
+	Zones []localZoneJSON `json:"zones"`
+}
+
+func (s *Server) handleLocalZonesList(w http.ResponseWriter, r *http.Request) {
+	j := localZonesJSON{Zones: []localZoneJSON{}}
+	s.RLock()
+	for _, z := range s.conf.LocalZones {
+		zj := localZoneJSON{LocalZone: z}
+		_, zj.Loaded = s.localZones[dns.Fqdn(strings.ToLower(z.Name))]
+		j.Zones = append(j.Zones, zj)
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleLocalZonesSet(w http.ResponseWriter, r *http.Request) {
+	j := localZonesJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	var list []LocalZone
+	for _, zj := range j.Zones {
+		_, err = loadLocalZone(zj.LocalZone)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "%s: %s", zj.Name, err)
+			return
+		}
+		list = append(list, zj.LocalZone)
+	}
+
+	s.Lock()
+	s.conf.LocalZones = list
+	s.localZones = loadLocalZones(list)
+	s.Unlock()
+	s.conf.ConfigModified()
+}
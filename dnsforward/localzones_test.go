@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func localZonesTestRequest(z *localZone, name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	return z.answer(req)
+}
+
+func TestLocalZones(t *testing.T) {
+	z, err := loadLocalZone(LocalZone{
+		Name: "Home.LAN",
+		Records: []string{
+			"nas 3600 IN A 192.168.1.10",
+			"nas 3600 IN AAAA fd00::10",
+			"files 3600 IN CNAME nas",
+			"ext 3600 IN CNAME example.org.",
+			"*.dev 3600 IN A 192.168.1.20",
+			"host.sub 3600 IN A 192.168.1.30",
+		},
+	})
+	assert.Nil(t, err)
+
+	// generated SOA and NS
+	resp := localZonesTestRequest(z, "home.lan.", dns.TypeSOA)
+	assert.True(t, resp.Authoritative)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "localhost.", resp.Answer[0].(*dns.SOA).Ns)
+	resp = localZonesTestRequest(z, "home.lan.", dns.TypeNS)
+	assert.Equal(t, 1, len(resp.Answer))
+
+	resp = localZonesTestRequest(z, "NAS.home.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "192.168.1.10", resp.Answer[0].(*dns.A).A.String())
+
+	resp = localZonesTestRequest(z, "nas.home.lan.", dns.TypeANY)
+	assert.Equal(t, 2, len(resp.Answer))
+
+	// CNAME inside the zone is followed
+	resp = localZonesTestRequest(z, "files.home.lan.", dns.TypeA)
+	assert.Equal(t, 2, len(resp.Answer))
+	assert.Equal(t, "192.168.1.10", resp.Answer[1].(*dns.A).A.String())
+
+	// CNAME to another zone
+	resp = localZonesTestRequest(z, "ext.home.lan.", dns.TypeA)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, 0, len(resp.Ns))
+
+	// wildcard
+	resp = localZonesTestRequest(z, "a.b.dev.home.lan.", dns.TypeA)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "a.b.dev.home.lan.", resp.Answer[0].Header().Name)
+
+	// NODATA
+	resp = localZonesTestRequest(z, "nas.home.lan.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+	assert.Equal(t, 1, len(resp.Ns))
+	assert.Equal(t, uint32(localZoneNegTTL), resp.Ns[0].Header().Ttl)
+
+	// empty non-terminal
+	resp = localZonesTestRequest(z, "sub.home.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	// NXDOMAIN
+	resp = localZonesTestRequest(z, "unknown.home.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Ns))
+	resp = localZonesTestRequest(z, "x.sub.home.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	// zone transfers are disabled
+	resp = localZonesTestRequest(z, "home.lan.", dns.TypeAXFR)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	zones := map[string]*localZone{z.name: z}
+	assert.NotNil(t, findLocalZone(zones, "nas.home.lan"))
+	assert.NotNil(t, findLocalZone(zones, "home.lan."))
+	assert.Nil(t, findLocalZone(zones, "lan."))
+	assert.Nil(t, findLocalZone(zones, "example.org."))
+
+	// out of zone
+	_, err = loadLocalZone(LocalZone{Name: "home.lan", Records: []string{"example.org. 3600 IN A 1.2.3.4"}})
+	assert.NotNil(t, err)
+	_, err = loadLocalZone(LocalZone{Name: "home.lan", Records: []string{"nas IN A 1.2.3"}})
+	assert.NotNil(t, err)
+}
+
+func TestLocalZonesFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "zone")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`$TTL 300
+@ IN SOA ns.home.lan. admin.home.lan. 2020010101 3600 600 86400 30
+@ IN NS ns
+ns IN A 192.168.1.1
+router IN A 192.168.1.1
+`)
+	_ = f.Close()
+
+	z, err := loadLocalZone(LocalZone{Name: "home.lan", File: f.Name()})
+	assert.Nil(t, err)
+	assert.Equal(t, "ns.home.lan.", z.soa.Ns)
+
+	resp := localZonesTestRequest(z, "home.lan.", dns.TypeNS)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "ns.home.lan.", resp.Answer[0].(*dns.NS).Ns)
+
+	resp = localZonesTestRequest(z, "router.home.lan.", dns.TypeAAAA)
+	assert.Equal(t, uint32(30), resp.Ns[0].Header().Ttl)
+}
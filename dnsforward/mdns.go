@@ -0,0 +1,488 @@
+// Resolution of ".local" names via multicast DNS and reflection of mDNS packets between interfaces
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	mdnsPort       = 5353
+	mdnsTimeout    = time.Second // how long to wait for the responses to a query
+	mdnsMaxRecords = 10000       // max number of names in the cache
+	mdnsDomain     = "local."
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+type mdnsRecord struct {
+	rr     dns.RR
+	expire time.Time
+}
+
+// mdnsCtx receives mDNS responses on the network interfaces and keeps their records,
+// so that ".local" names can be resolved by the clients from other subnets
+type mdnsCtx struct {
+	lock      sync.Mutex
+	enabled   bool
+	conn      *ipv4.PacketConn       // nil: not started
+	udpConn   *net.UDPConn           // the underlying socket
+	ifaces    map[int]*net.Interface // interface index -> interface
+	ownAddrs  map[string]bool        // IP addresses of our interfaces
+	reflector bool
+	records   map[string][]mdnsRecord    // lowercase FQDN -> records
+	waiters   map[string][]chan struct{} // lowercase FQDN -> the requests waiting for the records
+	onHost    func(ip, host string)      // called when a new host address is received.  May be nil
+
+	writeLock sync.Mutex // protects the multicast interface setting of the socket
+}
+
+// Check that the interfaces exist and support multicast
+func checkMDNSInterfaces(names []string) error {
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if iface.Flags&net.FlagMulticast == 0 {
+			return fmt.Errorf("%s: the interface doesn't support multicast", name)
+		}
+	}
+	return nil
+}
+
+// Start receiving mDNS packets on the interfaces
+func (m *mdnsCtx) start(names []string, reflector bool, onHost func(ip, host string)) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var ifaces []*net.Interface
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("mDNS: %s: %s", name, err)
+		}
+		ifaces = append(ifaces, iface)
+	}
+
+	// the socket is bound to the mDNS port with SO_REUSEADDR, so that it can be shared with the system mDNS responder
+	c, err := net.ListenMulticastUDP("udp4", ifaces[0], mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("mDNS: %s", err)
+	}
+	p := ipv4.NewPacketConn(c)
+	for _, iface := range ifaces[1:] {
+		err = p.JoinGroup(iface, mdnsGroup)
+		if err != nil {
+			_ = c.Close()
+			return fmt.Errorf("mDNS: %s: %s", iface.Name, err)
+		}
+	}
+	err = p.SetControlMessage(ipv4.FlagInterface, true)
+	if err != nil {
+		_ = c.Close()
+		return fmt.Errorf("mDNS: %s", err)
+	}
+	_ = p.SetMulticastTTL(255) // RFC 6762 section 11
+	_ = p.SetMulticastLoopback(false)
+
+	byIndex := map[int]*net.Interface{}
+	own := map[string]bool{}
+	for _, iface := range ifaces {
+		byIndex[iface.Index] = iface
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				own[ipnet.IP.String()] = true
+			}
+		}
+	}
+
+	m.lock.Lock()
+	m.enabled = true
+	m.conn = p
+	m.udpConn = c
+	m.ifaces = byIndex
+	m.ownAddrs = own
+	m.reflector = reflector
+	m.onHost = onHost
+	if m.records == nil {
+		m.records = map[string][]mdnsRecord{}
+	}
+	m.waiters = map[string][]chan struct{}{}
+	m.lock.Unlock()
+
+	go m.receive(p)
+	log.Info("mDNS: listening on %v (reflector: %t)", names, reflector)
+	return nil
+}
+
+func (m *mdnsCtx) stop() {
+	m.lock.Lock()
+	c := m.udpConn
+	m.enabled = false
+	m.conn = nil
+	m.udpConn = nil
+	m.lock.Unlock()
+
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+func (m *mdnsCtx) receive(p *ipv4.PacketConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := p.ReadFrom(buf)
+		if err != nil {
+			log.Debug("mDNS: receive: %s", err)
+			return
+		}
+		srcAddr, ok := src.(*net.UDPAddr)
+		if cm == nil || !ok {
+			continue
+		}
+
+		m.lock.Lock()
+		_, ok = m.ifaces[cm.IfIndex]
+		own := m.ownAddrs[srcAddr.IP.String()]
+		reflector := m.reflector
+		m.lock.Unlock()
+		if !ok || own {
+			continue
+		}
+
+		msg := &dns.Msg{}
+		err = msg.Unpack(buf[:n])
+		if err != nil {
+			log.Debug("mDNS: %s: %s", srcAddr, err)
+			continue
+		}
+		if msg.Response {
+			m.addRecords(msg, time.Now())
+		}
+		if reflector {
+			m.reflect(p, buf[:n], cm.IfIndex)
+		}
+	}
+}
+
+// Send the packet to the other interfaces
+func (m *mdnsCtx) reflect(p *ipv4.PacketConn, data []byte, from int) {
+	m.lock.Lock()
+	var ifaces []*net.Interface
+	for index, iface := range m.ifaces {
+		if index != from {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, iface := range ifaces {
+		m.write(p, iface, data)
+	}
+}
+
+func (m *mdnsCtx) write(p *ipv4.PacketConn, iface *net.Interface, data []byte) {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	err := p.SetMulticastInterface(iface)
+	if err == nil {
+		_, err = p.WriteTo(data, nil, mdnsGroup)
+	}
+	if err != nil {
+		log.Debug("mDNS: %s: send: %s", iface.Name, err)
+	}
+}
+
+// Store the records from the response.
+// The records with TTL=0 ("goodbye" packets) are removed from the cache.
+func (m *mdnsCtx) addRecords(msg *dns.Msg, now time.Time) {
+	var hosts [][2]string // IP, host name
+
+	m.lock.Lock()
+	names := map[string]bool{}
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		h.Class &^= 0x8000 // cache-flush bit
+		name := strings.ToLower(h.Name)
+
+		var list []mdnsRecord
+		found := false
+		for _, r := range m.records[name] {
+			if now.After(r.expire) {
+				continue
+			}
+			if dns.IsDuplicate(r.rr, rr) {
+				found = true
+				continue
+			}
+			list = append(list, r)
+		}
+		if h.Ttl != 0 {
+			list = append(list, mdnsRecord{rr: rr, expire: now.Add(time.Duration(h.Ttl) * time.Second)})
+			names[name] = true
+
+			if !found && strings.HasSuffix(name, "."+mdnsDomain) {
+				host := strings.TrimSuffix(name, "."+mdnsDomain)
+				switch v := rr.(type) {
+				case *dns.A:
+					hosts = append(hosts, [2]string{v.A.String(), host})
+				case *dns.AAAA:
+					hosts = append(hosts, [2]string{v.AAAA.String(), host})
+				}
+			}
+		}
+		if len(list) != 0 {
+			m.records[name] = list
+		} else {
+			delete(m.records, name)
+		}
+	}
+
+	for name := range names {
+		for _, ch := range m.waiters[name] {
+			close(ch)
+		}
+		delete(m.waiters, name)
+	}
+
+	if len(m.records) > mdnsMaxRecords {
+		m.cleanup(now)
+	}
+	onHost := m.onHost
+	m.lock.Unlock()
+
+	if onHost != nil {
+		for _, h := range hosts {
+			onHost(h[0], h[1])
+		}
+	}
+}
+
+// Remove the expired records.  If there are still too many names, the cache is cleared.
+func (m *mdnsCtx) cleanup(now time.Time) {
+	for name, list := range m.records {
+		var r []mdnsRecord
+		for _, rec := range list {
+			if now.Before(rec.expire) {
+				r = append(r, rec)
+			}
+		}
+		if len(r) != 0 {
+			m.records[name] = r
+		} else {
+			delete(m.records, name)
+		}
+	}
+	if len(m.records) > mdnsMaxRecords {
+		m.records = map[string][]mdnsRecord{}
+	}
+}
+
+// Get the records of the type for the name.  exists: the name has records of any type.
+func (m *mdnsCtx) lookup(name string, qtype uint16, now time.Time) (answer []dns.RR, exists bool) {
+	for _, r := range m.records[name] {
+		if !now.Before(r.expire) {
+			continue
+		}
+		exists = true
+		if r.rr.Header().Rrtype != qtype && qtype != dns.TypeANY {
+			continue
+		}
+		rr := dns.Copy(r.rr)
+		rr.Header().Ttl = uint32(r.expire.Sub(now) / time.Second)
+		answer = append(answer, rr)
+	}
+	return answer, exists
+}
+
+// Send the query to all interfaces
+func (m *mdnsCtx) query(q dns.Question) {
+	m.lock.Lock()
+	p := m.conn
+	var ifaces []*net.Interface
+	for _, iface := range m.ifaces {
+		ifaces = append(ifaces, iface)
+	}
+	m.lock.Unlock()
+	if p == nil {
+		return
+	}
+
+	msg := &dns.Msg{}
+	msg.Question = []dns.Question{{Name: q.Name, Qtype: q.Qtype, Qclass: dns.ClassINET}}
+	data, err := msg.Pack()
+	if err != nil {
+		log.Debug("mDNS: pack: %s", err)
+		return
+	}
+	for _, iface := range ifaces {
+		m.write(p, iface, data)
+	}
+}
+
+// Resolve ".local" name.  Return nil if mDNS is disabled.
+// If there are no records in the cache, the query is sent and the responses are awaited for 1 second.
+func (m *mdnsCtx) resolve(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	m.lock.Lock()
+	if !m.enabled {
+		m.lock.Unlock()
+		return nil
+	}
+	answer, exists := m.lookup(name, q.Qtype, time.Now())
+	if len(answer) == 0 {
+		ch := make(chan struct{})
+		m.waiters[name] = append(m.waiters[name], ch)
+		m.lock.Unlock()
+
+		m.query(q)
+		timer := time.NewTimer(mdnsTimeout)
+		select {
+		case <-ch:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		m.lock.Lock()
+		m.removeWaiter(name, ch)
+		answer, exists = m.lookup(name, q.Qtype, time.Now())
+	}
+	m.lock.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = answer
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+	return resp
+}
+
+func (m *mdnsCtx) removeWaiter(name string, ch chan struct{}) {
+	list := m.waiters[name]
+	for i, c := range list {
+		if c == ch {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) != 0 {
+		m.waiters[name] = list
+	} else {
+		delete(m.waiters, name)
+	}
+}
+
+// Respond to the requests for ".local" names
+func processMDNS(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil || !dns.IsSubDomain(mdnsDomain, strings.ToLower(d.Req.Question[0].Name)) {
+		return resultDone
+	}
+
+	resp := s.mdns.resolve(d.Req)
+	if resp != nil {
+		d.Res = resp
+	}
+	return resultDone
+}
+
+type mdnsHostJSON struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	TTL  uint32 `json:"ttl"`
+}
+
+type mdnsJSON struct {
+	Interfaces []string       `json:"interfaces"`
+	Reflector  bool           `json:"reflector"`
+	Hosts      []mdnsHostJSON `json:"hosts,omitempty"` // status only
+}
+
+func (s *Server) handleMDNSStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := mdnsJSON{
+		Interfaces: stringArrayDup(s.conf.MDNSInterfaces),
+		Reflector:  s.conf.MDNSReflector,
+		Hosts:      []mdnsHostJSON{},
+	}
+	s.RUnlock()
+
+	now := time.Now()
+	s.mdns.lock.Lock()
+	for name := range s.mdns.records {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			answer, _ := s.mdns.lookup(name, qtype, now)
+			for _, rr := range answer {
+				h := mdnsHostJSON{Name: strings.TrimSuffix(name, "."), TTL: rr.Header().Ttl}
+				switch v := rr.(type) {
+				case *dns.A:
+					h.IP = v.A.String()
+				case *dns.AAAA:
+					h.IP = v.AAAA.String()
+				}
+				j.Hosts = append(j.Hosts, h)
+			}
+		}
+	}
+	s.mdns.lock.Unlock()
+	sort.Slice(j.Hosts, func(i, k int) bool {
+		return j.Hosts[i].Name < j.Hosts[k].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleMDNSConfig(w http.ResponseWriter, r *http.Request) {
+	j := mdnsJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkMDNSInterfaces(j.Interfaces)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	s.Lock()
+	s.conf.MDNSInterfaces = j.Interfaces
+	s.conf.MDNSReflector = j.Reflector
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	err = s.Reconfigure(nil)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
@@ -0,0 +1,106 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMDNSRecords(t *testing.T) {
+	var hosts []string
+	m := &mdnsCtx{
+		enabled: true,
+		records: map[string][]mdnsRecord{},
+		waiters: map[string][]chan struct{}{},
+		onHost: func(ip, host string) {
+			hosts = append(hosts, ip+" "+host)
+		},
+	}
+
+	now := time.Now()
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.Answer = []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "NAS.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | 0x8000, Ttl: 120},
+			A:   net.ParseIP("192.168.1.10"),
+		},
+	}
+	m.addRecords(resp, now)
+	assert.Equal(t, []string{"192.168.1.10 nas"}, hosts)
+
+	// the same record again: the host isn't reported twice
+	m.addRecords(resp.Copy(), now.Add(time.Second))
+	assert.Equal(t, 1, len(hosts))
+	assert.Equal(t, 1, len(m.records["nas.local."]))
+
+	answer, exists := m.lookup("nas.local.", dns.TypeA, now.Add(20*time.Second))
+	assert.True(t, exists)
+	assert.Equal(t, 1, len(answer))
+	assert.Equal(t, uint32(101), answer[0].Header().Ttl)
+	assert.Equal(t, uint16(dns.ClassINET), answer[0].Header().Class)
+
+	answer, exists = m.lookup("nas.local.", dns.TypeAAAA, now)
+	assert.True(t, exists)
+	assert.Equal(t, 0, len(answer))
+
+	_, exists = m.lookup("nas.local.", dns.TypeA, now.Add(200*time.Second))
+	assert.False(t, exists)
+
+	// resolve from the cache
+	req := &dns.Msg{}
+	req.SetQuestion("nas.local.", dns.TypeA)
+	r := m.resolve(req)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, 1, len(r.Answer))
+
+	req.SetQuestion("nas.local.", dns.TypeAAAA)
+	r = m.resolve(req)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, 0, len(r.Answer))
+
+	// goodbye packet
+	resp.Answer[0].Header().Ttl = 0
+	m.addRecords(resp, now.Add(2*time.Second))
+	_, exists = m.lookup("nas.local.", dns.TypeA, now.Add(2*time.Second))
+	assert.False(t, exists)
+
+	// no responses
+	r = m.resolve(req)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Equal(t, 0, len(m.waiters))
+
+	m.enabled = false
+	assert.Nil(t, m.resolve(req))
+}
+
+func TestProcessMDNS(t *testing.T) {
+	s := &Server{}
+	s.mdns.enabled = true
+	s.mdns.records = map[string][]mdnsRecord{
+		"printer.local.": {{
+			rr: &dns.A{
+				Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+				A:   net.ParseIP("192.168.1.20"),
+			},
+			expire: time.Now().Add(time.Minute),
+		}},
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("printer.local.", dns.TypeA)
+	ctx := &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req}}
+	assert.Equal(t, resultDone, processMDNS(ctx))
+	assert.NotNil(t, ctx.proxyCtx.Res)
+	assert.Equal(t, 1, len(ctx.proxyCtx.Res.Answer))
+
+	req = &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	ctx = &dnsContext{srv: s, proxyCtx: &proxy.DNSContext{Req: req}}
+	assert.Equal(t, resultDone, processMDNS(ctx))
+	assert.Nil(t, ctx.proxyCtx.Res)
+}
@@ -0,0 +1,179 @@
+// DNS server metrics in Prometheus text format
+
+package dnsforward
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+// Upper bounds of the upstream latency histogram buckets (in seconds)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Histogram of upstream response times
+type latencyHistogram struct {
+	buckets []uint64 // the number of observations for each bucket (not cumulative)
+	count   uint64
+	sum     float64 // in seconds
+}
+
+func (h *latencyHistogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// DNS server counters
+type metrics struct {
+	lock          sync.Mutex
+	queries       uint64
+	reasons       map[dnsfilter.Reason]uint64
+	filterMatches map[int64]uint64             // filter list ID -> number of matched requests
+	upstreams     map[string]*latencyHistogram // upstream address -> response times
+
+	doqConnections uint64 // number of accepted DNS-over-QUIC connections
+	doqActive      int64  // number of open DNS-over-QUIC connections
+	doqQueries     uint64 // number of DNS-over-QUIC requests
+}
+
+// Count a processed request
+func (m *metrics) countQuery(res *dnsfilter.Result) {
+	m.lock.Lock()
+	m.queries++
+	if res != nil {
+		if m.reasons == nil {
+			m.reasons = make(map[dnsfilter.Reason]uint64)
+		}
+		m.reasons[res.Reason]++
+
+		if len(res.Rule) != 0 {
+			if m.filterMatches == nil {
+				m.filterMatches = make(map[int64]uint64)
+			}
+			m.filterMatches[res.FilterID]++
+		}
+	}
+	m.lock.Unlock()
+}
+
+// Count a response from upstream server
+func (m *metrics) observeUpstream(addr string, elapsed time.Duration) {
+	m.lock.Lock()
+	if m.upstreams == nil {
+		m.upstreams = make(map[string]*latencyHistogram)
+	}
+	h, ok := m.upstreams[addr]
+	if !ok {
+		h = &latencyHistogram{}
+		m.upstreams[addr] = h
+	}
+	h.observe(elapsed.Seconds())
+	m.lock.Unlock()
+}
+
+// Count an opened (delta=1) or closed (delta=-1) DNS-over-QUIC connection
+func (m *metrics) countDoQConnection(delta int64) {
+	m.lock.Lock()
+	if delta > 0 {
+		m.doqConnections++
+	}
+	m.doqActive += delta
+	m.lock.Unlock()
+}
+
+// Count a DNS-over-QUIC request
+func (m *metrics) countDoQQuery() {
+	m.lock.Lock()
+	m.doqQueries++
+	m.lock.Unlock()
+}
+
+// Write the header of a metric
+func writeMetricHeader(w io.Writer, name string, typ string, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteMetrics writes DNS server metrics in Prometheus text format
+func (s *Server) WriteMetrics(w io.Writer) {
+	m := &s.metrics
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeMetricHeader(w, "adguard_dns_queries_total", "counter", "Number of processed DNS queries.")
+	_, _ = fmt.Fprintf(w, "adguard_dns_queries_total %d\n", m.queries)
+
+	writeMetricHeader(w, "adguard_dns_queries_by_reason_total", "counter", "Number of DNS queries by filtering result.")
+	reasons := []int{}
+	for r := range m.reasons {
+		reasons = append(reasons, int(r))
+	}
+	sort.Ints(reasons)
+	for _, r := range reasons {
+		reason := dnsfilter.Reason(r)
+		_, _ = fmt.Fprintf(w, "adguard_dns_queries_by_reason_total{reason=%q} %d\n", reason.String(), m.reasons[reason])
+	}
+
+	writeMetricHeader(w, "adguard_filter_matches_total", "counter", "Number of DNS queries matched by filtering rules of a filter list.")
+	ids := []int64{}
+	for id := range m.filterMatches {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		_, _ = fmt.Fprintf(w, "adguard_filter_matches_total{filter_id=\"%d\"} %d\n", id, m.filterMatches[id])
+	}
+
+	writeMetricHeader(w, "adguard_upstream_latency_seconds", "histogram", "Response time of upstream servers.")
+	addrs := []string{}
+	for addr := range m.upstreams {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		h := m.upstreams[addr]
+		cumulative := uint64(0)
+		for i, b := range latencyBuckets {
+			cumulative += h.buckets[i]
+			_, _ = fmt.Fprintf(w, "adguard_upstream_latency_seconds_bucket{upstream=%q,le=\"%s\"} %d\n",
+				addr, formatFloat(b), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "adguard_upstream_latency_seconds_bucket{upstream=%q,le=\"+Inf\"} %d\n", addr, h.count)
+		_, _ = fmt.Fprintf(w, "adguard_upstream_latency_seconds_sum{upstream=%q} %s\n", addr, formatFloat(h.sum))
+		_, _ = fmt.Fprintf(w, "adguard_upstream_latency_seconds_count{upstream=%q} %d\n", addr, h.count)
+	}
+
+	writeMetricHeader(w, "adguard_doq_connections_total", "counter", "Number of accepted DNS-over-QUIC connections.")
+	_, _ = fmt.Fprintf(w, "adguard_doq_connections_total %d\n", m.doqConnections)
+	writeMetricHeader(w, "adguard_doq_connections", "gauge", "Number of open DNS-over-QUIC connections.")
+	_, _ = fmt.Fprintf(w, "adguard_doq_connections %d\n", m.doqActive)
+	writeMetricHeader(w, "adguard_doq_queries_total", "counter", "Number of DNS-over-QUIC requests.")
+	_, _ = fmt.Fprintf(w, "adguard_doq_queries_total %d\n", m.doqQueries)
+
+	writeMetricHeader(w, "adguard_stale_responses_total", "counter", "Number of responses served from expired cache entries.")
+	_, _ = fmt.Fprintf(w, "adguard_stale_responses_total %d\n", atomic.LoadUint64(&s.stale.served))
+
+	writeMetricHeader(w, "adguard_prefetch_requests_total", "counter", "Number of requests sent upstream to refresh popular cache entries.")
+	_, _ = fmt.Fprintf(w, "adguard_prefetch_requests_total %d\n", atomic.LoadUint64(&s.prefetch.requests))
+
+	writeMetricHeader(w, "adguard_ratelimited_queries_total", "counter", "Number of DNS queries throttled by rate limiting.")
+	_, _ = fmt.Fprintf(w, "adguard_ratelimited_queries_total %d\n", atomic.LoadUint64(&s.ratelimit.throttled))
+}
@@ -0,0 +1,489 @@
+// Source address binding for the requests sent to upstream servers
+
+package dnsforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// UpstreamSource sets the source address for the requests to an upstream server
+type UpstreamSource struct {
+	Upstream string `yaml:"upstream" json:"upstream"` // upstream address as in the list of upstreams ("tls://dns.example")
+	Source   string `yaml:"source" json:"source"`     // IP address or network interface name ("192.168.1.2", "wg0")
+}
+
+type outboundCtx struct {
+	lock      sync.Mutex
+	source    string            // the default source.  "": chosen by OS
+	sources   map[string]string // upstream address -> source
+	bootstrap []string          // plain DNS servers to resolve the host names of upstream servers
+	pool      UpstreamPoolConfig
+	bound     map[string]upstream.Upstream
+}
+
+// Check the source: IP address or the name of an existing network interface
+func checkUpstreamSource(source string) error {
+	if net.ParseIP(source) != nil {
+		return nil
+	}
+	_, err := net.InterfaceByName(source)
+	if err != nil {
+		return fmt.Errorf("invalid source %s: %s", source, err)
+	}
+	return nil
+}
+
+func (o *outboundCtx) configure(conf *FilteringConfig) error {
+	sources := map[string]string{}
+	for _, us := range conf.UpstreamSources {
+		u, err := upstream.AddressToUpstream(us.Upstream, upstream.Options{Bootstrap: conf.BootstrapDNS, Timeout: DefaultTimeout})
+		if err != nil {
+			return fmt.Errorf("upstream_sources: %s: %s", us.Upstream, err)
+		}
+		err = checkUpstreamSource(us.Source)
+		if err != nil {
+			return fmt.Errorf("upstream_sources: %s", err)
+		}
+		sources[u.Address()] = us.Source
+	}
+	if len(conf.UpstreamSource) != 0 {
+		err := checkUpstreamSource(conf.UpstreamSource)
+		if err != nil {
+			return fmt.Errorf("upstream_source: %s", err)
+		}
+	}
+
+	err := checkUpstreamPoolConfig(conf.UpstreamPool)
+	if err != nil {
+		return fmt.Errorf("upstream_pool: %s", err)
+	}
+
+	o.lock.Lock()
+	old := o.bound
+	o.source = conf.UpstreamSource
+	o.sources = sources
+	o.bootstrap = stringArrayDup(conf.BootstrapDNS)
+	o.pool = conf.UpstreamPool
+	o.bound = map[string]upstream.Upstream{}
+	o.lock.Unlock()
+
+	for _, u := range old {
+		if b, ok := u.(*boundUpstream); ok && b.pool != nil {
+			b.pool.close()
+		}
+	}
+	return nil
+}
+
+// Replace the upstreams with the objects which send the requests from the configured source address
+// and reuse the connections to the servers.
+// The objects are created once for every upstream address.
+func (o *outboundCtx) bind(list []upstream.Upstream) []upstream.Upstream {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.source) == 0 && len(o.sources) == 0 && !o.pool.Enabled {
+		return list
+	}
+
+	r := make([]upstream.Upstream, len(list))
+	for i, u := range list {
+		r[i] = u
+		addr := u.Address()
+		source, ok := o.sources[addr]
+		if !ok {
+			source = o.source
+		}
+		uurl := upstreamURL(u)
+		pooled := o.pool.Enabled && isPoolableUpstream(uurl)
+		if len(source) == 0 && !pooled {
+			continue
+		}
+
+		b, ok := o.bound[addr]
+		if !ok {
+			bu, err := newBoundUpstream(uurl, source, o.bootstrap)
+			if err != nil {
+				log.Error("DNS: %s: can't bind the upstream (source: %q): %s", addr, source, err)
+				b = u
+			} else {
+				bu.addr = addr
+				if pooled {
+					bu.initPool(o.pool)
+				}
+				b = bu
+			}
+			o.bound[addr] = b
+		}
+		r[i] = b
+	}
+	return r
+}
+
+// Get the address of the upstream with the protocol prefix.
+// dnsproxy omits the prefix of DNS-over-TLS and DNS-over-TCP upstreams in Address().
+func upstreamURL(u upstream.Upstream) string {
+	addr := u.Address()
+	if strings.Contains(addr, "://") {
+		return addr
+	}
+
+	v := reflect.ValueOf(u)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return addr
+	}
+	switch v.Type().Name() {
+	case "dnsOverTLS":
+		return "tls://" + addr
+	case "plainDNS":
+		f := v.FieldByName("preferTCP")
+		if f.IsValid() && f.Kind() == reflect.Bool && f.Bool() {
+			return "tcp://" + addr
+		}
+	}
+	return addr
+}
+
+// Bind the upstreams to the source address and wrap them according to the upstream selection strategy
+func (s *Server) wrapUpstreams(list []upstream.Upstream) []upstream.Upstream {
+	return s.selector.wrap(s.outbound.bind(list))
+}
+
+// boundUpstream sends the requests from the specified source address
+// and keeps the connections to the server open for the next requests
+type boundUpstream struct {
+	addr      string // the address of the original upstream
+	proto     string // "udp", "tcp", "tls", "https"
+	host      string // host name or IP address of the server
+	port      string
+	url       string // DoH URL
+	source    string // IP address or network interface name.  "": chosen by OS
+	bootstrap []string
+
+	httpClient *http.Client
+	pool       *connPool // nil: a new connection is opened for every request
+
+	lock     sync.Mutex
+	ip       net.IP // resolved IP address of the server
+	ipExpire time.Time
+}
+
+const minBootstrapTTL = 60 // seconds
+
+func newBoundUpstream(addr, source string, bootstrap []string) (*boundUpstream, error) {
+	u := &boundUpstream{addr: addr, source: source, bootstrap: bootstrap}
+
+	hostport := addr
+	defaultPort := "53"
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		u.proto = "udp"
+		hostport = addr[len("udp://"):]
+	case strings.HasPrefix(addr, "tcp://"):
+		u.proto = "tcp"
+		hostport = addr[len("tcp://"):]
+	case strings.HasPrefix(addr, "tls://"):
+		u.proto = "tls"
+		hostport = addr[len("tls://"):]
+		defaultPort = "853"
+	case strings.HasPrefix(addr, "https://"):
+		u.proto = "https"
+		u.url = addr
+		parsed, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		hostport = parsed.Host
+		defaultPort = "443"
+	case strings.Contains(addr, "://"):
+		return nil, fmt.Errorf("the protocol isn't supported")
+	default:
+		u.proto = "udp"
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+		port = defaultPort
+	}
+	u.host = host
+	u.port = port
+
+	if u.proto == "https" {
+		u.httpClient = &http.Client{
+			Timeout: DefaultTimeout,
+			Transport: &http.Transport{
+				DialContext:         u.dialContext,
+				TLSClientConfig:     &tls.Config{ServerName: host},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConns:        1,
+				IdleConnTimeout:     5 * time.Minute,
+				TLSHandshakeTimeout: DefaultTimeout,
+			},
+		}
+	}
+	return u, nil
+}
+
+// Address returns the address of the original upstream,
+// so that the statistics and health checks don't depend on the source
+func (u *boundUpstream) Address() string {
+	return u.addr
+}
+
+// Get the source IP address of the same family as the server address.  nil: chosen by OS.
+func (u *boundUpstream) sourceIP(server net.IP) (net.IP, error) {
+	if len(u.source) == 0 {
+		return nil, nil
+	}
+	ip := net.ParseIP(u.source)
+	if ip != nil {
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(u.source)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := server.To4() != nil
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) == ipv4 {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no suitable address for %s", u.source, server)
+}
+
+// Resolve the host name of the server via the bootstrap servers.
+// The address is cached for the TTL of the record.
+func (u *boundUpstream) resolve() (net.IP, error) {
+	ip := net.ParseIP(u.host)
+	if ip != nil {
+		return ip, nil
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.ip != nil && time.Now().Before(u.ipExpire) {
+		return u.ip, nil
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(u.host), dns.TypeA)
+	var lastErr error
+	for _, b := range u.bootstrap {
+		bip := net.ParseIP(b)
+		port := "53"
+		if bip == nil {
+			h, p, err := net.SplitHostPort(b)
+			if err != nil {
+				continue
+			}
+			bip = net.ParseIP(h)
+			port = p
+		}
+		if bip == nil {
+			continue
+		}
+
+		resp, err := u.exchangePlain(req, "udp", net.JoinHostPort(bip.String(), port), bip)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, a := range resp.Answer {
+			if v, ok := a.(*dns.A); ok {
+				ttl := v.Hdr.Ttl
+				if ttl < minBootstrapTTL {
+					ttl = minBootstrapTTL
+				}
+				u.ip = v.A
+				u.ipExpire = time.Now().Add(time.Duration(ttl) * time.Second)
+				return v.A, nil
+			}
+		}
+		lastErr = fmt.Errorf("no A records for %s", u.host)
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	// no bootstrap servers: use the system resolver
+	addrs, err := net.LookupIP(u.host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if a.To4() != nil {
+			u.ip = a
+			u.ipExpire = time.Now().Add(minBootstrapTTL * time.Second)
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 addresses for %s", u.host)
+}
+
+func (u *boundUpstream) dialer(server net.IP, network string) (*net.Dialer, error) {
+	src, err := u.sourceIP(server)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: DefaultTimeout}
+	if network == "udp" {
+		if src != nil {
+			d.LocalAddr = &net.UDPAddr{IP: src}
+		}
+		return d, nil
+	}
+
+	if src != nil {
+		d.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	if u.pool != nil && u.pool.fastOpen {
+		d.Control = tcpFastOpenControl
+	}
+	return d, nil
+}
+
+func (u *boundUpstream) exchangePlain(m *dns.Msg, network, addr string, server net.IP) (*dns.Msg, error) {
+	dialNet := network
+	if network == "tcp-tls" {
+		dialNet = "tcp"
+	}
+	d, err := u.dialer(server, dialNet)
+	if err != nil {
+		return nil, err
+	}
+	c := &dns.Client{Net: network, Dialer: d, Timeout: DefaultTimeout}
+	if network == "tcp-tls" {
+		c.TLSConfig = &tls.Config{ServerName: u.host}
+	}
+	resp, _, err := c.Exchange(m, addr)
+	return resp, err
+}
+
+// Used by HTTP transport for DoH connections
+func (u *boundUpstream) dialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	server, err := u.resolve()
+	if err != nil {
+		return nil, err
+	}
+	d, err := u.dialer(server, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.DialContext(ctx, network, net.JoinHostPort(server.String(), u.port))
+	if err != nil && u.pool != nil {
+		u.pool.addFailed()
+	}
+	return c, err
+}
+
+func (u *boundUpstream) exchangeHTTPS(m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	if u.pool != nil {
+		u.pool.flushHTTP(u.httpClient.Transport.(*http.Transport), time.Now())
+		var start time.Time
+		trace := &httptrace.ClientTrace{
+			GetConn: func(string) {
+				start = time.Now()
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				if info.Reused {
+					u.pool.addReused()
+				} else {
+					u.pool.addOpened(time.Since(start))
+				}
+			},
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP status %d", u.url, resp.StatusCode)
+	}
+
+	r := &dns.Msg{}
+	err = r.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Exchange sends the request to the server
+func (u *boundUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if u.proto == "https" {
+		return u.exchangeHTTPS(m)
+	}
+
+	server, err := u.resolve()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(server.String(), u.port)
+
+	switch u.proto {
+	case "tcp":
+		if u.pool != nil {
+			return u.exchangePooled(m, "tcp", addr, server)
+		}
+		return u.exchangePlain(m, "tcp", addr, server)
+	case "tls":
+		if u.pool != nil {
+			return u.exchangePooled(m, "tcp-tls", addr, server)
+		}
+		return u.exchangePlain(m, "tcp-tls", addr, server)
+	}
+
+	resp, err := u.exchangePlain(m, "udp", addr, server)
+	if err == nil && resp.Truncated {
+		return u.exchangePlain(m, "tcp", addr, server)
+	}
+	return resp, err
+}
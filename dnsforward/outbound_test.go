@@ -0,0 +1,153 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBoundUpstream(t *testing.T) {
+	u, err := newBoundUpstream("8.8.8.8", "127.0.0.1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "udp", u.proto)
+	assert.Equal(t, "8.8.8.8", u.host)
+	assert.Equal(t, "53", u.port)
+
+	u, err = newBoundUpstream("tcp://8.8.8.8:5353", "127.0.0.1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp", u.proto)
+	assert.Equal(t, "5353", u.port)
+
+	u, err = newBoundUpstream("tls://dns.example", "127.0.0.1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "tls", u.proto)
+	assert.Equal(t, "dns.example", u.host)
+	assert.Equal(t, "853", u.port)
+
+	u, err = newBoundUpstream("https://[2001:db8::1]/dns-query", "127.0.0.1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "https", u.proto)
+	assert.Equal(t, "2001:db8::1", u.host)
+	assert.Equal(t, "443", u.port)
+	assert.NotNil(t, u.httpClient)
+	assert.Equal(t, "https://[2001:db8::1]/dns-query", u.Address())
+
+	_, err = newBoundUpstream("quic://dns.example", "127.0.0.1", nil)
+	assert.NotNil(t, err)
+
+	ip, err := u.sourceIP(net.ParseIP("8.8.8.8"))
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip.String())
+
+	u, _ = newBoundUpstream("8.8.8.8", "no-such-interface", nil)
+	_, err = u.sourceIP(net.ParseIP("8.8.8.8"))
+	assert.NotNil(t, err)
+}
+
+func TestOutboundBind(t *testing.T) {
+	u1, _ := upstream.AddressToUpstream("8.8.8.8", upstream.Options{Timeout: DefaultTimeout})
+	u2, _ := upstream.AddressToUpstream("1.1.1.1", upstream.Options{Timeout: DefaultTimeout})
+	list := []upstream.Upstream{u1, u2}
+
+	o := outboundCtx{}
+	conf := FilteringConfig{}
+	assert.Nil(t, o.configure(&conf))
+	r := o.bind(list)
+	assert.True(t, r[0] == u1)
+	assert.True(t, r[1] == u2)
+
+	conf.UpstreamSources = []UpstreamSource{{Upstream: "1.1.1.1", Source: "127.0.0.1"}}
+	assert.Nil(t, o.configure(&conf))
+	r = o.bind(list)
+	assert.True(t, r[0] == u1)
+	b, ok := r[1].(*boundUpstream)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", b.source)
+	assert.Equal(t, u2.Address(), b.Address())
+
+	// the bound objects are created once
+	r2 := o.bind(list)
+	assert.True(t, r2[1] == r[1])
+
+	conf.UpstreamSource = "127.0.0.2"
+	assert.Nil(t, o.configure(&conf))
+	r = o.bind(list)
+	assert.Equal(t, "127.0.0.2", r[0].(*boundUpstream).source)
+	assert.Equal(t, "127.0.0.1", r[1].(*boundUpstream).source)
+
+	conf.UpstreamSource = "no-such-interface"
+	assert.NotNil(t, o.configure(&conf))
+}
+
+func TestConnPool(t *testing.T) {
+	p := newConnPool(UpstreamPoolConfig{Enabled: true, MaxIdle: 2, MaxAge: 60})
+	assert.Equal(t, defaultPoolIdleTimeout*time.Second, p.idleTimeout)
+
+	now := time.Now()
+	newConn := func() *pooledConn {
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return &pooledConn{conn: &dns.Conn{Conn: c1}, created: now, lastUse: now}
+	}
+	assert.Nil(t, p.get(now))
+
+	pc1 := newConn()
+	pc2 := newConn()
+	pc3 := newConn()
+	p.put(pc1, now)
+	p.put(pc2, now)
+	p.put(pc3, now) // the pool is full
+	assert.Equal(t, 2, len(p.idle))
+
+	// the most recently used connection is returned first
+	assert.True(t, p.get(now) == pc2)
+	assert.Equal(t, uint64(1), p.reused)
+
+	// idle timeout
+	assert.Nil(t, p.get(now.Add(31*time.Second)))
+	assert.Equal(t, 0, len(p.idle))
+
+	// max age
+	p.put(pc2, now.Add(59*time.Second))
+	assert.True(t, p.get(now.Add(59*time.Second)) == pc2)
+	p.put(pc2, now.Add(61*time.Second))
+	assert.Equal(t, 0, len(p.idle))
+
+	assert.NotNil(t, checkUpstreamPoolConfig(UpstreamPoolConfig{MaxIdle: 65}))
+	assert.Nil(t, checkUpstreamPoolConfig(UpstreamPoolConfig{MaxIdle: 64}))
+}
+
+func TestOutboundBindPool(t *testing.T) {
+	u1, _ := upstream.AddressToUpstream("8.8.8.8", upstream.Options{Timeout: DefaultTimeout})
+	u2, _ := upstream.AddressToUpstream("tls://8.8.8.8", upstream.Options{Timeout: DefaultTimeout})
+	list := []upstream.Upstream{u1, u2}
+
+	o := outboundCtx{}
+	conf := FilteringConfig{UpstreamPool: UpstreamPoolConfig{Enabled: true}}
+	assert.Nil(t, o.configure(&conf))
+	r := o.bind(list)
+	assert.True(t, r[0] == u1)
+	b, ok := r[1].(*boundUpstream)
+	assert.True(t, ok)
+	assert.Equal(t, "", b.source)
+	assert.NotNil(t, b.pool)
+	assert.Equal(t, defaultPoolMaxIdle, b.pool.maxIdle)
+
+	ip, err := b.sourceIP(net.ParseIP("8.8.8.8"))
+	assert.Nil(t, err)
+	assert.Nil(t, ip)
+
+	stats := o.poolStats()
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, u2.Address(), stats[0].Address)
+
+	// the protocol is detected by the upstream type, not by its address
+	assert.Equal(t, "tls", b.proto)
+	u3, _ := upstream.AddressToUpstream("tcp://8.8.8.8", upstream.Options{Timeout: DefaultTimeout})
+	assert.Equal(t, "tcp://8.8.8.8:53", upstreamURL(u3))
+	assert.Equal(t, "8.8.8.8:53", upstreamURL(u1))
+}
@@ -0,0 +1,194 @@
+package dnsforward
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// PluginRequest contains the information about a DNS request passed to the plugin hooks
+type PluginRequest struct {
+	Msg      *dns.Msg // DNS request.  Must not be modified.
+	ClientIP string   // client's IP address (or the address from EDNS Client Subnet option)
+	ClientID string   // client ID from DoH path or DoT server name.  "": not set
+	Protocol string   // "udp", "tcp", "tls", "https" or "quic"
+}
+
+// Plugin is an extension of the DNS request processing pipeline.
+// The hooks are called synchronously for every request, so they must not block for a long time.
+// The hooks may be called concurrently.
+type Plugin interface {
+	// Name returns the name of the plugin for the log messages
+	Name() string
+
+	// BeforeFilter is called before the request is filtered.
+	// Return a non-nil response (e.g. created with SetReply()) to answer the request immediately:
+	//  the filtering and the upstream servers are skipped then.
+	BeforeFilter(req *PluginRequest) *dns.Msg
+
+	// AfterFilter is called when the filtering result is ready.
+	// The plugin may block the request (set IsFiltered=true, e.g. with Reason=FilteredExternal)
+	//  or unblock it (set IsFiltered=false and Reason=NotFilteredWhiteList).
+	AfterFilter(req *PluginRequest, res *dnsfilter.Result)
+
+	// OnResponse is called when the response is ready to be sent to the client.
+	// The plugin may modify the response.
+	OnResponse(req *PluginRequest, resp *dns.Msg)
+}
+
+// BasePlugin implements all hooks of Plugin interface and does nothing.
+// Embed it to implement only the necessary hooks.
+type BasePlugin struct{}
+
+// BeforeFilter - Plugin interface
+func (BasePlugin) BeforeFilter(req *PluginRequest) *dns.Msg { return nil }
+
+// AfterFilter - Plugin interface
+func (BasePlugin) AfterFilter(req *PluginRequest, res *dnsfilter.Result) {}
+
+// OnResponse - Plugin interface
+func (BasePlugin) OnResponse(req *PluginRequest, resp *dns.Msg) {}
+
+// PluginFactory creates a plugin with the settings from the configuration file
+type PluginFactory func(conf map[string]string) (Plugin, error)
+
+var (
+	pluginFactories     = map[string]PluginFactory{}
+	pluginFactoriesLock sync.Mutex
+)
+
+// RegisterPlugin makes a built-in plugin available by name.
+// Call it from init() of the package which implements the plugin.
+func RegisterPlugin(name string, f PluginFactory) {
+	pluginFactoriesLock.Lock()
+	defer pluginFactoriesLock.Unlock()
+	_, ok := pluginFactories[name]
+	if ok {
+		panic(fmt.Sprintf("plugin %s is already registered", name))
+	}
+	pluginFactories[name] = f
+}
+
+// NewPlugin creates a built-in plugin registered with RegisterPlugin()
+func NewPlugin(name string, conf map[string]string) (Plugin, error) {
+	pluginFactoriesLock.Lock()
+	f, ok := pluginFactories[name]
+	pluginFactoriesLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin: %s", name)
+	}
+	return f(conf)
+}
+
+// RegisteredPlugins returns the sorted names of the built-in plugins
+func RegisteredPlugins() []string {
+	pluginFactoriesLock.Lock()
+	defer pluginFactoriesLock.Unlock()
+	names := []string{}
+	for name := range pluginFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Call the plugin's hook.
+// A panic in the third-party code must not crash the server: log it and continue.
+func callPlugin(p Plugin, hook string, f func()) (ok bool) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			log.Error("DNS: plugin %s: %s: panic: %v\n%s", p.Name(), hook, v, debug.Stack())
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+func (ctx *dnsContext) pluginRequest() *PluginRequest {
+	if ctx.pluginReq == nil {
+		ctx.pluginReq = &PluginRequest{
+			Msg:      ctx.proxyCtx.Req,
+			ClientIP: ctx.clientIP,
+			ClientID: ctx.clientID,
+			Protocol: ctx.proxyCtx.Proto,
+		}
+	}
+	return ctx.pluginReq
+}
+
+// Pass the request to the plugins' BeforeFilter hooks.
+// The first plugin which returns the response wins.
+func processPluginsBeforeFilter(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if len(s.conf.Plugins) == 0 {
+		return resultDone
+	}
+
+	req := ctx.pluginRequest()
+	for _, p := range s.conf.Plugins {
+		var resp *dns.Msg
+		if !callPlugin(p, "BeforeFilter", func() { resp = p.BeforeFilter(req) }) || resp == nil {
+			continue
+		}
+		resp.Id = d.Req.Id
+		d.Res = resp
+		ctx.plugin = p.Name()
+		log.Debug("DNS: plugin %s: response for %s", ctx.plugin, d.Req.Question[0].Name)
+		break
+	}
+	return resultDone
+}
+
+// Pass the filtering result to the plugins' AfterFilter hooks.
+// Generate a new response if a plugin has changed the verdict.
+func processPluginsAfterFilter(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if len(s.conf.Plugins) == 0 || len(ctx.plugin) != 0 {
+		return resultDone
+	}
+
+	req := ctx.pluginRequest()
+	filtered := ctx.result.IsFiltered
+	for _, p := range s.conf.Plugins {
+		res := *ctx.result
+		if callPlugin(p, "AfterFilter", func() { p.AfterFilter(req, &res) }) {
+			*ctx.result = res
+		}
+	}
+
+	if filtered == ctx.result.IsFiltered {
+		return resultDone
+	}
+
+	if ctx.result.IsFiltered {
+		d.Res = s.genDNSFilterMessage(d, ctx.result)
+	} else {
+		d.Res = nil // pass the request to upstream servers
+	}
+	log.Debug("DNS: plugins: %s: filtered: %t -> %t", d.Req.Question[0].Name, filtered, ctx.result.IsFiltered)
+	return resultDone
+}
+
+// Pass the response to the plugins' OnResponse hooks
+func processPluginsOnResponse(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if len(s.conf.Plugins) == 0 || d.Res == nil {
+		return resultDone
+	}
+
+	req := ctx.pluginRequest()
+	for _, p := range s.conf.Plugins {
+		_ = callPlugin(p, "OnResponse", func() { p.OnResponse(req, d.Res) })
+	}
+	return resultDone
+}
@@ -0,0 +1,121 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPlugin struct {
+	BasePlugin
+	responses int
+}
+
+func (p *testPlugin) Name() string {
+	return "test"
+}
+
+func (p *testPlugin) BeforeFilter(req *PluginRequest) *dns.Msg {
+	if req.Msg.Question[0].Name != "quota.example.org." {
+		return nil
+	}
+	resp := &dns.Msg{}
+	resp.SetRcode(req.Msg, dns.RcodeRefused)
+	return resp
+}
+
+func (p *testPlugin) AfterFilter(req *PluginRequest, res *dnsfilter.Result) {
+	switch req.Msg.Question[0].Name {
+	case "threat.example.org.":
+		res.IsFiltered = true
+		res.Reason = dnsfilter.FilteredExternal
+		res.Rule = "test"
+	case "allowed.example.org.":
+		res.IsFiltered = false
+		res.Reason = dnsfilter.NotFilteredWhiteList
+	case "panic.example.org.":
+		res.IsFiltered = true
+		panic("test")
+	}
+}
+
+func (p *testPlugin) OnResponse(req *PluginRequest, resp *dns.Msg) {
+	if req.ClientIP == "1.2.3.4" {
+		p.responses++
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	p := &testPlugin{}
+	s := &Server{}
+	s.conf.BlockingMode = "null_ip"
+	s.conf.Plugins = []Plugin{p}
+
+	process := func(host string, res *dnsfilter.Result) *dnsContext {
+		req := &dns.Msg{}
+		req.SetQuestion(host, dns.TypeA)
+		ctx := &dnsContext{
+			srv:      s,
+			proxyCtx: &proxy.DNSContext{Req: req},
+			result:   res,
+			clientIP: "1.2.3.4",
+		}
+		if res.IsFiltered {
+			ctx.proxyCtx.Res = s.genDNSFilterMessage(ctx.proxyCtx, res)
+		}
+		assert.Equal(t, resultDone, processPluginsBeforeFilter(ctx))
+		assert.Equal(t, resultDone, processFilteringBeforeRequest(ctx))
+		assert.Equal(t, resultDone, processPluginsAfterFilter(ctx))
+		assert.Equal(t, resultDone, processPluginsOnResponse(ctx))
+		return ctx
+	}
+
+	// the plugin has answered the request
+	ctx := process("quota.example.org.", &dnsfilter.Result{})
+	assert.Equal(t, "test", ctx.plugin)
+	assert.Equal(t, dns.RcodeRefused, ctx.proxyCtx.Res.Rcode)
+	assert.Equal(t, ctx.proxyCtx.Req.Id, ctx.proxyCtx.Res.Id)
+	assert.Equal(t, 1, p.responses)
+
+	// the plugin has blocked the request
+	ctx = process("threat.example.org.", &dnsfilter.Result{})
+	assert.True(t, ctx.result.IsFiltered)
+	assert.Equal(t, dnsfilter.FilteredExternal, ctx.result.Reason)
+	assert.Equal(t, "0.0.0.0", ctx.proxyCtx.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 2, p.responses)
+
+	// the plugin has unblocked the request
+	ctx = process("allowed.example.org.", &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList})
+	assert.False(t, ctx.result.IsFiltered)
+	assert.Nil(t, ctx.proxyCtx.Res)
+	assert.Equal(t, 2, p.responses)
+
+	// the changes made by a panicking plugin are ignored
+	ctx = process("panic.example.org.", &dnsfilter.Result{})
+	assert.False(t, ctx.result.IsFiltered)
+	assert.Nil(t, ctx.proxyCtx.Res)
+
+	// no changes
+	ctx = process("example.org.", &dnsfilter.Result{})
+	assert.Equal(t, "", ctx.plugin)
+	assert.False(t, ctx.result.IsFiltered)
+	assert.Nil(t, ctx.proxyCtx.Res)
+}
+
+func TestRegisterPlugin(t *testing.T) {
+	RegisterPlugin("test-registry", func(conf map[string]string) (Plugin, error) {
+		return &testPlugin{}, nil
+	})
+	assert.Contains(t, RegisteredPlugins(), "test-registry")
+	assert.Panics(t, func() { RegisterPlugin("test-registry", nil) })
+
+	p, err := NewPlugin("test-registry", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", p.Name())
+
+	_, err = NewPlugin("unknown", nil)
+	assert.NotNil(t, err)
+}
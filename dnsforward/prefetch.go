@@ -0,0 +1,294 @@
+// Prefetching of popular domains: the responses are refreshed before they expire
+
+package dnsforward
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPrefetchSize    = 1000
+	defaultPrefetchMinHits = 5
+	defaultPrefetchBudget  = 600 // requests per minute
+	prefetchWindow         = time.Minute
+	prefetchTick           = time.Second
+	prefetchAhead          = 10              // a response is refreshed when this percentage of its TTL is left
+	prefetchMinAhead       = 2 * time.Second // ... but not later than this time before it expires
+)
+
+// prefetchEntry is a tracked question
+type prefetchEntry struct {
+	q          dns.Question
+	do         bool   // DNSSEC OK bit
+	hits       uint32 // number of requests in the current window
+	prevHits   uint32 // number of requests in the previous window
+	resp       *dns.Msg
+	ttl        time.Duration
+	expire     time.Time
+	prefetched bool // the response is received by prefetch request
+	refreshing bool
+}
+
+// prefetchCtx tracks the most frequently requested questions and refreshes their responses
+type prefetchCtx struct {
+	lock      sync.Mutex
+	enabled   bool
+	size      int
+	minHits   uint32
+	budget    *tokenBucket // limits the number of prefetch requests
+	entries   map[string]*prefetchEntry
+	windowEnd time.Time
+
+	stop chan bool
+	done chan bool
+
+	// send the request upstream
+	exchange func(req *dns.Msg) (*dns.Msg, error)
+
+	requests uint64 // number of prefetch requests (atomic)
+}
+
+func (p *prefetchCtx) configure(conf *FilteringConfig, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.enabled = conf.Prefetch && !conf.EnableEDNSClientSubnet
+	if !p.enabled {
+		p.entries = nil
+		return
+	}
+
+	p.size = int(conf.PrefetchSize)
+	if p.size == 0 {
+		p.size = defaultPrefetchSize
+	}
+	p.minHits = conf.PrefetchMinHits
+	if p.minHits == 0 {
+		p.minHits = defaultPrefetchMinHits
+	}
+	budget := conf.PrefetchBudget
+	if budget == 0 {
+		budget = defaultPrefetchBudget
+	}
+	if p.budget == nil || p.budget.capacity != float64(budget) {
+		p.budget = newTokenBucket(budget, prefetchWindow, now)
+	}
+	if p.entries == nil {
+		p.entries = map[string]*prefetchEntry{}
+		p.windowEnd = now.Add(prefetchWindow)
+	}
+}
+
+func prefetchKey(req *dns.Msg) (string, bool) {
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s#%t", staleKey(req.Question[0]), do), do
+}
+
+// Count the request and store the response received from upstream
+func (p *prefetchCtx) record(req, resp *dns.Msg, fromUpstream bool, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabled || len(req.Question) != 1 {
+		return
+	}
+
+	key, do := prefetchKey(req)
+	e, ok := p.entries[key]
+	if !ok {
+		if len(p.entries) >= p.size {
+			return // the unpopular entries are removed when the window ends
+		}
+		e = &prefetchEntry{q: req.Question[0], do: do}
+		p.entries[key] = e
+	}
+	e.hits++
+
+	if fromUpstream && resp != nil && resp.Rcode == dns.RcodeSuccess && len(resp.Answer) != 0 {
+		p.setResponse(e, resp, false, now)
+	}
+}
+
+func (p *prefetchCtx) setResponse(e *prefetchEntry, resp *dns.Msg, prefetched bool, now time.Time) {
+	e.resp = resp.Copy()
+	e.ttl = time.Duration(responseTTL(resp)) * time.Second
+	e.expire = now.Add(e.ttl)
+	e.prefetched = prefetched
+}
+
+// Get the response received by prefetch request if it hasn't expired.
+// The TTL of the records is decreased by the time since the response was received.
+func (p *prefetchCtx) get(req *dns.Msg, now time.Time) *dns.Msg {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabled || len(req.Question) != 1 {
+		return nil
+	}
+
+	key, _ := prefetchKey(req)
+	e, ok := p.entries[key]
+	if !ok || !e.prefetched || !now.Before(e.expire) {
+		return nil
+	}
+
+	resp := e.resp.Copy()
+	resp.Id = req.Id
+	left := uint32(e.expire.Sub(now) / time.Second)
+	for _, rr := range append(append([]dns.RR{}, resp.Answer...), resp.Ns...) {
+		if rr.Header().Ttl > left {
+			rr.Header().Ttl = left
+		}
+	}
+	return resp
+}
+
+// Get the popular entries which expire soon.
+// The number of entries is limited by the budget.
+func (p *prefetchCtx) due(now time.Time) []*prefetchEntry {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabled {
+		return nil
+	}
+
+	if !now.Before(p.windowEnd) {
+		for key, e := range p.entries {
+			if e.hits == 0 && (e.resp == nil || !now.Before(e.expire)) {
+				delete(p.entries, key)
+				continue
+			}
+			e.prevHits = e.hits
+			e.hits = 0
+		}
+		p.windowEnd = now.Add(prefetchWindow)
+	}
+
+	var list []*prefetchEntry
+	for _, e := range p.entries {
+		if e.resp == nil || e.refreshing || !now.Before(e.expire) {
+			continue
+		}
+		hits := e.hits
+		if e.prevHits > hits {
+			hits = e.prevHits
+		}
+		ahead := e.ttl * prefetchAhead / 100
+		if ahead < prefetchMinAhead {
+			ahead = prefetchMinAhead
+		}
+		if hits < p.minHits || e.expire.Sub(now) > ahead {
+			continue
+		}
+		if !p.budget.available(now) {
+			break
+		}
+		p.budget.take(now)
+		e.refreshing = true
+		list = append(list, e)
+	}
+	return list
+}
+
+// Send the request upstream and update the entry
+func (p *prefetchCtx) refresh(e *prefetchEntry) {
+	p.lock.Lock()
+	q, do := e.q, e.do
+	exchange := p.exchange
+	p.lock.Unlock()
+
+	req := &dns.Msg{}
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	if do {
+		req.SetEdns0(4096, true)
+	}
+	atomic.AddUint64(&p.requests, 1)
+	resp, err := exchange(req)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e.refreshing = false
+	if err != nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		log.Debug("DNS: prefetch: %s: failed", q.Name)
+		return
+	}
+	p.setResponse(e, resp, true, time.Now())
+}
+
+func (p *prefetchCtx) start() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabled || p.stop != nil {
+		return
+	}
+
+	p.stop = make(chan bool)
+	p.done = make(chan bool)
+	go func(stop, done chan bool) {
+		ticker := time.NewTicker(prefetchTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				for _, e := range p.due(now) {
+					go p.refresh(e)
+				}
+
+			case <-stop:
+				close(done)
+				return
+			}
+		}
+	}(p.stop, p.done)
+}
+
+func (p *prefetchCtx) close() {
+	p.lock.Lock()
+	stop, done := p.stop, p.done
+	p.stop = nil
+	p.done = nil
+	p.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Send an internal request (prefetch, DNSSEC validation) to the upstreams for this domain
+func (s *Server) internalExchange(req *dns.Msg) (*dns.Msg, error) {
+	s.RLock()
+	upstreams := s.conf.Upstreams
+	list, ok := s.matchDomainUpstreams(req.Question[0].Name)
+	if ok && len(list) != 0 {
+		upstreams = list
+	}
+	s.RUnlock()
+
+	if !s.budget.reserve() {
+		return nil, errBudgetExceeded
+	}
+	return exchangeFirst(upstreams, req)
+}
+
+// Send the request to the upstreams one by one until a response is received
+func exchangeFirst(upstreams []upstream.Upstream, req *dns.Msg) (*dns.Msg, error) {
+	err := fmt.Errorf("no upstreams")
+	for _, u := range upstreams {
+		var resp *dns.Msg
+		resp, err = u.Exchange(req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
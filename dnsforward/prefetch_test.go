@@ -0,0 +1,70 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func prefetchResponse(req *dns.Msg, ttl uint32) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   []byte{1, 2, 3, 4},
+	})
+	return resp
+}
+
+func TestPrefetch(t *testing.T) {
+	now := time.Now()
+	p := &prefetchCtx{}
+	p.configure(&FilteringConfig{Prefetch: true, PrefetchMinHits: 3, PrefetchBudget: 1}, now)
+	n := 0
+	p.exchange = func(req *dns.Msg) (*dns.Msg, error) {
+		n++
+		return prefetchResponse(req, 100), nil
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	req2 := &dns.Msg{}
+	req2.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i != 3; i++ {
+		p.record(req, prefetchResponse(req, 100), true, now)
+		p.record(req2, prefetchResponse(req2, 100), true, now)
+	}
+	unpopular := &dns.Msg{}
+	unpopular.SetQuestion("example.net.", dns.TypeA)
+	p.record(unpopular, prefetchResponse(unpopular, 100), true, now)
+
+	// the response received from client's request isn't served by prefetch
+	assert.Nil(t, p.get(req, now))
+
+	// not expiring yet
+	assert.Equal(t, 0, len(p.due(now.Add(50*time.Second))))
+
+	// only one request is allowed by the budget
+	list := p.due(now.Add(95 * time.Second))
+	assert.Equal(t, 1, len(list))
+	p.refresh(list[0])
+	assert.Equal(t, 1, n)
+	assert.Equal(t, uint64(1), p.requests)
+
+	refreshed := req
+	if list[0].q.Name == req2.Question[0].Name {
+		refreshed = req2
+	}
+	resp := p.get(refreshed, list[0].expire.Add(-40*time.Second))
+	assert.NotNil(t, resp)
+	assert.Equal(t, uint32(40), resp.Answer[0].Header().Ttl)
+	assert.Nil(t, p.get(refreshed, list[0].expire))
+
+	// disabled
+	p.configure(&FilteringConfig{}, now)
+	p.record(req, prefetchResponse(req, 100), true, now)
+	assert.Nil(t, p.get(req, now))
+	assert.Equal(t, 0, len(p.due(now.Add(95*time.Second))))
+}
@@ -0,0 +1,167 @@
+// Conditional forwarding of reverse DNS (PTR) requests for local subnets
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// PTRForwarding sets the upstream server for the reverse zones of a local subnet
+// (e.g. the router which knows the hostnames of DHCP clients, or Active Directory domain controller)
+type PTRForwarding struct {
+	Subnet   string `yaml:"subnet" json:"subnet"`     // "192.168.1.0/24", "fd00::/64"
+	Upstream string `yaml:"upstream" json:"upstream"` // "192.168.1.1", "tls://dc.corp.example"
+}
+
+// Get the names of reverse zones which cover the subnet.
+// The prefix length is rounded up to the zone boundary (8 bits for IPv4, 4 bits for IPv6),
+// e.g. 192.168.0.0/23 -> 0.168.192.in-addr.arpa, 1.168.192.in-addr.arpa.
+// A subnet is covered by at most 128 zones.
+func reverseZones(subnet *net.IPNet) ([]string, error) {
+	ones, bits := subnet.Mask.Size()
+	step := 8
+	suffix := "in-addr.arpa."
+	ip := subnet.IP.To4()
+	if bits == 128 {
+		step = 4
+		suffix = "ip6.arpa."
+		ip = subnet.IP.To16()
+	}
+	if ip == nil || bits == 0 {
+		return nil, fmt.Errorf("invalid subnet %s", subnet)
+	}
+
+	rounded := (ones + step - 1) / step * step
+	n := 1 << uint(rounded-ones)
+
+	var zones []string
+	for i := 0; i != n; i++ {
+		// add i to the bits between the prefix and the zone boundary
+		addr := make(net.IP, len(ip))
+		copy(addr, ip)
+		for b := 0; b != rounded-ones; b++ {
+			if i&(1<<uint(b)) == 0 {
+				continue
+			}
+			pos := rounded - 1 - b
+			addr[pos/8] |= 0x80 >> uint(pos%8)
+		}
+
+		var labels []string
+		for pos := 0; pos != rounded; pos += step {
+			var v byte
+			if step == 8 {
+				v = addr[pos/8]
+				labels = append([]string{fmt.Sprintf("%d", v)}, labels...)
+			} else {
+				v = addr[pos/8] >> uint(4-pos%8) & 0xf
+				labels = append([]string{fmt.Sprintf("%x", v)}, labels...)
+			}
+		}
+		zones = append(zones, strings.Join(append(labels, suffix), "."))
+	}
+	return zones, nil
+}
+
+// Parse the settings and create the tree of reverse zones
+func (s *Server) preparePTRForwarding(list []PTRForwarding) (*domainTrie, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	t := &domainTrie{}
+	for _, f := range list {
+		_, subnet, err := net.ParseCIDR(f.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("ptr_forwarding: %s", err)
+		}
+		zones, err := reverseZones(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("ptr_forwarding: %s", err)
+		}
+		u, err := upstream.AddressToUpstream(f.Upstream, upstream.Options{Bootstrap: s.conf.BootstrapDNS, Timeout: DefaultTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("ptr_forwarding: %s: %s", f.Upstream, err)
+		}
+		upstreams := s.wrapUpstreams([]upstream.Upstream{u})
+		for _, z := range zones {
+			t.add(z, upstreams)
+		}
+		log.Debug("DNS: forwarding reverse zones for %s to %s", subnet, f.Upstream)
+	}
+	return t, nil
+}
+
+// Check the settings of PTR forwarding
+func checkPTRForwarding(list []PTRForwarding) error {
+	for _, f := range list {
+		_, subnet, err := net.ParseCIDR(f.Subnet)
+		if err != nil {
+			return err
+		}
+		_, err = reverseZones(subnet)
+		if err != nil {
+			return err
+		}
+		if len(f.Upstream) == 0 || f.Upstream == "#" {
+			return fmt.Errorf("%s: upstream is required", f.Subnet)
+		}
+		_, err = validateUpstream(f.Upstream)
+		if err != nil {
+			return fmt.Errorf("%s: invalid upstream: %s", f.Subnet, err)
+		}
+	}
+	return nil
+}
+
+type ptrForwardingJSON struct {
+	Forwarding []PTRForwarding `json:"forwarding"`
+}
+
+func (s *Server) handlePTRForwardingList(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := ptrForwardingJSON{
+		Forwarding: append([]PTRForwarding{}, s.conf.PTRForwarding...),
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handlePTRForwardingSet(w http.ResponseWriter, r *http.Request) {
+	j := ptrForwardingJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkPTRForwarding(j.Forwarding)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	s.Lock()
+	s.conf.PTRForwarding = j.Forwarding
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	err = s.Reconfigure(nil)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
@@ -0,0 +1,52 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseZones(t *testing.T) {
+	zones := func(cidr string) []string {
+		_, subnet, err := net.ParseCIDR(cidr)
+		assert.Nil(t, err)
+		z, err := reverseZones(subnet)
+		assert.Nil(t, err)
+		return z
+	}
+
+	assert.Equal(t, []string{"1.168.192.in-addr.arpa."}, zones("192.168.1.0/24"))
+	assert.Equal(t, []string{"10.in-addr.arpa."}, zones("10.0.0.0/8"))
+	assert.Equal(t, []string{"0.168.192.in-addr.arpa.", "1.168.192.in-addr.arpa."}, zones("192.168.0.0/23"))
+	assert.Equal(t, 16, len(zones("172.16.0.0/12")))
+	assert.Equal(t, []string{"0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."}, zones("fd00::/64"))
+	assert.Equal(t, []string{"c.f.ip6.arpa.", "d.f.ip6.arpa."}, zones("fc00::/7"))
+
+	assert.Equal(t, 128, len(zones("0.0.0.0/1")))
+	assert.Equal(t, 8, len(zones("2000::/1")))
+}
+
+func TestPTRForwarding(t *testing.T) {
+	s := &Server{}
+	list := []PTRForwarding{
+		{Subnet: "192.168.1.0/24", Upstream: "192.168.1.1"},
+		{Subnet: "fd00::/64", Upstream: "tls://dc.example.org"},
+	}
+	assert.Nil(t, checkPTRForwarding(list))
+	var err error
+	s.ptrUpstreams, err = s.preparePTRForwarding(list)
+	assert.Nil(t, err)
+
+	u, ok := s.matchDomainUpstreams("10.1.168.192.in-addr.arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.1.1:53", u[0].Address())
+	_, ok = s.matchDomainUpstreams("10.2.168.192.in-addr.arpa.")
+	assert.False(t, ok)
+	_, ok = s.matchDomainUpstreams("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.")
+	assert.True(t, ok)
+
+	assert.NotNil(t, checkPTRForwarding([]PTRForwarding{{Subnet: "192.168.1.0", Upstream: "192.168.1.1"}}))
+	assert.NotNil(t, checkPTRForwarding([]PTRForwarding{{Subnet: "192.168.1.0/24", Upstream: "#"}}))
+	assert.NotNil(t, checkPTRForwarding([]PTRForwarding{{Subnet: "192.168.1.0/24", Upstream: "bad://192.168.1.1"}}))
+}
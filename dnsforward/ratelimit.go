@@ -0,0 +1,164 @@
+// Rate limiting of the clients' requests
+
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Actions for the requests exceeding the limit
+const (
+	ratelimitActionDrop     = "drop"     // don't respond
+	ratelimitActionTruncate = "truncate" // respond with TC bit set, so the client retries over TCP
+	ratelimitActionRefuse   = "refuse"   // respond with REFUSED
+)
+
+const ratelimitCleanupInterval = time.Minute
+
+// Token bucket of a client
+type ratelimitBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ratelimiter struct {
+	lock        sync.Mutex
+	buckets     map[string]*ratelimitBucket // "proto|client IP" -> bucket
+	lastCleanup time.Time
+
+	throttled uint64 // number of throttled requests
+}
+
+// Return TRUE if the request is allowed.
+// rate: number of requests per second;  burst: number of requests allowed above the rate.
+func (r *ratelimiter) allow(key string, rate, burst uint32, now time.Time) bool {
+	max := float64(rate + burst)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.buckets == nil {
+		r.buckets = map[string]*ratelimitBucket{}
+		r.lastCleanup = now
+	}
+	if now.Sub(r.lastCleanup) >= ratelimitCleanupInterval {
+		r.cleanup(now)
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &ratelimitBucket{tokens: max, last: now}
+		r.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Remove the buckets of the clients which haven't sent requests for some time
+func (r *ratelimiter) cleanup(now time.Time) {
+	for key, b := range r.buckets {
+		if now.Sub(b.last) >= ratelimitCleanupInterval {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastCleanup = now
+}
+
+func checkRatelimitAction(action string) error {
+	switch action {
+	case "", ratelimitActionDrop, ratelimitActionTruncate, ratelimitActionRefuse:
+		return nil
+	}
+	return fmt.Errorf("invalid ratelimit action: %s", action)
+}
+
+// Get the limit for the client
+func (s *Server) getRatelimit(ip string, udp bool) (rate, burst uint32, action string) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, allowed := range s.conf.RatelimitWhitelist {
+		if allowed == ip {
+			return 0, 0, ""
+		}
+	}
+
+	rate = s.conf.Ratelimit
+	if !udp {
+		rate = s.conf.RatelimitTCP
+	}
+	if s.conf.GetRatelimitByClient != nil {
+		clientRate := s.conf.GetRatelimitByClient(ip)
+		if clientRate != 0 {
+			rate = clientRate
+		}
+	}
+	return rate, s.conf.RatelimitBurst, s.conf.RatelimitAction
+}
+
+// Drop or refuse the requests from the clients exceeding the limit.
+// Return TRUE if the request must be dropped;  otherwise d.Res is set if the request is refused.
+// It's called by BeforeRequestHandler, because DNS proxy expects a response from RequestHandler.
+func (s *Server) processRatelimit(d *proxy.DNSContext) bool {
+	ip := ipFromAddr(d.Addr)
+	if len(ip) == 0 {
+		return false
+	}
+	udp := d.Proto == proxy.ProtoUDP
+	rate, burst, action := s.getRatelimit(ip, udp)
+	if rate == 0 {
+		return false
+	}
+	proto := "udp"
+	if !udp {
+		proto = "tcp"
+	}
+	if s.ratelimit.allow(proto+"|"+ip, rate, burst, time.Now()) {
+		return false
+	}
+
+	atomic.AddUint64(&s.ratelimit.throttled, 1)
+	log.Tracef("DNS: ratelimit: %s %s: %s", proto, ip, action)
+
+	s.RLock()
+	if s.stats != nil && len(d.Req.Question) == 1 {
+		e := stats.Entry{
+			Domain: strings.TrimSuffix(strings.ToLower(d.Req.Question[0].Name), "."),
+			Client: getIP(d.Addr),
+			Result: stats.RRatelimited,
+		}
+		s.stats.Update(e)
+	}
+	s.RUnlock()
+
+	switch {
+	case action == ratelimitActionTruncate && udp:
+		resp := s.makeResponse(d.Req)
+		resp.Truncated = true
+		d.Res = resp
+	case action == ratelimitActionTruncate || action == ratelimitActionRefuse:
+		// TC bit is meaningless for TCP, DoT, DoH and DoQ
+		d.Res = s.genRefused(d.Req)
+	default:
+		return true
+	}
+	return false
+}
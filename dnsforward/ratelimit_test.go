@@ -0,0 +1,125 @@
+package dnsforward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRatelimiter(t *testing.T) {
+	r := ratelimiter{}
+	now := time.Now()
+
+	// 2 requests per second + burst of 1
+	assert.True(t, r.allow("udp|1.2.3.4", 2, 1, now))
+	assert.True(t, r.allow("udp|1.2.3.4", 2, 1, now))
+	assert.True(t, r.allow("udp|1.2.3.4", 2, 1, now))
+	assert.False(t, r.allow("udp|1.2.3.4", 2, 1, now))
+
+	// the other clients aren't affected
+	assert.True(t, r.allow("udp|1.2.3.5", 2, 1, now))
+	assert.True(t, r.allow("tcp|1.2.3.4", 2, 1, now))
+
+	// the bucket is refilled
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, r.allow("udp|1.2.3.4", 2, 1, now))
+	assert.False(t, r.allow("udp|1.2.3.4", 2, 1, now))
+
+	// idle clients are removed
+	now = now.Add(2 * ratelimitCleanupInterval)
+	assert.True(t, r.allow("udp|1.2.3.4", 2, 1, now))
+	assert.Equal(t, 1, len(r.buckets))
+}
+
+func TestProcessRatelimit(t *testing.T) {
+	s := &Server{}
+	s.conf.Ratelimit = 1
+	s.conf.RatelimitAction = ratelimitActionTruncate
+	s.conf.RatelimitWhitelist = []string{"1.2.3.5"}
+
+	process := func(proto, ip string) (bool, *dns.Msg) {
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", dns.TypeA)
+		d := &proxy.DNSContext{
+			Proto: proto,
+			Req:   req,
+			Addr:  &net.UDPAddr{IP: net.ParseIP(ip), Port: 53},
+		}
+		drop := s.processRatelimit(d)
+		return drop, d.Res
+	}
+
+	drop, resp := process("udp", "1.2.3.4")
+	assert.False(t, drop)
+	assert.Nil(t, resp)
+	drop, resp = process("udp", "1.2.3.4")
+	assert.False(t, drop)
+	assert.True(t, resp.Truncated)
+
+	// TCP isn't limited
+	drop, resp = process("tcp", "1.2.3.4")
+	assert.False(t, drop)
+	assert.Nil(t, resp)
+
+	s.conf.RatelimitTCP = 1
+	s.conf.RatelimitAction = ""
+	drop, _ = process("tcp", "1.2.3.4")
+	assert.False(t, drop)
+	drop, resp = process("tcp", "1.2.3.4")
+	assert.True(t, drop)
+	assert.Nil(t, resp)
+
+	// per-client limit
+	s.conf.GetRatelimitByClient = func(clientAddr string) uint32 {
+		return 100
+	}
+	for i := 0; i != 10; i++ {
+		drop, resp = process("udp", "1.2.3.6")
+		assert.False(t, drop)
+		assert.Nil(t, resp)
+	}
+
+	// whitelist
+	for i := 0; i != 10; i++ {
+		drop, resp = process("udp", "1.2.3.5")
+		assert.False(t, drop)
+		assert.Nil(t, resp)
+	}
+
+	assert.Equal(t, uint64(2), s.ratelimit.throttled)
+	assert.NotNil(t, checkRatelimitAction("block"))
+	assert.Nil(t, checkRatelimitAction(ratelimitActionRefuse))
+}
+
+// The requests exceeding the limit are dropped and the server keeps working
+func TestRatelimitDrop(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.Ratelimit = 1
+	s.conf.RatelimitAction = ratelimitActionDrop
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+	c := dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}
+	answered := 0
+	for i := 0; i != 5; i++ {
+		resp, _, err := c.Exchange(createTestMessage("nxdomain.example.org."), addr.String())
+		if err == nil {
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+			answered++
+		}
+	}
+	assert.Equal(t, 1, answered)
+	assert.Equal(t, uint64(4), atomic.LoadUint64(&s.ratelimit.throttled))
+
+	// TCP isn't limited
+	c = dns.Client{Net: "tcp", Timeout: time.Second}
+	resp, _, err := c.Exchange(createTestMessage("nxdomain.example.org."), s.dnsProxy.Addr(proxy.ProtoTCP).String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
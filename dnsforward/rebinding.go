@@ -0,0 +1,254 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Networks that must not be returned for public domain names
+var rebindingNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// Actions for the responses with private IP addresses
+const (
+	rebindingActionBlock  = "block"  // respond as for a blocked domain
+	rebindingActionStrip  = "strip"  // remove the records with private IP addresses from the response
+	rebindingActionRefuse = "refuse" // respond with REFUSED
+)
+
+// Domains which are supposed to be resolved to private addresses
+var localDomainSuffixes = []string{
+	".lan",
+	".local",
+	".localdomain",
+	".home",
+	".home.arpa",
+	".internal",
+	".in-addr.arpa",
+	".ip6.arpa",
+}
+
+type rebindingCtx struct {
+	nets    []*net.IPNet
+	blocked uint64 // number of blocked rebinding attempts (atomic)
+}
+
+func (r *rebindingCtx) init() {
+	for _, s := range rebindingNets {
+		_, ipnet, _ := net.ParseCIDR(s)
+		r.nets = append(r.nets, ipnet)
+	}
+}
+
+// Return TRUE if IP address belongs to a private network
+func (r *rebindingCtx) isPrivateIP(ip net.IP) bool {
+	if ip.IsUnspecified() {
+		// "0.0.0.0" and "::" are used by upstream servers for blocked domains
+		return false
+	}
+	for _, ipnet := range r.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if host is a local domain name which may be resolved to a private address
+func isLocalDomain(host string) bool {
+	if !strings.Contains(host, ".") || net.ParseIP(host) != nil {
+		return true
+	}
+	for _, suffix := range localDomainSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the host matches an entry from the list.
+// "example.org" matches "example.org" and its subdomains,
+// "*.example.org" matches only subdomains of "example.org".
+func matchRebindingAllowedHost(list []string, host string) bool {
+	for _, s := range list {
+		if isWildcard(s) {
+			if matchDomainWildcard(host, s) {
+				return true
+			}
+		} else if host == s || strings.HasSuffix(host, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the response for DNS rebinding attack
+// Return a private IP address from the answer section, or nil
+func (s *Server) checkRebinding(host string, resp *dns.Msg) net.IP {
+	if resp == nil || isLocalDomain(host) ||
+		matchRebindingAllowedHost(s.conf.RebindingAllowedHosts, host) {
+		return nil
+	}
+
+	for _, a := range resp.Answer {
+		var ip net.IP
+		switch v := a.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		if s.rebinding.isPrivateIP(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Remove the records with private IP addresses from the answer section
+func (r *rebindingCtx) stripPrivateIPs(resp *dns.Msg) {
+	answer := []dns.RR{}
+	for _, a := range resp.Answer {
+		switch v := a.(type) {
+		case *dns.A:
+			if r.isPrivateIP(v.A) {
+				continue
+			}
+		case *dns.AAAA:
+			if r.isPrivateIP(v.AAAA) {
+				continue
+			}
+		}
+		answer = append(answer, a)
+	}
+	resp.Answer = answer
+}
+
+func checkRebindingAction(action string) error {
+	switch action {
+	case "", rebindingActionBlock, rebindingActionStrip, rebindingActionRefuse:
+		return nil
+	}
+	return fmt.Errorf("invalid rebinding protection action: %s", action)
+}
+
+// Block the responses that contain private IP addresses for public domain names
+func processRebindingProtection(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+
+	if !ctx.responseFromUpstream || !s.conf.RebindingProtectionEnabled ||
+		ctx.result.Reason.Matched() {
+		return resultDone
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(d.Req.Question[0].Name, "."))
+	ip := s.checkRebinding(host, d.Res)
+	if ip == nil {
+		return resultDone
+	}
+
+	atomic.AddUint64(&s.rebinding.blocked, 1)
+	log.Debug("DNS: blocked rebinding attempt: %s -> %s", host, ip)
+
+	ctx.origResp = d.Res
+	ctx.result = &dnsfilter.Result{
+		IsFiltered: true,
+		Reason:     dnsfilter.FilteredRebind,
+		Rule:       fmt.Sprintf("rebinding: %s", ip),
+	}
+	switch s.conf.RebindingProtectionAction {
+	case rebindingActionStrip:
+		d.Res = d.Res.Copy()
+		s.rebinding.stripPrivateIPs(d.Res)
+	case rebindingActionRefuse:
+		d.Res = s.genRefused(d.Req)
+	default:
+		d.Res = s.genDNSFilterMessage(d, ctx.result)
+	}
+	return resultDone
+}
+
+type rebindingJSON struct {
+	Enabled      bool     `json:"enabled"`
+	AllowedHosts []string `json:"allowed_hosts"`
+	Action       string   `json:"action"`
+	Blocked      uint64   `json:"blocked"` // number of blocked rebinding attempts since startup
+}
+
+func (s *Server) handleRebindingStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := rebindingJSON{
+		Enabled:      s.conf.RebindingProtectionEnabled,
+		AllowedHosts: s.conf.RebindingAllowedHosts,
+		Action:       s.conf.RebindingProtectionAction,
+		Blocked:      atomic.LoadUint64(&s.rebinding.blocked),
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleRebindingSet(w http.ResponseWriter, r *http.Request) {
+	j := rebindingJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkRebindingAction(j.Action)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	hosts := []string{}
+	for _, h := range j.AllowedHosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if len(h) == 0 {
+			continue
+		}
+		if _, ok := dns.IsDomainName(h); !ok {
+			httpError(r, w, http.StatusBadRequest, "invalid domain name: %s", h)
+			return
+		}
+		hosts = append(hosts, h)
+	}
+
+	s.Lock()
+	s.conf.RebindingProtectionEnabled = j.Enabled
+	s.conf.RebindingAllowedHosts = hosts
+	s.conf.RebindingProtectionAction = j.Action
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	log.Debug("DNS: rebinding protection: enabled:%t  allowed hosts:%d", j.Enabled, len(hosts))
+}
@@ -0,0 +1,185 @@
+// Removing the records of blocked types from the responses
+
+package dnsforward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Record types which aren't known to the DNS library
+var recordTypeAliases = map[string]uint16{
+	"SVCB":  64,
+	"HTTPS": 65, // used to pass ECH configuration
+}
+
+// The records of this type are removed from the responses for these domains
+type recordTypeRule struct {
+	domains []string // the domains and their subdomains.  nil: all domains
+	qtype   uint16
+}
+
+// Parse the record type: "AAAA", "HTTPS", "TYPE65"
+func parseRecordType(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	t, ok := dns.StringToType[s]
+	if ok {
+		return t, nil
+	}
+	t, ok = recordTypeAliases[s]
+	if ok {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[len("TYPE"):], 10, 16)
+		if err == nil {
+			return uint16(n), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid record type: %s", s)
+}
+
+// Parse the rules: "TYPE" (all domains) or "[/domain1/domain2/]TYPE"
+func parseRecordTypeRules(list []string) ([]recordTypeRule, error) {
+	var rules []recordTypeRule
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+
+		r := recordTypeRule{}
+		if strings.HasPrefix(s, "[/") {
+			i := strings.Index(s, "/]")
+			if i < 0 {
+				return nil, fmt.Errorf("%s: invalid domain specification", s)
+			}
+			for _, d := range strings.Split(s[2:i], "/") {
+				d = strings.ToLower(strings.TrimSuffix(d, "."))
+				if _, ok := dns.IsDomainName(d); !ok || len(d) == 0 {
+					return nil, fmt.Errorf("%s: invalid domain name: %s", s, d)
+				}
+				r.domains = append(r.domains, d)
+			}
+			s = s[i+2:]
+		}
+
+		t, err := parseRecordType(s)
+		if err != nil {
+			return nil, err
+		}
+		if t == dns.TypeCNAME || t == dns.TypeSOA {
+			return nil, fmt.Errorf("%s records can't be blocked", s)
+		}
+		r.qtype = t
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// ValidateBlockedRecordTypes validates the record type rules of a client
+func ValidateBlockedRecordTypes(list []string) error {
+	_, err := parseRecordTypeRules(list)
+	return err
+}
+
+func recordTypeName(t uint16) string {
+	for name, alias := range recordTypeAliases {
+		if alias == t {
+			return name
+		}
+	}
+	return dns.Type(t).String()
+}
+
+// Return TRUE if the records of this type must be removed from the response for the host
+func matchRecordTypeRules(rules []recordTypeRule, host string, qtype uint16) bool {
+	for _, r := range rules {
+		if r.qtype != qtype {
+			continue
+		}
+		if r.domains == nil {
+			return true
+		}
+		for _, d := range r.domains {
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Remove the records of blocked types from the answer and additional sections.
+// Return the names of removed types.
+func stripRecordTypes(resp *dns.Msg, host string, rules []recordTypeRule) []string {
+	var removed []string
+	seen := map[uint16]bool{}
+	filter := func(records []dns.RR) []dns.RR {
+		var r []dns.RR
+		for _, rr := range records {
+			t := rr.Header().Rrtype
+			if matchRecordTypeRules(rules, host, t) {
+				if !seen[t] {
+					seen[t] = true
+					removed = append(removed, recordTypeName(t))
+				}
+				continue
+			}
+			r = append(r, rr)
+		}
+		return r
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Extra = filter(resp.Extra)
+	return removed
+}
+
+// Remove the records of blocked types from the response
+func processRecordTypeFiltering(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+
+	if d.Res == nil || !ctx.protectionEnabled || ctx.result.IsFiltered {
+		return resultDone
+	}
+
+	s.RLock()
+	rules := s.recordTypeRules
+	s.RUnlock()
+	if s.conf.GetBlockedRecordTypesByClient != nil {
+		clientRules, err := parseRecordTypeRules(s.conf.GetBlockedRecordTypesByClient(ctx.clientKey()))
+		if err != nil {
+			log.Debug("DNS: %s: %s", ctx.clientIP, err)
+		}
+		rules = append(clientRules, rules...)
+	}
+	if len(rules) == 0 {
+		return resultDone
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(d.Req.Question[0].Name, "."))
+	orig := d.Res
+	resp := d.Res.Copy()
+	removed := stripRecordTypes(resp, host, rules)
+	if len(removed) == 0 {
+		return resultDone
+	}
+	log.Debug("DNS: removed %v records from the response for %s", removed, host)
+
+	d.Res = resp
+	if !ctx.result.Reason.Matched() {
+		// keep the reason of rewritten responses
+		ctx.origResp = orig
+		ctx.result = &dnsfilter.Result{
+			Reason: dnsfilter.FilteredRecordType,
+			Rule:   fmt.Sprintf("record types: %s", strings.Join(removed, ",")),
+		}
+	}
+	return resultDone
+}
@@ -0,0 +1,76 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordTypeRules(t *testing.T) {
+	rules, err := parseRecordTypeRules([]string{"HTTPS", "type64", "[/example.org/Example.NET./]aaaa"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(rules))
+	assert.Equal(t, uint16(64), rules[1].qtype)
+
+	assert.True(t, matchRecordTypeRules(rules, "example.com", 65))
+	assert.True(t, matchRecordTypeRules(rules, "www.example.org", dns.TypeAAAA))
+	assert.True(t, matchRecordTypeRules(rules, "example.net", dns.TypeAAAA))
+	assert.False(t, matchRecordTypeRules(rules, "example.com", dns.TypeAAAA))
+	assert.False(t, matchRecordTypeRules(rules, "example.org", dns.TypeA))
+
+	_, err = parseRecordTypeRules([]string{"XYZ"})
+	assert.NotNil(t, err)
+	_, err = parseRecordTypeRules([]string{"[/example.org]AAAA"})
+	assert.NotNil(t, err)
+	_, err = parseRecordTypeRules([]string{"CNAME"})
+	assert.NotNil(t, err)
+}
+
+func TestProcessRecordTypeFiltering(t *testing.T) {
+	s := &Server{}
+	s.recordTypeRules, _ = parseRecordTypeRules([]string{"HTTPS"})
+	s.conf.GetBlockedRecordTypesByClient = func(clientAddr string) []string {
+		if clientAddr == "192.168.1.2" {
+			return []string{"[/example.org/]AAAA"}
+		}
+		return nil
+	}
+
+	process := func(clientIP string, qtype uint16, answer ...dns.RR) *dnsContext {
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", qtype)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = answer
+		ctx := &dnsContext{
+			srv:               s,
+			proxyCtx:          &proxy.DNSContext{Req: req, Res: resp},
+			result:            &dnsfilter.Result{},
+			clientIP:          clientIP,
+			protectionEnabled: true,
+		}
+		assert.Equal(t, resultDone, processRecordTypeFiltering(ctx))
+		return ctx
+	}
+
+	https := &dns.RFC3597{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: 65}}
+	ctx := process("192.168.1.3", 65, https)
+	assert.Equal(t, 0, len(ctx.proxyCtx.Res.Answer))
+	assert.Equal(t, dnsfilter.FilteredRecordType, ctx.result.Reason)
+	assert.Equal(t, "record types: HTTPS", ctx.result.Rule)
+	assert.Equal(t, 1, len(ctx.origResp.Answer))
+
+	aaaa := &dns.AAAA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("::1")}
+	ctx = process("192.168.1.3", dns.TypeAAAA, aaaa)
+	assert.Equal(t, 1, len(ctx.proxyCtx.Res.Answer))
+	assert.Equal(t, dnsfilter.NotFilteredNotFound, ctx.result.Reason)
+
+	// per-client rules
+	ctx = process("192.168.1.2", dns.TypeAAAA, aaaa)
+	assert.Equal(t, 0, len(ctx.proxyCtx.Res.Answer))
+	assert.Equal(t, "record types: AAAA", ctx.result.Rule)
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package dnsforward
+
+import (
+	"syscall"
+)
+
+// SO_REUSEPORT isn't supported on this OS
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
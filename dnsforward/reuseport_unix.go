@@ -0,0 +1,23 @@
+// +build linux darwin freebsd openbsd netbsd
+
+package dnsforward
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Enable SO_REUSEPORT for the listening socket:
+// when AdGuard Home is restarted, the new instance may bind to the same address
+// while the previous one is completing the requests in progress
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
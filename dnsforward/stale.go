@@ -0,0 +1,253 @@
+// Serve-stale (RFC 8767): respond with expired data when upstream servers don't respond.
+// The same responses are used when the upstream query budget is exceeded.
+
+package dnsforward
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	staleTTL           = 30               // TTL (in seconds) of a stale response
+	staleRecheck       = 30 * time.Second // upstream isn't queried for this time after it has failed
+	defaultStaleMaxAge = 24 * 60 * 60     // in seconds
+	staleCacheSize     = 4 * 1024 * 1024  // in bytes
+)
+
+// staleCache keeps the last responses from upstream after they've expired.
+// The entries are kept separately for every set of upstreams,
+// because the domain-specific upstreams may respond differently.
+type staleCache struct {
+	lock       sync.Mutex
+	cache      cache.Cache          // key -> expiration time (8 bytes) + response.  nil: the responses aren't stored
+	maxAge     time.Duration        // how long an expired response may be used.  0: serve-stale is disabled
+	failed     map[string]time.Time // key -> the time when upstream failed
+	refreshing map[string]bool      // key -> a refresh request is in progress
+
+	served uint64 // number of stale responses (atomic)
+}
+
+// Apply the settings.
+// The responses are stored if serve-stale is enabled or if the upstream budget overflow mode is "stale".
+func (c *staleCache) configure(conf *FilteringConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !conf.ServeStale && conf.UpstreamBudgetOverflow != budgetOverflowStale {
+		c.maxAge = 0
+		c.cache = nil
+		c.failed = nil
+		c.refreshing = nil
+		return
+	}
+
+	c.maxAge = 0
+	if conf.ServeStale {
+		maxAge := conf.ServeStaleMaxAge
+		if maxAge == 0 {
+			maxAge = defaultStaleMaxAge
+		}
+		c.maxAge = time.Duration(maxAge) * time.Second
+	}
+	if c.cache == nil {
+		c.cache = cache.New(cache.Config{
+			EnableLRU: true,
+			MaxSize:   staleCacheSize,
+		})
+		c.failed = map[string]time.Time{}
+		c.refreshing = map[string]bool{}
+	}
+}
+
+func staleKey(q dns.Question) string {
+	return strings.ToLower(q.Name) + "#" + dns.TypeToString[q.Qtype] + "#" + dns.ClassToString[q.Qclass]
+}
+
+// Get the key of the entry for the question and the upstreams which were used for it.
+// nil: the global upstreams.
+func staleEntryKey(upstreams []upstream.Upstream, q dns.Question) string {
+	key := staleKey(q)
+	for _, u := range upstreams {
+		key += "#" + u.Address()
+	}
+	return key
+}
+
+// Get the minimum TTL of the records in the response
+func responseTTL(resp *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+	for _, rr := range append(append([]dns.RR{}, resp.Answer...), resp.Ns...) {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	return ttl
+}
+
+// Store the response from upstream
+func (c *staleCache) set(upstreams []upstream.Upstream, req, resp *dns.Msg, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cache == nil || resp == nil || len(req.Question) != 1 ||
+		!(resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError) {
+		return
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	expire := now.Add(time.Duration(responseTTL(resp)) * time.Second)
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(expire.Unix()))
+	key := staleEntryKey(upstreams, req.Question[0])
+	c.cache.Set([]byte(key), append(buf, data...))
+	delete(c.failed, key)
+}
+
+// Get the stored response and its expiration time
+func (c *staleCache) load(upstreams []upstream.Upstream, req *dns.Msg) (*dns.Msg, time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cache == nil || len(req.Question) != 1 {
+		return nil, time.Time{}
+	}
+
+	data := c.cache.Get([]byte(staleEntryKey(upstreams, req.Question[0])))
+	if len(data) < 8 {
+		return nil, time.Time{}
+	}
+	expire := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+
+	resp := &dns.Msg{}
+	err := resp.Unpack(data[8:])
+	if err != nil {
+		return nil, time.Time{}
+	}
+	resp.Id = req.Id
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = staleTTL
+	}
+	for _, rr := range resp.Ns {
+		rr.Header().Ttl = staleTTL
+	}
+	return resp, expire
+}
+
+// Get the stored response if it has expired not more than maxAge ago.
+// The TTL of the records is set to 30 seconds.
+func (c *staleCache) get(upstreams []upstream.Upstream, req *dns.Msg, now time.Time) *dns.Msg {
+	c.lock.Lock()
+	maxAge := c.maxAge
+	c.lock.Unlock()
+	if maxAge == 0 {
+		return nil
+	}
+
+	resp, expire := c.load(upstreams, req)
+	if resp == nil || now.Sub(expire) > maxAge {
+		return nil
+	}
+	atomic.AddUint64(&c.served, 1)
+	return resp
+}
+
+// Get the last stored response, even if it has expired long ago (used when the upstream budget is exceeded).
+// The TTL of the records is set to 30 seconds.
+func (c *staleCache) getLast(upstreams []upstream.Upstream, req *dns.Msg) *dns.Msg {
+	resp, _ := c.load(upstreams, req)
+	return resp
+}
+
+// Remember that upstream has failed to respond to the request
+func (c *staleCache) setFailed(upstreams []upstream.Upstream, req *dns.Msg, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.maxAge == 0 || len(req.Question) != 1 {
+		return
+	}
+	for key, t := range c.failed {
+		if now.Sub(t) >= staleRecheck {
+			delete(c.failed, key)
+		}
+	}
+	c.failed[staleEntryKey(upstreams, req.Question[0])] = now
+}
+
+// Return TRUE if upstream has failed to respond to this request recently
+func (c *staleCache) recentlyFailed(upstreams []upstream.Upstream, req *dns.Msg, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.maxAge == 0 || len(req.Question) != 1 {
+		return false
+	}
+	t, ok := c.failed[staleEntryKey(upstreams, req.Question[0])]
+	return ok && now.Sub(t) < staleRecheck
+}
+
+// Respond with a stale response and refresh it in background.
+// Return FALSE if there's no stale response.
+func (s *Server) serveStale(ctx *dnsContext) bool {
+	d := ctx.proxyCtx
+	resp := s.stale.get(d.Upstreams, d.Req, time.Now())
+	if resp == nil {
+		return false
+	}
+	log.Debug("DNS: serve-stale: stale response for %s", d.Req.Question[0].Name)
+	d.Res = resp
+	ctx.responseFromUpstream = true // the response is filtered in the same way
+	s.refreshStale(s.dnsProxy, d.Upstreams, d.Req.Copy())
+	return true
+}
+
+// Send the request to the same upstreams in background and update the stale cache.
+// Only one request for the question may be in progress.
+func (s *Server) refreshStale(p *proxy.Proxy, upstreams []upstream.Upstream, req *dns.Msg) {
+	key := staleEntryKey(upstreams, req.Question[0])
+	c := &s.stale
+	c.lock.Lock()
+	if c.refreshing == nil || c.refreshing[key] {
+		c.lock.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.lock.Unlock()
+
+	go func() {
+		defer func() {
+			c.lock.Lock()
+			delete(c.refreshing, key)
+			c.lock.Unlock()
+		}()
+
+		d := &proxy.DNSContext{
+			Proto:     "udp",
+			Req:       req,
+			StartTime: time.Now(),
+			Upstreams: s.budget.wrap(upstreams),
+		}
+		gate := s.budget.begin(req)
+		err := p.Resolve(d)
+		s.budget.end(req, gate)
+		if gate != nil && gate.isExceeded() {
+			return
+		}
+		if err != nil || d.Res == nil || d.Res.Rcode == dns.RcodeServerFailure {
+			c.setFailed(upstreams, req, time.Now())
+			return
+		}
+		c.set(upstreams, req, d.Res, time.Now())
+	}()
+}
@@ -0,0 +1,78 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleCache(t *testing.T) {
+	c := staleCache{}
+	c.configure(&FilteringConfig{ServeStale: true, ServeStaleMaxAge: 3600})
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IP{1, 2, 3, 4},
+	})
+
+	now := time.Now()
+	c.set(nil, req, resp, now)
+
+	// SERVFAIL responses aren't stored
+	fail := &dns.Msg{}
+	fail.SetRcode(req, dns.RcodeServerFailure)
+	c.set(nil, req, fail, now)
+
+	req2 := &dns.Msg{}
+	req2.SetQuestion("EXAMPLE.org.", dns.TypeA)
+	stale := c.get(nil, req2, now.Add(time.Hour))
+	assert.NotNil(t, stale)
+	assert.Equal(t, req2.Id, stale.Id)
+	assert.Equal(t, uint32(staleTTL), stale.Answer[0].Header().Ttl)
+	assert.Equal(t, uint64(1), c.served)
+
+	// the response has expired more than max-stale ago
+	assert.Nil(t, c.get(nil, req, now.Add(300*time.Second+time.Hour+time.Second)))
+
+	req2.SetQuestion("example.org.", dns.TypeAAAA)
+	assert.Nil(t, c.get(nil, req2, now))
+
+	// failure recheck timer
+	assert.False(t, c.recentlyFailed(nil, req, now))
+	c.setFailed(nil, req, now)
+	assert.True(t, c.recentlyFailed(nil, req, now.Add(time.Second)))
+	assert.False(t, c.recentlyFailed(nil, req, now.Add(staleRecheck)))
+	c.set(nil, req, resp, now)
+	assert.False(t, c.recentlyFailed(nil, req, now))
+
+	// the entries are kept separately for every set of upstreams
+	u, _ := upstream.AddressToUpstream("1.1.1.1", upstream.Options{})
+	upstreams := []upstream.Upstream{u}
+	assert.Nil(t, c.get(upstreams, req, now))
+	c.setFailed(upstreams, req, now)
+	assert.True(t, c.recentlyFailed(upstreams, req, now))
+	assert.False(t, c.recentlyFailed(nil, req, now))
+
+	// the responses are stored for the upstream budget, but serve-stale is disabled
+	c.configure(&FilteringConfig{UpstreamBudgetOverflow: budgetOverflowStale})
+	c.set(nil, req, resp, now)
+	assert.Nil(t, c.get(nil, req, now.Add(time.Hour)))
+	assert.NotNil(t, c.getLast(nil, req))
+	c.setFailed(nil, req, now)
+	assert.False(t, c.recentlyFailed(nil, req, now))
+
+	// serve-stale is disabled
+	c.configure(&FilteringConfig{})
+	c.set(nil, req, resp, now)
+	assert.Nil(t, c.get(nil, req, now))
+	c.setFailed(nil, req, now)
+	assert.False(t, c.recentlyFailed(nil, req, now))
+}
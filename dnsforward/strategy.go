@@ -0,0 +1,431 @@
+// Upstream selection strategies
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Upstream selection strategies
+const (
+	strategyDefault  = ""         // dnsproxy chooses the upstream (or queries all of them if all_servers is set)
+	strategyParallel = "parallel" // query all upstreams at once and use the first successful response
+	strategyFastest  = "fastest"  // query the upstream with the lowest average response time first
+	strategyFailover = "failover" // query the upstreams in the configured order
+	strategyWeighted = "weighted" // weighted round-robin
+)
+
+const (
+	defaultMaxFailures = 3
+	latencyWeight      = 0.2              // weight of a new sample in the average response time
+	unhealthyRetry     = 30 * time.Second // an unhealthy upstream is tried again after this time
+)
+
+// UpstreamThresholds are the health thresholds of an upstream selection strategy.
+// An upstream is unhealthy when any threshold is exceeded:
+// unhealthy upstreams are used only if all healthy upstreams have failed.
+type UpstreamThresholds struct {
+	MaxFailures uint32 `yaml:"max_failures" json:"max_failures"` // number of consecutive errors.  0: default (3)
+	MaxLatency  uint32 `yaml:"max_latency" json:"max_latency"`   // average response time (in milliseconds).  0: unlimited
+}
+
+// upstreamStats are the live metrics of an upstream server
+type upstreamStats struct {
+	Address   string  `json:"address"`
+	Weight    uint32  `json:"weight"`
+	Queries   uint64  `json:"queries"`
+	Errors    uint64  `json:"errors"`
+	Failures  uint32  `json:"consecutive_failures"`
+	Latency   float64 `json:"avg_latency"` // average response time (in milliseconds)
+	LastError string  `json:"last_error,omitempty"`
+	Healthy   bool    `json:"healthy"`
+
+	// health checks
+	Quarantined bool   `json:"quarantined"`          // the upstream is temporarily removed
+	NextProbe   string `json:"next_probe,omitempty"` // the time of the next probe (RFC 3339)
+
+	lastUsed  time.Time
+	current   int64         // current weight for smooth weighted round-robin
+	backoff   time.Duration // the interval between recovery probes of quarantined upstream
+	nextProbe time.Time
+	probing   bool // a probe request is in progress
+}
+
+// upstreamSelector chooses the upstream servers for a request according to the strategy
+type upstreamSelector struct {
+	lock       sync.Mutex
+	strategy   string
+	thresholds UpstreamThresholds
+	weights    map[string]uint32
+	stats      map[string]*upstreamStats // upstream address -> metrics
+	upstreams  []upstream.Upstream       // all configured upstreams
+
+	healthInterval time.Duration // 0: health checks are disabled
+	healthDomain   string
+	healthStop     chan bool
+	healthDone     chan bool
+
+	observe  func(addr string, elapsed time.Duration)     // called for every response from upstream (may be nil)
+	onStatus func(addr string, up bool, lastError string) // called when the upstream is quarantined or released (may be nil)
+}
+
+func checkUpstreamStrategy(strategy string) error {
+	switch strategy {
+	case strategyDefault, strategyParallel, strategyFastest, strategyFailover, strategyWeighted:
+		return nil
+	}
+	return fmt.Errorf("unknown upstream strategy: %s", strategy)
+}
+
+// Apply the settings, create the metrics of the new upstreams and remove the metrics of the upstreams that aren't used anymore
+func (sel *upstreamSelector) configure(conf *FilteringConfig, upstreams []upstream.Upstream) {
+	sel.lock.Lock()
+	defer sel.lock.Unlock()
+
+	sel.strategy = conf.UpstreamStrategy
+	sel.thresholds = conf.UpstreamThresholds[conf.UpstreamStrategy]
+	sel.weights = conf.UpstreamWeights
+	sel.healthInterval = time.Duration(conf.UpstreamHealthCheckInterval) * time.Second
+	sel.healthDomain = dns.Fqdn(conf.UpstreamHealthCheckDomain)
+
+	used := map[string]bool{}
+	sel.upstreams = nil
+	for _, u := range upstreams {
+		if !used[u.Address()] {
+			sel.upstreams = append(sel.upstreams, u)
+			sel.getStats(u.Address())
+		}
+		used[u.Address()] = true
+	}
+	for addr, st := range sel.stats {
+		if !used[addr] {
+			delete(sel.stats, addr)
+		} else if sel.healthInterval == 0 {
+			st.Quarantined = false
+			st.nextProbe = time.Time{}
+		}
+	}
+}
+
+func (sel *upstreamSelector) setOnStatus(onStatus func(addr string, up bool, lastError string)) {
+	sel.lock.Lock()
+	sel.onStatus = onStatus
+	sel.lock.Unlock()
+}
+
+// Wrap the upstreams so that the requests are processed according to the strategy.
+// dnsproxy sees the group as a single upstream.
+// If health checks are enabled, the upstreams are wrapped even with the default strategy:
+// they are queried in the configured order.
+func (sel *upstreamSelector) wrap(upstreams []upstream.Upstream) []upstream.Upstream {
+	sel.lock.Lock()
+	wrap := sel.strategy != strategyDefault || sel.healthInterval != 0
+	sel.lock.Unlock()
+	if len(upstreams) == 0 || !wrap {
+		return upstreams
+	}
+	return []upstream.Upstream{&upstreamGroup{sel: sel, upstreams: upstreams}}
+}
+
+func (sel *upstreamSelector) getStats(addr string) *upstreamStats {
+	if sel.stats == nil {
+		sel.stats = map[string]*upstreamStats{}
+	}
+	st, ok := sel.stats[addr]
+	if !ok {
+		st = &upstreamStats{Address: addr}
+		sel.stats[addr] = st
+	}
+	return st
+}
+
+func (sel *upstreamSelector) weight(addr string) uint32 {
+	w, ok := sel.weights[addr]
+	if !ok {
+		return 1
+	}
+	return w
+}
+
+// Return TRUE if the upstream doesn't exceed the thresholds
+func (sel *upstreamSelector) isHealthy(st *upstreamStats) bool {
+	maxFailures := sel.thresholds.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = defaultMaxFailures
+	}
+	if st.Failures >= maxFailures {
+		return false
+	}
+	if sel.thresholds.MaxLatency != 0 && st.Latency > float64(sel.thresholds.MaxLatency) {
+		return false
+	}
+	return true
+}
+
+// Get the upstreams in the order in which they should be queried
+func (sel *upstreamSelector) order(upstreams []upstream.Upstream, now time.Time) (string, []upstream.Upstream) {
+	sel.lock.Lock()
+	defer sel.lock.Unlock()
+
+	var healthy, unhealthy, quarantined []upstream.Upstream
+	for _, u := range upstreams {
+		st := sel.getStats(u.Address())
+		if st.Quarantined {
+			quarantined = append(quarantined, u)
+		} else if sel.isHealthy(st) || now.Sub(st.lastUsed) >= unhealthyRetry {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+
+	switch sel.strategy {
+	case strategyParallel:
+		if len(healthy) != 0 {
+			return sel.strategy, healthy
+		}
+		if len(unhealthy) != 0 {
+			return sel.strategy, unhealthy
+		}
+		return sel.strategy, quarantined
+
+	case strategyFastest:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			a := sel.stats[healthy[i].Address()]
+			b := sel.stats[healthy[j].Address()]
+			if a.Failures != b.Failures {
+				return a.Failures < b.Failures
+			}
+			return a.Latency < b.Latency
+		})
+
+	case strategyWeighted:
+		healthy = sel.weightedOrder(healthy)
+	}
+
+	// quarantined upstreams are used only as the last resort
+	return sel.strategy, append(append(healthy, unhealthy...), quarantined...)
+}
+
+// Choose the next upstream by smooth weighted round-robin and move it to the front of the list.
+// The upstreams with zero weight are used only as a fallback.
+func (sel *upstreamSelector) weightedOrder(upstreams []upstream.Upstream) []upstream.Upstream {
+	var total int64
+	best := -1
+	for i, u := range upstreams {
+		w := int64(sel.weight(u.Address()))
+		if w == 0 {
+			continue
+		}
+		st := sel.stats[u.Address()]
+		st.current += w
+		total += w
+		if best < 0 || st.current > sel.stats[upstreams[best].Address()].current {
+			best = i
+		}
+	}
+	if best < 0 {
+		return upstreams
+	}
+	sel.stats[upstreams[best].Address()].current -= total
+	if best == 0 {
+		return upstreams
+	}
+
+	r := make([]upstream.Upstream, 0, len(upstreams))
+	r = append(r, upstreams[best])
+	r = append(r, upstreams[:best]...)
+	return append(r, upstreams[best+1:]...)
+}
+
+// Update the metrics of the upstream
+func (sel *upstreamSelector) record(addr string, elapsed time.Duration, err error, now time.Time) {
+	sel.lock.Lock()
+	st := sel.getStats(addr)
+	st.Queries++
+	st.lastUsed = now
+	if err != nil {
+		st.Errors++
+		st.Failures++
+		st.LastError = err.Error()
+		if sel.healthInterval != 0 && !st.Quarantined && !sel.isHealthy(st) {
+			sel.quarantine(st, now)
+		}
+		sel.lock.Unlock()
+		return
+	}
+
+	if st.Quarantined {
+		sel.release(st, now)
+	}
+	st.Failures = 0
+	ms := float64(elapsed) / float64(time.Millisecond)
+	if st.Queries-st.Errors == 1 {
+		st.Latency = ms
+	} else {
+		st.Latency += (ms - st.Latency) * latencyWeight
+	}
+	sel.lock.Unlock()
+
+	if sel.observe != nil {
+		sel.observe(addr, elapsed)
+	}
+}
+
+func (sel *upstreamSelector) exchange(u upstream.Upstream, req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := u.Exchange(req)
+	sel.record(u.Address(), time.Since(start), err, time.Now())
+	return resp, err
+}
+
+// Get the copy of the metrics sorted by address
+func (sel *upstreamSelector) getStatsList() []upstreamStats {
+	sel.lock.Lock()
+	list := []upstreamStats{}
+	for _, st := range sel.stats {
+		s := *st
+		s.Weight = sel.weight(st.Address)
+		s.Healthy = sel.isHealthy(st) && !st.Quarantined
+		if sel.healthInterval != 0 && !st.nextProbe.IsZero() {
+			s.NextProbe = st.nextProbe.Format(time.RFC3339)
+		}
+		list = append(list, s)
+	}
+	sel.lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+// upstreamGroup is a set of upstreams which are queried according to the strategy
+type upstreamGroup struct {
+	sel       *upstreamSelector
+	upstreams []upstream.Upstream
+}
+
+// Address returns the addresses of all upstreams in the group
+func (g *upstreamGroup) Address() string {
+	var addrs []string
+	for _, u := range g.upstreams {
+		addrs = append(addrs, u.Address())
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Exchange sends the request to the upstreams according to the strategy
+func (g *upstreamGroup) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	strategy, upstreams := g.sel.order(g.upstreams, time.Now())
+	if strategy == strategyParallel && len(upstreams) > 1 {
+		return g.exchangeParallel(req, upstreams)
+	}
+
+	var errs []string
+	for _, u := range upstreams {
+		resp, err := g.sel.exchange(u, req)
+		if err == nil {
+			return resp, nil
+		}
+		log.Debug("DNS: upstream %s: %s", u.Address(), err)
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("all upstreams failed: %s", strings.Join(errs, "; "))
+}
+
+// Send the request to all upstreams at once and return the first successful response
+func (g *upstreamGroup) exchangeParallel(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	ch := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		go func(u upstream.Upstream, req *dns.Msg) {
+			resp, err := g.sel.exchange(u, req)
+			ch <- result{resp, err}
+		}(u, req.Copy())
+	}
+
+	var errs []string
+	for range upstreams {
+		r := <-ch
+		if r.err == nil {
+			return r.resp, nil
+		}
+		errs = append(errs, r.err.Error())
+	}
+	return nil, fmt.Errorf("all upstreams failed: %s", strings.Join(errs, "; "))
+}
+
+type upstreamStrategyJSON struct {
+	Strategy   string                        `json:"strategy"`
+	Thresholds map[string]UpstreamThresholds `json:"thresholds"` // strategy -> health thresholds
+	Weights    map[string]uint32             `json:"weights"`    // upstream address -> weight
+
+	// status
+	Upstreams []upstreamStats `json:"upstreams,omitempty"`
+}
+
+func (s *Server) handleUpstreamStrategyStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := upstreamStrategyJSON{
+		Strategy:   s.conf.UpstreamStrategy,
+		Thresholds: s.conf.UpstreamThresholds,
+		Weights:    s.conf.UpstreamWeights,
+	}
+	s.RUnlock()
+	j.Upstreams = s.selector.getStatsList()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleUpstreamStrategySet(w http.ResponseWriter, r *http.Request) {
+	j := upstreamStrategyJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkUpstreamStrategy(j.Strategy)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "strategy: %s", err)
+		return
+	}
+	for strategy := range j.Thresholds {
+		if checkUpstreamStrategy(strategy) != nil {
+			httpError(r, w, http.StatusBadRequest, "thresholds: unknown strategy: %s", strategy)
+			return
+		}
+	}
+
+	s.Lock()
+	s.conf.UpstreamStrategy = j.Strategy
+	s.conf.UpstreamThresholds = j.Thresholds
+	s.conf.UpstreamWeights = j.Weights
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	err = s.Reconfigure(nil)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
@@ -0,0 +1,148 @@
+package dnsforward
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// strategyUpstream responds after a delay or fails
+type strategyUpstream struct {
+	addr  string
+	delay time.Duration
+	fail  bool
+	count int
+}
+
+func (u *strategyUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	u.count++
+	time.Sleep(u.delay)
+	if u.fail {
+		return nil, fmt.Errorf("%s: timeout", u.addr)
+	}
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{u.addr},
+	})
+	return resp, nil
+}
+
+func (u *strategyUpstream) Address() string {
+	return u.addr
+}
+
+func strategyExchange(t *testing.T, g upstream.Upstream) string {
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeTXT)
+	resp, err := g.Exchange(req)
+	assert.Nil(t, err)
+	if err != nil {
+		return ""
+	}
+	return resp.Answer[0].(*dns.TXT).Txt[0]
+}
+
+func TestUpstreamStrategyFailover(t *testing.T) {
+	u1 := &strategyUpstream{addr: "1", fail: true}
+	u2 := &strategyUpstream{addr: "2"}
+	u3 := &strategyUpstream{addr: "3"}
+	sel := &upstreamSelector{}
+	conf := &FilteringConfig{
+		UpstreamStrategy:   strategyFailover,
+		UpstreamThresholds: map[string]UpstreamThresholds{strategyFailover: {MaxFailures: 2}},
+	}
+	sel.configure(conf, nil)
+	g := sel.wrap([]upstream.Upstream{u1, u2, u3})
+	assert.Equal(t, 1, len(g))
+
+	assert.Equal(t, "2", strategyExchange(t, g[0]))
+	assert.Equal(t, "2", strategyExchange(t, g[0]))
+	assert.Equal(t, 2, u1.count)
+
+	// the failed upstream is skipped until the retry time
+	assert.Equal(t, "2", strategyExchange(t, g[0]))
+	assert.Equal(t, 2, u1.count)
+	assert.Equal(t, 0, u3.count)
+
+	list := sel.getStatsList()
+	assert.Equal(t, 3, len(list))
+	assert.Equal(t, "1", list[0].Address)
+	assert.False(t, list[0].Healthy)
+	assert.Equal(t, uint32(2), list[0].Failures)
+	assert.True(t, list[1].Healthy)
+	assert.Equal(t, uint64(3), list[1].Queries)
+
+	// all upstreams have failed
+	u2.fail = true
+	u3.fail = true
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeTXT)
+	_, err := g[0].Exchange(req)
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamStrategyFastest(t *testing.T) {
+	u1 := &strategyUpstream{addr: "1", delay: 20 * time.Millisecond}
+	u2 := &strategyUpstream{addr: "2"}
+	sel := &upstreamSelector{}
+	sel.configure(&FilteringConfig{UpstreamStrategy: strategyFastest}, nil)
+	g := sel.wrap([]upstream.Upstream{u1, u2})
+
+	// the upstreams without metrics are tried first
+	assert.Equal(t, "1", strategyExchange(t, g[0]))
+	sel.record("2", 5*time.Millisecond, nil, time.Now())
+	for i := 0; i != 5; i++ {
+		assert.Equal(t, "2", strategyExchange(t, g[0]))
+	}
+	assert.Equal(t, 1, u1.count)
+
+	// the upstream is unhealthy if its response time exceeds the threshold
+	sel.configure(&FilteringConfig{
+		UpstreamStrategy:   strategyFastest,
+		UpstreamThresholds: map[string]UpstreamThresholds{strategyFastest: {MaxLatency: 10}},
+	}, []upstream.Upstream{u1, u2})
+	list := sel.getStatsList()
+	assert.False(t, list[0].Healthy)
+	assert.True(t, list[1].Healthy)
+}
+
+func TestUpstreamStrategyWeighted(t *testing.T) {
+	u1 := &strategyUpstream{addr: "1"}
+	u2 := &strategyUpstream{addr: "2"}
+	u3 := &strategyUpstream{addr: "3"}
+	sel := &upstreamSelector{}
+	sel.configure(&FilteringConfig{
+		UpstreamStrategy: strategyWeighted,
+		UpstreamWeights:  map[string]uint32{"1": 3, "3": 0},
+	}, nil)
+	g := sel.wrap([]upstream.Upstream{u1, u2, u3})
+
+	for i := 0; i != 8; i++ {
+		strategyExchange(t, g[0])
+	}
+	assert.Equal(t, 6, u1.count)
+	assert.Equal(t, 2, u2.count)
+	assert.Equal(t, 0, u3.count)
+}
+
+func TestUpstreamStrategyParallel(t *testing.T) {
+	u1 := &strategyUpstream{addr: "1", delay: 100 * time.Millisecond}
+	u2 := &strategyUpstream{addr: "2", delay: 10 * time.Millisecond}
+	u3 := &strategyUpstream{addr: "3", fail: true}
+	sel := &upstreamSelector{}
+	sel.configure(&FilteringConfig{UpstreamStrategy: strategyParallel}, nil)
+	g := sel.wrap([]upstream.Upstream{u1, u2, u3})
+
+	assert.Equal(t, "2", strategyExchange(t, g[0]))
+
+	// the default strategy doesn't wrap the upstreams
+	sel.configure(&FilteringConfig{}, nil)
+	assert.Equal(t, 3, len(sel.wrap([]upstream.Upstream{u1, u2, u3})))
+	assert.NotNil(t, checkUpstreamStrategy("random"))
+}
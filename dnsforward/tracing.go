@@ -0,0 +1,333 @@
+// OpenTelemetry tracing of DNS requests
+// Spans are exported in OTLP/HTTP JSON format.
+
+package dnsforward
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	tracingServiceName   = "AdGuardHome"
+	tracingQueueSize     = 4096 // spans which aren't exported yet.  New spans are dropped when the queue is full.
+	tracingBatchSize     = 512  // max number of spans in a request to the collector
+	tracingFlushInterval = 5 * time.Second
+	tracingTimeout       = 10 * time.Second
+)
+
+// Span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// An operation within a trace
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero: root span
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{} // string, int or bool values
+	err      string
+}
+
+// tracer collects the finished spans and sends them to OTLP collector
+type tracer struct {
+	url    string
+	client *http.Client
+	queue  chan *span
+	stop   chan bool
+	done   chan bool
+}
+
+func newTracer(url string) *tracer {
+	t := &tracer{
+		url:    url,
+		client: &http.Client{Timeout: tracingTimeout},
+		queue:  make(chan *span, tracingQueueSize),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+	go t.run()
+	return t
+}
+
+// Export the remaining spans and stop
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+// Start a new span.  A nil tracer returns nil span.
+func (t *tracer) startSpan(name string, kind int, parent *span, start time.Time) *span {
+	if t == nil {
+		return nil
+	}
+
+	sp := &span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  start,
+	}
+	if parent != nil {
+		sp.traceID = parent.traceID
+		sp.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(sp.traceID[:])
+	}
+	_, _ = rand.Read(sp.spanID[:])
+	return sp
+}
+
+// Start a child span.  A nil span returns nil.
+func (sp *span) child(name string, kind int, start time.Time) *span {
+	if sp == nil {
+		return nil
+	}
+	return sp.tracer.startSpan(name, kind, sp, start)
+}
+
+// Set an attribute.  A nil span is a no-op.
+func (sp *span) setAttr(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	if sp.attrs == nil {
+		sp.attrs = make(map[string]interface{})
+	}
+	sp.attrs[key] = value
+}
+
+// Mark the span as failed.  A nil span is a no-op.
+func (sp *span) setError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.err = err.Error()
+}
+
+// Finish the span and pass it to the exporter.  A nil span is a no-op.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case sp.tracer.queue <- sp:
+	default:
+		// the collector is too slow
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	batch := []*span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.export(batch)
+		if err != nil {
+			log.Debug("Tracing: %s", err)
+		}
+		batch = []*span{}
+	}
+
+	for {
+		select {
+		case sp := <-t.queue:
+			batch = append(batch, sp)
+			if len(batch) >= tracingBatchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-t.stop:
+			n := len(t.queue)
+			for i := 0; i != n; i++ {
+				batch = append(batch, <-t.queue)
+			}
+			flush()
+			close(t.done)
+			return
+		}
+	}
+}
+
+// OTLP JSON objects
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 is encoded as a string
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2: error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func makeOTLPAttr(key string, value interface{}) otlpAttr {
+	a := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (sp *span) toOTLP() otlpSpan {
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(sp.traceID[:]),
+		SpanID:            hex.EncodeToString(sp.spanID[:]),
+		Name:              sp.name,
+		Kind:              sp.kind,
+		StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+	}
+	if sp.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+	}
+	for k, v := range sp.attrs {
+		o.Attributes = append(o.Attributes, makeOTLPAttr(k, v))
+	}
+	if len(sp.err) != 0 {
+		o.Status = &otlpStatus{Code: 2, Message: sp.err}
+	}
+	return o
+}
+
+// Send the spans to OTLP collector
+func (t *tracer) export(batch []*span) error {
+	ss := otlpScopeSpans{}
+	ss.Scope.Name = "dnsforward"
+	for _, sp := range batch {
+		ss.Spans = append(ss.Spans, sp.toOTLP())
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{ss}}
+	rs.Resource.Attributes = []otlpAttr{makeOTLPAttr("service.name", tracingServiceName)}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err)
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: got status code %d", t.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// Start the root span for a DNS request
+func (s *Server) startRequestSpan(ctx *dnsContext) {
+	s.RLock()
+	ctx.span = s.tracer.startSpan("dns.query", spanKindServer, nil, ctx.startTime)
+	s.RUnlock()
+	if ctx.span == nil {
+		return
+	}
+
+	q := ctx.proxyCtx.Req.Question[0]
+	ctx.span.setAttr("dns.qname", strings.TrimSuffix(q.Name, "."))
+	ctx.span.setAttr("dns.qtype", dns.TypeToString[q.Qtype])
+	ctx.span.setAttr("dns.protocol", string(ctx.proxyCtx.Proto))
+}
+
+// Finish the root span of a DNS request
+func finishRequestSpan(ctx *dnsContext) {
+	if ctx.span == nil {
+		return
+	}
+
+	ctx.span.setAttr("client.address", ctx.clientIP)
+	if ctx.result != nil {
+		ctx.span.setAttr("filtering.reason", ctx.result.Reason.String())
+		if len(ctx.result.Rule) != 0 {
+			ctx.span.setAttr("filtering.rule", ctx.result.Rule)
+		}
+	}
+	if ctx.proxyCtx.Res != nil {
+		ctx.span.setAttr("dns.rcode", dns.RcodeToString[ctx.proxyCtx.Res.Rcode])
+	}
+	ctx.span.setError(ctx.err)
+	ctx.span.finish()
+}
+
+// Create a child span for every completed filtering stage
+func traceFilteringStages(ctx *dnsContext) {
+	if ctx.span == nil || ctx.setts == nil {
+		return
+	}
+	ctx.setts.OnStageDone = func(stage string, start time.Time) {
+		ctx.span.child("filtering."+stage, spanKindInternal, start).finish()
+	}
+}
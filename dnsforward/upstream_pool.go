@@ -0,0 +1,342 @@
+// Reuse of TCP, TLS and HTTPS connections to upstream servers
+
+package dnsforward
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamPoolConfig sets how the connections to upstream servers are reused
+type UpstreamPoolConfig struct {
+	Enabled     bool   `yaml:"enabled" json:"enabled"`             // false: the connections are managed by DNS proxy
+	MaxIdle     int    `yaml:"max_idle" json:"max_idle"`           // max number of idle connections per upstream.  0: default (4)
+	IdleTimeout uint32 `yaml:"idle_timeout" json:"idle_timeout"`   // seconds.  0: default (30)
+	MaxAge      uint32 `yaml:"max_age" json:"max_age"`             // max age of a connection (seconds).  0: not limited
+	TCPFastOpen bool   `yaml:"tcp_fast_open" json:"tcp_fast_open"` // send the request in SYN packet (Linux only)
+}
+
+const (
+	defaultPoolMaxIdle     = 4
+	defaultPoolIdleTimeout = 30 // seconds
+	maxPoolMaxIdle         = 64
+)
+
+func checkUpstreamPoolConfig(c UpstreamPoolConfig) error {
+	if c.MaxIdle < 0 || c.MaxIdle > maxPoolMaxIdle {
+		return fmt.Errorf("max_idle must be in range 0..%d", maxPoolMaxIdle)
+	}
+	return nil
+}
+
+// Return TRUE if the connections to the upstream can be reused
+func isPoolableUpstream(addr string) bool {
+	return strings.HasPrefix(addr, "tcp://") ||
+		strings.HasPrefix(addr, "tls://") ||
+		strings.HasPrefix(addr, "https://")
+}
+
+type pooledConn struct {
+	conn    *dns.Conn
+	created time.Time
+	lastUse time.Time
+}
+
+// connPool keeps idle connections to an upstream server
+type connPool struct {
+	maxIdle     int
+	idleTimeout time.Duration
+	maxAge      time.Duration // 0: not limited
+	fastOpen    bool
+
+	sessionCache tls.ClientSessionCache // TLS session resumption makes the handshakes cheaper
+
+	lock      sync.Mutex
+	idle      []*pooledConn // the most recently used connection is the last
+	lastFlush time.Time     // DoH: the last time the idle connections were closed because of max age
+
+	opened    uint64        // number of new connections
+	reused    uint64        // number of requests sent over the existing connections
+	failed    uint64        // number of failed connection attempts
+	handshake time.Duration // total time spent on establishing new connections
+}
+
+func newConnPool(c UpstreamPoolConfig) *connPool {
+	p := &connPool{
+		maxIdle:      c.MaxIdle,
+		idleTimeout:  time.Duration(c.IdleTimeout) * time.Second,
+		maxAge:       time.Duration(c.MaxAge) * time.Second,
+		fastOpen:     c.TCPFastOpen,
+		sessionCache: tls.NewLRUClientSessionCache(0),
+		lastFlush:    time.Now(),
+	}
+	if p.maxIdle == 0 {
+		p.maxIdle = defaultPoolMaxIdle
+	}
+	if p.idleTimeout == 0 {
+		p.idleTimeout = defaultPoolIdleTimeout * time.Second
+	}
+	return p
+}
+
+func (p *connPool) expired(pc *pooledConn, now time.Time) bool {
+	return now.Sub(pc.lastUse) >= p.idleTimeout ||
+		(p.maxAge != 0 && now.Sub(pc.created) >= p.maxAge)
+}
+
+// Get an idle connection.  nil: there are no usable connections.
+func (p *connPool) get(now time.Time) *pooledConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.idle) != 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(pc, now) {
+			_ = pc.conn.Close()
+			continue
+		}
+		p.reused++
+		return pc
+	}
+	return nil
+}
+
+// Return the connection to the pool.  The connection is closed if the pool is full or if it's too old.
+func (p *connPool) put(pc *pooledConn, now time.Time) {
+	pc.lastUse = now
+	p.lock.Lock()
+	if p.expired(pc, now) || len(p.idle) >= p.maxIdle {
+		p.lock.Unlock()
+		_ = pc.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pc)
+	p.lock.Unlock()
+}
+
+func (p *connPool) addOpened(d time.Duration) {
+	p.lock.Lock()
+	p.opened++
+	p.handshake += d
+	p.lock.Unlock()
+}
+
+func (p *connPool) addReused() {
+	p.lock.Lock()
+	p.reused++
+	p.lock.Unlock()
+}
+
+func (p *connPool) addFailed() {
+	p.lock.Lock()
+	p.failed++
+	p.lock.Unlock()
+}
+
+// DoH: close the idle connections of HTTP transport once per max age
+func (p *connPool) flushHTTP(t *http.Transport, now time.Time) {
+	if p.maxAge == 0 {
+		return
+	}
+	p.lock.Lock()
+	flush := now.Sub(p.lastFlush) >= p.maxAge
+	if flush {
+		p.lastFlush = now
+	}
+	p.lock.Unlock()
+	if flush {
+		t.CloseIdleConnections()
+	}
+}
+
+// Close the idle connections
+func (p *connPool) close() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+	for _, pc := range idle {
+		_ = pc.conn.Close()
+	}
+}
+
+// Set up the connection pool for the upstream
+func (u *boundUpstream) initPool(c UpstreamPoolConfig) {
+	u.pool = newConnPool(c)
+	if u.httpClient != nil {
+		t := u.httpClient.Transport.(*http.Transport)
+		t.MaxIdleConns = u.pool.maxIdle
+		t.MaxIdleConnsPerHost = u.pool.maxIdle
+		t.IdleConnTimeout = u.pool.idleTimeout
+		t.TLSClientConfig.ClientSessionCache = u.pool.sessionCache
+	}
+}
+
+// Open a new TCP or TLS connection
+func (u *boundUpstream) dialPooled(network, addr string, server net.IP) (*pooledConn, error) {
+	start := time.Now()
+	d, err := u.dialer(server, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		u.pool.addFailed()
+		return nil, err
+	}
+	if network == "tcp-tls" {
+		tc := tls.Client(c, &tls.Config{ServerName: u.host, ClientSessionCache: u.pool.sessionCache})
+		_ = tc.SetDeadline(time.Now().Add(DefaultTimeout))
+		err = tc.Handshake()
+		if err != nil {
+			_ = c.Close()
+			u.pool.addFailed()
+			return nil, err
+		}
+		c = tc
+	}
+	u.pool.addOpened(time.Since(start))
+
+	now := time.Now()
+	return &pooledConn{conn: &dns.Conn{Conn: c}, created: now, lastUse: now}, nil
+}
+
+func exchangeConn(c *dns.Conn, m *dns.Msg) (*dns.Msg, error) {
+	_ = c.SetDeadline(time.Now().Add(DefaultTimeout))
+	err := c.WriteMsg(m)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return resp, nil
+}
+
+// Send the request over a connection from the pool
+func (u *boundUpstream) exchangePooled(m *dns.Msg, network, addr string, server net.IP) (*dns.Msg, error) {
+	for {
+		pc := u.pool.get(time.Now())
+		reused := pc != nil
+		if !reused {
+			var err error
+			pc, err = u.dialPooled(network, addr, server)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := exchangeConn(pc.conn, m)
+		if err != nil {
+			_ = pc.conn.Close()
+			if reused {
+				continue // the server may have closed the idle connection
+			}
+			return nil, err
+		}
+		u.pool.put(pc, time.Now())
+		return resp, nil
+	}
+}
+
+type upstreamPoolStatsJSON struct {
+	Address        string `json:"address"`
+	Opened         uint64 `json:"opened"`
+	Reused         uint64 `json:"reused"`
+	Failed         uint64 `json:"failed"`
+	Idle           int    `json:"idle"`
+	AvgHandshakeMS uint64 `json:"avg_handshake_ms"`
+}
+
+// Get the statistics of the connection pools
+func (o *outboundCtx) poolStats() []upstreamPoolStatsJSON {
+	o.lock.Lock()
+	var list []*boundUpstream
+	for _, u := range o.bound {
+		if b, ok := u.(*boundUpstream); ok && b.pool != nil {
+			list = append(list, b)
+		}
+	}
+	o.lock.Unlock()
+
+	r := []upstreamPoolStatsJSON{}
+	for _, b := range list {
+		p := b.pool
+		p.lock.Lock()
+		st := upstreamPoolStatsJSON{
+			Address: b.addr,
+			Opened:  p.opened,
+			Reused:  p.reused,
+			Failed:  p.failed,
+			Idle:    len(p.idle),
+		}
+		if p.opened != 0 {
+			st.AvgHandshakeMS = uint64(p.handshake/time.Millisecond) / p.opened
+		}
+		p.lock.Unlock()
+		r = append(r, st)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Address < r[j].Address
+	})
+	return r
+}
+
+type upstreamPoolJSON struct {
+	UpstreamPoolConfig
+	Upstreams []upstreamPoolStatsJSON `json:"upstreams,omitempty"` // status only
+}
+
+func (s *Server) handleUpstreamPoolStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := upstreamPoolJSON{UpstreamPoolConfig: s.conf.UpstreamPool}
+	s.RUnlock()
+	j.Upstreams = s.outbound.poolStats()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleUpstreamPoolConfig(w http.ResponseWriter, r *http.Request) {
+	j := UpstreamPoolConfig{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkUpstreamPoolConfig(j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	s.Lock()
+	s.conf.UpstreamPool = j
+	s.Unlock()
+	s.conf.ConfigModified()
+
+	// the upstream objects are re-created
+	err = s.Reconfigure(nil)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+}
@@ -0,0 +1,20 @@
+package dnsforward
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Enable TCP Fast Open for the outgoing connection:
+// the data of the first write is sent in SYN packet if the server supports it
+func tcpFastOpenControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
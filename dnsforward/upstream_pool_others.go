@@ -0,0 +1,12 @@
+// +build !linux
+
+package dnsforward
+
+import (
+	"syscall"
+)
+
+// TCP Fast Open for the outgoing connections is supported only on Linux
+func tcpFastOpenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,62 @@
+// Validation of the DNS settings from the configuration file
+
+package dnsforward
+
+import (
+	"fmt"
+)
+
+// ConfigError is an invalid setting
+type ConfigError struct {
+	Field string // YAML name of the setting ("upstream_strategy")
+	Err   error
+}
+
+// ValidateFilteringConfig checks the DNS settings before they are applied.
+// All invalid settings are returned, not only the first one.
+func ValidateFilteringConfig(c *FilteringConfig) []ConfigError {
+	errs := []ConfigError{}
+	add := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, ConfigError{Field: field, Err: err})
+		}
+	}
+
+	add("upstream_dns", ValidateUpstreams(c.UpstreamDNS))
+	add("upstream_strategy", checkUpstreamStrategy(c.UpstreamStrategy))
+	add("upstream_pool", checkUpstreamPoolConfig(c.UpstreamPool))
+	if len(c.UpstreamSource) != 0 {
+		add("upstream_source", checkUpstreamSource(c.UpstreamSource))
+	}
+	for _, us := range c.UpstreamSources {
+		add("upstream_sources", checkUpstreamSource(us.Source))
+	}
+
+	if len(c.BlockingMode) != 0 && !checkBlockingMode(dnsConfigJSON{
+		BlockingMode:         c.BlockingMode,
+		BlockingIPv4:         c.BlockingIPv4,
+		BlockingIPv6:         c.BlockingIPv6,
+		BlockingIPv6NXDomain: c.BlockingIPv6NXDomain,
+	}) {
+		add("blocking_mode", fmt.Errorf("invalid blocking mode %q or blocking IP addresses", c.BlockingMode))
+	}
+	if !checkReasonBlockingMode(c.ParentalBlockingMode, c.ParentalBlockingIP) {
+		add("parental_blocking_mode", fmt.Errorf("invalid blocking mode %q or blocking IP address", c.ParentalBlockingMode))
+	}
+	if !checkReasonBlockingMode(c.SafeBrowsingBlockingMode, c.SafeBrowsingBlockingIP) {
+		add("safebrowsing_blocking_mode", fmt.Errorf("invalid blocking mode %q or blocking IP address", c.SafeBrowsingBlockingMode))
+	}
+
+	add("blocked_response_ttl", checkTTL(c.BlockedResponseTTL))
+	add("rewrite_ttl", checkTTL(c.RewriteTTL))
+	add("ratelimit_action", checkRatelimitAction(c.RatelimitAction))
+	add("rebinding_protection_action", checkRebindingAction(c.RebindingProtectionAction))
+	add("dnssec_validation", checkDNSSECMode(c.DNSSECValidation, false))
+	add("allowed_clients", checkIPCIDRArray(c.AllowedClients))
+	add("disallowed_clients", checkIPCIDRArray(c.DisallowedClients))
+	add("ptr_forwarding", checkPTRForwarding(c.PTRForwarding))
+	add("views", checkViews(c.Views))
+	add("listeners", checkListeners(c.Listeners, c.Views))
+	add("mdns_interfaces", checkMDNSInterfaces(c.MDNSInterfaces))
+	return errs
+}
@@ -0,0 +1,185 @@
+// Split-horizon DNS: views selected by client subnet
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// View is a named set of settings for the clients from the subnets,
+// so that e.g. VPN clients and LAN clients receive different answers for the same names
+type View struct {
+	Name       string                   `yaml:"name" json:"name"`
+	Subnets    []string                 `yaml:"subnets" json:"subnets"`         // client subnets or IP addresses ("10.8.0.0/24", "192.168.1.5")
+	Rewrites   []dnsfilter.RewriteEntry `yaml:"rewrites" json:"rewrites"`       // take precedence over the global rewrites
+	LocalZones []LocalZone              `yaml:"local_zones" json:"local_zones"` // take precedence over the global local zones
+	Upstreams  []string                 `yaml:"upstreams" json:"upstreams"`     // the same syntax as for the client's upstreams.  Empty: the global upstreams are used
+}
+
+// view is a prepared View
+type view struct {
+	name       string
+	subnets    []*net.IPNet
+	rewrites   []dnsfilter.RewriteEntry
+	localZones map[string]*localZone
+	upstreams  *ClientUpstreams // nil: not set
+}
+
+// Parse the subnet or IP address
+func parseViewSubnet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	return subnet, err
+}
+
+// Check the settings of views
+func checkViews(list []View) error {
+	names := map[string]bool{}
+	for _, v := range list {
+		if len(v.Name) == 0 {
+			return fmt.Errorf("view name is required")
+		}
+		if names[v.Name] {
+			return fmt.Errorf("duplicate view name: %s", v.Name)
+		}
+		names[v.Name] = true
+
+		if len(v.Subnets) == 0 {
+			return fmt.Errorf("%s: at least one subnet is required", v.Name)
+		}
+		for _, s := range v.Subnets {
+			_, err := parseViewSubnet(s)
+			if err != nil {
+				return fmt.Errorf("%s: %s", v.Name, err)
+			}
+		}
+		for _, r := range v.Rewrites {
+			if len(r.Domain) == 0 || (len(r.Answer) == 0 && !r.Exception) {
+				return fmt.Errorf("%s: rewrite domain and answer are required", v.Name)
+			}
+		}
+		for _, z := range v.LocalZones {
+			_, err := loadLocalZone(z)
+			if err != nil {
+				return fmt.Errorf("%s: local zone %s: %s", v.Name, z.Name, err)
+			}
+		}
+		err := ValidateClientUpstreams(v.Upstreams)
+		if err != nil {
+			return fmt.Errorf("%s: %s", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// Prepare the views for use
+func (s *Server) prepareViews(list []View) ([]*view, error) {
+	var views []*view
+	for _, v := range list {
+		pv := &view{
+			name:       v.Name,
+			rewrites:   dnsfilter.PrepareRewrites(v.Rewrites),
+			localZones: loadLocalZones(v.LocalZones),
+		}
+		for _, sn := range v.Subnets {
+			subnet, err := parseViewSubnet(sn)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %s", v.Name, err)
+			}
+			pv.subnets = append(pv.subnets, subnet)
+		}
+		if len(v.Upstreams) != 0 {
+			var err error
+			pv.upstreams, err = NewClientUpstreams(v.Upstreams, s.conf.BootstrapDNS)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %s", v.Name, err)
+			}
+		}
+		views = append(views, pv)
+	}
+	return views, nil
+}
+
+// Find the view for the client.  The first matching view is used.
+func (s *Server) findView(clientIP string) *view {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	for _, v := range s.views {
+		for _, subnet := range v.subnets {
+			if subnet.Contains(ip) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+type viewsJSON struct {
+	Views []View `json:"views"`
+}
+
+func (s *Server) handleViewsList(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	j := viewsJSON{
+		Views: append([]View{}, s.conf.Views...),
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (s *Server) handleViewsSet(w http.ResponseWriter, r *http.Request) {
+	j := viewsJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkViews(j.Views)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	views, err := s.prepareViews(j.Views)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	log.Debug("DNS: set %d views", len(views))
+
+	s.Lock()
+	s.conf.Views = j.Views
+	s.views = views
+	s.Unlock()
+	s.conf.ConfigModified()
+}
@@ -0,0 +1,61 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViews(t *testing.T) {
+	list := []View{
+		{
+			Name:     "vpn",
+			Subnets:  []string{"10.8.0.0/24", "fd00:8::/64"},
+			Rewrites: []dnsfilter.RewriteEntry{{Domain: "NAS.example.org", Answer: "10.8.0.10"}},
+			LocalZones: []LocalZone{
+				{Name: "home.lan", Records: []string{"nas IN A 10.8.0.10"}},
+			},
+			Upstreams: []string{"[/corp.example/]10.8.0.1"},
+		},
+		{
+			Name:    "lan",
+			Subnets: []string{"192.168.1.0/24", "10.8.0.5"},
+		},
+	}
+	assert.Nil(t, checkViews(list))
+
+	s := &Server{}
+	views, err := s.prepareViews(list)
+	assert.Nil(t, err)
+	s.views = views
+
+	v := s.findView("10.8.0.5")
+	assert.NotNil(t, v)
+	assert.Equal(t, "vpn", v.name) // the first matching view is used
+	assert.Equal(t, "nas.example.org", v.rewrites[0].Domain)
+	assert.Equal(t, dns.TypeA, v.rewrites[0].Type)
+	assert.NotNil(t, findLocalZone(v.localZones, "nas.home.lan."))
+	assert.Equal(t, 1, len(v.upstreams.forHost("www.corp.example.")))
+	assert.Equal(t, 0, len(v.upstreams.forHost("example.org.")))
+
+	v = s.findView("fd00:8::1")
+	assert.NotNil(t, v)
+	assert.Equal(t, "vpn", v.name)
+
+	v = s.findView("192.168.1.2")
+	assert.NotNil(t, v)
+	assert.Equal(t, "lan", v.name)
+	assert.Nil(t, v.upstreams)
+
+	assert.Nil(t, s.findView("1.2.3.4"))
+	assert.Nil(t, s.findView(""))
+
+	// invalid settings
+	assert.NotNil(t, checkViews([]View{{Name: "vpn"}}))
+	assert.NotNil(t, checkViews([]View{{Subnets: []string{"10.8.0.0/24"}}}))
+	assert.NotNil(t, checkViews([]View{{Name: "vpn", Subnets: []string{"10.8.0.0/33"}}}))
+	assert.NotNil(t, checkViews([]View{list[1], list[1]}))
+	assert.NotNil(t, checkViews([]View{{Name: "vpn", Subnets: []string{"10.8.0.0/24"}, Upstreams: []string{"abc://10.8.0.1"}}}))
+}
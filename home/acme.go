@@ -0,0 +1,674 @@
+// ACME: obtain and renew TLS certificates automatically (e.g. from Let's Encrypt)
+
+package home
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeChallengePath           = "/.well-known/acme-challenge/"
+	acmeHTTP01                  = "http-01"
+	acmeDNS01                   = "dns-01"
+	letsEncryptDirectoryURL     = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeDefaultRenewBefore      = 30 // in days
+	acmeDefaultPropagationDelay = 60 // in seconds
+	acmeCheckInterval           = 12 * time.Hour
+	acmeRetryInterval           = 1 * time.Hour
+	acmeTimeout                 = 10 * time.Minute // the maximum time for obtaining a certificate
+)
+
+type acmeConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Email   string `yaml:"email" json:"email"` // contact e-mail for the account (optional)
+
+	// Domain names for the certificate.  Wildcard names (*.example.org) require dns-01 challenge.
+	Domains []string `yaml:"domains" json:"domains"`
+
+	// ACME server directory URL.  "": Let's Encrypt
+	DirectoryURL string `yaml:"directory_url" json:"directory_url"`
+
+	// Challenge type: "http-01" or "dns-01"
+	Challenge string `yaml:"challenge" json:"challenge"`
+
+	// http-01: the address for a temporary HTTP server which answers the challenge (e.g. ":80").
+	// "": the challenge is answered by the web interface and the block page servers, one of them must listen on port 80.
+	HTTPAddress string `yaml:"http_address" json:"http_address"`
+
+	// dns-01: DNS provider ("cloudflare", "rfc2136", "exec") and its settings
+	DNSProvider string            `yaml:"dns_provider" json:"dns_provider"`
+	DNSSettings map[string]string `yaml:"dns_settings" json:"dns_settings"`
+
+	// dns-01: the time to wait until the TXT record is propagated (in seconds).  0: default (60)
+	DNSPropagationDelay uint32 `yaml:"dns_propagation_delay" json:"dns_propagation_delay"`
+
+	// Renew the certificate this number of days before it expires.  0: default (30)
+	RenewBefore uint32 `yaml:"renew_before" json:"renew_before"`
+}
+
+// The state of the certificate
+type acmeStatus struct {
+	Running     bool      `json:"running"` // the certificate is being obtained right now
+	LastError   string    `json:"last_error"`
+	LastRenewal time.Time `json:"last_renewal"`
+	NotAfter    time.Time `json:"not_after"` // the expiration time of the current certificate
+}
+
+// ACME module
+type acmeManager struct {
+	conf   acmeConfig
+	dir    string // directory for the account key, the certificate and its key
+	client *http.Client
+
+	dnsProvider acmeDNSProvider
+
+	lock   sync.Mutex
+	tokens map[string]string // http-01: token -> key authorization
+	status acmeStatus
+
+	renew chan bool // request to renew the certificate now
+	stop  chan bool
+}
+
+// Create module context
+func initACME(conf acmeConfig, dir string, client *http.Client) *acmeManager {
+	m := &acmeManager{
+		conf:   conf,
+		dir:    dir,
+		client: client,
+		tokens: map[string]string{},
+		renew:  make(chan bool, 1),
+	}
+	if len(m.conf.Challenge) == 0 {
+		m.conf.Challenge = acmeHTTP01
+	}
+	if m.conf.RenewBefore == 0 {
+		m.conf.RenewBefore = acmeDefaultRenewBefore
+	}
+	if m.conf.DNSPropagationDelay == 0 {
+		m.conf.DNSPropagationDelay = acmeDefaultPropagationDelay
+	}
+	return m
+}
+
+// Check ACME settings
+func checkACMEConfig(conf acmeConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if len(conf.Domains) == 0 {
+		return fmt.Errorf("domains list is empty")
+	}
+
+	switch conf.Challenge {
+	case "", acmeHTTP01:
+		for _, d := range conf.Domains {
+			if strings.HasPrefix(d, "*.") {
+				return fmt.Errorf("wildcard domain %s requires %s challenge", d, acmeDNS01)
+			}
+		}
+
+	case acmeDNS01:
+		_, err := newACMEDNSProvider(conf.DNSProvider, conf.DNSSettings, nil)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("invalid challenge type: %s", conf.Challenge)
+	}
+
+	for _, d := range conf.Domains {
+		err := utils.IsValidHostname(strings.TrimPrefix(d, "*."))
+		if err != nil {
+			return fmt.Errorf("invalid domain name %s: %s", d, err)
+		}
+	}
+	return nil
+}
+
+// Start the background worker
+func (m *acmeManager) Start() {
+	if !m.conf.Enabled {
+		return
+	}
+
+	if m.conf.Challenge == acmeDNS01 {
+		var err error
+		m.dnsProvider, err = newACMEDNSProvider(m.conf.DNSProvider, m.conf.DNSSettings, m.client)
+		if err != nil {
+			log.Error("ACME: %s", err)
+			return
+		}
+	}
+
+	err := os.MkdirAll(m.dir, 0700)
+	if err != nil {
+		log.Error("ACME: %s", err)
+		return
+	}
+
+	m.stop = make(chan bool)
+	go m.workerLoop(m.stop)
+}
+
+// Close - stop the background worker
+// Note: we don't wait until the worker is stopped, because it may be waiting for the control lock.
+func (m *acmeManager) Close() {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+// Renew the certificate now
+func (m *acmeManager) Renew() {
+	select {
+	case m.renew <- true:
+	default:
+	}
+}
+
+func (m *acmeManager) certFile() string {
+	return filepath.Join(m.dir, "cert.pem")
+}
+
+func (m *acmeManager) keyFile() string {
+	return filepath.Join(m.dir, "key.pem")
+}
+
+func (m *acmeManager) workerLoop(stop chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	force := false
+	for {
+		wait := acmeCheckInterval
+		err := m.check(ctx, stop, force)
+		if err != nil {
+			log.Error("ACME: %s", err)
+			wait = acmeRetryInterval
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-m.renew:
+			force = true
+		case <-time.After(wait):
+			force = false
+		}
+	}
+}
+
+// Obtain a new certificate if the current one is going to expire, and apply it
+func (m *acmeManager) check(ctx context.Context, stop chan bool, force bool) error {
+	renewBefore := time.Duration(m.conf.RenewBefore) * 24 * time.Hour
+	certPEM, err := ioutil.ReadFile(m.certFile())
+	renewed := false
+	if force || err != nil || acmeNeedRenew(certPEM, m.conf.Domains, renewBefore, time.Now()) {
+		m.setStatus(func(s *acmeStatus) { s.Running = true })
+		certPEM, err = m.renewCert(ctx)
+		m.setStatus(func(s *acmeStatus) {
+			s.Running = false
+			s.LastError = ""
+			if err != nil {
+				s.LastError = err.Error()
+			} else {
+				s.LastRenewal = time.Now()
+			}
+		})
+		if err != nil {
+			return err
+		}
+		renewed = true
+	}
+
+	cert, err := parseCertPEM(certPEM)
+	if err == nil {
+		m.setStatus(func(s *acmeStatus) { s.NotAfter = cert.NotAfter })
+	}
+
+	return m.apply(stop, renewed)
+}
+
+func (m *acmeManager) setStatus(f func(s *acmeStatus)) {
+	m.lock.Lock()
+	f(&m.status)
+	m.lock.Unlock()
+}
+
+func (m *acmeManager) getStatus() acmeStatus {
+	m.lock.Lock()
+	s := m.status
+	m.lock.Unlock()
+	return s
+}
+
+// Obtain a new certificate and store it with its private key
+func (m *acmeManager) renewCert(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+
+	log.Info("ACME: obtaining a certificate for %v", m.conf.Domains)
+	certPEM, keyPEM, err := m.obtain(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.SafeWrite(m.keyFile(), keyPEM)
+	if err == nil {
+		err = os.Chmod(m.keyFile(), 0600)
+	}
+	if err == nil {
+		err = file.SafeWrite(m.certFile(), certPEM)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("ACME: obtained a certificate for %v", m.conf.Domains)
+	return certPEM, nil
+}
+
+// Use the certificate in TLS settings
+// renewed: the certificate has been just renewed, otherwise it's applied only if TLS settings don't use it
+func (m *acmeManager) apply(stop chan bool, renewed bool) error {
+	Context.controlLock.Lock()
+	defer Context.controlLock.Unlock()
+
+	select {
+	case <-stop:
+		// the settings have been changed while we were waiting for the lock
+		return nil
+	default:
+	}
+
+	if !renewed && config.TLS.CertificatePath == m.certFile() && config.TLS.PrivateKeyPath == m.keyFile() {
+		return nil
+	}
+
+	data := config.TLS
+	data.CertificateChain = ""
+	data.PrivateKey = ""
+	data.CertificatePath = m.certFile()
+	data.PrivateKeyPath = m.keyFile()
+	if len(data.ServerName) == 0 {
+		data.ServerName = strings.TrimPrefix(m.conf.Domains[0], "*.")
+	}
+
+	status := tlsConfigStatus{}
+	if !tlsLoadConfig(&data, &status) {
+		return fmt.Errorf("TLS: %s", status.WarningValidation)
+	}
+	data.tlsConfigStatus = validateCertificates(string(data.CertificateChainData), string(data.PrivateKeyData), data.ServerName)
+	if !data.ValidPair {
+		return fmt.Errorf("TLS: %s", data.WarningValidation)
+	}
+
+	config.TLS = data
+	err := writeAllConfigsAndReloadDNS()
+	if err != nil {
+		return err
+	}
+	restartHTTPSServer()
+
+	if Context.blockPage != nil {
+		// the block page server has a copy of the certificate
+		Context.blockPage.Close()
+		Context.blockPage.Start()
+	}
+
+	log.Info("ACME: TLS settings have been updated")
+	return nil
+}
+
+// Return TRUE if the certificate doesn't exist, doesn't contain all domain names or is going to expire
+func acmeNeedRenew(certPEM []byte, domains []string, renewBefore time.Duration, now time.Time) bool {
+	cert, err := parseCertPEM(certPEM)
+	if err != nil {
+		return true
+	}
+
+	for _, d := range domains {
+		if !stringArrayContains(cert.DNSNames, d) {
+			return true
+		}
+	}
+	return now.Add(renewBefore).After(cert.NotAfter)
+}
+
+// Parse the first certificate of PEM-encoded chain
+func parseCertPEM(data []byte) (*x509.Certificate, error) {
+	b, _ := pem.Decode(data)
+	if b == nil || b.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return x509.ParseCertificate(b.Bytes)
+}
+
+// Load the account key or create a new one
+// The key is encrypted with the master key if the encryption of secrets is enabled.
+func acmeAccountKey(fn string) (*ecdsa.PrivateKey, error) {
+	data, encrypted, err := readSecretFile(fn)
+	if err == nil {
+		b, _ := pem.Decode(data)
+		if b == nil || b.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("%s: invalid key", fn)
+		}
+		if config.Secrets.Encrypt && !encrypted {
+			// the key was stored before the encryption was enabled
+			err = writeSecretFile(fn, data)
+			if err != nil {
+				log.Error("acme: encrypting the account key: %s", err)
+			}
+		}
+		return x509.ParseECPrivateKey(b.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = writeSecretFile(fn, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// Obtain a new certificate from ACME server
+// Return PEM-encoded certificate chain and private key
+func (m *acmeManager) obtain(ctx context.Context) ([]byte, []byte, error) {
+	accountKey, err := acmeAccountKey(filepath.Join(m.dir, "account.key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("account key: %s", err)
+	}
+
+	cl := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: m.conf.DirectoryURL,
+		HTTPClient:   m.client,
+		UserAgent:    "AdGuardHome",
+	}
+	if len(cl.DirectoryURL) == 0 {
+		cl.DirectoryURL = letsEncryptDirectoryURL
+	}
+
+	acct := &acme.Account{}
+	if len(m.conf.Email) != 0 {
+		acct.Contact = []string{"mailto:" + m.conf.Email}
+	}
+	_, err = cl.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, nil, fmt.Errorf("register: %s", err)
+	}
+
+	if m.conf.Challenge == acmeHTTP01 && len(m.conf.HTTPAddress) != 0 {
+		srv := m.startChallengeServer()
+		defer func() {
+			_ = srv.Shutdown(context.TODO())
+		}()
+	}
+
+	order, err := cl.AuthorizeOrder(ctx, acme.DomainIDs(m.conf.Domains...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("order: %s", err)
+	}
+	for _, u := range order.AuthzURLs {
+		err = m.authorize(ctx, cl, u)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	order, err = cl.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("order: %s", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: strings.TrimPrefix(m.conf.Domains[0], "*.")},
+		DNSNames: m.conf.Domains,
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, req, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := cl.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finalize: %s", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Prove that we control the domain name
+func (m *acmeManager) authorize(ctx context.Context, cl *acme.Client, url string) error {
+	z, err := cl.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("authorization: %s", err)
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	domain := z.Identifier.Value
+
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == m.conf.Challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s: challenge %s isn't offered", domain, m.conf.Challenge)
+	}
+
+	switch chal.Type {
+	case acmeHTTP01:
+		resp, err := cl.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		m.lock.Lock()
+		m.tokens[chal.Token] = resp
+		m.lock.Unlock()
+		defer func() {
+			m.lock.Lock()
+			delete(m.tokens, chal.Token)
+			m.lock.Unlock()
+		}()
+
+	case acmeDNS01:
+		val, err := cl.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := "_acme-challenge." + dns.Fqdn(domain)
+		err = m.dnsProvider.Present(fqdn, val)
+		if err != nil {
+			return fmt.Errorf("%s: DNS provider: %s", domain, err)
+		}
+		defer func() {
+			err := m.dnsProvider.CleanUp(fqdn, val)
+			if err != nil {
+				log.Error("ACME: %s: DNS provider: %s", domain, err)
+			}
+		}()
+
+		log.Debug("ACME: waiting %ds until TXT record %s is propagated", m.conf.DNSPropagationDelay, fqdn)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(m.conf.DNSPropagationDelay) * time.Second):
+		}
+	}
+
+	_, err = cl.Accept(ctx, chal)
+	if err != nil {
+		return fmt.Errorf("%s: accept: %s", domain, err)
+	}
+	_, err = cl.WaitAuthorization(ctx, z.URI)
+	if err != nil {
+		return fmt.Errorf("%s: %s", domain, err)
+	}
+	log.Debug("ACME: %s: authorized", domain)
+	return nil
+}
+
+// Start a temporary HTTP server for http-01 challenge
+func (m *acmeManager) startChallengeServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(acmeChallengePath, m.handleChallenge)
+	srv := &http.Server{
+		Addr:    m.conf.HTTPAddress,
+		Handler: mux,
+	}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Error("ACME: %s", err)
+		}
+	}()
+	return srv
+}
+
+// Respond to http-01 challenge
+func (m *acmeManager) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+	m.lock.Lock()
+	resp, ok := m.tokens[token]
+	m.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	log.Debug("ACME: responding to http-01 challenge from %s", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(resp))
+}
+
+func handleACMEChallenge(w http.ResponseWriter, r *http.Request) {
+	if Context.acme == nil {
+		http.NotFound(w, r)
+		return
+	}
+	Context.acme.handleChallenge(w, r)
+}
+
+type acmeStatusJSON struct {
+	acmeConfig
+	acmeStatus
+}
+
+func handleACMEStatus(w http.ResponseWriter, r *http.Request) {
+	resp := acmeStatusJSON{
+		acmeConfig: config.ACME,
+	}
+	if Context.acme != nil {
+		resp.acmeStatus = Context.acme.getStatus()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleACMEConfig(w http.ResponseWriter, r *http.Request) {
+	conf := acmeConfig{}
+	err := json.NewDecoder(r.Body).Decode(&conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkACMEConfig(conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.ACME = conf
+	if Context.acme != nil {
+		Context.acme.Close()
+		Context.acme = initACME(conf, Context.acme.dir, Context.client)
+		Context.acme.Start()
+	}
+
+	onConfigModified()
+	returnOK(w)
+}
+
+func handleACMERenew(w http.ResponseWriter, r *http.Request) {
+	if Context.acme == nil || !config.ACME.Enabled {
+		httpError(w, http.StatusBadRequest, "ACME is disabled")
+		return
+	}
+	Context.acme.Renew()
+	returnOK(w)
+}
+
+// RegisterACMEHandlers - register handlers
+func RegisterACMEHandlers() {
+	httpRegister(http.MethodGet, "/control/acme/status", handleACMEStatus)
+	httpRegister(http.MethodPost, "/control/acme/config", handleACMEConfig)
+	httpRegister(http.MethodPost, "/control/acme/renew", handleACMERenew)
+
+	// ACME server must be able to reach it without authentication and without redirection to HTTPS
+	http.HandleFunc(acmeChallengePath, handleACMEChallenge)
+}
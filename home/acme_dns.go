@@ -0,0 +1,271 @@
+// ACME: DNS providers for dns-01 challenge
+
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const cloudflareAPIURL = "https://api.cloudflare.com/client/v4"
+
+// DNS provider creates and removes TXT records for dns-01 challenge
+type acmeDNSProvider interface {
+	// Create TXT record
+	Present(fqdn string, value string) error
+
+	// Remove TXT record
+	CleanUp(fqdn string, value string) error
+}
+
+// Create DNS provider object
+// client: nil: only check the settings
+func newACMEDNSProvider(name string, settings map[string]string, client *http.Client) (acmeDNSProvider, error) {
+	switch name {
+	case "cloudflare":
+		p := &cloudflareProvider{
+			apiURL:  cloudflareAPIURL,
+			token:   settings["api_token"],
+			zoneID:  settings["zone_id"],
+			client:  client,
+			records: map[string]string{},
+		}
+		if len(p.token) == 0 {
+			return nil, fmt.Errorf("cloudflare: api_token isn't set")
+		}
+		return p, nil
+
+	case "rfc2136":
+		p := &rfc2136Provider{
+			nameserver: settings["nameserver"],
+			zone:       settings["zone"],
+			tsigKey:    settings["tsig_key"],
+			tsigSecret: settings["tsig_secret"],
+			tsigAlg:    settings["tsig_algorithm"],
+		}
+		if len(p.nameserver) == 0 || len(p.zone) == 0 {
+			return nil, fmt.Errorf("rfc2136: nameserver and zone must be set")
+		}
+		if _, _, err := net.SplitHostPort(p.nameserver); err != nil {
+			p.nameserver = net.JoinHostPort(p.nameserver, "53")
+		}
+		p.zone = dns.Fqdn(p.zone)
+		if len(p.tsigKey) != 0 {
+			p.tsigKey = dns.Fqdn(p.tsigKey)
+			if len(p.tsigAlg) == 0 {
+				p.tsigAlg = dns.HmacSHA256
+			}
+			p.tsigAlg = dns.Fqdn(p.tsigAlg)
+		}
+		return p, nil
+
+	case "exec":
+		p := &execProvider{
+			command: settings["command"],
+		}
+		if len(p.command) == 0 {
+			return nil, fmt.Errorf("exec: command isn't set")
+		}
+		return p, nil
+	}
+
+	return nil, fmt.Errorf("unknown DNS provider: %s", name)
+}
+
+// Cloudflare API
+type cloudflareProvider struct {
+	apiURL  string
+	token   string
+	zoneID  string // "": find the zone by the record name
+	client  *http.Client
+	records map[string]string // record name + value -> record ID
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// Send API request and decode the result
+func (p *cloudflareProvider) request(method string, path string, body interface{}, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, p.apiURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	cr := cloudflareResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&cr)
+	if err != nil {
+		return fmt.Errorf("%s %s: status code %d: %s", method, path, resp.StatusCode, err)
+	}
+	if !cr.Success {
+		msgs := []string{}
+		for _, e := range cr.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(cr.Result, result)
+	}
+	return nil
+}
+
+// Find the zone which contains the record: try all parent domains
+func (p *cloudflareProvider) findZone(fqdn string) (string, error) {
+	if len(p.zoneID) != 0 {
+		return p.zoneID, nil
+	}
+
+	labels := dns.SplitDomainName(fqdn)
+	for i := 1; i < len(labels)-1; i++ {
+		name := strings.Join(labels[i:], ".")
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		err := p.request("GET", "/zones?name="+name, nil, &zones)
+		if err != nil {
+			return "", err
+		}
+		if len(zones) != 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("zone for %s isn't found", fqdn)
+}
+
+func (p *cloudflareProvider) Present(fqdn string, value string) error {
+	zone, err := p.findZone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	rec := map[string]interface{}{
+		"type":    "TXT",
+		"name":    strings.TrimSuffix(fqdn, "."),
+		"content": value,
+		"ttl":     120,
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	err = p.request("POST", "/zones/"+zone+"/dns_records", rec, &result)
+	if err != nil {
+		return err
+	}
+	p.records[fqdn+value] = zone + "/dns_records/" + result.ID
+	return nil
+}
+
+func (p *cloudflareProvider) CleanUp(fqdn string, value string) error {
+	id, ok := p.records[fqdn+value]
+	if !ok {
+		return nil
+	}
+	delete(p.records, fqdn+value)
+	return p.request("DELETE", "/zones/"+id, nil, nil)
+}
+
+// Dynamic DNS update (RFC 2136) with optional TSIG authentication
+type rfc2136Provider struct {
+	nameserver string // host:port
+	zone       string
+	tsigKey    string // "": no TSIG
+	tsigSecret string // base64
+	tsigAlg    string
+}
+
+func (p *rfc2136Provider) update(fqdn string, value string, insert bool) error {
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		Txt: []string{value},
+	}
+
+	m := &dns.Msg{}
+	m.SetUpdate(p.zone)
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+
+	c := &dns.Client{
+		Net:     "tcp",
+		Timeout: 10 * time.Second,
+	}
+	if len(p.tsigKey) != 0 {
+		m.SetTsig(p.tsigKey, p.tsigAlg, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{p.tsigKey: p.tsigSecret}
+	}
+
+	resp, _, err := c.Exchange(m, p.nameserver)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%s: %s", p.nameserver, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) Present(fqdn string, value string) error {
+	return p.update(fqdn, value, true)
+}
+
+func (p *rfc2136Provider) CleanUp(fqdn string, value string) error {
+	return p.update(fqdn, value, false)
+}
+
+// External command: "command present|cleanup <fqdn> <value>"
+type execProvider struct {
+	command string
+}
+
+func (p *execProvider) run(action string, fqdn string, value string) error {
+	cmd := exec.Command(p.command, action, fqdn, value)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %s", p.command, action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (p *execProvider) Present(fqdn string, value string) error {
+	return p.run("present", fqdn, value)
+}
+
+func (p *execProvider) CleanUp(fqdn string, value string) error {
+	return p.run("cleanup", fqdn, value)
+}
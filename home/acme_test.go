@@ -0,0 +1,172 @@
+package home
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCertPEM(t *testing.T, names []string, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestACMENeedRenew(t *testing.T) {
+	now := time.Now()
+	renewBefore := 30 * 24 * time.Hour
+	cert := testCertPEM(t, []string{"example.org", "*.example.org"}, now.Add(60*24*time.Hour))
+
+	assert.False(t, acmeNeedRenew(cert, []string{"example.org"}, renewBefore, now))
+	assert.False(t, acmeNeedRenew(cert, []string{"example.org", "*.example.org"}, renewBefore, now))
+	// a new domain name
+	assert.True(t, acmeNeedRenew(cert, []string{"example.org", "dns.example.net"}, renewBefore, now))
+	// expires soon
+	assert.True(t, acmeNeedRenew(cert, []string{"example.org"}, renewBefore, now.Add(31*24*time.Hour)))
+	// no certificate
+	assert.True(t, acmeNeedRenew(nil, []string{"example.org"}, renewBefore, now))
+}
+
+func TestCheckACMEConfig(t *testing.T) {
+	assert.Nil(t, checkACMEConfig(acmeConfig{}))
+	assert.NotNil(t, checkACMEConfig(acmeConfig{Enabled: true}))
+	assert.Nil(t, checkACMEConfig(acmeConfig{Enabled: true, Domains: []string{"dns.example.org"}}))
+	assert.NotNil(t, checkACMEConfig(acmeConfig{Enabled: true, Domains: []string{"*.example.org"}}))
+	assert.NotNil(t, checkACMEConfig(acmeConfig{Enabled: true, Domains: []string{"example.org"}, Challenge: "tls-alpn-01"}))
+
+	conf := acmeConfig{
+		Enabled:     true,
+		Domains:     []string{"*.example.org"},
+		Challenge:   acmeDNS01,
+		DNSProvider: "cloudflare",
+	}
+	assert.NotNil(t, checkACMEConfig(conf))
+	conf.DNSSettings = map[string]string{"api_token": "token"}
+	assert.Nil(t, checkACMEConfig(conf))
+	conf.DNSProvider = "unknown"
+	assert.NotNil(t, checkACMEConfig(conf))
+}
+
+func TestACMEChallenge(t *testing.T) {
+	m := initACME(acmeConfig{}, "", nil)
+	m.tokens["token1"] = "token1.thumbprint"
+
+	w := httptest.NewRecorder()
+	m.handleChallenge(w, httptest.NewRequest("GET", acmeChallengePath+"token1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "token1.thumbprint", w.Body.String())
+
+	w = httptest.NewRecorder()
+	m.handleChallenge(w, httptest.NewRequest("GET", acmeChallengePath+"token2", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestACMECloudflare(t *testing.T) {
+	records := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			_, _ = w.Write([]byte(`{"success":false,"errors":[{"message":"Invalid API token"}]}`))
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/zones":
+			if r.URL.Query().Get("name") == "example.org" {
+				_, _ = w.Write([]byte(`{"success":true,"result":[{"id":"zone1"}]}`))
+			} else {
+				_, _ = w.Write([]byte(`{"success":true,"result":[]}`))
+			}
+		case r.Method == "POST" && r.URL.Path == "/zones/zone1/dns_records":
+			rec := map[string]interface{}{}
+			_ = json.NewDecoder(r.Body).Decode(&rec)
+			records["rec1"] = rec["name"].(string) + " " + rec["content"].(string)
+			_, _ = w.Write([]byte(`{"success":true,"result":{"id":"rec1"}}`))
+		case r.Method == "DELETE" && r.URL.Path == "/zones/zone1/dns_records/rec1":
+			delete(records, "rec1")
+			_, _ = w.Write([]byte(`{"success":true,"result":{"id":"rec1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p, err := newACMEDNSProvider("cloudflare", map[string]string{"api_token": "token"}, srv.Client())
+	assert.Nil(t, err)
+	p.(*cloudflareProvider).apiURL = srv.URL
+
+	fqdn := "_acme-challenge.dns.example.org."
+	assert.Nil(t, p.Present(fqdn, "value"))
+	assert.Equal(t, "_acme-challenge.dns.example.org value", records["rec1"])
+	assert.Nil(t, p.CleanUp(fqdn, "value"))
+	assert.Equal(t, 0, len(records))
+
+	p.(*cloudflareProvider).token = "invalid"
+	assert.NotNil(t, p.Present(fqdn, "value"))
+}
+
+func TestACMERFC2136(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	var updates []dns.RR
+	srv := &dns.Server{
+		Listener: l,
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			// the default function rejects Update requests
+			return dns.MsgAccept
+		},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+			if req.Opcode != dns.OpcodeUpdate || req.Question[0].Name != "example.org." {
+				resp.Rcode = dns.RcodeRefused
+			} else {
+				updates = append(updates, req.Ns...)
+			}
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	p, err := newACMEDNSProvider("rfc2136", map[string]string{
+		"nameserver": l.Addr().String(),
+		"zone":       "example.org",
+	}, nil)
+	assert.Nil(t, err)
+
+	fqdn := "_acme-challenge.dns.example.org."
+	assert.Nil(t, p.Present(fqdn, "value"))
+	assert.Nil(t, p.CleanUp(fqdn, "value"))
+	assert.Equal(t, 2, len(updates))
+	txt, ok := updates[0].(*dns.TXT)
+	assert.True(t, ok)
+	assert.Equal(t, fqdn, txt.Hdr.Name)
+	assert.Equal(t, []string{"value"}, txt.Txt)
+	// the record is removed
+	assert.Equal(t, uint16(dns.ClassNONE), updates[1].Header().Class)
+
+	p.(*rfc2136Provider).zone = "example.net."
+	assert.NotNil(t, p.Present(fqdn, "value"))
+}
@@ -0,0 +1,355 @@
+// Household activity reports: an estimation of the time spent by clients on different categories of services
+
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+const (
+	activityGap     = 5 * 60 // queries within this interval (in seconds) belong to the same session
+	activityMinTime = 60     // time (in seconds) credited for the first query of a session
+	activityDays    = 7      // the number of days we keep
+	activityDateFmt = "2006-01-02"
+)
+
+// Service name -> category
+var activityCategories = map[string]string{
+	"facebook":   "social",
+	"messenger":  "social",
+	"whatsapp":   "social",
+	"instagram":  "social",
+	"twitter":    "social",
+	"snapchat":   "social",
+	"reddit":     "social",
+	"vk":         "social",
+	"ok":         "social",
+	"tiktok":     "social",
+	"youtube":    "video",
+	"netflix":    "video",
+	"twitch":     "video",
+	"steam":      "gaming",
+	"epic_games": "gaming",
+	"origin":     "gaming",
+	"discord":    "gaming",
+}
+
+// activityCounter is the estimated time spent by a client on a category during a day
+type activityCounter struct {
+	Seconds uint32 `json:"seconds"`
+	last    int64  // time of the last query (in seconds)
+}
+
+// Count a query.
+// If a query follows the previous one within activityGap, the session continues
+// and the time between the queries is added.
+// Otherwise a new session is started and activityMinTime is added.
+func (c *activityCounter) add(t int64) {
+	if c.last != 0 && t <= c.last {
+		return
+	}
+	if c.last != 0 && t-c.last <= activityGap {
+		c.Seconds += uint32(t - c.last)
+	} else {
+		c.Seconds += activityMinTime
+	}
+	c.last = t
+}
+
+// date -> client -> category -> counter
+type activityData map[string]map[string]map[string]*activityCounter
+
+// Activity module
+type activityCtx struct {
+	lock     sync.Mutex
+	data     activityData
+	rules    map[string][]*rules.NetworkRule // category -> rules
+	filename string
+
+	// Get the name of a client by its IP address.  An IP address is used if it returns an empty string.
+	clientName func(ip string) string
+}
+
+// Create module context
+func initActivity(filename string) *activityCtx {
+	a := &activityCtx{
+		data:     activityData{},
+		filename: filename,
+		clientName: func(ip string) string {
+			c, ok := Context.clients.Find(ip)
+			if !ok {
+				return ""
+			}
+			return c.Name
+		},
+	}
+	a.initRules()
+	a.load()
+	return a
+}
+
+// Prepare the rules for each category from the blocked services rules
+func (a *activityCtx) initRules() {
+	a.rules = map[string][]*rules.NetworkRule{}
+	for svc, cat := range activityCategories {
+		a.rules[cat] = append(a.rules[cat], serviceRules[svc]...)
+	}
+}
+
+// Get the category of a host name
+func (a *activityCtx) category(host string) string {
+	req := rules.NewRequestForHostname(host)
+	for cat, list := range a.rules {
+		for _, rule := range list {
+			if rule.Match(req) {
+				return cat
+			}
+		}
+	}
+	return ""
+}
+
+// Count the query to a host name from a client
+func (a *activityCtx) record(ip string, host string, t time.Time) {
+	cat := a.category(host)
+	if len(cat) == 0 {
+		return
+	}
+
+	client := a.clientName(ip)
+	if len(client) == 0 {
+		client = ip
+	}
+	date := t.Format(activityDateFmt)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	clients, ok := a.data[date]
+	if !ok {
+		clients = map[string]map[string]*activityCounter{}
+		a.data[date] = clients
+		a.purge(t)
+	}
+	cats, ok := clients[client]
+	if !ok {
+		cats = map[string]*activityCounter{}
+		clients[client] = cats
+	}
+	c, ok := cats[cat]
+	if !ok {
+		c = &activityCounter{}
+		cats[cat] = c
+	}
+	c.add(t.Unix())
+}
+
+// Remove the days which are older than activityDays (and does not lock anything)
+func (a *activityCtx) purge(now time.Time) {
+	oldest := now.AddDate(0, 0, -(activityDays - 1)).Format(activityDateFmt)
+	for date := range a.data {
+		if date < oldest {
+			delete(a.data, date)
+		}
+	}
+}
+
+// Called by DNS module when the response is ready
+func (a *activityCtx) onDNSResponse(d *proxy.DNSContext, res *dnsfilter.Result) {
+	if len(d.Req.Question) == 0 ||
+		(res != nil && res.IsFiltered) || d.Res == nil || len(d.Res.Answer) == 0 {
+		// a blocked or unresolved host isn't used by the client
+		return
+	}
+
+	ip := dnsforward.GetIPString(d.Addr)
+	host := strings.ToLower(strings.TrimSuffix(d.Req.Question[0].Name, "."))
+	a.record(ip, host, time.Now())
+}
+
+type activityDayJSON struct {
+	Date    string            `json:"date"`
+	Minutes map[string]uint32 `json:"minutes"` // category -> minutes
+}
+
+type activityClientJSON struct {
+	Client string            `json:"client"`
+	Days   []activityDayJSON `json:"days"`
+	Total  map[string]uint32 `json:"total"` // category -> minutes for the whole period
+}
+
+type activityReportJSON struct {
+	Enabled bool                 `json:"enabled"`
+	Days    int                  `json:"days"`
+	Clients []activityClientJSON `json:"clients"`
+}
+
+// Get the report for the last N days (including today)
+func (a *activityCtx) report(days int, now time.Time) []activityClientJSON {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	byClient := map[string]*activityClientJSON{}
+	for i := days - 1; i >= 0; i-- {
+		date := now.AddDate(0, 0, -i).Format(activityDateFmt)
+		for client, cats := range a.data[date] {
+			cj, ok := byClient[client]
+			if !ok {
+				cj = &activityClientJSON{
+					Client: client,
+					Days:   []activityDayJSON{},
+					Total:  map[string]uint32{},
+				}
+				byClient[client] = cj
+			}
+
+			day := activityDayJSON{
+				Date:    date,
+				Minutes: map[string]uint32{},
+			}
+			for cat, c := range cats {
+				day.Minutes[cat] = c.Seconds / 60
+				cj.Total[cat] += c.Seconds
+			}
+			cj.Days = append(cj.Days, day)
+		}
+	}
+
+	list := []activityClientJSON{}
+	for _, cj := range byClient {
+		for cat, sec := range cj.Total {
+			cj.Total[cat] = sec / 60
+		}
+		list = append(list, *cj)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Client < list[j].Client
+	})
+	return list
+}
+
+// Load data from file
+func (a *activityCtx) load() {
+	if len(a.filename) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(a.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Activity: %s", err)
+		}
+		return
+	}
+
+	d := activityData{}
+	err = json.Unmarshal(data, &d)
+	if err != nil {
+		log.Error("Activity: %s: %s", a.filename, err)
+		return
+	}
+
+	a.lock.Lock()
+	a.data = d
+	a.purge(time.Now())
+	a.lock.Unlock()
+}
+
+// Save data to file
+func (a *activityCtx) save() {
+	if len(a.filename) == 0 {
+		return
+	}
+
+	a.lock.Lock()
+	data, err := json.Marshal(a.data)
+	a.lock.Unlock()
+	if err != nil {
+		log.Error("Activity: json.Marshal: %s", err)
+		return
+	}
+
+	err = file.SafeWrite(a.filename, data)
+	if err != nil {
+		log.Error("Activity: %s", err)
+		return
+	}
+	log.Debug("Activity: saved data to %s", a.filename)
+}
+
+// Close - save data and free resources
+func (a *activityCtx) Close() {
+	a.save()
+}
+
+func handleActivityReport(w http.ResponseWriter, r *http.Request) {
+	days := activityDays
+	s := r.URL.Query().Get("days")
+	if len(s) != 0 {
+		var err error
+		days, err = strconv.Atoi(s)
+		if err != nil || days < 1 || days > activityDays {
+			httpError(w, http.StatusBadRequest, "days must be in range [1..%d]", activityDays)
+			return
+		}
+	}
+
+	if Context.activity == nil {
+		httpError(w, http.StatusInternalServerError, "activity module isn't initialized")
+		return
+	}
+
+	resp := activityReportJSON{
+		Days:    days,
+		Clients: Context.activity.report(days, time.Now()),
+	}
+	config.RLock()
+	resp.Enabled = config.DNS.ActivityEnabled
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+type activityConfigJSON struct {
+	Enabled bool `json:"enabled"`
+}
+
+func handleActivityConfig(w http.ResponseWriter, r *http.Request) {
+	req := activityConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	config.Lock()
+	config.DNS.ActivityEnabled = req.Enabled
+	config.Unlock()
+	onConfigModified()
+}
+
+// RegisterActivityHandlers - register HTTP handlers
+func RegisterActivityHandlers() {
+	httpRegister(http.MethodGet, "/control/activity/report", handleActivityReport)
+	httpRegister(http.MethodPost, "/control/activity/config", handleActivityConfig)
+}
@@ -0,0 +1,65 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivity(t *testing.T) {
+	initServices()
+	a := &activityCtx{
+		data: activityData{},
+		clientName: func(ip string) string {
+			if ip == "1.1.1.1" {
+				return "kid"
+			}
+			return ""
+		},
+	}
+	a.initRules()
+
+	now := time.Date(2020, 5, 20, 12, 0, 0, 0, time.Local)
+
+	// a session: 60 sec for the first query + 4 min
+	a.record("1.1.1.1", "www.youtube.com", now)
+	a.record("1.1.1.1", "i.ytimg.com", now.Add(2*time.Minute))
+	a.record("1.1.1.1", "www.youtube.com", now.Add(4*time.Minute))
+	// a new session after a pause
+	a.record("1.1.1.1", "www.youtube.com", now.Add(30*time.Minute))
+	// unknown category
+	a.record("1.1.1.1", "example.org", now)
+	// yesterday
+	a.record("1.1.1.1", "api.steam.com", now.AddDate(0, 0, -1))
+	a.record("1.1.1.1", "steam.com", now.AddDate(0, 0, -1))
+	// another client
+	a.record("2.2.2.2", "www.instagram.com", now)
+
+	list := a.report(7, now)
+	assert.Equal(t, 2, len(list))
+
+	assert.Equal(t, "2.2.2.2", list[0].Client)
+	assert.Equal(t, uint32(1), list[0].Total["social"])
+
+	assert.Equal(t, "kid", list[1].Client)
+	assert.Equal(t, 2, len(list[1].Days))
+	assert.Equal(t, "2020-05-19", list[1].Days[0].Date)
+	assert.Equal(t, uint32(1), list[1].Days[0].Minutes["gaming"])
+	assert.Equal(t, "2020-05-20", list[1].Days[1].Date)
+	assert.Equal(t, uint32(6), list[1].Days[1].Minutes["video"])
+	assert.Equal(t, uint32(1), list[1].Total["gaming"])
+	assert.Equal(t, uint32(6), list[1].Total["video"])
+
+	// only today
+	list = a.report(1, now)
+	assert.Equal(t, 1, len(list[1].Days))
+	assert.Equal(t, uint32(0), list[1].Total["gaming"])
+
+	// old data is removed when a new day starts
+	a.record("1.1.1.1", "www.youtube.com", now.AddDate(0, 0, 6))
+	_, ok := a.data["2020-05-19"]
+	assert.False(t, ok)
+	_, ok = a.data["2020-05-20"]
+	assert.True(t, ok)
+}
@@ -8,13 +8,13 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/etcd-io/bbolt"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const cookieTTL = 365 * 24 // in hours
@@ -60,20 +60,43 @@ type Auth struct {
 	sessions   map[string]*session // session name -> session data
 	lock       sync.Mutex
 	users      []User
+	tokens     []APIToken
 	sessionTTL uint32 // in seconds
+
+	totpPending map[string]string // user name -> TOTP secret which isn't yet confirmed
+	totpUsed    map[string]int64  // user name -> the time step of the last used TOTP code
+
+	limiter *authLimiter // brute-force protection
+	audit   *authAudit   // login attempts
+
+	// Called when the users' password hashes are upgraded and must be saved.  nil: not called
+	onUsersModified func()
 }
 
 // User object
 type User struct {
 	Name         string `yaml:"name"`
-	PasswordHash string `yaml:"password"` // bcrypt hash
+	PasswordHash string `yaml:"password"` // argon2id or bcrypt hash
+	Role         string `yaml:"role"`     // "": admin
+
+	// The clients and the groups of clients which are managed by a user with "parent" role
+	Clients []string `yaml:"clients"`
+	Groups  []string `yaml:"groups"`
+
+	// Two-factor authentication
+	TOTPSecret    string   `yaml:"totp_secret"`    // base32.  "": 2FA is disabled
+	RecoveryCodes []string `yaml:"recovery_codes"` // SHA-256 of the unused recovery codes, hex
 }
 
 // InitAuth - create a global object
-func InitAuth(dbFilename string, users []User, sessionTTL uint32) *Auth {
+func InitAuth(dbFilename string, users []User, tokens []APIToken, sessionTTL uint32) *Auth {
 	a := Auth{}
 	a.sessionTTL = sessionTTL
 	a.sessions = make(map[string]*session)
+	a.totpPending = make(map[string]string)
+	a.totpUsed = make(map[string]int64)
+	a.limiter = newAuthLimiter(0, 0)
+	a.audit = newAuthAudit("")
 	rand.Seed(time.Now().UTC().Unix())
 	var err error
 	a.db, err = bbolt.Open(dbFilename, 0644, nil)
@@ -83,7 +106,8 @@ func InitAuth(dbFilename string, users []User, sessionTTL uint32) *Auth {
 	}
 	a.loadSessions()
 	a.users = users
-	log.Debug("Auth: initialized.  users:%d  sessions:%d", len(a.users), len(a.sessions))
+	a.tokens = tokens
+	log.Debug("Auth: initialized.  users:%d  tokens:%d  sessions:%d", len(a.users), len(a.tokens), len(a.sessions))
 	return &a
 }
 
@@ -268,6 +292,7 @@ func (a *Auth) RemoveSession(sess string) {
 type loginJSON struct {
 	Name     string `json:"name"`
 	Password string `json:"password"`
+	OTP      string `json:"otp"` // TOTP code or recovery code, if 2FA is enabled for the user
 }
 
 func getSession(u *User) []byte {
@@ -276,10 +301,17 @@ func getSession(u *User) []byte {
 	return hash[:]
 }
 
-func (a *Auth) httpCookie(req loginJSON) string {
+func (a *Auth) httpCookie(req loginJSON) (string, error) {
 	u := a.UserFind(req.Name, req.Password)
 	if len(u.Name) == 0 {
-		return ""
+		return "", fmt.Errorf("invalid user name or password")
+	}
+
+	if len(u.TOTPSecret) != 0 {
+		err := a.checkOTP(u.Name, req.OTP)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	sess := getSession(&u)
@@ -296,7 +328,7 @@ func (a *Auth) httpCookie(req loginJSON) string {
 	a.addSession(sess, &s)
 
 	return fmt.Sprintf("%s=%s; Path=/; HttpOnly; Expires=%s",
-		sessionCookieName, hex.EncodeToString(sess), expstr)
+		sessionCookieName, hex.EncodeToString(sess), expstr), nil
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -307,13 +339,46 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie := Context.auth.httpCookie(req)
-	if len(cookie) == 0 {
-		log.Info("Auth: invalid user name or password: name='%s'", req.Name)
+	a := Context.auth
+	ip := requestIP(r)
+	e := authAuditEntry{Time: time.Now(), IP: ip, User: req.Name, Method: authMethodLogin}
+	dur := a.limiter.blocked(ip, e.Time)
+	if dur != 0 {
+		e.Result = authResultBlocked
+		a.audit.add(e)
+		w.Header().Set("Retry-After", strconv.Itoa(int((dur+time.Second-1)/time.Second)))
+		http.Error(w, fmt.Sprintf("too many failed login attempts: try again in %s", dur.Round(time.Second)),
+			http.StatusTooManyRequests)
+		return
+	}
+
+	cookie, err := a.httpCookie(req)
+	if err == errOTPRequired {
+		e.Result = authResultOTPRequired
+		a.audit.add(e)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		e.Result = authResultInvalid
+		if err == errInvalidOTP {
+			e.Result = authResultInvalidOTP
+		}
+		a.audit.add(e)
+		dur = a.limiter.fail(ip, e.Time)
+		if dur != 0 {
+			log.Info("Auth: %s is blocked for %s: too many failed login attempts", ip, dur)
+		}
 		time.Sleep(1 * time.Second)
-		http.Error(w, "invalid user name or password", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	a.limiter.success(ip)
+	e.Result = authResultSuccess
+	a.audit.add(e)
+	if isRecoveryCode(req.OTP) {
+		// the used recovery code has been removed
+		onConfigModified()
+	}
 
 	w.Header().Set("Set-Cookie", cookie)
 
@@ -343,6 +408,20 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 func RegisterAuthHandlers() {
 	http.Handle("/control/login", postInstallHandler(ensureHandler("POST", handleLogin)))
 	httpRegister("GET", "/control/logout", handleLogout)
+	httpRegister("GET", "/control/tokens", handleTokensList)
+	httpRegister("POST", "/control/tokens/add", handleTokensAdd)
+	httpRegister("POST", "/control/tokens/delete", handleTokensDelete)
+	httpRegister("GET", "/control/users", handleUsersList)
+	httpRegister("POST", "/control/users/add", handleUsersAdd)
+	httpRegister("POST", "/control/users/update", handleUsersUpdate)
+	httpRegister("POST", "/control/users/delete", handleUsersDelete)
+	httpRegister("GET", "/control/2fa/status", handleTOTPStatus)
+	httpRegister("POST", "/control/2fa/setup", handleTOTPSetup)
+	httpRegister("POST", "/control/2fa/enable", handleTOTPEnable)
+	httpRegister("POST", "/control/2fa/disable", handleTOTPDisable)
+	httpRegister("POST", "/control/2fa/recovery_codes", handleTOTPRecoveryCodes)
+	httpRegister("POST", "/control/2fa/reset", handleTOTPReset)
+	httpRegister("GET", "/control/login_log", handleLoginLog)
 }
 
 func parseCookie(cookie string) string {
@@ -386,26 +465,50 @@ func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.Re
 		} else if Context.auth != nil && Context.auth.AuthRequired() {
 			// redirect to login page if not authenticated
 			ok := false
+			tokenAuth := false
+			authUser := User{}
 			cookie, err := r.Cookie(sessionCookieName)
 			if err == nil {
 				r := Context.auth.CheckSession(cookie.Value)
 				if r == 0 {
 					ok = true
+					authUser = Context.auth.sessionUser(cookie.Value)
 				} else if r < 0 {
 					log.Info("Auth: invalid cookie value: %s", cookie)
 				}
+			} else if token := parseBearerToken(r); len(token) != 0 {
+				// API token
+				tokenAuth = true
+				t, found := Context.auth.TokenFind(token)
+				if !found {
+					log.Info("Auth: invalid API token")
+				} else if !tokenAllowed(t.Scope, r) {
+					log.Info("Auth: API token '%s' (%s): access to %s %s is denied",
+						t.Name, t.Scope, r.Method, r.URL.Path)
+				} else {
+					ok = true
+				}
 			} else {
 				// there's no Cookie, check Basic authentication
 				user, pass, ok2 := r.BasicAuth()
 				if ok2 {
-					u := Context.auth.UserFind(user, pass)
-					if len(u.Name) != 0 {
+					u := Context.auth.basicAuthUser(r, user, pass)
+					if len(u.TOTPSecret) != 0 {
+						// the second factor can't be passed with Basic authentication
+						log.Info("Auth: user '%s' has 2FA enabled: Basic authentication is denied", u.Name)
+					} else if len(u.Name) != 0 {
 						ok = true
+						authUser = u
 					} else {
 						log.Info("Auth: invalid Basic Authorization value")
 					}
 				}
 			}
+			if ok && !tokenAuth && !roleAllowed(authUser, r) {
+				log.Info("Auth: user '%s' (%s): access to %s %s is denied",
+					authUser.Name, userRole(authUser), r.Method, r.URL.Path)
+				ok = false
+			}
 			if !ok {
 				if r.URL.Path == "/" || r.URL.Path == "/index.html" {
 					w.Header().Set("Location", "/login.html")
@@ -435,36 +538,115 @@ func optionalAuthHandler(handler http.Handler) http.Handler {
 }
 
 // UserAdd - add new user
-func (a *Auth) UserAdd(u *User, password string) {
+func (a *Auth) UserAdd(u *User, password string) error {
 	if len(password) == 0 {
-		return
+		return fmt.Errorf("invalid password")
+	}
+	err := a.checkUser(u)
+	if err != nil {
+		return err
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := hashPassword(password)
 	if err != nil {
-		log.Error("bcrypt.GenerateFromPassword: %s", err)
-		return
+		log.Error("hashPassword: %s", err)
+		return err
 	}
-	u.PasswordHash = string(hash)
+	u.PasswordHash = hash
 
 	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.userIndex(u.Name) >= 0 {
+		return fmt.Errorf("user '%s' already exists", u.Name)
+	}
 	a.users = append(a.users, *u)
-	a.lock.Unlock()
 
 	log.Debug("Auth: added user: %s", u.Name)
+	return nil
 }
 
 // UserFind - find a user
+// The bcrypt hash of the password is replaced with argon2id hash.
 func (a *Auth) UserFind(login string, password string) User {
+	a.lock.Lock()
+	i := a.userIndex(login)
+	if i < 0 {
+		a.lock.Unlock()
+		return User{}
+	}
+	u := a.users[i]
+	a.lock.Unlock()
+
+	// the hash computation is slow: don't hold the lock
+	ok, upgrade := checkPassword(u.PasswordHash, password)
+	if !ok {
+		return User{}
+	}
+	if upgrade && a.upgradePasswordHash(u.Name, u.PasswordHash, password) {
+		return a.userByName(u.Name)
+	}
+	return u
+}
+
+// Replace the user's password hash with a new one
+func (a *Auth) upgradePasswordHash(name, oldHash, password string) bool {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Error("Auth: hashPassword: %s", err)
+		return false
+	}
+
+	a.lock.Lock()
+	i := a.userIndex(name)
+	if i < 0 || a.users[i].PasswordHash != oldHash {
+		// the user has been changed meanwhile
+		a.lock.Unlock()
+		return false
+	}
+	a.users[i].PasswordHash = hash
+	a.lock.Unlock()
+
+	log.Info("Auth: upgraded the password hash of user '%s'", name)
+	if a.onUsersModified != nil {
+		a.onUsersModified()
+	}
+	return true
+}
+
+// Get the user by name
+func (a *Auth) userByName(name string) User {
 	a.lock.Lock()
 	defer a.lock.Unlock()
-	for _, u := range a.users {
-		if u.Name == login &&
-			bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil {
-			return u
+	i := a.userIndex(name)
+	if i < 0 {
+		return User{}
+	}
+	return a.users[i]
+}
+
+// Check the credentials from HTTP Basic authentication with brute-force protection
+// The successful attempts aren't written to the audit log: the credentials are sent with each request.
+func (a *Auth) basicAuthUser(r *http.Request, name, password string) User {
+	ip := requestIP(r)
+	e := authAuditEntry{Time: time.Now(), IP: ip, User: name, Method: authMethodBasic}
+	if a.limiter.blocked(ip, e.Time) != 0 {
+		e.Result = authResultBlocked
+		a.audit.add(e)
+		return User{}
+	}
+
+	u := a.UserFind(name, password)
+	if len(u.Name) == 0 {
+		e.Result = authResultInvalid
+		a.audit.add(e)
+		dur := a.limiter.fail(ip, e.Time)
+		if dur != 0 {
+			log.Info("Auth: %s is blocked for %s: too many failed login attempts", ip, dur)
 		}
+		return User{}
 	}
-	return User{}
+	a.limiter.success(ip)
+	return u
 }
 
 // GetCurrentUser - get the current user
@@ -480,19 +662,22 @@ func (a *Auth) GetCurrentUser(r *http.Request) User {
 		return User{}
 	}
 
+	return a.sessionUser(cookie.Value)
+}
+
+// Get the user of the session
+func (a *Auth) sessionUser(sess string) User {
 	a.lock.Lock()
-	s, ok := a.sessions[cookie.Value]
+	defer a.lock.Unlock()
+	s, ok := a.sessions[sess]
 	if !ok {
-		a.lock.Unlock()
 		return User{}
 	}
 	for _, u := range a.users {
 		if u.Name == s.userName {
-			a.lock.Unlock()
 			return u
 		}
 	}
-	a.lock.Unlock()
 	return User{}
 }
 
@@ -0,0 +1,151 @@
+// Audit log of login attempts
+
+package home
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	authAuditMaxEntries = 1000        // the number of entries kept in memory
+	authAuditMaxSize    = 1024 * 1024 // the file is rotated when it becomes larger
+)
+
+// The results of login attempts
+const (
+	authResultSuccess     = "success"
+	authResultInvalid     = "invalid_credentials"
+	authResultOTPRequired = "otp_required"
+	authResultInvalidOTP  = "invalid_otp"
+	authResultBlocked     = "blocked" // the IP address is blocked because of too many failed attempts
+)
+
+// Login methods
+const (
+	authMethodLogin = "login" // login form
+	authMethodBasic = "basic" // HTTP Basic authentication
+)
+
+type authAuditEntry struct {
+	Time   time.Time `json:"time"`
+	IP     string    `json:"ip"`
+	User   string    `json:"user"`
+	Method string    `json:"method"`
+	Result string    `json:"result"`
+}
+
+// authAudit stores the login attempts in memory and in the file (one JSON object per line)
+type authAudit struct {
+	lock     sync.Mutex
+	entries  []authAuditEntry // the oldest first
+	filename string           // "": the entries are kept only in memory
+}
+
+// Create the audit log and load the last entries from the file
+func newAuthAudit(filename string) *authAudit {
+	a := &authAudit{filename: filename}
+	if len(filename) == 0 {
+		return a
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Auth: audit log: %s", err)
+		}
+		return a
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		e := authAuditEntry{}
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			a.append(e)
+		}
+	}
+	return a
+}
+
+func (a *authAudit) append(e authAuditEntry) {
+	a.entries = append(a.entries, e)
+	if len(a.entries) > authAuditMaxEntries {
+		a.entries = a.entries[len(a.entries)-authAuditMaxEntries:]
+	}
+}
+
+// Add the login attempt
+func (a *authAudit) add(e authAuditEntry) {
+	if e.Result == authResultSuccess {
+		log.Info("Auth: user '%s' logged in from %s", e.User, e.IP)
+	} else {
+		log.Info("Auth: login failed: %s: user '%s' from %s", e.Result, e.User, e.IP)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.append(e)
+	if len(a.filename) == 0 {
+		return
+	}
+
+	st, err := os.Stat(a.filename)
+	if err == nil && st.Size() >= authAuditMaxSize {
+		err = os.Rename(a.filename, a.filename+".1")
+		if err != nil {
+			log.Error("Auth: audit log: %s", err)
+		}
+	}
+
+	data, _ := json.Marshal(e)
+	f, err := os.OpenFile(a.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("Auth: audit log: %s", err)
+		return
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		log.Error("Auth: audit log: %s", err)
+	}
+	_ = f.Close()
+}
+
+// Get the last entries, the newest first
+func (a *authAudit) get(limit int) []authAuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if limit <= 0 || limit > len(a.entries) {
+		limit = len(a.entries)
+	}
+	list := make([]authAuditEntry, 0, limit)
+	for i := len(a.entries) - 1; i >= 0 && len(list) < limit; i-- {
+		list = append(list, a.entries[i])
+	}
+	return list
+}
+
+type authAuditJSON struct {
+	Entries []authAuditEntry `json:"entries"`
+}
+
+// Get the audit log of login attempts
+// ?limit=N: the number of the last entries
+func handleLoginLog(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	resp := authAuditJSON{
+		Entries: Context.auth.audit.get(limit),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
@@ -0,0 +1,96 @@
+// Password hashing: argon2id for the new hashes, bcrypt hashes are still accepted and upgraded on login
+
+package home
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id parameters
+const (
+	argon2Memory  = 19 * 1024 // in KiB
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+const argon2Prefix = "$argon2id$"
+
+var argon2Encoding = base64.RawStdEncoding
+
+// Hash the password with argon2id
+// The hash is stored in PHC string format: "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>"
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("rand.Read: %s", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		argon2Encoding.EncodeToString(salt), argon2Encoding.EncodeToString(key)), nil
+}
+
+// argon2id hash parameters
+type argon2Hash struct {
+	version int
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(s string) (argon2Hash, error) {
+	h := argon2Hash{}
+	parts := strings.Split(strings.TrimPrefix(s, argon2Prefix), "$")
+	if !strings.HasPrefix(s, argon2Prefix) || len(parts) != 4 {
+		return h, fmt.Errorf("invalid argon2id hash")
+	}
+	_, err := fmt.Sscanf(parts[0], "v=%d", &h.version)
+	if err == nil {
+		_, err = fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	}
+	if err == nil {
+		h.salt, err = argon2Encoding.DecodeString(parts[2])
+	}
+	if err == nil {
+		h.key, err = argon2Encoding.DecodeString(parts[3])
+	}
+	if err != nil {
+		return h, fmt.Errorf("invalid argon2id hash: %s", err)
+	}
+	if h.version != argon2.Version || h.time == 0 || h.threads == 0 || len(h.key) == 0 {
+		return h, fmt.Errorf("invalid argon2id hash parameters")
+	}
+	return h, nil
+}
+
+// Check the password against argon2id or bcrypt hash
+// upgrade: the password is correct, but the hash should be replaced with a new one
+// (it's bcrypt hash or argon2id hash with other parameters)
+func checkPassword(hash, password string) (ok bool, upgrade bool) {
+	if !strings.HasPrefix(hash, argon2Prefix) {
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+		return ok, ok
+	}
+
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false, false
+	}
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	ok = subtle.ConstantTimeCompare(key, h.key) == 1
+	upgrade = ok && (h.memory != argon2Memory || h.time != argon2Time || h.threads != argon2Threads ||
+		len(h.key) != argon2KeyLen)
+	return ok, upgrade
+}
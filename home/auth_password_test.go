@@ -0,0 +1,76 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("password")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"))
+
+	ok, upgrade := checkPassword(hash, "password")
+	assert.True(t, ok)
+	assert.False(t, upgrade)
+	ok, _ = checkPassword(hash, "password2")
+	assert.False(t, ok)
+
+	// a random salt is used for each hash
+	hash2, _ := hashPassword("password")
+	assert.NotEqual(t, hash, hash2)
+
+	// bcrypt
+	ok, upgrade = checkPassword("$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2", "password")
+	assert.True(t, ok)
+	assert.True(t, upgrade)
+	ok, upgrade = checkPassword("$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2", "password2")
+	assert.False(t, ok)
+	assert.False(t, upgrade)
+
+	// argon2id hash with other parameters
+	salt := []byte("somesalt")
+	key := argon2.IDKey([]byte("password"), salt, 1, 16, 1, 16)
+	hash = "$argon2id$v=19$m=16,t=1,p=1$" + argon2Encoding.EncodeToString(salt) + "$" + argon2Encoding.EncodeToString(key)
+	ok, upgrade = checkPassword(hash, "password")
+	assert.True(t, ok)
+	assert.True(t, upgrade)
+
+	ok, _ = checkPassword("$argon2id$v=19$m=16,t=2,p=1$c29tZXNhbHQ", "password")
+	assert.False(t, ok)
+	ok, _ = checkPassword("", "password")
+	assert.False(t, ok)
+}
+
+func TestAuthPasswordUpgrade(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "sessions.db")
+
+	users := []User{
+		{Name: "name", PasswordHash: "$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2"},
+	}
+	a := InitAuth(fn, users, nil, 60)
+	defer a.Close()
+	modified := 0
+	a.onUsersModified = func() { modified++ }
+
+	assert.Equal(t, "", a.UserFind("name", "password2").Name)
+	assert.Equal(t, 0, modified)
+
+	// bcrypt hash is replaced with argon2id hash after successful login
+	u := a.UserFind("name", "password")
+	assert.Equal(t, "name", u.Name)
+	assert.True(t, strings.HasPrefix(u.PasswordHash, argon2Prefix))
+	assert.Equal(t, u.PasswordHash, a.GetUsers()[0].PasswordHash)
+	assert.Equal(t, 1, modified)
+
+	u = a.UserFind("name", "password")
+	assert.Equal(t, "name", u.Name)
+	assert.Equal(t, 1, modified)
+}
@@ -27,7 +27,7 @@ func TestAuth(t *testing.T) {
 	users := []User{
 		User{Name: "name", PasswordHash: "$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2"},
 	}
-	a := InitAuth(fn, nil, 60)
+	a := InitAuth(fn, nil, nil, 60)
 	s := session{}
 
 	user := User{Name: "name"}
@@ -54,7 +54,7 @@ func TestAuth(t *testing.T) {
 	a.Close()
 
 	// load saved session
-	a = InitAuth(fn, users, 60)
+	a = InitAuth(fn, users, nil, 60)
 
 	// the session is still alive
 	assert.True(t, a.CheckSession(sessStr) == 0)
@@ -69,7 +69,7 @@ func TestAuth(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	// load and remove expired sessions
-	a = InitAuth(fn, users, 60)
+	a = InitAuth(fn, users, nil, 60)
 	assert.True(t, a.CheckSession(sessStr) == -1)
 
 	a.Close()
@@ -100,7 +100,7 @@ func TestAuthHTTP(t *testing.T) {
 	users := []User{
 		User{Name: "name", PasswordHash: "$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2"},
 	}
-	Context.auth = InitAuth(fn, users, 60)
+	Context.auth = InitAuth(fn, users, nil, 60)
 
 	handlerCalled := false
 	handler := func(w http.ResponseWriter, r *http.Request) {
@@ -129,7 +129,8 @@ func TestAuthHTTP(t *testing.T) {
 	assert.True(t, handlerCalled)
 
 	// perform login
-	cookie := Context.auth.httpCookie(loginJSON{Name: "name", Password: "password"})
+	cookie, err := Context.auth.httpCookie(loginJSON{Name: "name", Password: "password"})
+	assert.Nil(t, err)
 	assert.True(t, cookie != "")
 
 	// get /
@@ -175,3 +176,135 @@ func TestAuthHTTP(t *testing.T) {
 
 	Context.auth.Close()
 }
+
+func TestAuthTokens(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "sessions.db")
+
+	users := []User{
+		User{Name: "name", PasswordHash: "$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2"},
+	}
+	Context.auth = InitAuth(fn, users, nil, 60)
+	defer Context.auth.Close()
+
+	_, _, err := Context.auth.TokenAdd("ha", "unknown")
+	assert.NotNil(t, err)
+	tok, token, err := Context.auth.TokenAdd("ha", tokenScopeStats)
+	assert.Nil(t, err)
+	assert.True(t, tok.Hash != token && len(tok.Hash) != 0)
+	_, _, err = Context.auth.TokenAdd("ha", tokenScopeAdmin)
+	assert.NotNil(t, err)
+	_, filterToken, err := Context.auth.TokenAdd("script", tokenScopeFiltering)
+	assert.Nil(t, err)
+
+	handlerCalled := false
+	handler := optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		handlerCalled = true
+	})
+	check := func(method, path, token string) bool {
+		w := testResponseWriter{hdr: make(http.Header)}
+		r := http.Request{Method: method, URL: &url.URL{Path: path}, Header: make(http.Header)}
+		r.Header.Set("Authorization", "Bearer "+token)
+		handlerCalled = false
+		handler(&w, &r)
+		return handlerCalled
+	}
+
+	assert.True(t, check("GET", "/control/stats", token))
+	assert.True(t, check("GET", "/control/querylog/export", token))
+	assert.False(t, check("POST", "/control/stats_reset", token))
+	assert.False(t, check("POST", "/control/filtering/set_rules", token))
+	assert.False(t, check("GET", "/control/tls/status", token))
+	assert.False(t, check("GET", "/control/stats", token+"0"))
+
+	assert.True(t, check("POST", "/control/filtering/set_rules", filterToken))
+	assert.True(t, check("GET", "/control/stats", filterToken))
+	assert.False(t, check("POST", "/control/dns_config", filterToken))
+	assert.False(t, check("GET", "/control/tokens", filterToken))
+
+	// only the hashes are stored
+	tokens := Context.auth.GetTokens()
+	assert.Equal(t, 2, len(tokens))
+	Context.auth.Close()
+	Context.auth = InitAuth(fn, users, tokens, 60)
+	_, found := Context.auth.TokenFind(token)
+	assert.True(t, found)
+
+	assert.True(t, Context.auth.TokenDel("ha"))
+	assert.False(t, Context.auth.TokenDel("ha"))
+	assert.False(t, check("GET", "/control/stats", token))
+
+	// user management isn't available even with "admin" scope
+	_, adminToken, err := Context.auth.TokenAdd("admin", tokenScopeAdmin)
+	assert.Nil(t, err)
+	assert.True(t, check("POST", "/control/dns_config", adminToken))
+	assert.False(t, check("POST", "/control/users/add", adminToken))
+	assert.False(t, check("GET", "/control/users", adminToken))
+	assert.False(t, check("GET", "/control/login_log", adminToken))
+	assert.False(t, check("POST", "/control/tokens/add", adminToken))
+	assert.False(t, check("POST", "/control/2fa/setup", adminToken))
+	assert.False(t, check("POST", "/control/users/add", filterToken))
+}
+
+func TestAuthRoles(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "sessions.db")
+
+	a := InitAuth(fn, nil, nil, 60)
+	defer a.Close()
+
+	assert.Nil(t, a.UserAdd(&User{Name: "admin"}, "password"))
+	assert.NotNil(t, a.UserAdd(&User{Name: "admin"}, "password"))
+	assert.NotNil(t, a.UserAdd(&User{Name: "user", Role: "unknown"}, "password"))
+	assert.NotNil(t, a.UserAdd(&User{Name: "user", Role: roleViewer, Groups: []string{"kids"}}, "password"))
+	assert.Nil(t, a.UserAdd(&User{Name: "viewer", Role: roleViewer}, "password"))
+	assert.Nil(t, a.UserAdd(&User{Name: "mom", Role: roleParent, Groups: []string{"kids"}}, "password"))
+	assert.Nil(t, a.UserAdd(&User{Name: "operator", Role: roleOperator}, "password"))
+
+	req := func(method, path string) *http.Request {
+		return &http.Request{Method: method, URL: &url.URL{Path: path}}
+	}
+	users := map[string]User{}
+	for _, u := range a.GetUsers() {
+		users[u.Name] = u
+	}
+
+	assert.True(t, roleAllowed(users["admin"], req("POST", "/control/tls/configure")))
+	assert.True(t, roleAllowed(users["viewer"], req("GET", "/")))
+	assert.True(t, roleAllowed(users["viewer"], req("GET", "/control/stats")))
+	assert.True(t, roleAllowed(users["viewer"], req("GET", "/control/profile")))
+	assert.False(t, roleAllowed(users["viewer"], req("POST", "/control/filtering/set_rules")))
+	assert.True(t, roleAllowed(users["operator"], req("POST", "/control/filtering/set_rules")))
+	assert.True(t, roleAllowed(users["operator"], req("POST", "/control/clients/add")))
+	assert.False(t, roleAllowed(users["operator"], req("POST", "/control/dns_config")))
+	assert.False(t, roleAllowed(users["operator"], req("GET", "/control/users")))
+	assert.True(t, roleAllowed(users["mom"], req("POST", "/control/clients/groups/update")))
+	assert.False(t, roleAllowed(users["mom"], req("POST", "/control/clients/add")))
+	assert.False(t, roleAllowed(users["mom"], req("POST", "/control/tls/configure")))
+	assert.False(t, roleAllowed(User{}, req("GET", "/control/stats")))
+
+	mom := users["mom"]
+	assert.True(t, mom.managesClient("laptop", "kids"))
+	assert.False(t, mom.managesClient("laptop", ""))
+
+	// the last administrator can't be removed or demoted
+	assert.NotNil(t, a.UserDel("admin"))
+	assert.NotNil(t, a.UserUpdate("admin", User{Name: "admin", Role: roleViewer}, ""))
+	assert.NotNil(t, a.UserUpdate("viewer", User{Name: "admin"}, ""))
+	assert.Nil(t, a.UserUpdate("viewer", User{Name: "viewer2", Role: roleAdmin}, ""))
+	assert.Nil(t, a.UserDel("admin"))
+	assert.NotNil(t, a.UserDel("admin"))
+
+	// the password isn't changed
+	u := a.UserFind("viewer2", "password")
+	assert.Equal(t, roleAdmin, userRole(u))
+
+	// the sessions of the removed user are removed
+	sess := getSession(&u)
+	a.addSession(sess, &session{userName: "viewer2", expire: uint32(time.Now().Unix()) + 60})
+	assert.Equal(t, "viewer2", a.sessionUser(hex.EncodeToString(sess)).Name)
+	assert.Nil(t, a.UserUpdate("viewer2", User{Name: "viewer2"}, "new password"))
+	assert.Equal(t, -1, a.CheckSession(hex.EncodeToString(sess)))
+}
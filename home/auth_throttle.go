@@ -0,0 +1,120 @@
+// Brute-force protection: blocking the IP addresses with too many failed login attempts
+
+package home
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	authDefaultAttempts = 5                // failed login attempts before the IP address is blocked
+	authDefaultBlockMin = 15               // the first block duration (in minutes)
+	authMaxBlock        = 24 * time.Hour   // the block duration isn't doubled beyond this value
+	authFailuresTTL     = 24 * time.Hour   // the failures are forgotten after this time without new failures
+	authCleanupInterval = 10 * time.Minute // how often the expired entries are removed
+)
+
+// The failed login attempts from an IP address
+type authFailures struct {
+	num    uint32    // failed attempts since the last block
+	blocks uint      // the number of blocks without successful login between them
+	until  time.Time // the IP address is blocked until this time
+	last   time.Time // the last failed attempt
+}
+
+// authLimiter blocks the IP addresses with too many failed login attempts.
+// The block duration is doubled after each block.
+type authLimiter struct {
+	lock        sync.Mutex
+	attempts    uint32        // failed attempts before blocking
+	blockDur    time.Duration // the first block duration
+	clients     map[string]*authFailures
+	lastCleanup time.Time
+}
+
+func newAuthLimiter(attempts, blockMin uint32) *authLimiter {
+	if attempts == 0 {
+		attempts = authDefaultAttempts
+	}
+	if blockMin == 0 {
+		blockMin = authDefaultBlockMin
+	}
+	return &authLimiter{
+		attempts: attempts,
+		blockDur: time.Duration(blockMin) * time.Minute,
+		clients:  map[string]*authFailures{},
+	}
+}
+
+// Get the time the IP address is still blocked for.  0: not blocked
+func (l *authLimiter) blocked(ip string, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, ok := l.clients[ip]
+	if !ok || !now.Before(f.until) {
+		return 0
+	}
+	return f.until.Sub(now)
+}
+
+// Count a failed attempt.  Return the block duration if the IP address is blocked now.
+func (l *authLimiter) fail(ip string, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastCleanup) >= authCleanupInterval {
+		l.cleanup(now)
+		l.lastCleanup = now
+	}
+
+	f, ok := l.clients[ip]
+	if !ok {
+		f = &authFailures{}
+		l.clients[ip] = f
+	}
+	f.last = now
+	f.num++
+	if f.num < l.attempts {
+		return 0
+	}
+
+	dur := l.blockDur
+	for i := uint(0); i < f.blocks && dur < authMaxBlock; i++ {
+		dur *= 2
+	}
+	if dur > authMaxBlock {
+		dur = authMaxBlock
+	}
+	f.num = 0
+	f.blocks++
+	f.until = now.Add(dur)
+	return dur
+}
+
+// Forget the failures after successful login
+func (l *authLimiter) success(ip string) {
+	l.lock.Lock()
+	delete(l.clients, ip)
+	l.lock.Unlock()
+}
+
+// Remove the entries which aren't blocked and have no recent failures
+func (l *authLimiter) cleanup(now time.Time) {
+	for ip, f := range l.clients {
+		if now.After(f.until) && now.Sub(f.last) >= authFailuresTTL {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// Get the IP address of the client
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,78 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	l := newAuthLimiter(3, 1)
+	now := time.Unix(1000000, 0)
+	ip := "1.2.3.4"
+
+	assert.Equal(t, time.Duration(0), l.fail(ip, now))
+	assert.Equal(t, time.Duration(0), l.fail(ip, now))
+	assert.Equal(t, time.Duration(0), l.blocked(ip, now))
+	assert.Equal(t, time.Minute, l.fail(ip, now))
+	assert.Equal(t, time.Minute, l.blocked(ip, now))
+	assert.Equal(t, 30*time.Second, l.blocked(ip, now.Add(30*time.Second)))
+	assert.Equal(t, time.Duration(0), l.blocked("1.2.3.5", now))
+
+	// the block duration is doubled
+	now = now.Add(time.Minute)
+	assert.Equal(t, time.Duration(0), l.blocked(ip, now))
+	l.fail(ip, now)
+	l.fail(ip, now)
+	assert.Equal(t, 2*time.Minute, l.fail(ip, now))
+	now = now.Add(2 * time.Minute)
+	l.fail(ip, now)
+	l.fail(ip, now)
+	assert.Equal(t, 4*time.Minute, l.fail(ip, now))
+
+	// successful login resets the counters
+	l.success(ip)
+	assert.Equal(t, time.Duration(0), l.blocked(ip, now))
+	l.fail(ip, now)
+	l.fail(ip, now)
+	assert.Equal(t, time.Minute, l.fail(ip, now))
+
+	// the block duration is limited
+	l = newAuthLimiter(1, 60)
+	for i := 0; i < 10; i++ {
+		l.fail(ip, now)
+	}
+	assert.Equal(t, authMaxBlock, l.fail(ip, now))
+
+	// the failures are forgotten
+	l.fail("1.2.3.5", now)
+	now = now.Add(authMaxBlock + authFailuresTTL)
+	l.fail("1.2.3.6", now)
+	_, ok := l.clients["1.2.3.5"]
+	assert.False(t, ok)
+}
+
+func TestAuthAudit(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "login_audit.json")
+
+	a := newAuthAudit(fn)
+	a.add(authAuditEntry{IP: "1.2.3.4", User: "admin", Method: authMethodLogin, Result: authResultInvalid})
+	a.add(authAuditEntry{IP: "1.2.3.4", User: "admin", Method: authMethodLogin, Result: authResultSuccess})
+
+	list := a.get(0)
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, authResultSuccess, list[0].Result)
+	assert.Equal(t, 1, len(a.get(1)))
+
+	// the entries are loaded from the file
+	a = newAuthAudit(fn)
+	list = a.get(0)
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, authResultInvalid, list[1].Result)
+	assert.Equal(t, "admin", list[1].User)
+}
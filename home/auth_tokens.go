@@ -0,0 +1,282 @@
+// API tokens: long-lived keys with limited access for automation
+
+package home
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Token scopes
+const (
+	tokenScopeStats     = "stats"     // read-only access to status, statistics and query log
+	tokenScopeFiltering = "filtering" // stats + filtering management
+	tokenScopeAdmin     = "admin"     // access to all API methods except user, session, token and 2FA management
+)
+
+const tokenPrefix = "agh_"
+
+// The paths which are available with "stats" scope (GET requests only)
+var tokenStatsPaths = []string{
+	"/control/status",
+	"/control/stats",
+	"/control/stats_info",
+	"/control/querylog",
+	"/control/querylog_info",
+	"/control/querylog/",
+	"/control/clients",
+	"/control/clients/find",
+	"/control/filtering/status",
+	"/control/filtering/lookup_stats",
+	"/control/safebrowsing/status",
+	"/control/parental/status",
+	"/control/safesearch/status",
+}
+
+// The path prefixes which are available with "filtering" scope
+var tokenFilteringPrefixes = []string{
+	"/control/filtering/",
+	"/control/rewrite/",
+	"/control/blocked_services/",
+	"/control/safebrowsing/",
+	"/control/parental/",
+	"/control/safesearch/",
+	"/control/sync/export",
+}
+
+// The path prefixes which are denied for all scopes:
+// a token can't be used to manage the users, the sessions, other tokens and 2FA settings
+var tokenDeniedPrefixes = []string{
+	"/control/tokens",
+	"/control/users",
+	"/control/login",
+	"/control/logout",
+	"/control/2fa/",
+}
+
+// APIToken - API token object
+type APIToken struct {
+	Name    string `yaml:"name"`
+	Scope   string `yaml:"scope"`
+	Hash    string `yaml:"hash"` // SHA-256 of the token, hex
+	Created int64  `yaml:"created"`
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func tokenScopeValid(scope string) bool {
+	return scope == tokenScopeStats || scope == tokenScopeFiltering || scope == tokenScopeAdmin
+}
+
+// Get the token from "Authorization: Bearer <token>" header
+func parseBearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// Return TRUE if the request is allowed for the token's scope
+func tokenAllowed(scope string, r *http.Request) bool {
+	path := r.URL.Path
+	for _, p := range tokenDeniedPrefixes {
+		if strings.HasPrefix(path, p) {
+			return false
+		}
+	}
+
+	switch scope {
+	case tokenScopeAdmin:
+		return true
+
+	case tokenScopeFiltering:
+		for _, p := range tokenFilteringPrefixes {
+			if strings.HasPrefix(path, p) {
+				return true
+			}
+		}
+		return tokenAllowed(tokenScopeStats, r)
+
+	case tokenScopeStats:
+		if r.Method != "GET" {
+			return false
+		}
+		for _, p := range tokenStatsPaths {
+			if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TokenFind - find a token
+func (a *Auth) TokenFind(token string) (APIToken, bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return APIToken{}, false
+	}
+	hash := hashToken(token)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, t := range a.tokens {
+		if t.Hash == hash {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// TokenAdd - create a new token
+// Return the token string: it's shown to the user only once, we store just its hash.
+func (a *Auth) TokenAdd(name string, scope string) (APIToken, string, error) {
+	if len(name) == 0 {
+		return APIToken{}, "", fmt.Errorf("invalid name")
+	}
+	if !tokenScopeValid(scope) {
+		return APIToken{}, "", fmt.Errorf("invalid scope: %s", scope)
+	}
+
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return APIToken{}, "", fmt.Errorf("rand.Read: %s", err)
+	}
+	token := tokenPrefix + hex.EncodeToString(data)
+
+	t := APIToken{
+		Name:    name,
+		Scope:   scope,
+		Hash:    hashToken(token),
+		Created: time.Now().Unix(),
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, it := range a.tokens {
+		if it.Name == name {
+			return APIToken{}, "", fmt.Errorf("token '%s' already exists", name)
+		}
+	}
+	a.tokens = append(a.tokens, t)
+
+	log.Debug("Auth: added token '%s' (%s)", name, scope)
+	return t, token, nil
+}
+
+// TokenDel - remove a token
+func (a *Auth) TokenDel(name string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i, t := range a.tokens {
+		if t.Name == name {
+			a.tokens = append(a.tokens[:i], a.tokens[i+1:]...)
+			log.Debug("Auth: removed token '%s'", name)
+			return true
+		}
+	}
+	return false
+}
+
+// GetTokens - get tokens
+func (a *Auth) GetTokens() []APIToken {
+	a.lock.Lock()
+	tokens := make([]APIToken, len(a.tokens))
+	copy(tokens, a.tokens)
+	a.lock.Unlock()
+	return tokens
+}
+
+type tokenJSON struct {
+	Name    string `json:"name"`
+	Scope   string `json:"scope"`
+	Created string `json:"created,omitempty"`
+	Token   string `json:"token,omitempty"` // only in the response to "add" request
+}
+
+func tokenToJSON(t APIToken) tokenJSON {
+	return tokenJSON{
+		Name:    t.Name,
+		Scope:   t.Scope,
+		Created: time.Unix(t.Created, 0).Format(time.RFC3339),
+	}
+}
+
+func handleTokensList(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Tokens []tokenJSON `json:"tokens"`
+	}{
+		Tokens: []tokenJSON{},
+	}
+	if Context.auth != nil {
+		for _, t := range Context.auth.GetTokens() {
+			resp.Tokens = append(resp.Tokens, tokenToJSON(t))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleTokensAdd(w http.ResponseWriter, r *http.Request) {
+	req := tokenJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if Context.auth == nil {
+		httpError(w, http.StatusBadRequest, "authentication is disabled")
+		return
+	}
+
+	t, token, err := Context.auth.TokenAdd(req.Name, req.Scope)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	onConfigModified()
+
+	resp := tokenToJSON(t)
+	resp.Token = token
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleTokensDelete(w http.ResponseWriter, r *http.Request) {
+	req := tokenJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if Context.auth == nil || !Context.auth.TokenDel(req.Name) {
+		httpError(w, http.StatusBadRequest, "token not found")
+		return
+	}
+	onConfigModified()
+	returnOK(w)
+}
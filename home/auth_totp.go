@@ -0,0 +1,405 @@
+// Two-factor authentication: time-based one-time passwords (RFC 6238) and recovery codes
+
+package home
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	totpPeriod        = 30 // in seconds
+	totpDigits        = 6
+	totpSkew          = 1 // the number of periods before and after the current one which are also accepted
+	totpIssuer        = "AdGuard Home"
+	recoveryCodesNum  = 10
+	recoveryCodeChars = "abcdefghijkmnpqrstuvwxyz23456789"
+)
+
+var (
+	errOTPRequired = errors.New("two-factor authentication code is required")
+	errInvalidOTP  = errors.New("invalid two-factor authentication code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Get the one-time password for the counter value (RFC 4226)
+func hotpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	h := hmac.New(sha1.New, secret)
+	_, _ = h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	val := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, val%1000000)
+}
+
+// Check the time-based one-time password
+// Return the time step of the password, or -1 if the password is invalid.
+func totpValidate(secretB32 string, code string, now time.Time) int64 {
+	secret, err := totpEncoding.DecodeString(strings.ToUpper(secretB32))
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+
+	step := now.Unix() / totpPeriod
+	for i := step - totpSkew; i <= step+totpSkew; i++ {
+		c := hotpCode(secret, uint64(i))
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Generate a new TOTP secret (base32)
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", fmt.Errorf("rand.Read: %s", err)
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// Get the URI for authenticator apps (usually shown as QR code)
+func totpURI(name string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + name)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// Recovery codes have "xxxxx-xxxxx" format, so they can't be confused with TOTP codes
+func isRecoveryCode(code string) bool {
+	return len(code) == 11 && code[5] == '-'
+}
+
+// Generate new recovery codes
+// Return the codes to be shown to the user and their hashes to be stored.
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	data := make([]byte, 10)
+	for i := 0; i != recoveryCodesNum; i++ {
+		_, err := rand.Read(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rand.Read: %s", err)
+		}
+		var sb strings.Builder
+		for j, b := range data {
+			if j == 5 {
+				sb.WriteByte('-')
+			}
+			sb.WriteByte(recoveryCodeChars[int(b)%len(recoveryCodeChars)])
+		}
+		codes = append(codes, sb.String())
+		hashes = append(hashes, hashToken(sb.String()))
+	}
+	return codes, hashes, nil
+}
+
+// Check the second factor of the user: a TOTP code or a recovery code
+// A TOTP code can't be used twice.  A recovery code is removed after it's used.
+func (a *Auth) checkOTP(name string, code string) error {
+	if len(code) == 0 {
+		return errOTPRequired
+	}
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndex(name)
+	if i < 0 || len(a.users[i].TOTPSecret) == 0 {
+		return errInvalidOTP
+	}
+	u := &a.users[i]
+
+	if isRecoveryCode(code) {
+		hash := hashToken(code)
+		for j, h := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:j:j], u.RecoveryCodes[j+1:]...)
+				log.Info("Auth: user '%s' has used a recovery code, %d codes left", name, len(u.RecoveryCodes))
+				return nil
+			}
+		}
+		return errInvalidOTP
+	}
+
+	step := totpValidate(u.TOTPSecret, code, time.Now())
+	if step < 0 || step <= a.totpUsed[name] {
+		return errInvalidOTP
+	}
+	a.totpUsed[name] = step
+	return nil
+}
+
+// Start 2FA enrollment: generate a new secret for the user
+// The secret is stored after the user confirms it with a valid code.
+func (a *Auth) totpSetup(name string) (string, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	a.lock.Lock()
+	a.totpPending[name] = secret
+	a.lock.Unlock()
+	return secret, nil
+}
+
+// Finish 2FA enrollment
+// Return recovery codes.
+func (a *Auth) totpEnable(name string, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	secret, ok := a.totpPending[name]
+	if !ok {
+		return nil, fmt.Errorf("2FA setup isn't started")
+	}
+	i := a.userIndex(name)
+	if i < 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	step := totpValidate(secret, code, time.Now())
+	if step < 0 {
+		return nil, errInvalidOTP
+	}
+
+	delete(a.totpPending, name)
+	a.totpUsed[name] = step
+	a.users[i].TOTPSecret = secret
+	a.users[i].RecoveryCodes = hashes
+	log.Info("Auth: enabled 2FA for user '%s'", name)
+	return codes, nil
+}
+
+// Disable 2FA for the user
+func (a *Auth) totpDisable(name string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndex(name)
+	if i < 0 {
+		return fmt.Errorf("user not found")
+	}
+	a.users[i].TOTPSecret = ""
+	a.users[i].RecoveryCodes = nil
+	delete(a.totpUsed, name)
+	log.Info("Auth: disabled 2FA for user '%s'", name)
+	return nil
+}
+
+// Replace the recovery codes of the user
+func (a *Auth) newUserRecoveryCodes(name string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndex(name)
+	if i < 0 || len(a.users[i].TOTPSecret) == 0 {
+		return nil, fmt.Errorf("2FA is disabled")
+	}
+	a.users[i].RecoveryCodes = hashes
+	return codes, nil
+}
+
+type totpJSON struct {
+	Enabled           bool     `json:"enabled"`
+	RecoveryCodesLeft int      `json:"recovery_codes_left"`
+	Secret            string   `json:"secret,omitempty"`
+	URI               string   `json:"uri,omitempty"`
+	RecoveryCodes     []string `json:"recovery_codes,omitempty"`
+}
+
+type totpReqJSON struct {
+	Code string `json:"code"`
+	Name string `json:"name"` // for "reset" request
+}
+
+// Get the current user for 2FA requests
+func totpUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	if Context.auth == nil {
+		httpError(w, http.StatusBadRequest, "authentication is disabled")
+		return User{}, false
+	}
+	u := Context.auth.GetCurrentUser(r)
+	if len(u.Name) == 0 {
+		httpError(w, http.StatusForbidden, "user not found")
+		return User{}, false
+	}
+	return u, true
+}
+
+func writeTOTPJSON(w http.ResponseWriter, resp totpJSON) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	u, ok := totpUser(w, r)
+	if !ok {
+		return
+	}
+	writeTOTPJSON(w, totpJSON{
+		Enabled:           len(u.TOTPSecret) != 0,
+		RecoveryCodesLeft: len(u.RecoveryCodes),
+	})
+}
+
+func handleTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	u, ok := totpUser(w, r)
+	if !ok {
+		return
+	}
+	if len(u.TOTPSecret) != 0 {
+		httpError(w, http.StatusBadRequest, "2FA is already enabled")
+		return
+	}
+
+	secret, err := Context.auth.totpSetup(u.Name)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	writeTOTPJSON(w, totpJSON{
+		Secret: secret,
+		URI:    totpURI(u.Name, secret),
+	})
+}
+
+func handleTOTPEnable(w http.ResponseWriter, r *http.Request) {
+	req := totpReqJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	u, ok := totpUser(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := Context.auth.totpEnable(u.Name, req.Code)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	onConfigModified()
+
+	writeTOTPJSON(w, totpJSON{
+		Enabled:           true,
+		RecoveryCodesLeft: len(codes),
+		RecoveryCodes:     codes,
+	})
+}
+
+// Disable 2FA for the current user: a valid code is required
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	req := totpReqJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	u, ok := totpUser(w, r)
+	if !ok {
+		return
+	}
+
+	err = Context.auth.checkOTP(u.Name, req.Code)
+	if err == nil {
+		err = Context.auth.totpDisable(u.Name)
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	onConfigModified()
+	returnOK(w)
+}
+
+// Generate new recovery codes for the current user: a valid code is required
+func handleTOTPRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	req := totpReqJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	u, ok := totpUser(w, r)
+	if !ok {
+		return
+	}
+
+	var codes []string
+	err = Context.auth.checkOTP(u.Name, req.Code)
+	if err == nil {
+		codes, err = Context.auth.newUserRecoveryCodes(u.Name)
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	onConfigModified()
+
+	writeTOTPJSON(w, totpJSON{
+		Enabled:           true,
+		RecoveryCodesLeft: len(codes),
+		RecoveryCodes:     codes,
+	})
+}
+
+// Disable 2FA for another user (e.g. if the user has lost the device and recovery codes)
+func handleTOTPReset(w http.ResponseWriter, r *http.Request) {
+	req := totpReqJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if Context.auth == nil {
+		httpError(w, http.StatusBadRequest, "authentication is disabled")
+		return
+	}
+
+	err = Context.auth.totpDisable(req.Name)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	onConfigModified()
+	returnOK(w)
+}
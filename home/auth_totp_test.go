@@ -0,0 +1,87 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 4226, RFC 6238 test vectors
+	secret := []byte("12345678901234567890")
+	assert.Equal(t, "755224", hotpCode(secret, 0))
+	assert.Equal(t, "287082", hotpCode(secret, 1))
+	assert.Equal(t, "338314", hotpCode(secret, 4))
+
+	secretB32 := totpEncoding.EncodeToString(secret)
+	assert.Equal(t, int64(1), totpValidate(secretB32, "287082", time.Unix(59, 0)))
+	assert.Equal(t, int64(37037036), totpValidate(secretB32, "081804", time.Unix(1111111109, 0)))
+	assert.Equal(t, int64(-1), totpValidate(secretB32, "081804", time.Unix(1111111209, 0)))
+	assert.Equal(t, int64(-1), totpValidate(secretB32, "", time.Unix(59, 0)))
+
+	assert.Equal(t, "otpauth://totp/AdGuard%20Home:user?issuer=AdGuard+Home&secret=ABC",
+		totpURI("user", "ABC"))
+
+	codes, hashes, err := newRecoveryCodes()
+	assert.Nil(t, err)
+	assert.Equal(t, recoveryCodesNum, len(codes))
+	assert.True(t, isRecoveryCode(codes[0]))
+	assert.Equal(t, hashToken(codes[0]), hashes[0])
+}
+
+func TestAuthTOTP(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "sessions.db")
+
+	a := InitAuth(fn, nil, nil, 60)
+	defer a.Close()
+	assert.Nil(t, a.UserAdd(&User{Name: "name"}, "password"))
+
+	code := func(secretB32 string) string {
+		secret, _ := totpEncoding.DecodeString(secretB32)
+		return hotpCode(secret, uint64(time.Now().Unix()/totpPeriod))
+	}
+
+	// enrollment
+	_, err := a.totpEnable("name", "123456")
+	assert.NotNil(t, err)
+	secret, err := a.totpSetup("name")
+	assert.Nil(t, err)
+	_, err = a.totpEnable("name", "12345")
+	assert.NotNil(t, err)
+	codes, err := a.totpEnable("name", code(secret))
+	assert.Nil(t, err)
+	assert.Equal(t, recoveryCodesNum, len(codes))
+	assert.Equal(t, secret, a.UserFind("name", "password").TOTPSecret)
+
+	// log in
+	_, err = a.httpCookie(loginJSON{Name: "name", Password: "password"})
+	assert.Equal(t, errOTPRequired, err)
+	// the code has already been used during enrollment
+	_, err = a.httpCookie(loginJSON{Name: "name", Password: "password", OTP: code(secret)})
+	assert.Equal(t, errInvalidOTP, err)
+	a.totpUsed["name"] = 0
+	cookie, err := a.httpCookie(loginJSON{Name: "name", Password: "password", OTP: code(secret)})
+	assert.Nil(t, err)
+	assert.True(t, len(cookie) != 0)
+
+	// a recovery code may be used only once
+	_, err = a.httpCookie(loginJSON{Name: "name", Password: "password", OTP: codes[3]})
+	assert.Nil(t, err)
+	_, err = a.httpCookie(loginJSON{Name: "name", Password: "password", OTP: codes[3]})
+	assert.Equal(t, errInvalidOTP, err)
+	assert.Equal(t, recoveryCodesNum-1, len(a.UserFind("name", "password").RecoveryCodes))
+
+	// the settings are kept when the user is updated
+	assert.Nil(t, a.UserUpdate("name", User{Name: "name2"}, ""))
+	assert.Equal(t, secret, a.UserFind("name2", "password").TOTPSecret)
+
+	assert.Nil(t, a.totpDisable("name2"))
+	cookie, err = a.httpCookie(loginJSON{Name: "name2", Password: "password"})
+	assert.Nil(t, err)
+	assert.True(t, len(cookie) != 0)
+}
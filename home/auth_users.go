@@ -0,0 +1,351 @@
+// Web users and their roles
+
+package home
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// User roles
+const (
+	roleAdmin    = "admin"    // full access
+	roleOperator = "operator" // stats + filtering and clients management
+	roleViewer   = "viewer"   // read-only access to status, statistics and query log
+	roleParent   = "parent"   // viewer + blocked services of the assigned clients and groups
+)
+
+// The paths which are available to all users
+var userCommonPaths = []string{
+	"/control/status",
+	"/control/profile",
+	"/control/logout",
+	"/control/i18n/current_language",
+	"/control/version.json",
+	"/control/2fa/status",
+	"/control/2fa/setup",
+	"/control/2fa/enable",
+	"/control/2fa/disable",
+	"/control/2fa/recovery_codes",
+}
+
+// The paths which are available to a user with "parent" role
+// The handlers check that the user manages the client or the group.
+var userParentPaths = []string{
+	"/control/clients/update",
+	"/control/clients/groups/update",
+	"/control/blocked_services/list",
+}
+
+// Get the user's role.  The users without a role are administrators.
+func userRole(u User) string {
+	if len(u.Role) == 0 {
+		return roleAdmin
+	}
+	return u.Role
+}
+
+func userRoleValid(role string) bool {
+	return len(role) == 0 ||
+		role == roleAdmin || role == roleOperator || role == roleViewer || role == roleParent
+}
+
+// Return TRUE if the user with "parent" role manages this client
+func (u *User) managesClient(name string, group string) bool {
+	return stringArrayContains(u.Clients, name) ||
+		(len(group) != 0 && stringArrayContains(u.Groups, group))
+}
+
+// Return TRUE if the request is allowed for the user's role
+func roleAllowed(u User, r *http.Request) bool {
+	if len(u.Name) == 0 {
+		// the user was removed
+		return false
+	}
+
+	path := r.URL.Path
+	if !strings.HasPrefix(path, "/control/") {
+		// UI files
+		return true
+	}
+	for _, p := range userCommonPaths {
+		if path == p {
+			return true
+		}
+	}
+
+	switch userRole(u) {
+	case roleAdmin:
+		return true
+
+	case roleOperator:
+		return strings.HasPrefix(path, "/control/clients") ||
+			tokenAllowed(tokenScopeFiltering, r)
+
+	case roleParent:
+		for _, p := range userParentPaths {
+			if path == p {
+				return true
+			}
+		}
+		return tokenAllowed(tokenScopeStats, r)
+
+	case roleViewer:
+		return tokenAllowed(tokenScopeStats, r)
+	}
+	return false
+}
+
+// Get the user who performs the request if it has "parent" role
+func requestParent(r *http.Request) *User {
+	if Context.auth == nil {
+		return nil
+	}
+	u := Context.auth.GetCurrentUser(r)
+	if len(u.Name) == 0 || userRole(u) != roleParent {
+		return nil
+	}
+	return &u
+}
+
+func (a *Auth) checkUser(u *User) error {
+	if len(u.Name) == 0 {
+		return fmt.Errorf("invalid name")
+	}
+	if !userRoleValid(u.Role) {
+		return fmt.Errorf("invalid role: %s", u.Role)
+	}
+	if userRole(*u) != roleParent && (len(u.Clients) != 0 || len(u.Groups) != 0) {
+		return fmt.Errorf("clients and groups may be assigned only to a user with '%s' role", roleParent)
+	}
+	return nil
+}
+
+// Get the number of administrators (the lock must be held)
+func (a *Auth) adminsCount() int {
+	n := 0
+	for _, u := range a.users {
+		if userRole(u) == roleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// Remove all sessions of the user (the lock must be held)
+func (a *Auth) removeUserSessions(name string) {
+	for sess, s := range a.sessions {
+		if s.userName != name {
+			continue
+		}
+		delete(a.sessions, sess)
+		key, _ := hex.DecodeString(sess)
+		a.removeSession(key)
+	}
+}
+
+// UserUpdate - update user's properties
+// password: "": don't change
+func (a *Auth) UserUpdate(name string, u User, password string) error {
+	err := a.checkUser(&u)
+	if err != nil {
+		return err
+	}
+
+	hash := ""
+	if len(password) != 0 {
+		hash, err = hashPassword(password)
+		if err != nil {
+			return fmt.Errorf("hashPassword: %s", err)
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndex(name)
+	if i < 0 {
+		return fmt.Errorf("user not found")
+	}
+	if name != u.Name && a.userIndex(u.Name) >= 0 {
+		return fmt.Errorf("user '%s' already exists", u.Name)
+	}
+
+	old := a.users[i]
+	u.TOTPSecret = old.TOTPSecret
+	u.RecoveryCodes = old.RecoveryCodes
+	if len(hash) == 0 {
+		u.PasswordHash = old.PasswordHash
+	} else {
+		u.PasswordHash = hash
+	}
+	a.users[i] = u
+	if a.adminsCount() == 0 {
+		a.users[i] = old
+		return fmt.Errorf("there must be at least one user with '%s' role", roleAdmin)
+	}
+
+	if name != u.Name || len(hash) != 0 {
+		a.removeUserSessions(name)
+	}
+	if name != u.Name {
+		delete(a.totpPending, name)
+		a.totpUsed[u.Name] = a.totpUsed[name]
+		delete(a.totpUsed, name)
+	}
+
+	log.Debug("Auth: updated user: %s", u.Name)
+	return nil
+}
+
+// UserDel - remove a user
+func (a *Auth) UserDel(name string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndex(name)
+	if i < 0 {
+		return fmt.Errorf("user not found")
+	}
+	if userRole(a.users[i]) == roleAdmin && a.adminsCount() == 1 {
+		return fmt.Errorf("there must be at least one user with '%s' role", roleAdmin)
+	}
+
+	a.users = append(a.users[:i], a.users[i+1:]...)
+	a.removeUserSessions(name)
+	delete(a.totpPending, name)
+	delete(a.totpUsed, name)
+
+	log.Debug("Auth: removed user: %s", name)
+	return nil
+}
+
+// Get the index of the user (the lock must be held)
+func (a *Auth) userIndex(name string) int {
+	for i, u := range a.users {
+		if u.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+type userJSON struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password,omitempty"` // only in requests
+	Role     string   `json:"role"`
+	Clients  []string `json:"clients"`
+	Groups   []string `json:"groups"`
+
+	TOTPEnabled bool `json:"totp_enabled"` // only in responses
+}
+
+func jsonToUser(uj userJSON) User {
+	return User{
+		Name:    uj.Name,
+		Role:    uj.Role,
+		Clients: uj.Clients,
+		Groups:  uj.Groups,
+	}
+}
+
+func handleUsersList(w http.ResponseWriter, r *http.Request) {
+	data := []userJSON{}
+	if Context.auth != nil {
+		for _, u := range Context.auth.GetUsers() {
+			uj := userJSON{
+				Name:    u.Name,
+				Role:    userRole(u),
+				Clients: stringArrayDup(u.Clients),
+				Groups:  stringArrayDup(u.Groups),
+
+				TOTPEnabled: len(u.TOTPSecret) != 0,
+			}
+			data = append(data, uj)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleUsersAdd(w http.ResponseWriter, r *http.Request) {
+	uj := userJSON{}
+	err := json.NewDecoder(r.Body).Decode(&uj)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if Context.auth == nil {
+		httpError(w, http.StatusBadRequest, "authentication is disabled")
+		return
+	}
+
+	u := jsonToUser(uj)
+	err = Context.auth.UserAdd(&u, uj.Password)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+	returnOK(w)
+}
+
+type updateUserJSON struct {
+	Name string   `json:"name"`
+	Data userJSON `json:"data"`
+}
+
+func handleUsersUpdate(w http.ResponseWriter, r *http.Request) {
+	req := updateUserJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if Context.auth == nil {
+		httpError(w, http.StatusBadRequest, "authentication is disabled")
+		return
+	}
+
+	err = Context.auth.UserUpdate(req.Name, jsonToUser(req.Data), req.Data.Password)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+	returnOK(w)
+}
+
+func handleUsersDelete(w http.ResponseWriter, r *http.Request) {
+	uj := userJSON{}
+	err := json.NewDecoder(r.Body).Decode(&uj)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if Context.auth == nil {
+		httpError(w, http.StatusBadRequest, "authentication is disabled")
+		return
+	}
+
+	err = Context.auth.UserDel(uj.Name)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+	returnOK(w)
+}
@@ -0,0 +1,444 @@
+// Backup and restore of the configuration and data files
+
+package home
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	backupManifestName = "manifest.json"
+	backupConfigName   = "AdGuardHome.yaml"
+	backupLeasesName   = "leases.db" // DHCP leases (dhcpd stores them in the working directory)
+	backupStatsName    = "stats.db"
+	backupQueryLogName = "querylog" // the prefix of query log files
+
+	backupMaxSize = 1024 * 1024 * 1024 // the maximum size of the archive to restore
+
+	restoreDirName       = "agh-restore"        // the unpacked archive
+	restoreBackupDirName = "agh-restore-backup" // the files replaced by the last restore
+)
+
+// The description of the backup archive
+type backupManifest struct {
+	Version       string `json:"version"`
+	SchemaVersion int    `json:"schema_version"`
+	Created       string `json:"created"`
+	Stats         bool   `json:"stats"`
+	QueryLog      bool   `json:"querylog"`
+}
+
+// Get the path on disk of the file in the archive
+func backupDiskPath(name string) string {
+	switch {
+	case name == backupConfigName:
+		return config.getConfigFilename()
+	case strings.HasPrefix(name, dataDir+"/"):
+		return filepath.Join(Context.getDataDir(), filepath.FromSlash(name[len(dataDir)+1:]))
+	}
+	return filepath.Join(Context.workDir, filepath.FromSlash(name))
+}
+
+// Return TRUE if the file with this name may be restored from the archive
+func backupNameValid(name string, m backupManifest) bool {
+	if path.Clean(name) != name || path.IsAbs(name) || strings.Contains(name, "..") {
+		return false
+	}
+
+	switch name {
+	case backupConfigName, backupLeasesName:
+		return true
+	case dataDir + "/" + backupStatsName:
+		return m.Stats
+	}
+
+	dir, base := path.Split(name)
+	switch dir {
+	case dataDir + "/" + filterDir + "/":
+		return len(base) != 0
+	case dataDir + "/":
+		return m.QueryLog && strings.HasPrefix(base, backupQueryLogName)
+	}
+	return false
+}
+
+// Get the names of the query log files in the data directory
+func backupQueryLogFiles() []string {
+	names := []string{}
+	files, err := ioutil.ReadDir(Context.getDataDir())
+	if err != nil {
+		return names
+	}
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), backupQueryLogName) {
+			names = append(names, dataDir+"/"+fi.Name())
+		}
+	}
+	return names
+}
+
+// Get the names of the files to back up
+func backupFiles(m backupManifest) []string {
+	names := []string{backupConfigName, backupLeasesName}
+
+	dir := filepath.Join(Context.getDataDir(), filterDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Backup: %s", err)
+	}
+	for _, fi := range files {
+		// skip temporary files, e.g. the copies of filter files used by the filtering engine
+		if fi.Mode().IsRegular() && !strings.HasSuffix(fi.Name(), ".tmp") {
+			names = append(names, dataDir+"/"+filterDir+"/"+fi.Name())
+		}
+	}
+
+	if m.Stats {
+		names = append(names, dataDir+"/"+backupStatsName)
+	}
+	if m.QueryLog {
+		names = append(names, backupQueryLogFiles()...)
+	}
+	return names
+}
+
+// Write the archive: the manifest, then the files which exist
+func writeBackup(w io.Writer, m backupManifest, names []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	data, _ := json.MarshalIndent(m, "", "\t")
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     backupManifestName,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = writeBackupFile(tw, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeBackupFile(tw *tar.Writer, name string) error {
+	f, err := os.Open(backupDiskPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(fi.Mode().Perm()),
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the file may grow while we're reading it (e.g. the query log): copy only the data we've promised
+	_, err = io.CopyN(tw, f, fi.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// Unpack the archive to the directory
+// Return the manifest and the names of the files
+func unpackBackup(r io.Reader, dir string) (backupManifest, []string, error) {
+	m := backupManifest{}
+	names := []string{}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return m, nil, fmt.Errorf("gzip.NewReader(): %s", err)
+	}
+	defer gr.Close()
+
+	manifest := false
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, nil, fmt.Errorf("tar.Next(): %s", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if h.Name == backupManifestName {
+			err = json.NewDecoder(tr).Decode(&m)
+			if err != nil {
+				return m, nil, fmt.Errorf("%s: %s", backupManifestName, err)
+			}
+			manifest = true
+			continue
+		}
+		if !manifest {
+			return m, nil, fmt.Errorf("%s must be the first file", backupManifestName)
+		}
+		if !backupNameValid(h.Name, m) {
+			return m, nil, fmt.Errorf("unexpected file: %s", h.Name)
+		}
+
+		fn := filepath.Join(dir, filepath.FromSlash(h.Name))
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			return m, nil, err
+		}
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(h.Mode&0777)|0600)
+		if err != nil {
+			return m, nil, err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return m, nil, fmt.Errorf("%s: %s", h.Name, err)
+		}
+		names = append(names, h.Name)
+	}
+
+	if !manifest {
+		return m, nil, fmt.Errorf("%s not found", backupManifestName)
+	}
+	if !stringArrayContains(names, backupConfigName) {
+		return m, nil, fmt.Errorf("%s not found", backupConfigName)
+	}
+	return m, names, nil
+}
+
+// Check the unpacked configuration file
+func checkBackup(dir string, m backupManifest) error {
+	if m.SchemaVersion > currentSchemaVersion {
+		return fmt.Errorf("the backup was created by a newer version: %s", m.Version)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, backupConfigName))
+	if err != nil {
+		return err
+	}
+	var schema struct {
+		SchemaVersion int `yaml:"schema_version"`
+	}
+	err = yaml.Unmarshal(data, &schema)
+	if err != nil {
+		return fmt.Errorf("%s: %s", backupConfigName, err)
+	}
+	if schema.SchemaVersion > currentSchemaVersion {
+		return fmt.Errorf("%s: unsupported schema version %d", backupConfigName, schema.SchemaVersion)
+	}
+	if schema.SchemaVersion < currentSchemaVersion {
+		// the configuration will be upgraded on startup
+		return nil
+	}
+
+	conf := configuration{}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return fmt.Errorf("%s: %s", backupConfigName, err)
+	}
+	if conf.BindPort <= 0 || conf.BindPort > 0xffff {
+		return fmt.Errorf("%s: invalid bind_port: %d", backupConfigName, conf.BindPort)
+	}
+	return nil
+}
+
+// Move a file or a directory.  Files are copied if they can't be renamed.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	fi, err2 := os.Stat(src)
+	if err2 != nil || fi.IsDir() {
+		return err
+	}
+	err = copyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Replace the current files with the files from the unpacked archive
+// The current files are moved to the backup directory.  If an error occurs, they're moved back.
+func applyBackup(dir string, m backupManifest, names []string) error {
+	bdir := filepath.Join(Context.workDir, restoreBackupDirName)
+	_ = os.RemoveAll(bdir)
+
+	old := []string{backupConfigName, backupLeasesName, dataDir + "/" + filterDir}
+	if m.Stats {
+		old = append(old, dataDir+"/"+backupStatsName)
+	}
+	if m.QueryLog {
+		old = append(old, backupQueryLogFiles()...)
+	}
+
+	var moved []string
+	var placed []string
+	rollback := func() {
+		for _, name := range placed {
+			_ = os.Remove(backupDiskPath(name))
+		}
+		for _, name := range moved {
+			fn := backupDiskPath(name)
+			_ = os.RemoveAll(fn)
+			err := moveFile(filepath.Join(bdir, filepath.FromSlash(name)), fn)
+			if err != nil {
+				log.Error("Restore: %s", err)
+			}
+		}
+	}
+
+	for _, name := range old {
+		fn := backupDiskPath(name)
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			continue
+		}
+		bfn := filepath.Join(bdir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(bfn), 0755)
+		if err == nil {
+			err = moveFile(fn, bfn)
+		}
+		if err != nil {
+			rollback()
+			return err
+		}
+		moved = append(moved, name)
+	}
+
+	for _, name := range names {
+		fn := backupDiskPath(name)
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = moveFile(filepath.Join(dir, filepath.FromSlash(name)), fn)
+		}
+		if err != nil {
+			rollback()
+			return err
+		}
+		placed = append(placed, name)
+	}
+
+	_ = os.RemoveAll(dir)
+	log.Info("Restore: restored %d files from the backup created at %s, the previous files are in %s",
+		len(names), m.Created, bdir)
+	return nil
+}
+
+// Stop all modules, replace the files and start a new instance
+func finishRestore(dir string, m backupManifest, names []string) {
+	binName, err := os.Executable()
+	if err != nil {
+		log.Error("Restore: os.Executable(): %s", err)
+		return
+	}
+
+	log.Info("Stopping all tasks")
+	cleanup()
+	stopHTTPServer()
+
+	err = applyBackup(dir, m, names)
+	if err != nil {
+		log.Error("Restore: %s.  The previous configuration is kept.", err)
+	}
+
+	cleanupAlways()
+	restartProcess(binName)
+}
+
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	m := backupManifest{
+		Version:       versionString,
+		SchemaVersion: currentSchemaVersion,
+		Created:       time.Now().Format(time.RFC3339),
+		Stats:         q.Get("stats") == "true",
+		QueryLog:      q.Get("querylog") == "true",
+	}
+
+	err := config.write()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+
+	fn := "AdGuardHome-backup-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+fn)
+	err = writeBackup(w, m, backupFiles(m))
+	if err != nil {
+		log.Error("Backup: %s", err)
+	}
+}
+
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	dir := filepath.Join(Context.workDir, restoreDirName)
+	_ = os.RemoveAll(dir)
+
+	m, names, err := unpackBackup(io.LimitReader(r.Body, backupMaxSize), dir)
+	if err == nil {
+		err = checkBackup(dir, m)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		httpError(w, http.StatusBadRequest, "invalid backup: %s", err)
+		return
+	}
+
+	log.Info("Restore: restoring the backup created at %s by version %s", m.Created, m.Version)
+	returnOK(w)
+
+	time.Sleep(time.Second) // wait (hopefully) until response is sent
+	go finishRestore(dir, m, names)
+}
+
+// RegisterBackupHandlers - register handlers
+func RegisterBackupHandlers() {
+	httpRegister(http.MethodGet, "/control/backup", handleBackup)
+	httpRegister(http.MethodPost, "/control/restore", handleRestore)
+}
@@ -0,0 +1,130 @@
+package home
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testWriteFile(t *testing.T, fn string, data string) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(fn), 0755))
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(data), 0644))
+}
+
+func testReadFile(fn string) string {
+	data, _ := ioutil.ReadFile(fn)
+	return string(data)
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	defer func() {
+		Context.workDir = ""
+		Context.configFilename = ""
+	}()
+
+	conf := fmt.Sprintf("bind_port: 3000\nschema_version: %d\n", currentSchemaVersion)
+	testWriteFile(t, filepath.Join(dir, "AdGuardHome.yaml"), conf)
+	testWriteFile(t, filepath.Join(dir, "data/filters/1.txt"), "||example.org^\n")
+	testWriteFile(t, filepath.Join(dir, "data/stats.db"), "stats")
+	testWriteFile(t, filepath.Join(dir, "data/querylog.json"), "querylog")
+
+	m := backupManifest{SchemaVersion: currentSchemaVersion, Stats: true}
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeBackup(buf, m, backupFiles(m)))
+
+	// change the current files
+	testWriteFile(t, filepath.Join(dir, "AdGuardHome.yaml"), "bind_port: 80\n")
+	testWriteFile(t, filepath.Join(dir, "data/filters/2.txt"), "||example.net^\n")
+	testWriteFile(t, filepath.Join(dir, "data/stats.db"), "stats2")
+
+	rdir := filepath.Join(dir, restoreDirName)
+	m2, names, err := unpackBackup(buf, rdir)
+	assert.Nil(t, err)
+	assert.True(t, m2.Stats)
+	assert.False(t, m2.QueryLog)
+	assert.Equal(t, []string{"AdGuardHome.yaml", "data/filters/1.txt", "data/stats.db"}, names)
+	assert.Nil(t, checkBackup(rdir, m2))
+
+	assert.Nil(t, applyBackup(rdir, m2, names))
+	assert.Equal(t, conf, testReadFile(filepath.Join(dir, "AdGuardHome.yaml")))
+	assert.Equal(t, "||example.org^\n", testReadFile(filepath.Join(dir, "data/filters/1.txt")))
+	assert.Equal(t, "stats", testReadFile(filepath.Join(dir, "data/stats.db")))
+	// the query log isn't in the backup
+	assert.Equal(t, "querylog", testReadFile(filepath.Join(dir, "data/querylog.json")))
+	_, err = os.Stat(filepath.Join(dir, "data/filters/2.txt"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(rdir)
+	assert.True(t, os.IsNotExist(err))
+
+	// the previous files
+	bdir := filepath.Join(dir, restoreBackupDirName)
+	assert.Equal(t, "bind_port: 80\n", testReadFile(filepath.Join(bdir, "AdGuardHome.yaml")))
+	assert.Equal(t, "||example.net^\n", testReadFile(filepath.Join(bdir, "data/filters/2.txt")))
+	assert.Equal(t, "stats2", testReadFile(filepath.Join(bdir, "data/stats.db")))
+}
+
+func testBackupArchive(t *testing.T, files ...string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for i := 0; i < len(files); i += 2 {
+		assert.Nil(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     files[i],
+			Mode:     0644,
+			Size:     int64(len(files[i+1])),
+		}))
+		_, err := tw.Write([]byte(files[i+1]))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gw.Close())
+	return buf
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	conf := fmt.Sprintf("bind_port: 3000\nschema_version: %d\n", currentSchemaVersion)
+	manifest := `{"stats":false}`
+
+	_, _, err := unpackBackup(testBackupArchive(t, manifest, conf), dir)
+	assert.NotNil(t, err) // no manifest
+
+	_, _, err = unpackBackup(testBackupArchive(t, "manifest.json", manifest), dir)
+	assert.NotNil(t, err) // no config
+
+	_, _, err = unpackBackup(testBackupArchive(t, "manifest.json", manifest, "AdGuardHome.yaml", conf,
+		"data/stats.db", "stats"), dir)
+	assert.NotNil(t, err) // stats aren't in the manifest
+
+	_, _, err = unpackBackup(testBackupArchive(t, "manifest.json", manifest, "AdGuardHome.yaml", conf,
+		"data/filters/../../../x", "x"), dir)
+	assert.NotNil(t, err)
+
+	m, _, err := unpackBackup(testBackupArchive(t, "manifest.json", manifest, "AdGuardHome.yaml", conf), dir)
+	assert.Nil(t, err)
+	assert.Nil(t, checkBackup(dir, m))
+
+	m.SchemaVersion = currentSchemaVersion + 1
+	assert.NotNil(t, checkBackup(dir, m))
+
+	testWriteFile(t, filepath.Join(dir, "AdGuardHome.yaml"), fmt.Sprintf("bind_port: [1]\nschema_version: %d\n", currentSchemaVersion))
+	assert.NotNil(t, checkBackup(dir, backupManifest{}))
+
+	// an old configuration is upgraded on startup
+	testWriteFile(t, filepath.Join(dir, "AdGuardHome.yaml"), "bind_port: 3000\nschema_version: 1\n")
+	assert.Nil(t, checkBackup(dir, backupManifest{}))
+}
@@ -2,7 +2,9 @@ package home
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
@@ -190,8 +192,94 @@ func handleBlockedServicesSet(w http.ResponseWriter, r *http.Request) {
 	httpOK(r, w)
 }
 
+type serviceTestReq struct {
+	Name  string   `json:"name"`  // name of a known service (used if "rules" is empty)
+	Rules []string `json:"rules"` // service definition
+	Hosts []string `json:"hosts"` // sample host names
+}
+
+type serviceTestHost struct {
+	Host    string `json:"host"`
+	Matched bool   `json:"matched"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+type serviceTestResp struct {
+	InvalidRules []string          `json:"invalid_rules"`
+	Hosts        []serviceTestHost `json:"hosts"`
+}
+
+// Compile service definition and match sample host names against it
+func testServiceRules(req serviceTestReq) (serviceTestResp, error) {
+	resp := serviceTestResp{
+		InvalidRules: []string{},
+		Hosts:        []serviceTestHost{},
+	}
+
+	var netRules []*rules.NetworkRule
+	if len(req.Rules) != 0 {
+		for _, text := range req.Rules {
+			text = strings.TrimSpace(text)
+			if len(text) == 0 {
+				continue
+			}
+			rule, err := rules.NewNetworkRule(text, 0)
+			if err != nil {
+				resp.InvalidRules = append(resp.InvalidRules, text)
+				continue
+			}
+			netRules = append(netRules, rule)
+		}
+	} else {
+		var ok bool
+		netRules, ok = serviceRules[req.Name]
+		if !ok {
+			return resp, fmt.Errorf("unknown service name: %s", req.Name)
+		}
+	}
+
+	for _, host := range req.Hosts {
+		h := serviceTestHost{
+			Host: strings.ToLower(host),
+		}
+		r := rules.NewRequestForHostname(h.Host)
+		for _, rule := range netRules {
+			if rule.Match(r) {
+				h.Matched = true
+				h.Rule = rule.Text()
+				break
+			}
+		}
+		resp.Hosts = append(resp.Hosts, h)
+	}
+	return resp, nil
+}
+
+func handleBlockedServicesTest(w http.ResponseWriter, r *http.Request) {
+	req := serviceTestReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	resp, err := testServiceRules(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
 // RegisterBlockedServicesHandlers - register HTTP handlers
 func RegisterBlockedServicesHandlers() {
 	httpRegister(http.MethodGet, "/control/blocked_services/list", handleBlockedServicesList)
 	httpRegister(http.MethodPost, "/control/blocked_services/set", handleBlockedServicesSet)
+	httpRegister(http.MethodPost, "/control/blocked_services/test", handleBlockedServicesTest)
 }
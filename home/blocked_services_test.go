@@ -0,0 +1,29 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceRulesTest(t *testing.T) {
+	req := serviceTestReq{
+		Rules: []string{"||example.org^", "||cdn.example.net^", "||bad$rule=1"},
+		Hosts: []string{"www.example.org", "example.net", "img.CDN.example.net"},
+	}
+	resp, err := testServiceRules(req)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"||bad$rule=1"}, resp.InvalidRules)
+	assert.Equal(t, 3, len(resp.Hosts))
+	assert.True(t, resp.Hosts[0].Matched && resp.Hosts[0].Rule == "||example.org^")
+	assert.False(t, resp.Hosts[1].Matched)
+	assert.True(t, resp.Hosts[2].Matched && resp.Hosts[2].Rule == "||cdn.example.net^")
+
+	initServices()
+	resp, err = testServiceRules(serviceTestReq{Name: "twitch", Hosts: []string{"twitch.tv"}})
+	assert.Nil(t, err)
+	assert.True(t, resp.Hosts[0].Matched)
+
+	_, err = testServiceRules(serviceTestReq{Name: "unknown"})
+	assert.NotNil(t, err)
+}
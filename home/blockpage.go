@@ -0,0 +1,499 @@
+// Built-in web server which shows a "blocked" page for the domains redirected to our IP address
+
+package home
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	blockPageDefaultPort  = 80
+	blockPageDefaultTitle = "Blocked by AdGuard Home"
+	blockPageUnblockPath  = "/__adguardhome/unblock"
+	unblockRequestsMax    = 100 // the maximum number of pending unblock requests
+	unblockCommentMaxLen  = 1000
+)
+
+type blockPageConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	BindHost  string `yaml:"bind_host"`
+	Port      int    `yaml:"port"`       // HTTP port.  0: default (80)
+	PortHTTPS int    `yaml:"port_https"` // HTTPS port.  0: disabled.  The certificate from TLS settings is used.
+	Title     string `yaml:"title"`      // Page title.  "": "Blocked by AdGuard Home"
+}
+
+// Information about a blocked request
+type blockedInfo struct {
+	Reason      string `json:"reason"`
+	Rule        string `json:"rule"`
+	FilterID    int64  `json:"filter_id"`
+	ServiceName string `json:"service_name"`
+}
+
+// A request from a user to unblock a domain
+type unblockRequest struct {
+	ID         uint32    `json:"id"`
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	ClientName string    `json:"client_name"`
+	Host       string    `json:"host"`
+	Rule       string    `json:"rule"`
+	FilterID   int64     `json:"filter_id"`
+	FilterName string    `json:"filter_name"`
+	Comment    string    `json:"comment"`
+}
+
+// Block page module
+type blockPage struct {
+	conf     blockPageConfig
+	filename string // file with unblock requests
+
+	// client IP + host name -> blocked request info (JSON)
+	// The recently blocked requests are stored here so that we know the rule when a browser opens the page.
+	recent cache.Cache
+
+	lock     sync.Mutex
+	requests []unblockRequest
+	lastID   uint32
+
+	servers []*http.Server
+}
+
+// Create module context
+func initBlockPage(conf blockPageConfig, filename string) *blockPage {
+	b := &blockPage{
+		conf:     conf,
+		filename: filename,
+		requests: []unblockRequest{},
+	}
+	if len(b.conf.Title) == 0 {
+		b.conf.Title = blockPageDefaultTitle
+	}
+	b.recent = cache.New(cache.Config{
+		EnableLRU: true,
+		MaxCount:  10000,
+	})
+	b.load()
+	return b
+}
+
+// Start HTTP and HTTPS servers
+func (b *blockPage) Start() {
+	if !b.conf.Enabled {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(blockPageUnblockPath, b.handleUnblock)
+	mux.HandleFunc(acmeChallengePath, handleACMEChallenge)
+	mux.HandleFunc("/", b.handlePage)
+
+	port := b.conf.Port
+	if port == 0 {
+		port = blockPageDefaultPort
+	}
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(b.conf.BindHost, strconv.Itoa(port)),
+		Handler: mux,
+	}
+	b.servers = append(b.servers, srv)
+	go func() {
+		log.Info("Block page: listening on http://%s", srv.Addr)
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Error("Block page: %s", err)
+		}
+	}()
+
+	if b.conf.PortHTTPS == 0 {
+		return
+	}
+	config.RLock()
+	cert, err := tls.X509KeyPair(config.TLS.CertificateChainData, config.TLS.PrivateKeyData)
+	config.RUnlock()
+	if err != nil {
+		log.Error("Block page: HTTPS is disabled: %s", err)
+		return
+	}
+	srvTLS := &http.Server{
+		Addr:    net.JoinHostPort(b.conf.BindHost, strconv.Itoa(b.conf.PortHTTPS)),
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+	b.servers = append(b.servers, srvTLS)
+	go func() {
+		log.Info("Block page: listening on https://%s", srvTLS.Addr)
+		err := srvTLS.ListenAndServeTLS("", "")
+		if err != http.ErrServerClosed {
+			log.Error("Block page: %s", err)
+		}
+	}()
+}
+
+// Close - stop servers
+func (b *blockPage) Close() {
+	for _, srv := range b.servers {
+		_ = srv.Shutdown(context.TODO())
+	}
+	b.servers = nil
+}
+
+// Called by DNS module when the response is ready
+func (b *blockPage) onDNSResponse(d *proxy.DNSContext, res *dnsfilter.Result) {
+	if !b.conf.Enabled || res == nil || !res.IsFiltered || len(d.Req.Question) == 0 {
+		return
+	}
+
+	info := blockedInfo{
+		Reason:      res.Reason.String(),
+		Rule:        res.Rule,
+		FilterID:    res.FilterID,
+		ServiceName: res.ServiceName,
+	}
+	data, _ := json.Marshal(info)
+	ip := dnsforward.GetIPString(d.Addr)
+	host := strings.ToLower(strings.TrimSuffix(d.Req.Question[0].Name, "."))
+	b.recent.Set([]byte(ip+"#"+host), data)
+}
+
+// Get the information about the host blocked for a client
+func (b *blockPage) getBlockedInfo(ip string, host string) (blockedInfo, bool) {
+	info := blockedInfo{}
+	data := b.recent.Get([]byte(ip + "#" + host))
+	if data != nil {
+		err := json.Unmarshal(data, &info)
+		return info, err == nil
+	}
+
+	// the DNS response may have been cached by the client for a long time: check the host again
+	if Context.dnsFilter == nil {
+		return info, false
+	}
+	setts := Context.dnsFilter.GetConfig()
+	setts.FilteringEnabled = config.DNS.FilteringEnabled
+	setts.ClientIP = ip
+	applyAdditionalFiltering(ip, &setts)
+	res, err := Context.dnsFilter.CheckHost(host, dns.TypeA, &setts)
+	if err != nil || !res.IsFiltered {
+		return info, false
+	}
+	info.Reason = res.Reason.String()
+	info.Rule = res.Rule
+	info.FilterID = res.FilterID
+	info.ServiceName = res.ServiceName
+	return info, true
+}
+
+// Get the name of a filter list by its ID
+func filterNameByID(id int64) string {
+	if id == 0 {
+		return "Custom filtering rules"
+	}
+
+	config.RLock()
+	defer config.RUnlock()
+	for _, f := range config.Filters {
+		if f.ID == id {
+			return f.Name
+		}
+	}
+	return ""
+}
+
+// Get the host name (without port) and the client IP address
+func blockPageRequestInfo(r *http.Request) (string, string) {
+	host := r.Host
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return strings.ToLower(host), ip
+}
+
+var blockPageTemplate = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; background: #f5f5f5; color: #333; margin: 0; }
+.box { max-width: 600px; margin: 60px auto; background: #fff; padding: 30px; border-radius: 6px; box-shadow: 0 1px 4px rgba(0,0,0,.2); }
+h1 { color: #67b279; font-size: 24px; }
+td { padding: 4px 10px 4px 0; vertical-align: top; }
+code { word-break: break-all; }
+textarea { width: 100%; box-sizing: border-box; }
+button { margin-top: 10px; padding: 8px 16px; background: #67b279; color: #fff; border: 0; border-radius: 4px; cursor: pointer; }
+</style>
+</head>
+<body>
+<div class="box">
+<h1>{{.Title}}</h1>
+<p>Access to <b>{{.Host}}</b> has been blocked by the network administrator.</p>
+{{if .Found}}
+<table>
+<tr><td>Reason:</td><td>{{.Info.Reason}}</td></tr>
+{{if .Info.ServiceName}}<tr><td>Service:</td><td>{{.Info.ServiceName}}</td></tr>{{end}}
+{{if .Info.Rule}}<tr><td>Rule:</td><td><code>{{.Info.Rule}}</code></td></tr>{{end}}
+{{if .FilterName}}<tr><td>Filter:</td><td>{{.FilterName}}</td></tr>{{end}}
+</table>
+{{end}}
+{{if .Sent}}
+<p>Your request has been sent to the administrator.</p>
+{{else}}
+<form method="POST" action="{{.UnblockPath}}">
+<input type="hidden" name="host" value="{{.Host}}">
+<p><textarea name="comment" rows="3" maxlength="1000" placeholder="Why do you need this site? (optional)"></textarea></p>
+<button type="submit">Ask admin to unblock</button>
+</form>
+{{end}}
+</div>
+</body>
+</html>
+`))
+
+type blockPageData struct {
+	Title       string
+	Host        string
+	Found       bool
+	Info        blockedInfo
+	FilterName  string
+	Sent        bool
+	UnblockPath string
+}
+
+func (b *blockPage) renderPage(w http.ResponseWriter, host string, ip string, sent bool) {
+	data := blockPageData{
+		Title:       b.conf.Title,
+		Host:        host,
+		Sent:        sent,
+		UnblockPath: blockPageUnblockPath,
+	}
+	data.Info, data.Found = b.getBlockedInfo(ip, host)
+	if data.Found && len(data.Info.Rule) != 0 {
+		data.FilterName = filterNameByID(data.Info.FilterID)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	err := blockPageTemplate.Execute(w, data)
+	if err != nil {
+		log.Debug("Block page: %s", err)
+	}
+}
+
+func (b *blockPage) handlePage(w http.ResponseWriter, r *http.Request) {
+	host, ip := blockPageRequestInfo(r)
+	b.renderPage(w, host, ip, false)
+}
+
+func (b *blockPage) handleUnblock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "This request must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, ip := blockPageRequestInfo(r)
+	host := strings.ToLower(strings.TrimSpace(r.FormValue("host")))
+	if _, ok := dns.IsDomainName(host); !ok || len(host) == 0 {
+		http.Error(w, "invalid host name", http.StatusBadRequest)
+		return
+	}
+	comment := strings.TrimSpace(r.FormValue("comment"))
+	if len(comment) > unblockCommentMaxLen {
+		comment = comment[:unblockCommentMaxLen]
+	}
+
+	req := unblockRequest{
+		Time:    time.Now(),
+		Client:  ip,
+		Host:    host,
+		Comment: comment,
+	}
+	c, ok := Context.clients.Find(ip)
+	if ok {
+		req.ClientName = c.Name
+	}
+	info, ok := b.getBlockedInfo(ip, host)
+	if ok {
+		req.Rule = info.Rule
+		req.FilterID = info.FilterID
+		req.FilterName = filterNameByID(info.FilterID)
+	}
+	b.addRequest(req)
+
+	b.renderPage(w, host, ip, true)
+}
+
+// Add an unblock request.
+// A repeated request from the same client for the same host replaces the previous one.
+func (b *blockPage) addRequest(req unblockRequest) {
+	b.lock.Lock()
+	for i, r := range b.requests {
+		if r.Client == req.Client && r.Host == req.Host {
+			b.requests = append(b.requests[:i], b.requests[i+1:]...)
+			break
+		}
+	}
+	if len(b.requests) >= unblockRequestsMax {
+		b.requests = b.requests[1:]
+	}
+	b.lastID++
+	req.ID = b.lastID
+	b.requests = append(b.requests, req)
+	b.lock.Unlock()
+
+	log.Info("Block page: %s asks to unblock %s", req.Client, req.Host)
+	b.save()
+}
+
+// Remove an unblock request
+// Return FALSE if not found
+func (b *blockPage) delRequest(id uint32) bool {
+	b.lock.Lock()
+	found := false
+	for i, r := range b.requests {
+		if r.ID == id {
+			b.requests = append(b.requests[:i], b.requests[i+1:]...)
+			found = true
+			break
+		}
+	}
+	b.lock.Unlock()
+
+	if found {
+		b.save()
+	}
+	return found
+}
+
+// Load unblock requests from file
+func (b *blockPage) load() {
+	if len(b.filename) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(b.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Block page: %s", err)
+		}
+		return
+	}
+
+	list := []unblockRequest{}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		log.Error("Block page: %s: %s", b.filename, err)
+		return
+	}
+
+	b.lock.Lock()
+	b.requests = list
+	for _, r := range list {
+		if r.ID > b.lastID {
+			b.lastID = r.ID
+		}
+	}
+	b.lock.Unlock()
+}
+
+// Save unblock requests to file
+func (b *blockPage) save() {
+	if len(b.filename) == 0 {
+		return
+	}
+
+	b.lock.Lock()
+	data, err := json.Marshal(b.requests)
+	b.lock.Unlock()
+	if err != nil {
+		log.Error("Block page: json.Marshal: %s", err)
+		return
+	}
+
+	err = file.SafeWrite(b.filename, data)
+	if err != nil {
+		log.Error("Block page: %s", err)
+	}
+}
+
+type unblockRequestsJSON struct {
+	Requests []unblockRequest `json:"requests"`
+}
+
+func handleUnblockRequestsList(w http.ResponseWriter, r *http.Request) {
+	if Context.blockPage == nil {
+		httpError(w, http.StatusInternalServerError, "block page module isn't initialized")
+		return
+	}
+
+	b := Context.blockPage
+	resp := unblockRequestsJSON{}
+	b.lock.Lock()
+	resp.Requests = make([]unblockRequest, len(b.requests))
+	copy(resp.Requests, b.requests)
+	b.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+type unblockRequestDelJSON struct {
+	ID uint32 `json:"id"`
+}
+
+func handleUnblockRequestsDelete(w http.ResponseWriter, r *http.Request) {
+	req := unblockRequestDelJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if Context.blockPage == nil {
+		httpError(w, http.StatusInternalServerError, "block page module isn't initialized")
+		return
+	}
+
+	if !Context.blockPage.delRequest(req.ID) {
+		httpError(w, http.StatusBadRequest, "request not found: %d", req.ID)
+		return
+	}
+}
+
+// RegisterBlockPageHandlers - register HTTP handlers
+func RegisterBlockPageHandlers() {
+	httpRegister(http.MethodGet, "/control/blockpage/requests", handleUnblockRequestsList)
+	httpRegister(http.MethodPost, "/control/blockpage/requests/delete", handleUnblockRequestsDelete)
+}
@@ -0,0 +1,66 @@
+package home
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockPage(t *testing.T) {
+	Context.clients = clientsContainer{testing: true}
+	Context.clients.Init(nil, nil, nil)
+	b := initBlockPage(blockPageConfig{Enabled: true}, "")
+
+	req := &dns.Msg{}
+	req.SetQuestion("Blocked.example.org.", dns.TypeA)
+	d := &proxy.DNSContext{
+		Req:  req,
+		Addr: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234},
+	}
+	b.onDNSResponse(d, &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList, Rule: "||blocked.example.org^", FilterID: 0})
+
+	// the page shows the rule
+	r := httptest.NewRequest("GET", "http://blocked.example.org/path", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+	w := httptest.NewRecorder()
+	b.handlePage(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	body := w.Body.String()
+	assert.True(t, strings.Contains(body, "Blocked by AdGuard Home"))
+	assert.True(t, strings.Contains(body, "||blocked.example.org^"))
+	assert.True(t, strings.Contains(body, "Custom filtering rules"))
+	assert.True(t, strings.Contains(body, "Ask admin to unblock"))
+
+	// unblock request
+	form := url.Values{}
+	form.Set("host", "blocked.example.org")
+	form.Set("comment", "homework")
+	r = httptest.NewRequest("POST", "http://blocked.example.org"+blockPageUnblockPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "1.2.3.4:5678"
+	w = httptest.NewRecorder()
+	b.handleUnblock(w, r)
+	assert.True(t, strings.Contains(w.Body.String(), "Your request has been sent"))
+	assert.Equal(t, 1, len(b.requests))
+	assert.Equal(t, "1.2.3.4", b.requests[0].Client)
+	assert.Equal(t, "blocked.example.org", b.requests[0].Host)
+	assert.Equal(t, "||blocked.example.org^", b.requests[0].Rule)
+	assert.Equal(t, "homework", b.requests[0].Comment)
+
+	// the same request again replaces the previous one
+	b.addRequest(unblockRequest{Client: "1.2.3.4", Host: "blocked.example.org"})
+	assert.Equal(t, 1, len(b.requests))
+	assert.Equal(t, uint32(2), b.requests[0].ID)
+
+	assert.False(t, b.delRequest(1))
+	assert.True(t, b.delRequest(2))
+	assert.Equal(t, 0, len(b.requests))
+}
@@ -15,7 +15,6 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
-	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/utils"
 )
@@ -34,27 +33,50 @@ type Client struct {
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
+	AllowlistOnly       bool // block all host names except those matched by whitelist rules (independent of UseOwnSettings)
+	IgnoreQueryLog      bool // don't write the client's requests to the query log
+	IgnoreStatistics    bool // don't count the client's requests in statistics
 
 	UseOwnBlockedServices bool // false: use global settings
 	BlockedServices       []string
 
 	Upstreams []string // list of upstream servers to be used for the client's requests
+
+	// DNSSEC validation mode for the client's requests: "off", "permissive", "enforce".  "": use global settings
+	DNSSECValidation string
+
+	// Max number of requests per second from the client.  0: use global settings
+	Ratelimit uint32
+
+	// Remove the records of these types from the responses in addition to the global settings ("AAAA", "[/example.org/]HTTPS")
+	BlockedRecordTypes []string
+
+	// Priority of the client among the clients whose CIDR ranges contain the same IP address.
+	// The client with the highest priority wins.  If priorities are equal, the longest prefix wins.
+	// Clients with exactly matching IP address always have higher priority.
+	Priority int
+
+	// The group whose settings are inherited by the client.  "": none
+	Group string
+
 	// Upstream objects:
 	// nil: not yet initialized
-	// not nil, but empty: initialized, no good upstreams
-	// not nil, not empty: Upstreams ready to be used
-	upstreamObjects []upstream.Upstream
+	// not nil: Upstreams ready to be used (may be empty if the settings are invalid)
+	upstreamObjects *dnsforward.ClientUpstreams
 }
 
 type clientSource uint
 
 // Client sources
 const (
-	// Priority: etc/hosts > DHCP > ARP > rDNS > WHOIS
+	// Priority: etc/hosts > VPN > DHCP > ARP > mDNS > NetBIOS > rDNS > WHOIS
 	ClientSourceWHOIS     clientSource = iota // from WHOIS
 	ClientSourceRDNS                          // from rDNS
+	ClientSourceNetBIOS                       // from NetBIOS node status response
+	ClientSourceMDNS                          // from mDNS announcements
 	ClientSourceDHCP                          // from DHCP
 	ClientSourceARP                           // from 'arp -a'
+	ClientSourceVPN                           // from WireGuard configuration or Tailscale API
 	ClientSourceHostsFile                     // from /etc/hosts
 )
 
@@ -63,31 +85,43 @@ type ClientHost struct {
 	Host      string
 	Source    clientSource
 	WhoisInfo [][]string // [[key,value], ...]
+
+	MAC    net.HardwareAddr // from ARP table
+	Vendor string           // the vendor of the network adapter
 }
 
 type clientsContainer struct {
-	list    map[string]*Client     // name -> client
-	idIndex map[string]*Client     // IP -> client
-	ipHost  map[string]*ClientHost // IP -> Hostname
+	list    map[string]*Client      // name -> client
+	idIndex map[string]*Client      // IP -> client
+	ipHost  map[string]*ClientHost  // IP -> Hostname
+	groups  map[string]*ClientGroup // name -> group
 	lock    sync.Mutex
 
+	cidrIndex *cidrTree // CIDR -> client
+
 	allTags map[string]bool
 
 	// dhcpServer is used for looking up clients IP addresses by MAC addresses
 	dhcpServer *dhcpd.Server
 
+	// The system neighbor table is used for looking up MAC addresses
+	// of the clients which didn't receive their IP addresses from our DHCP server
+	neighbors *neighborCache
+
 	testing bool // if TRUE, this object is used for internal tests
 }
 
 // Init initializes clients container
 // Note: this function must be called only once
-func (clients *clientsContainer) Init(objects []clientObject, dhcpServer *dhcpd.Server) {
+func (clients *clientsContainer) Init(objects []clientObject, groups []clientGroupObject, dhcpServer *dhcpd.Server) {
 	if clients.list != nil {
 		log.Fatal("clients.list != nil")
 	}
 	clients.list = make(map[string]*Client)
 	clients.idIndex = make(map[string]*Client)
 	clients.ipHost = make(map[string]*ClientHost)
+	clients.groups = make(map[string]*ClientGroup)
+	clients.cidrIndex = &cidrTree{}
 
 	clients.allTags = make(map[string]bool)
 	for _, t := range clientTags {
@@ -95,9 +129,11 @@ func (clients *clientsContainer) Init(objects []clientObject, dhcpServer *dhcpd.
 	}
 
 	clients.dhcpServer = dhcpServer
+	clients.addGroupsFromConfig(groups)
 	clients.addFromConfig(objects)
 
 	if !clients.testing {
+		clients.neighbors = newNeighborCache()
 		go clients.periodicUpdate()
 
 		clients.addFromDHCP()
@@ -116,11 +152,22 @@ type clientObject struct {
 	ParentalEnabled     bool     `yaml:"parental_enabled"`
 	SafeSearchEnabled   bool     `yaml:"safesearch_enabled"`
 	SafeBrowsingEnabled bool     `yaml:"safebrowsing_enabled"`
+	AllowlistOnly       bool     `yaml:"allowlist_only"`
+	IgnoreQueryLog      bool     `yaml:"ignore_querylog"`
+	IgnoreStatistics    bool     `yaml:"ignore_statistics"`
 
 	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services"`
 	BlockedServices          []string `yaml:"blocked_services"`
 
 	Upstreams []string `yaml:"upstreams"`
+	Priority  int      `yaml:"priority"`
+
+	DNSSECValidation string `yaml:"dnssec_validation"`
+	Ratelimit        uint32 `yaml:"ratelimit"`
+
+	BlockedRecordTypes []string `yaml:"blocked_record_types"`
+
+	Group string `yaml:"group"`
 }
 
 func (clients *clientsContainer) tagKnown(tag string) bool {
@@ -138,11 +185,28 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 			ParentalEnabled:     cy.ParentalEnabled,
 			SafeSearchEnabled:   cy.SafeSearchEnabled,
 			SafeBrowsingEnabled: cy.SafeBrowsingEnabled,
+			AllowlistOnly:       cy.AllowlistOnly,
+			IgnoreQueryLog:      cy.IgnoreQueryLog,
+			IgnoreStatistics:    cy.IgnoreStatistics,
 
 			UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
 			BlockedServices:       cy.BlockedServices,
 
 			Upstreams: cy.Upstreams,
+			Priority:  cy.Priority,
+
+			DNSSECValidation: cy.DNSSECValidation,
+			Ratelimit:        cy.Ratelimit,
+
+			BlockedRecordTypes: cy.BlockedRecordTypes,
+
+			Group: cy.Group,
+		}
+
+		_, ok := clients.groups[cli.Group]
+		if len(cli.Group) != 0 && !ok {
+			log.Debug("Clients: skipping unknown group '%s'", cli.Group)
+			cli.Group = ""
 		}
 
 		for _, t := range cy.Tags {
@@ -161,8 +225,31 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 	}
 }
 
+// Replace all persistent clients and groups
+func (clients *clientsContainer) replaceFromConfig(objects []clientObject, groups []clientGroupObject) {
+	clients.lock.Lock()
+	names := []string{}
+	for name := range clients.list {
+		names = append(names, name)
+	}
+	groupNames := []string{}
+	for name := range clients.groups {
+		groupNames = append(groupNames, name)
+	}
+	clients.lock.Unlock()
+
+	for _, name := range names {
+		clients.Del(name)
+	}
+	for _, name := range groupNames {
+		_ = clients.DelGroup(name)
+	}
+	clients.addGroupsFromConfig(groups)
+	clients.addFromConfig(objects)
+}
+
 // WriteDiskConfig - write configuration
-func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
+func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject, groups *[]clientGroupObject) {
 	clients.lock.Lock()
 	for _, cli := range clients.list {
 		cy := clientObject{
@@ -172,16 +259,25 @@ func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
 			ParentalEnabled:          cli.ParentalEnabled,
 			SafeSearchEnabled:        cli.SafeSearchEnabled,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
+			AllowlistOnly:            cli.AllowlistOnly,
+			IgnoreQueryLog:           cli.IgnoreQueryLog,
+			IgnoreStatistics:         cli.IgnoreStatistics,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+			Priority:                 cli.Priority,
+			DNSSECValidation:         cli.DNSSECValidation,
+			Ratelimit:                cli.Ratelimit,
+			Group:                    cli.Group,
 		}
 
 		cy.Tags = stringArrayDup(cli.Tags)
 		cy.IDs = stringArrayDup(cli.IDs)
 		cy.BlockedServices = stringArrayDup(cli.BlockedServices)
 		cy.Upstreams = stringArrayDup(cli.Upstreams)
+		cy.BlockedRecordTypes = stringArrayDup(cli.BlockedRecordTypes)
 
 		*objects = append(*objects, cy)
 	}
+	clients.writeGroupsConfig(groups)
 	clients.lock.Unlock()
 }
 
@@ -229,6 +325,7 @@ func stringArrayDup(a []string) []string {
 }
 
 // Find searches for a client by IP
+// The returned object contains the settings inherited from the client's group.
 func (clients *clientsContainer) Find(ip string) (Client, bool) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
@@ -241,75 +338,146 @@ func (clients *clientsContainer) Find(ip string) (Client, bool) {
 	c.Tags = stringArrayDup(c.Tags)
 	c.BlockedServices = stringArrayDup(c.BlockedServices)
 	c.Upstreams = stringArrayDup(c.Upstreams)
+	clients.applyGroup(&c)
 	return c, true
 }
 
-func upstreamArrayCopy(a []upstream.Upstream) []upstream.Upstream {
-	a2 := make([]upstream.Upstream, len(a))
-	copy(a2, a)
-	return a2
+// IsQueryLogIgnored returns TRUE if the client's requests mustn't be written to the query log
+func (clients *clientsContainer) IsQueryLogIgnored(ip net.IP) bool {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByIP(ip.String())
+	return ok && c.IgnoreQueryLog
 }
 
-// FindUpstreams looks for upstreams configured for the client
+// IsStatisticsIgnored returns TRUE if the client's requests mustn't be counted in statistics
+func (clients *clientsContainer) IsStatisticsIgnored(ip net.IP) bool {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByIP(ip.String())
+	return ok && c.IgnoreStatistics
+}
+
+// FindUpstreams looks for upstreams configured for the client or for its group
 // If no client found for this IP, or if no custom upstreams are configured,
 // this method returns nil
-func (clients *clientsContainer) FindUpstreams(ip string) []upstream.Upstream {
+func (clients *clientsContainer) FindUpstreams(ip string) *dnsforward.ClientUpstreams {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
-	c, ok := clients.findByIP(ip)
-	if !ok {
+	c := clients.findPtrByIP(ip)
+	if c == nil {
 		return nil
 	}
 
-	if c.upstreamObjects == nil {
-		c.upstreamObjects = make([]upstream.Upstream, 0)
-		for _, us := range c.Upstreams {
-			u, err := upstream.AddressToUpstream(us, upstream.Options{Timeout: dnsforward.DefaultTimeout})
-			if err != nil {
-				log.Error("upstream.AddressToUpstream: %s: %s", us, err)
-				continue
-			}
-			c.upstreamObjects = append(c.upstreamObjects, u)
+	name := c.Name
+	upstreams := c.Upstreams
+	objects := &c.upstreamObjects
+	g, ok := clients.groups[c.Group]
+	if len(upstreams) == 0 && ok {
+		name = "group " + g.Name
+		upstreams = g.Upstreams
+		objects = &g.upstreamObjects
+	}
+	if len(upstreams) == 0 {
+		return nil
+	}
+
+	// the objects are created once and kept until the client's settings are changed
+	if *objects == nil {
+		u, err := dnsforward.NewClientUpstreams(upstreams, config.DNS.BootstrapDNS)
+		if err != nil {
+			log.Error("Clients: %s: invalid upstreams: %s", name, err)
+			u = &dnsforward.ClientUpstreams{}
 		}
+		*objects = u
 	}
+	return *objects
+}
 
-	if len(c.upstreamObjects) == 0 {
+// FindDNSSECMode returns DNSSEC validation mode configured for the client
+func (clients *clientsContainer) FindDNSSECMode(ip string) string {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByIP(ip)
+	if !ok {
+		return ""
+	}
+	return c.DNSSECValidation
+}
+
+// FindRatelimit returns the rate limit configured for the client
+func (clients *clientsContainer) FindRatelimit(ip string) uint32 {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c := clients.findPtrByIP(ip)
+	if c == nil {
+		return 0
+	}
+	return c.Ratelimit
+}
+
+// FindBlockedRecordTypes returns the record type rules configured for the client
+func (clients *clientsContainer) FindBlockedRecordTypes(ip string) []string {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c := clients.findPtrByIP(ip)
+	if c == nil {
 		return nil
 	}
-	return upstreamArrayCopy(c.upstreamObjects)
+	return c.BlockedRecordTypes
+}
+
+// FindByName searches for a client by name
+// The returned object doesn't contain the settings of the client's group.
+func (clients *clientsContainer) FindByName(name string) (Client, bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[name]
+	if !ok {
+		return Client{}, false
+	}
+	return *c, true
 }
 
 // Find searches for a client by IP (and does not lock anything)
 func (clients *clientsContainer) findByIP(ip string) (Client, bool) {
-	ipAddr := net.ParseIP(ip)
-	if ipAddr == nil {
+	c := clients.findPtrByIP(ip)
+	if c == nil {
 		return Client{}, false
 	}
+	return *c, true
+}
 
+// Find the client object by IP or by client ID (and does not lock anything)
+func (clients *clientsContainer) findPtrByIP(ip string) *Client {
 	c, ok := clients.idIndex[ip]
 	if ok {
-		return *c, true
+		return c
 	}
 
-	for _, c = range clients.list {
-		for _, id := range c.IDs {
-			_, ipnet, err := net.ParseCIDR(id)
-			if err != nil {
-				continue
-			}
-			if ipnet.Contains(ipAddr) {
-				return *c, true
-			}
-		}
+	ipAddr := net.ParseIP(ip)
+	if ipAddr == nil {
+		return nil
 	}
 
-	if clients.dhcpServer == nil {
-		return Client{}, false
+	c = clients.cidrIndex.find(ipAddr)
+	if c != nil {
+		return c
 	}
-	macFound := clients.dhcpServer.FindMACbyIP(ipAddr)
+
+	if !clients.hasMACIDs() {
+		return nil
+	}
+	macFound := clients.findMACbyIP(ipAddr)
 	if macFound == nil {
-		return Client{}, false
+		return nil
 	}
 	for _, c = range clients.list {
 		for _, id := range c.IDs {
@@ -318,12 +486,39 @@ func (clients *clientsContainer) findByIP(ip string) (Client, bool) {
 				continue
 			}
 			if bytes.Equal(hwAddr, macFound) {
-				return *c, true
+				return c
 			}
 		}
 	}
 
-	return Client{}, false
+	return nil
+}
+
+// Return TRUE if there are clients identified by MAC address
+func (clients *clientsContainer) hasMACIDs() bool {
+	for _, c := range clients.list {
+		for _, id := range c.IDs {
+			_, err := net.ParseMAC(id)
+			if err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get MAC address of the client from DHCP leases or from the system neighbor table
+func (clients *clientsContainer) findMACbyIP(ip net.IP) net.HardwareAddr {
+	if clients.dhcpServer != nil {
+		mac := clients.dhcpServer.FindMACbyIP(ip)
+		if mac != nil {
+			return mac
+		}
+	}
+	if clients.neighbors == nil {
+		return nil
+	}
+	return clients.neighbors.find(ip)
 }
 
 // FindAutoClient - search for an auto-client by IP
@@ -360,8 +555,9 @@ func (clients *clientsContainer) check(c *Client) error {
 			continue
 		}
 
-		_, _, err := net.ParseCIDR(id)
+		_, ipnet, err := net.ParseCIDR(id)
 		if err == nil {
+			c.IDs[i] = ipnet.String() // normalize CIDR range
 			continue
 		}
 
@@ -370,6 +566,11 @@ func (clients *clientsContainer) check(c *Client) error {
 			continue
 		}
 
+		err = dnsforward.ValidateClientID(id)
+		if err == nil {
+			continue
+		}
+
 		return fmt.Errorf("Invalid ID: %s", id)
 	}
 
@@ -381,12 +582,22 @@ func (clients *clientsContainer) check(c *Client) error {
 	sort.Strings(c.Tags)
 
 	if len(c.Upstreams) != 0 {
-		err := dnsforward.ValidateUpstreams(c.Upstreams)
+		err := dnsforward.ValidateClientUpstreams(c.Upstreams)
 		if err != nil {
 			return fmt.Errorf("Invalid upstream servers: %s", err)
 		}
 	}
 
+	err := dnsforward.ValidateClientDNSSECMode(c.DNSSECValidation)
+	if err != nil {
+		return err
+	}
+
+	err = dnsforward.ValidateBlockedRecordTypes(c.BlockedRecordTypes)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -407,6 +618,11 @@ func (clients *clientsContainer) Add(c Client) (bool, error) {
 		return false, nil
 	}
 
+	_, ok = clients.groups[c.Group]
+	if len(c.Group) != 0 && !ok {
+		return false, fmt.Errorf("Invalid group: %s", c.Group)
+	}
+
 	// check ID index
 	for _, id := range c.IDs {
 		c2, ok := clients.idIndex[id]
@@ -422,6 +638,7 @@ func (clients *clientsContainer) Add(c Client) (bool, error) {
 	for _, id := range c.IDs {
 		clients.idIndex[id] = &c
 	}
+	clients.updateCIDRIndex()
 
 	log.Debug("Clients: added '%s': ID:%v [%d]", c.Name, c.IDs, len(clients.list))
 	return true, nil
@@ -444,6 +661,7 @@ func (clients *clientsContainer) Del(name string) bool {
 	for _, id := range c.IDs {
 		delete(clients.idIndex, id)
 	}
+	clients.updateCIDRIndex()
 	return true
 }
 
@@ -475,6 +693,11 @@ func (clients *clientsContainer) Update(name string, c Client) error {
 		return fmt.Errorf("Client not found")
 	}
 
+	_, ok = clients.groups[c.Group]
+	if len(c.Group) != 0 && !ok {
+		return fmt.Errorf("Invalid group: %s", c.Group)
+	}
+
 	// check Name index
 	if old.Name != c.Name {
 		_, ok = clients.list[c.Name]
@@ -511,6 +734,7 @@ func (clients *clientsContainer) Update(name string, c Client) error {
 	c.upstreamObjects = nil
 
 	*old = c
+	clients.updateCIDRIndex()
 	return nil
 }
 
@@ -541,6 +765,28 @@ func (clients *clientsContainer) SetWhoisInfo(ip string, info [][]string) {
 	log.Debug("Clients: set WHOIS info for auto-client with IP %s: %v", ip, ch.WhoisInfo)
 }
 
+// SetHWInfo - associate the hardware address and its vendor with an auto-client
+func (clients *clientsContainer) SetHWInfo(ip string, mac net.HardwareAddr, vendor string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok := clients.findByIP(ip)
+	if ok {
+		return
+	}
+
+	ch, ok := clients.ipHost[ip]
+	if !ok {
+		// Create a ClientHost implicitly: its name may be received later from the other sources
+		ch = &ClientHost{
+			Source: ClientSourceWHOIS,
+		}
+		clients.ipHost[ip] = ch
+	}
+	ch.MAC = mac
+	ch.Vendor = vendor
+}
+
 // AddHost adds new IP -> Host pair
 // Use priority of the source (etc/hosts > ARP > rDNS)
 //  so we overwrite existing entries with an equal or higher priority
@@ -557,6 +803,7 @@ func (clients *clientsContainer) addHost(ip, host string, source clientSource) (
 	if ok && ch.Source > source {
 		return false, nil
 	} else if ok {
+		ch.Host = host
 		ch.Source = source
 	} else {
 		ch = &ClientHost{
@@ -582,6 +829,22 @@ func (clients *clientsContainer) rmHosts(source clientSource) int {
 	return n
 }
 
+// Replace all entries of the source with the new IP -> Host pairs
+func (clients *clientsContainer) replaceHosts(source clientSource, hosts map[string]string) int {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_ = clients.rmHosts(source)
+	n := 0
+	for ip, host := range hosts {
+		ok, _ := clients.addHost(ip, host, source)
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
 // Parse system 'hosts' file and fill clients array
 func (clients *clientsContainer) addFromHostsFile() {
 	hostsFn := "/etc/hosts"
@@ -0,0 +1,88 @@
+package home
+
+import (
+	"net"
+)
+
+// cidrNode is a node of a binary prefix tree
+type cidrNode struct {
+	child   [2]*cidrNode
+	clients []*Client // clients whose CIDR ends at this node
+}
+
+// cidrTree is a binary prefix tree for searching clients by CIDR ranges.
+// IPv4 and IPv6 ranges are stored in separate trees.
+type cidrTree struct {
+	root4 *cidrNode
+	root6 *cidrNode
+}
+
+// Return the root node and the IP address in the form suitable for this tree
+func (t *cidrTree) root(ip net.IP, create bool) (*cidrNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if t.root4 == nil && create {
+			t.root4 = &cidrNode{}
+		}
+		return t.root4, ip4
+	}
+
+	if t.root6 == nil && create {
+		t.root6 = &cidrNode{}
+	}
+	return t.root6, ip.To16()
+}
+
+// Get the bit value at the specified position
+func ipBit(ip net.IP, n int) int {
+	return int(ip[n/8]>>(7-uint(n%8))) & 1
+}
+
+// Add a client's CIDR range
+func (t *cidrTree) add(ipnet *net.IPNet, c *Client) {
+	node, ip := t.root(ipnet.IP, true)
+	ones, _ := ipnet.Mask.Size()
+	for i := 0; i != ones; i++ {
+		b := ipBit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = &cidrNode{}
+		}
+		node = node.child[b]
+	}
+	node.clients = append(node.clients, c)
+}
+
+// Find the best client whose CIDR range contains the IP address:
+// . a client with the highest priority wins
+// . if priorities are equal, a client with the longest prefix wins
+func (t *cidrTree) find(ip net.IP) *Client {
+	node, ip := t.root(ip, false)
+	var best *Client
+	for i := 0; node != nil; i++ {
+		for _, c := range node.clients {
+			// ">=" because a node at the deeper level has a longer prefix
+			if best == nil || c.Priority >= best.Priority {
+				best = c
+			}
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.child[ipBit(ip, i)]
+	}
+	return best
+}
+
+// Rebuild the index of clients by CIDR ranges (and does not lock anything)
+func (clients *clientsContainer) updateCIDRIndex() {
+	t := &cidrTree{}
+	for _, c := range clients.list {
+		for _, id := range c.IDs {
+			_, ipnet, err := net.ParseCIDR(id)
+			if err != nil {
+				continue
+			}
+			t.add(ipnet, c)
+		}
+	}
+	clients.cidrIndex = t
+}
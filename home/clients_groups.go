@@ -0,0 +1,256 @@
+package home
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ClientGroup - the settings which are inherited by the member clients
+type ClientGroup struct {
+	Name                string
+	Tags                []string
+	UseOwnSettings      bool // false: the members use global settings
+	FilteringEnabled    bool
+	SafeSearchEnabled   bool
+	SafeBrowsingEnabled bool
+	ParentalEnabled     bool
+
+	UseOwnBlockedServices bool // false: the members use global settings
+	BlockedServices       []string
+
+	Upstreams []string // upstream servers for the members which don't have their own
+
+	// Upstream objects:
+	// nil: not yet initialized
+	// not nil: Upstreams ready to be used (may be empty if the settings are invalid)
+	upstreamObjects *dnsforward.ClientUpstreams
+}
+
+type clientGroupObject struct {
+	Name                string   `yaml:"name"`
+	Tags                []string `yaml:"tags"`
+	UseGlobalSettings   bool     `yaml:"use_global_settings"`
+	FilteringEnabled    bool     `yaml:"filtering_enabled"`
+	ParentalEnabled     bool     `yaml:"parental_enabled"`
+	SafeSearchEnabled   bool     `yaml:"safesearch_enabled"`
+	SafeBrowsingEnabled bool     `yaml:"safebrowsing_enabled"`
+
+	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services"`
+	BlockedServices          []string `yaml:"blocked_services"`
+
+	Upstreams []string `yaml:"upstreams"`
+}
+
+func (clients *clientsContainer) addGroupsFromConfig(objects []clientGroupObject) {
+	for _, gy := range objects {
+		g := ClientGroup{
+			Name:                gy.Name,
+			UseOwnSettings:      !gy.UseGlobalSettings,
+			FilteringEnabled:    gy.FilteringEnabled,
+			ParentalEnabled:     gy.ParentalEnabled,
+			SafeSearchEnabled:   gy.SafeSearchEnabled,
+			SafeBrowsingEnabled: gy.SafeBrowsingEnabled,
+
+			UseOwnBlockedServices: !gy.UseGlobalBlockedServices,
+			BlockedServices:       gy.BlockedServices,
+
+			Upstreams: gy.Upstreams,
+		}
+
+		for _, t := range gy.Tags {
+			if !clients.tagKnown(t) {
+				log.Debug("Clients: skipping unknown tag '%s'", t)
+				continue
+			}
+			g.Tags = append(g.Tags, t)
+		}
+
+		_, err := clients.AddGroup(g)
+		if err != nil {
+			log.Tracef("clientAddGroup: %s", err)
+		}
+	}
+}
+
+// Write the groups configuration (the lock must be held)
+func (clients *clientsContainer) writeGroupsConfig(objects *[]clientGroupObject) {
+	for _, g := range clients.groups {
+		gy := clientGroupObject{
+			Name:                     g.Name,
+			UseGlobalSettings:        !g.UseOwnSettings,
+			FilteringEnabled:         g.FilteringEnabled,
+			ParentalEnabled:          g.ParentalEnabled,
+			SafeSearchEnabled:        g.SafeSearchEnabled,
+			SafeBrowsingEnabled:      g.SafeBrowsingEnabled,
+			UseGlobalBlockedServices: !g.UseOwnBlockedServices,
+		}
+
+		gy.Tags = stringArrayDup(g.Tags)
+		gy.BlockedServices = stringArrayDup(g.BlockedServices)
+		gy.Upstreams = stringArrayDup(g.Upstreams)
+
+		*objects = append(*objects, gy)
+	}
+	sort.Slice(*objects, func(i, j int) bool {
+		return (*objects)[i].Name < (*objects)[j].Name
+	})
+}
+
+// Check if ClientGroup object's fields are correct
+func (clients *clientsContainer) checkGroup(g *ClientGroup) error {
+	if len(g.Name) == 0 {
+		return fmt.Errorf("Invalid Name")
+	}
+
+	for _, t := range g.Tags {
+		if !clients.tagKnown(t) {
+			return fmt.Errorf("Invalid tag: %s", t)
+		}
+	}
+	sort.Strings(g.Tags)
+
+	if len(g.Upstreams) != 0 {
+		err := dnsforward.ValidateClientUpstreams(g.Upstreams)
+		if err != nil {
+			return fmt.Errorf("Invalid upstream servers: %s", err)
+		}
+	}
+	return nil
+}
+
+// AddGroup adds a new group
+// Return true: success;  false: group exists.
+func (clients *clientsContainer) AddGroup(g ClientGroup) (bool, error) {
+	err := clients.checkGroup(&g)
+	if err != nil {
+		return false, err
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok := clients.groups[g.Name]
+	if ok {
+		return false, nil
+	}
+	clients.groups[g.Name] = &g
+
+	log.Debug("Clients: added group '%s' [%d]", g.Name, len(clients.groups))
+	return true, nil
+}
+
+// FindGroup searches for a group by name
+func (clients *clientsContainer) FindGroup(name string) (ClientGroup, bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	g, ok := clients.groups[name]
+	if !ok {
+		return ClientGroup{}, false
+	}
+	return *g, true
+}
+
+// DelGroup removes a group.  The group must not have members.
+func (clients *clientsContainer) DelGroup(name string) error {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok := clients.groups[name]
+	if !ok {
+		return fmt.Errorf("Group not found")
+	}
+
+	for _, c := range clients.list {
+		if c.Group == name {
+			return fmt.Errorf("Group is used by client %s", c.Name)
+		}
+	}
+
+	delete(clients.groups, name)
+	return nil
+}
+
+// UpdateGroup updates a group.  If the group is renamed, its members are moved to the new name.
+func (clients *clientsContainer) UpdateGroup(name string, g ClientGroup) error {
+	err := clients.checkGroup(&g)
+	if err != nil {
+		return err
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	old, ok := clients.groups[name]
+	if !ok {
+		return fmt.Errorf("Group not found")
+	}
+
+	if old.Name != g.Name {
+		_, ok = clients.groups[g.Name]
+		if ok {
+			return fmt.Errorf("Group already exists")
+		}
+
+		delete(clients.groups, old.Name)
+		clients.groups[g.Name] = old
+		for _, c := range clients.list {
+			if c.Group == old.Name {
+				c.Group = g.Name
+			}
+		}
+	}
+
+	// update upstreams cache
+	g.upstreamObjects = nil
+
+	*old = g
+	return nil
+}
+
+// Apply the settings of the client's group: the client inherits the settings which it doesn't override.
+// The tags of the group are added to the client's tags.
+// The lock must be held.
+func (clients *clientsContainer) applyGroup(c *Client) {
+	g, ok := clients.groups[c.Group]
+	if !ok {
+		return
+	}
+
+	if !c.UseOwnSettings && g.UseOwnSettings {
+		c.UseOwnSettings = true
+		c.FilteringEnabled = g.FilteringEnabled
+		c.SafeSearchEnabled = g.SafeSearchEnabled
+		c.SafeBrowsingEnabled = g.SafeBrowsingEnabled
+		c.ParentalEnabled = g.ParentalEnabled
+	}
+
+	if !c.UseOwnBlockedServices && g.UseOwnBlockedServices {
+		c.UseOwnBlockedServices = true
+		c.BlockedServices = stringArrayDup(g.BlockedServices)
+	}
+
+	if len(c.Upstreams) == 0 {
+		c.Upstreams = stringArrayDup(g.Upstreams)
+	}
+
+	for _, t := range g.Tags {
+		if !stringArrayContains(c.Tags, t) {
+			c.Tags = append(c.Tags, t)
+		}
+	}
+	sort.Strings(c.Tags)
+}
+
+// Return TRUE if the array contains the string
+func stringArrayContains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -16,6 +16,32 @@ type clientJSON struct {
 	ParentalEnabled     bool     `json:"parental_enabled"`
 	SafeSearchEnabled   bool     `json:"safesearch_enabled"`
 	SafeBrowsingEnabled bool     `json:"safebrowsing_enabled"`
+	AllowlistOnly       bool     `json:"allowlist_only"`
+	IgnoreQueryLog      bool     `json:"ignore_querylog"`
+	IgnoreStatistics    bool     `json:"ignore_statistics"`
+
+	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
+	BlockedServices          []string `json:"blocked_services"`
+
+	Upstreams []string `json:"upstreams"`
+	Priority  int      `json:"priority"`
+
+	DNSSECValidation string `json:"dnssec_validation"`
+	Ratelimit        uint32 `json:"ratelimit"`
+
+	BlockedRecordTypes []string `json:"blocked_record_types"`
+
+	Group string `json:"group"`
+}
+
+type clientGroupJSON struct {
+	Name                string   `json:"name"`
+	Tags                []string `json:"tags"`
+	UseGlobalSettings   bool     `json:"use_global_settings"`
+	FilteringEnabled    bool     `json:"filtering_enabled"`
+	ParentalEnabled     bool     `json:"parental_enabled"`
+	SafeSearchEnabled   bool     `json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool     `json:"safebrowsing_enabled"`
 
 	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
 	BlockedServices          []string `json:"blocked_services"`
@@ -29,12 +55,16 @@ type clientHostJSON struct {
 	Source string `json:"source"`
 
 	WhoisInfo map[string]interface{} `json:"whois_info"`
+
+	MAC    string `json:"mac,omitempty"`
+	Vendor string `json:"vendor,omitempty"`
 }
 
 type clientListJSON struct {
-	Clients     []clientJSON     `json:"clients"`
-	AutoClients []clientHostJSON `json:"auto_clients"`
-	Tags        []string         `json:"supported_tags"`
+	Clients     []clientJSON      `json:"clients"`
+	AutoClients []clientHostJSON  `json:"auto_clients"`
+	Groups      []clientGroupJSON `json:"groups"`
+	Tags        []string          `json:"supported_tags"`
 }
 
 // respond with information about configured clients
@@ -58,8 +88,14 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http
 			cj.Source = "DHCP"
 		case ClientSourceRDNS:
 			cj.Source = "rDNS"
+		case ClientSourceMDNS:
+			cj.Source = "mDNS"
+		case ClientSourceNetBIOS:
+			cj.Source = "NetBIOS"
 		case ClientSourceARP:
 			cj.Source = "ARP"
+		case ClientSourceVPN:
+			cj.Source = "VPN"
 		case ClientSourceWHOIS:
 			cj.Source = "WHOIS"
 		}
@@ -68,9 +104,16 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http
 		for _, wi := range ch.WhoisInfo {
 			cj.WhoisInfo[wi[0]] = wi[1]
 		}
+		if ch.MAC != nil {
+			cj.MAC = ch.MAC.String()
+		}
+		cj.Vendor = ch.Vendor
 
 		data.AutoClients = append(data.AutoClients, cj)
 	}
+	for _, g := range clients.groups {
+		data.Groups = append(data.Groups, groupToJSON(g))
+	}
 	clients.lock.Unlock()
 
 	data.Tags = clientTags
@@ -94,11 +137,22 @@ func jsonToClient(cj clientJSON) (*Client, error) {
 		ParentalEnabled:     cj.ParentalEnabled,
 		SafeSearchEnabled:   cj.SafeSearchEnabled,
 		SafeBrowsingEnabled: cj.SafeBrowsingEnabled,
+		AllowlistOnly:       cj.AllowlistOnly,
+		IgnoreQueryLog:      cj.IgnoreQueryLog,
+		IgnoreStatistics:    cj.IgnoreStatistics,
 
 		UseOwnBlockedServices: !cj.UseGlobalBlockedServices,
 		BlockedServices:       cj.BlockedServices,
 
 		Upstreams: cj.Upstreams,
+		Priority:  cj.Priority,
+
+		DNSSECValidation: cj.DNSSECValidation,
+		Ratelimit:        cj.Ratelimit,
+
+		BlockedRecordTypes: cj.BlockedRecordTypes,
+
+		Group: cj.Group,
 	}
 	return &c, nil
 }
@@ -114,19 +168,69 @@ func clientToJSON(c *Client) clientJSON {
 		ParentalEnabled:     c.ParentalEnabled,
 		SafeSearchEnabled:   c.SafeSearchEnabled,
 		SafeBrowsingEnabled: c.SafeBrowsingEnabled,
+		AllowlistOnly:       c.AllowlistOnly,
+		IgnoreQueryLog:      c.IgnoreQueryLog,
+		IgnoreStatistics:    c.IgnoreStatistics,
 
 		UseGlobalBlockedServices: !c.UseOwnBlockedServices,
 		BlockedServices:          c.BlockedServices,
 
 		Upstreams: c.Upstreams,
+		Priority:  c.Priority,
+
+		DNSSECValidation: c.DNSSECValidation,
+		Ratelimit:        c.Ratelimit,
+
+		BlockedRecordTypes: c.BlockedRecordTypes,
+
+		Group: c.Group,
 	}
 	return cj
 }
 
+// Convert JSON object to ClientGroup object
+func jsonToGroup(gj clientGroupJSON) *ClientGroup {
+	return &ClientGroup{
+		Name:                gj.Name,
+		Tags:                gj.Tags,
+		UseOwnSettings:      !gj.UseGlobalSettings,
+		FilteringEnabled:    gj.FilteringEnabled,
+		ParentalEnabled:     gj.ParentalEnabled,
+		SafeSearchEnabled:   gj.SafeSearchEnabled,
+		SafeBrowsingEnabled: gj.SafeBrowsingEnabled,
+
+		UseOwnBlockedServices: !gj.UseGlobalBlockedServices,
+		BlockedServices:       gj.BlockedServices,
+
+		Upstreams: gj.Upstreams,
+	}
+}
+
+// Convert ClientGroup object to JSON
+func groupToJSON(g *ClientGroup) clientGroupJSON {
+	return clientGroupJSON{
+		Name:                g.Name,
+		Tags:                g.Tags,
+		UseGlobalSettings:   !g.UseOwnSettings,
+		FilteringEnabled:    g.FilteringEnabled,
+		ParentalEnabled:     g.ParentalEnabled,
+		SafeSearchEnabled:   g.SafeSearchEnabled,
+		SafeBrowsingEnabled: g.SafeBrowsingEnabled,
+
+		UseGlobalBlockedServices: !g.UseOwnBlockedServices,
+		BlockedServices:          g.BlockedServices,
+
+		Upstreams: g.Upstreams,
+	}
+}
+
 type clientHostJSONWithID struct {
 	IDs       []string               `json:"ids"`
 	Name      string                 `json:"name"`
 	WhoisInfo map[string]interface{} `json:"whois_info"`
+
+	MAC    string `json:"mac,omitempty"`
+	Vendor string `json:"vendor,omitempty"`
 }
 
 // Convert ClientHost object to JSON
@@ -140,6 +244,10 @@ func clientHostToJSON(ip string, ch ClientHost) clientHostJSONWithID {
 	for _, wi := range ch.WhoisInfo {
 		cj.WhoisInfo[wi[0]] = wi[1]
 	}
+	if ch.MAC != nil {
+		cj.MAC = ch.MAC.String()
+	}
+	cj.Vendor = ch.Vendor
 	return cj
 }
 
@@ -223,13 +331,117 @@ func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *ht
 		return
 	}
 
-	c, err := jsonToClient(dj.Data)
+	var c *Client
+	u := requestParent(r)
+	if u != nil {
+		// a parent may change only the blocked services of the assigned clients
+		old, ok := clients.FindByName(dj.Name)
+		if !ok {
+			httpError(w, http.StatusBadRequest, "Client not found")
+			return
+		}
+		if !u.managesClient(old.Name, old.Group) {
+			httpError(w, http.StatusForbidden, "Access to client %s is denied", old.Name)
+			return
+		}
+		old.UseOwnBlockedServices = !dj.Data.UseGlobalBlockedServices
+		old.BlockedServices = dj.Data.BlockedServices
+		c = &old
+
+	} else {
+		c, err = jsonToClient(dj.Data)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+
+	err = clients.Update(dj.Name, *c)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "%s", err)
 		return
 	}
 
-	err = clients.Update(dj.Name, *c)
+	onConfigModified()
+}
+
+// Add a new group
+func (clients *clientsContainer) handleAddGroup(w http.ResponseWriter, r *http.Request) {
+	gj := clientGroupJSON{}
+	err := json.NewDecoder(r.Body).Decode(&gj)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+
+	ok, err := clients.AddGroup(*jsonToGroup(gj))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if !ok {
+		httpError(w, http.StatusBadRequest, "Group already exists")
+		return
+	}
+
+	onConfigModified()
+}
+
+// Remove group
+func (clients *clientsContainer) handleDelGroup(w http.ResponseWriter, r *http.Request) {
+	gj := clientGroupJSON{}
+	err := json.NewDecoder(r.Body).Decode(&gj)
+	if err != nil || len(gj.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+
+	err = clients.DelGroup(gj.Name)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	onConfigModified()
+}
+
+type updateGroupJSON struct {
+	Name string          `json:"name"`
+	Data clientGroupJSON `json:"data"`
+}
+
+// Update group's properties
+func (clients *clientsContainer) handleUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	var dj updateGroupJSON
+	err := json.NewDecoder(r.Body).Decode(&dj)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "JSON parse: %s", err)
+		return
+	}
+	if len(dj.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	g := jsonToGroup(dj.Data)
+	u := requestParent(r)
+	if u != nil {
+		// a parent may change only the blocked services of the assigned groups
+		old, ok := clients.FindGroup(dj.Name)
+		if !ok {
+			httpError(w, http.StatusBadRequest, "Group not found")
+			return
+		}
+		if !stringArrayContains(u.Groups, old.Name) {
+			httpError(w, http.StatusForbidden, "Access to group %s is denied", old.Name)
+			return
+		}
+		old.UseOwnBlockedServices = !dj.Data.UseGlobalBlockedServices
+		old.BlockedServices = dj.Data.BlockedServices
+		g = &old
+	}
+
+	err = clients.UpdateGroup(dj.Name, *g)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "%s", err)
 		return
@@ -284,4 +496,7 @@ func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister("POST", "/control/clients/delete", clients.handleDelClient)
 	httpRegister("POST", "/control/clients/update", clients.handleUpdateClient)
 	httpRegister("GET", "/control/clients/find", clients.handleFindClient)
+	httpRegister("POST", "/control/clients/groups/add", clients.handleAddGroup)
+	httpRegister("POST", "/control/clients/groups/delete", clients.handleDelGroup)
+	httpRegister("POST", "/control/clients/groups/update", clients.handleUpdateGroup)
 }
@@ -18,7 +18,7 @@ func TestClients(t *testing.T) {
 	clients := clientsContainer{}
 	clients.testing = true
 
-	clients.Init(nil, nil)
+	clients.Init(nil, nil, nil)
 
 	// add
 	c = Client{
@@ -156,7 +156,7 @@ func TestClientsWhois(t *testing.T) {
 	var c Client
 	clients := clientsContainer{}
 	clients.testing = true
-	clients.Init(nil, nil)
+	clients.Init(nil, nil, nil)
 
 	whois := [][]string{{"orgname", "orgname-val"}, {"country", "country-val"}}
 	// set whois info on new client
@@ -179,11 +179,37 @@ func TestClientsWhois(t *testing.T) {
 	_ = clients.Del("client1")
 }
 
+func TestClientsHWInfo(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	mac, _ := net.ParseMAC("00:1a:11:aa:bb:cc")
+	clients.SetHWInfo("1.1.1.1", mac, "Google, Inc.")
+	ch, ok := clients.FindAutoClient("1.1.1.1")
+	assert.True(t, ok)
+	assert.Equal(t, "", ch.Host)
+	assert.Equal(t, "Google, Inc.", ch.Vendor)
+
+	// the name is received later: the hardware info is kept
+	ok, _ = clients.AddHost("1.1.1.1", "android-1", ClientSourceNetBIOS)
+	assert.True(t, ok)
+	ch, _ = clients.FindAutoClient("1.1.1.1")
+	assert.Equal(t, "android-1", ch.Host)
+	assert.Equal(t, mac, ch.MAC)
+
+	// a name from the source with a lower priority is ignored
+	ok, _ = clients.AddHost("1.1.1.1", "host", ClientSourceRDNS)
+	assert.False(t, ok)
+	assert.True(t, clients.Exists("1.1.1.1", ClientSourceNetBIOS))
+	assert.False(t, clients.Exists("1.1.1.1", ClientSourceMDNS))
+}
+
 func TestClientsAddExisting(t *testing.T) {
 	var c Client
 	clients := clientsContainer{}
 	clients.testing = true
-	clients.Init(nil, nil)
+	clients.Init(nil, nil, nil)
 
 	// some test variables
 	mac, _ := net.ParseMAC("aa:aa:aa:aa:aa:aa")
@@ -236,3 +262,181 @@ func TestClientsAddExisting(t *testing.T) {
 	assert.True(t, ok)
 	assert.Nil(t, err)
 }
+
+func TestClientsCIDR(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(Client{IDs: []string{"10.0.0.0/8"}, Name: "all"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.Add(Client{IDs: []string{"10.1.0.0/16"}, Name: "vlan"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.Add(Client{IDs: []string{"10.1.1.1"}, Name: "device"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.Add(Client{IDs: []string{"fd00::/8"}, Name: "ula"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// the longest prefix wins
+	c, ok := clients.Find("10.2.0.1")
+	assert.True(t, ok && c.Name == "all")
+	c, ok = clients.Find("10.1.0.1")
+	assert.True(t, ok && c.Name == "vlan")
+	c, ok = clients.Find("10.1.1.1")
+	assert.True(t, ok && c.Name == "device")
+	c, ok = clients.Find("fd00::1")
+	assert.True(t, ok && c.Name == "ula")
+	_, ok = clients.Find("11.0.0.1")
+	assert.False(t, ok)
+
+	// the highest priority wins
+	assert.Nil(t, clients.Update("all", Client{IDs: []string{"10.0.0.0/8"}, Name: "all", Priority: 1}))
+	c, ok = clients.Find("10.1.0.1")
+	assert.True(t, ok && c.Name == "all")
+
+	// exact match always wins
+	c, ok = clients.Find("10.1.1.1")
+	assert.True(t, ok && c.Name == "device")
+
+	// CIDR ranges are normalized
+	_, err = clients.Add(Client{IDs: []string{"10.1.2.3/16"}, Name: "vlan2"})
+	assert.NotNil(t, err)
+
+	assert.True(t, clients.Del("all"))
+	_, ok = clients.Find("10.2.0.1")
+	assert.False(t, ok)
+}
+
+func TestClientsClientID(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(Client{IDs: []string{"kids-tablet", "1.1.1.1"}, Name: "tablet"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	c, ok := clients.Find("kids-tablet")
+	assert.True(t, ok && c.Name == "tablet")
+	c, ok = clients.Find("1.1.1.1")
+	assert.True(t, ok && c.Name == "tablet")
+	_, ok = clients.Find("phone")
+	assert.False(t, ok)
+
+	_, err = clients.Add(Client{IDs: []string{"Kids_Tablet"}, Name: "invalid"})
+	assert.NotNil(t, err)
+}
+
+func TestClientsUpstreams(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "laptop", Upstreams: []string{"[/corp.example/]10.0.0.1"}})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.Add(Client{IDs: []string{"2.2.2.2"}, Name: "phone"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	_, err = clients.Add(Client{IDs: []string{"3.3.3.3"}, Name: "tv", Upstreams: []string{"bad://1.1.1.1"}})
+	assert.NotNil(t, err)
+
+	// the upstream objects are created once
+	u := clients.FindUpstreams("1.1.1.1")
+	assert.NotNil(t, u)
+	assert.True(t, u == clients.FindUpstreams("1.1.1.1"))
+	assert.Nil(t, clients.FindUpstreams("2.2.2.2"))
+
+	// ... and re-created when the settings are changed
+	assert.Nil(t, clients.Update("laptop", Client{IDs: []string{"1.1.1.1"}, Name: "laptop", Upstreams: []string{"1.0.0.1"}}))
+	assert.False(t, u == clients.FindUpstreams("1.1.1.1"))
+}
+
+func TestClientGroups(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.AddGroup(ClientGroup{
+		Name:                  "Kids",
+		Tags:                  []string{"user_child"},
+		UseOwnSettings:        true,
+		ParentalEnabled:       true,
+		SafeSearchEnabled:     true,
+		UseOwnBlockedServices: true,
+		BlockedServices:       []string{"tiktok"},
+	})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// unknown group
+	_, err = clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "tablet", Group: "IoT"})
+	assert.NotNil(t, err)
+
+	// the settings are inherited from the group
+	ok, err = clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "tablet", Group: "Kids", Tags: []string{"device_tablet"}})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	c, ok := clients.Find("1.1.1.1")
+	assert.True(t, ok)
+	assert.True(t, c.UseOwnSettings)
+	assert.True(t, c.ParentalEnabled)
+	assert.True(t, c.SafeSearchEnabled)
+	assert.Equal(t, []string{"tiktok"}, c.BlockedServices)
+	assert.Equal(t, []string{"device_tablet", "user_child"}, c.Tags)
+
+	// the client's own settings override the group settings
+	ok, _ = clients.Add(Client{IDs: []string{"1.1.1.2"}, Name: "laptop", Group: "Kids", UseOwnSettings: true, FilteringEnabled: true})
+	assert.True(t, ok)
+	c, _ = clients.Find("1.1.1.2")
+	assert.True(t, c.FilteringEnabled)
+	assert.False(t, c.ParentalEnabled)
+	assert.Equal(t, []string{"tiktok"}, c.BlockedServices)
+
+	// the group has members
+	assert.NotNil(t, clients.DelGroup("Kids"))
+
+	// the members are moved to the renamed group
+	assert.Nil(t, clients.UpdateGroup("Kids", ClientGroup{Name: "Children"}))
+	c, _ = clients.Find("1.1.1.1")
+	assert.Equal(t, "Children", c.Group)
+	assert.False(t, c.UseOwnSettings)
+	assert.Equal(t, []string{"device_tablet"}, c.Tags)
+
+	var objects []clientObject
+	var groups []clientGroupObject
+	clients.WriteDiskConfig(&objects, &groups)
+	assert.Equal(t, 1, len(groups))
+	assert.Equal(t, "Children", groups[0].Name)
+
+	assert.True(t, clients.Del("tablet"))
+	assert.True(t, clients.Del("laptop"))
+	assert.Nil(t, clients.DelGroup("Children"))
+}
+
+func TestClientsNeighborMAC(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+	clients.neighbors = &neighborCache{
+		table:   map[string]net.HardwareAddr{"192.168.1.57": {0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}},
+		updated: time.Now(),
+		read:    func() []arpEntry { return nil },
+	}
+
+	ok, err := clients.Add(Client{IDs: []string{"aa:aa:aa:aa:aa:aa"}, Name: "phone"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// the client is found by the MAC address from the neighbor table
+	c, ok := clients.Find("192.168.1.57")
+	assert.True(t, ok)
+	assert.Equal(t, "phone", c.Name)
+
+	_, ok = clients.Find("192.168.1.58")
+	assert.False(t, ok)
+}
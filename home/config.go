@@ -25,10 +25,14 @@ const (
 
 // logSettings
 type logSettings struct {
-	LogFile string `yaml:"log_file"` // Path to the log file. If empty, write to stdout. If "syslog", writes to syslog
-	Verbose bool   `yaml:"verbose"`  // If true, verbose logging is enabled
+	LogFile    string `yaml:"log_file"`    // Path to the log file. If empty, write to stdout. If "syslog", writes to syslog
+	Verbose    bool   `yaml:"verbose"`     // If true, verbose logging is enabled
+	LogFormat  string `yaml:"log_format"`  // "text" (or empty) or "json"
+	LogQueries bool   `yaml:"log_queries"` // If true, the result of every DNS query is logged
 }
 
+const logFormatJSON = "json"
+
 // HTTPSServer - HTTPS Server
 type HTTPSServer struct {
 	server     *http.Server
@@ -54,18 +58,58 @@ type configuration struct {
 	Language     string `yaml:"language"`      // two-letter ISO 639-1 language code
 	RlimitNoFile uint   `yaml:"rlimit_nofile"` // Maximum number of opened fd's per process (0: default)
 
+	// API tokens for automation.  Only the hashes of the tokens are stored.
+	APITokens []APIToken `yaml:"api_tokens"`
+
 	// TTL for a web session (in hours)
 	// An active session is automatically refreshed once a day.
 	WebSessionTTLHours uint32 `yaml:"web_session_ttl"`
 
+	// Brute-force protection: the number of failed login attempts from an IP address before it's blocked,
+	// and the time it's blocked for (in minutes).  The block time is doubled after each block.
+	AuthAttempts uint32 `yaml:"auth_attempts"`  // 0: default (5)
+	AuthBlockMin uint32 `yaml:"block_auth_min"` // 0: default (15)
+
 	DNS       dnsConfig          `yaml:"dns"`
 	TLS       tlsConfig          `yaml:"tls"`
 	Filters   []filter           `yaml:"filters"`
 	UserRules []string           `yaml:"user_rules"`
 	DHCP      dhcpd.ServerConfig `yaml:"dhcp"`
 
-	// Note: this array is filled only before file read/write and then it's cleared
-	Clients []clientObject `yaml:"clients"`
+	// User rules which are removed automatically at the specified time
+	UserRulesExpiry []dnsfilter.RuleExpiry `yaml:"user_rules_expiry"`
+
+	// Built-in web server which shows a "blocked" page.
+	// Requests must be redirected to our IP address with "custom_ip" blocking mode.
+	BlockPage blockPageConfig `yaml:"block_page"`
+
+	// Note: these arrays are filled only before file read/write and then they're cleared
+	Clients      []clientObject      `yaml:"clients"`
+	ClientGroups []clientGroupObject `yaml:"client_groups"`
+
+	// Find the active hosts in the local network and identify them
+	Discovery discoveryConfig `yaml:"client_discovery"`
+
+	// Get the names of VPN clients from WireGuard configuration and Tailscale API
+	VPN vpnConfig `yaml:"vpn_clients"`
+
+	// Obtain and renew TLS certificate automatically
+	ACME acmeConfig `yaml:"acme"`
+
+	// Pull the settings from the primary instance
+	Sync syncConfig `yaml:"sync"`
+
+	// Share a virtual IP address and DHCP leases with another instance
+	HA haConfig `yaml:"ha"`
+
+	// Send webhooks and MQTT messages on events
+	Notifications notifyConfig `yaml:"notifications"`
+
+	// Extend the DNS request processing with custom logic
+	Plugins []pluginConfig `yaml:"plugins"`
+
+	// Encryption of the secrets in this file
+	Secrets secretsConfig `yaml:"secrets"`
 
 	logSettings `yaml:",inline"`
 
@@ -82,19 +126,52 @@ type dnsConfig struct {
 	// time interval for statistics (in days)
 	StatsInterval uint32 `yaml:"statistics_interval"`
 
+	// time to keep the daily (in days) and monthly (in months) statistics for.  0: disabled
+	StatsDailyRetention   uint32 `yaml:"statistics_daily_retention"`
+	StatsMonthlyRetention uint32 `yaml:"statistics_monthly_retention"`
+
+	// push the statistics counters to InfluxDB ("http://host:8086/write?db=adguard") or Graphite ("tcp://host:2003")
+	StatsPushURL         string `yaml:"statistics_push_url"`
+	StatsPushInterval    uint32 `yaml:"statistics_push_interval"`    // in seconds
+	StatsPushMeasurement string `yaml:"statistics_push_measurement"` // InfluxDB measurement name or Graphite metric prefix
+
 	QueryLogEnabled  bool   `yaml:"querylog_enabled"`  // if true, query log is enabled
 	QueryLogInterval uint32 `yaml:"querylog_interval"` // time interval for query log (in days)
 	QueryLogMemSize  uint32 `yaml:"querylog_memsize"`  // number of entries kept in memory before they are flushed to disk
 
+	// Query log storage: "file" (or empty), "sqlite", "postgres" or "clickhouse"
+	QueryLogBackend    string `yaml:"querylog_backend"`
+	QueryLogBackendURL string `yaml:"querylog_backend_url"` // database location (see querylog.Config)
+
+	// Mirror query log entries to a syslog server and/or an HTTP webhook (see querylog.Config)
+	QueryLogSyslogURL  string `yaml:"querylog_syslog_url"`
+	QueryLogWebhookURL string `yaml:"querylog_webhook_url"`
+
+	QueryLogMaxSize     uint32 `yaml:"querylog_max_size"`    // size limit (in MB) for all query log files.  0: unlimited
+	QueryLogCompression string `yaml:"querylog_compression"` // compression of the rotated query log files: "", "gzip" or "zstd"
+
+	// Query log privacy settings (see querylog.Config)
+	QueryLogAnonymizeClientIP string `yaml:"querylog_anonymize_client_ip"`
+	QueryLogHashClientIP      bool   `yaml:"querylog_hash_client_ip"`
+	QueryLogBlockedOnly       bool   `yaml:"querylog_blocked_only"`
+
 	dnsforward.FilteringConfig `yaml:",inline"`
 
 	FilteringEnabled           bool             `yaml:"filtering_enabled"`       // whether or not use filter lists
 	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"` // time period to update filters (in hours)
 	DnsfilterConf              dnsfilter.Config `yaml:",inline"`
 
+	// Outbound proxy for downloading filter lists: "http://[user:password@]host:port" or "socks5://host:port".
+	// "": direct connection
+	// Host names are resolved via the upstream servers anyway (see customDialContext()).
+	FiltersProxyURL string `yaml:"filters_proxy_url"`
+
 	// Names of services to block (globally).
 	// Per-client settings can override this configuration.
 	BlockedServices []string `yaml:"blocked_services"`
+
+	// Estimate the time spent by clients on social networks, video and gaming services
+	ActivityEnabled bool `yaml:"activity_enabled"`
 }
 
 type tlsConfigSettings struct {
@@ -104,6 +181,12 @@ type tlsConfigSettings struct {
 	PortHTTPS      int    `yaml:"port_https" json:"port_https,omitempty"`               // HTTPS port. If 0, HTTPS will be disabled
 	PortDNSOverTLS int    `yaml:"port_dns_over_tls" json:"port_dns_over_tls,omitempty"` // DNS-over-TLS port. If 0, DOT will be disabled
 
+	// DNS-over-QUIC port (UDP). If 0, DOQ will be disabled
+	PortDNSOverQUIC int `yaml:"port_dns_over_quic" json:"port_dns_over_quic"`
+
+	// HTTP/3 port (UDP) for HTTPS server and DNS-over-HTTPS.  It's advertised via Alt-Svc header.  If 0, HTTP/3 will be disabled
+	PortHTTP3 int `yaml:"port_https_http3" json:"port_https_http3"`
+
 	// Allow DOH queries via unencrypted HTTP (e.g. for reverse proxying)
 	AllowUnencryptedDOH bool `yaml:"allow_unencrypted_doh" json:"allow_unencrypted_doh"`
 
@@ -145,6 +228,12 @@ var config = configuration{
 		BindHost:      "0.0.0.0",
 		Port:          53,
 		StatsInterval: 1,
+
+		StatsDailyRetention:   365,
+		StatsMonthlyRetention: 60,
+		StatsPushInterval:     60,
+		StatsPushMeasurement:  "adguardhome",
+
 		FilteringConfig: dnsforward.FilteringConfig{
 			ProtectionEnabled:  true,      // whether or not use any of dnsfilter features
 			BlockingMode:       "default", // mode how to answer filtered requests
@@ -163,8 +252,21 @@ var config = configuration{
 		},
 	},
 	DHCP: dhcpd.ServerConfig{
-		LeaseDuration: 86400,
-		ICMPTimeout:   1000,
+		LeaseDuration:   86400,
+		ICMPTimeout:     1000,
+		LocalDomainName: "lan",
+	},
+	BlockPage: blockPageConfig{
+		BindHost: "0.0.0.0",
+		Port:     blockPageDefaultPort,
+	},
+	Discovery: discoveryConfig{
+		Interval: discoveryDefaultInterval,
+		MDNS:     true,
+		NetBIOS:  true,
+	},
+	VPN: vpnConfig{
+		Interval: vpnDefaultInterval,
 	},
 	SchemaVersion: currentSchemaVersion,
 }
@@ -182,6 +284,9 @@ func initConfig() {
 	config.DNS.DnsfilterConf.SafeSearchCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.ParentalCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.CacheTime = 30
+	config.DNS.DnsfilterConf.ResultCacheSize = 10000
+	config.DNS.DnsfilterConf.VerdictTimeout = 1000
+	config.DNS.DnsfilterConf.VerdictCacheSize = 1 * 1024 * 1024
 	config.Filters = defaultFilters()
 }
 
@@ -204,7 +309,7 @@ func (c *configuration) getConfigFilename() string {
 // we do it in a separate method in order to configure logger before the actual configuration is parsed and applied.
 func getLogSettings() logSettings {
 	l := logSettings{}
-	yamlFile, err := readConfigFile()
+	yamlFile, err := readConfigWithOverrides()
 	if err != nil {
 		return l
 	}
@@ -219,8 +324,18 @@ func getLogSettings() logSettings {
 func parseConfig() error {
 	configFile := config.getConfigFilename()
 	log.Debug("Reading config file: %s", configFile)
-	yamlFile, err := readConfigFile()
+	err := checkDefaultConfigOverrides()
 	if err != nil {
+		log.Error("%s", err)
+		return err
+	}
+	v := validateConfigFile()
+	if !logConfigValidation(v) {
+		return v.err()
+	}
+	yamlFile, err := readConfigWithOverrides()
+	if err != nil {
+		log.Error("%s", err)
 		return err
 	}
 	config.fileData = nil
@@ -263,16 +378,22 @@ func (c *configuration) write() error {
 	c.Lock()
 	defer c.Unlock()
 
-	Context.clients.WriteDiskConfig(&config.Clients)
+	Context.clients.WriteDiskConfig(&config.Clients, &config.ClientGroups)
 
 	if Context.auth != nil {
 		config.Users = Context.auth.GetUsers()
+		config.APITokens = Context.auth.GetTokens()
 	}
 
 	if Context.stats != nil {
 		sdc := stats.DiskConfig{}
 		Context.stats.WriteDiskConfig(&sdc)
 		config.DNS.StatsInterval = sdc.Interval
+		config.DNS.StatsDailyRetention = sdc.DailyRetention
+		config.DNS.StatsMonthlyRetention = sdc.MonthlyRetention
+		config.DNS.StatsPushURL = sdc.PushURL
+		config.DNS.StatsPushInterval = sdc.PushInterval
+		config.DNS.StatsPushMeasurement = sdc.PushMeasurement
 	}
 
 	if Context.queryLog != nil {
@@ -281,6 +402,15 @@ func (c *configuration) write() error {
 		config.DNS.QueryLogEnabled = dc.Enabled
 		config.DNS.QueryLogInterval = dc.Interval
 		config.DNS.QueryLogMemSize = dc.MemSize
+		config.DNS.QueryLogBackend = dc.Backend
+		config.DNS.QueryLogBackendURL = dc.BackendURL
+		config.DNS.QueryLogSyslogURL = dc.SyslogURL
+		config.DNS.QueryLogWebhookURL = dc.WebhookURL
+		config.DNS.QueryLogMaxSize = dc.MaxSize
+		config.DNS.QueryLogCompression = dc.Compression
+		config.DNS.QueryLogAnonymizeClientIP = dc.AnonymizeClientIP
+		config.DNS.QueryLogHashClientIP = dc.HashClientIP
+		config.DNS.QueryLogBlockedOnly = dc.BlockedOnly
 	}
 
 	if Context.dnsFilter != nil {
@@ -305,10 +435,25 @@ func (c *configuration) write() error {
 	log.Debug("Writing YAML file: %s", configFile)
 	yamlText, err := yaml.Marshal(&config)
 	config.Clients = nil
+	config.ClientGroups = nil
 	if err != nil {
 		log.Error("Couldn't generate YAML file: %s", err)
 		return err
 	}
+	if Context.configReadOnly {
+		log.Debug("The config file is read-only: the changes are kept until restart")
+		return nil
+	}
+	yamlText, err = encryptConfigSecrets(yamlText, config.Secrets)
+	if err != nil {
+		log.Error("Couldn't encrypt the secrets: %s", err)
+		return err
+	}
+	yamlText, err = restoreOverriddenSettings(yamlText, configFile)
+	if err != nil {
+		log.Error("Couldn't restore the overridden settings: %s", err)
+		return err
+	}
 	err = file.SafeWrite(configFile, yamlText)
 	if err != nil {
 		log.Error("Couldn't save YAML config: %s", err)
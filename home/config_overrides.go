@@ -0,0 +1,321 @@
+// Overriding the settings from the configuration file via environment variables and command-line arguments
+
+package home
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	configEnvPrefix    = "AGH_" // environment variables which override the settings: AGH_DNS__PORT=53
+	configEnvSeparator = "__"   // separates the levels of the setting path in the name of environment variable
+)
+
+// configOverride is a setting which overrides the value from the configuration file
+type configOverride struct {
+	path   []string    // "dns", "upstream_dns"
+	value  interface{} // parsed YAML value
+	source string      // environment variable or command-line argument (for log messages)
+
+	// the override is set by environment variable.
+	// Other programs may use the same prefix, so the unknown environment variables are ignored.
+	fromEnv bool
+	err     error // the value of environment variable can't be parsed (reported only if the setting is known)
+}
+
+func (o configOverride) String() string {
+	return strings.Join(o.path, ".")
+}
+
+// Parse the value of the setting as YAML, so any setting (including lists and objects) may be overridden
+func parseConfigOverride(path []string, value, source string) (configOverride, error) {
+	o := configOverride{path: path, source: source}
+	for _, p := range path {
+		if len(p) == 0 {
+			return o, fmt.Errorf("%s: invalid setting path", source)
+		}
+	}
+	err := yaml.Unmarshal([]byte(value), &o.value)
+	if err != nil {
+		return o, fmt.Errorf("%s: invalid value: %s", source, err)
+	}
+	return o, nil
+}
+
+// Get the overrides from the environment variables ("AGH_DNS__UPSTREAM_DNS=[1.1.1.1, 8.8.8.8]")
+// and from "--set PATH=VALUE" command-line arguments ("dns.upstream_dns=[1.1.1.1, 8.8.8.8]").
+// The command-line arguments are applied after the environment variables.
+func getConfigOverrides(environ []string, args []string) ([]configOverride, error) {
+	overrides := []configOverride{}
+
+	env := []string{}
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, configEnvPrefix) {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		name := kv[:i]
+		path := strings.Split(strings.ToLower(name[len(configEnvPrefix):]), configEnvSeparator)
+		o, err := parseConfigOverride(path, kv[i+1:], name)
+		o.fromEnv = true
+		o.err = err
+		overrides = append(overrides, o)
+	}
+
+	for _, arg := range args {
+		i := strings.IndexByte(arg, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("--set %s: expected PATH=VALUE", arg)
+		}
+		o, err := parseConfigOverride(strings.Split(arg[:i], "."), arg[i+1:], "--set "+arg[:i])
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// Find the value at path in the YAML document
+func getYAMLPath(node interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return node, true
+	}
+
+	switch n := node.(type) {
+	case yaml.MapSlice:
+		for _, it := range n {
+			if fmt.Sprint(it.Key) == path[0] {
+				return getYAMLPath(it.Value, path[1:])
+			}
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err == nil && i >= 0 && i < len(n) {
+			return getYAMLPath(n[i], path[1:])
+		}
+	}
+	return nil, false
+}
+
+// Set the value at path in the YAML document.  The missing mappings are created.
+// The elements of lists are addressed by their index: "filters.0.enabled".
+func setYAMLPath(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	switch n := node.(type) {
+	case nil:
+		v, err := setYAMLPath(nil, path[1:], value)
+		return yaml.MapSlice{yaml.MapItem{Key: path[0], Value: v}}, err
+
+	case yaml.MapSlice:
+		for i := range n {
+			if fmt.Sprint(n[i].Key) == path[0] {
+				v, err := setYAMLPath(n[i].Value, path[1:], value)
+				n[i].Value = v
+				return n, err
+			}
+		}
+		v, err := setYAMLPath(nil, path[1:], value)
+		return append(n, yaml.MapItem{Key: path[0], Value: v}), err
+
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(n) {
+			return n, fmt.Errorf("%s: invalid list index", path[0])
+		}
+		v, err := setYAMLPath(n[i], path[1:], value)
+		n[i] = v
+		return n, err
+	}
+	return node, fmt.Errorf("%s: the parent setting is not an object", path[0])
+}
+
+// Remove the value at path from the YAML document
+func deleteYAMLPath(node interface{}, path []string) interface{} {
+	switch n := node.(type) {
+	case yaml.MapSlice:
+		for i := range n {
+			if fmt.Sprint(n[i].Key) != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				return append(n[:i], n[i+1:]...)
+			}
+			n[i].Value = deleteYAMLPath(n[i].Value, path[1:])
+			return n
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err == nil && i >= 0 && i < len(n) && len(path) > 1 {
+			n[i] = deleteYAMLPath(n[i], path[1:])
+		}
+	}
+	return node
+}
+
+// Return TRUE if the overridden setting exists
+// known is the YAML document with all settings (the default configuration).
+// The keys of the empty objects aren't checked: they are set by user (e.g. "dns.upstream_weights").
+func isKnownSetting(known interface{}, path []string) bool {
+	node := known
+	for _, p := range path {
+		if len(p) == 0 {
+			return false
+		}
+		m, ok := node.(yaml.MapSlice)
+		if !ok || len(m) == 0 {
+			break
+		}
+		node, ok = getYAMLPath(m, []string{p})
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that the overridden settings exist.
+// The unknown settings from command-line arguments are errors,
+// the unknown environment variables are ignored with a warning.
+// Return the overrides which must be applied.
+func checkConfigOverrides(known interface{}, overrides []configOverride) ([]configOverride, error) {
+	list := []configOverride{}
+	for _, o := range overrides {
+		if !isKnownSetting(known, o.path) {
+			if o.fromEnv {
+				log.Info("config overrides: warning: %s doesn't match any setting, ignoring it", o.source)
+				continue
+			}
+			return nil, fmt.Errorf("%s: unknown setting %s", o.source, o)
+		}
+		if o.err != nil {
+			return nil, o.err
+		}
+		list = append(list, o)
+	}
+	return list, nil
+}
+
+// Apply the overrides to the configuration file data
+func applyConfigOverrides(data []byte, overrides []configOverride) ([]byte, error) {
+	if len(overrides) == 0 {
+		return data, nil
+	}
+
+	// the nested objects are decoded into yaml.MapSlice too, so the order of the settings is kept
+	doc := yaml.MapSlice{}
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var node interface{} = doc
+	for _, o := range overrides {
+		node, err = setYAMLPath(node, o.path, o.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", o.source, err)
+		}
+		log.Debug("config: %s is overridden by %s", o, o.source)
+	}
+	return yaml.Marshal(node)
+}
+
+// Get the configuration file data with the overrides applied and the secrets decrypted
+func readConfigWithOverrides() ([]byte, error) {
+	data, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err = applyConfigOverrides(data, Context.configOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("config overrides: %s", err)
+	}
+	return decryptConfigData(data)
+}
+
+// The overridden settings aren't written to the configuration file:
+// the file keeps its own values for them
+func restoreOverriddenSettings(data []byte, fn string) ([]byte, error) {
+	if len(Context.configOverrides) == 0 {
+		return data, nil
+	}
+
+	doc := yaml.MapSlice{}
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	orig := yaml.MapSlice{}
+	origData, err := ioutil.ReadFile(fn)
+	if err == nil {
+		err = yaml.Unmarshal(origData, &orig)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var node interface{} = doc
+	for _, o := range Context.configOverrides {
+		v, ok := getYAMLPath(orig, o.path)
+		if ok {
+			node, err = setYAMLPath(node, o.path, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", o, err)
+			}
+		} else {
+			node = deleteYAMLPath(node, o.path)
+		}
+	}
+	return yaml.Marshal(node)
+}
+
+// Get the overrides and the read-only mode from the environment and command-line arguments
+func initConfigOverrides(args options) {
+	overrides, err := getConfigOverrides(os.Environ(), args.configOverrides)
+	if err != nil {
+		log.Fatalf("config overrides: %s", err)
+	}
+	Context.configOverrides = overrides
+	Context.configReadOnly = args.configReadOnly
+}
+
+// Check the overrides against the default configuration
+// Must be called before the configuration file is parsed.
+func checkDefaultConfigOverrides() error {
+	if len(Context.configOverrides) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	known := yaml.MapSlice{}
+	err = yaml.Unmarshal(data, &known)
+	if err != nil {
+		return err
+	}
+	overrides, err := checkConfigOverrides(known, Context.configOverrides)
+	if err != nil {
+		return fmt.Errorf("config overrides: %s", err)
+	}
+	Context.configOverrides = overrides
+	return nil
+}
@@ -0,0 +1,148 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestGetConfigOverrides(t *testing.T) {
+	environ := []string{
+		"PATH=/bin",
+		"AGH_DNS__UPSTREAM_DNS=[1.1.1.1, tls://dns.example]",
+		"AGH_BIND_PORT=80",
+	}
+	args := []string{"dns.port=5353", "filters.0.enabled=false"}
+	overrides, err := getConfigOverrides(environ, args)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(overrides))
+
+	// the environment variables are sorted, the command-line arguments are applied last
+	assert.Equal(t, "bind_port", overrides[0].String())
+	assert.Equal(t, 80, overrides[0].value)
+	assert.Equal(t, "AGH_BIND_PORT", overrides[0].source)
+	assert.Equal(t, "dns.upstream_dns", overrides[1].String())
+	assert.Equal(t, []interface{}{"1.1.1.1", "tls://dns.example"}, overrides[1].value)
+	assert.Equal(t, "dns.port", overrides[2].String())
+	assert.Equal(t, "filters.0.enabled", overrides[3].String())
+	assert.Equal(t, false, overrides[3].value)
+
+	_, err = getConfigOverrides(nil, []string{"dns.port"})
+	assert.NotNil(t, err)
+	_, err = getConfigOverrides(nil, []string{"dns..port=53"})
+	assert.NotNil(t, err)
+
+	// the environment variables are checked later, since other programs may use the same prefix
+	overrides, err = getConfigOverrides([]string{"AGH_DNS__PORT=[53", "AGH_VERSION=[1"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(overrides))
+	assert.NotNil(t, overrides[0].err)
+}
+
+func TestApplyConfigOverrides(t *testing.T) {
+	data := `
+bind_port: 3000
+dns:
+  port: 53
+  upstream_dns:
+  - 8.8.8.8
+filters:
+- enabled: true
+  url: https://example.org/1.txt
+`
+	overrides, err := getConfigOverrides(nil, []string{
+		"dns.port=5353",
+		"dns.upstream_dns=[1.1.1.1]",
+		"filters.0.enabled=false",
+		"tls.enabled=true",
+	})
+	assert.Nil(t, err)
+	out, err := applyConfigOverrides([]byte(data), overrides)
+	assert.Nil(t, err)
+
+	c := reloadedConfig{}
+	assert.Nil(t, yaml.Unmarshal(out, &c))
+	assert.Equal(t, 3000, c.BindPort)
+	assert.Equal(t, 5353, c.DNS.Port)
+	assert.Equal(t, []string{"1.1.1.1"}, c.DNS.UpstreamDNS)
+	assert.False(t, c.Filters[0].Enabled)
+	assert.Equal(t, "https://example.org/1.txt", c.Filters[0].URL)
+	assert.True(t, c.TLS.Enabled)
+
+	// invalid list index
+	overrides, _ = getConfigOverrides(nil, []string{"filters.1.enabled=false"})
+	_, err = applyConfigOverrides([]byte(data), overrides)
+	assert.NotNil(t, err)
+
+	// the parent setting isn't an object
+	overrides, _ = getConfigOverrides(nil, []string{"bind_port.value=1"})
+	_, err = applyConfigOverrides([]byte(data), overrides)
+	assert.NotNil(t, err)
+}
+
+func TestCheckConfigOverrides(t *testing.T) {
+	known := yaml.MapSlice{}
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+bind_port: 3000
+dns:
+  port: 53
+  upstream_weights: {}
+`), &known))
+
+	check := func(arg string) error {
+		overrides, err := getConfigOverrides(nil, []string{arg})
+		assert.Nil(t, err)
+		_, err = checkConfigOverrides(known, overrides)
+		return err
+	}
+	assert.Nil(t, check("bind_port=80"))
+	assert.Nil(t, check("dns.port=5353"))
+	assert.Nil(t, check("dns.upstream_weights.dns=2"))
+	assert.NotNil(t, check("bind_prot=80"))
+	assert.NotNil(t, check("dns.prot=5353"))
+
+	// the unknown environment variables are ignored
+	overrides, err := getConfigOverrides([]string{
+		"AGH_BIND_PORT=80",
+		"AGH_VERSION=[1",
+		"AGH_DNS__PROT=5353",
+		"AGH_=1",
+	}, nil)
+	assert.Nil(t, err)
+	overrides, err = checkConfigOverrides(known, overrides)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(overrides))
+	assert.Equal(t, "bind_port", overrides[0].String())
+
+	// the invalid value of a known setting is an error
+	overrides, err = getConfigOverrides([]string{"AGH_DNS__PORT=[53"}, nil)
+	assert.Nil(t, err)
+	_, err = checkConfigOverrides(known, overrides)
+	assert.NotNil(t, err)
+}
+
+func TestRestoreOverriddenSettings(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := dir + "/AdGuardHome.yaml"
+	prev := Context.configOverrides
+	defer func() { Context.configOverrides = prev }()
+
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("bind_port: 3000\ndns:\n  port: 53\n"), 0644))
+	Context.configOverrides, _ = getConfigOverrides(nil, []string{"dns.port=5353", "tls.enabled=true"})
+
+	data := "bind_port: 80\ndns:\n  port: 5353\ntls:\n  enabled: true\n  port_https: 443\n"
+	out, err := restoreOverriddenSettings([]byte(data), fn)
+	assert.Nil(t, err)
+
+	// the file keeps its own values of the overridden settings
+	c := reloadedConfig{}
+	assert.Nil(t, yaml.Unmarshal(out, &c))
+	assert.Equal(t, 80, c.BindPort)
+	assert.Equal(t, 53, c.DNS.Port)
+	assert.False(t, c.TLS.Enabled)
+	assert.Equal(t, 443, c.TLS.PortHTTPS)
+}
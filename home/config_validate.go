@@ -0,0 +1,430 @@
+// Validation of the configuration file: types, ranges, unknown settings and conflicting settings
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/querylog"
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configIssue is an invalid setting in the configuration file
+type configIssue struct {
+	Line    int    `json:"line,omitempty"`  // 0: unknown
+	Field   string `json:"field,omitempty"` // the path of the setting: "dns.port"
+	Message string `json:"message"`
+}
+
+func (i configIssue) String() string {
+	s := i.Message
+	if len(i.Field) != 0 {
+		s = i.Field + ": " + s
+	}
+	if i.Line != 0 {
+		s = fmt.Sprintf("line %d: %s", i.Line, s)
+	}
+	return s
+}
+
+// configValidation is the result of configuration file validation
+type configValidation struct {
+	Valid    bool          `json:"valid"`    // there are no errors (there may be warnings)
+	Errors   []configIssue `json:"errors"`   // the configuration can't be applied
+	Warnings []configIssue `json:"warnings"` // the settings which are ignored (e.g. unknown settings)
+}
+
+// Get all errors as one
+func (v configValidation) err() error {
+	list := []string{}
+	for _, e := range v.Errors {
+		list = append(list, e.String())
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(list, "; "))
+}
+
+var yamlKeyRegexp = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"\[{][^:#]*?)\s*:(\s|$)`)
+
+type yamlPathFrame struct {
+	indent int
+	path   string
+	item   bool // an element of a list
+	n      int  // number of the elements of the list which belong to this setting
+}
+
+// Get the path of the setting on each line of YAML document: 12 -> "dns.upstream_dns".
+// The elements of lists are addressed by their index: "filters.0.url".
+// Only block style is supported:  the lines in flow style and the lines of multi-line strings
+// get the path of their setting.
+func yamlLinePaths(data []byte) map[int]string {
+	paths := map[int]string{}
+	stack := []*yamlPathFrame{}
+	blockIndent := -1 // the indentation of the setting with multi-line string value.  -1: none
+	blockPath := ""
+
+	top := func() *yamlPathFrame {
+		if len(stack) == 0 {
+			return &yamlPathFrame{indent: -1}
+		}
+		return stack[len(stack)-1]
+	}
+	join := func(parent, name string) string {
+		if len(parent) == 0 {
+			return name
+		}
+		return parent + "." + name
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		num := i + 1
+		line = strings.TrimRight(line, "\r")
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		if len(content) == 0 || content[0] == '#' || content == "---" {
+			continue
+		}
+
+		if blockIndent >= 0 {
+			if indent > blockIndent {
+				paths[num] = blockPath
+				continue
+			}
+			blockIndent = -1
+		}
+
+		// list elements, possibly nested: "- - value"
+		for content == "-" || strings.HasPrefix(content, "- ") {
+			for len(stack) != 0 && (top().indent > indent || (top().item && top().indent == indent)) {
+				stack = stack[:len(stack)-1]
+			}
+			owner := top()
+			f := &yamlPathFrame{indent: indent, path: join(owner.path, strconv.Itoa(owner.n)), item: true}
+			owner.n++
+			stack = append(stack, f)
+			paths[num] = f.path
+
+			rest := strings.TrimLeft(content[1:], " ")
+			indent += len(content) - len(rest)
+			content = rest
+		}
+		if len(content) == 0 {
+			continue
+		}
+
+		m := yamlKeyRegexp.FindStringSubmatch(content)
+		if m == nil {
+			// a scalar element of a list or a continuation of the value
+			if _, ok := paths[num]; !ok {
+				paths[num] = top().path
+			}
+			continue
+		}
+		key := strings.Trim(m[1], `"'`)
+		for len(stack) != 0 && top().indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		f := &yamlPathFrame{indent: indent, path: join(top().path, key)}
+		stack = append(stack, f)
+		paths[num] = f.path
+
+		value := strings.TrimSpace(content[len(m[0]):])
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockIndent = indent
+			blockPath = f.path
+		}
+	}
+	return paths
+}
+
+// Get the first line of the setting (or of its closest parent setting)
+func findPathLine(paths map[int]string, field string) int {
+	for len(field) != 0 {
+		line := 0
+		for n, p := range paths {
+			if p == field && (line == 0 || n < line) {
+				line = n
+			}
+		}
+		if line != 0 {
+			return line
+		}
+		i := strings.LastIndexByte(field, '.')
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return 0
+}
+
+var yamlErrorRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+var yamlUnknownFieldRegexp = regexp.MustCompile(`^field (.+) not found in type `)
+
+// Convert the error from YAML decoder
+func parseYAMLError(msg string, paths map[int]string) (configIssue, bool) {
+	issue := configIssue{Message: msg}
+	m := yamlErrorRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		return issue, false
+	}
+	issue.Line, _ = strconv.Atoi(m[1])
+	issue.Message = m[2]
+	issue.Field = paths[issue.Line]
+
+	unknown := yamlUnknownFieldRegexp.FindStringSubmatch(m[2])
+	if unknown != nil {
+		issue.Message = "unknown setting " + unknown[1]
+		return issue, true
+	}
+	return issue, false
+}
+
+// Validate the configuration data
+func validateConfigData(data []byte) configValidation {
+	v := configValidation{
+		Errors:   []configIssue{},
+		Warnings: []configIssue{},
+	}
+	paths := yamlLinePaths(data)
+
+	// the settings which aren't in the file keep their current values
+	c := configuration{}
+	config.RLock()
+	base, err := yaml.Marshal(&config)
+	config.RUnlock()
+	if err == nil {
+		err = yaml.Unmarshal(base, &c)
+	}
+	if err != nil {
+		v.Errors = append(v.Errors, configIssue{Message: err.Error()})
+		return v
+	}
+
+	err = yaml.UnmarshalStrict(data, &c)
+	if err != nil {
+		te, ok := err.(*yaml.TypeError)
+		if !ok {
+			// syntax error: nothing else can be checked
+			issue, _ := parseYAMLError(err.Error(), paths)
+			v.Errors = append(v.Errors, issue)
+			return v
+		}
+		for _, msg := range te.Errors {
+			issue, unknown := parseYAMLError(msg, paths)
+			if unknown {
+				v.Warnings = append(v.Warnings, issue)
+			} else {
+				v.Errors = append(v.Errors, issue)
+			}
+		}
+	}
+
+	for _, issue := range checkConfigValues(&c) {
+		issue.Line = findPathLine(paths, issue.Field)
+		v.Errors = append(v.Errors, issue)
+	}
+	v.Valid = len(v.Errors) == 0
+	return v
+}
+
+// Validate the configuration file with the overrides applied
+// The line numbers aren't reported if there are overrides: the checked data differs from the file.
+func validateConfigFile() configValidation {
+	data, err := readConfigWithOverrides()
+	if err != nil {
+		return configValidation{
+			Errors:   []configIssue{{Message: err.Error()}},
+			Warnings: []configIssue{},
+		}
+	}
+
+	v := validateConfigData(data)
+	if len(Context.configOverrides) != 0 {
+		for i := range v.Errors {
+			v.Errors[i].Line = 0
+		}
+		for i := range v.Warnings {
+			v.Warnings[i].Line = 0
+		}
+	}
+	return v
+}
+
+// Print the result of validation to the log.  Return FALSE if there are errors.
+func logConfigValidation(v configValidation) bool {
+	for _, w := range v.Warnings {
+		log.Info("config: warning: %s", w)
+	}
+	for _, e := range v.Errors {
+		log.Error("config: %s", e)
+	}
+	return v.Valid
+}
+
+// A listening socket configured in the settings
+type configListener struct {
+	field string // the setting with the port
+	host  string
+	port  int
+	proto string // "tcp" or "udp"
+}
+
+func isUnspecifiedHost(host string) bool {
+	ip := net.ParseIP(host)
+	return ip == nil || ip.IsUnspecified()
+}
+
+// Find the settings which use the same port
+func checkPortConflicts(c *configuration) []configIssue {
+	list := []configListener{
+		{"bind_port", c.BindHost, c.BindPort, "tcp"},
+		{"dns.port", c.DNS.BindHost, c.DNS.Port, "tcp"},
+		{"dns.port", c.DNS.BindHost, c.DNS.Port, "udp"},
+	}
+	if c.TLS.Enabled {
+		list = append(list,
+			configListener{"tls.port_https", c.BindHost, c.TLS.PortHTTPS, "tcp"},
+			configListener{"tls.port_https_http3", c.BindHost, c.TLS.PortHTTP3, "udp"},
+			configListener{"tls.port_dns_over_tls", c.DNS.BindHost, c.TLS.PortDNSOverTLS, "tcp"},
+			configListener{"tls.port_dns_over_quic", c.DNS.BindHost, c.TLS.PortDNSOverQUIC, "udp"},
+		)
+	}
+
+	issues := []configIssue{}
+	for i, l := range list {
+		if l.port == 0 {
+			continue
+		}
+		for _, prev := range list[:i] {
+			if prev.port != l.port || prev.proto != l.proto || prev.field == l.field {
+				continue
+			}
+			if prev.host != l.host && !isUnspecifiedHost(prev.host) && !isUnspecifiedHost(l.host) {
+				continue
+			}
+			issues = append(issues, configIssue{
+				Field:   l.field,
+				Message: fmt.Sprintf("port %d/%s is used by %s too", l.port, l.proto, prev.field),
+			})
+			break
+		}
+	}
+	return issues
+}
+
+// Check the values of the settings
+func checkConfigValues(c *configuration) []configIssue {
+	issues := []configIssue{}
+	add := func(field string, err error) {
+		if err != nil {
+			issues = append(issues, configIssue{Field: field, Message: err.Error()})
+		}
+	}
+	checkPort := func(field string, port int, disabledOK bool) {
+		min := 1
+		if disabledOK {
+			min = 0 // 0: disabled
+		}
+		if port < min || port > 65535 {
+			add(field, fmt.Errorf("port %d must be in range %d..65535", port, min))
+		}
+	}
+	checkIP := func(field, host string) {
+		if net.ParseIP(host) == nil {
+			add(field, fmt.Errorf("invalid IP address: %q", host))
+		}
+	}
+
+	if c.SchemaVersion > currentSchemaVersion {
+		add("schema_version", fmt.Errorf("schema version %d is newer than supported (%d)", c.SchemaVersion, currentSchemaVersion))
+	}
+
+	checkIP("bind_host", c.BindHost)
+	checkPort("bind_port", c.BindPort, false)
+	checkIP("dns.bind_host", c.DNS.BindHost)
+	checkPort("dns.port", c.DNS.Port, false)
+	checkPort("tls.port_https", c.TLS.PortHTTPS, true)
+	checkPort("tls.port_https_http3", c.TLS.PortHTTP3, true)
+	checkPort("tls.port_dns_over_tls", c.TLS.PortDNSOverTLS, true)
+	checkPort("tls.port_dns_over_quic", c.TLS.PortDNSOverQUIC, true)
+	if c.TLS.PortDNSOverQUIC != 0 {
+		add("tls.port_dns_over_quic", dnsforward.CheckDoQ())
+	}
+	if c.TLS.PortHTTP3 != 0 {
+		add("tls.port_https_http3", checkHTTP3())
+	}
+	issues = append(issues, checkPortConflicts(c)...)
+
+	if !checkFiltersUpdateIntervalHours(c.DNS.FiltersUpdateIntervalHours) {
+		add("dns.filters_update_interval", fmt.Errorf("invalid interval: %d", c.DNS.FiltersUpdateIntervalHours))
+	}
+	for _, e := range dnsforward.ValidateFilteringConfig(&c.DNS.FilteringConfig) {
+		add("dns."+e.Field, e.Err)
+	}
+	_, err := dnsfilter.PrepareScripts(c.DNS.DnsfilterConf.Scripts)
+	add("dns.scripts", err)
+	add("dns.querylog_backend", querylog.CheckBackend(c.DNS.QueryLogBackend))
+	add("dns.querylog_compression", querylog.CheckCompression(c.DNS.QueryLogCompression))
+
+	ids := map[int64]bool{}
+	urls := map[string]bool{}
+	for i, f := range c.Filters {
+		field := fmt.Sprintf("filters.%d", i)
+		if !isLocalFilterURL(f.URL) && !IsValidURL(f.URL) {
+			add(field+".url", fmt.Errorf("invalid URL: %q", f.URL))
+		} else if urls[f.URL] {
+			add(field+".url", fmt.Errorf("duplicate URL: %s", f.URL))
+		}
+		urls[f.URL] = true
+		if f.ID != 0 && ids[f.ID] {
+			add(field+".id", fmt.Errorf("duplicate ID: %d", f.ID))
+		}
+		ids[f.ID] = true
+	}
+
+	add("acme", checkACMEConfig(c.ACME))
+	add("ha", checkHAConfig(c.HA))
+	add("notifications", checkNotifyConfig(c.Notifications))
+	add("plugins", checkPluginsConfig(c.Plugins))
+	add("sync", checkSyncConfig(c.Sync))
+	add("secrets", checkSecretsConfig(c.Secrets))
+	return issues
+}
+
+// Validate the configuration data from request body, or the configuration file if the body is empty
+func handleConfigValidate(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "read body: %s", err)
+		return
+	}
+
+	var v configValidation
+	if len(data) == 0 {
+		v = validateConfigFile()
+	} else {
+		v = validateConfigData(data)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// RegisterConfigValidateHandlers - register HTTP handlers
+func RegisterConfigValidateHandlers() {
+	httpRegister(http.MethodPost, "/control/config/validate", handleConfigValidate)
+}
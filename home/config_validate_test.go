@@ -0,0 +1,141 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestYAMLLinePaths(t *testing.T) {
+	data := `bind_port: 3000
+dns:
+  # comment
+  port: 53
+  upstream_dns:
+  - 1.1.1.1
+  - "tls://dns.example"
+  ids:
+    - a
+tls:
+  certificate_chain: |
+    -----BEGIN CERTIFICATE-----
+    key: value
+  port_https: 443
+filters:
+- enabled: true
+  url: https://example.org/1.txt
+- enabled: false
+  url: https://example.org/2.txt
+clients:
+- name: nas
+  ids:
+  - 192.168.1.2
+schema_version: 6
+`
+	paths := yamlLinePaths([]byte(data))
+	assert.Equal(t, "bind_port", paths[1])
+	assert.Equal(t, "dns", paths[2])
+	assert.Equal(t, "", paths[3])
+	assert.Equal(t, "dns.port", paths[4])
+	assert.Equal(t, "dns.upstream_dns", paths[5])
+	assert.Equal(t, "dns.upstream_dns.0", paths[6])
+	assert.Equal(t, "dns.upstream_dns.1", paths[7])
+	assert.Equal(t, "dns.ids.0", paths[9])
+	assert.Equal(t, "tls.certificate_chain", paths[11])
+	assert.Equal(t, "tls.certificate_chain", paths[13])
+	assert.Equal(t, "tls.port_https", paths[14])
+	assert.Equal(t, "filters.0.enabled", paths[16])
+	assert.Equal(t, "filters.0.url", paths[17])
+	assert.Equal(t, "filters.1.enabled", paths[18])
+	assert.Equal(t, "filters.1.url", paths[19])
+	assert.Equal(t, "clients.0.name", paths[21])
+	assert.Equal(t, "clients.0.ids.0", paths[23])
+	assert.Equal(t, "schema_version", paths[24])
+
+	assert.Equal(t, 17, findPathLine(paths, "filters.0.url"))
+	assert.Equal(t, 15, findPathLine(paths, "filters.2.url"))
+	assert.Equal(t, 0, findPathLine(paths, "unknown"))
+}
+
+func TestParseYAMLError(t *testing.T) {
+	paths := map[int]string{3: "dns.prot", 4: "dns.port"}
+
+	issue, unknown := parseYAMLError("line 3: field prot not found in type home.dnsConfig", paths)
+	assert.True(t, unknown)
+	assert.Equal(t, configIssue{Line: 3, Field: "dns.prot", Message: "unknown setting prot"}, issue)
+
+	issue, unknown = parseYAMLError("line 4: cannot unmarshal !!str `abc` into int", paths)
+	assert.False(t, unknown)
+	assert.Equal(t, "line 4: dns.port: cannot unmarshal !!str `abc` into int", issue.String())
+
+	issue, _ = parseYAMLError("yaml: line 2: mapping values are not allowed in this context", paths)
+	assert.Equal(t, 2, issue.Line)
+	assert.Equal(t, "", issue.Field)
+}
+
+func TestCheckPortConflicts(t *testing.T) {
+	c := configuration{BindHost: "0.0.0.0", BindPort: 3000}
+	c.DNS.BindHost = "0.0.0.0"
+	c.DNS.Port = 53
+	c.TLS.PortHTTPS = 443
+	c.TLS.PortDNSOverTLS = 443
+	assert.Equal(t, 0, len(checkPortConflicts(&c)))
+
+	c.TLS.Enabled = true
+	issues := checkPortConflicts(&c)
+	assert.Equal(t, 1, len(issues))
+	assert.Equal(t, "tls.port_dns_over_tls", issues[0].Field)
+
+	// DNS-over-QUIC uses UDP
+	c.TLS.PortDNSOverTLS = 853
+	c.TLS.PortDNSOverQUIC = 443
+	assert.Equal(t, 0, len(checkPortConflicts(&c)))
+
+	c.BindPort = 53
+	issues = checkPortConflicts(&c)
+	assert.Equal(t, 1, len(issues))
+	assert.Equal(t, "dns.port", issues[0].Field)
+	assert.Equal(t, "port 53/tcp is used by bind_port too", issues[0].Message)
+
+	// different addresses
+	c.BindHost = "127.0.0.1"
+	c.DNS.BindHost = "192.168.1.1"
+	assert.Equal(t, 0, len(checkPortConflicts(&c)))
+}
+
+func TestValidateConfigData(t *testing.T) {
+	data := `bind_host: 0.0.0.0
+bind_port: 53
+dns:
+  port: 53
+  upstream_dns:
+  - 1.1.1.1
+  ratelimit: fast
+  unknown_setting: 1
+filters:
+- enabled: true
+  url: https://example.org/1.txt
+  id: 1
+- enabled: true
+  url: https://example.org/1.txt
+  id: 2
+`
+	v := validateConfigData([]byte(data))
+	assert.False(t, v.Valid)
+
+	assert.Equal(t, 1, len(v.Warnings))
+	assert.Equal(t, 8, v.Warnings[0].Line)
+	assert.Equal(t, "dns.unknown_setting", v.Warnings[0].Field)
+
+	fields := map[string]int{}
+	for _, e := range v.Errors {
+		fields[e.Field] = e.Line
+	}
+	assert.Equal(t, 7, fields["dns.ratelimit"])
+	assert.Equal(t, 4, fields["dns.port"])
+	assert.Equal(t, 14, fields["filters.1.url"])
+
+	v = validateConfigData([]byte("dns: ["))
+	assert.False(t, v.Valid)
+	assert.Equal(t, 1, len(v.Errors))
+}
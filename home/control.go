@@ -90,6 +90,11 @@ func getDNSAddresses() []string {
 			addr := fmt.Sprintf("tls://%s:%d", config.TLS.ServerName, config.TLS.PortDNSOverTLS)
 			dnsAddresses = append(dnsAddresses, addr)
 		}
+
+		if config.TLS.PortDNSOverQUIC != 0 {
+			addr := fmt.Sprintf("quic://%s:%d", config.TLS.ServerName, config.TLS.PortDNSOverQUIC)
+			dnsAddresses = append(dnsAddresses, addr)
+		}
 	}
 
 	return dnsAddresses
@@ -129,12 +134,16 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 
 type profileJSON struct {
 	Name string `json:"name"`
+	Role string `json:"role"`
 }
 
 func handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	pj := profileJSON{}
 	u := Context.auth.GetCurrentUser(r)
 	pj.Name = u.Name
+	if len(u.Name) != 0 {
+		pj.Role = userRole(u)
+	}
 
 	data, err := json.Marshal(pj)
 	if err != nil {
@@ -176,13 +185,48 @@ func registerControlHandlers() {
 	RegisterFilteringHandlers()
 	RegisterTLSHandlers()
 	RegisterBlockedServicesHandlers()
+	RegisterActivityHandlers()
+	RegisterMetricsHandlers()
+	RegisterBlockPageHandlers()
+	RegisterACMEHandlers()
+	RegisterBackupHandlers()
+	RegisterSyncHandlers()
+	RegisterHAHandlers()
+	RegisterNotifyHandlers()
 	RegisterAuthHandlers()
+	RegisterReloadHandlers()
+	RegisterHealthHandlers()
+	RegisterConfigValidateHandlers()
 
 	http.HandleFunc("/dns-query", postInstall(handleDOH))
+	http.HandleFunc("/dns-query/", postInstall(handleDOH)) // "/dns-query/ID": client ID
 }
 
+// URL -> method -> handler
+// The handlers must be registered before the HTTP server is started.
+var httpMethodHandlers = map[string]map[string]func(http.ResponseWriter, *http.Request){}
+
+// Register the handler for the URL and the method.
+// Several handlers with different methods may be registered for the same URL ("GET" and "PUT").
 func httpRegister(method string, url string, handler func(http.ResponseWriter, *http.Request)) {
-	http.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, handler)))))
+	handlers, ok := httpMethodHandlers[url]
+	if ok {
+		handlers[method] = handler
+		return
+	}
+	handlers = map[string]func(http.ResponseWriter, *http.Request){method: handler}
+	httpMethodHandlers[url] = handlers
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mh, ok := handlers[r.Method]
+		if !ok {
+			// respond with an error
+			ensure(method, handler)(w, r)
+			return
+		}
+		ensure(r.Method, mh)(w, r)
+	})
+	http.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(h))))
 }
 
 // ----------------------------------
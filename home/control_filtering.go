@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
@@ -28,8 +29,9 @@ func IsValidURL(rawurl string) bool {
 }
 
 type filterAddJSON struct {
-	Name string `json:"name"`
-	URL  string `json:"url"`
+	Name string      `json:"name"`
+	URL  string      `json:"url"`
+	Auth *filterAuth `json:"auth"` // optional
 }
 
 func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
@@ -57,6 +59,14 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 		URL:     fj.URL,
 		Name:    fj.Name,
 	}
+	if fj.Auth != nil {
+		err = fj.Auth.check()
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "auth: %s", err)
+			return
+		}
+		f.Auth = *fj.Auth
+	}
 	f.ID = assignUniqueFilterID()
 
 	// Download the filter contents
@@ -139,9 +149,12 @@ func handleFilteringRemoveURL(w http.ResponseWriter, r *http.Request) {
 }
 
 type filterURLJSON struct {
-	Name    string `json:"name"`
-	URL     string `json:"url"`
-	Enabled bool   `json:"enabled"`
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	Enabled        bool   `json:"enabled"`
+	UpdateInterval uint32 `json:"update_interval"` // in hours.  0: default
+
+	Auth *filterAuth `json:"auth"` // nil: don't change
 }
 
 type filterURLReq struct {
@@ -163,11 +176,19 @@ func handleFilteringSetURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	f := filter{
-		Enabled: fj.Data.Enabled,
-		Name:    fj.Data.Name,
-		URL:     fj.Data.URL,
+		Enabled:        fj.Data.Enabled,
+		Name:           fj.Data.Name,
+		URL:            fj.Data.URL,
+		UpdateInterval: fj.Data.UpdateInterval,
+	}
+	if fj.Data.Auth != nil {
+		err = fj.Data.Auth.check()
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "auth: %s", err)
+			return
+		}
 	}
-	status := filterSetProperties(fj.URL, f)
+	status := filterSetProperties(fj.URL, f, fj.Data.Auth)
 	if (status & statusFound) == 0 {
 		http.Error(w, "URL doesn't exist", http.StatusBadRequest)
 		return
@@ -199,7 +220,38 @@ func handleFilteringSetRules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	config.UserRules = strings.Split(string(body), "\n")
+	var rules []string
+	var expiry []dnsfilter.RuleExpiry
+	if r.Header.Get("Content-Type") == "application/json" {
+		req := userRulesJSON{}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "json.Unmarshal: %s", err)
+			return
+		}
+		rules = req.Rules
+		expiry = req.Expiry
+
+	} else {
+		rules = strings.Split(string(body), "\n")
+		// keep the expiration time of the rules which are still present
+		config.RLock()
+		expiry = config.UserRulesExpiry
+		config.RUnlock()
+	}
+
+	for _, e := range expiry {
+		if e.Until.IsZero() {
+			httpError(w, http.StatusBadRequest, "expiry: no time for rule %s", e.Rule)
+			return
+		}
+	}
+	expiry = filterUserRulesExpiry(rules, expiry)
+
+	config.Lock()
+	config.UserRules = rules
+	config.UserRulesExpiry = expiry
+	config.Unlock()
 	onConfigModified()
 	userFilter := userFilter()
 	err = userFilter.save()
@@ -207,6 +259,13 @@ func handleFilteringSetRules(w http.ResponseWriter, r *http.Request) {
 		log.Error("Couldn't save the user filter: %s", err)
 	}
 	enableFilters(true)
+	Context.dnsFilter.SetRulesExpiry(expiry)
+}
+
+// User rules with their expiration time
+type userRulesJSON struct {
+	Rules  []string               `json:"rules"`
+	Expiry []dnsfilter.RuleExpiry `json:"expiry"`
 }
 
 func handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
@@ -220,44 +279,71 @@ func handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK %d filters updated\n", nUpdated)
 }
 
+
 type filterJSON struct {
-	ID          int64  `json:"id"`
-	Enabled     bool   `json:"enabled"`
-	URL         string `json:"url"`
-	Name        string `json:"name"`
-	RulesCount  uint32 `json:"rules_count"`
-	LastUpdated string `json:"last_updated"`
+	ID             int64  `json:"id"`
+	Enabled        bool   `json:"enabled"`
+	URL            string `json:"url"`
+	Name           string `json:"name"`
+	RulesCount     uint32 `json:"rules_count"`
+	LastUpdated    string `json:"last_updated"`
+	Homepage       string `json:"homepage"`
+	Version        string `json:"version"`
+	Expires        uint32 `json:"expires"`         // update interval from the filter list header (in seconds).  0: not specified
+	Stale          bool   `json:"stale"`           // the filter list hasn't been updated in time
+	UpdateInterval uint32 `json:"update_interval"` // in hours.  0: default
+	AuthType       string `json:"auth_type"`       // "": none, "basic", "bearer"
+	MemoryUsage    uint64 `json:"memory_usage"`    // estimated memory usage in the filtering engine (in bytes)
+	LoadError      string `json:"load_error"`      // the reason why the list isn't loaded.  "": no error
 }
 
 type filteringConfig struct {
-	Enabled   bool         `json:"enabled"`
-	Interval  uint32       `json:"interval"` // in hours
-	Filters   []filterJSON `json:"filters"`
-	UserRules []string     `json:"user_rules"`
+	Enabled         bool                   `json:"enabled"`
+	Interval        uint32                 `json:"interval"` // in hours
+	Filters         []filterJSON           `json:"filters"`
+	UserRules       []string               `json:"user_rules"`
+	UserRulesExpiry []dnsfilter.RuleExpiry `json:"user_rules_expiry"`
+
+	// Estimated memory usage of the user rules in the filtering engine (in bytes)
+	UserRulesMemoryUsage uint64 `json:"user_rules_memory_usage"`
 }
 
 // Get filtering configuration
 func handleFilteringStatus(w http.ResponseWriter, r *http.Request) {
 	resp := filteringConfig{}
+	now := time.Now()
+	memory := Context.dnsFilter.GetFiltersMemory()
 	config.RLock()
 	resp.Enabled = config.DNS.FilteringEnabled
 	resp.Interval = config.DNS.FiltersUpdateIntervalHours
 	for _, f := range config.Filters {
 		fj := filterJSON{
-			ID:         f.ID,
-			Enabled:    f.Enabled,
-			URL:        f.URL,
-			Name:       f.Name,
-			RulesCount: uint32(f.RulesCount),
+			ID:             f.ID,
+			Enabled:        f.Enabled,
+			URL:            f.URL,
+			Name:           f.Name,
+			RulesCount:     uint32(f.RulesCount),
+			Homepage:       f.Homepage,
+			Version:        f.Version,
+			Expires:        uint32(f.Expires / time.Second),
+			UpdateInterval: f.UpdateInterval,
+			AuthType:       f.Auth.Type,
+			MemoryUsage:    memory[f.ID].Bytes,
+			LoadError:      memory[f.ID].Error,
 		}
 
 		if !f.LastUpdated.IsZero() {
 			fj.LastUpdated = f.LastUpdated.Format(time.RFC3339)
 		}
+		if f.Enabled && f.updateInterval() != 0 {
+			fj.Stale = now.After(f.nextUpdate().Add(filterStaleGap))
+		}
 
 		resp.Filters = append(resp.Filters, fj)
 	}
 	resp.UserRules = config.UserRules
+	resp.UserRulesExpiry = filterUserRulesExpiry(config.UserRules, config.UserRulesExpiry)
+	resp.UserRulesMemoryUsage = memory[0].Bytes
 	config.RUnlock()
 
 	jsonVal, err := json.Marshal(resp)
@@ -334,6 +420,80 @@ func handleCheckHost(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
+type checkHostVerboseReq struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`   // DNS record type.  "": A
+	Client string `json:"client"` // Client IP address whose settings are applied.  "": global settings
+}
+
+type checkHostVerboseResp struct {
+	checkHostResp
+	DecidedBy string                 `json:"decided_by"` // The stage that has taken the final decision.  "": none
+	Trace     []dnsfilter.TraceEntry `json:"trace"`
+}
+
+// Check the host name and return the information about every evaluated filtering stage
+func handleCheckHostVerbose(w http.ResponseWriter, r *http.Request) {
+	req := checkHostVerboseReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	if len(req.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "host name is empty")
+		return
+	}
+
+	qtype := dns.TypeA
+	if len(req.Type) != 0 {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(req.Type)]
+		if !ok {
+			httpError(w, http.StatusBadRequest, "invalid DNS type: %s", req.Type)
+			return
+		}
+	}
+
+	if len(req.Client) != 0 && net.ParseIP(req.Client) == nil {
+		httpError(w, http.StatusBadRequest, "invalid client IP address: %s", req.Client)
+		return
+	}
+
+	setts := Context.dnsFilter.GetConfig()
+	setts.FilteringEnabled = config.DNS.FilteringEnabled
+	setts.ClientIP = req.Client
+	applyAdditionalFiltering(req.Client, &setts)
+	result, trace, err := Context.dnsFilter.CheckHostTrace(r.Context(), req.Name, qtype, &setts)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "couldn't apply filtering: %s: %s", req.Name, err)
+		return
+	}
+
+	resp := checkHostVerboseResp{}
+	resp.Reason = result.Reason.String()
+	resp.FilterID = result.FilterID
+	resp.Rule = result.Rule
+	resp.SvcName = result.ServiceName
+	resp.CanonName = result.CanonName
+	resp.IPList = result.IPList
+	resp.Trace = trace.Entries
+	for _, e := range trace.Entries {
+		if e.Matched {
+			resp.DecidedBy = e.Stage
+		}
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
 // RegisterFilteringHandlers - register handlers
 func RegisterFilteringHandlers() {
 	httpRegister("GET", "/control/filtering/status", handleFilteringStatus)
@@ -344,6 +504,8 @@ func RegisterFilteringHandlers() {
 	httpRegister("POST", "/control/filtering/refresh", handleFilteringRefresh)
 	httpRegister("POST", "/control/filtering/set_rules", handleFilteringSetRules)
 	httpRegister("GET", "/control/filtering/check_host", handleCheckHost)
+	httpRegister("POST", "/control/filtering/check_host_verbose", handleCheckHostVerbose)
+	httpRegister("GET", "/control/filtering/recommendations", handleFilteringRecommendations)
 }
 
 func checkFiltersUpdateIntervalHours(i uint32) bool {
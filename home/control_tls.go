@@ -20,6 +20,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/util"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -68,6 +69,23 @@ func RegisterTLSHandlers() {
 	httpRegister(http.MethodPost, "/control/tls/validate", handleTLSValidate)
 }
 
+// Check that the QUIC listeners are supported and their ports don't conflict
+func checkQUICSettings(data tlsConfigSettings) error {
+	if data.PortDNSOverQUIC != 0 {
+		err := dnsforward.CheckDoQ()
+		if err != nil {
+			return err
+		}
+	}
+	if data.PortHTTP3 != 0 {
+		err := checkHTTP3()
+		if err != nil {
+			return err
+		}
+	}
+	return checkHTTP3Port(data)
+}
+
 func handleTLSStatus(w http.ResponseWriter, r *http.Request) {
 	marshalTLS(w, config.TLS)
 }
@@ -79,6 +97,12 @@ func handleTLSValidate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = checkQUICSettings(data.tlsConfigSettings)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
 	// check if port is available
 	// BUT: if we are already using this port, no need
 	alreadyRunning := false
@@ -109,6 +133,12 @@ func handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = checkQUICSettings(data.tlsConfigSettings)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
 	// check if port is available
 	// BUT: if we are already using this port, no need
 	alreadyRunning := false
@@ -147,16 +177,21 @@ func handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 	if restartHTTPS {
 		go func() {
 			time.Sleep(time.Second) // TODO: could not find a way to reliably know that data was fully sent to client by https server, so we wait a bit to let response through before closing the server
-			Context.httpsServer.cond.L.Lock()
-			Context.httpsServer.cond.Broadcast()
-			if Context.httpsServer.server != nil {
-				Context.httpsServer.server.Shutdown(context.TODO())
-			}
-			Context.httpsServer.cond.L.Unlock()
+			restartHTTPSServer()
 		}()
 	}
 }
 
+// Restart HTTPS server so that it uses the new TLS settings
+func restartHTTPSServer() {
+	Context.httpsServer.cond.L.Lock()
+	Context.httpsServer.cond.Broadcast()
+	if Context.httpsServer.server != nil {
+		Context.httpsServer.server.Shutdown(context.TODO())
+	}
+	Context.httpsServer.cond.L.Unlock()
+}
+
 func verifyCertChain(data *tlsConfigStatus, certChain string, serverName string) error {
 	log.Tracef("TLS: got certificate: %d bytes", len(certChain))
 
@@ -479,6 +479,11 @@ func finishUpdate(u *updateInfo) {
 	stopHTTPServer()
 	cleanupAlways()
 
+	restartProcess(u.curBinName)
+}
+
+// Start a new instance of the application and exit
+func restartProcess(binName string) {
 	if runtime.GOOS == "windows" {
 		if Context.runningAsService {
 			// Note:
@@ -492,7 +497,7 @@ func finishUpdate(u *updateInfo) {
 			os.Exit(0)
 		}
 
-		cmd := exec.Command(u.curBinName, os.Args[1:]...)
+		cmd := exec.Command(binName, os.Args[1:]...)
 		log.Info("Restarting: %v", cmd.Args)
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
@@ -506,7 +511,8 @@ func finishUpdate(u *updateInfo) {
 	} else {
 
 		log.Info("Restarting: %v", os.Args)
-		err := syscall.Exec(u.curBinName, os.Args, os.Environ())
+		keepActivatedSockets()
+		err := syscall.Exec(binName, os.Args, os.Environ())
 		if err != nil {
 			log.Fatalf("syscall.Exec() failed: %s", err)
 		}
@@ -0,0 +1,438 @@
+// Network discovery: find the active hosts in the local network
+//  and identify them by the information from ARP table, mDNS and NetBIOS
+
+package home
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+)
+
+const (
+	discoveryDefaultInterval = 10 // in minutes
+	discoveryProbeTimeout    = 500 * time.Millisecond
+	discoveryProbeTTL        = 1 * 60 * 60 // don't probe the same host again during this time (in seconds)
+	netbiosPort              = "137"
+	mdnsUnicastPort          = "5353"
+)
+
+type discoveryConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Interval uint32 `yaml:"interval"` // in minutes.  0: default (10)
+	MDNS     bool   `yaml:"mdns"`     // send mDNS queries to the hosts
+	NetBIOS  bool   `yaml:"netbios"`  // send NetBIOS node status requests to the hosts
+
+	// The database of MAC address vendors: IEEE "oui.txt" or Wireshark "manuf" file.
+	// "": use the system file from the default location
+	OUIFile string `yaml:"oui_file"`
+}
+
+// The default locations of the database of MAC address vendors
+var ouiFiles = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/hwdata/oui.txt",
+	"/usr/share/wireshark/manuf",
+}
+
+// An entry of the system ARP table
+type arpEntry struct {
+	ip  string
+	mac net.HardwareAddr
+}
+
+// Network discovery module
+type discovery struct {
+	conf    discoveryConfig
+	clients *clientsContainer
+	vendors map[[3]byte]string // OUI -> vendor name
+	probed  map[string]int64   // IP -> the time of the last probe
+	stop    chan bool
+}
+
+// Create module context
+func initDiscovery(conf discoveryConfig, clients *clientsContainer) *discovery {
+	d := &discovery{
+		conf:    conf,
+		clients: clients,
+		probed:  map[string]int64{},
+	}
+	if d.conf.Interval == 0 {
+		d.conf.Interval = discoveryDefaultInterval
+	}
+	return d
+}
+
+// Start the background worker
+func (d *discovery) Start() {
+	if !d.conf.Enabled {
+		return
+	}
+	d.loadVendors()
+	d.stop = make(chan bool)
+	go d.workerLoop(d.stop)
+	log.Info("Discovery: scanning the network every %d minutes", d.conf.Interval)
+}
+
+// Close - stop the background worker
+func (d *discovery) Close() {
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+}
+
+func (d *discovery) workerLoop(stop chan bool) {
+	for {
+		d.update(stop)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(d.conf.Interval) * time.Minute):
+			//
+		}
+	}
+}
+
+// Enumerate the hosts from ARP table, set their hardware addresses and try to get their names
+func (d *discovery) update(stop chan bool) {
+	entries, err := readARPTable()
+	if err != nil {
+		log.Debug("Discovery: %s", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	for ip, t := range d.probed {
+		if t+discoveryProbeTTL <= now {
+			delete(d.probed, ip)
+		}
+	}
+
+	n := 0
+	for _, e := range entries {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		d.clients.SetHWInfo(e.ip, e.mac, d.vendor(e.mac))
+
+		host, source := d.probe(e.ip, now)
+		if len(host) == 0 {
+			continue
+		}
+		ok, _ := d.clients.AddHost(e.ip, host, source)
+		if ok {
+			n++
+		}
+	}
+	log.Debug("Discovery: found %d hosts, resolved %d names", len(entries), n)
+}
+
+// Get the host name via mDNS or NetBIOS
+// "": the host didn't respond, or the name is already known from a source with a higher priority
+func (d *discovery) probe(ip string, now int64) (string, clientSource) {
+	if d.clients.Exists(ip, ClientSourceMDNS) {
+		return "", 0
+	}
+	_, ok := d.probed[ip]
+	if ok {
+		return "", 0
+	}
+	d.probed[ip] = now
+
+	if d.conf.MDNS {
+		host := queryMDNSName(ip)
+		if len(host) != 0 {
+			return host, ClientSourceMDNS
+		}
+	}
+
+	if d.conf.NetBIOS && !d.clients.Exists(ip, ClientSourceNetBIOS) {
+		host := queryNetBIOSName(ip)
+		if len(host) != 0 {
+			return host, ClientSourceNetBIOS
+		}
+	}
+	return "", 0
+}
+
+// Load the database of MAC address vendors
+func (d *discovery) loadVendors() {
+	files := ouiFiles
+	if len(d.conf.OUIFile) != 0 {
+		files = []string{d.conf.OUIFile}
+	}
+
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Debug("Discovery: %s", err)
+			continue
+		}
+		d.vendors = parseVendors(string(data))
+		log.Debug("Discovery: loaded %d vendors from %s", len(d.vendors), fn)
+		return
+	}
+	log.Info("Discovery: the database of MAC address vendors isn't found")
+}
+
+// Get the vendor name by MAC address
+func (d *discovery) vendor(mac net.HardwareAddr) string {
+	if len(mac) < 3 || mac[0]&0x02 != 0 {
+		return "" // locally administered (e.g. randomized) address
+	}
+	return d.vendors[[3]byte{mac[0], mac[1], mac[2]}]
+}
+
+// Parse the database of MAC address vendors:
+// IEEE "oui.txt" ("00-1A-11   (hex)		Google, Inc.")
+// or Wireshark "manuf" ("00:1A:11	Google	Google, Inc.")
+func parseVendors(data string) map[[3]byte]string {
+	vendors := map[[3]byte]string{}
+	for _, ln := range strings.Split(data, "\n") {
+		ln = strings.TrimSpace(ln)
+		if len(ln) < 8 || ln[0] == '#' {
+			continue
+		}
+
+		var name string
+		i := strings.Index(ln, "(hex)")
+		if i > 0 {
+			name = ln[i+len("(hex)"):]
+		} else {
+			fields := strings.Split(ln, "\t")
+			if len(fields) < 2 || len(fields[0]) != 8 {
+				continue // e.g. "00:1B:C5:00:00/36": the block is smaller than OUI
+			}
+			name = fields[len(fields)-1]
+		}
+		name = strings.TrimSpace(name)
+
+		oui, err := hex.DecodeString(strings.NewReplacer("-", "", ":", "").Replace(ln[:8]))
+		if err != nil || len(oui) != 3 || len(name) == 0 {
+			continue
+		}
+		vendors[[3]byte{oui[0], oui[1], oui[2]}] = name
+	}
+	return vendors
+}
+
+// Read the system ARP table
+func readARPTable() ([]arpEntry, error) {
+	if runtime.GOOS == "linux" {
+		data, err := ioutil.ReadFile("/proc/net/arp")
+		if err == nil {
+			return parseProcARP(string(data)), nil
+		}
+	}
+
+	cmd := exec.Command("arp", "-a")
+	log.Tracef("executing %s %v", cmd.Path, cmd.Args)
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("command %s has failed: %s", cmd.Path, err)
+	}
+	return parseARPOutput(string(data)), nil
+}
+
+// Parse /proc/net/arp:
+// IP address       HW type     Flags       HW address            Mask     Device
+// 192.168.1.57     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func parseProcARP(data string) []arpEntry {
+	var entries []arpEntry
+	for _, ln := range strings.Split(data, "\n") {
+		fields := strings.Fields(ln)
+		if len(fields) < 4 || fields[2] == "0x0" { // incomplete entry
+			continue
+		}
+		e, ok := newARPEntry(fields[0], fields[3])
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Parse the output of 'arp -a' command:
+// BSD and macOS: "host (192.168.1.57) at aa:bb:cc:dd:ee:ff on en0 ifscope [ethernet]"
+// Windows: "192.168.1.57          aa-bb-cc-dd-ee-ff     dynamic"
+func parseARPOutput(data string) []arpEntry {
+	var entries []arpEntry
+	for _, ln := range strings.Split(data, "\n") {
+		var ip, mac string
+		open := strings.Index(ln, " (")
+		close := strings.Index(ln, ") at ")
+		if open != -1 && close != -1 && open < close {
+			ip = ln[open+2 : close]
+			fields := strings.Fields(ln[close+len(") at "):])
+			if len(fields) == 0 {
+				continue
+			}
+			mac = fields[0]
+		} else {
+			fields := strings.Fields(ln)
+			if len(fields) < 2 {
+				continue
+			}
+			ip = fields[0]
+			mac = fields[1]
+		}
+
+		e, ok := newARPEntry(ip, mac)
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Create ARP table entry.  Broadcast and multicast addresses are skipped.
+// The octets of MAC address may be without leading zeros ("0:1a:2b:3:4:5")
+func newARPEntry(ip, mac string) (arpEntry, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return arpEntry{}, false
+	}
+
+	octets := strings.FieldsFunc(mac, func(c rune) bool { return c == ':' || c == '-' })
+	if len(octets) != 6 {
+		return arpEntry{}, false
+	}
+	hw := make(net.HardwareAddr, 0, 6)
+	for _, o := range octets {
+		if len(o) == 1 {
+			o = "0" + o
+		}
+		b, err := hex.DecodeString(o)
+		if err != nil || len(b) != 1 {
+			return arpEntry{}, false
+		}
+		hw = append(hw, b[0])
+	}
+	if hw[0]&0x01 != 0 || (hw[0]|hw[1]|hw[2]|hw[3]|hw[4]|hw[5]) == 0 {
+		return arpEntry{}, false
+	}
+
+	return arpEntry{ip: addr.String(), mac: hw}, true
+}
+
+// Get the host name via unicast mDNS query (RFC 6762 section 5.5) for the reverse address
+func queryMDNSName(ip string) string {
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	req := dns.Msg{}
+	req.SetQuestion(name, dns.TypePTR)
+	req.RecursionDesired = false
+
+	c := dns.Client{Timeout: discoveryProbeTimeout}
+	resp, _, err := c.Exchange(&req, net.JoinHostPort(ip, mdnsUnicastPort))
+	if err != nil {
+		log.Tracef("Discovery: mDNS: %s: %s", ip, err)
+		return ""
+	}
+	for _, a := range resp.Answer {
+		ptr, ok := a.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimSuffix(ptr.Ptr, "."), ".local")
+		if utils.IsValidHostname(host) == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// Get the computer name via NetBIOS node status request
+func queryNetBIOSName(ip string) string {
+	c, err := net.Dial("udp4", net.JoinHostPort(ip, netbiosPort))
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(discoveryProbeTimeout))
+
+	id := uint16(rand.Uint32())
+	_, err = c.Write(netbiosStatusRequest(id))
+	if err != nil {
+		return ""
+	}
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil {
+		log.Tracef("Discovery: NetBIOS: %s: %s", ip, err)
+		return ""
+	}
+
+	host := parseNetBIOSStatus(buf[:n], id)
+	if utils.IsValidHostname(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// Create NetBIOS node status request for the name "*" (RFC 1002 section 4.2.17)
+func netbiosStatusRequest(id uint16) []byte {
+	b := []byte{byte(id >> 8), byte(id), 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	// the encoded name: "*" followed by 15 zero bytes
+	b = append(b, 32, 'C', 'K')
+	for i := 0; i != 15; i++ {
+		b = append(b, 'A', 'A')
+	}
+	b = append(b, 0)
+	return append(b, 0, 0x21, 0, 1) // NBSTAT, IN
+}
+
+// Get the computer name from NetBIOS node status response (RFC 1002 section 4.2.18):
+// the first unique name with the type 0x00 (Workstation Service)
+func parseNetBIOSStatus(b []byte, id uint16) string {
+	if len(b) <= 12 || binary.BigEndian.Uint16(b) != id || b[2]&0x80 == 0 ||
+		binary.BigEndian.Uint16(b[6:]) == 0 {
+		return ""
+	}
+
+	// skip the name
+	i := 12
+	if b[i]&0xc0 == 0xc0 {
+		i += 2
+	} else {
+		for i < len(b) && b[i] != 0 {
+			i += int(b[i]) + 1
+		}
+		i++
+	}
+	i += 10 // type, class, TTL, data length
+	if i >= len(b) {
+		return ""
+	}
+
+	num := int(b[i])
+	i++
+	for ; num != 0 && i+18 <= len(b); num-- {
+		name := b[i : i+15]
+		suffix := b[i+15]
+		flags := binary.BigEndian.Uint16(b[i+16:])
+		i += 18
+		if suffix == 0 && flags&0x8000 == 0 {
+			return strings.TrimRight(string(name), " \x00")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package home
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveryParseARP(t *testing.T) {
+	data := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.57     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+192.168.1.58     0x1         0x0         00:00:00:00:00:00     *        eth0
+`
+	entries := parseProcARP(data)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "192.168.1.57", entries[0].ip)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", entries[0].mac.String())
+
+	data = `router (192.168.1.1) at 0:1a:2b:3:4:5 on en0 ifscope [ethernet]
+? (192.168.1.2) at (incomplete) on en0 ifscope [ethernet]
+? (192.168.1.255) at ff:ff:ff:ff:ff:ff on en0 ifscope [ethernet]
+? (224.0.0.251) at 1:0:5e:0:0:fb on en0 ifscope permanent [ethernet]
+
+Interface: 192.168.1.10 --- 0x4
+  Internet Address      Physical Address      Type
+  192.168.1.57          aa-bb-cc-dd-ee-ff     dynamic
+`
+	entries = parseARPOutput(data)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "192.168.1.1", entries[0].ip)
+	assert.Equal(t, "00:1a:2b:03:04:05", entries[0].mac.String())
+	assert.Equal(t, "192.168.1.57", entries[1].ip)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", entries[1].mac.String())
+}
+
+func TestDiscoveryVendors(t *testing.T) {
+	data := "00-1A-11   (hex)\t\tGoogle, Inc.\n" +
+		"001A11     (base 16)\t\tGoogle, Inc.\n" +
+		"# comment\n" +
+		"00:03:93\tApple\tApple, Inc.\n" +
+		"00:1B:C5:00:00/36\tConverging\tConverging Systems Inc.\n"
+	d := discovery{vendors: parseVendors(data)}
+	assert.Equal(t, 2, len(d.vendors))
+
+	assert.Equal(t, "Google, Inc.", d.vendor(net.HardwareAddr{0x00, 0x1a, 0x11, 1, 2, 3}))
+	assert.Equal(t, "Apple, Inc.", d.vendor(net.HardwareAddr{0x00, 0x03, 0x93, 1, 2, 3}))
+	assert.Equal(t, "", d.vendor(net.HardwareAddr{0x00, 0x00, 0x01, 1, 2, 3}))
+	// locally administered address
+	assert.Equal(t, "", d.vendor(net.HardwareAddr{0x02, 0x1a, 0x11, 1, 2, 3}))
+}
+
+func TestDiscoveryNetBIOS(t *testing.T) {
+	req := netbiosStatusRequest(0x1234)
+	assert.Equal(t, 50, len(req))
+	assert.Equal(t, []byte{0x12, 0x34}, req[:2])
+	assert.Equal(t, "CKAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", string(req[13:45]))
+
+	resp := []byte{0x12, 0x34, 0x84, 0x00, 0, 0, 0, 1, 0, 0, 0, 0}
+	resp = append(resp, req[12:46]...)                   // name
+	resp = append(resp, 0, 0x21, 0, 1, 0, 0, 0, 0, 0, 0) // NBSTAT, IN, TTL, data length (isn't checked)
+	resp = append(resp, 3)
+	resp = append(resp, []byte("WORKGROUP      \x00\x84\x00")...) // group name
+	resp = append(resp, []byte("DESKTOP-1A2B   \x20\x04\x00")...) // file server service
+	resp = append(resp, []byte("DESKTOP-1A2B   \x00\x04\x00")...)
+	resp = append(resp, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff)
+	assert.Equal(t, "DESKTOP-1A2B", parseNetBIOSStatus(resp, 0x1234))
+
+	// another transaction ID
+	assert.Equal(t, "", parseNetBIOSStatus(resp, 0x1235))
+	// truncated response
+	assert.Equal(t, "", parseNetBIOSStatus(resp[:100], 0x1234))
+	assert.Equal(t, "", parseNetBIOSStatus(resp[:12], 0x1234))
+}
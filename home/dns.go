@@ -1,17 +1,19 @@
 package home
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/querylog"
 	"github.com/AdguardTeam/AdGuardHome/stats"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/dnsproxy/proxy"
-	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 )
@@ -33,22 +35,38 @@ func initDNSServer() error {
 	}
 
 	statsConf := stats.Config{
-		Filename:       filepath.Join(baseDir, "stats.db"),
-		LimitDays:      config.DNS.StatsInterval,
-		ConfigModified: onConfigModified,
-		HTTPRegister:   httpRegister,
+		Filename:         filepath.Join(baseDir, "stats.db"),
+		LimitDays:        config.DNS.StatsInterval,
+		DailyRetention:   config.DNS.StatsDailyRetention,
+		MonthlyRetention: config.DNS.StatsMonthlyRetention,
+		PushURL:          config.DNS.StatsPushURL,
+		PushInterval:     config.DNS.StatsPushInterval,
+		PushMeasurement:  config.DNS.StatsPushMeasurement,
+		IgnoredClient:    Context.clients.IsStatisticsIgnored,
+		ConfigModified:   onConfigModified,
+		HTTPRegister:     httpRegister,
 	}
 	Context.stats, err = stats.New(statsConf)
 	if err != nil {
 		return fmt.Errorf("Couldn't initialize statistics module")
 	}
 	conf := querylog.Config{
-		Enabled:        config.DNS.QueryLogEnabled,
-		BaseDir:        baseDir,
-		Interval:       config.DNS.QueryLogInterval,
-		MemSize:        config.DNS.QueryLogMemSize,
-		ConfigModified: onConfigModified,
-		HTTPRegister:   httpRegister,
+		Enabled:           config.DNS.QueryLogEnabled,
+		BaseDir:           baseDir,
+		Interval:          config.DNS.QueryLogInterval,
+		MemSize:           config.DNS.QueryLogMemSize,
+		Backend:           config.DNS.QueryLogBackend,
+		BackendURL:        config.DNS.QueryLogBackendURL,
+		SyslogURL:         config.DNS.QueryLogSyslogURL,
+		WebhookURL:        config.DNS.QueryLogWebhookURL,
+		MaxSize:           config.DNS.QueryLogMaxSize,
+		Compression:       config.DNS.QueryLogCompression,
+		AnonymizeClientIP: config.DNS.QueryLogAnonymizeClientIP,
+		HashClientIP:      config.DNS.QueryLogHashClientIP,
+		BlockedOnly:       config.DNS.QueryLogBlockedOnly,
+		IgnoredClient:     Context.clients.IsQueryLogIgnored,
+		ConfigModified:    onConfigModified,
+		HTTPRegister:      httpRegister,
 	}
 	Context.queryLog = querylog.New(conf)
 
@@ -60,8 +78,18 @@ func initDNSServer() error {
 	filterConf.ResolverAddress = fmt.Sprintf("%s:%d", bindhost, config.DNS.Port)
 	filterConf.ConfigModified = onConfigModified
 	filterConf.HTTPRegister = httpRegister
+	filterConf.UserRulesExpired = onUserRulesExpired
+	if filterConf.PersistentCacheEnabled {
+		filterConf.CacheFilePath = filepath.Join(baseDir, "sbpc_cache.db")
+	}
 	Context.dnsFilter = dnsfilter.New(&filterConf, nil)
 
+	Context.plugins, err = loadPlugins(config.Plugins)
+	if err != nil {
+		closeDNSServer()
+		return err
+	}
+
 	Context.dnsServer = dnsforward.NewServer(Context.dnsFilter, Context.stats, Context.queryLog)
 	dnsConfig := generateServerConfig()
 	err = Context.dnsServer.Prepare(&dnsConfig)
@@ -71,17 +99,37 @@ func initDNSServer() error {
 	}
 
 	sessFilename := filepath.Join(baseDir, "sessions.db")
-	Context.auth = InitAuth(sessFilename, config.Users, config.WebSessionTTLHours*60*60)
+	Context.auth = InitAuth(sessFilename, config.Users, config.APITokens, config.WebSessionTTLHours*60*60)
 	if Context.auth == nil {
 		closeDNSServer()
 		return fmt.Errorf("Couldn't initialize Auth module")
 	}
 	config.Users = nil
+	config.APITokens = nil
+	Context.auth.limiter = newAuthLimiter(config.AuthAttempts, config.AuthBlockMin)
+	Context.auth.audit = newAuthAudit(filepath.Join(baseDir, "login_audit.json"))
+	Context.auth.onUsersModified = onConfigModified
 
 	Context.rdns = InitRDNS(Context.dnsServer, &Context.clients)
 	Context.whois = initWhois(&Context.clients)
+	Context.discovery = initDiscovery(config.Discovery, &Context.clients)
+	Context.discovery.Start()
+	Context.vpnClients = initVPNClients(config.VPN, &Context.clients, Context.client)
+	Context.vpnClients.Start()
+	Context.activity = initActivity(filepath.Join(baseDir, "activity.json"))
+	Context.blockPage = initBlockPage(config.BlockPage, filepath.Join(baseDir, "unblock_requests.json"))
+	Context.blockPage.Start()
+	Context.acme = initACME(config.ACME, filepath.Join(baseDir, "acme"), Context.client)
+	Context.acme.Start()
+	Context.replica = initReplica(config.Sync, Context.client)
+	Context.ha = initHA(config.HA, Context.dhcpServer, Context.client)
+	Context.ha.Start()
+	Context.notifier = initNotifier(config.Notifications, baseDir, Context.dhcpServer, Context.client)
+	Context.notifier.Start()
+	Context.recentHosts = newRecentHosts(recentAllowedMax)
 
 	initFiltering()
+	Context.replica.Start()
 	return nil
 }
 
@@ -159,14 +207,61 @@ func onDNSRequest(d *proxy.DNSContext) {
 	}
 }
 
+func onDNSResponse(d *proxy.DNSContext, res *dnsfilter.Result) {
+	if Context.blockPage != nil {
+		Context.blockPage.onDNSResponse(d, res)
+	}
+
+	if Context.recentHosts != nil {
+		Context.recentHosts.onDNSResponse(d, res)
+	}
+
+	if config.DNS.ActivityEnabled && Context.activity != nil {
+		Context.activity.onDNSResponse(d, res)
+	}
+
+	if Context.notifier != nil {
+		Context.notifier.onDNSResponse(d, res)
+	}
+}
+
+// Block non-essential services while the upstream budget is exceeded
+func applyBudgetBlockedServices(setts *dnsfilter.RequestFilteringSettings) {
+	if Context.dnsServer == nil {
+		return
+	}
+
+	for _, name := range Context.dnsServer.BudgetBlockedServices() {
+		rules, ok := serviceRules[name]
+		if !ok {
+			log.Error("unknown service name: %s", name)
+			continue
+		}
+		setts.ServicesRules = append(setts.ServicesRules, dnsfilter.ServiceEntry{
+			Name:  name,
+			Rules: rules,
+		})
+	}
+}
+
 func generateServerConfig() dnsforward.ServerConfig {
 	newconfig := dnsforward.ServerConfig{
-		UDPListenAddr:   &net.UDPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.DNS.Port},
-		TCPListenAddr:   &net.TCPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.DNS.Port},
-		FilteringConfig: config.DNS.FilteringConfig,
-		ConfigModified:  onConfigModified,
-		HTTPRegister:    httpRegister,
-		OnDNSRequest:    onDNSRequest,
+		UDPListenAddr:    &net.UDPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.DNS.Port},
+		TCPListenAddr:    &net.TCPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.DNS.Port},
+		FilteringConfig:  config.DNS.FilteringConfig,
+		ConfigModified:   onConfigModified,
+		HTTPRegister:     httpRegister,
+		OnDNSRequest:     onDNSRequest,
+		OnDNSResponse:    onDNSResponse,
+		OnMDNSHost:       onMDNSHost,
+		OnUpstreamStatus: onUpstreamStatus,
+		HealthCheck:      checkHealth,
+		Plugins:          Context.plugins,
+		ResolveDHCPHost:  resolveDHCPHost,
+		ResolveDHCPAddr:  resolveDHCPAddr,
+		LogQueries:       config.LogQueries,
+		ActivatedUDP:     Context.activated.dnsUDP,
+		ActivatedTCP:     Context.activated.dnsTCP,
 	}
 
 	if config.TLS.Enabled {
@@ -174,19 +269,59 @@ func generateServerConfig() dnsforward.ServerConfig {
 		if config.TLS.PortDNSOverTLS != 0 {
 			newconfig.TLSListenAddr = &net.TCPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.TLS.PortDNSOverTLS}
 		}
+		if config.TLS.PortDNSOverQUIC != 0 {
+			newconfig.QUICListenAddr = &net.UDPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.TLS.PortDNSOverQUIC}
+		}
 	}
 
 	newconfig.FilterHandler = applyAdditionalFiltering
 	newconfig.GetUpstreamsByClient = getUpstreamsByClient
+	newconfig.GetDNSSECModeByClient = getDNSSECModeByClient
+	newconfig.GetRatelimitByClient = getRatelimitByClient
+	newconfig.GetBlockedRecordTypesByClient = getBlockedRecordTypesByClient
 	return newconfig
 }
 
-func getUpstreamsByClient(clientAddr string) []upstream.Upstream {
+// Use the host names received via mDNS for the clients
+func onMDNSHost(ip, host string) {
+	_, _ = Context.clients.AddHost(ip, host, ClientSourceMDNS)
+}
+
+// Resolve the host names of DHCP clients in the local domain
+func resolveDHCPHost(host string) ([]net.IP, bool) {
+	if Context.dhcpServer == nil {
+		return nil, false
+	}
+	return Context.dhcpServer.LookupHost(host)
+}
+
+func resolveDHCPAddr(ip net.IP) string {
+	if Context.dhcpServer == nil {
+		return ""
+	}
+	return Context.dhcpServer.LookupAddr(ip)
+}
+
+func getUpstreamsByClient(clientAddr string) *dnsforward.ClientUpstreams {
 	return Context.clients.FindUpstreams(clientAddr)
 }
 
+func getDNSSECModeByClient(clientAddr string) string {
+	return Context.clients.FindDNSSECMode(clientAddr)
+}
+
+func getRatelimitByClient(clientAddr string) uint32 {
+	return Context.clients.FindRatelimit(clientAddr)
+}
+
+func getBlockedRecordTypesByClient(clientAddr string) []string {
+	return Context.clients.FindBlockedRecordTypes(clientAddr)
+}
+
 // If a client has his own settings, apply them
 func applyAdditionalFiltering(clientAddr string, setts *dnsfilter.RequestFilteringSettings) {
+	defer applyBudgetBlockedServices(setts)
+
 	ApplyBlockedServices(setts, config.DNS.BlockedServices)
 
 	if len(clientAddr) == 0 {
@@ -205,6 +340,8 @@ func applyAdditionalFiltering(clientAddr string, setts *dnsfilter.RequestFilteri
 	}
 
 	setts.ClientTags = c.Tags
+	setts.ClientName = c.Name
+	setts.AllowlistOnly = c.AllowlistOnly
 
 	if !c.UseOwnSettings {
 		return
@@ -223,12 +360,13 @@ func startDNSServer() error {
 
 	enableFilters(false)
 
-	err := Context.dnsServer.Start()
+	err := startDNSServerRetry()
 	if err != nil {
 		return errorx.Decorate(err, "Couldn't start forwarding DNS server")
 	}
 
 	Context.dnsFilter.Start()
+	Context.dnsFilter.SetRulesExpiry(config.UserRulesExpiry)
 	startFiltering()
 	Context.stats.Start()
 	Context.queryLog.Start()
@@ -248,6 +386,42 @@ func startDNSServer() error {
 	return nil
 }
 
+// When AdGuard Home is restarted, the previous instance may still be completing the requests in progress
+// (see dnsforward.Server.Shutdown()), so its listening sockets are busy for a short time
+const (
+	bindRetryTimeout  = 5 * time.Second
+	bindRetryInterval = 200 * time.Millisecond
+)
+
+// Start the DNS server.  Retry while the listen address is in use.
+func startDNSServerRetry() error {
+	deadline := time.Now().Add(bindRetryTimeout)
+	for {
+		err := Context.dnsServer.Start()
+		if err == nil || !isAddrInUse(err) || time.Now().After(deadline) {
+			return err
+		}
+		log.Info("DNS: the listen address is in use, retrying: %s", err)
+		time.Sleep(bindRetryInterval)
+	}
+}
+
+// Return TRUE if the error or one of its causes is "address already in use"
+func isAddrInUse(err error) bool {
+	for err != nil {
+		if util.ErrorIsAddrInUse(err) {
+			return true
+		}
+		e, ok := err.(*errorx.Error)
+		if ok {
+			err = e.Cause()
+			continue
+		}
+		err = errors.Unwrap(err)
+	}
+	return false
+}
+
 func reconfigureDNSServer() error {
 	newconfig := generateServerConfig()
 	err := Context.dnsServer.Reconfigure(&newconfig)
@@ -263,7 +437,7 @@ func stopDNSServer() error {
 		return nil
 	}
 
-	err := Context.dnsServer.Stop()
+	err := Context.dnsServer.Shutdown()
 	if err != nil {
 		return errorx.Decorate(err, "Couldn't stop forwarding DNS server")
 	}
@@ -279,6 +453,9 @@ func closeDNSServer() {
 		Context.dnsServer = nil
 	}
 
+	closePlugins(Context.plugins)
+	Context.plugins = nil
+
 	if Context.dnsFilter != nil {
 		Context.dnsFilter.Close()
 		Context.dnsFilter = nil
@@ -299,5 +476,45 @@ func closeDNSServer() {
 		Context.auth = nil
 	}
 
+	if Context.activity != nil {
+		Context.activity.Close()
+		Context.activity = nil
+	}
+
+	if Context.notifier != nil {
+		Context.notifier.Close()
+		Context.notifier = nil
+	}
+
+	if Context.ha != nil {
+		Context.ha.Close()
+		Context.ha = nil
+	}
+
+	if Context.replica != nil {
+		Context.replica.Close()
+		Context.replica = nil
+	}
+
+	if Context.acme != nil {
+		Context.acme.Close()
+		Context.acme = nil
+	}
+
+	if Context.blockPage != nil {
+		Context.blockPage.Close()
+		Context.blockPage = nil
+	}
+
+	if Context.discovery != nil {
+		Context.discovery.Close()
+		Context.discovery = nil
+	}
+
+	if Context.vpnClients != nil {
+		Context.vpnClients.Close()
+		Context.vpnClients = nil
+	}
+
 	log.Debug("Closed all DNS modules")
 }
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -21,10 +23,15 @@ import (
 var (
 	nextFilterID      = time.Now().Unix() // semi-stable way to generate an unique ID
 	filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
+	filterMetaRegexp  = regexp.MustCompile(`^! (Homepage|Version|Expires): *(.*)$`)
+	expiresRegexp     = regexp.MustCompile(`^(\d+) *(days?|d|hours?|h)?\b`)
 	refreshStatus     uint32 // 0:none; 1:in progress
 	refreshLock       sync.Mutex
 )
 
+// A filter list is considered stale if it isn't updated within this time after the scheduled update
+const filterStaleGap = 24 * time.Hour
+
 func initFiltering() {
 	loadFilters()
 	deduplicateFilters()
@@ -36,6 +43,7 @@ func startFiltering() {
 	//  but currently we can't wake up the periodic task to do so.
 	// So for now we just start this periodic task from here.
 	go periodicallyRefreshFilters()
+	go watchLocalFilters()
 }
 
 func defaultFilters() []filter {
@@ -51,10 +59,24 @@ func defaultFilters() []filter {
 type filter struct {
 	Enabled     bool
 	URL         string
-	Name        string    `yaml:"name"`
-	RulesCount  int       `yaml:"-"`
-	LastUpdated time.Time `yaml:"-"`
-	checksum    uint32    // checksum of the file data
+	Name        string        `yaml:"name"`
+	RulesCount  int           `yaml:"-"`
+	LastUpdated time.Time     `yaml:"-"`
+	Homepage    string        `yaml:"-"` // "! Homepage:" header of the filter list
+	Version     string        `yaml:"-"` // "! Version:" header of the filter list
+	Expires     time.Duration `yaml:"-"` // update interval from "! Expires:" header.  0: not specified
+	checksum    uint32        // checksum of the file data
+
+	// Update interval (in hours) for this filter list.
+	// 0: use the interval from the filter list header or the global interval
+	UpdateInterval uint32 `yaml:"update_interval"`
+
+	// Authentication for private filter lists
+	Auth filterAuth `yaml:"auth"`
+
+	// Validators from the last response, used for conditional requests
+	ETag         string `yaml:"etag"`
+	LastModified string `yaml:"last_modified"`
 
 	dnsfilter.Filter `yaml:",inline"`
 }
@@ -65,10 +87,75 @@ func userFilter() filter {
 		// User filter always has constant ID=0
 		Enabled: true,
 	}
-	f.Filter.Data = []byte(strings.Join(config.UserRules, "\n"))
+	rules := removeUserRules(config.UserRules, expiredUserRules(config.UserRulesExpiry, time.Now()))
+	f.Filter.Data = []byte(strings.Join(rules, "\n"))
 	return f
 }
 
+// Get the user rules which have expired by the specified time
+func expiredUserRules(expiry []dnsfilter.RuleExpiry, now time.Time) []string {
+	expired := []string{}
+	for _, e := range expiry {
+		if !e.Until.After(now) {
+			expired = append(expired, e.Rule)
+		}
+	}
+	return expired
+}
+
+// Get the list of rules without the specified ones
+func removeUserRules(rules []string, remove []string) []string {
+	if len(remove) == 0 {
+		return rules
+	}
+	m := map[string]bool{}
+	for _, r := range remove {
+		m[r] = true
+	}
+	list := []string{}
+	for _, r := range rules {
+		if !m[r] {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// Get the expiration times only for the rules from the list
+func filterUserRulesExpiry(rules []string, expiry []dnsfilter.RuleExpiry) []dnsfilter.RuleExpiry {
+	m := map[string]bool{}
+	for _, r := range rules {
+		m[r] = true
+	}
+	list := []dnsfilter.RuleExpiry{}
+	for _, e := range expiry {
+		if m[e.Rule] {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Called by dnsfilter when user rules expire
+func onUserRulesExpired(expired []string) {
+	Context.controlLock.Lock()
+	defer Context.controlLock.Unlock()
+
+	config.Lock()
+	config.UserRules = removeUserRules(config.UserRules, expired)
+	config.UserRulesExpiry = filterUserRulesExpiry(config.UserRules, config.UserRulesExpiry)
+	config.Unlock()
+	onConfigModified()
+
+	log.Info("Filtering: removed %d expired user rules", len(expired))
+	userFilter := userFilter()
+	err := userFilter.save()
+	if err != nil {
+		log.Error("Couldn't save the user filter: %s", err)
+	}
+	enableFilters(true)
+}
+
 const (
 	statusFound          = 1
 	statusEnabledChanged = 2
@@ -77,8 +164,9 @@ const (
 )
 
 // Update properties for a filter specified by its URL
+// auth: new authentication settings (nil: don't change)
 // Return status* flags.
-func filterSetProperties(url string, newf filter) int {
+func filterSetProperties(url string, newf filter, auth *filterAuth) int {
 	r := 0
 	config.Lock()
 	defer config.Unlock()
@@ -92,6 +180,10 @@ func filterSetProperties(url string, newf filter) int {
 		log.Debug("filter: set properties: %s: {%s %s %v}",
 			f.URL, newf.Name, newf.URL, newf.Enabled)
 		f.Name = newf.Name
+		f.UpdateInterval = newf.UpdateInterval
+		if auth != nil {
+			f.Auth = *auth
+		}
 
 		if f.URL != newf.URL {
 			r |= statusURLChanged
@@ -101,6 +193,8 @@ func filterSetProperties(url string, newf filter) int {
 			f.URL = newf.URL
 			f.unload()
 			f.LastUpdated = time.Time{}
+			f.ETag = ""
+			f.LastModified = ""
 		}
 
 		if f.Enabled != newf.Enabled {
@@ -291,8 +385,7 @@ func refreshFiltersIfNecessary(force bool) (int, bool) {
 			continue
 		}
 
-		expireTime := f.LastUpdated.Unix() + int64(config.DNS.FiltersUpdateIntervalHours)*60*60
-		if !force && expireTime > now.Unix() {
+		if !force && f.nextUpdate().After(now) {
 			continue
 		}
 
@@ -300,6 +393,9 @@ func refreshFiltersIfNecessary(force bool) (int, bool) {
 		uf.ID = f.ID
 		uf.URL = f.URL
 		uf.Name = f.Name
+		uf.Auth = f.Auth
+		uf.ETag = f.ETag
+		uf.LastModified = f.LastModified
 		uf.checksum = f.checksum
 		updateFilters = append(updateFilters, uf)
 	}
@@ -317,6 +413,16 @@ func refreshFiltersIfNecessary(force bool) (int, bool) {
 		if err != nil {
 			nfail++
 			log.Printf("Failed to update filter %s: %s\n", uf.URL, err)
+			notifyEvent(event{
+				Type:    eventFilterUpdateFailed,
+				Message: fmt.Sprintf("Failed to update filter list %s: %s", uf.Name, err),
+				Data: map[string]string{
+					"name":  uf.Name,
+					"url":   uf.URL,
+					"error": err.Error(),
+				},
+				key: uf.URL,
+			})
 			continue
 		}
 		uf.LastUpdated = now
@@ -350,6 +456,8 @@ func refreshFiltersIfNecessary(force bool) (int, bool) {
 				continue
 			}
 			f.LastUpdated = uf.LastUpdated
+			f.ETag = uf.ETag
+			f.LastModified = uf.LastModified
 			if !updated {
 				continue
 			}
@@ -359,6 +467,9 @@ func refreshFiltersIfNecessary(force bool) (int, bool) {
 			f.Name = uf.Name
 			f.Data = nil
 			f.RulesCount = uf.RulesCount
+			f.Homepage = uf.Homepage
+			f.Version = uf.Version
+			f.Expires = uf.Expires
 			f.checksum = uf.checksum
 			updateCount++
 		}
@@ -393,11 +504,35 @@ func isPrintableText(data []byte) bool {
 	return true
 }
 
-// A helper function that parses filter contents and returns a number of rules and a filter name (if there's any)
-func parseFilterContents(contents []byte) (int, string) {
+// Metadata of a filter list
+type filterMetadata struct {
+	RulesCount int
+	Title      string
+	Homepage   string
+	Version    string
+	Expires    time.Duration // 0: not specified
+}
+
+// Parse the value of "! Expires:" header, e.g. "4 days (update frequency)" or "12 hours"
+func parseFilterExpires(s string) time.Duration {
+	m := expiresRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if strings.HasPrefix(m[2], "h") {
+		return time.Duration(n) * time.Hour
+	}
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// A helper function that parses filter contents and returns a number of rules and the metadata from the header
+func parseFilterContents(contents []byte) filterMetadata {
 	data := string(contents)
-	rulesCount := 0
-	name := ""
+	meta := filterMetadata{}
 	seenTitle := false
 
 	// Count lines in the filter
@@ -410,38 +545,147 @@ func parseFilterContents(contents []byte) (int, string) {
 		if line[0] == '!' {
 			m := filterTitleRegexp.FindAllStringSubmatch(line, -1)
 			if len(m) > 0 && len(m[0]) >= 2 && !seenTitle {
-				name = m[0][1]
+				meta.Title = m[0][1]
 				seenTitle = true
+				continue
+			}
+
+			mm := filterMetaRegexp.FindStringSubmatch(line)
+			if mm == nil {
+				continue
+			}
+			switch mm[1] {
+			case "Homepage":
+				if len(meta.Homepage) == 0 {
+					meta.Homepage = strings.TrimSpace(mm[2])
+				}
+			case "Version":
+				if len(meta.Version) == 0 {
+					meta.Version = strings.TrimSpace(mm[2])
+				}
+			case "Expires":
+				if meta.Expires == 0 {
+					meta.Expires = parseFilterExpires(mm[2])
+				}
 			}
 		} else {
-			rulesCount++
+			meta.RulesCount++
 		}
 	}
 
-	return rulesCount, name
+	return meta
 }
 
-// Perform upgrade on a filter
-func (filter *filter) update() (bool, error) {
+// Set the properties from the filter list metadata
+func (filter *filter) setMetadata(meta filterMetadata) {
+	filter.RulesCount = meta.RulesCount
+	filter.Homepage = meta.Homepage
+	filter.Version = meta.Version
+	filter.Expires = meta.Expires
+}
+
+// Get the update interval for the filter list:
+// the interval set for this list, the interval from the list's "Expires" header or the global interval
+// Return 0 if the automatic updates are disabled
+func (filter *filter) updateInterval() time.Duration {
+	if config.DNS.FiltersUpdateIntervalHours == 0 {
+		return 0
+	}
+	if filter.UpdateInterval != 0 {
+		return time.Duration(filter.UpdateInterval) * time.Hour
+	}
+	if filter.Expires != 0 {
+		return filter.Expires
+	}
+	return time.Duration(config.DNS.FiltersUpdateIntervalHours) * time.Hour
+}
+
+// Get the time when the filter list should be updated
+func (filter *filter) nextUpdate() time.Time {
+	return filter.LastUpdated.Add(filter.updateInterval())
+}
+
+// Get the outbound proxy for filter lists download requests
+func filtersProxy(r *http.Request) (*url.URL, error) {
+	config.RLock()
+	proxyURL := config.DNS.FiltersProxyURL
+	config.RUnlock()
+
+	if len(proxyURL) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, fmt.Errorf("invalid proxy URL: unsupported scheme %s", u.Scheme)
+}
+
+// Download filter data
+// Return nil if the data hasn't been modified since the last update
+func (filter *filter) download() ([]byte, error) {
 	log.Tracef("Downloading update for filter %d from %s", filter.ID, filter.URL)
 
-	resp, err := Context.client.Get(filter.URL)
+	req, err := http.NewRequest("GET", filter.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	filter.Auth.apply(req)
+	// don't download the data again if it hasn't changed on server,
+	// but only if we have the file
+	if filter.checksum != 0 {
+		if len(filter.ETag) != 0 {
+			req.Header.Set("If-None-Match", filter.ETag)
+		}
+		if len(filter.LastModified) != 0 {
+			req.Header.Set("If-Modified-Since", filter.LastModified)
+		}
+	}
+
+	resp, err := Context.filtersClient.Do(req)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
 		log.Printf("Couldn't request filter from URL %s, skipping: %s", filter.URL, err)
-		return false, err
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && filter.checksum != 0 {
+		log.Tracef("Filter #%d at URL %s hasn't been modified", filter.ID, filter.URL)
+		return nil, nil
 	}
 
 	if resp.StatusCode != 200 {
 		log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, filter.URL)
-		return false, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+		return nil, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("Couldn't fetch filter contents from URL %s, skipping: %s", filter.URL, err)
+		return nil, err
+	}
+
+	filter.ETag = resp.Header.Get("ETag")
+	filter.LastModified = resp.Header.Get("Last-Modified")
+	return body, nil
+}
+
+// Perform upgrade on a filter
+func (filter *filter) update() (bool, error) {
+	var body []byte
+	var err error
+	if isLocalFilterURL(filter.URL) {
+		body, err = readLocalFilter(filter.URL)
+	} else {
+		body, err = filter.download()
+	}
+	if err != nil || body == nil {
 		return false, err
 	}
 
@@ -469,12 +713,12 @@ func (filter *filter) update() (bool, error) {
 	}
 
 	// Extract filter name and count number of rules
-	rulesCount, filterName := parseFilterContents(body)
-	log.Printf("Filter %d has been updated: %d bytes, %d rules", filter.ID, len(body), rulesCount)
-	if filterName != "" {
-		filter.Name = filterName
+	meta := parseFilterContents(body)
+	log.Printf("Filter %d has been updated: %d bytes, %d rules", filter.ID, len(body), meta.RulesCount)
+	if meta.Title != "" {
+		filter.Name = meta.Title
 	}
-	filter.RulesCount = rulesCount
+	filter.setMetadata(meta)
 	filter.Data = body
 	filter.checksum = checksum
 
@@ -521,9 +765,8 @@ func (filter *filter) load() error {
 	}
 
 	log.Tracef("File %s, id %d, length %d", filterFilePath, filter.ID, len(filterFileContents))
-	rulesCount, _ := parseFilterContents(filterFileContents)
+	filter.setMetadata(parseFilterContents(filterFileContents))
 
-	filter.RulesCount = rulesCount
 	filter.Data = nil
 	filter.checksum = crc32.ChecksumIEEE(filterFileContents)
 	filter.LastUpdated = filter.LastTimeUpdated()
@@ -0,0 +1,221 @@
+// Filter list recommendations based on the observed traffic
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	recentAllowedMax      = 10000 // the number of recently allowed host names we keep
+	recommendExamplesMax  = 10    // the number of matched host names returned for a filter list
+	filterRuleMemCost     = 120   // approximate memory (in bytes) used by a rule in the filtering engine
+	filterCatalogMaxBytes = 64 * 1024 * 1024
+)
+
+// A filter list which may be recommended
+type filterCatalogEntry struct {
+	Name string
+	URL  string
+}
+
+// Well-known filter lists
+var filterCatalog = []filterCatalogEntry{
+	{"AdGuard Simplified Domain Names filter", "https://adguardteam.github.io/AdGuardSDNSFilter/Filters/filter.txt"},
+	{"AdAway", "https://adaway.org/hosts.txt"},
+	{"hpHosts - Ad and Tracking servers only", "https://hosts-file.net/ad_servers.txt"},
+	{"MalwareDomainList.com Hosts List", "https://www.malwaredomainlist.com/hostslist/hosts.txt"},
+	{"Peter Lowe's List", "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=adblockplus&showintro=1&mimetype=plaintext"},
+	{"Dan Pollock's List", "https://someonewhocares.org/hosts/zero/hosts"},
+	{"WindowsSpyBlocker - Hosts spy rules", "https://raw.githubusercontent.com/crazy-max/WindowsSpyBlocker/master/data/hosts/spy.txt"},
+	{"EasyPrivacy", "https://easylist.to/easylist/easyprivacy.txt"},
+}
+
+// recentHosts is a set of the recently allowed host names
+type recentHosts struct {
+	lock  sync.Mutex
+	hosts map[string]bool
+	max   int
+}
+
+func newRecentHosts(max int) *recentHosts {
+	return &recentHosts{
+		hosts: make(map[string]bool),
+		max:   max,
+	}
+}
+
+func (r *recentHosts) add(host string) {
+	r.lock.Lock()
+	if !r.hosts[host] {
+		if len(r.hosts) >= r.max {
+			// remove an arbitrary entry
+			for k := range r.hosts {
+				delete(r.hosts, k)
+				break
+			}
+		}
+		r.hosts[host] = true
+	}
+	r.lock.Unlock()
+}
+
+func (r *recentHosts) list() []string {
+	r.lock.Lock()
+	list := make([]string, 0, len(r.hosts))
+	for h := range r.hosts {
+		list = append(list, h)
+	}
+	r.lock.Unlock()
+	sort.Strings(list)
+	return list
+}
+
+// Called by DNS module when the response is ready
+func (r *recentHosts) onDNSResponse(d *proxy.DNSContext, res *dnsfilter.Result) {
+	if len(d.Req.Question) == 0 || (res != nil && res.Reason.Matched()) ||
+		d.Res == nil || d.Res.Rcode != dns.RcodeSuccess {
+		return
+	}
+	r.add(strings.ToLower(strings.TrimSuffix(d.Req.Question[0].Name, ".")))
+}
+
+type filterRecommendation struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Matched    int      `json:"matched"`     // the number of the allowed host names which would be blocked by this list
+	Examples   []string `json:"examples"`    // some of the matched host names
+	RulesCount int      `json:"rules_count"` // the number of rules that would be added
+	MemoryCost int      `json:"memory_cost"` // estimated memory usage (in bytes)
+}
+
+type filterRecommendationsJSON struct {
+	HostsChecked    int                    `json:"hosts_checked"`
+	Recommendations []filterRecommendation `json:"recommendations"`
+	Errors          []string               `json:"errors"` // the lists which couldn't be downloaded
+}
+
+// Get the host names (from the list) which are blocked by the filter list
+func matchFilterList(data string, hosts []string) []string {
+	d := dnsfilter.New(nil, map[int]string{0: data})
+	if d == nil {
+		return nil
+	}
+	defer d.Close()
+
+	setts := dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	matched := []string{}
+	for _, host := range hosts {
+		res, err := d.CheckHostRules(host, dns.TypeA, &setts)
+		if err == nil && res.IsFiltered {
+			matched = append(matched, host)
+		}
+	}
+	return matched
+}
+
+// Download a filter list
+func downloadFilterList(url string) ([]byte, error) {
+	resp, err := Context.filtersClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, filterCatalogMaxBytes))
+}
+
+// Get the filter lists from the catalog which aren't enabled
+func candidateFilterLists() []filterCatalogEntry {
+	enabled := map[string]bool{}
+	config.RLock()
+	for _, f := range config.Filters {
+		if f.Enabled {
+			enabled[f.URL] = true
+		}
+	}
+	config.RUnlock()
+
+	list := []filterCatalogEntry{}
+	for _, e := range filterCatalog {
+		if !enabled[e.URL] {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Check the recently allowed host names against the candidate filter lists
+func recommendFilterLists(hosts []string, candidates []filterCatalogEntry,
+	download func(url string) ([]byte, error)) filterRecommendationsJSON {
+
+	resp := filterRecommendationsJSON{
+		HostsChecked:    len(hosts),
+		Recommendations: []filterRecommendation{},
+		Errors:          []string{},
+	}
+
+	for _, e := range candidates {
+		data, err := download(e.URL)
+		if err != nil {
+			log.Debug("Filter recommendations: %s: %s", e.URL, err)
+			resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %s", e.URL, err))
+			continue
+		}
+
+		matched := matchFilterList(string(data), hosts)
+		if len(matched) == 0 {
+			continue
+		}
+
+		rulesCount := parseFilterContents(data).RulesCount
+		r := filterRecommendation{
+			Name:       e.Name,
+			URL:        e.URL,
+			Matched:    len(matched),
+			Examples:   matched,
+			RulesCount: rulesCount,
+			MemoryCost: rulesCount * filterRuleMemCost,
+		}
+		if len(r.Examples) > recommendExamplesMax {
+			r.Examples = r.Examples[:recommendExamplesMax]
+		}
+		resp.Recommendations = append(resp.Recommendations, r)
+	}
+
+	sort.SliceStable(resp.Recommendations, func(i, j int) bool {
+		return resp.Recommendations[i].Matched > resp.Recommendations[j].Matched
+	})
+	return resp
+}
+
+func handleFilteringRecommendations(w http.ResponseWriter, r *http.Request) {
+	if Context.recentHosts == nil {
+		httpError(w, http.StatusInternalServerError, "DNS server isn't initialized")
+		return
+	}
+
+	resp := recommendFilterLists(Context.recentHosts.list(), candidateFilterLists(), downloadFilterList)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
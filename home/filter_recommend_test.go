@@ -0,0 +1,53 @@
+package home
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterRecommendations(t *testing.T) {
+	r := newRecentHosts(3)
+	r.add("ads.example.org")
+	r.add("tracker.example.com")
+	r.add("example.net")
+	r.add("example.net")
+	assert.Equal(t, []string{"ads.example.org", "example.net", "tracker.example.com"}, r.list())
+	r.add("another.example.net")
+	assert.Equal(t, 3, len(r.list()))
+
+	hosts := []string{"ads.example.org", "tracker.example.com", "example.net", "www.example.org"}
+	candidates := []filterCatalogEntry{
+		{"list1", "http://list1"},
+		{"list2", "http://list2"},
+		{"list3", "http://list3"},
+		{"list4", "http://list4"},
+	}
+	lists := map[string]string{
+		"http://list1": "! Title: List 1\n||ads.example.org^\n||other.example.org^\n",
+		"http://list2": "0.0.0.0 ads.example.org\n0.0.0.0 tracker.example.com\n",
+		"http://list3": "||nothing.example.org^\n",
+	}
+	download := func(url string) ([]byte, error) {
+		data, ok := lists[url]
+		if !ok {
+			return nil, fmt.Errorf("not found")
+		}
+		return []byte(data), nil
+	}
+
+	resp := recommendFilterLists(hosts, candidates, download)
+	assert.Equal(t, 4, resp.HostsChecked)
+	assert.Equal(t, 1, len(resp.Errors))
+	assert.Equal(t, 2, len(resp.Recommendations))
+
+	assert.Equal(t, "list2", resp.Recommendations[0].Name)
+	assert.Equal(t, 2, resp.Recommendations[0].Matched)
+	assert.Equal(t, []string{"ads.example.org", "tracker.example.com"}, resp.Recommendations[0].Examples)
+	assert.Equal(t, 2, resp.Recommendations[0].RulesCount)
+	assert.Equal(t, 2*filterRuleMemCost, resp.Recommendations[0].MemoryCost)
+
+	assert.Equal(t, "list1", resp.Recommendations[1].Name)
+	assert.Equal(t, 1, resp.Recommendations[1].Matched)
+}
@@ -0,0 +1,186 @@
+// Filter list sources: local directories and HTTP servers with authentication
+
+package home
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const localFiltersCheckInterval = 10 * time.Second
+
+// Authentication types for private filter lists
+const (
+	filterAuthNone   = ""
+	filterAuthBasic  = "basic"
+	filterAuthBearer = "bearer"
+)
+
+// Authentication for private filter lists
+type filterAuth struct {
+	Type     string `yaml:"type" json:"type"`         // "": none, "basic", "bearer"
+	Username string `yaml:"username" json:"username"` // for "basic"
+	Password string `yaml:"password" json:"password"` // password for "basic" or token for "bearer"
+}
+
+func (a *filterAuth) check() error {
+	switch a.Type {
+	case filterAuthNone, filterAuthBearer:
+		return nil
+	case filterAuthBasic:
+		if len(a.Username) == 0 {
+			return fmt.Errorf("username is required")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown authentication type: %s", a.Type)
+}
+
+// Add the authentication headers to HTTP request
+func (a *filterAuth) apply(req *http.Request) {
+	switch a.Type {
+	case filterAuthBasic:
+		req.SetBasicAuth(a.Username, a.Password)
+	case filterAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+a.Password)
+	}
+}
+
+// Return TRUE if the filter list is stored locally ("file:///path")
+func isLocalFilterURL(u string) bool {
+	return strings.HasPrefix(u, "file://")
+}
+
+// Get the local path from the filter list URL
+func localFilterPath(u string) (string, error) {
+	uu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if len(uu.Path) == 0 {
+		return "", fmt.Errorf("empty path")
+	}
+	return uu.Path, nil
+}
+
+// Get the files of the local filter list.
+// If the path is a directory, all its files are used.
+func localFilterFiles(u string) ([]string, error) {
+	path, err := localFilterPath(u)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return []string{path}, nil
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+			files = append(files, filepath.Join(path, fi.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Read the local filter list
+func readLocalFilter(u string) ([]byte, error) {
+	files, err := localFilterFiles(u)
+	if err != nil {
+		return nil, err
+	}
+
+	data := []byte{}
+	for _, fn := range files {
+		d, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, d...)
+		if len(d) != 0 && d[len(d)-1] != '\n' {
+			data = append(data, '\n')
+		}
+	}
+	return data, nil
+}
+
+// Get the state of the local filter list files: names, sizes and modification times
+func localFilterState(u string) string {
+	files, err := localFilterFiles(u)
+	if err != nil {
+		return ""
+	}
+
+	state := ""
+	for _, fn := range files {
+		st, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		state += fmt.Sprintf("%s %d %d\n", fn, st.Size(), st.ModTime().UnixNano())
+	}
+	return state
+}
+
+// Check local filter lists for changes and reload the changed ones
+func watchLocalFilters() {
+	states := map[int64]string{} // filter ID -> state of its files
+	pending := false
+	for {
+		time.Sleep(localFiltersCheckInterval)
+
+		changed := pending
+		config.Lock()
+		for i := range config.Filters {
+			f := &config.Filters[i]
+			if !f.Enabled || !isLocalFilterURL(f.URL) {
+				continue
+			}
+
+			st := localFilterState(f.URL)
+			prev, ok := states[f.ID]
+			states[f.ID] = st
+			if ok && prev != st {
+				log.Debug("Filters: local filter #%d (%s) has changed", f.ID, f.URL)
+				// the filter will be updated on the next refresh
+				f.LastUpdated = time.Time{}
+				changed = true
+			}
+		}
+		config.Unlock()
+
+		if !changed {
+			continue
+		}
+		if refreshStatus != 0 {
+			// try again later
+			pending = true
+			continue
+		}
+		pending = false
+		refreshStatus = 1
+		refreshLock.Lock()
+		_, _ = refreshFiltersIfNecessary(false)
+		refreshLock.Unlock()
+		refreshStatus = 0
+	}
+}
@@ -1,11 +1,15 @@
 package home
 
 import (
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,7 +19,7 @@ func TestFilters(t *testing.T) {
 
 	Context = homeContext{}
 	Context.workDir = dir
-	Context.client = &http.Client{
+	Context.filtersClient = &http.Client{
 		Timeout: time.Minute * 5,
 	}
 
@@ -40,3 +44,148 @@ func TestFilters(t *testing.T) {
 	f.unload()
 	_ = os.Remove(f.Path())
 }
+
+func TestUserRulesExpiry(t *testing.T) {
+	now := time.Now()
+	rules := []string{"||example.org^", "||example.com^", "||example.net^"}
+	expiry := []dnsfilter.RuleExpiry{
+		{Rule: "||example.org^", Until: now.Add(-time.Minute)},
+		{Rule: "||example.com^", Until: now.Add(time.Hour)},
+		{Rule: "||removed.org^", Until: now.Add(time.Hour)},
+	}
+
+	expired := expiredUserRules(expiry, now)
+	assert.Equal(t, []string{"||example.org^"}, expired)
+
+	rules = removeUserRules(rules, expired)
+	assert.Equal(t, []string{"||example.com^", "||example.net^"}, rules)
+
+	expiry = filterUserRulesExpiry(rules, expiry)
+	assert.Equal(t, 1, len(expiry))
+	assert.Equal(t, "||example.com^", expiry[0].Rule)
+}
+
+func TestParseFilterContents(t *testing.T) {
+	data := `! Title: Test filter
+! Homepage: https://example.org/filter
+! Version: 2.0.15
+! Expires: 4 days (update frequency)
+! Title: Another title
+||example.org^
+
+||example.com^
+`
+	meta := parseFilterContents([]byte(data))
+	assert.Equal(t, "Test filter", meta.Title)
+	assert.Equal(t, "https://example.org/filter", meta.Homepage)
+	assert.Equal(t, "2.0.15", meta.Version)
+	assert.Equal(t, 4*24*time.Hour, meta.Expires)
+	assert.Equal(t, 2, meta.RulesCount)
+
+	assert.Equal(t, 12*time.Hour, parseFilterExpires("12 hours"))
+	assert.Equal(t, 24*time.Hour, parseFilterExpires("1"))
+	assert.Equal(t, time.Duration(0), parseFilterExpires("soon"))
+}
+
+func TestFilterConditionalUpdate(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("! Expires: 12 hours\n||example.org^\n"))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.filtersClient = &http.Client{
+		Timeout: time.Minute,
+	}
+	config.DNS.FiltersUpdateIntervalHours = 24
+
+	f := filter{URL: srv.URL}
+	ok, err := f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, `"v1"`, f.ETag)
+	assert.Equal(t, 1, f.RulesCount)
+	assert.Equal(t, 12*time.Hour, f.updateInterval())
+
+	// not modified
+	ok, err = f.update()
+	assert.True(t, !ok && err == nil)
+	assert.Equal(t, 2, requests)
+
+	// the interval set by user has priority
+	f.UpdateInterval = 72
+	assert.Equal(t, 72*time.Hour, f.updateInterval())
+}
+
+func TestFiltersProxy(t *testing.T) {
+	r, _ := http.NewRequest("GET", "https://example.org/filter.txt", nil)
+
+	config.DNS.FiltersProxyURL = ""
+	u, err := filtersProxy(r)
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+
+	config.DNS.FiltersProxyURL = "socks5://127.0.0.1:1080"
+	u, err = filtersProxy(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:1080", u.Host)
+
+	config.DNS.FiltersProxyURL = "ftp://127.0.0.1"
+	_, err = filtersProxy(r)
+	assert.NotNil(t, err)
+	config.DNS.FiltersProxyURL = ""
+}
+
+func TestLocalFilter(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	absDir, _ := filepath.Abs(dir)
+	u := "file://" + absDir
+
+	_ = ioutil.WriteFile(filepath.Join(dir, "1.txt"), []byte("||example.org^"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "2.txt"), []byte("||example.com^\n"), 0644)
+	assert.True(t, isLocalFilterURL(u))
+
+	data, err := readLocalFilter(u)
+	assert.Nil(t, err)
+	assert.Equal(t, "||example.org^\n||example.com^\n", string(data))
+
+	f := filter{URL: u}
+	ok, err := f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 2, f.RulesCount)
+
+	st := localFilterState(u)
+	_ = ioutil.WriteFile(filepath.Join(dir, "3.txt"), []byte("||example.net^\n"), 0644)
+	assert.NotEqual(t, st, localFilterState(u))
+
+	ok, err = f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 3, f.RulesCount)
+}
+
+func TestFilterAuth(t *testing.T) {
+	r, _ := http.NewRequest("GET", "https://example.org/filter.txt", nil)
+	a := filterAuth{Type: "bearer", Password: "token"}
+	assert.Nil(t, a.check())
+	a.apply(r)
+	assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+	r, _ = http.NewRequest("GET", "https://example.org/filter.txt", nil)
+	a = filterAuth{Type: "basic", Username: "user", Password: "pass"}
+	assert.Nil(t, a.check())
+	a.apply(r)
+	user, pass, ok := r.BasicAuth()
+	assert.True(t, ok && user == "user" && pass == "pass")
+
+	a = filterAuth{Type: "basic"}
+	assert.NotNil(t, a.check())
+	a = filterAuth{Type: "digest"}
+	assert.NotNil(t, a.check())
+}
@@ -0,0 +1,664 @@
+// High availability: two instances share a virtual IP address,
+// only the master instance answers DHCP requests
+
+package home
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Node state
+const (
+	haMaster = "master"
+	haBackup = "backup"
+	haFault  = "fault" // set by an external program, e.g. keepalived
+)
+
+// How the master node is chosen
+const (
+	haElectionBuiltin  = "builtin"  // heartbeats between the nodes
+	haElectionExternal = "external" // the state is set via /control/ha/state (e.g. by keepalived notify script)
+)
+
+const (
+	haDefaultHeartbeatInterval = 2 // in seconds
+	haDefaultDeadInterval      = 6 // in seconds
+	haMaxSize                  = 16 * 1024 * 1024
+)
+
+type haConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+
+	// Node name.  Default: host name.
+	// If both nodes have the same priority, the node with the greater name becomes master.
+	Name string `yaml:"name" json:"name"`
+
+	// The address of the peer's web interface (e.g. "http://192.168.1.3:3000")
+	PeerURL string `yaml:"peer_url" json:"peer_url"`
+
+	// API token of the peer ("admin" scope)
+	Token string `yaml:"token" json:"token"`
+
+	// The node with the greater priority becomes master
+	Priority uint32 `yaml:"priority" json:"priority"`
+
+	// "builtin" (default) or "external"
+	Election string `yaml:"election" json:"election"`
+
+	// Virtual IP address with prefix length (e.g. "192.168.1.2/24") which is assigned to the master node.
+	// Linux only.  Not used with external election.
+	VirtualIP string `yaml:"virtual_ip" json:"virtual_ip"`
+	Interface string `yaml:"interface" json:"interface"` // network interface for the virtual IP
+
+	HeartbeatInterval uint32 `yaml:"heartbeat_interval" json:"heartbeat_interval"` // in seconds
+	// The peer is considered dead if there were no heartbeats for this time (in seconds)
+	DeadInterval uint32 `yaml:"dead_interval" json:"dead_interval"`
+
+	// The program which is executed when the node state changes: "command master|backup|fault"
+	NotifyCommand string `yaml:"notify_command" json:"notify_command"`
+}
+
+// The information about a node which is sent with each heartbeat
+type haNodeInfo struct {
+	Name       string `json:"name"`
+	Priority   uint32 `json:"priority"`
+	State      string `json:"state"`
+	LeasesHash string `json:"leases_hash"` // the hash of dynamic DHCP leases
+}
+
+// Heartbeat request
+type haHeartbeat struct {
+	haNodeInfo
+
+	// The master node sends its dynamic DHCP leases if the peer's leases are different
+	Leases []dhcpd.Lease `json:"leases,omitempty"`
+}
+
+type haStatus struct {
+	State         string     `json:"state"`
+	Peer          haNodeInfo `json:"peer"`
+	PeerAlive     bool       `json:"peer_alive"`
+	PeerLastSeen  time.Time  `json:"peer_last_seen"`
+	LastError     string     `json:"last_error"`
+	LeasesHash    string     `json:"leases_hash"`
+	LeasesSynced  bool       `json:"leases_synced"` // TRUE if the peer has the same dynamic leases
+	LastStateTime time.Time  `json:"last_state_time"`
+}
+
+// HA module
+type haNode struct {
+	conf       haConfig
+	client     *http.Client
+	dhcpServer *dhcpd.Server
+
+	lock         sync.Mutex
+	state        string
+	stateTime    time.Time
+	peer         haNodeInfo
+	peerLastSeen time.Time
+	synced       bool // TRUE if we've got the leases from the master node
+	lastError    string
+
+	transLock sync.Mutex // serialize state transitions
+
+	now  chan bool // run election right now
+	stop chan bool
+}
+
+// Create module context
+func initHA(conf haConfig, dhcpServer *dhcpd.Server, client *http.Client) *haNode {
+	h := &haNode{
+		conf:       conf,
+		dhcpServer: dhcpServer,
+		state:      haBackup,
+		now:        make(chan bool, 1),
+	}
+	if len(h.conf.Name) == 0 {
+		h.conf.Name, _ = os.Hostname()
+	}
+	if len(h.conf.Election) == 0 {
+		h.conf.Election = haElectionBuiltin
+	}
+	if h.conf.HeartbeatInterval == 0 {
+		h.conf.HeartbeatInterval = haDefaultHeartbeatInterval
+	}
+	if h.conf.DeadInterval == 0 {
+		h.conf.DeadInterval = haDefaultDeadInterval
+	}
+
+	h.client = &http.Client{
+		Timeout: time.Duration(h.conf.HeartbeatInterval) * time.Second,
+	}
+	if client != nil {
+		h.client.Transport = client.Transport
+	}
+	return h
+}
+
+func checkHAConfig(conf haConfig) error {
+	switch conf.Election {
+	case "", haElectionBuiltin, haElectionExternal:
+		//
+	default:
+		return fmt.Errorf("invalid election type: %s", conf.Election)
+	}
+
+	if len(conf.PeerURL) != 0 {
+		u, err := url.Parse(conf.PeerURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid peer URL: %s", conf.PeerURL)
+		}
+	}
+
+	if len(conf.VirtualIP) != 0 {
+		_, _, err := net.ParseCIDR(conf.VirtualIP)
+		if err != nil {
+			return fmt.Errorf("invalid virtual IP: %s", conf.VirtualIP)
+		}
+		if len(conf.Interface) == 0 {
+			return fmt.Errorf("interface isn't set")
+		}
+	}
+
+	if conf.HeartbeatInterval != 0 && conf.DeadInterval != 0 &&
+		conf.DeadInterval <= conf.HeartbeatInterval {
+		return fmt.Errorf("dead interval must be greater than heartbeat interval")
+	}
+
+	if !conf.Enabled {
+		return nil
+	}
+
+	if conf.Election != haElectionExternal {
+		if len(conf.PeerURL) == 0 {
+			return fmt.Errorf("peer URL isn't set")
+		}
+		if len(conf.VirtualIP) != 0 && runtime.GOOS != "linux" {
+			return fmt.Errorf("virtual IP is supported on Linux only")
+		}
+	}
+	if len(conf.PeerURL) != 0 && len(conf.Token) == 0 {
+		return fmt.Errorf("token isn't set")
+	}
+	return nil
+}
+
+// Start the background worker
+// The DHCP server doesn't answer requests until this node becomes master.
+func (h *haNode) Start() {
+	h.dhcpSetStandby(h.conf.Enabled)
+	if !h.conf.Enabled {
+		return
+	}
+
+	h.lock.Lock()
+	// give the peer some time to respond before we become master
+	h.peerLastSeen = time.Now()
+	h.stateTime = time.Now()
+	h.lock.Unlock()
+
+	h.stop = make(chan bool)
+	go h.workerLoop(h.stop)
+}
+
+// Close - stop the background worker and release the virtual IP
+// The DHCP server remains in standby mode.
+func (h *haNode) Close() {
+	if h.stop == nil {
+		return
+	}
+	close(h.stop)
+	h.stop = nil
+
+	h.transLock.Lock()
+	if h.getState() == haMaster {
+		h.setVirtualIP(false)
+	}
+	h.transLock.Unlock()
+}
+
+func (h *haNode) dhcpSetStandby(standby bool) {
+	if h.dhcpServer != nil {
+		h.dhcpServer.SetStandby(standby)
+	}
+}
+
+// Wake up the worker
+func (h *haNode) electNow() {
+	select {
+	case h.now <- true:
+	default:
+	}
+}
+
+func (h *haNode) workerLoop(stop chan bool) {
+	for {
+		if len(h.conf.PeerURL) != 0 {
+			err := h.heartbeat()
+			h.lock.Lock()
+			if err != nil {
+				log.Debug("HA: heartbeat: %s", err)
+				h.lastError = err.Error()
+			} else {
+				h.lastError = ""
+			}
+			h.lock.Unlock()
+		}
+
+		if h.conf.Election == haElectionBuiltin {
+			h.elect()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-h.now:
+			//
+		case <-time.After(time.Duration(h.conf.HeartbeatInterval) * time.Second):
+			//
+		}
+	}
+}
+
+// Choose the state of this node and switch to it
+func (h *haNode) elect() {
+	h.lock.Lock()
+	self := haNodeInfo{Name: h.conf.Name, Priority: h.conf.Priority, State: h.state}
+	state := h.state
+	if !h.peerAlive() {
+		state = haElect(self, nil, h.synced)
+	} else if len(h.peer.State) != 0 {
+		peer := h.peer
+		state = haElect(self, &peer, h.synced)
+	}
+	// else: we haven't heard from the peer yet
+	h.lock.Unlock()
+
+	h.setState(state)
+}
+
+// Choose the state of this node
+// peer: nil if the peer is dead
+// synced: TRUE if this node has the up-to-date DHCP leases
+func haElect(self haNodeInfo, peer *haNodeInfo, synced bool) string {
+	if peer == nil {
+		return haMaster
+	}
+
+	selfWins := self.Priority > peer.Priority ||
+		(self.Priority == peer.Priority && self.Name > peer.Name)
+
+	switch {
+	case peer.State == haFault:
+		return haMaster
+
+	case self.State == haMaster && peer.State == haMaster:
+		// both nodes are master: only one of them remains master
+		if selfWins {
+			return haMaster
+		}
+		return haBackup
+
+	case peer.State == haMaster:
+		// preempt the master node with lower priority,
+		//  but only after we've got the current leases from it
+		if self.Priority > peer.Priority && synced {
+			return haMaster
+		}
+		return haBackup
+
+	case self.State == haMaster:
+		// the master node keeps its role: the peer with greater priority preempts it itself
+		return haMaster
+	}
+
+	// both nodes are backup
+	if selfWins {
+		return haMaster
+	}
+	return haBackup
+}
+
+// Return TRUE if we've heard from the peer recently
+// Note: h.lock must be held
+func (h *haNode) peerAlive() bool {
+	return time.Since(h.peerLastSeen) < time.Duration(h.conf.DeadInterval)*time.Second
+}
+
+func (h *haNode) getState() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state
+}
+
+// Switch to a new state
+func (h *haNode) setState(state string) {
+	h.transLock.Lock()
+	defer h.transLock.Unlock()
+
+	h.lock.Lock()
+	prev := h.state
+	if prev == state {
+		h.lock.Unlock()
+		return
+	}
+	h.state = state
+	h.stateTime = time.Now()
+	h.lock.Unlock()
+
+	log.Info("HA: %s -> %s", prev, state)
+
+	if state == haMaster {
+		h.setVirtualIP(true)
+		h.dhcpSetStandby(false)
+	} else {
+		h.dhcpSetStandby(true)
+		if prev == haMaster {
+			h.setVirtualIP(false)
+		}
+	}
+
+	if len(h.conf.NotifyCommand) != 0 {
+		cmd := exec.Command(h.conf.NotifyCommand, state)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Error("HA: %s %s: %s: %s", h.conf.NotifyCommand, state, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// Add or remove the virtual IP address
+func (h *haNode) setVirtualIP(add bool) {
+	if len(h.conf.VirtualIP) == 0 || h.conf.Election != haElectionBuiltin {
+		return
+	}
+
+	action := "del"
+	if add {
+		action = "add"
+	}
+	cmd := exec.Command("ip", "addr", action, h.conf.VirtualIP, "dev", h.conf.Interface)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Error("HA: ip addr %s %s: %s: %s", action, h.conf.VirtualIP, err, strings.TrimSpace(string(out)))
+		return
+	}
+	log.Info("HA: ip addr %s %s dev %s", action, h.conf.VirtualIP, h.conf.Interface)
+
+	if add {
+		// update ARP caches of the clients and the switches
+		ip, _, _ := net.ParseCIDR(h.conf.VirtualIP)
+		cmd = exec.Command("arping", "-U", "-c", "3", "-I", h.conf.Interface, ip.String())
+		out, err = cmd.CombinedOutput()
+		if err != nil {
+			log.Debug("HA: arping: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// Get the current dynamic IPv4 leases
+func (h *haNode) leases() []dhcpd.Lease {
+	if h.dhcpServer == nil {
+		return nil
+	}
+	leases := []dhcpd.Lease{}
+	for _, l := range h.dhcpServer.Leases(dhcpd.LeasesDynamic) {
+		if l.IP.To4() != nil {
+			leases = append(leases, l)
+		}
+	}
+	return leases
+}
+
+// Get the hash of the leases
+func haLeasesHash(leases []dhcpd.Lease) string {
+	list := []string{}
+	for _, l := range leases {
+		list = append(list, fmt.Sprintf("%s %s %s %d", l.HWAddr, l.IP, l.Hostname, l.Expiry.Unix()))
+	}
+	sort.Strings(list)
+	sum := sha256.Sum256([]byte(strings.Join(list, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Send a heartbeat to the peer
+// The master node also sends its leases if the peer has different leases.
+func (h *haNode) heartbeat() error {
+	leases := h.leases()
+	hash := haLeasesHash(leases)
+
+	h.lock.Lock()
+	req := haHeartbeat{
+		haNodeInfo: haNodeInfo{
+			Name:       h.conf.Name,
+			Priority:   h.conf.Priority,
+			State:      h.state,
+			LeasesHash: hash,
+		},
+	}
+	if h.state == haMaster && h.peer.LeasesHash != hash {
+		req.Leases = leases
+	}
+	h.lock.Unlock()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err)
+	}
+
+	u := strings.TrimSuffix(h.conf.PeerURL, "/") + "/control/ha/heartbeat"
+	r, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+h.conf.Token)
+
+	resp, err := h.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, haMaxSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status code %d: %s", u, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	peer := haNodeInfo{}
+	err = json.Unmarshal(body, &peer)
+	if err != nil {
+		return fmt.Errorf("json.Unmarshal: %s", err)
+	}
+
+	h.lock.Lock()
+	h.peer = peer
+	h.peerLastSeen = time.Now()
+	if peer.State == haMaster && peer.LeasesHash == hash {
+		h.synced = true
+	}
+	h.lock.Unlock()
+	return nil
+}
+
+// Process a heartbeat from the peer and return the information about this node
+func (h *haNode) processHeartbeat(req haHeartbeat) haNodeInfo {
+	if req.Leases != nil && req.State == haMaster && h.getState() != haMaster && h.dhcpServer != nil {
+		h.dhcpServer.SetDynamicLeases(req.Leases)
+		log.Debug("HA: received %d leases from %s", len(req.Leases), req.Name)
+	}
+
+	hash := haLeasesHash(h.leases())
+
+	h.lock.Lock()
+	prevState := h.peer.State
+	h.peer = req.haNodeInfo
+	h.peerLastSeen = time.Now()
+	if req.State == haMaster && req.LeasesHash == hash {
+		h.synced = true
+	}
+	resp := haNodeInfo{
+		Name:       h.conf.Name,
+		Priority:   h.conf.Priority,
+		State:      h.state,
+		LeasesHash: hash,
+	}
+	h.lock.Unlock()
+
+	if prevState != req.State {
+		// the peer's state has changed: re-elect right now
+		h.electNow()
+	}
+	return resp
+}
+
+func (h *haNode) getStatus() haStatus {
+	hash := haLeasesHash(h.leases())
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return haStatus{
+		State:         h.state,
+		Peer:          h.peer,
+		PeerAlive:     len(h.peer.Name) != 0 && h.peerAlive(),
+		PeerLastSeen:  h.peerLastSeen,
+		LastError:     h.lastError,
+		LeasesHash:    hash,
+		LeasesSynced:  h.peer.LeasesHash == hash,
+		LastStateTime: h.stateTime,
+	}
+}
+
+type haStatusJSON struct {
+	haConfig
+	haStatus
+	TokenSet bool `json:"token_set"` // the token isn't returned: it allows to control the peer
+}
+
+func handleHAStatus(w http.ResponseWriter, r *http.Request) {
+	resp := haStatusJSON{
+		haConfig: config.HA,
+		TokenSet: len(config.HA.Token) != 0,
+	}
+	resp.Token = ""
+	if Context.ha != nil && config.HA.Enabled {
+		resp.haStatus = Context.ha.getStatus()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleHAConfig(w http.ResponseWriter, r *http.Request) {
+	conf := haConfig{}
+	err := json.NewDecoder(r.Body).Decode(&conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkHAConfig(conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if len(conf.Token) == 0 {
+		// the token isn't changed: the client doesn't get it with the status
+		conf.Token = config.HA.Token
+	}
+	config.HA = conf
+	if Context.ha != nil {
+		Context.ha.Close()
+		Context.ha = initHA(conf, Context.dhcpServer, Context.client)
+		Context.ha.Start()
+	}
+
+	onConfigModified()
+	returnOK(w)
+}
+
+type haStateJSON struct {
+	State string `json:"state"`
+}
+
+// Set the node state (external election)
+func handleHAState(w http.ResponseWriter, r *http.Request) {
+	req := haStateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if Context.ha == nil || !config.HA.Enabled || config.HA.Election != haElectionExternal {
+		httpError(w, http.StatusBadRequest, "external election is disabled")
+		return
+	}
+
+	switch req.State {
+	case haMaster, haBackup, haFault:
+		Context.ha.setState(req.State)
+	default:
+		httpError(w, http.StatusBadRequest, "invalid state: %s", req.State)
+		return
+	}
+
+	returnOK(w)
+}
+
+func handleHAHeartbeat(w http.ResponseWriter, r *http.Request) {
+	req := haHeartbeat{}
+	err := json.NewDecoder(io.LimitReader(r.Body, haMaxSize)).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if Context.ha == nil || !config.HA.Enabled {
+		httpError(w, http.StatusBadRequest, "HA is disabled")
+		return
+	}
+
+	resp := Context.ha.processHeartbeat(req)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// RegisterHAHandlers - register handlers
+func RegisterHAHandlers() {
+	httpRegister(http.MethodGet, "/control/ha/status", handleHAStatus)
+	httpRegister(http.MethodPost, "/control/ha/config", handleHAConfig)
+	httpRegister(http.MethodPost, "/control/ha/state", handleHAState)
+	httpRegister(http.MethodPost, "/control/ha/heartbeat", handleHAHeartbeat)
+}
@@ -0,0 +1,142 @@
+package home
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHAElect(t *testing.T) {
+	self := haNodeInfo{Name: "a", Priority: 10, State: haBackup}
+
+	// the peer is dead
+	assert.Equal(t, haMaster, haElect(self, nil, false))
+
+	// both are backup: the greater priority wins
+	assert.Equal(t, haMaster, haElect(self, &haNodeInfo{Name: "b", Priority: 5, State: haBackup}, false))
+	assert.Equal(t, haBackup, haElect(self, &haNodeInfo{Name: "b", Priority: 20, State: haBackup}, false))
+	// the same priority: the greater name wins
+	assert.Equal(t, haBackup, haElect(self, &haNodeInfo{Name: "b", Priority: 10, State: haBackup}, false))
+	assert.Equal(t, haMaster, haElect(self, &haNodeInfo{Name: "0", Priority: 10, State: haBackup}, false))
+
+	// the peer is master: preempt it only after the leases are received
+	peer := haNodeInfo{Name: "b", Priority: 5, State: haMaster}
+	assert.Equal(t, haBackup, haElect(self, &peer, false))
+	assert.Equal(t, haMaster, haElect(self, &peer, true))
+	peer.Priority = 10
+	assert.Equal(t, haBackup, haElect(self, &peer, true))
+
+	// the peer has failed
+	assert.Equal(t, haMaster, haElect(self, &haNodeInfo{Name: "b", Priority: 20, State: haFault}, false))
+
+	// the master keeps its role
+	self.State = haMaster
+	assert.Equal(t, haMaster, haElect(self, &haNodeInfo{Name: "b", Priority: 10, State: haBackup}, false))
+	assert.Equal(t, haMaster, haElect(self, &haNodeInfo{Name: "b", Priority: 20, State: haBackup}, false))
+
+	// both are master
+	assert.Equal(t, haBackup, haElect(self, &haNodeInfo{Name: "b", Priority: 10, State: haMaster}, false))
+	assert.Equal(t, haMaster, haElect(self, &haNodeInfo{Name: "0", Priority: 10, State: haMaster}, false))
+}
+
+func TestCheckHAConfig(t *testing.T) {
+	assert.Nil(t, checkHAConfig(haConfig{}))
+	assert.NotNil(t, checkHAConfig(haConfig{Election: "vrrp"}))
+	assert.NotNil(t, checkHAConfig(haConfig{Enabled: true, Token: "agh_1"}))
+	assert.NotNil(t, checkHAConfig(haConfig{Enabled: true, PeerURL: "ftp://192.168.1.3", Token: "agh_1"}))
+	assert.NotNil(t, checkHAConfig(haConfig{Enabled: true, PeerURL: "http://192.168.1.3:3000"}))
+	assert.NotNil(t, checkHAConfig(haConfig{VirtualIP: "192.168.1.2"}))
+	assert.NotNil(t, checkHAConfig(haConfig{VirtualIP: "192.168.1.2/24"}))
+	assert.NotNil(t, checkHAConfig(haConfig{HeartbeatInterval: 5, DeadInterval: 5}))
+	assert.Nil(t, checkHAConfig(haConfig{Enabled: true, PeerURL: "http://192.168.1.3:3000", Token: "agh_1"}))
+	assert.Nil(t, checkHAConfig(haConfig{Enabled: true, Election: haElectionExternal}))
+}
+
+func TestHALeasesHash(t *testing.T) {
+	l1 := dhcpd.Lease{HWAddr: []byte{1, 1, 1, 1, 1, 1}, IP: net.ParseIP("1.1.1.1"), Expiry: time.Unix(1600000000, 0)}
+	l2 := dhcpd.Lease{HWAddr: []byte{2, 2, 2, 2, 2, 2}, IP: net.ParseIP("1.1.1.2"), Expiry: time.Unix(1600000000, 0)}
+	assert.Equal(t, haLeasesHash([]dhcpd.Lease{l1, l2}), haLeasesHash([]dhcpd.Lease{l2, l1}))
+	assert.NotEqual(t, haLeasesHash([]dhcpd.Lease{l1, l2}), haLeasesHash([]dhcpd.Lease{l1}))
+	l2.Expiry = time.Unix(1600000001, 0)
+	assert.NotEqual(t, haLeasesHash([]dhcpd.Lease{l1}), haLeasesHash([]dhcpd.Lease{l1, l2}))
+}
+
+func haTestServer(h *haNode) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := haHeartbeat{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || parseBearerToken(r) != "agh_1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(h.processHeartbeat(req))
+	}))
+}
+
+func TestHAHeartbeat(t *testing.T) {
+	a := initHA(haConfig{Enabled: true, Name: "a", Priority: 10, Token: "agh_1"}, nil, nil)
+	b := initHA(haConfig{Enabled: true, Name: "b", Priority: 5, Token: "agh_1"}, nil, nil)
+	srvA := haTestServer(a)
+	defer srvA.Close()
+	srvB := haTestServer(b)
+	defer srvB.Close()
+	a.conf.PeerURL = srvB.URL
+	b.conf.PeerURL = srvA.URL
+	a.peerLastSeen = time.Now()
+	b.peerLastSeen = time.Now()
+
+	// we haven't heard from the peer yet
+	a.elect()
+	assert.Equal(t, haBackup, a.getState())
+
+	assert.Nil(t, a.heartbeat())
+	assert.Equal(t, "b", a.getStatus().Peer.Name)
+	assert.Equal(t, "a", b.getStatus().Peer.Name)
+
+	a.elect()
+	b.elect()
+	assert.Equal(t, haMaster, a.getState())
+	assert.Equal(t, haBackup, b.getState())
+
+	assert.Nil(t, b.heartbeat())
+	assert.Equal(t, haMaster, b.getStatus().Peer.State)
+	assert.True(t, b.getStatus().LeasesSynced)
+	b.elect()
+	assert.Equal(t, haBackup, b.getState())
+
+	// the master node is dead
+	srvA.Close()
+	assert.NotNil(t, b.heartbeat())
+	b.peerLastSeen = time.Now().Add(-time.Minute)
+	b.elect()
+	assert.Equal(t, haMaster, b.getState())
+
+	// wrong token
+	b.conf.Token = "agh_2"
+	b.conf.PeerURL = srvB.URL
+	assert.NotNil(t, b.heartbeat())
+}
+
+func TestHAStatusToken(t *testing.T) {
+	prev := config.HA
+	defer func() { config.HA = prev }()
+	config.HA = haConfig{Name: "a", PeerURL: "http://192.168.1.3:3000", Token: "agh_secret"}
+
+	w := httptest.NewRecorder()
+	handleHAStatus(w, httptest.NewRequest(http.MethodGet, "/control/ha/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "agh_secret")
+
+	resp := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "", resp["token"])
+	assert.Equal(t, true, resp["token_set"])
+	assert.Equal(t, "http://192.168.1.3:3000", resp["peer_url"])
+	assert.Equal(t, "agh_secret", config.HA.Token)
+}
@@ -0,0 +1,167 @@
+// Health and readiness endpoints for container orchestrators (Docker HEALTHCHECK, Kubernetes probes)
+
+package home
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Names of the health checks
+const (
+	healthDNS       = "dns"       // the DNS server is running
+	healthFiltering = "filtering" // the filtering engine is loaded
+	healthUpstreams = "upstreams" // at least one upstream server responds
+	healthDisk      = "disk"      // the data directory is writable
+)
+
+// The checks which must pass for the process to be considered alive.
+// The failures that don't go away after restart (e.g. upstream servers are down) aren't checked here,
+// so the orchestrator doesn't restart AdGuard Home in vain.
+var livenessChecks = []string{healthDNS, healthDisk}
+
+// The checks which must pass for AdGuard Home to receive the DNS requests
+var readinessChecks = []string{healthDNS, healthFiltering, healthUpstreams, healthDisk}
+
+type healthCheckJSON struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"` // "": the check has passed
+}
+
+type healthJSON struct {
+	Status string            `json:"status"` // "ok" or "fail"
+	Checks []healthCheckJSON `json:"checks"`
+}
+
+func runHealthCheck(name string) error {
+	switch name {
+	case healthDNS:
+		return checkHealthDNS()
+	case healthFiltering:
+		return checkHealthFiltering()
+	case healthUpstreams:
+		if Context.dnsServer == nil {
+			return errors.New("the DNS server isn't initialized")
+		}
+		return Context.dnsServer.CheckUpstreams()
+	case healthDisk:
+		return checkHealthDisk()
+	}
+	return fmt.Errorf("unknown check: %s", name)
+}
+
+func checkHealthDNS() error {
+	if Context.firstRun {
+		return errors.New("AdGuard Home isn't configured yet")
+	}
+	if !isRunning() {
+		return errors.New("the DNS server isn't running")
+	}
+	return nil
+}
+
+func checkHealthFiltering() error {
+	if Context.dnsFilter == nil {
+		return errors.New("the filtering module isn't initialized")
+	}
+	st := Context.dnsFilter.GetFilteringStatus()
+	if st.LastReload.IsZero() {
+		if len(st.LastError) != 0 {
+			return fmt.Errorf("the filters aren't loaded: %s", st.LastError)
+		}
+		return errors.New("the filters aren't loaded yet")
+	}
+	return nil
+}
+
+// Create and remove a temporary file in the data directory
+func checkHealthDisk() error {
+	dir := Context.getDataDir()
+	if Context.firstRun {
+		// the data directory is created after the configuration
+		dir = Context.workDir
+	}
+	f, err := ioutil.TempFile(dir, "health")
+	if err != nil {
+		return err
+	}
+	fn := f.Name()
+	_, err = f.Write([]byte("OK\n"))
+	err2 := f.Close()
+	_ = os.Remove(fn)
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// Run the checks.  Return FALSE if any of them has failed.
+func runHealthChecks(names []string) (healthJSON, bool) {
+	resp := healthJSON{Status: "ok"}
+	ok := true
+	for _, name := range names {
+		c := healthCheckJSON{Name: name}
+		err := runHealthCheck(name)
+		if err != nil {
+			c.Error = err.Error()
+			resp.Status = "fail"
+			ok = false
+		}
+		resp.Checks = append(resp.Checks, c)
+	}
+	return resp, ok
+}
+
+// Check the health of AdGuard Home for the DNS health probe requests
+func checkHealth() error {
+	for _, name := range readinessChecks {
+		err := runHealthCheck(name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func writeHealthResponse(w http.ResponseWriter, names []string) {
+	resp, ok := runHealthChecks(names)
+	if !ok {
+		log.Debug("health: %+v", resp.Checks)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Debug("health: json.Encode: %s", err)
+	}
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	names := livenessChecks
+	if Context.firstRun {
+		// the DNS server isn't started until AdGuard Home is configured
+		names = []string{healthDisk}
+	}
+	writeHealthResponse(w, names)
+}
+
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, readinessChecks)
+}
+
+// RegisterHealthHandlers - register HTTP handlers
+// The handlers don't require authentication and work before AdGuard Home is configured.
+func RegisterHealthHandlers() {
+	http.HandleFunc("/health", ensureGET(handleHealth))
+	http.HandleFunc("/ready", ensureGET(handleReady))
+}
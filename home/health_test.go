@@ -0,0 +1,53 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir, prevFirstRun := Context.workDir, Context.firstRun
+	defer func() {
+		Context.workDir = prevWorkDir
+		Context.firstRun = prevFirstRun
+	}()
+	Context.workDir = dir
+
+	request := func(handler func(http.ResponseWriter, *http.Request)) (int, healthJSON) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		resp := healthJSON{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	// not configured yet: alive, but not ready
+	Context.firstRun = true
+	code, resp := request(handleHealth)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, []healthCheckJSON{{Name: healthDisk}}, resp.Checks)
+
+	code, resp = request(handleReady)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "fail", resp.Status)
+	assert.Equal(t, len(readinessChecks), len(resp.Checks))
+	assert.Equal(t, healthDNS, resp.Checks[0].Name)
+	assert.NotEqual(t, "", resp.Checks[0].Error)
+
+	// the DNS server isn't running
+	Context.firstRun = false
+	assert.Nil(t, os.MkdirAll(Context.getDataDir(), 0755))
+	code, resp = request(handleHealth)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.NotEqual(t, "", resp.Checks[0].Error)
+	assert.Equal(t, "", resp.Checks[1].Error)
+	assert.NotNil(t, checkHealth())
+}
@@ -62,11 +62,22 @@ type homeContext struct {
 	dnsServer   *dnsforward.Server   // DNS module
 	rdns        *RDNS                // rDNS module
 	whois       *Whois               // WHOIS module
+	discovery   *discovery           // network discovery module
+	vpnClients  *vpnClients          // names of VPN clients module
+	activity    *activityCtx         // household activity reports module
+	blockPage   *blockPage           // block page module
+	acme        *acmeManager         // ACME certificates module
+	replica     *replica             // configuration sync module
+	ha          *haNode              // high availability module
+	notifier    *notifier            // event notifications module
+	plugins     []dnsforward.Plugin  // DNS request processing plugins
+	recentHosts *recentHosts         // recently allowed host names (for filter list recommendations)
 	dnsFilter   *dnsfilter.Dnsfilter // DNS filtering module
 	dhcpServer  *dhcpd.Server        // DHCP module
 	auth        *Auth                // HTTP authentication module
 	httpServer  *http.Server         // HTTP module
 	httpsServer HTTPSServer          // HTTPS module
+	activated   activatedSockets     // sockets passed by systemd
 
 	// Runtime properties
 	// --
@@ -79,9 +90,14 @@ type homeContext struct {
 	controlLock      sync.Mutex
 	transport        *http.Transport
 	client           *http.Client
+	filtersClient    *http.Client   // HTTP client for downloading filter lists (it may use an outbound proxy)
 	appSignalChannel chan os.Signal // Channel for receiving OS signals by the console app
 	// runningAsService flag is set to true when options are passed from the service runner
 	runningAsService bool
+
+	configOverrides []configOverride // settings which override the values from the config file
+	configReadOnly  bool             // if set, the config file is never written
+	secrets         secretsCtx       // master key for the encrypted settings
 }
 
 // getDataDir returns path to the directory where we store databases and filters
@@ -112,10 +128,16 @@ func Main(version string, channel string, armVer string) {
 	Context.appSignalChannel = make(chan os.Signal)
 	signal.Notify(Context.appSignalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 	go func() {
-		<-Context.appSignalChannel
-		cleanup()
-		cleanupAlways()
-		os.Exit(0)
+		for {
+			sig := <-Context.appSignalChannel
+			if sig == syscall.SIGHUP {
+				onReloadSignal()
+				continue
+			}
+			cleanup()
+			cleanupAlways()
+			os.Exit(0)
+		}
 	}()
 
 	// run the protection
@@ -142,9 +164,17 @@ func run(args options) {
 		Timeout:   time.Minute * 5,
 		Transport: Context.transport,
 	}
+	Context.filtersClient = &http.Client{
+		Timeout: time.Minute * 5,
+		Transport: &http.Transport{
+			DialContext: customDialContext,
+			Proxy:       filtersProxy,
+		},
+	}
 
 	// configure working dir and config path
 	initWorkingDir(args)
+	initConfigOverrides(args)
 
 	// configure log level and output
 	configureLogger(args)
@@ -192,8 +222,10 @@ func run(args options) {
 	config.DHCP.HTTPRegister = httpRegister
 	config.DHCP.ConfigModified = onConfigModified
 	Context.dhcpServer = dhcpd.Create(config.DHCP)
-	Context.clients.Init(config.Clients, Context.dhcpServer)
+	Context.clients.Init(config.Clients, config.ClientGroups, Context.dhcpServer)
+	Context.dhcpServer.SetOnLeaseChanged(onDHCPLeaseChanged)
 	config.Clients = nil
+	config.ClientGroups = nil
 
 	if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") &&
 		config.RlimitNoFile != 0 {
@@ -208,6 +240,8 @@ func run(args options) {
 		config.BindPort = args.bindPort
 	}
 
+	Context.activated = getActivatedSockets(config.BindPort)
+
 	if !Context.firstRun {
 		// Save the updated config
 		err := config.write()
@@ -224,6 +258,7 @@ func run(args options) {
 			if err != nil {
 				log.Fatal(err)
 			}
+			notifyReady()
 		}()
 
 		err = startDHCPServer()
@@ -248,6 +283,7 @@ func run(args options) {
 		log.Info("This is the first launch of AdGuard Home, redirecting everything to /install.html ")
 		http.Handle("/install.html", preInstallHandler(http.FileServer(box)))
 		registerInstallHandlers()
+		notifyReady()
 	}
 
 	Context.httpsServer.cond = sync.NewCond(&Context.httpsServer.Mutex)
@@ -264,7 +300,15 @@ func run(args options) {
 		Context.httpServer = &http.Server{
 			Addr: address,
 		}
-		err := Context.httpServer.ListenAndServe()
+		var err error
+		if Context.activated.web != nil {
+			// the listener is closed by Shutdown(), so the server listens on the configured address after rebind
+			l := Context.activated.web
+			Context.activated.web = nil
+			err = Context.httpServer.Serve(l)
+		} else {
+			err = Context.httpServer.ListenAndServe()
+		}
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
@@ -310,9 +354,17 @@ func httpServerLoop() {
 		}
 		Context.httpsServer.cond.L.Unlock()
 
+		// HTTP/3 server is stopped together with HTTPS server
+		handler, server3, err := startHTTP3(cert)
+		if err != nil {
+			cleanupAlways()
+			log.Fatal(err)
+		}
+
 		// prepare HTTPS server
 		Context.httpsServer.server = &http.Server{
-			Addr: address,
+			Addr:    address,
+			Handler: handler,
 			TLSConfig: &tls.Config{
 				Certificates: []tls.Certificate{cert},
 				MinVersion:   tls.VersionTLS12,
@@ -321,6 +373,9 @@ func httpServerLoop() {
 
 		printHTTPAddresses("https")
 		err = Context.httpsServer.server.ListenAndServeTLS("", "")
+		if server3 != nil {
+			_ = server3.Close()
+		}
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
@@ -410,17 +465,13 @@ func configureLogger(args options) {
 		ls.LogFile = configSyslog
 	}
 
-	if ls.LogFile == "" {
-		return
-	}
-
 	if ls.LogFile == configSyslog {
 		// Use syslog where it is possible and eventlog on Windows
 		err := util.ConfigureSyslog(serviceName)
 		if err != nil {
 			log.Fatalf("cannot initialize syslog: %s", err)
 		}
-	} else {
+	} else if ls.LogFile != "" {
 		logFilePath := filepath.Join(Context.workDir, ls.LogFile)
 		if filepath.IsAbs(ls.LogFile) {
 			logFilePath = ls.LogFile
@@ -432,10 +483,15 @@ func configureLogger(args options) {
 		}
 		log.SetOutput(file)
 	}
+
+	if ls.LogFormat == logFormatJSON {
+		util.ConfigureJSONLog()
+	}
 }
 
 func cleanup() {
 	log.Info("Stopping AdGuard Home")
+	sdNotify("STOPPING=1")
 
 	err := stopDNSServer()
 	if err != nil {
@@ -478,6 +534,9 @@ type options struct {
 	checkConfig    bool   // Check configuration and exit
 	disableUpdate  bool   // If set, don't check for updates
 
+	configOverrides []string // "PATH=VALUE" settings which override the values from the config file
+	configReadOnly  bool     // Never write the config file
+
 	// service control action (see service.ControlAction array + "status" command)
 	serviceControlAction string
 
@@ -515,6 +574,12 @@ func loadOptions() options {
 		}, nil},
 		{"pidfile", "", "Path to a file where PID is stored", func(value string) { o.pidFile = value }, nil},
 		{"check-config", "", "Check configuration and exit", nil, func() { o.checkConfig = true }},
+		{"set", "", "Override the setting from the config file: dns.port=5353 (may be repeated)", func(value string) {
+			o.configOverrides = append(o.configOverrides, value)
+		}, nil},
+		{"config-read-only", "", "Never write the config file: the changed settings are kept until restart", nil, func() {
+			o.configReadOnly = true
+		}},
 		{"no-check-update", "", "Don't check for updates", nil, func() { o.disableUpdate = true }},
 		{"verbose", "v", "Enable verbose output", nil, func() { o.verbose = true }},
 		{"version", "", "Show the version and exit", nil, func() {
@@ -0,0 +1,84 @@
+// HTTP/3 listener for HTTPS server (DNS-over-HTTP/3)
+
+package home
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const altSvcMaxAge = 86400 // in seconds
+
+// http3Server serves HTTP/3 requests
+type http3Server interface {
+	ListenAndServe() error
+	Close() error
+}
+
+// newHTTP3Server creates HTTP/3 server.
+// It's set only if QUIC support is compiled in (built with "-tags quic").
+var newHTTP3Server func(addr string, tlsConf *tls.Config, handler http.Handler) http3Server
+
+// Return an error if HTTP/3 support isn't compiled in
+func checkHTTP3() error {
+	if newHTTP3Server == nil {
+		return fmt.Errorf("HTTP/3 support isn't compiled in (build with \"-tags quic\")")
+	}
+	return nil
+}
+
+// Check that HTTP/3 port doesn't conflict with the other UDP listeners
+func checkHTTP3Port(data tlsConfigSettings) error {
+	if data.PortHTTP3 == 0 {
+		return nil
+	}
+	if data.PortHTTP3 == data.PortDNSOverQUIC {
+		return fmt.Errorf("HTTP/3 port %d is used by DNS-over-QUIC", data.PortHTTP3)
+	}
+	if data.PortHTTP3 == config.DNS.Port {
+		return fmt.Errorf("HTTP/3 port %d is used by DNS server", data.PortHTTP3)
+	}
+	return nil
+}
+
+// Add Alt-Svc header to the responses, so the clients know they can use HTTP/3
+func altSvcHandler(h http.Handler, port int) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=%d`, port, altSvcMaxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Start HTTP/3 server in background if it's enabled.
+// Return HTTP handler for HTTPS server and HTTP/3 server (nil if it isn't started).
+func startHTTP3(cert tls.Certificate) (http.Handler, http3Server, error) {
+	port := config.TLS.PortHTTP3
+	if port == 0 {
+		return nil, nil, nil
+	}
+	err := checkHTTP3()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	address := net.JoinHostPort(config.BindHost, strconv.Itoa(port))
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+	srv := newHTTP3Server(address, tlsConf, http.DefaultServeMux)
+	go func() {
+		log.Info("Listening for HTTP/3 requests on udp://%s", address)
+		err := srv.ListenAndServe()
+		if err != nil {
+			log.Debug("HTTP/3 server: %s", err)
+		}
+	}()
+	return altSvcHandler(http.DefaultServeMux, port), srv, nil
+}
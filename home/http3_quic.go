@@ -0,0 +1,21 @@
+// +build quic
+
+package home
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP/3 transport for HTTPS server
+func init() {
+	newHTTP3Server = func(addr string, tlsConf *tls.Config, handler http.Handler) http3Server {
+		return &http3.Server{
+			Addr:      addr,
+			TLSConfig: tlsConf,
+			Handler:   handler,
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP3(t *testing.T) {
+	h := altSvcHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), 8443)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dns-query", nil))
+	assert.Equal(t, `h3=":8443"; ma=86400`, w.Header().Get("Alt-Svc"))
+
+	assert.Nil(t, checkHTTP3Port(tlsConfigSettings{PortHTTP3: 0, PortDNSOverQUIC: 0}))
+	assert.Nil(t, checkHTTP3Port(tlsConfigSettings{PortHTTP3: 443, PortDNSOverQUIC: 853}))
+	assert.NotNil(t, checkHTTP3Port(tlsConfigSettings{PortHTTP3: 853, PortDNSOverQUIC: 853}))
+
+	prev := newHTTP3Server
+	newHTTP3Server = nil
+	defer func() { newHTTP3Server = prev }()
+	assert.NotNil(t, checkHTTP3())
+	assert.NotNil(t, checkQUICSettings(tlsConfigSettings{PortHTTP3: 443}))
+	assert.Nil(t, checkQUICSettings(tlsConfigSettings{}))
+}
@@ -0,0 +1,125 @@
+// Metrics in Prometheus text format
+
+package home
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+// Write the counters of safebrowsing, parental and safesearch lookups
+func writeLookupMetrics(w io.Writer, st dnsfilter.Stats) {
+	services := []struct {
+		name string
+		st   dnsfilter.LookupStats
+	}{
+		{"safebrowsing", st.Safebrowsing},
+		{"parental", st.Parental},
+		{"safesearch", st.Safesearch},
+	}
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_lookup_requests_total Number of requests sent to security services.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_lookup_requests_total counter\n")
+	for _, s := range services {
+		_, _ = fmt.Fprintf(w, "adguard_lookup_requests_total{service=%q} %d\n", s.name, s.st.Requests)
+	}
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_lookup_cache_hits_total Number of security services lookups answered from cache.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_lookup_cache_hits_total counter\n")
+	for _, s := range services {
+		_, _ = fmt.Fprintf(w, "adguard_lookup_cache_hits_total{service=%q} %d\n", s.name, s.st.CacheHits)
+	}
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_lookup_cache_hit_ratio Ratio of security services lookups answered from cache.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_lookup_cache_hit_ratio gauge\n")
+	for _, s := range services {
+		ratio := float64(0)
+		total := s.st.Requests + s.st.CacheHits
+		if total != 0 {
+			ratio = float64(s.st.CacheHits) / float64(total)
+		}
+		_, _ = fmt.Fprintf(w, "adguard_lookup_cache_hit_ratio{service=%q} %g\n", s.name, ratio)
+	}
+}
+
+// Write the information about filtering engine reloads
+func writeEngineMetrics(w io.Writer, st dnsfilter.EngineStats) {
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_engine_reloads_total Number of filtering engine reloads.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_engine_reloads_total counter\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_engine_reloads_total %d\n", st.Reloads)
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_engine_reload_seconds Duration of the last filtering engine reload.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_engine_reload_seconds gauge\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_engine_reload_seconds %g\n", st.LastDuration.Seconds())
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_engine_reload_seconds_total Time spent on filtering engine reloads.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_engine_reload_seconds_total counter\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_engine_reload_seconds_total %g\n", st.TotalTime.Seconds())
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_prefilter_hosts Number of host names in the prefilter.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_prefilter_hosts gauge\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_prefilter_hosts %d\n", st.PrefilterHosts)
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_prefilter_skips_total Number of host names rejected by the prefilter.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_prefilter_skips_total counter\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_prefilter_skips_total %d\n", st.PrefilterSkips)
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_engine_memory_bytes Estimated memory usage of the loaded filter lists.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_engine_memory_bytes gauge\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_engine_memory_bytes %d\n", st.MemoryUsage)
+}
+
+// Write the status of filters re-initialization
+func writeFilteringStatusMetrics(w io.Writer, st dnsfilter.FilteringStatus) {
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_reload_failures_total Number of failed filters re-initializations.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_reload_failures_total counter\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_reload_failures_total %d\n", st.Failures)
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filtering_rules Number of rules in the loaded filter lists.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filtering_rules gauge\n")
+	_, _ = fmt.Fprintf(w, "adguard_filtering_rules %d\n", st.Rules)
+}
+
+// Write the names of the filter lists so the match counters can be joined with them
+func writeFilterInfoMetrics(w io.Writer) {
+	type filterInfo struct {
+		id   int64
+		name string
+	}
+	list := []filterInfo{}
+	config.RLock()
+	for _, f := range config.Filters {
+		list = append(list, filterInfo{f.ID, f.Name})
+	}
+	config.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	_, _ = fmt.Fprintf(w, "# HELP adguard_filter_info Names of the filter lists.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE adguard_filter_info gauge\n")
+	for _, f := range list {
+		_, _ = fmt.Fprintf(w, "adguard_filter_info{filter_id=\"%d\",name=%q} 1\n", f.id, f.name)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if Context.dnsServer == nil || Context.dnsFilter == nil {
+		httpError(w, http.StatusInternalServerError, "DNS server isn't initialized")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	Context.dnsServer.WriteMetrics(w)
+	writeFilterInfoMetrics(w)
+	writeLookupMetrics(w, Context.dnsFilter.GetStats())
+	writeEngineMetrics(w, Context.dnsFilter.GetEngineStats())
+	writeFilteringStatusMetrics(w, Context.dnsFilter.GetFilteringStatus())
+}
+
+// RegisterMetricsHandlers - register HTTP handlers
+func RegisterMetricsHandlers() {
+	httpRegister(http.MethodGet, "/metrics", handleMetrics)
+}
@@ -0,0 +1,102 @@
+// The cache of the system neighbor table: identification of clients by MAC address
+//  when we aren't their DHCP server
+
+package home
+
+import (
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The table is read again if it's older than this
+const neighborCacheTTL = 10 * time.Second
+
+// The cache of the system neighbor table (ARP and IPv6 neighbors)
+type neighborCache struct {
+	lock     sync.Mutex
+	table    map[string]net.HardwareAddr // IP -> MAC
+	updated  time.Time                   // the time of the last update
+	updating bool
+
+	read func() []arpEntry // read the system table
+}
+
+func newNeighborCache() *neighborCache {
+	return &neighborCache{
+		table: map[string]net.HardwareAddr{},
+		read:  readNeighbors,
+	}
+}
+
+// Get MAC address by IP address
+// The outdated table is updated in background, so the address of a new neighbor is found after the update is finished.
+func (n *neighborCache) find(ip net.IP) net.HardwareAddr {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !n.updating && time.Since(n.updated) >= neighborCacheTTL {
+		n.updating = true
+		go n.update()
+	}
+	return n.table[ip.String()]
+}
+
+func (n *neighborCache) update() {
+	table := map[string]net.HardwareAddr{}
+	for _, e := range n.read() {
+		table[e.ip] = e.mac
+	}
+
+	n.lock.Lock()
+	n.table = table
+	n.updated = time.Now()
+	n.updating = false
+	n.lock.Unlock()
+	log.Tracef("Clients: %d entries in the neighbor table", len(table))
+}
+
+// Read the system ARP table and, on Linux, IPv6 neighbors
+func readNeighbors() []arpEntry {
+	entries, err := readARPTable()
+	if err != nil {
+		log.Debug("Clients: %s", err)
+	}
+
+	if runtime.GOOS == "linux" {
+		cmd := exec.Command("ip", "-6", "neigh", "show")
+		data, err := cmd.Output()
+		if err != nil {
+			log.Debug("Clients: command %s has failed: %s", cmd.Path, err)
+		} else {
+			entries = append(entries, parseIPNeigh(string(data))...)
+		}
+	}
+	return entries
+}
+
+// Parse the output of 'ip neigh' command:
+// "fe80::1 dev eth0 lladdr aa:bb:cc:dd:ee:ff router REACHABLE"
+// The entries without hardware address (e.g. "FAILED") are skipped.
+func parseIPNeigh(data string) []arpEntry {
+	var entries []arpEntry
+	for _, ln := range strings.Split(data, "\n") {
+		fields := strings.Fields(ln)
+		for i := 1; i+1 < len(fields); i++ {
+			if fields[i] != "lladdr" {
+				continue
+			}
+			e, ok := newARPEntry(fields[0], fields[i+1])
+			if ok {
+				entries = append(entries, e)
+			}
+			break
+		}
+	}
+	return entries
+}
@@ -0,0 +1,46 @@
+package home
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPNeigh(t *testing.T) {
+	data := `fe80::1 dev eth0 lladdr aa:bb:cc:dd:ee:ff router REACHABLE
+2001:db8::20 dev eth0 lladdr 00:1a:11:01:02:03 STALE
+2001:db8::30 dev eth0  FAILED
+`
+	entries := parseIPNeigh(data)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "fe80::1", entries[0].ip)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", entries[0].mac.String())
+	assert.Equal(t, "2001:db8::20", entries[1].ip)
+}
+
+func TestNeighborCache(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x1a, 0x11, 1, 2, 3}
+	reads := 0
+	n := newNeighborCache()
+	n.read = func() []arpEntry {
+		reads++
+		return []arpEntry{{ip: "192.168.1.57", mac: mac}}
+	}
+
+	// the table is updated in background
+	assert.Nil(t, n.find(net.ParseIP("192.168.1.57")))
+	for i := 0; i != 100; i++ {
+		n.lock.Lock()
+		updated := !n.updated.IsZero()
+		n.lock.Unlock()
+		if updated {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, mac, n.find(net.ParseIP("192.168.1.57")))
+	assert.Nil(t, n.find(net.ParseIP("192.168.1.58")))
+	assert.Equal(t, 1, reads)
+}
@@ -0,0 +1,668 @@
+// Event notifications: webhooks and MQTT messages
+
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Event types
+const (
+	eventFilterUpdateFailed  = "filter_update_failed"
+	eventSafeBrowsingBlocked = "safebrowsing_blocked"
+	eventDHCPNewDevice       = "dhcp_new_device"
+	eventDiskSpaceLow        = "disk_space_low"
+	eventUpstreamDown        = "upstream_down"
+	eventUpstreamUp          = "upstream_up"
+	eventTest                = "test"
+)
+
+var eventTypes = []string{eventFilterUpdateFailed, eventSafeBrowsingBlocked, eventDHCPNewDevice,
+	eventDiskSpaceLow, eventUpstreamDown, eventUpstreamUp}
+
+const (
+	notifyDefaultDiskSpaceMin = 100 // in MB
+	notifyDiskCheckInterval   = 10 * time.Minute
+	notifyQueueSize           = 256 // events which aren't sent yet.  New events are dropped when the queue is full.
+	notifyTimeout             = 10 * time.Second
+	notifyThrottle            = time.Hour // events with the same key are sent not more often than this
+	notifyThrottleMax         = 1000
+	devicesFileName           = "devices.json"
+)
+
+type notifyConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+
+	// Send "disk_space_low" event if the free space in the data directory is less than this value (in MB).
+	// 0: default (100)
+	DiskSpaceMin uint32 `yaml:"disk_space_min" json:"disk_space_min"`
+
+	Targets []notifyTarget `yaml:"targets" json:"targets"`
+}
+
+// A destination for the events
+type notifyTarget struct {
+	Name string `yaml:"name" json:"name"`
+
+	// "http://...", "https://...": webhook
+	// "mqtt://[user:password@]host[:port]/topic", "mqtts://...": MQTT message
+	URL string `yaml:"url" json:"url"`
+
+	// Webhook only: HTTP method (default: POST) and additional headers
+	Method  string            `yaml:"method" json:"method"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+
+	// Payload template (Go text/template).  "": the event as a JSON object.
+	// Fields: .Type, .Time, .Message, .Data.<name>.  {{json .Message}}: a quoted JSON string.
+	Template string `yaml:"template" json:"template"`
+
+	// The event types to send.  Empty: all types.
+	Events []string `yaml:"events" json:"events"`
+
+	// The events about a client are sent only for these clients (names or IP addresses).  Empty: all clients.
+	Clients []string `yaml:"clients" json:"clients"`
+}
+
+type notifyTargetStatus struct {
+	LastSent  time.Time `json:"last_sent"` // the time of the last successful delivery
+	LastError string    `json:"last_error"`
+}
+
+type event struct {
+	Type    string            `json:"type"`
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"` // human-readable description
+	Data    map[string]string `json:"data"`    // event-specific fields
+
+	key string // the events with the same key are throttled.  "": no throttling
+}
+
+// Notifications module
+type notifier struct {
+	conf       notifyConfig
+	dataDir    string
+	dhcpServer *dhcpd.Server
+	client     *http.Client
+
+	lock     sync.Mutex
+	status   map[string]*notifyTargetStatus // target name -> status
+	throttle map[string]time.Time           // event key -> the time when the event was sent
+	devices  map[string]bool                // MAC addresses of the known DHCP clients
+
+	queue chan event
+	stop  chan bool
+}
+
+// Create module context
+func initNotifier(conf notifyConfig, dataDir string, dhcpServer *dhcpd.Server, client *http.Client) *notifier {
+	n := &notifier{
+		conf:       conf,
+		dataDir:    dataDir,
+		dhcpServer: dhcpServer,
+		status:     map[string]*notifyTargetStatus{},
+		throttle:   map[string]time.Time{},
+		devices:    map[string]bool{},
+		queue:      make(chan event, notifyQueueSize),
+	}
+	if n.conf.DiskSpaceMin == 0 {
+		n.conf.DiskSpaceMin = notifyDefaultDiskSpaceMin
+	}
+	n.client = &http.Client{
+		Timeout: notifyTimeout,
+	}
+	if client != nil {
+		n.client.Transport = client.Transport
+	}
+	for _, t := range n.conf.Targets {
+		n.status[t.Name] = &notifyTargetStatus{}
+	}
+	return n
+}
+
+func checkNotifyConfig(conf notifyConfig) error {
+	names := map[string]bool{}
+	for _, t := range conf.Targets {
+		if len(t.Name) == 0 {
+			return fmt.Errorf("target name isn't set")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate target name: %s", t.Name)
+		}
+		names[t.Name] = true
+
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return fmt.Errorf("%s: invalid URL: %s", t.Name, t.URL)
+		}
+		switch u.Scheme {
+		case "http", "https":
+			if len(u.Host) == 0 {
+				return fmt.Errorf("%s: invalid URL: %s", t.Name, t.URL)
+			}
+		case "mqtt", "mqtts":
+			if len(u.Host) == 0 || len(strings.TrimPrefix(u.Path, "/")) == 0 {
+				return fmt.Errorf("%s: invalid MQTT URL: %s", t.Name, t.URL)
+			}
+		default:
+			return fmt.Errorf("%s: unsupported URL scheme: %s", t.Name, u.Scheme)
+		}
+
+		_, err = parseNotifyTemplate(t.Template)
+		if err != nil {
+			return fmt.Errorf("%s: invalid template: %s", t.Name, err)
+		}
+
+		for _, e := range t.Events {
+			if !stringArrayContains(eventTypes, e) {
+				return fmt.Errorf("%s: unknown event type: %s", t.Name, e)
+			}
+		}
+	}
+	return nil
+}
+
+// Start the background worker
+func (n *notifier) Start() {
+	if !n.conf.Enabled {
+		return
+	}
+	n.loadDevices()
+	n.stop = make(chan bool)
+	go n.workerLoop(n.stop)
+}
+
+// Close - stop the background worker
+func (n *notifier) Close() {
+	if n.stop != nil {
+		close(n.stop)
+		n.stop = nil
+	}
+}
+
+func (n *notifier) workerLoop(stop chan bool) {
+	diskLow := false
+	n.checkDiskSpace(&diskLow)
+	ticker := time.NewTicker(notifyDiskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-n.queue:
+			for _, t := range n.conf.Targets {
+				if !t.match(ev) {
+					continue
+				}
+				err := n.send(t, ev)
+				n.setStatus(t.Name, err)
+			}
+
+		case <-ticker.C:
+			n.checkDiskSpace(&diskLow)
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Pass the event to the worker
+// The event isn't sent if an event with the same key has been sent recently.
+func (n *notifier) emit(ev event) {
+	if !n.conf.Enabled {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	if len(ev.key) != 0 {
+		key := ev.Type + " " + ev.key
+		n.lock.Lock()
+		t, ok := n.throttle[key]
+		if ok && ev.Time.Sub(t) < notifyThrottle {
+			n.lock.Unlock()
+			return
+		}
+		if len(n.throttle) >= notifyThrottleMax {
+			n.throttle = map[string]time.Time{}
+		}
+		n.throttle[key] = ev.Time
+		n.lock.Unlock()
+	}
+
+	select {
+	case n.queue <- ev:
+	default:
+		log.Debug("Notify: queue is full: dropping %s event", ev.Type)
+	}
+}
+
+func (n *notifier) setStatus(name string, err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	st, ok := n.status[name]
+	if !ok {
+		return
+	}
+	if err != nil {
+		log.Debug("Notify: %s: %s", name, err)
+		st.LastError = err.Error()
+		return
+	}
+	st.LastSent = time.Now()
+	st.LastError = ""
+}
+
+func (n *notifier) getStatus(name string) notifyTargetStatus {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	st, ok := n.status[name]
+	if !ok {
+		return notifyTargetStatus{}
+	}
+	return *st
+}
+
+// Return TRUE if the event should be sent to this target
+func (t *notifyTarget) match(ev event) bool {
+	if ev.Type == eventTest {
+		return false // sent explicitly
+	}
+	if len(t.Events) != 0 && !stringArrayContains(t.Events, ev.Type) {
+		return false
+	}
+	if len(t.Clients) != 0 {
+		ip, ok := ev.Data["client"]
+		if ok && !stringArrayContains(t.Clients, ip) &&
+			!stringArrayContains(t.Clients, ev.Data["client_name"]) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseNotifyTemplate(text string) (*template.Template, error) {
+	if len(text) == 0 {
+		return nil, nil
+	}
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}
+	return template.New("payload").Funcs(funcs).Option("missingkey=zero").Parse(text)
+}
+
+// Get the payload for the event
+func (t *notifyTarget) payload(ev event) ([]byte, error) {
+	tmpl, err := parseNotifyTemplate(t.Template)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == nil {
+		return json.Marshal(ev)
+	}
+
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, ev)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Send the event to the target
+func (n *notifier) send(t notifyTarget, ev event) error {
+	data, err := t.payload(ev)
+	if err != nil {
+		return fmt.Errorf("template: %s", err)
+	}
+
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "mqtt" || u.Scheme == "mqtts" {
+		return mqttPublish(u, data, notifyTimeout)
+	}
+
+	method := t.Method
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, t.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if len(t.Template) == 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: got status code %d", u.Host, resp.StatusCode)
+	}
+	return nil
+}
+
+// Send "disk_space_low" event when the free space falls below the limit
+func (n *notifier) checkDiskSpace(low *bool) {
+	free, err := util.DiskFreeSpace(n.dataDir)
+	if err != nil {
+		log.Debug("Notify: disk space: %s", err)
+		return
+	}
+
+	freeMB := free / (1024 * 1024)
+	if freeMB >= uint64(n.conf.DiskSpaceMin) {
+		*low = false
+		return
+	}
+	if *low {
+		return
+	}
+	*low = true
+	n.emit(event{
+		Type:    eventDiskSpaceLow,
+		Message: fmt.Sprintf("Low disk space: %d MB free in %s", freeMB, n.dataDir),
+		Data: map[string]string{
+			"path":    n.dataDir,
+			"free_mb": fmt.Sprintf("%d", freeMB),
+		},
+	})
+}
+
+// Load the list of known devices
+// On the first run all current DHCP clients become known.
+func (n *notifier) loadDevices() {
+	fn := n.devicesFile()
+	data, err := ioutil.ReadFile(fn)
+	if err == nil {
+		list := []string{}
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			log.Error("Notify: %s: %s", fn, err)
+		}
+		n.lock.Lock()
+		for _, mac := range list {
+			n.devices[mac] = true
+		}
+		n.lock.Unlock()
+		return
+	}
+	if !os.IsNotExist(err) {
+		log.Error("Notify: %s", err)
+		return
+	}
+
+	if n.dhcpServer != nil {
+		n.lock.Lock()
+		for _, l := range n.dhcpServer.Leases(dhcpd.LeasesAll) {
+			n.devices[l.HWAddr.String()] = true
+		}
+		n.lock.Unlock()
+	}
+	n.storeDevices()
+}
+
+func (n *notifier) devicesFile() string {
+	return filepath.Join(n.dataDir, devicesFileName)
+}
+
+func (n *notifier) storeDevices() {
+	n.lock.Lock()
+	list := []string{}
+	for mac := range n.devices {
+		list = append(list, mac)
+	}
+	n.lock.Unlock()
+
+	data, _ := json.Marshal(list)
+	err := file.SafeWrite(n.devicesFile(), data)
+	if err != nil {
+		log.Error("Notify: %s", err)
+	}
+}
+
+// Send "dhcp_new_device" event for the DHCP clients which we haven't seen before
+func (n *notifier) checkNewDevices() {
+	if !n.conf.Enabled || n.dhcpServer == nil {
+		return
+	}
+
+	var added []dhcpd.Lease
+	n.lock.Lock()
+	for _, l := range n.dhcpServer.Leases(dhcpd.LeasesDynamic) {
+		mac := l.HWAddr.String()
+		if n.devices[mac] {
+			continue
+		}
+		n.devices[mac] = true
+		added = append(added, l)
+	}
+	n.lock.Unlock()
+	if len(added) == 0 {
+		return
+	}
+	n.storeDevices()
+
+	for _, l := range added {
+		n.emit(event{
+			Type:    eventDHCPNewDevice,
+			Message: fmt.Sprintf("New device has joined the network: %s (%s, %s)", l.HWAddr, l.IP, l.Hostname),
+			Data: map[string]string{
+				"mac":      l.HWAddr.String(),
+				"ip":       l.IP.String(),
+				"hostname": l.Hostname,
+			},
+		})
+	}
+}
+
+// Send "safebrowsing_blocked" event
+func (n *notifier) onDNSResponse(d *proxy.DNSContext, res *dnsfilter.Result) {
+	if !n.conf.Enabled || res == nil || res.Reason != dnsfilter.FilteredSafeBrowsing ||
+		len(d.Req.Question) == 0 {
+		return
+	}
+
+	ip := dnsforward.GetIPString(d.Addr)
+	host := strings.TrimSuffix(d.Req.Question[0].Name, ".")
+	name := ""
+	c, ok := Context.clients.Find(ip)
+	if ok {
+		name = c.Name
+	}
+	clientName := ip
+	if len(name) != 0 {
+		clientName = name + " (" + ip + ")"
+	}
+
+	n.emit(event{
+		Type:    eventSafeBrowsingBlocked,
+		Message: fmt.Sprintf("Blocked malicious or phishing host %s for client %s", host, clientName),
+		Data: map[string]string{
+			"client":      ip,
+			"client_name": name,
+			"host":        host,
+		},
+		key: ip + " " + host,
+	})
+}
+
+// Send "upstream_down" or "upstream_up" event
+func (n *notifier) onUpstreamStatus(addr string, up bool, lastError string) {
+	ev := event{
+		Type:    eventUpstreamUp,
+		Message: fmt.Sprintf("Upstream %s is back online", addr),
+		Data: map[string]string{
+			"upstream": addr,
+		},
+	}
+	if !up {
+		ev.Type = eventUpstreamDown
+		ev.Message = fmt.Sprintf("Upstream %s is down: %s", addr, lastError)
+		ev.Data["error"] = lastError
+	}
+	n.emit(ev)
+}
+
+// Send the event if the notifications module is initialized
+func notifyEvent(ev event) {
+	if Context.notifier != nil {
+		Context.notifier.emit(ev)
+	}
+}
+
+func onDHCPLeaseChanged(flags int) {
+	if flags == dhcpd.LeaseChangedAdded && Context.notifier != nil {
+		Context.notifier.checkNewDevices()
+	}
+}
+
+func onUpstreamStatus(addr string, up bool, lastError string) {
+	if Context.notifier != nil {
+		Context.notifier.onUpstreamStatus(addr, up, lastError)
+	}
+}
+
+type notifyTargetJSON struct {
+	notifyTarget
+	notifyTargetStatus
+}
+
+type notifyStatusJSON struct {
+	Enabled      bool               `json:"enabled"`
+	DiskSpaceMin uint32             `json:"disk_space_min"`
+	Targets      []notifyTargetJSON `json:"targets"`
+	EventTypes   []string           `json:"event_types"`
+}
+
+func handleNotifyStatus(w http.ResponseWriter, r *http.Request) {
+	resp := notifyStatusJSON{
+		Enabled:      config.Notifications.Enabled,
+		DiskSpaceMin: config.Notifications.DiskSpaceMin,
+		Targets:      []notifyTargetJSON{},
+		EventTypes:   eventTypes,
+	}
+	for _, t := range config.Notifications.Targets {
+		tj := notifyTargetJSON{notifyTarget: t}
+		if Context.notifier != nil {
+			tj.notifyTargetStatus = Context.notifier.getStatus(t.Name)
+		}
+		resp.Targets = append(resp.Targets, tj)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleNotifyConfig(w http.ResponseWriter, r *http.Request) {
+	conf := notifyConfig{}
+	err := json.NewDecoder(r.Body).Decode(&conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkNotifyConfig(conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Notifications = conf
+	if Context.notifier != nil {
+		Context.notifier.Close()
+		Context.notifier = initNotifier(conf, Context.getDataDir(), Context.dhcpServer, Context.client)
+		Context.notifier.Start()
+	}
+
+	onConfigModified()
+	returnOK(w)
+}
+
+type notifyTestJSON struct {
+	Name string `json:"name"`
+}
+
+// Send a test event to the target right now
+func handleNotifyTest(w http.ResponseWriter, r *http.Request) {
+	req := notifyTestJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if Context.notifier == nil {
+		httpError(w, http.StatusBadRequest, "notifications are disabled")
+		return
+	}
+	n := Context.notifier
+	for _, t := range n.conf.Targets {
+		if t.Name != req.Name {
+			continue
+		}
+
+		host, _ := os.Hostname()
+		ev := event{
+			Type:    eventTest,
+			Time:    time.Now(),
+			Message: "Test notification from AdGuard Home",
+			Data: map[string]string{
+				"host": host,
+			},
+		}
+		err = n.send(t, ev)
+		n.setStatus(t.Name, err)
+		if err != nil {
+			httpError(w, http.StatusBadGateway, "%s", err)
+			return
+		}
+		returnOK(w)
+		return
+	}
+
+	httpError(w, http.StatusBadRequest, "unknown target: %s", req.Name)
+}
+
+// RegisterNotifyHandlers - register handlers
+func RegisterNotifyHandlers() {
+	httpRegister(http.MethodGet, "/control/notifications/status", handleNotifyStatus)
+	httpRegister(http.MethodPost, "/control/notifications/config", handleNotifyConfig)
+	httpRegister(http.MethodPost, "/control/notifications/test", handleNotifyTest)
+}
@@ -0,0 +1,128 @@
+// Minimal MQTT client for event notifications
+
+package home
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Publish a message to MQTT broker (MQTT 3.1.1, QoS 0)
+// URL: "mqtt://[user:password@]host[:port]/topic" or "mqtts://..." (TLS)
+func mqttPublish(u *url.URL, payload []byte, timeout time.Duration) error {
+	host := u.Host
+	if len(u.Port()) == 0 {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var conn net.Conn
+	var err error
+	d := &net.Dialer{Timeout: timeout}
+	if u.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{})
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return fmt.Errorf("mqtt: %s", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	user := ""
+	pass := ""
+	hasPass := false
+	if u.User != nil {
+		user = u.User.Username()
+		pass, hasPass = u.User.Password()
+	}
+	clientID := fmt.Sprintf("adguardhome-%d", time.Now().UnixNano()%1000000)
+
+	_, err = conn.Write(mqttConnectPacket(clientID, user, pass, hasPass))
+	if err != nil {
+		return fmt.Errorf("mqtt: %s", err)
+	}
+
+	// CONNACK: 0x20 0x02 <flags> <return code>
+	ack := make([]byte, 4)
+	_, err = io.ReadFull(conn, ack)
+	if err != nil {
+		return fmt.Errorf("mqtt: %s", err)
+	}
+	if ack[0] != 0x20 || ack[1] != 0x02 {
+		return fmt.Errorf("mqtt: invalid CONNACK packet")
+	}
+	if ack[3] != 0 {
+		return fmt.Errorf("mqtt: connection refused: code %d", ack[3])
+	}
+
+	topic := strings.TrimPrefix(u.Path, "/")
+	_, err = conn.Write(mqttPublishPacket(topic, payload))
+	if err != nil {
+		return fmt.Errorf("mqtt: %s", err)
+	}
+
+	// DISCONNECT
+	_, _ = conn.Write([]byte{0xe0, 0x00})
+	return nil
+}
+
+// Append MQTT "remaining length" field
+func mqttAppendLength(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// Append MQTT string: 2-byte length + data
+func mqttAppendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func mqttConnectPacket(clientID, user, pass string, hasPass bool) []byte {
+	flags := byte(0x02) // clean session
+	if len(user) != 0 {
+		flags |= 0x80
+		if hasPass {
+			flags |= 0x40
+		}
+	}
+
+	body := mqttAppendString(nil, "MQTT")
+	body = append(body, 4, flags, 0, 60) // protocol level 4 (3.1.1), keep alive: 60 seconds
+	body = mqttAppendString(body, clientID)
+	if len(user) != 0 {
+		body = mqttAppendString(body, user)
+		if hasPass {
+			body = mqttAppendString(body, pass)
+		}
+	}
+
+	p := mqttAppendLength([]byte{0x10}, len(body))
+	return append(p, body...)
+}
+
+func mqttPublishPacket(topic string, payload []byte) []byte {
+	body := mqttAppendString(nil, topic)
+	body = append(body, payload...)
+	p := mqttAppendLength([]byte{0x30}, len(body))
+	return append(p, body...)
+}
@@ -0,0 +1,81 @@
+package home
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Plugin settings
+type pluginConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// The name of a built-in plugin (registered with dnsforward.RegisterPlugin())
+	Name string `yaml:"name"`
+
+	// The path to a Go plugin file (.so) which exports the function:
+	//  func NewPlugin(conf map[string]string) (dnsforward.Plugin, error)
+	// The plugin must be built with the same Go version and the same versions of the packages.
+	Path string `yaml:"path"`
+
+	// The settings passed to the plugin
+	Config map[string]string `yaml:"config"`
+}
+
+// The name of the function exported by a Go plugin file
+const pluginSymbol = "NewPlugin"
+
+func checkPluginsConfig(confs []pluginConfig) error {
+	for i, c := range confs {
+		if (len(c.Name) == 0) == (len(c.Path) == 0) {
+			return fmt.Errorf("plugins[%d]: either name or path must be set", i)
+		}
+	}
+	return nil
+}
+
+// Create the enabled plugins
+func loadPlugins(confs []pluginConfig) ([]dnsforward.Plugin, error) {
+	err := checkPluginsConfig(confs)
+	if err != nil {
+		return nil, err
+	}
+
+	plugins := []dnsforward.Plugin{}
+	for _, c := range confs {
+		if !c.Enabled {
+			continue
+		}
+
+		var p dnsforward.Plugin
+		if len(c.Path) != 0 {
+			p, err = loadGoPlugin(c.Path, c.Config)
+		} else {
+			p, err = dnsforward.NewPlugin(c.Name, c.Config)
+		}
+		if err != nil {
+			closePlugins(plugins)
+			return nil, fmt.Errorf("plugin %s%s: %s", c.Name, c.Path, err)
+		}
+
+		log.Info("Plugins: loaded %s", p.Name())
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// Close the plugins which implement io.Closer
+func closePlugins(plugins []dnsforward.Plugin) {
+	for _, p := range plugins {
+		c, ok := p.(io.Closer)
+		if !ok {
+			continue
+		}
+		err := c.Close()
+		if err != nil {
+			log.Error("Plugins: %s: close: %s", p.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// +build linux,cgo darwin,cgo freebsd,cgo
+
+package home
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+)
+
+// Load a Go plugin file and create the plugin object
+func loadGoPlugin(path string, conf map[string]string) (dnsforward.Plugin, error) {
+	pl, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sym, err := pl.Lookup(pluginSymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	newPlugin, ok := sym.(func(map[string]string) (dnsforward.Plugin, error))
+	if !ok {
+		return nil, fmt.Errorf("%s has unexpected type %T", pluginSymbol, sym)
+	}
+	return newPlugin(conf)
+}
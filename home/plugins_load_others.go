@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!freebsd !cgo
+
+package home
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+)
+
+// Go plugins are supported only on Linux, macOS and FreeBSD with cgo enabled
+func loadGoPlugin(path string, conf map[string]string) (dnsforward.Plugin, error) {
+	return nil, fmt.Errorf("go plugins are not supported on this platform")
+}
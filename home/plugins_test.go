@@ -0,0 +1,50 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPlugin struct {
+	dnsforward.BasePlugin
+	closed bool
+}
+
+func (p *testPlugin) Name() string {
+	return "test"
+}
+
+func (p *testPlugin) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestLoadPlugins(t *testing.T) {
+	var created *testPlugin
+	dnsforward.RegisterPlugin("home-test", func(conf map[string]string) (dnsforward.Plugin, error) {
+		assert.Equal(t, "1", conf["key"])
+		created = &testPlugin{}
+		return created, nil
+	})
+
+	assert.NotNil(t, checkPluginsConfig([]pluginConfig{{}}))
+	assert.NotNil(t, checkPluginsConfig([]pluginConfig{{Name: "home-test", Path: "/tmp/plugin.so"}}))
+
+	plugins, err := loadPlugins([]pluginConfig{
+		{Enabled: true, Name: "home-test", Config: map[string]string{"key": "1"}},
+		{Enabled: false, Name: "unknown"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(plugins))
+	assert.Equal(t, "test", plugins[0].Name())
+
+	closePlugins(plugins)
+	assert.True(t, created.closed)
+
+	_, err = loadPlugins([]pluginConfig{{Enabled: true, Name: "unknown"}})
+	assert.NotNil(t, err)
+	_, err = loadPlugins([]pluginConfig{{Enabled: true, Path: "/nonexistent/plugin.so"}})
+	assert.NotNil(t, err)
+}
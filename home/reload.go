@@ -0,0 +1,646 @@
+// Reloading the configuration file without restart
+
+package home
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/querylog"
+	"github.com/AdguardTeam/AdGuardHome/stats"
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Configuration sections which are applied on reload
+const (
+	reloadDNSServer = "dns_server" // upstreams, listeners and the other DNS server settings
+	reloadFiltering = "filtering"  // global filtering settings, blocked services, rewrites and scripts
+	reloadFilters   = "filters"    // filter lists
+	reloadUserRules = "user_rules" // user rules and their expiration time
+	reloadClients   = "clients"    // persistent clients and groups of clients
+	reloadHTTP      = "http"       // web interface address
+	reloadTLS       = "tls"        // certificates, HTTPS server and encrypted DNS listeners
+	reloadDHCP      = "dhcp"
+	reloadQueryLog  = "querylog" // the query log settings which are available in web interface
+	reloadStats     = "stats"    // statistics interval
+)
+
+// Configuration sections which are applied after restart
+const (
+	reloadDNS = "dns" // the other settings from "dns" section: storage of query log and statistics, filtering engine
+)
+
+// The settings from the configuration file which are checked on reload
+// The format is the same as in the configuration file.
+type reloadedConfig struct {
+	BindHost        string                 `yaml:"bind_host"`
+	BindPort        int                    `yaml:"bind_port"`
+	DNS             dnsConfig              `yaml:"dns"`
+	TLS             tlsConfigSettings      `yaml:"tls"`
+	Filters         []filter               `yaml:"filters"`
+	UserRules       []string               `yaml:"user_rules"`
+	UserRulesExpiry []dnsfilter.RuleExpiry `yaml:"user_rules_expiry"`
+	DHCP            dhcpd.ServerConfig     `yaml:"dhcp"`
+	Clients         []clientObject         `yaml:"clients"`
+	ClientGroups    []clientGroupObject    `yaml:"client_groups"`
+	SchemaVersion   int                    `yaml:"schema_version"`
+}
+
+type reloadResult struct {
+	Changed         []string `json:"changed"`          // the sections which have been applied
+	RestartRequired []string `json:"restart_required"` // the changed sections which are applied after restart
+}
+
+// Get the settings which are in use now
+func currentReloadedConfig() reloadedConfig {
+	c := reloadedConfig{}
+	config.RLock()
+	c.BindHost = config.BindHost
+	c.BindPort = config.BindPort
+	c.DNS = config.DNS
+	c.TLS = config.TLS.tlsConfigSettings
+	c.Filters = append([]filter{}, config.Filters...)
+	c.UserRules = config.UserRules
+	c.UserRulesExpiry = config.UserRulesExpiry
+	c.DHCP = config.DHCP
+	c.SchemaVersion = config.SchemaVersion
+	config.RUnlock()
+
+	Context.dnsServer.WriteDiskConfig(&c.DNS.FilteringConfig)
+	Context.dnsFilter.WriteDiskConfig(&c.DNS.DnsfilterConf)
+	Context.clients.WriteDiskConfig(&c.Clients, &c.ClientGroups)
+	if Context.dhcpServer != nil {
+		Context.dhcpServer.WriteDiskConfig(&c.DHCP)
+	}
+	if Context.queryLog != nil {
+		dc := querylog.DiskConfig{}
+		Context.queryLog.WriteDiskConfig(&dc)
+		c.DNS.QueryLogEnabled = dc.Enabled
+		c.DNS.QueryLogInterval = dc.Interval
+		c.DNS.QueryLogMaxSize = dc.MaxSize
+		c.DNS.QueryLogCompression = dc.Compression
+		c.DNS.QueryLogAnonymizeClientIP = dc.AnonymizeClientIP
+		c.DNS.QueryLogHashClientIP = dc.HashClientIP
+		c.DNS.QueryLogBlockedOnly = dc.BlockedOnly
+	}
+	if Context.stats != nil {
+		sdc := stats.DiskConfig{}
+		Context.stats.WriteDiskConfig(&sdc)
+		c.DNS.StatsInterval = sdc.Interval
+	}
+	return c
+}
+
+// Get the query log settings which are applied on reload
+func reloadQueryLogConfig(c dnsConfig) querylog.DiskConfig {
+	return querylog.DiskConfig{
+		Enabled:           c.QueryLogEnabled,
+		Interval:          c.QueryLogInterval,
+		MaxSize:           c.QueryLogMaxSize,
+		Compression:       c.QueryLogCompression,
+		AnonymizeClientIP: c.QueryLogAnonymizeClientIP,
+		HashClientIP:      c.QueryLogHashClientIP,
+		BlockedOnly:       c.QueryLogBlockedOnly,
+	}
+}
+
+// Read the configuration file
+// The settings which aren't in the file keep their current values.
+func readReloadedConfig(cur reloadedConfig) (reloadedConfig, error) {
+	c := reloadedConfig{}
+
+	// deep copy, so the current settings aren't modified by yaml.Unmarshal()
+	data, err := yaml.Marshal(&cur)
+	if err != nil {
+		return c, fmt.Errorf("yaml.Marshal: %s", err)
+	}
+	err = yaml.Unmarshal(data, &c)
+	if err != nil {
+		return c, fmt.Errorf("yaml.Unmarshal: %s", err)
+	}
+	// yaml.Unmarshal() adds the elements to the existing maps, so the removed elements would be kept
+	c.DNS.UpstreamThresholds = nil
+	c.DNS.UpstreamWeights = nil
+
+	configFile := config.getConfigFilename()
+	data, err = ioutil.ReadFile(configFile)
+	if err != nil {
+		return c, err
+	}
+	data, err = applyConfigOverrides(data, Context.configOverrides)
+	if err != nil {
+		return c, fmt.Errorf("config overrides: %s", err)
+	}
+	data, err = decryptConfigData(data)
+	if err != nil {
+		return c, err
+	}
+	err = yaml.Unmarshal(data, &c)
+	if err != nil {
+		return c, fmt.Errorf("%s: %s", configFile, err)
+	}
+	return c, nil
+}
+
+// Check the new settings before applying them
+func checkReloadedConfig(c *reloadedConfig) error {
+	if c.SchemaVersion != currentSchemaVersion {
+		return fmt.Errorf("schema version %d is not supported (expected %d): restart is required to upgrade the configuration",
+			c.SchemaVersion, currentSchemaVersion)
+	}
+
+	if !checkFiltersUpdateIntervalHours(c.DNS.FiltersUpdateIntervalHours) {
+		return fmt.Errorf("invalid filters_update_interval: %d", c.DNS.FiltersUpdateIntervalHours)
+	}
+
+	err := dnsforward.ValidateUpstreams(c.DNS.UpstreamDNS)
+	if err != nil {
+		return fmt.Errorf("upstream_dns: %s", err)
+	}
+
+	_, err = dnsfilter.PrepareScripts(c.DNS.DnsfilterConf.Scripts)
+	if err != nil {
+		return fmt.Errorf("scripts: %s", err)
+	}
+
+	qc := reloadQueryLogConfig(c.DNS)
+	err = querylog.CheckDiskConfig(&qc)
+	if err != nil {
+		return fmt.Errorf("querylog: %s", err)
+	}
+	err = stats.CheckDiskConfig(&stats.DiskConfig{Interval: c.DNS.StatsInterval})
+	if err != nil {
+		return fmt.Errorf("statistics: %s", err)
+	}
+
+	ids := map[int64]bool{}
+	urls := map[string]bool{}
+	for _, f := range c.Filters {
+		if !isLocalFilterURL(f.URL) && !IsValidURL(f.URL) {
+			return fmt.Errorf("filters: invalid URL: %s", f.URL)
+		}
+		if urls[f.URL] {
+			return fmt.Errorf("filters: duplicate URL: %s", f.URL)
+		}
+		urls[f.URL] = true
+		if f.ID != 0 {
+			if ids[f.ID] {
+				return fmt.Errorf("filters: duplicate ID: %d", f.ID)
+			}
+			ids[f.ID] = true
+		}
+	}
+	return nil
+}
+
+// Check the changed settings which depend on the system: the ports, the certificates and the network interfaces
+// Return the new TLS settings with the certificate data.
+func checkReloadedChanges(c, cur *reloadedConfig) (tlsConfig, error) {
+	tls := tlsConfig{tlsConfigSettings: c.TLS}
+
+	if c.BindPort != cur.BindPort {
+		err := util.CheckPortAvailable(c.BindHost, c.BindPort)
+		if err != nil {
+			return tls, fmt.Errorf("bind_port: %s", err)
+		}
+	}
+
+	if c.DNS.Port != cur.DNS.Port {
+		err := util.CheckPacketPortAvailable(c.DNS.BindHost, c.DNS.Port)
+		if err == nil {
+			err = util.CheckPortAvailable(c.DNS.BindHost, c.DNS.Port)
+		}
+		if err != nil {
+			return tls, fmt.Errorf("dns.port: %s", err)
+		}
+	}
+
+	if !yamlEqual(c.TLS, cur.TLS) {
+		err := checkQUICSettings(c.TLS)
+		if err != nil {
+			return tls, fmt.Errorf("tls: %s", err)
+		}
+		status := tlsConfigStatus{}
+		if !tlsLoadConfig(&tls, &status) {
+			return tls, fmt.Errorf("tls: %s", status.WarningValidation)
+		}
+		if c.TLS.Enabled {
+			tls.tlsConfigStatus = validateCertificates(string(tls.CertificateChainData), string(tls.PrivateKeyData), tls.ServerName)
+			if !tls.ValidPair {
+				return tls, fmt.Errorf("tls: %s", tls.WarningValidation)
+			}
+			if c.TLS.PortHTTPS != 0 && (c.TLS.PortHTTPS != cur.TLS.PortHTTPS || !cur.TLS.Enabled) {
+				err = util.CheckPortAvailable(c.BindHost, c.TLS.PortHTTPS)
+				if err != nil {
+					return tls, fmt.Errorf("tls.port_https: %s", err)
+				}
+			}
+		}
+	}
+
+	if Context.dhcpServer != nil && !yamlEqual(c.DHCP, cur.DHCP) {
+		err := dhcpd.CheckOptions(c.DHCP.Options, c.DHCP.StaticLeaseOptions)
+		if err == nil && c.DHCP.Enabled {
+			err = Context.dhcpServer.CheckConfig(c.DHCP)
+		}
+		if err != nil {
+			return tls, fmt.Errorf("dhcp: %s", err)
+		}
+	}
+	return tls, nil
+}
+
+// Re-read the configuration file and apply the changed settings
+// All settings are checked before anything is applied, and they are applied as one unit:
+// if a section can't be applied, the sections which have been applied are restored.
+// Return the sections which have been applied and the changed sections which require restart.
+// Context.controlLock must be held.
+func reloadConfig() (reloadResult, error) {
+	res := reloadResult{
+		Changed:         []string{},
+		RestartRequired: []string{},
+	}
+
+	cur := currentReloadedConfig()
+	c, err := readReloadedConfig(cur)
+	if err != nil {
+		return res, err
+	}
+	err = checkReloadedConfig(&c)
+	if err != nil {
+		return res, err
+	}
+	v := validateConfigFile()
+	if !v.Valid {
+		return res, v.err()
+	}
+	tls, err := checkReloadedChanges(&c, &cur)
+	if err != nil {
+		return res, err
+	}
+
+	config.RLock()
+	curTLS := config.TLS
+	config.RUnlock()
+
+	res, download, err := reloadApply(&c, &cur, tls)
+	if err != nil {
+		log.Error("Reload: %s: restoring the previous settings", err)
+		_, _, err2 := reloadApply(&cur, &c, curTLS)
+		if err2 != nil {
+			log.Error("Reload: couldn't restore the previous settings: %s", err2)
+		}
+		return reloadResult{Changed: []string{}, RestartRequired: []string{}}, err
+	}
+
+	reloadFinish(cur.Filters, res, download)
+	log.Info("Reload: applied: %v;  restart is required for: %v", res.Changed, res.RestartRequired)
+	return res, nil
+}
+
+// Apply the settings c which differ from cur
+// tls is the new TLS settings with the certificate data.
+// Return TRUE if the new filters must be downloaded.
+func reloadApply(c, cur *reloadedConfig, tls tlsConfig) (reloadResult, bool, error) {
+	res := reloadResult{
+		Changed:         []string{},
+		RestartRequired: []string{},
+	}
+
+	if !reloadOtherDNSEqual(c.DNS, cur.DNS) {
+		res.RestartRequired = append(res.RestartRequired, reloadDNS)
+	}
+
+	if c.BindHost != cur.BindHost || c.BindPort != cur.BindPort {
+		// the web servers are restarted when all settings are applied
+		config.Lock()
+		config.BindHost = c.BindHost
+		config.BindPort = c.BindPort
+		config.Unlock()
+		res.Changed = append(res.Changed, reloadHTTP)
+	}
+
+	tlsChanged := !yamlEqual(c.TLS, cur.TLS)
+	if tlsChanged {
+		// the DNS server is re-configured with the new certificate below
+		config.Lock()
+		config.TLS = tls
+		config.Unlock()
+		res.Changed = append(res.Changed, reloadTLS)
+	}
+
+	qc := reloadQueryLogConfig(c.DNS)
+	if Context.queryLog != nil && !yamlEqual(qc, reloadQueryLogConfig(cur.DNS)) {
+		Context.queryLog.SetDiskConfig(&qc)
+		res.Changed = append(res.Changed, reloadQueryLog)
+	}
+	if Context.stats != nil && c.DNS.StatsInterval != cur.DNS.StatsInterval {
+		Context.stats.SetDiskConfig(&stats.DiskConfig{Interval: c.DNS.StatsInterval})
+		res.Changed = append(res.Changed, reloadStats)
+	}
+
+	if reloadApplyFiltering(c.DNS, cur.DNS) {
+		res.Changed = append(res.Changed, reloadFiltering)
+	}
+	changed, download := reloadApplyFilters(c.Filters)
+	if changed {
+		res.Changed = append(res.Changed, reloadFilters)
+	}
+	if syncApplyUserRules(c.UserRules, c.UserRulesExpiry) {
+		res.Changed = append(res.Changed, reloadUserRules)
+	}
+	if syncApplyClients(c.Clients, c.ClientGroups) {
+		res.Changed = append(res.Changed, reloadClients)
+	}
+
+	if Context.dhcpServer != nil && !yamlEqual(c.DHCP, cur.DHCP) {
+		err := Context.dhcpServer.Reconfigure(c.DHCP)
+		if err != nil {
+			return res, download, fmt.Errorf("dhcp: %s", err)
+		}
+		config.Lock()
+		Context.dhcpServer.WriteDiskConfig(&config.DHCP)
+		config.Unlock()
+		res.Changed = append(res.Changed, reloadDHCP)
+	}
+
+	// the DNS server is re-configured last:
+	//  it also applies the changed blocked services and TLS settings
+	serverChanged := !yamlEqual(c.DNS.FilteringConfig, cur.DNS.FilteringConfig) ||
+		c.DNS.BindHost != cur.DNS.BindHost || c.DNS.Port != cur.DNS.Port
+	if serverChanged || tlsChanged || !arraysEqual(c.DNS.BlockedServices, cur.DNS.BlockedServices) {
+		config.Lock()
+		config.DNS.FilteringConfig = c.DNS.FilteringConfig
+		config.DNS.BindHost = c.DNS.BindHost
+		config.DNS.Port = c.DNS.Port
+		config.DNS.BlockedServices = c.DNS.BlockedServices
+		config.Unlock()
+
+		err := reconfigureDNSServer()
+		if err != nil {
+			return res, download, err
+		}
+	}
+	if serverChanged {
+		res.Changed = append(res.Changed, reloadDNSServer)
+	}
+	return res, download, nil
+}
+
+// Finish reloading when all settings have been applied:
+// remove the files of the deleted filters, download the new filters and restart the web servers
+func reloadFinish(prevFilters []filter, res reloadResult, download bool) {
+	config.RLock()
+	for _, f := range prevFilters {
+		found := false
+		for _, nf := range config.Filters {
+			if nf.ID == f.ID && nf.URL == f.URL {
+				found = true
+				break
+			}
+		}
+		if !found {
+			err := os.Rename(f.Path(), f.Path()+".old")
+			if err != nil && !os.IsNotExist(err) {
+				log.Error("os.Rename: %s: %s", f.Path(), err)
+			}
+		}
+	}
+	config.RUnlock()
+
+	if download {
+		go reloadDownloadFilters()
+	}
+
+	web := stringArrayContains(res.Changed, reloadHTTP)
+	tls := stringArrayContains(res.Changed, reloadTLS)
+	if tls && Context.blockPage != nil {
+		// the block page server has a copy of the certificate
+		Context.blockPage.Close()
+		Context.blockPage.Start()
+	}
+	if web || tls {
+		// this needs to be done in a goroutine because Shutdown() is a blocking call,
+		// and we may be inside a request to the web server right now
+		go func() {
+			time.Sleep(time.Second) // let the response to the reload request through
+			if web {
+				_ = Context.httpServer.Shutdown(context.TODO())
+			}
+			restartHTTPSServer()
+		}()
+	}
+}
+
+// Return TRUE if the settings from "dns" section which aren't applied on reload are equal
+func reloadOtherDNSEqual(a, b dnsConfig) bool {
+	a.BindHost = b.BindHost
+	a.Port = b.Port
+	a.FilteringConfig = b.FilteringConfig
+	a.FilteringEnabled = b.FilteringEnabled
+	a.FiltersUpdateIntervalHours = b.FiltersUpdateIntervalHours
+	a.BlockedServices = b.BlockedServices
+	a.DnsfilterConf.ParentalEnabled = b.DnsfilterConf.ParentalEnabled
+	a.DnsfilterConf.SafeSearchEnabled = b.DnsfilterConf.SafeSearchEnabled
+	a.DnsfilterConf.SafeBrowsingEnabled = b.DnsfilterConf.SafeBrowsingEnabled
+	a.DnsfilterConf.Rewrites = b.DnsfilterConf.Rewrites
+	a.DnsfilterConf.Scripts = b.DnsfilterConf.Scripts
+	a.QueryLogEnabled = b.QueryLogEnabled
+	a.QueryLogInterval = b.QueryLogInterval
+	a.QueryLogMaxSize = b.QueryLogMaxSize
+	a.QueryLogCompression = b.QueryLogCompression
+	a.QueryLogAnonymizeClientIP = b.QueryLogAnonymizeClientIP
+	a.QueryLogHashClientIP = b.QueryLogHashClientIP
+	a.QueryLogBlockedOnly = b.QueryLogBlockedOnly
+	a.StatsInterval = b.StatsInterval
+	return yamlEqual(a, b)
+}
+
+// Apply the global filtering settings
+// Return TRUE if the settings have changed.
+func reloadApplyFiltering(c, cur dnsConfig) bool {
+	changed := false
+
+	config.Lock()
+	enable := config.DNS.FilteringEnabled != c.FilteringEnabled
+	if enable || config.DNS.FiltersUpdateIntervalHours != c.FiltersUpdateIntervalHours {
+		config.DNS.FilteringEnabled = c.FilteringEnabled
+		config.DNS.FiltersUpdateIntervalHours = c.FiltersUpdateIntervalHours
+		changed = true
+	}
+	config.Unlock()
+	if enable {
+		enableFilters(true)
+	}
+
+	if !arraysEqual(c.BlockedServices, cur.BlockedServices) {
+		// applied when the DNS server is re-configured
+		changed = true
+	}
+
+	if c.DnsfilterConf.SafeBrowsingEnabled != cur.DnsfilterConf.SafeBrowsingEnabled ||
+		c.DnsfilterConf.ParentalEnabled != cur.DnsfilterConf.ParentalEnabled ||
+		c.DnsfilterConf.SafeSearchEnabled != cur.DnsfilterConf.SafeSearchEnabled {
+
+		Context.dnsFilter.SetProtection(c.DnsfilterConf.SafeBrowsingEnabled,
+			c.DnsfilterConf.ParentalEnabled, c.DnsfilterConf.SafeSearchEnabled)
+		changed = true
+	}
+
+	if syncApplyRewrites(c.DnsfilterConf.Rewrites) {
+		changed = true
+	}
+
+	if !yamlEqual(c.DnsfilterConf.Scripts, cur.DnsfilterConf.Scripts) {
+		// the scripts have been checked already
+		_ = Context.dnsFilter.SetScripts(c.DnsfilterConf.Scripts)
+		changed = true
+	}
+	return changed
+}
+
+// Replace the filter lists
+// The filters with the same ID and URL keep their data, the other filters are loaded from disk or downloaded.
+// The files of the removed filters are kept until the reload is finished.
+// Return TRUE if the filters have changed; TRUE if the new filters must be downloaded.
+func reloadApplyFilters(list []filter) (bool, bool) {
+	changed := false
+	download := false
+
+	config.Lock()
+	updateUniqueFilterID(list)
+	filters := []filter{}
+	for _, nf := range list {
+		i := 0
+		for ; i != len(config.Filters); i++ {
+			if config.Filters[i].ID == nf.ID && config.Filters[i].URL == nf.URL {
+				break
+			}
+		}
+		if i == len(config.Filters) {
+			f := filter{
+				Enabled:        nf.Enabled,
+				URL:            nf.URL,
+				Name:           nf.Name,
+				UpdateInterval: nf.UpdateInterval,
+				Auth:           nf.Auth,
+			}
+			f.ID = nf.ID
+			if f.ID == 0 {
+				f.ID = assignUniqueFilterID()
+			}
+			if f.Enabled {
+				err := f.load()
+				if err != nil {
+					download = true
+				}
+			}
+			filters = append(filters, f)
+			changed = true
+			continue
+		}
+
+		f := config.Filters[i]
+		if !yamlEqual(f, nf) {
+			f.Name = nf.Name
+			f.UpdateInterval = nf.UpdateInterval
+			f.Auth = nf.Auth
+			f.ETag = nf.ETag
+			f.LastModified = nf.LastModified
+			changed = true
+		}
+		if f.Enabled != nf.Enabled {
+			f.Enabled = nf.Enabled
+			if f.Enabled {
+				err := f.load()
+				if err != nil {
+					f.LastUpdated = time.Time{}
+					download = true
+				}
+			} else {
+				f.unload()
+			}
+		}
+		filters = append(filters, f)
+	}
+
+	for _, f := range config.Filters {
+		found := false
+		for _, nf := range filters {
+			if nf.ID == f.ID && nf.URL == f.URL {
+				found = true
+				break
+			}
+		}
+		if !found {
+			changed = true
+		}
+	}
+
+	if changed {
+		config.Filters = filters
+	}
+	config.Unlock()
+
+	if changed {
+		enableFilters(true)
+	}
+	return changed, download
+}
+
+// Download the new filter lists
+func reloadDownloadFilters() {
+	refreshStatus = 1
+	refreshLock.Lock()
+	_, _ = refreshFiltersIfNecessary(false)
+	refreshLock.Unlock()
+	refreshStatus = 0
+}
+
+// Reload the configuration on SIGHUP
+func onReloadSignal() {
+	Context.controlLock.Lock()
+	if Context.firstRun || Context.dnsServer == nil {
+		Context.controlLock.Unlock()
+		log.Info("Reload: received SIGHUP, but AdGuard Home isn't configured yet")
+		return
+	}
+	log.Info("Reload: received SIGHUP, reloading configuration")
+	sdNotify("RELOADING=1")
+	_, err := reloadConfig()
+	Context.controlLock.Unlock()
+	sdNotify("READY=1")
+	if err != nil {
+		log.Error("Reload: %s", err)
+	}
+}
+
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	res, err := reloadConfig()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "reload: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// RegisterReloadHandlers - register handlers
+func RegisterReloadHandlers() {
+	httpRegister(http.MethodPost, "/control/reload", handleReload)
+}
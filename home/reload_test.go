@@ -0,0 +1,100 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadedConfig(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := dir + "/AdGuardHome.yaml"
+	prev := Context.configFilename
+	Context.configFilename = fn
+	defer func() { Context.configFilename = prev }()
+
+	cur := reloadedConfig{
+		BindHost:      "0.0.0.0",
+		BindPort:      3000,
+		SchemaVersion: currentSchemaVersion,
+	}
+	cur.DNS.Port = 53
+	cur.DNS.FiltersUpdateIntervalHours = 24
+	cur.DNS.UpstreamDNS = []string{"1.1.1.1"}
+	cur.DNS.UpstreamWeights = map[string]uint32{"1.1.1.1": 1}
+	cur.DNS.StatsInterval = 1
+	cur.DNS.QueryLogInterval = 90
+
+	data := `
+bind_port: 3001
+dns:
+  upstream_dns:
+  - 8.8.8.8
+  upstream_weights:
+    8.8.8.8: 2
+  blocked_services:
+  - facebook
+filters:
+- enabled: true
+  url: https://example.org/1.txt
+  name: list
+  id: 1
+`
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(data), 0644))
+	c, err := readReloadedConfig(cur)
+	assert.Nil(t, err)
+	assert.Nil(t, checkReloadedConfig(&c))
+
+	// the settings which aren't in the file keep their values
+	assert.Equal(t, "0.0.0.0", c.BindHost)
+	assert.Equal(t, 3001, c.BindPort)
+	assert.Equal(t, 53, c.DNS.Port)
+	assert.Equal(t, []string{"8.8.8.8"}, c.DNS.UpstreamDNS)
+	assert.Equal(t, []string{"facebook"}, c.DNS.BlockedServices)
+	assert.Equal(t, 1, len(c.Filters))
+
+	// the current settings aren't modified
+	assert.Equal(t, map[string]uint32{"1.1.1.1": 1}, cur.DNS.UpstreamWeights)
+	assert.Equal(t, map[string]uint32{"8.8.8.8": 2}, c.DNS.UpstreamWeights)
+
+	// only the settings which are applied on reload have changed
+	assert.True(t, reloadOtherDNSEqual(c.DNS, cur.DNS))
+	c.DNS.StatsInterval = 7
+	c.DNS.QueryLogInterval = 30
+	assert.True(t, reloadOtherDNSEqual(c.DNS, cur.DNS))
+	c.DNS.StatsDailyRetention = 30
+	assert.False(t, reloadOtherDNSEqual(c.DNS, cur.DNS))
+	c.DNS.StatsDailyRetention = cur.DNS.StatsDailyRetention
+
+	// invalid settings
+	c.Filters = append(c.Filters, c.Filters[0])
+	assert.NotNil(t, checkReloadedConfig(&c))
+	c.Filters[1].URL = "https://example.org/2.txt"
+	assert.NotNil(t, checkReloadedConfig(&c))
+	c.Filters[1].ID = 2
+	assert.Nil(t, checkReloadedConfig(&c))
+
+	c.DNS.QueryLogInterval = 2
+	assert.NotNil(t, checkReloadedConfig(&c))
+	c.DNS.QueryLogInterval = 30
+
+	c.SchemaVersion = currentSchemaVersion - 1
+	assert.NotNil(t, checkReloadedConfig(&c))
+	c.SchemaVersion = currentSchemaVersion
+
+	// the changed settings are checked before anything is applied
+	c.BindPort = cur.BindPort
+	_, err = checkReloadedChanges(&c, &cur)
+	assert.Nil(t, err)
+	c.TLS.Enabled = true
+	c.TLS.CertificatePath = dir + "/missing.crt"
+	_, err = checkReloadedChanges(&c, &cur)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("dns: ["), 0644))
+	_, err = readReloadedConfig(cur)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,69 @@
+// Storing the master key in OS keyring: Secret Service on Linux (secret-tool) and Keychain on macOS (security)
+
+package home
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	keyringService = "AdGuardHome"
+	keyringAccount = "master-key"
+	keyringLabel   = "AdGuard Home master key"
+
+	securityItemNotFound = 44 // the exit code of "security find-generic-password" if the item isn't found
+)
+
+func keyringSupported() bool {
+	return runtime.GOOS == "linux" || runtime.GOOS == "darwin"
+}
+
+// Get the master key from OS keyring
+// Return FALSE if the key isn't found.
+func keyringGet() (string, bool, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", keyringAccount)
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", keyringAccount, "-w")
+	default:
+		return "", false, fmt.Errorf("OS keyring is not supported on %s", runtime.GOOS)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		ee, ok := err.(*exec.ExitError)
+		if ok && ((runtime.GOOS == "linux" && len(out) == 0 && len(ee.Stderr) == 0) ||
+			(runtime.GOOS == "darwin" && ee.ExitCode() == securityItemNotFound)) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("%s: %s", cmd.Path, err)
+	}
+	return strings.TrimSpace(string(out)), true, nil
+}
+
+// Store the master key in OS keyring
+func keyringSet(val string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		// secret-tool reads the secret from stdin
+		cmd = exec.Command("secret-tool", "store", "--label", keyringLabel, "service", keyringService, "account", keyringAccount)
+		cmd.Stdin = strings.NewReader(val)
+	case "darwin":
+		cmd = exec.Command("security", "add-generic-password", "-U", "-s", keyringService, "-a", keyringAccount,
+			"-l", keyringLabel, "-w", val)
+	default:
+		return fmt.Errorf("OS keyring is not supported on %s", runtime.GOOS)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", cmd.Path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
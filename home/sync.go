@@ -0,0 +1,593 @@
+// Configuration sync: a replica pulls settings from the primary instance
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Configuration sections which are synchronized
+const (
+	syncFilters         = "filters"          // filter lists (except local files)
+	syncUserRules       = "user_rules"       // user rules and their expiration time
+	syncRewrites        = "rewrites"         // DNS rewrites
+	syncClients         = "clients"          // persistent clients and groups of clients
+	syncBlockedServices = "blocked_services" // global blocked services
+)
+
+var syncSections = []string{syncFilters, syncUserRules, syncRewrites, syncClients, syncBlockedServices}
+
+const (
+	syncDefaultInterval = 60 // in minutes
+	syncMaxSize         = 64 * 1024 * 1024
+)
+
+type syncConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+
+	// The address of the primary instance's web interface (e.g. "http://192.168.1.2:3000")
+	PrimaryURL string `yaml:"primary_url" json:"primary_url"`
+
+	// API token of the primary instance ("filtering" or "admin" scope)
+	Token string `yaml:"token" json:"token"`
+
+	Interval uint32 `yaml:"interval" json:"interval"` // in minutes.  0: default (60)
+
+	// The sections to synchronize.  Empty: all sections.
+	Include []string `yaml:"include" json:"include"`
+	// The sections which are never synchronized
+	Exclude []string `yaml:"exclude" json:"exclude"`
+}
+
+type syncStatus struct {
+	LastSync  time.Time `json:"last_sync"` // the time of the last successful sync
+	LastError string    `json:"last_error"`
+}
+
+// The data which the primary instance sends to a replica
+// The format is the same as in the configuration file.
+type syncData struct {
+	Sections        []string                 `yaml:"sections"` // the sections present in this data
+	Filters         []filter                 `yaml:"filters"`
+	UserRules       []string                 `yaml:"user_rules"`
+	UserRulesExpiry []dnsfilter.RuleExpiry   `yaml:"user_rules_expiry"`
+	Rewrites        []dnsfilter.RewriteEntry `yaml:"rewrites"`
+	Clients         []clientObject           `yaml:"clients"`
+	ClientGroups    []clientGroupObject      `yaml:"client_groups"`
+	BlockedServices []string                 `yaml:"blocked_services"`
+}
+
+// Replica module
+type replica struct {
+	conf   syncConfig
+	client *http.Client
+	lock   sync.Mutex
+	status syncStatus
+	now    chan bool // sync right now
+	stop   chan bool
+}
+
+// Create module context
+func initReplica(conf syncConfig, client *http.Client) *replica {
+	r := &replica{
+		conf:   conf,
+		client: client,
+	}
+	if r.conf.Interval == 0 {
+		r.conf.Interval = syncDefaultInterval
+	}
+	return r
+}
+
+func checkSyncConfig(conf syncConfig) error {
+	for _, s := range append(conf.Include, conf.Exclude...) {
+		if !stringArrayContains(syncSections, s) {
+			return fmt.Errorf("unknown section: %s", s)
+		}
+	}
+	if !conf.Enabled {
+		return nil
+	}
+
+	u, err := url.Parse(conf.PrimaryURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid primary URL: %s", conf.PrimaryURL)
+	}
+	if len(conf.Token) == 0 {
+		return fmt.Errorf("token isn't set")
+	}
+	return nil
+}
+
+// Get the sections to synchronize
+func (r *replica) sections() []string {
+	sections := []string{}
+	for _, s := range syncSections {
+		if (len(r.conf.Include) == 0 || stringArrayContains(r.conf.Include, s)) &&
+			!stringArrayContains(r.conf.Exclude, s) {
+			sections = append(sections, s)
+		}
+	}
+	return sections
+}
+
+// Start the background worker
+func (r *replica) Start() {
+	if !r.conf.Enabled || len(r.sections()) == 0 {
+		return
+	}
+	r.now = make(chan bool, 1)
+	r.stop = make(chan bool)
+	go r.workerLoop(r.stop)
+}
+
+// Close - stop the background worker
+func (r *replica) Close() {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// SyncNow - wake up the worker
+func (r *replica) SyncNow() {
+	if r.now == nil {
+		return
+	}
+	select {
+	case r.now <- true:
+	default:
+	}
+}
+
+func (r *replica) workerLoop(stop chan bool) {
+	for {
+		err := r.sync()
+		r.lock.Lock()
+		if err != nil {
+			log.Error("Sync: %s", err)
+			r.status.LastError = err.Error()
+		} else {
+			r.status.LastSync = time.Now()
+			r.status.LastError = ""
+		}
+		r.lock.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-r.now:
+			//
+		case <-time.After(time.Duration(r.conf.Interval) * time.Minute):
+			//
+		}
+	}
+}
+
+func (r *replica) getStatus() syncStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+// Get the data from the primary instance
+func (r *replica) load() (syncData, error) {
+	data := syncData{}
+	u := strings.TrimSuffix(r.conf.PrimaryURL, "/") + "/control/sync/export?sections=" +
+		url.QueryEscape(strings.Join(r.sections(), ","))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return data, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.conf.Token)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return data, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, syncMaxSize))
+	if err != nil {
+		return data, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return data, fmt.Errorf("%s: status code %d: %s", u, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	err = yaml.Unmarshal(body, &data)
+	if err != nil {
+		return data, fmt.Errorf("yaml.Unmarshal: %s", err)
+	}
+	return data, nil
+}
+
+// Get the data from the primary instance and apply it
+func (r *replica) sync() error {
+	data, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	Context.controlLock.Lock()
+	download := false
+	n := 0
+	for _, s := range r.sections() {
+		if !stringArrayContains(data.Sections, s) {
+			// the primary instance doesn't support this section
+			continue
+		}
+		changed := false
+		switch s {
+		case syncFilters:
+			changed, download = syncApplyFilters(data.Filters)
+		case syncUserRules:
+			changed = syncApplyUserRules(data.UserRules, data.UserRulesExpiry)
+		case syncRewrites:
+			changed = syncApplyRewrites(data.Rewrites)
+		case syncClients:
+			changed = syncApplyClients(data.Clients, data.ClientGroups)
+		case syncBlockedServices:
+			changed, err = syncApplyBlockedServices(data.BlockedServices)
+		}
+		if err != nil {
+			break
+		}
+		if changed {
+			log.Info("Sync: updated %s", s)
+			n++
+		}
+	}
+	if n != 0 {
+		onConfigModified()
+	}
+	Context.controlLock.Unlock()
+
+	if download {
+		// download the new filter lists
+		refreshStatus = 1
+		refreshLock.Lock()
+		_, _ = refreshFiltersIfNecessary(false)
+		refreshLock.Unlock()
+		refreshStatus = 0
+	}
+
+	log.Debug("Sync: %d sections changed", n)
+	return err
+}
+
+// Replace the filter lists
+// The filters with the same URL keep their data, the new filters are downloaded.
+// Local filter lists aren't synchronized.
+// Return TRUE if the filters have changed; TRUE if the new filters must be downloaded.
+func syncApplyFilters(remote []filter) (bool, bool) {
+	changed := false
+	download := false
+
+	config.Lock()
+	filters := []filter{}
+	for _, f := range config.Filters {
+		if isLocalFilterURL(f.URL) {
+			filters = append(filters, f)
+		}
+	}
+
+	for _, rf := range remote {
+		if isLocalFilterURL(rf.URL) || !IsValidURL(rf.URL) {
+			continue
+		}
+
+		i := 0
+		for ; i != len(config.Filters); i++ {
+			if config.Filters[i].URL == rf.URL {
+				break
+			}
+		}
+		if i == len(config.Filters) {
+			f := filter{
+				Enabled:        rf.Enabled,
+				URL:            rf.URL,
+				Name:           rf.Name,
+				UpdateInterval: rf.UpdateInterval,
+				Auth:           rf.Auth,
+			}
+			f.ID = assignUniqueFilterID()
+			filters = append(filters, f)
+			changed = true
+			download = download || f.Enabled
+			continue
+		}
+
+		f := config.Filters[i]
+		if f.Name != rf.Name || f.UpdateInterval != rf.UpdateInterval || f.Auth != rf.Auth {
+			f.Name = rf.Name
+			f.UpdateInterval = rf.UpdateInterval
+			f.Auth = rf.Auth
+			changed = true
+		}
+		if f.Enabled != rf.Enabled {
+			f.Enabled = rf.Enabled
+			if f.Enabled {
+				err := f.load()
+				if err != nil {
+					f.LastUpdated = time.Time{}
+					download = true
+				}
+			} else {
+				f.unload()
+			}
+			changed = true
+		}
+		filters = append(filters, f)
+	}
+
+	for _, f := range config.Filters {
+		found := false
+		for _, nf := range filters {
+			if nf.URL == f.URL {
+				found = true
+				break
+			}
+		}
+		if !found {
+			err := os.Rename(f.Path(), f.Path()+".old")
+			if err != nil && !os.IsNotExist(err) {
+				log.Error("os.Rename: %s: %s", f.Path(), err)
+			}
+			changed = true
+		}
+	}
+
+	if changed {
+		config.Filters = filters
+	}
+	config.Unlock()
+
+	if changed {
+		enableFilters(true)
+	}
+	return changed, download
+}
+
+func syncApplyUserRules(rules []string, expiry []dnsfilter.RuleExpiry) bool {
+	expiry = filterUserRulesExpiry(rules, expiry)
+
+	config.Lock()
+	if yamlEqual(config.UserRules, rules) && yamlEqual(config.UserRulesExpiry, expiry) {
+		config.Unlock()
+		return false
+	}
+	config.UserRules = rules
+	config.UserRulesExpiry = expiry
+	config.Unlock()
+
+	userFilter := userFilter()
+	err := userFilter.save()
+	if err != nil {
+		log.Error("Couldn't save the user filter: %s", err)
+	}
+	enableFilters(true)
+	Context.dnsFilter.SetRulesExpiry(expiry)
+	return true
+}
+
+func syncApplyRewrites(remote []dnsfilter.RewriteEntry) bool {
+	c := dnsfilter.Config{}
+	Context.dnsFilter.WriteDiskConfig(&c)
+	if len(c.Rewrites) == len(remote) {
+		equal := true
+		for i := range remote {
+			a, b := c.Rewrites[i], remote[i]
+			if a.Domain != b.Domain || a.Answer != b.Answer ||
+				a.Priority != b.Priority || a.Exception != b.Exception || a.TTL != b.TTL {
+				equal = false
+				break
+			}
+		}
+		if equal {
+			return false
+		}
+	}
+
+	Context.dnsFilter.SetRewrites(remote)
+	return true
+}
+
+// Return TRUE if the objects are equal in the configuration file
+// Note: nil and empty arrays are equal
+func yamlEqual(a, b interface{}) bool {
+	da, err := yaml.Marshal(a)
+	if err != nil {
+		return false
+	}
+	db, err := yaml.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(da) == string(db)
+}
+
+func sortClientObjects(objects []clientObject, groups []clientGroupObject) {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+}
+
+func syncApplyClients(objects []clientObject, groups []clientGroupObject) bool {
+	var cur []clientObject
+	var curGroups []clientGroupObject
+	Context.clients.WriteDiskConfig(&cur, &curGroups)
+	sortClientObjects(cur, curGroups)
+	sortClientObjects(objects, groups)
+	if yamlEqual(cur, objects) && yamlEqual(curGroups, groups) {
+		return false
+	}
+
+	Context.clients.replaceFromConfig(objects, groups)
+	return true
+}
+
+func syncApplyBlockedServices(list []string) (bool, error) {
+	config.Lock()
+	if arraysEqual(config.DNS.BlockedServices, list) {
+		config.Unlock()
+		return false, nil
+	}
+	config.DNS.BlockedServices = list
+	config.Unlock()
+
+	return true, reconfigureDNSServer()
+}
+
+// Get the data for a replica
+func getSyncData(sections []string) syncData {
+	data := syncData{}
+	for _, s := range sections {
+		if !stringArrayContains(syncSections, s) || stringArrayContains(data.Sections, s) {
+			continue
+		}
+		data.Sections = append(data.Sections, s)
+
+		switch s {
+		case syncFilters:
+			config.RLock()
+			for _, f := range config.Filters {
+				if isLocalFilterURL(f.URL) {
+					continue
+				}
+				data.Filters = append(data.Filters, filter{
+					Enabled:        f.Enabled,
+					URL:            f.URL,
+					Name:           f.Name,
+					UpdateInterval: f.UpdateInterval,
+					Auth:           f.Auth,
+				})
+			}
+			config.RUnlock()
+
+		case syncUserRules:
+			config.RLock()
+			data.UserRules = stringArrayDup(config.UserRules)
+			data.UserRulesExpiry = append([]dnsfilter.RuleExpiry{}, config.UserRulesExpiry...)
+			config.RUnlock()
+
+		case syncRewrites:
+			c := dnsfilter.Config{}
+			Context.dnsFilter.WriteDiskConfig(&c)
+			data.Rewrites = c.Rewrites
+
+		case syncClients:
+			Context.clients.WriteDiskConfig(&data.Clients, &data.ClientGroups)
+			sortClientObjects(data.Clients, data.ClientGroups)
+
+		case syncBlockedServices:
+			config.RLock()
+			data.BlockedServices = stringArrayDup(config.DNS.BlockedServices)
+			config.RUnlock()
+		}
+	}
+	return data
+}
+
+// Send the configuration to a replica
+func handleSyncExport(w http.ResponseWriter, r *http.Request) {
+	sections := syncSections
+	s := r.URL.Query().Get("sections")
+	if len(s) != 0 {
+		sections = strings.Split(s, ",")
+	}
+
+	data, err := yaml.Marshal(getSyncData(sections))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "yaml.Marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	_, _ = w.Write(data)
+}
+
+type syncStatusJSON struct {
+	syncConfig
+	syncStatus
+	TokenSet bool `json:"token_set"` // the token isn't returned: it gives access to the primary instance
+}
+
+func handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	resp := syncStatusJSON{
+		syncConfig: config.Sync,
+		TokenSet:   len(config.Sync.Token) != 0,
+	}
+	resp.Token = ""
+	if Context.replica != nil {
+		resp.syncStatus = Context.replica.getStatus()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleSyncConfig(w http.ResponseWriter, r *http.Request) {
+	conf := syncConfig{}
+	err := json.NewDecoder(r.Body).Decode(&conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	if len(conf.Token) == 0 {
+		// the token isn't changed: the client doesn't get it with the status
+		conf.Token = config.Sync.Token
+	}
+	err = checkSyncConfig(conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Sync = conf
+	if Context.replica != nil {
+		Context.replica.Close()
+		Context.replica = initReplica(conf, Context.client)
+		Context.replica.Start()
+	}
+
+	onConfigModified()
+	returnOK(w)
+}
+
+func handleSyncNow(w http.ResponseWriter, r *http.Request) {
+	if Context.replica == nil || !config.Sync.Enabled {
+		httpError(w, http.StatusBadRequest, "sync is disabled")
+		return
+	}
+	Context.replica.SyncNow()
+	returnOK(w)
+}
+
+// RegisterSyncHandlers - register handlers
+func RegisterSyncHandlers() {
+	httpRegister(http.MethodGet, "/control/sync/export", handleSyncExport)
+	httpRegister(http.MethodGet, "/control/sync/status", handleSyncStatus)
+	httpRegister(http.MethodPost, "/control/sync/config", handleSyncConfig)
+	httpRegister(http.MethodPost, "/control/sync/now", handleSyncNow)
+}
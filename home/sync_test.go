@@ -0,0 +1,109 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncSections(t *testing.T) {
+	r := initReplica(syncConfig{}, nil)
+	assert.Equal(t, syncSections, r.sections())
+
+	r = initReplica(syncConfig{Exclude: []string{syncClients}}, nil)
+	assert.Equal(t, []string{syncFilters, syncUserRules, syncRewrites, syncBlockedServices}, r.sections())
+
+	r = initReplica(syncConfig{Include: []string{syncRewrites, syncClients}, Exclude: []string{syncClients}}, nil)
+	assert.Equal(t, []string{syncRewrites}, r.sections())
+}
+
+func TestCheckSyncConfig(t *testing.T) {
+	assert.Nil(t, checkSyncConfig(syncConfig{}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{Include: []string{"unknown"}}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{Enabled: true, Token: "agh_1"}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{Enabled: true, PrimaryURL: "ftp://192.168.1.2", Token: "agh_1"}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{Enabled: true, PrimaryURL: "http://192.168.1.2:3000"}))
+	assert.Nil(t, checkSyncConfig(syncConfig{Enabled: true, PrimaryURL: "http://192.168.1.2:3000", Token: "agh_1"}))
+}
+
+func TestSyncLoad(t *testing.T) {
+	config.UserRules = []string{"||example.org^"}
+	config.DNS.BlockedServices = []string{"facebook"}
+	defer func() {
+		config.UserRules = nil
+		config.DNS.BlockedServices = nil
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/control/sync/export" || parseBearerToken(r) != "agh_1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handleSyncExport(w, r)
+	}))
+	defer srv.Close()
+
+	r := initReplica(syncConfig{
+		Enabled:    true,
+		PrimaryURL: srv.URL + "/",
+		Token:      "agh_1",
+		Include:    []string{syncUserRules, syncBlockedServices},
+	}, srv.Client())
+	data, err := r.load()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{syncUserRules, syncBlockedServices}, data.Sections)
+	assert.Equal(t, []string{"||example.org^"}, data.UserRules)
+	assert.Equal(t, []string{"facebook"}, data.BlockedServices)
+	assert.Equal(t, 0, len(data.Filters))
+
+	r.conf.Token = "agh_2"
+	_, err = r.load()
+	assert.NotNil(t, err)
+}
+
+func TestSyncClients(t *testing.T) {
+	Context.clients = clientsContainer{testing: true}
+	Context.clients.Init(nil, nil, nil)
+	_, err := Context.clients.Add(Client{Name: "local", IDs: []string{"1.1.1.1"}})
+	assert.Nil(t, err)
+
+	objects := []clientObject{
+		{Name: "remote", IDs: []string{"1.1.1.1"}, Group: "kids"},
+	}
+	groups := []clientGroupObject{
+		{Name: "kids", SafeSearchEnabled: true},
+	}
+	assert.True(t, syncApplyClients(objects, groups))
+
+	_, ok := Context.clients.FindByName("local")
+	assert.False(t, ok)
+	c, ok := Context.clients.FindByName("remote")
+	assert.True(t, ok)
+	assert.Equal(t, "kids", c.Group)
+	_, ok = Context.clients.FindGroup("kids")
+	assert.True(t, ok)
+
+	// nothing has changed
+	assert.False(t, syncApplyClients(objects, groups))
+}
+
+func TestSyncStatusToken(t *testing.T) {
+	prev := config.Sync
+	defer func() { config.Sync = prev }()
+	config.Sync = syncConfig{Enabled: true, PrimaryURL: "http://192.168.1.2:3000", Token: "agh_secret"}
+
+	w := httptest.NewRecorder()
+	handleSyncStatus(w, httptest.NewRequest(http.MethodGet, "/control/sync/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "agh_secret")
+
+	resp := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "", resp["token"])
+	assert.Equal(t, true, resp["token_set"])
+	assert.Equal(t, "http://192.168.1.2:3000", resp["primary_url"])
+	assert.Equal(t, "agh_secret", config.Sync.Token)
+}
@@ -0,0 +1,218 @@
+// Integration with systemd: socket activation, readiness notification and watchdog
+
+package home
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const sdListenFDsStart = 3 // the first file descriptor passed by systemd
+
+// Names of the activated sockets (FileDescriptorName= in the socket unit)
+const (
+	activatedDNS = "dns"
+	activatedWeb = "web"
+)
+
+// Sockets passed by systemd (socket activation)
+type activatedSockets struct {
+	// The passed file descriptors.
+	// They are kept open, so they are passed to the new process when AdGuard Home is restarted after update.
+	files []*os.File
+
+	dnsUDP []net.PacketConn
+	dnsTCP []net.Listener
+	web    net.Listener // nil: the web interface listens on its own socket
+}
+
+// Get the role of the activated socket: activatedDNS or activatedWeb
+// The sockets without names are checked by their type and port:
+// the stream socket on the web interface port is the web listener, the others are DNS sockets.
+func activatedSocketRole(name string, stream bool, port, webPort int) string {
+	switch name {
+	case activatedDNS, activatedWeb:
+		return name
+	}
+	if stream && port == webPort {
+		return activatedWeb
+	}
+	return activatedDNS
+}
+
+// Get the sockets passed by systemd:
+// LISTEN_PID is the PID of this process, LISTEN_FDS is the number of sockets (starting from fd 3),
+// LISTEN_FDNAMES is the colon-separated list of their names
+func getActivatedSockets(webPort int) activatedSockets {
+	s := activatedSockets{}
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || n <= 0 {
+		return s
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		fd := uintptr(sdListenFDsStart + i)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		// the processes started by AdGuard Home must not get the sockets
+		_ = util.SetInheritable(fd, false)
+		f := os.NewFile(fd, "systemd:"+name)
+		s.files = append(s.files, f)
+
+		l, err := net.FileListener(f)
+		if err == nil {
+			port := 0
+			if a, ok := l.Addr().(*net.TCPAddr); ok {
+				port = a.Port
+			}
+			if activatedSocketRole(name, true, port, webPort) == activatedWeb && s.web == nil {
+				s.web = l
+				log.Info("systemd: web interface socket: tcp://%s", l.Addr())
+			} else {
+				s.dnsTCP = append(s.dnsTCP, l)
+				log.Info("systemd: DNS socket: tcp://%s", l.Addr())
+			}
+			continue
+		}
+
+		c, err := net.FilePacketConn(f)
+		if err == nil {
+			s.dnsUDP = append(s.dnsUDP, c)
+			log.Info("systemd: DNS socket: udp://%s", c.LocalAddr())
+			continue
+		}
+		log.Error("systemd: socket %d (%s): %s", fd, name, err)
+	}
+	return s
+}
+
+// Pass the activated sockets to the new process which replaces this one via exec
+func keepActivatedSockets() {
+	for _, f := range Context.activated.files {
+		err := util.SetInheritable(f.Fd(), true)
+		if err != nil {
+			log.Error("systemd: %s: %s", f.Name(), err)
+		}
+	}
+}
+
+// Send the state to systemd: "READY=1", "STOPPING=1", etc.
+// Nothing is sent if AdGuard Home isn't started by systemd with Type=notify.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if len(addr) == 0 {
+		return
+	}
+
+	// "@name" is a socket in the abstract namespace
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Debug("systemd: notify: %s", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		log.Debug("systemd: notify: %s", err)
+	}
+}
+
+// Get the watchdog interval (WatchdogSec= in the service unit).  0: the watchdog is disabled
+func watchdogInterval() time.Duration {
+	pid := os.Getenv("WATCHDOG_PID")
+	if len(pid) != 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Notify systemd that AdGuard Home is ready and start pinging the watchdog
+func notifyReady() {
+	sdNotify("READY=1")
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Debug("systemd: watchdog interval: %s", interval)
+	go watchdogLoop(interval / 2)
+}
+
+// Ping the watchdog while the DNS server responds to the probe requests,
+// so systemd restarts the service if the DNS server hangs
+func watchdogLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !Context.firstRun {
+			err := probeDNSServer(interval)
+			if err != nil {
+				log.Error("systemd: watchdog: the DNS server doesn't respond: %s", err)
+				continue
+			}
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// Get the address to which the probe requests are sent
+func dnsProbeAddr() string {
+	var host string
+	port := 0
+	if len(Context.activated.dnsUDP) != 0 {
+		if a, ok := Context.activated.dnsUDP[0].LocalAddr().(*net.UDPAddr); ok {
+			host = a.IP.String()
+			port = a.Port
+		}
+	} else {
+		config.RLock()
+		host = config.DNS.BindHost
+		port = config.DNS.Port
+		config.RUnlock()
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+		if ip6 := net.ParseIP(host); ip6 != nil && ip6.To4() == nil {
+			ip = net.IPv6loopback
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// Send a request to the DNS server.  Any response means the server processes the requests.
+// If the health probe name is set, the request is answered by AdGuard Home itself and isn't sent upstream.
+func probeDNSServer(timeout time.Duration) error {
+	config.RLock()
+	name := config.DNS.HealthProbeName
+	config.RUnlock()
+	req := &dns.Msg{}
+	if len(name) != 0 {
+		req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	} else {
+		req.SetQuestion(".", dns.TypeNS)
+	}
+	c := dns.Client{Net: "udp", Timeout: timeout}
+	addr := dnsProbeAddr()
+	_, _, err := c.Exchange(req, addr)
+	if err != nil {
+		return fmt.Errorf("%s: %s", addr, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package home
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivatedSocketRole(t *testing.T) {
+	assert.Equal(t, activatedDNS, activatedSocketRole("dns", true, 3000, 3000))
+	assert.Equal(t, activatedWeb, activatedSocketRole("web", true, 80, 3000))
+	assert.Equal(t, activatedWeb, activatedSocketRole("", true, 3000, 3000))
+	assert.Equal(t, activatedWeb, activatedSocketRole("unknown", true, 3000, 3000))
+	assert.Equal(t, activatedDNS, activatedSocketRole("unknown", true, 53, 3000))
+	assert.Equal(t, activatedDNS, activatedSocketRole("", false, 3000, 3000))
+}
+
+func TestSdNotify(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn, _ := filepath.Abs(filepath.Join(dir, "notify.sock"))
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: fn, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets aren't supported: %s", err)
+	}
+	defer conn.Close()
+
+	// not started by systemd
+	os.Unsetenv("NOTIFY_SOCKET")
+	sdNotify("READY=1")
+
+	os.Setenv("NOTIFY_SOCKET", fn)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	sdNotify("READY=1")
+
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, watchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, watchdogInterval())
+
+	// the watchdog is set for another process
+	os.Setenv("WATCHDOG_PID", "1")
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+}
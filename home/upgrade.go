@@ -9,7 +9,6 @@ import (
 
 	"github.com/AdguardTeam/golibs/file"
 	"github.com/AdguardTeam/golibs/log"
-	"golang.org/x/crypto/bcrypt"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -104,6 +103,10 @@ func upgradeConfigSchema(oldVersion int, diskConfig *map[string]interface{}) err
 	}
 
 	config.fileData = body
+	if Context.configReadOnly {
+		log.Info("The config file is read-only: the upgraded configuration isn't saved")
+		return nil
+	}
 	err = file.SafeWrite(configFile, body)
 	if err != nil {
 		log.Printf("Couldn't save YAML config: %s", err)
@@ -263,14 +266,14 @@ func upgradeSchema4to5(diskConfig *map[string]interface{}) error {
 		return nil
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(passStr), bcrypt.DefaultCost)
+	hash, err := hashPassword(passStr)
 	if err != nil {
-		log.Fatalf("Can't use password \"%s\": bcrypt.GenerateFromPassword: %s", passStr, err)
+		log.Fatalf("Can't use password \"%s\": hashPassword: %s", passStr, err)
 		return nil
 	}
 	u := User{
 		Name:         nameStr,
-		PasswordHash: string(hash),
+		PasswordHash: hash,
 	}
 	users := []User{u}
 	(*diskConfig)["users"] = users
@@ -0,0 +1,254 @@
+// Names of VPN clients: WireGuard peers and Tailscale devices
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	vpnDefaultInterval = 5 // in minutes
+	tailscaleAPIURL    = "https://api.tailscale.com/api/v2"
+)
+
+type vpnConfig struct {
+	// WireGuard configuration files (e.g. "/etc/wireguard/wg0.conf")
+	WireGuardConfigs []string `yaml:"wireguard_configs"`
+
+	// Tailscale API access token.  "": disabled
+	TailscaleAPIKey string `yaml:"tailscale_api_key"`
+	// Tailnet name.  "": the default tailnet of the token
+	TailscaleTailnet string `yaml:"tailscale_tailnet"`
+
+	Interval uint32 `yaml:"interval"` // in minutes.  0: default (5)
+}
+
+// VPN clients module
+type vpnClients struct {
+	conf    vpnConfig
+	clients *clientsContainer
+	client  *http.Client
+	apiURL  string // Tailscale API URL
+	stop    chan bool
+}
+
+// Create module context
+func initVPNClients(conf vpnConfig, clients *clientsContainer, client *http.Client) *vpnClients {
+	v := &vpnClients{
+		conf:    conf,
+		clients: clients,
+		client:  client,
+		apiURL:  tailscaleAPIURL,
+	}
+	if v.conf.Interval == 0 {
+		v.conf.Interval = vpnDefaultInterval
+	}
+	if len(v.conf.TailscaleTailnet) == 0 {
+		v.conf.TailscaleTailnet = "-"
+	}
+	return v
+}
+
+// Start the background worker
+func (v *vpnClients) Start() {
+	if len(v.conf.WireGuardConfigs) == 0 && len(v.conf.TailscaleAPIKey) == 0 {
+		return
+	}
+	v.stop = make(chan bool)
+	go v.workerLoop(v.stop)
+}
+
+// Close - stop the background worker
+func (v *vpnClients) Close() {
+	if v.stop != nil {
+		close(v.stop)
+		v.stop = nil
+	}
+}
+
+func (v *vpnClients) workerLoop(stop chan bool) {
+	for {
+		hosts, err := v.load()
+		if err != nil {
+			log.Error("VPN clients: %s", err)
+		} else {
+			n := v.clients.replaceHosts(ClientSourceVPN, hosts)
+			log.Debug("VPN clients: added %d client aliases", n)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(v.conf.Interval) * time.Minute):
+			//
+		}
+	}
+}
+
+// Get the names of all VPN clients: IP -> name
+// If any source fails, the error is returned, so that the current list of clients is kept.
+func (v *vpnClients) load() (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, fn := range v.conf.WireGuardConfigs {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		for ip, name := range parseWireGuardPeers(string(data)) {
+			hosts[ip] = name
+		}
+	}
+
+	if len(v.conf.TailscaleAPIKey) != 0 {
+		devices, err := v.loadTailscaleDevices()
+		if err != nil {
+			return nil, fmt.Errorf("Tailscale: %s", err)
+		}
+		for ip, name := range devices {
+			hosts[ip] = name
+		}
+	}
+	return hosts, nil
+}
+
+// Parse WireGuard configuration file and get the names of the peers: tunnel IP -> name
+// The name is taken from a comment in [Peer] section ("# Name = phone" or "# Name: phone")
+// or from the comment line just before the section ("# phone").
+// The peer's addresses are taken from AllowedIPs: only the single addresses are used (/32, /128).
+func parseWireGuardPeers(data string) map[string]string {
+	hosts := map[string]string{}
+	inPeer := false
+	comment := "" // the last comment line before the section
+	name := ""
+	var ips []string
+
+	flush := func() {
+		if inPeer && len(name) != 0 {
+			for _, ip := range ips {
+				hosts[ip] = name
+			}
+		}
+		ips = nil
+	}
+
+	for _, ln := range strings.Split(data, "\n") {
+		ln = strings.TrimSpace(ln)
+
+		if strings.HasPrefix(ln, "[") {
+			flush()
+			inPeer = strings.EqualFold(ln, "[Peer]")
+			name = comment
+			comment = ""
+			continue
+		}
+
+		if strings.HasPrefix(ln, "#") {
+			c := strings.TrimSpace(strings.TrimLeft(ln, "#"))
+			k, val, ok := splitKeyValue(c)
+			if ok && strings.EqualFold(k, "name") {
+				c = val
+				if inPeer {
+					name = val
+					continue
+				}
+			}
+			comment = c
+			continue
+		}
+
+		if len(ln) == 0 {
+			comment = ""
+			continue
+		}
+
+		k, val, ok := splitKeyValue(ln)
+		if !inPeer || !ok || !strings.EqualFold(k, "AllowedIPs") {
+			continue
+		}
+		for _, s := range strings.Split(val, ",") {
+			ip, ipnet, err := net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				continue
+			}
+			ones, bits := ipnet.Mask.Size()
+			if ones == bits {
+				ips = append(ips, ip.String())
+			}
+		}
+	}
+	flush()
+	return hosts
+}
+
+// Split "key = value" or "key: value" string
+func splitKeyValue(s string) (string, string, bool) {
+	i := strings.IndexAny(s, "=:")
+	if i <= 0 {
+		return "", "", false
+	}
+	k := strings.TrimSpace(s[:i])
+	if strings.ContainsAny(k, " \t") {
+		return "", "", false
+	}
+	return k, strings.TrimSpace(s[i+1:]), true
+}
+
+type tailscaleDevices struct {
+	Devices []struct {
+		Addresses []string `json:"addresses"`
+		Name      string   `json:"name"` // "host.tailnet.ts.net"
+		Hostname  string   `json:"hostname"`
+	} `json:"devices"`
+}
+
+// Get the devices of the tailnet: IP -> name
+func (v *vpnClients) loadTailscaleDevices() (map[string]string, error) {
+	u := fmt.Sprintf("%s/tailnet/%s/devices", v.apiURL, v.conf.TailscaleTailnet)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(v.conf.TailscaleAPIKey, "")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status code %d", u, resp.StatusCode)
+	}
+
+	var devs tailscaleDevices
+	err = json.NewDecoder(resp.Body).Decode(&devs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", u, err)
+	}
+
+	hosts := map[string]string{}
+	for _, d := range devs.Devices {
+		// the machine name is unique in the tailnet, while the host name may be not
+		name := strings.SplitN(d.Name, ".", 2)[0]
+		if len(name) == 0 {
+			name = d.Hostname
+		}
+		if len(name) == 0 {
+			continue
+		}
+		for _, a := range d.Addresses {
+			ip := net.ParseIP(a)
+			if ip != nil {
+				hosts[ip.String()] = name
+			}
+		}
+	}
+	return hosts, nil
+}
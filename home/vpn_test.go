@@ -0,0 +1,71 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWireGuardPeers(t *testing.T) {
+	data := `[Interface]
+Address = 10.0.0.1/24
+PrivateKey = cHJpdmF0ZQ==
+
+[Peer]
+# Name = alice-phone
+PublicKey = YWxpY2U=
+AllowedIPs = 10.0.0.2/32, fd00::2/128
+
+# Bob's laptop
+[Peer]
+PublicKey = Ym9i
+AllowedIPs = 10.0.0.3/32
+
+# site-to-site link: the subnet isn't used
+[Peer]
+PublicKey = b2ZmaWNl
+AllowedIPs = 192.168.10.0/24
+
+[Peer]
+PublicKey = bm9uYW1l
+AllowedIPs = 10.0.0.4/32
+`
+	hosts := parseWireGuardPeers(data)
+	assert.Equal(t, map[string]string{
+		"10.0.0.2": "alice-phone",
+		"fd00::2":  "alice-phone",
+		"10.0.0.3": "Bob's laptop",
+	}, hosts)
+}
+
+func TestTailscaleDevices(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		if user != "tskey-api-123" || r.URL.Path != "/tailnet/-/devices" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"devices":[
+			{"addresses":["100.64.0.1","fd7a:115c:a1e0::1"],"name":"nas.example.ts.net","hostname":"NAS"},
+			{"addresses":["100.64.0.2"],"name":"","hostname":"phone"}
+		]}`))
+	}))
+	defer srv.Close()
+
+	v := initVPNClients(vpnConfig{TailscaleAPIKey: "tskey-api-123"}, nil, srv.Client())
+	v.apiURL = srv.URL
+	hosts, err := v.load()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"100.64.0.1":        "nas",
+		"fd7a:115c:a1e0::1": "nas",
+		"100.64.0.2":        "phone",
+	}, hosts)
+
+	// the error is returned, so that the current list is kept
+	v.conf.TailscaleAPIKey = "invalid"
+	_, err = v.load()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,95 @@
+// Anonymization of client IP addresses
+
+package querylog
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client IP address masks
+const (
+	anonymizeNone = ""
+	anonymize24   = "/24"  // IPv4: /24, IPv6: /56
+	anonymize16   = "/16"  // IPv4: /16, IPv6: /48
+	anonymizeFull = "full" // IPv4: 0.0.0.0, IPv6: ::
+)
+
+func checkAnonymizeMode(mode string) bool {
+	switch mode {
+	case anonymizeNone, anonymize24, anonymize16, anonymizeFull:
+		return true
+	}
+	return false
+}
+
+// Mask the IP address
+func maskIP(ip net.IP, mode string) net.IP {
+	ones4, ones6 := 32, 128
+	switch mode {
+	case anonymize24:
+		ones4, ones6 = 24, 56
+	case anonymize16:
+		ones4, ones6 = 16, 48
+	case anonymizeFull:
+		ones4, ones6 = 0, 0
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(ones4, 32))
+	}
+	return ip.Mask(net.CIDRMask(ones6, 128))
+}
+
+// ipHasher hashes client IP addresses (and client IDs) with a random salt which is changed every day,
+// so the hashes can't be linked with the addresses and with the hashes from the previous days
+type ipHasher struct {
+	lock sync.Mutex
+	salt []byte
+	date string // the day when the salt was generated
+}
+
+func (h *ipHasher) hash(data []byte, now time.Time) string {
+	h.lock.Lock()
+	date := now.Format("2006-01-02")
+	if h.date != date {
+		h.salt = make([]byte, 16)
+		_, _ = rand.Read(h.salt)
+		h.date = date
+	}
+	salt := h.salt
+	h.lock.Unlock()
+
+	sum := sha256.Sum256(append(append([]byte{}, salt...), data...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Get the client identifier which is written to the log
+func (l *queryLog) anonymizeClient(ip net.IP, now time.Time) string {
+	conf := l.conf
+	if len(conf.AnonymizeClientIP) != 0 {
+		ip = maskIP(ip, conf.AnonymizeClientIP)
+	}
+	if conf.HashClientIP {
+		return l.ipHasher.hash(ip, now)
+	}
+	return ip.String()
+}
+
+// Get the client ID which is written to the log.
+// The client ID identifies the client just as its IP address does,
+// so it's removed if the addresses are masked and it's hashed if the addresses are hashed.
+func (l *queryLog) anonymizeClientID(id string, now time.Time) string {
+	conf := l.conf
+	if len(id) == 0 || len(conf.AnonymizeClientIP) != 0 {
+		return ""
+	}
+	if conf.HashClientIP {
+		return l.ipHasher.hash([]byte("id:"+id), now) // the prefix: the hash of ID can't match the hash of IP
+	}
+	return id
+}
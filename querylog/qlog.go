@@ -2,7 +2,6 @@ package querylog
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -26,7 +25,13 @@ const (
 type queryLog struct {
 	conf    *Config
 	lock    sync.Mutex
-	logFile string // path to the log file
+	logFile string  // path to the log file
+	storage storage // the backend which keeps the entries flushed from memory buffer
+
+	subscribers subscribers // consumers of new entries (real-time stream)
+	forwarder   *forwarder  // mirrors new entries to syslog server or webhook.  nil: disabled
+	ipHasher    ipHasher
+	index       qlogIndex // index of the log files (file storage only)
 
 	bufferLock    sync.RWMutex
 	buffer        []*logEntry
@@ -44,6 +49,26 @@ func newQueryLog(conf Config) *queryLog {
 	if !checkInterval(l.conf.Interval) {
 		l.conf.Interval = 1
 	}
+	if !checkCompression(l.conf.Compression) {
+		log.Error("QueryLog: unsupported compression: %s", l.conf.Compression)
+		l.conf.Compression = compressGzip
+	}
+	if !checkAnonymizeMode(l.conf.AnonymizeClientIP) {
+		log.Error("QueryLog: invalid anonymize_client_ip value: %s", l.conf.AnonymizeClientIP)
+		l.conf.AnonymizeClientIP = anonymizeFull
+	}
+
+	var err error
+	l.storage, err = newStorage(&l)
+	if err != nil {
+		log.Error("QueryLog: %s.  Using file backend", err)
+		l.storage = &fileStorage{l: &l}
+	}
+
+	l.forwarder, err = newForwarder(l.conf)
+	if err != nil {
+		log.Error("QueryLog: %s", err)
+	}
 	return &l
 }
 
@@ -52,10 +77,16 @@ func (l *queryLog) Start() {
 		l.initWeb()
 	}
 	go l.periodicRotate()
+	if _, ok := l.storage.(*fileStorage); ok {
+		go l.buildIndex()
+	}
+	l.forwarder.start()
 }
 
 func (l *queryLog) Close() {
 	_ = l.flushLogBuffer(true)
+	l.storage.close()
+	l.forwarder.close()
 }
 
 func checkInterval(days uint32) bool {
@@ -65,6 +96,45 @@ func checkInterval(days uint32) bool {
 func (l *queryLog) WriteDiskConfig(dc *DiskConfig) {
 	dc.Enabled = l.conf.Enabled
 	dc.Interval = l.conf.Interval
+	dc.Backend = l.conf.Backend
+	dc.BackendURL = l.conf.BackendURL
+	dc.SyslogURL = l.conf.SyslogURL
+	dc.WebhookURL = l.conf.WebhookURL
+	dc.MaxSize = l.conf.MaxSize
+	dc.Compression = l.conf.Compression
+	dc.AnonymizeClientIP = l.conf.AnonymizeClientIP
+	dc.HashClientIP = l.conf.HashClientIP
+	dc.BlockedOnly = l.conf.BlockedOnly
+}
+
+func (l *queryLog) SetDiskConfig(dc *DiskConfig) {
+	l.lock.Lock()
+	// copy data, modify it, then activate.  Other threads (readers) don't need to use this lock.
+	conf := *l.conf
+	conf.Enabled = dc.Enabled
+	conf.Interval = dc.Interval
+	conf.MaxSize = dc.MaxSize
+	conf.Compression = dc.Compression
+	conf.AnonymizeClientIP = dc.AnonymizeClientIP
+	conf.HashClientIP = dc.HashClientIP
+	conf.BlockedOnly = dc.BlockedOnly
+	l.conf = &conf
+	l.lock.Unlock()
+}
+
+// CheckDiskConfig - check the settings which may be changed at runtime
+func CheckDiskConfig(dc *DiskConfig) error {
+	if !checkInterval(dc.Interval) {
+		return fmt.Errorf("unsupported interval: %d", dc.Interval)
+	}
+	err := CheckCompression(dc.Compression)
+	if err != nil {
+		return fmt.Errorf("unsupported compression: %s", err)
+	}
+	if !checkAnonymizeMode(dc.AnonymizeClientIP) {
+		return fmt.Errorf("unsupported anonymize_client_ip value: %s", dc.AnonymizeClientIP)
+	}
+	return nil
 }
 
 // Clear memory buffer and remove log files
@@ -77,14 +147,9 @@ func (l *queryLog) clear() {
 	l.flushPending = false
 	l.bufferLock.Unlock()
 
-	err := os.Remove(l.logFile + ".1")
-	if err != nil && !os.IsNotExist(err) {
-		log.Error("file remove: %s: %s", l.logFile+".1", err)
-	}
-
-	err = os.Remove(l.logFile)
-	if err != nil && !os.IsNotExist(err) {
-		log.Error("file remove: %s: %s", l.logFile, err)
+	err := l.storage.clear()
+	if err != nil {
+		log.Error("QueryLog: clear: %s", err)
 	}
 
 	log.Debug("Query log: cleared")
@@ -104,6 +169,8 @@ type logEntry struct {
 	Result   dnsfilter.Result
 	Elapsed  time.Duration
 	Upstream string `json:",omitempty"` // if empty, means it was cached
+	DNSSEC   string `json:",omitempty"` // result of DNSSEC validation
+	ClientID string `json:"CID,omitempty"`
 }
 
 func (l *queryLog) Add(params AddParams) {
@@ -120,14 +187,23 @@ func (l *queryLog) Add(params AddParams) {
 		params.Result = &dnsfilter.Result{}
 	}
 
+	if l.conf.BlockedOnly && !params.Result.IsFiltered {
+		return
+	}
+	if l.conf.IgnoredClient != nil && l.conf.IgnoredClient(params.ClientIP) {
+		return
+	}
+
 	now := time.Now()
 	entry := logEntry{
-		IP:   params.ClientIP.String(),
+		IP:   l.anonymizeClient(params.ClientIP, now),
 		Time: now,
 
 		Result:   *params.Result,
 		Elapsed:  params.Elapsed,
 		Upstream: params.Upstream,
+		DNSSEC:   params.DNSSEC,
+		ClientID: l.anonymizeClientID(params.ClientID, now),
 	}
 	q := params.Question.Question[0]
 	entry.QHost = strings.ToLower(q.Name[:len(q.Name)-1]) // remove the last dot
@@ -152,6 +228,9 @@ func (l *queryLog) Add(params AddParams) {
 		entry.OrigAnswer = a
 	}
 
+	l.subscribers.publish(&entry)
+	l.forwarder.add(&entry)
+
 	l.bufferLock.Lock()
 	l.buffer = append(l.buffer, &entry)
 	needFlush := false
@@ -197,9 +276,33 @@ func isNeeded(entry *logEntry, params getDataParams) bool {
 		}
 	}
 
+	if len(params.Reason) != 0 && entry.Result.Reason.String() != params.Reason {
+		return false
+	}
+
+	if len(params.Rcode) != 0 && entryRcode(entry) != params.Rcode {
+		return false
+	}
+
+	if len(params.Rule) != 0 && !strings.Contains(entry.Result.Rule, params.Rule) {
+		return false
+	}
+
+	if !params.NewerThan.IsZero() && entry.Time.Before(params.NewerThan) {
+		return false
+	}
+
 	return true
 }
 
+// Get the response code name from the header of the packed answer.  "": no answer
+func entryRcode(entry *logEntry) string {
+	if len(entry.Answer) < 4 {
+		return ""
+	}
+	return dns.RcodeToString[int(entry.Answer[3]&0x0f)]
+}
+
 func (l *queryLog) readFromFile(params getDataParams) ([]*logEntry, time.Time, int) {
 	entries := []*logEntry{}
 	oldest := time.Time{}
@@ -256,6 +359,10 @@ type getDataParams struct {
 	ResponseStatus    responseStatusType // filter by response status
 	StrictMatchDomain bool               // if Domain value must be matched strictly
 	StrictMatchClient bool               // if Client value must be matched strictly
+	Reason            string             // filter by Reason name
+	Rcode             string             // filter by response code name (e.g. "NXDOMAIN")
+	Rule              string             // filter by substring of the matched rule
+	NewerThan         time.Time          // return entries that are not older than this value
 }
 
 // Response status
@@ -276,8 +383,8 @@ func (l *queryLog) getData(params getDataParams) map[string]interface{} {
 	entries := []*logEntry{}
 	total := 0
 
-	// add from file
-	entries, oldest, total = l.readFromFile(params)
+	// add from storage
+	entries, oldest, total = l.storage.read(params)
 
 	if params.OlderThan.IsZero() {
 		params.OlderThan = now
@@ -305,60 +412,7 @@ func (l *queryLog) getData(params getDataParams) map[string]interface{} {
 
 	// process the elements from latest to oldest
 	for i := len(entries) - 1; i >= 0; i-- {
-		entry := entries[i]
-		var a *dns.Msg
-
-		if len(entry.Answer) > 0 {
-			a = new(dns.Msg)
-			if err := a.Unpack(entry.Answer); err != nil {
-				log.Debug("Failed to unpack dns message answer: %s: %s", err, string(entry.Answer))
-				a = nil
-			}
-		}
-
-		jsonEntry := map[string]interface{}{
-			"reason":    entry.Result.Reason.String(),
-			"elapsedMs": strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
-			"time":      entry.Time.Format(time.RFC3339Nano),
-			"client":    entry.IP,
-		}
-		jsonEntry["question"] = map[string]interface{}{
-			"host":  entry.QHost,
-			"type":  entry.QType,
-			"class": entry.QClass,
-		}
-
-		if a != nil {
-			jsonEntry["status"] = dns.RcodeToString[a.Rcode]
-		}
-		if len(entry.Result.Rule) > 0 {
-			jsonEntry["rule"] = entry.Result.Rule
-			jsonEntry["filterId"] = entry.Result.FilterID
-		}
-
-		if len(entry.Result.ServiceName) != 0 {
-			jsonEntry["service_name"] = entry.Result.ServiceName
-		}
-
-		answers := answerToMap(a)
-		if answers != nil {
-			jsonEntry["answer"] = answers
-		}
-
-		if len(entry.OrigAnswer) != 0 {
-			a := new(dns.Msg)
-			err := a.Unpack(entry.OrigAnswer)
-			if err == nil {
-				answers = answerToMap(a)
-				if answers != nil {
-					jsonEntry["original_answer"] = answers
-				}
-			} else {
-				log.Debug("Querylog: a.Unpack(entry.OrigAnswer): %s: %s", err, string(entry.OrigAnswer))
-			}
-		}
-
-		data = append(data, jsonEntry)
+		data = append(data, entryToJSON(entries[i]))
 	}
 
 	log.Debug("QueryLog: prepared data (%d/%d) older than %s in %s",
@@ -376,6 +430,71 @@ func (l *queryLog) getData(params getDataParams) map[string]interface{} {
 	return result
 }
 
+// Convert the log entry to the object returned by HTTP API
+func entryToJSON(entry *logEntry) map[string]interface{} {
+	var a *dns.Msg
+
+	if len(entry.Answer) > 0 {
+		a = new(dns.Msg)
+		if err := a.Unpack(entry.Answer); err != nil {
+			log.Debug("Failed to unpack dns message answer: %s: %s", err, string(entry.Answer))
+			a = nil
+		}
+	}
+
+	jsonEntry := map[string]interface{}{
+		"reason":    entry.Result.Reason.String(),
+		"elapsedMs": strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
+		"time":      entry.Time.Format(time.RFC3339Nano),
+		"client":    entry.IP,
+	}
+	jsonEntry["question"] = map[string]interface{}{
+		"host":  entry.QHost,
+		"type":  entry.QType,
+		"class": entry.QClass,
+	}
+
+	if a != nil {
+		jsonEntry["status"] = dns.RcodeToString[a.Rcode]
+	}
+	if len(entry.Result.Rule) > 0 {
+		jsonEntry["rule"] = entry.Result.Rule
+		jsonEntry["filterId"] = entry.Result.FilterID
+	}
+
+	if len(entry.Result.ServiceName) != 0 {
+		jsonEntry["service_name"] = entry.Result.ServiceName
+	}
+
+	if len(entry.DNSSEC) != 0 {
+		jsonEntry["dnssec"] = entry.DNSSEC
+	}
+
+	if len(entry.ClientID) != 0 {
+		jsonEntry["client_id"] = entry.ClientID
+	}
+
+	answers := answerToMap(a)
+	if answers != nil {
+		jsonEntry["answer"] = answers
+	}
+
+	if len(entry.OrigAnswer) != 0 {
+		a := new(dns.Msg)
+		err := a.Unpack(entry.OrigAnswer)
+		if err == nil {
+			answers = answerToMap(a)
+			if answers != nil {
+				jsonEntry["original_answer"] = answers
+			}
+		} else {
+			log.Debug("Querylog: a.Unpack(entry.OrigAnswer): %s: %s", err, string(entry.OrigAnswer))
+		}
+	}
+
+	return jsonEntry
+}
+
 func answerToMap(a *dns.Msg) []map[string]interface{} {
 	if a == nil || len(a.Answer) == 0 {
 		return nil
@@ -0,0 +1,270 @@
+// Export of the query log in CSV and JSON Lines formats
+
+package querylog
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Export formats
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+)
+
+// Parameters for export()
+type exportParams struct {
+	From   time.Time // export entries which are not older than this value.  Zero: not set
+	To     time.Time // export entries which are older than this value.  Zero: not set
+	Search getDataParams
+}
+
+// Return TRUE if the entry must be exported
+func (p *exportParams) match(ent *logEntry) bool {
+	if !p.From.IsZero() && ent.Time.Before(p.From) {
+		return false
+	}
+	if !p.To.IsZero() && !ent.Time.Before(p.To) {
+		return false
+	}
+	return isNeeded(ent, p.Search)
+}
+
+// Pass the entries from the log file (or a compressed segment) to the callback function
+func exportFile(fn string, p exportParams, write func(ent *logEntry) error) error {
+	f, err := openLogFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadBytes('\n')
+		if len(b) != 0 {
+			ent := logEntry{}
+			decode(&ent, string(b))
+			if !ent.Time.IsZero() && p.match(&ent) {
+				werr := write(&ent)
+				if werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Pass all matching entries (from the oldest to the latest) to the callback function
+func (l *queryLog) export(p exportParams, write func(ent *logEntry) error) error {
+	// don't let the memory buffer be flushed to file while we're reading:
+	//  otherwise some entries may be skipped or exported twice
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	err := l.storage.export(p, write)
+	if err != nil {
+		return err
+	}
+
+	l.bufferLock.Lock()
+	buffer := make([]*logEntry, len(l.buffer))
+	copy(buffer, l.buffer)
+	l.bufferLock.Unlock()
+
+	for _, ent := range buffer {
+		if !p.match(ent) {
+			continue
+		}
+		err = write(ent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A flat representation of a log entry
+type exportEntry struct {
+	Time        string   `json:"time"`
+	Client      string   `json:"client"`
+	Host        string   `json:"host"`
+	Type        string   `json:"type"`
+	Class       string   `json:"class"`
+	Status      string   `json:"status"`
+	Reason      string   `json:"reason"`
+	Rule        string   `json:"rule,omitempty"`
+	FilterID    int64    `json:"filter_id,omitempty"`
+	ServiceName string   `json:"service_name,omitempty"`
+	Upstream    string   `json:"upstream,omitempty"`
+	ElapsedMs   float64  `json:"elapsed_ms"`
+	Answer      []string `json:"answer,omitempty"` // "TYPE value"
+}
+
+var exportCSVHeader = []string{"time", "client", "host", "type", "class", "status", "reason",
+	"rule", "filter_id", "service_name", "upstream", "elapsed_ms", "answer"}
+
+func makeExportEntry(ent *logEntry) exportEntry {
+	e := exportEntry{
+		Time:        ent.Time.Format(time.RFC3339Nano),
+		Client:      ent.IP,
+		Host:        ent.QHost,
+		Type:        ent.QType,
+		Class:       ent.QClass,
+		Reason:      ent.Result.Reason.String(),
+		Rule:        ent.Result.Rule,
+		FilterID:    ent.Result.FilterID,
+		ServiceName: ent.Result.ServiceName,
+		Upstream:    ent.Upstream,
+		ElapsedMs:   ent.Elapsed.Seconds() * 1000,
+	}
+
+	if len(ent.Answer) != 0 {
+		a := &dns.Msg{}
+		if a.Unpack(ent.Answer) == nil {
+			e.Status = dns.RcodeToString[a.Rcode]
+			for _, ans := range answerToMap(a) {
+				e.Answer = append(e.Answer, fmt.Sprintf("%s %v", ans["type"], ans["value"]))
+			}
+		}
+	}
+	return e
+}
+
+func (e *exportEntry) csvRecord() []string {
+	filterID := ""
+	if e.FilterID != 0 {
+		filterID = strconv.FormatInt(e.FilterID, 10)
+	}
+	return []string{e.Time, e.Client, e.Host, e.Type, e.Class, e.Status, e.Reason,
+		e.Rule, filterID, e.ServiceName, e.Upstream,
+		strconv.FormatFloat(e.ElapsedMs, 'f', -1, 64), strings.Join(e.Answer, ";")}
+}
+
+// Parse the query parameters of export request
+func parseExportParams(r *http.Request) (exportParams, string, error) {
+	q := r.URL.Query()
+	p := exportParams{
+		Search: getDataParams{
+			Domain:         q.Get("domain"),
+			Client:         q.Get("client"),
+			ResponseStatus: responseStatusAll,
+		},
+	}
+	var err error
+
+	format := q.Get("format")
+	if len(format) == 0 {
+		format = exportFormatCSV
+	}
+	if format != exportFormatCSV && format != exportFormatJSONL {
+		return p, "", fmt.Errorf("invalid format: %s", format)
+	}
+
+	if len(q.Get("from")) != 0 {
+		p.From, err = time.Parse(time.RFC3339Nano, q.Get("from"))
+		if err != nil {
+			return p, "", fmt.Errorf("invalid from: %s", err)
+		}
+	}
+	if len(q.Get("to")) != 0 {
+		p.To, err = time.Parse(time.RFC3339Nano, q.Get("to"))
+		if err != nil {
+			return p, "", fmt.Errorf("invalid to: %s", err)
+		}
+	}
+
+	if getDoubleQuotesEnclosedValue(&p.Search.Domain) {
+		p.Search.StrictMatchDomain = true
+	}
+	if getDoubleQuotesEnclosedValue(&p.Search.Client) {
+		p.Search.StrictMatchClient = true
+	}
+
+	qtype := q.Get("question_type")
+	if len(qtype) != 0 {
+		_, ok := dns.StringToType[qtype]
+		if !ok {
+			return p, "", fmt.Errorf("invalid question_type")
+		}
+		p.Search.QuestionType = qtype
+	}
+
+	switch q.Get("response_status") {
+	case "":
+		//
+	case "filtered":
+		p.Search.ResponseStatus = responseStatusFiltered
+	default:
+		return p, "", fmt.Errorf("invalid response_status")
+	}
+
+	err = parseAdvancedSearch(q, "", &p.Search)
+	if err != nil {
+		return p, "", err
+	}
+
+	return p, format, nil
+}
+
+func (l *queryLog) handleQueryLogExport(w http.ResponseWriter, r *http.Request) {
+	p, format, err := parseExportParams(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	var write func(ent *logEntry) error
+	var flush func() error
+	if format == exportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=querylog.csv")
+		cw := csv.NewWriter(w)
+		_ = cw.Write(exportCSVHeader)
+		write = func(ent *logEntry) error {
+			e := makeExportEntry(ent)
+			return cw.Write(e.csvRecord())
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=querylog.jsonl")
+		enc := json.NewEncoder(w)
+		write = func(ent *logEntry) error {
+			return enc.Encode(makeExportEntry(ent))
+		}
+		flush = func() error { return nil }
+	}
+
+	// the response is already being sent, so we can't respond with an error code
+	err = l.export(p, write)
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		log.Debug("QueryLog: export: %s", err)
+	}
+}
@@ -0,0 +1,277 @@
+// Mirroring of the query log entries to a syslog server or an HTTP webhook
+
+package querylog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	forwardQueueSize     = 4096 // entries which aren't sent yet.  New entries are dropped when the queue is full.
+	forwardBatchSize     = 500  // max number of entries in a webhook request
+	forwardFlushInterval = 5 * time.Second
+	forwardTimeout       = 10 * time.Second
+
+	syslogAppName  = "AdGuardHome"
+	syslogMsgID    = "query"
+	syslogPriority = 16*8 + 6 // facility: local0, severity: informational
+)
+
+// A destination for the entries
+type forwardTarget interface {
+	send(entries []*logEntry) error
+	close()
+}
+
+// forwarder passes the new entries to the targets in background
+type forwarder struct {
+	targets []forwardTarget
+	queue   chan *logEntry
+	stop    chan bool
+	done    chan bool
+}
+
+// Create the forwarder for the configured targets.  Return nil if there are no targets.
+func newForwarder(conf *Config) (*forwarder, error) {
+	f := &forwarder{}
+	if len(conf.SyslogURL) != 0 {
+		t, err := newSyslogTarget(conf.SyslogURL)
+		if err != nil {
+			return nil, err
+		}
+		f.targets = append(f.targets, t)
+	}
+	if len(conf.WebhookURL) != 0 {
+		t, err := newWebhookTarget(conf.WebhookURL)
+		if err != nil {
+			return nil, err
+		}
+		f.targets = append(f.targets, t)
+	}
+	if len(f.targets) == 0 {
+		return nil, nil
+	}
+
+	f.queue = make(chan *logEntry, forwardQueueSize)
+	f.stop = make(chan bool)
+	f.done = make(chan bool)
+	return f, nil
+}
+
+func (f *forwarder) start() {
+	if f != nil {
+		go f.run()
+	}
+}
+
+// Send the remaining entries and stop
+func (f *forwarder) close() {
+	if f == nil {
+		return
+	}
+	close(f.stop)
+	<-f.done
+	for _, t := range f.targets {
+		t.close()
+	}
+}
+
+// Pass a new entry to the forwarder.  A nil forwarder is a no-op.
+func (f *forwarder) add(ent *logEntry) {
+	if f == nil {
+		return
+	}
+	select {
+	case f.queue <- ent:
+	default:
+		// the targets are too slow
+	}
+}
+
+func (f *forwarder) run() {
+	ticker := time.NewTicker(forwardFlushInterval)
+	defer ticker.Stop()
+
+	batch := []*logEntry{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for _, t := range f.targets {
+			err := t.send(batch)
+			if err != nil {
+				log.Debug("QueryLog: forward: %s", err)
+			}
+		}
+		batch = []*logEntry{}
+	}
+
+	for {
+		select {
+		case ent := <-f.queue:
+			batch = append(batch, ent)
+			if len(batch) >= forwardBatchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-f.stop:
+			n := len(f.queue)
+			for i := 0; i != n; i++ {
+				batch = append(batch, <-f.queue)
+			}
+			flush()
+			close(f.done)
+			return
+		}
+	}
+}
+
+// syslogTarget sends the entries to syslog server (RFC 5424)
+type syslogTarget struct {
+	network  string // "udp", "tcp" or "tls"
+	addr     string
+	hostname string
+	conn     net.Conn
+}
+
+// Parse syslog server URL: "udp://host:port", "tcp://host:port" or "tls://host:port"
+func newSyslogTarget(s string) (*syslogTarget, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog URL: %s", err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		//
+	default:
+		return nil, fmt.Errorf("invalid syslog URL: unsupported scheme: %s", u.Scheme)
+	}
+	if len(u.Port()) == 0 {
+		return nil, fmt.Errorf("invalid syslog URL: no port")
+	}
+
+	t := &syslogTarget{
+		network: u.Scheme,
+		addr:    u.Host,
+	}
+	t.hostname, _ = os.Hostname()
+	if len(t.hostname) == 0 {
+		t.hostname = "-"
+	}
+	return t, nil
+}
+
+func (t *syslogTarget) connect() error {
+	if t.conn != nil {
+		return nil
+	}
+	var err error
+	d := &net.Dialer{Timeout: forwardTimeout}
+	if t.network == "tls" {
+		t.conn, err = tls.DialWithDialer(d, "tcp", t.addr, &tls.Config{})
+	} else {
+		t.conn, err = d.Dial(t.network, t.addr)
+	}
+	return err
+}
+
+// Format the entry as syslog message
+func (t *syslogTarget) format(ent *logEntry) ([]byte, error) {
+	msg, err := json.Marshal(makeExportEntry(ent))
+	if err != nil {
+		return nil, err
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		syslogPriority, ent.Time.Format(time.RFC3339Nano), t.hostname, syslogAppName,
+		os.Getpid(), syslogMsgID, msg)), nil
+}
+
+func (t *syslogTarget) send(entries []*logEntry) error {
+	err := t.connect()
+	if err != nil {
+		return fmt.Errorf("syslog: %s", err)
+	}
+	_ = t.conn.SetWriteDeadline(time.Now().Add(forwardTimeout))
+
+	for _, ent := range entries {
+		msg, err := t.format(ent)
+		if err != nil {
+			continue
+		}
+		if t.network != "udp" {
+			// octet-counting framing (RFC 6587)
+			msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}
+		_, err = t.conn.Write(msg)
+		if err != nil {
+			t.close() // reconnect next time
+			return fmt.Errorf("syslog: %s", err)
+		}
+	}
+	return nil
+}
+
+func (t *syslogTarget) close() {
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// webhookTarget sends the entries to HTTP server as JSON array
+type webhookTarget struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookTarget(s string) (*webhookTarget, error) {
+	u, err := url.Parse(s)
+	if err != nil || !(u.Scheme == "http" || u.Scheme == "https") {
+		return nil, fmt.Errorf("invalid webhook URL: %s", s)
+	}
+	return &webhookTarget{
+		url:    s,
+		client: &http.Client{Timeout: forwardTimeout},
+	}, nil
+}
+
+func (t *webhookTarget) send(entries []*logEntry) error {
+	list := []exportEntry{}
+	for _, ent := range entries {
+		list = append(list, makeExportEntry(ent))
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("webhook: %s", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s: got status code %d", t.url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *webhookTarget) close() {
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/AdguardTeam/golibs/jsonutil"
@@ -37,6 +38,28 @@ func getDoubleQuotesEnclosedValue(s *string) bool {
 	return false
 }
 
+// Parse the advanced search parameters: reason, response code and rule text
+func parseAdvancedSearch(q url.Values, prefix string, params *getDataParams) error {
+	params.Reason = q.Get(prefix + "reason")
+	if len(params.Reason) != 0 {
+		_, ok := reasonByName(params.Reason)
+		if !ok {
+			return fmt.Errorf("invalid reason: %s", params.Reason)
+		}
+	}
+
+	params.Rcode = q.Get(prefix + "rcode")
+	if len(params.Rcode) != 0 {
+		_, ok := dns.StringToRcode[params.Rcode]
+		if !ok {
+			return fmt.Errorf("invalid rcode: %s", params.Rcode)
+		}
+	}
+
+	params.Rule = q.Get(prefix + "rule")
+	return nil
+}
+
 func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	var err error
 	req := request{}
@@ -60,6 +83,14 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if len(q.Get("newer_than")) != 0 {
+		params.NewerThan, err = time.Parse(time.RFC3339Nano, q.Get("newer_than"))
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "invalid time stamp: %s", err)
+			return
+		}
+	}
+
 	if getDoubleQuotesEnclosedValue(&params.Domain) {
 		params.StrictMatchDomain = true
 	}
@@ -67,6 +98,12 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 		params.StrictMatchClient = true
 	}
 
+	err = parseAdvancedSearch(q, "filter_", &params)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
 	if len(req.filterQuestionType) != 0 {
 		_, ok := dns.StringToType[req.filterQuestionType]
 		if !ok {
@@ -108,6 +145,13 @@ func (l *queryLog) handleQueryLogClear(w http.ResponseWriter, r *http.Request) {
 type qlogConfig struct {
 	Enabled  bool   `json:"enabled"`
 	Interval uint32 `json:"interval"`
+
+	MaxSize     uint32 `json:"max_size"` // in MB
+	Compression string `json:"compression"`
+
+	AnonymizeClientIP string `json:"anonymize_client_ip"`
+	HashClientIP      bool   `json:"hash_client_ip"`
+	BlockedOnly       bool   `json:"blocked_only"`
 }
 
 // Get configuration
@@ -115,6 +159,11 @@ func (l *queryLog) handleQueryLogInfo(w http.ResponseWriter, r *http.Request) {
 	resp := qlogConfig{}
 	resp.Enabled = l.conf.Enabled
 	resp.Interval = l.conf.Interval
+	resp.MaxSize = l.conf.MaxSize
+	resp.Compression = l.conf.Compression
+	resp.AnonymizeClientIP = l.conf.AnonymizeClientIP
+	resp.HashClientIP = l.conf.HashClientIP
+	resp.BlockedOnly = l.conf.BlockedOnly
 
 	jsonVal, err := json.Marshal(resp)
 	if err != nil {
@@ -141,6 +190,16 @@ func (l *queryLog) handleQueryLogConfig(w http.ResponseWriter, r *http.Request)
 		httpError(r, w, http.StatusBadRequest, "Unsupported interval")
 		return
 	}
+	if req.Exists("compression") {
+		if err = CheckCompression(d.Compression); err != nil {
+			httpError(r, w, http.StatusBadRequest, "Unsupported compression: %s", err)
+			return
+		}
+	}
+	if req.Exists("anonymize_client_ip") && !checkAnonymizeMode(d.AnonymizeClientIP) {
+		httpError(r, w, http.StatusBadRequest, "Unsupported anonymize_client_ip value")
+		return
+	}
 
 	l.lock.Lock()
 	// copy data, modify it, then activate.  Other threads (readers) don't need to use this lock.
@@ -151,6 +210,21 @@ func (l *queryLog) handleQueryLogConfig(w http.ResponseWriter, r *http.Request)
 	if req.Exists("interval") {
 		conf.Interval = d.Interval
 	}
+	if req.Exists("max_size") {
+		conf.MaxSize = d.MaxSize
+	}
+	if req.Exists("compression") {
+		conf.Compression = d.Compression
+	}
+	if req.Exists("anonymize_client_ip") {
+		conf.AnonymizeClientIP = d.AnonymizeClientIP
+	}
+	if req.Exists("hash_client_ip") {
+		conf.HashClientIP = d.HashClientIP
+	}
+	if req.Exists("blocked_only") {
+		conf.BlockedOnly = d.BlockedOnly
+	}
 	l.conf = &conf
 	l.lock.Unlock()
 
@@ -163,4 +237,6 @@ func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister("GET", "/control/querylog_info", l.handleQueryLogInfo)
 	l.conf.HTTPRegister("POST", "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister("POST", "/control/querylog_config", l.handleQueryLogConfig)
+	l.conf.HTTPRegister("GET", "/control/querylog/export", l.handleQueryLogExport)
+	l.conf.HTTPRegister("GET", "/control/querylog/stream", l.handleQueryLogStream)
 }
@@ -0,0 +1,406 @@
+// In-memory index of the query log files
+
+package querylog
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	indexNoRcode   = 0xff    // the entry has no answer
+	indexMaxLine   = 1 << 20 // maximum length of a line in the log file
+	indexReadBlock = 4 * 1024
+)
+
+// indexRecord is the location of an entry in the log file and its properties which are checked without reading the file
+type indexRecord struct {
+	time     int64  // UNIX time (ns)
+	off      int64  // offset in the file
+	gen      uint32 // generation of the file
+	qtype    uint16
+	rcode    uint8
+	reason   uint8
+	filtered bool
+}
+
+// postings maps a value (host name, client, rule) to the IDs of the entries (in ascending order)
+type postings map[string][]uint32
+
+func (p postings) add(key string, id uint32) {
+	ids, ok := p[key]
+	if !ok {
+		// don't keep the whole line in memory
+		key = string([]byte(key))
+	}
+	p[key] = append(ids, id)
+}
+
+// Get the IDs of the entries whose value is equal to (or contains) the search string
+func (p postings) find(val string, strict bool) []uint32 {
+	if strict {
+		return p[val]
+	}
+
+	ids := []uint32{}
+	for k, list := range p {
+		if strings.Contains(k, val) {
+			ids = append(ids, list...)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Remove the IDs which are less than base
+func (p postings) trim(base uint32) {
+	for k, ids := range p {
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= base })
+		if i == len(ids) {
+			delete(p, k)
+		} else if i != 0 {
+			p[k] = append(make([]uint32, 0, len(ids)-i), ids[i:]...)
+		}
+	}
+}
+
+// Get the IDs which are present in both sorted lists
+func intersectIDs(a, b []uint32) []uint32 {
+	ids := []uint32{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			ids = append(ids, a[i])
+			i++
+			j++
+		}
+	}
+	return ids
+}
+
+// qlogIndex is an index of the entries in the current and the previous log files,
+// so the search requests don't need to scan the files
+type qlogIndex struct {
+	lock  sync.RWMutex
+	ready bool   // the index is built and may be used
+	gen   uint32 // generation of the current log file.  The previous file has generation gen-1.
+	base  uint32 // ID of list[0]
+	list  []indexRecord
+
+	domains postings
+	clients postings
+	rules   postings
+}
+
+func (x *qlogIndex) init() {
+	x.list = nil
+	x.domains = postings{}
+	x.clients = postings{}
+	x.rules = postings{}
+}
+
+// Add the entry (and does not lock anything)
+func (x *qlogIndex) addEntry(gen uint32, ent *logEntry, off int64) {
+	id := x.base + uint32(len(x.list))
+	rec := indexRecord{
+		time:     ent.Time.UnixNano(),
+		off:      off,
+		gen:      gen,
+		qtype:    dns.StringToType[ent.QType],
+		rcode:    indexNoRcode,
+		reason:   uint8(ent.Result.Reason),
+		filtered: ent.Result.IsFiltered,
+	}
+	if len(ent.Answer) >= 4 {
+		rec.rcode = ent.Answer[3] & 0x0f
+	}
+	x.list = append(x.list, rec)
+
+	x.domains.add(ent.QHost, id)
+	x.clients.add(ent.IP, id)
+	if len(ent.Result.Rule) != 0 {
+		x.rules.add(ent.Result.Rule, id)
+	}
+}
+
+// Add the entries which were written to the current log file
+func (x *qlogIndex) add(entries []*logEntry, offsets []int64) {
+	x.lock.Lock()
+	if x.ready {
+		for i, ent := range entries {
+			x.addEntry(x.gen, ent, offsets[i])
+		}
+	}
+	x.lock.Unlock()
+}
+
+// Don't use the index until it's built again
+func (x *qlogIndex) invalidate() {
+	x.lock.Lock()
+	x.ready = false
+	x.init()
+	x.lock.Unlock()
+}
+
+// Remove all entries
+func (x *qlogIndex) clear() {
+	x.lock.Lock()
+	x.base += uint32(len(x.list))
+	x.init()
+	x.lock.Unlock()
+}
+
+// Called when the current log file becomes the previous one:
+// the entries of the old previous file are removed from the index
+func (x *qlogIndex) rotate() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.gen++
+	n := 0
+	for n < len(x.list) && x.gen-x.list[n].gen > 1 {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	x.list = append(make([]indexRecord, 0, len(x.list)-n), x.list[n:]...)
+	x.base += uint32(n)
+	x.domains.trim(x.base)
+	x.clients.trim(x.base)
+	x.rules.trim(x.base)
+}
+
+// Return TRUE if the record matches the search parameters which aren't checked with the posting lists
+func (rec *indexRecord) match(params getDataParams, qtype uint16, reason int, rcode int) bool {
+	if params.ResponseStatus == responseStatusFiltered && !rec.filtered {
+		return false
+	}
+	if len(params.QuestionType) != 0 && rec.qtype != qtype {
+		return false
+	}
+	if reason >= 0 && int(rec.reason) != reason {
+		return false
+	}
+	if rcode >= 0 && int(rec.rcode) != rcode {
+		return false
+	}
+	return true
+}
+
+// Find the entries which match the search parameters and are in the time range [from..params.OlderThan)
+// Return the records (from the latest to the oldest) and the number of the checked records.
+// Must be called with the read lock held.
+func (x *qlogIndex) search(params getDataParams, from time.Time, limit int) ([]indexRecord, int) {
+	first := sort.Search(len(x.list), func(i int) bool { return x.list[i].time >= from.UnixNano() })
+	last := len(x.list)
+	if !params.OlderThan.IsZero() {
+		t := params.OlderThan.UnixNano()
+		last = sort.Search(len(x.list), func(i int) bool { return x.list[i].time >= t })
+	}
+	lo := x.base + uint32(first)
+	hi := x.base + uint32(last)
+
+	// the IDs of the entries matching the string values.  nil: all entries
+	var ids []uint32
+	narrow := func(list []uint32) {
+		if ids == nil {
+			ids = append([]uint32{}, list...)
+		} else {
+			ids = intersectIDs(ids, list)
+		}
+	}
+	if len(params.Domain) != 0 {
+		narrow(x.domains.find(params.Domain, params.StrictMatchDomain))
+	}
+	if len(params.Client) != 0 {
+		narrow(x.clients.find(params.Client, params.StrictMatchClient))
+	}
+	if len(params.Rule) != 0 {
+		narrow(x.rules.find(params.Rule, false))
+	}
+
+	qtype := dns.StringToType[params.QuestionType]
+	reason := -1
+	if r, ok := reasonByName(params.Reason); ok {
+		reason = int(r)
+	}
+	rcode := -1
+	if rc, ok := dns.StringToRcode[params.Rcode]; ok {
+		rcode = rc
+	}
+
+	recs := []indexRecord{}
+	checked := 0
+	check := func(id uint32) {
+		rec := &x.list[id-x.base]
+		checked++
+		if rec.match(params, qtype, reason, rcode) {
+			recs = append(recs, *rec)
+		}
+	}
+
+	if ids == nil {
+		for id := hi; id > lo && len(recs) < limit; {
+			id--
+			check(id)
+		}
+	} else {
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= hi })
+		for i--; i >= 0 && ids[i] >= lo && len(recs) < limit; i-- {
+			check(ids[i])
+		}
+	}
+	return recs, checked
+}
+
+// Read the entry from the file at the specified offset
+func readEntryAt(f *os.File, off int64) (*logEntry, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(f, off, indexMaxLine), indexReadBlock)
+	b, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	ent := logEntry{}
+	decode(&ent, string(b))
+	return &ent, nil
+}
+
+// Get the entries (from the oldest to the latest) using the index.
+// Return FALSE if the index isn't ready.
+func (l *queryLog) readFromIndex(params getDataParams) ([]*logEntry, time.Time, int, bool) {
+	x := &l.index
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	if !x.ready {
+		return nil, time.Time{}, 0, false
+	}
+
+	start := time.Now()
+	from := validFrom(l.conf.Interval, start)
+	if params.NewerThan.After(from) {
+		from = params.NewerThan
+	}
+	recs, checked := x.search(params, from, getDataLimit)
+
+	files := map[uint32]*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	entries := make([]*logEntry, 0, len(recs))
+	for i := len(recs) - 1; i >= 0; i-- {
+		rec := recs[i]
+		f, ok := files[rec.gen]
+		if !ok {
+			fn := l.logFile
+			if rec.gen != x.gen {
+				fn += ".1"
+			}
+			var err error
+			f, err = os.Open(fn)
+			if err != nil {
+				log.Error("QueryLog: index: %s", err)
+				return nil, time.Time{}, 0, false
+			}
+			files[rec.gen] = f
+		}
+
+		ent, err := readEntryAt(f, rec.off)
+		if err != nil {
+			log.Error("QueryLog: index: %s", err)
+			return nil, time.Time{}, 0, false
+		}
+		if ent.Time.UnixNano() != rec.time || !isNeeded(ent, params) {
+			// the file was changed
+			log.Debug("QueryLog: index: entry mismatch at %d", rec.off)
+			continue
+		}
+		entries = append(entries, ent)
+	}
+
+	log.Debug("QueryLog: index: found %d entries (checked %d) in %v", len(entries), checked, time.Since(start))
+	return entries, time.Time{}, checked, true
+}
+
+// Pass the entries from the log file with their offsets to the callback function
+func scanLogFile(fn string, fun func(ent *logEntry, off int64)) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	off := int64(0)
+	for {
+		b, err := r.ReadBytes('\n')
+		if len(b) != 0 {
+			ent := logEntry{}
+			decode(&ent, string(b))
+			if !ent.Time.IsZero() {
+				fun(&ent, off)
+			}
+			off += int64(len(b))
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Build the index from the log files
+func (l *queryLog) buildIndex() {
+	// new entries can't be written while we're reading the files
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	start := time.Now()
+	x := &l.index
+	x.lock.RLock()
+	gen := x.gen
+	x.lock.RUnlock()
+
+	nx := qlogIndex{gen: gen}
+	nx.init()
+	for i, fn := range []string{l.logFile + ".1", l.logFile} {
+		fgen := gen - 1 + uint32(i)
+		err := scanLogFile(fn, func(ent *logEntry, off int64) {
+			nx.addEntry(fgen, ent, off)
+		})
+		if err != nil {
+			log.Error("QueryLog: index: %s: %s", fn, err)
+			return
+		}
+	}
+
+	x.lock.Lock()
+	x.base = 0
+	x.list = nx.list
+	x.domains = nx.domains
+	x.clients = nx.clients
+	x.rules = nx.rules
+	x.ready = true
+	x.lock.Unlock()
+
+	log.Debug("QueryLog: index: built for %d entries in %v", len(nx.list), time.Since(start))
+}
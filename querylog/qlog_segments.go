@@ -0,0 +1,284 @@
+// Size-based rotation of the query log file and compressed segments
+
+package querylog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Compression of the rotated log files
+const (
+	compressNone = ""
+	compressGzip = "gzip"
+	compressZstd = "zstd" // available if built with "-tags zstd"
+)
+
+const (
+	segmentSizeRatio  = 4                     // the log file is rotated when it's larger than 1/4 of the size limit
+	segmentTimeFormat = "20060102-150405.000" // the time of the latest entry in the segment file name
+)
+
+// compressor creates and reads compressed segments
+type compressor struct {
+	ext       string // file name extension
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// Supported compression methods
+var compressors = map[string]compressor{
+	compressGzip: {
+		ext: ".gz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+func checkCompression(c string) bool {
+	return CheckCompression(c) == nil
+}
+
+// CheckCompression returns an error if the compression method of the rotated
+// files is unknown or isn't compiled in
+func CheckCompression(c string) error {
+	if c == compressNone {
+		return nil
+	}
+	if _, ok := compressors[c]; ok {
+		return nil
+	}
+	if c == compressZstd {
+		return fmt.Errorf("%s: the compression isn't compiled in (build with \"-tags zstd\")", c)
+	}
+	return fmt.Errorf("unknown compression: %s", c)
+}
+
+// Get the compressor by the file name
+func segmentCompressor(fn string) (compressor, bool) {
+	for _, c := range compressors {
+		if len(fn) > len(c.ext) && strings.HasSuffix(fn, c.ext) {
+			return c, true
+		}
+	}
+	return compressor{}, false
+}
+
+// Open the log file for reading.  Compressed files are decompressed on-the-fly.
+func openLogFile(fn string) (io.ReadCloser, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := segmentCompressor(filepath.Base(fn))
+	if !ok {
+		return f, nil
+	}
+	zr, err := c.newReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return &compressedFile{ReadCloser: zr, f: f}, nil
+}
+
+// compressedFile closes both the decompressor and the file
+type compressedFile struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (c *compressedFile) Close() error {
+	_ = c.ReadCloser.Close()
+	return c.f.Close()
+}
+
+// segment is a compressed part of the query log
+type segment struct {
+	name    string // full path
+	size    int64
+	modTime time.Time // the time of the latest entry
+}
+
+// Get the compressed segments (from the oldest to the latest)
+func (l *queryLog) segments() []segment {
+	dir := filepath.Dir(l.logFile)
+	prefix := filepath.Base(l.logFile) + "."
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Error("QueryLog: %s", err)
+		return nil
+	}
+
+	// files are sorted by name, and so by time
+	list := []segment{}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, ok := segmentCompressor(name[len(prefix):]); !ok {
+			continue
+		}
+		list = append(list, segment{
+			name:    filepath.Join(dir, name),
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+		})
+	}
+	return list
+}
+
+// Return the size limit (in bytes).  0: unlimited
+func (l *queryLog) sizeLimit() int64 {
+	return int64(l.conf.MaxSize) * 1024 * 1024
+}
+
+// Return TRUE if the log file must be rotated because of its size
+func (l *queryLog) needRotateBySize(size int64) bool {
+	limit := l.sizeLimit()
+	return limit != 0 && size >= limit/segmentSizeRatio
+}
+
+// Compress the file into a new segment and remove it
+func compressSegment(fn string, prefix string, c compressor) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	name := prefix + "." + fi.ModTime().Format(segmentTimeFormat) + c.ext
+	start := time.Now()
+
+	src, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	zw, err := c.newWriter(dst)
+	if err == nil {
+		_, err = io.Copy(zw, src)
+		cerr := zw.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	cerr := dst.Close()
+	if err == nil {
+		err = cerr
+	}
+	src.Close()
+	if err != nil {
+		_ = os.Remove(name)
+		return err
+	}
+
+	// the modification time of a segment is used for time-based retention
+	_ = os.Chtimes(name, fi.ModTime(), fi.ModTime())
+
+	err = os.Remove(fn)
+	if err != nil {
+		return err
+	}
+
+	log.Debug("QueryLog: compressed %s to %s in %v", fn, name, time.Since(start))
+	return nil
+}
+
+// Remove the segments which are older than the query log interval or don't fit into the size limit
+func (l *queryLog) purgeSegments() {
+	list := l.segments()
+	if len(list) == 0 {
+		return
+	}
+
+	total := int64(0)
+	for _, fn := range []string{l.logFile, l.logFile + ".1"} {
+		fi, err := os.Stat(fn)
+		if err == nil {
+			total += fi.Size()
+		}
+	}
+	for _, s := range list {
+		total += s.size
+	}
+
+	from := validFrom(l.conf.Interval, time.Now())
+	limit := l.sizeLimit()
+	for _, s := range list {
+		if !s.modTime.Before(from) && (limit == 0 || total <= limit) {
+			break
+		}
+		err := os.Remove(s.name)
+		if err != nil {
+			log.Error("QueryLog: %s", err)
+			continue
+		}
+		total -= s.size
+		log.Debug("QueryLog: removed segment %s", s.name)
+	}
+}
+
+// Search the compressed segments for the entries older than the ones in the log files.
+// entries: the entries found in the log files (from the oldest to the latest)
+func (l *queryLog) readFromSegments(params getDataParams, entries []*logEntry, oldest time.Time) ([]*logEntry, time.Time, int) {
+	p := exportParams{
+		From:   validFrom(l.conf.Interval, time.Now()),
+		To:     params.OlderThan,
+		Search: params,
+	}
+	if len(entries) != 0 {
+		p.To = entries[0].Time
+	}
+
+	total := 0
+	list := l.segments()
+	for i := len(list) - 1; i >= 0 && len(entries) < getDataLimit; i-- {
+		if list[i].modTime.Before(p.From) {
+			break
+		}
+
+		need := getDataLimit - len(entries)
+		found := []*logEntry{}
+		err := exportFile(list[i].name, p, func(ent *logEntry) error {
+			if len(found) == need {
+				found = found[1:]
+			}
+			found = append(found, ent)
+			return nil
+		})
+		if err != nil {
+			log.Error("QueryLog: %s", err)
+			continue
+		}
+
+		total += len(found)
+		if len(found) != 0 {
+			oldest = found[0].Time
+		}
+		entries = append(found, entries...)
+	}
+
+	return entries, oldest, total
+}
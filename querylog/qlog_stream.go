@@ -0,0 +1,182 @@
+// Real-time streaming of the query log entries (Server-Sent Events)
+
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/miekg/dns"
+)
+
+const (
+	streamQueueSize      = 256 // entries which aren't sent to a subscriber yet.  New entries are dropped when the queue is full.
+	streamMaxSubscribers = 16
+	streamPingInterval   = 30 * time.Second
+)
+
+// A consumer of new entries
+type subscriber struct {
+	params getDataParams
+	ch     chan *logEntry
+}
+
+// Return TRUE if the entry must be sent to the subscriber
+func (s *subscriber) match(ent *logEntry) bool {
+	return isNeeded(ent, s.params)
+}
+
+// The list of subscribers
+type subscribers struct {
+	lock sync.Mutex
+	list map[*subscriber]bool
+}
+
+func (ss *subscribers) add(s *subscriber) bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if len(ss.list) >= streamMaxSubscribers {
+		return false
+	}
+	if ss.list == nil {
+		ss.list = make(map[*subscriber]bool)
+	}
+	ss.list[s] = true
+	return true
+}
+
+func (ss *subscribers) remove(s *subscriber) {
+	ss.lock.Lock()
+	delete(ss.list, s)
+	ss.lock.Unlock()
+}
+
+// Pass the new entry to the subscribers
+func (ss *subscribers) publish(ent *logEntry) {
+	ss.lock.Lock()
+	for s := range ss.list {
+		if !s.match(ent) {
+			continue
+		}
+		select {
+		case s.ch <- ent:
+		default:
+			// the subscriber is too slow
+		}
+	}
+	ss.lock.Unlock()
+}
+
+// Parse the filter parameters of stream request
+func parseStreamParams(r *http.Request) (*subscriber, error) {
+	q := r.URL.Query()
+	s := &subscriber{
+		params: getDataParams{
+			Domain:         q.Get("filter_domain"),
+			Client:         q.Get("filter_client"),
+			ResponseStatus: responseStatusAll,
+		},
+		ch: make(chan *logEntry, streamQueueSize),
+	}
+
+	if getDoubleQuotesEnclosedValue(&s.params.Domain) {
+		s.params.StrictMatchDomain = true
+	}
+	if getDoubleQuotesEnclosedValue(&s.params.Client) {
+		s.params.StrictMatchClient = true
+	}
+
+	qtype := q.Get("filter_question_type")
+	if len(qtype) != 0 {
+		_, ok := dns.StringToType[qtype]
+		if !ok {
+			return nil, fmt.Errorf("invalid question_type")
+		}
+		s.params.QuestionType = qtype
+	}
+
+	switch q.Get("filter_response_status") {
+	case "":
+		//
+	case "filtered":
+		s.params.ResponseStatus = responseStatusFiltered
+	default:
+		return nil, fmt.Errorf("invalid response_status")
+	}
+
+	err := parseAdvancedSearch(q, "filter_", &s.params)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get dnsfilter.Reason value by its name
+func reasonByName(name string) (dnsfilter.Reason, bool) {
+	for r := dnsfilter.Reason(0); len(r.String()) != 0; r++ {
+		if r.String() == name {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+func (l *queryLog) handleQueryLogStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(r, w, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+
+	s, err := parseStreamParams(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if !l.subscribers.add(s) {
+		httpError(r, w, http.StatusServiceUnavailable, "too many subscribers")
+		return
+	}
+	defer l.subscribers.remove(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// the compressing handler would buffer the events
+	w.Header().Set("Content-Encoding", "identity")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, ": connected\n\n")
+	flusher.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case ent := <-s.ch:
+			data, err := json.Marshal(entryToJSON(ent))
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-ping.C:
+			// keep the connection open through proxies
+			_, err = fmt.Fprintf(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// +build zstd
+
+package querylog
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLogSegmentsZstd(t *testing.T) {
+	assert.Nil(t, CheckCompression(compressZstd))
+
+	conf := Config{
+		Enabled:     true,
+		Interval:    1,
+		MemSize:     100,
+		MaxSize:     1,
+		Compression: compressZstd,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "first.example.org", "1.2.3.4", "0.1.2.3")
+	l.flushLogBuffer(true)
+	assert.Nil(t, l.rotate())
+	addEntry(l, "second.example.org", "1.2.3.5", "0.1.2.3")
+	l.flushLogBuffer(true)
+	assert.Nil(t, l.rotate())
+	segs := l.segments()
+	assert.Equal(t, 1, len(segs))
+	assert.True(t, strings.HasSuffix(segs[0].name, ".zst"))
+
+	// the compressed entries are found
+	d := l.getData(getDataParams{Domain: "first.example.org"})
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 1, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "first.example.org", "1.2.3.4", "0.1.2.3"))
+}
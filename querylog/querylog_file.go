@@ -36,7 +36,7 @@ func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	l.buffer = nil
 	l.flushPending = false
 	l.bufferLock.Unlock()
-	err := l.flushToFile(flushBuffer)
+	err := l.storage.write(flushBuffer)
 	if err != nil {
 		log.Error("Saving querylog to file failed: %s", err)
 		return err
@@ -54,7 +54,9 @@ func (l *queryLog) flushToFile(buffer []*logEntry) error {
 
 	var b bytes.Buffer
 	e := json.NewEncoder(&b)
-	for _, entry := range buffer {
+	offsets := make([]int64, len(buffer))
+	for i, entry := range buffer {
+		offsets[i] = int64(b.Len())
 		err := e.Encode(entry)
 		if err != nil {
 			log.Error("Failed to marshal entry: %s", err)
@@ -99,20 +101,51 @@ func (l *queryLog) flushToFile(buffer []*logEntry) error {
 		log.Error("failed to create file \"%s\": %s", filename, err)
 		return err
 	}
-	defer f.Close()
 
 	n, err := f.Write(zb.Bytes())
 	if err != nil {
+		f.Close()
 		log.Error("Couldn't write to file: %s", err)
 		return err
 	}
+	fi, err := f.Stat()
+	f.Close()
 
 	log.Debug("ok \"%s\": %v bytes written", filename, n)
 
+	if err == nil && !enableGzip {
+		fileStart := fi.Size() - int64(n)
+		for i := range offsets {
+			offsets[i] += fileStart
+		}
+		l.index.add(buffer, offsets)
+	} else {
+		l.index.invalidate()
+	}
+
+	if err == nil && l.needRotateBySize(fi.Size()) {
+		log.Debug("QueryLog: file size limit is reached: %d bytes", fi.Size())
+		err = l.rotateFile()
+		if err != nil {
+			return err
+		}
+		l.purgeSegments()
+	}
+
 	return nil
 }
 
 func (l *queryLog) rotate() error {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	err := l.rotateFile()
+	l.purgeSegments()
+	return err
+}
+
+// Rename the log file and compress the previous one (and does not lock anything)
+func (l *queryLog) rotateFile() error {
 	from := l.logFile
 	to := l.logFile + ".1"
 
@@ -126,11 +159,21 @@ func (l *queryLog) rotate() error {
 		return nil
 	}
 
+	c, ok := compressors[l.conf.Compression]
+	if ok {
+		err := compressSegment(to, l.logFile, c)
+		if err != nil {
+			// the file will be overwritten
+			log.Error("QueryLog: compress %s: %s", to, err)
+		}
+	}
+
 	err := os.Rename(from, to)
 	if err != nil {
 		log.Error("Failed to rename querylog: %s", err)
 		return err
 	}
+	l.index.rotate()
 
 	log.Debug("Rotated from %s to %s successfully", from, to)
 
@@ -139,7 +182,7 @@ func (l *queryLog) rotate() error {
 
 func (l *queryLog) periodicRotate() {
 	for range time.Tick(time.Duration(l.conf.Interval) * 24 * time.Hour) {
-		err := l.rotate()
+		err := l.storage.rotate()
 		if err != nil {
 			log.Error("Failed to rotate querylog: %s", err)
 			// do nothing, continue rotating
@@ -593,6 +636,10 @@ func decode(ent *logEntry, str string) {
 
 		case "Upstream":
 			ent.Upstream = v
+		case "DNSSEC":
+			ent.DNSSEC = v
+		case "CID":
+			ent.ClientID = v
 		case "Elapsed":
 			i, err = strconv.Atoi(v)
 			ent.Elapsed = time.Duration(i)
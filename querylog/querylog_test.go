@@ -1,8 +1,15 @@
 package querylog
 
 import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -165,3 +172,466 @@ func TestJSON(t *testing.T) {
 	k, v, jtype = readJSON(&s)
 	assert.True(t, jtype == jsonTErr)
 }
+
+func TestQueryLogExport(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "example.org", "1.2.3.4", "0.1.2.3")
+	l.flushLogBuffer(true)
+	addEntry(l, "test.example.org", "2.2.3.4", "0.1.2.4")
+
+	// CSV: all entries
+	r := httptest.NewRequest("GET", "/control/querylog/export?format=csv", nil)
+	w := httptest.NewRecorder()
+	l.handleQueryLogExport(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, "time", records[0][0])
+	assert.Equal(t, "example.org", records[1][2])
+	assert.Equal(t, "A 1.2.3.4", records[1][12])
+	assert.Equal(t, "test.example.org", records[2][2])
+
+	// JSONL: filter by client
+	r = httptest.NewRequest("GET", "/control/querylog/export?format=jsonl&client=%220.1.2.4%22", nil)
+	w = httptest.NewRecorder()
+	l.handleQueryLogExport(w, r)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	e := exportEntry{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, "test.example.org", e.Host)
+	assert.Equal(t, "0.1.2.4", e.Client)
+	assert.Equal(t, "NOERROR", e.Status)
+
+	// time range
+	r = httptest.NewRequest("GET", "/control/querylog/export?format=jsonl&to="+
+		url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), nil)
+	w = httptest.NewRecorder()
+	l.handleQueryLogExport(w, r)
+	assert.Equal(t, "", w.Body.String())
+
+	// invalid format
+	r = httptest.NewRequest("GET", "/control/querylog/export?format=xml", nil)
+	w = httptest.NewRecorder()
+	l.handleQueryLogExport(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestStorageSQLQuery(t *testing.T) {
+	from := time.Unix(100, 0)
+	to := time.Unix(200, 0)
+	params := getDataParams{
+		Domain:         "example.org",
+		Client:         "1.2.3.4",
+		ResponseStatus: responseStatusFiltered,
+
+		StrictMatchClient: true,
+	}
+
+	// PostgreSQL
+	s := &sqlStorage{dialect: sqlDialects[backendPostgreSQL]}
+	q := s.newQuery()
+	q.search(params, from, to)
+	assert.Equal(t, "time >= $1 AND time < $2 AND is_filtered AND strpos(qhost, $3) > 0 AND client = $4", q.where())
+	assert.Equal(t, []interface{}{int64(100000000000), int64(200000000000), "example.org", "1.2.3.4"}, q.args)
+
+	// ClickHouse
+	ch := &clickhouseStorage{}
+	q, qparams := ch.newQuery()
+	q.search(params, from, time.Time{})
+	assert.Equal(t, "time >= {p1:Int64} AND is_filtered AND position(qhost, {p2:String}) > 0 AND client = {p3:String}", q.where())
+	assert.Equal(t, "100000000000", qparams.Get("p1"))
+	assert.Equal(t, "example.org", qparams.Get("p2"))
+
+	// advanced search
+	params = getDataParams{
+		Reason: "FilteredBlackList",
+		Rcode:  "NXDOMAIN",
+		Rule:   "ads",
+	}
+	q = s.newQuery()
+	q.search(params, from, to)
+	assert.Equal(t, "time >= $1 AND time < $2 AND reason = $3 AND "+
+		"length(answer) >= 4 AND (get_byte(answer, 3) & 15) = $4 AND strpos(rule, $5) > 0", q.where())
+	assert.Equal(t, []interface{}{int64(100000000000), int64(200000000000),
+		int64(dnsfilter.FilteredBlackList), int64(dns.RcodeNameError), "ads"}, q.args)
+
+	// the driver isn't compiled in: file backend is used
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+		Backend:  "postgres",
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+	_, ok := l.storage.(*fileStorage)
+	assert.True(t, ok)
+	dc := DiskConfig{}
+	l.WriteDiskConfig(&dc)
+	assert.Equal(t, "postgres", dc.Backend)
+}
+
+func TestQueryLogStream(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	srv := httptest.NewServer(http.HandlerFunc(l.handleQueryLogStream))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?filter_client=%220.1.2.4%22")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	r := bufio.NewReader(resp.Body)
+	line, _ := r.ReadString('\n')
+	assert.Equal(t, ": connected\n", line)
+
+	addEntry(l, "example.org", "1.2.3.4", "0.1.2.3")
+	addEntry(l, "test.example.org", "2.2.3.4", "0.1.2.4")
+
+	// only the entry for the requested client is sent
+	for {
+		line, err = r.ReadString('\n')
+		assert.Nil(t, err)
+		if strings.HasPrefix(line, "data: ") {
+			break
+		}
+	}
+	m := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m))
+	assert.Equal(t, "0.1.2.4", m["client"])
+	assert.Equal(t, "test.example.org", m["question"].(map[string]interface{})["host"])
+
+	// invalid parameters
+	w := httptest.NewRecorder()
+	l.handleQueryLogStream(w, httptest.NewRequest("GET", "/control/querylog/stream?filter_reason=Unknown", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestQueryLogForward(t *testing.T) {
+	// syslog server
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	// webhook
+	var received []exportEntry
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := []exportEntry{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&list))
+		received = append(received, list...)
+	}))
+	defer srv.Close()
+
+	conf := Config{
+		Enabled:    true,
+		Interval:   1,
+		MemSize:    100,
+		SyslogURL:  "udp://" + pc.LocalAddr().String(),
+		WebhookURL: srv.URL,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+	l.forwarder.start()
+
+	addEntry(l, "example.org", "1.2.3.4", "0.1.2.3")
+	l.forwarder.close()
+
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	assert.Nil(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<134>1 "))
+	assert.True(t, strings.Contains(msg, " AdGuardHome "))
+	assert.True(t, strings.Contains(msg, `"host":"example.org"`))
+
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, "example.org", received[0].Host)
+	assert.Equal(t, "0.1.2.3", received[0].Client)
+
+	// invalid URL
+	_, err = newForwarder(&Config{SyslogURL: "http://host:514"})
+	assert.NotNil(t, err)
+}
+
+func TestAnonymize(t *testing.T) {
+	assert.Equal(t, "1.2.3.0", maskIP(net.ParseIP("1.2.3.4"), anonymize24).String())
+	assert.Equal(t, "1.2.0.0", maskIP(net.ParseIP("1.2.3.4"), anonymize16).String())
+	assert.Equal(t, "0.0.0.0", maskIP(net.ParseIP("1.2.3.4"), anonymizeFull).String())
+	assert.Equal(t, "2001:db8:1:100::", maskIP(net.ParseIP("2001:db8:1:1ff::1"), anonymize24).String())
+	assert.Equal(t, "2001:db8:1::", maskIP(net.ParseIP("2001:db8:1:1ff::1"), anonymize16).String())
+	assert.Equal(t, "::", maskIP(net.ParseIP("2001:db8:1:1ff::1"), anonymizeFull).String())
+
+	// the hash is stable during the day and is changed the next day
+	h := ipHasher{}
+	now := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	hash := h.hash(net.ParseIP("1.2.3.4"), now)
+	assert.Equal(t, 16, len(hash))
+	assert.Equal(t, hash, h.hash(net.ParseIP("1.2.3.4"), now.Add(time.Hour)))
+	assert.NotEqual(t, hash, h.hash(net.ParseIP("1.2.3.5"), now))
+	assert.NotEqual(t, hash, h.hash(net.ParseIP("1.2.3.4"), now.AddDate(0, 0, 1)))
+
+	conf := Config{
+		Enabled:           true,
+		Interval:          1,
+		MemSize:           100,
+		AnonymizeClientIP: anonymize24,
+		BlockedOnly:       true,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	// not blocked: not logged
+	addEntry(l, "example.org", "1.2.3.4", "1.2.3.4")
+	assert.Equal(t, 0, len(l.buffer))
+
+	q := dns.Msg{}
+	q.SetQuestion("example.org.", dns.TypeA)
+	l.Add(AddParams{
+		Question: &q,
+		Result:   &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList},
+		ClientIP: net.ParseIP("1.2.3.4"),
+	})
+	assert.Equal(t, 1, len(l.buffer))
+	assert.Equal(t, "1.2.3.0", l.buffer[0].IP)
+
+	// client ID is removed if the addresses are masked
+	params := AddParams{
+		Question: &q,
+		Result:   &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList},
+		ClientIP: net.ParseIP("1.2.3.4"),
+		ClientID: "kids-tablet",
+	}
+	l.Add(params)
+	assert.Equal(t, 2, len(l.buffer))
+	assert.Equal(t, "", l.buffer[1].ClientID)
+
+	// client ID is hashed if the addresses are hashed
+	l.conf.AnonymizeClientIP = anonymizeNone
+	l.conf.HashClientIP = true
+	l.Add(params)
+	assert.Equal(t, 3, len(l.buffer))
+	assert.Equal(t, 16, len(l.buffer[2].ClientID))
+	assert.NotEqual(t, "kids-tablet", l.buffer[2].ClientID)
+	assert.NotEqual(t, l.buffer[2].IP, l.buffer[2].ClientID)
+
+	l.conf.HashClientIP = false
+	l.Add(params)
+	assert.Equal(t, 4, len(l.buffer))
+	assert.Equal(t, "kids-tablet", l.buffer[3].ClientID)
+}
+
+func TestQueryLogIgnoredClient(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+		IgnoredClient: func(ip net.IP) bool {
+			return ip.Equal(net.ParseIP("2.2.2.2"))
+		},
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "example.org", "1.2.3.4", "1.1.1.1")
+	addEntry(l, "example.org", "1.2.3.4", "2.2.2.2")
+	assert.Equal(t, 1, len(l.buffer))
+	assert.Equal(t, "1.1.1.1", l.buffer[0].IP)
+}
+
+func TestQueryLogSegments(t *testing.T) {
+	conf := Config{
+		Enabled:     true,
+		Interval:    1,
+		MemSize:     100,
+		MaxSize:     1,
+		Compression: compressGzip,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	assert.False(t, l.needRotateBySize(100*1024))
+	assert.True(t, l.needRotateBySize(256*1024))
+
+	// the first file is compressed after the second rotation
+	addEntry(l, "first.example.org", "1.2.3.4", "0.1.2.3")
+	l.flushLogBuffer(true)
+	assert.Nil(t, l.rotate())
+	assert.Equal(t, 0, len(l.segments()))
+	addEntry(l, "second.example.org", "1.2.3.5", "0.1.2.3")
+	l.flushLogBuffer(true)
+	assert.Nil(t, l.rotate())
+	segs := l.segments()
+	assert.Equal(t, 1, len(segs))
+	assert.True(t, strings.HasSuffix(segs[0].name, ".gz"))
+	_, err := os.Stat(l.logFile + ".1")
+	assert.Nil(t, err)
+
+	// the compressed entries are found
+	d := l.getData(getDataParams{Domain: "first.example.org"})
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 1, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "first.example.org", "1.2.3.4", "0.1.2.3"))
+
+	hosts := []string{}
+	err = l.export(exportParams{}, func(ent *logEntry) error {
+		hosts = append(hosts, ent.QHost)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first.example.org", "second.example.org"}, hosts)
+
+	// the segments which are out of the interval are removed
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(t, os.Chtimes(segs[0].name, old, old))
+	l.purgeSegments()
+	assert.Equal(t, 0, len(l.segments()))
+}
+
+func TestQueryLogIndex(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "example.org", "1.2.3.4", "0.1.2.3")
+	l.flushLogBuffer(true)
+	l.buildIndex()
+	assert.True(t, l.index.ready)
+	assert.Equal(t, 1, len(l.index.list))
+
+	addEntry(l, "test.example.org", "1.2.3.5", "0.1.2.4")
+	q := dns.Msg{}
+	q.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	a := dns.Msg{}
+	a.SetRcode(&q, dns.RcodeNameError)
+	l.Add(AddParams{
+		Question: &q,
+		Answer:   &a,
+		Result: &dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredBlackList,
+			Rule:       "||ads.example.com^",
+		},
+		ClientIP: net.ParseIP("0.1.2.3"),
+	})
+	l.flushLogBuffer(true)
+	assert.Equal(t, 3, len(l.index.list))
+
+	find := func(params getDataParams) []string {
+		entries, _, _, ok := l.readFromIndex(params)
+		assert.True(t, ok)
+		hosts := []string{}
+		for _, e := range entries {
+			hosts = append(hosts, e.QHost)
+		}
+		return hosts
+	}
+	assert.Equal(t, []string{"example.org", "test.example.org", "ads.example.com"}, find(getDataParams{}))
+	assert.Equal(t, []string{"example.org", "test.example.org"}, find(getDataParams{Domain: "example.org"}))
+	assert.Equal(t, []string{"example.org"}, find(getDataParams{Domain: "example.org", StrictMatchDomain: true}))
+	assert.Equal(t, []string{"example.org", "ads.example.com"}, find(getDataParams{Client: "0.1.2.3", StrictMatchClient: true}))
+	assert.Equal(t, []string{"ads.example.com"}, find(getDataParams{Rcode: "NXDOMAIN"}))
+	assert.Equal(t, []string{"ads.example.com"}, find(getDataParams{Reason: "FilteredBlackList", Rule: "ads"}))
+	assert.Equal(t, []string{"ads.example.com"}, find(getDataParams{ResponseStatus: responseStatusFiltered}))
+	assert.Equal(t, []string{"ads.example.com"}, find(getDataParams{QuestionType: "AAAA"}))
+	assert.Equal(t, []string{}, find(getDataParams{Domain: "example.org", Rcode: "NXDOMAIN"}))
+	assert.Equal(t, []string{}, find(getDataParams{NewerThan: time.Now().Add(time.Hour)}))
+
+	// the entries of the previous file are still found after rotation
+	assert.Nil(t, l.rotate())
+	addEntry(l, "new.example.org", "1.2.3.6", "0.1.2.3")
+	l.flushLogBuffer(true)
+	assert.Equal(t, []string{"example.org", "new.example.org"}, find(getDataParams{Domain: "example.org", StrictMatchClient: true, Client: "0.1.2.3"}))
+
+	// the entries of the removed file are removed from the index
+	assert.Nil(t, l.rotate())
+	assert.Equal(t, 1, len(l.index.list))
+	assert.Equal(t, 1, len(l.index.clients))
+	assert.Equal(t, []string{"new.example.org"}, find(getDataParams{}))
+}
+
+func TestCheckBackend(t *testing.T) {
+	assert.Nil(t, CheckBackend(""))
+	assert.Nil(t, CheckBackend(backendFile))
+	assert.Nil(t, CheckBackend(backendClickHouse))
+	assert.NotNil(t, CheckBackend("mysql"))
+
+	// the drivers aren't compiled in without build tags
+	if checkSQLDriver(backendSQLite) != nil {
+		assert.Contains(t, CheckBackend(backendSQLite).Error(), "-tags sqlite")
+	}
+	if checkSQLDriver(backendPostgreSQL) != nil {
+		assert.Contains(t, CheckBackend(backendPostgreSQL).Error(), "-tags postgres")
+	}
+}
+
+func TestCheckCompression(t *testing.T) {
+	assert.Nil(t, CheckCompression(compressNone))
+	assert.Nil(t, CheckCompression(compressGzip))
+	assert.NotNil(t, CheckCompression("lzma"))
+
+	if _, ok := compressors[compressZstd]; !ok {
+		assert.Contains(t, CheckCompression(compressZstd).Error(), "-tags zstd")
+	}
+}
+
+func TestQueryLogSetDiskConfig(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+		Backend:  backendFile,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	dc := DiskConfig{}
+	l.WriteDiskConfig(&dc)
+	dc.Enabled = false
+	dc.Interval = 7
+	dc.AnonymizeClientIP = anonymize24
+	dc.Backend = "clickhouse" // can't be changed at runtime
+	assert.Nil(t, CheckDiskConfig(&dc))
+	l.SetDiskConfig(&dc)
+
+	dc = DiskConfig{}
+	l.WriteDiskConfig(&dc)
+	assert.False(t, dc.Enabled)
+	assert.Equal(t, uint32(7), dc.Interval)
+	assert.Equal(t, anonymize24, dc.AnonymizeClientIP)
+	assert.Equal(t, backendFile, dc.Backend)
+
+	dc.Interval = 2
+	assert.NotNil(t, CheckDiskConfig(&dc))
+	dc.Interval = 1
+	dc.AnonymizeClientIP = "/8"
+	assert.NotNil(t, CheckDiskConfig(&dc))
+}
@@ -0,0 +1,143 @@
+// Query log storage backends
+
+package querylog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Storage backends
+const (
+	backendFile       = "file" // JSON file (default)
+	backendSQLite     = "sqlite"
+	backendPostgreSQL = "postgres"
+	backendClickHouse = "clickhouse"
+
+	sqliteFileName = "querylog.db" // default SQLite database file name
+)
+
+// storage keeps the entries flushed from the memory buffer
+type storage interface {
+	// Store the entries
+	write(entries []*logEntry) error
+
+	// Get the latest entries (up to getDataLimit) which match the search parameters and are older than params.OlderThan.
+	// Return the entries (from the oldest to the latest), the time of the oldest processed entry
+	//  and the number of processed entries.
+	read(params getDataParams) ([]*logEntry, time.Time, int)
+
+	// Pass all entries matching the export parameters (from the oldest to the latest) to the callback function
+	export(p exportParams, write func(ent *logEntry) error) error
+
+	// Remove the old entries.  Called periodically with the query log interval.
+	rotate() error
+
+	// Remove all entries
+	clear() error
+
+	close()
+}
+
+// CheckBackend returns an error if the query log backend is unknown
+// or its database driver isn't compiled in
+func CheckBackend(backend string) error {
+	switch backend {
+	case "", backendFile, backendClickHouse:
+		return nil
+	case backendSQLite, backendPostgreSQL:
+		return checkSQLDriver(backend)
+	}
+	return fmt.Errorf("unknown query log backend: %s", backend)
+}
+
+// Create the storage object for the configured backend
+func newStorage(l *queryLog) (storage, error) {
+	switch l.conf.Backend {
+	case "", backendFile:
+		return &fileStorage{l: l}, nil
+	case backendSQLite:
+		fn := l.conf.BackendURL
+		if len(fn) == 0 {
+			fn = sqliteFileName
+		}
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(l.conf.BaseDir, fn)
+		}
+		return newSQLStorage(l.conf.Backend, fn, l.conf.Interval)
+	case backendPostgreSQL:
+		return newSQLStorage(l.conf.Backend, l.conf.BackendURL, l.conf.Interval)
+	case backendClickHouse:
+		return newClickHouseStorage(l.conf.BackendURL, l.conf.Interval)
+	}
+	return nil, fmt.Errorf("unknown query log backend: %s", l.conf.Backend)
+}
+
+// The time from which the entries are valid
+func validFrom(interval uint32, now time.Time) time.Time {
+	return now.Add(-time.Duration(interval) * 24 * time.Hour)
+}
+
+// fileStorage stores the entries in JSON file which is rotated with the query log interval
+// or when the size limit is reached.  The rotated files may be compressed.
+type fileStorage struct {
+	l *queryLog
+}
+
+func (s *fileStorage) write(entries []*logEntry) error {
+	return s.l.flushToFile(entries)
+}
+
+func (s *fileStorage) read(params getDataParams) ([]*logEntry, time.Time, int) {
+	entries, oldest, total, ok := s.l.readFromIndex(params)
+	if !ok {
+		entries, oldest, total = s.l.readFromFile(params)
+	}
+	if len(entries) < getDataLimit {
+		var n int
+		entries, oldest, n = s.l.readFromSegments(params, entries, oldest)
+		total += n
+	}
+	return entries, oldest, total
+}
+
+// Get the names of the log files (from the oldest to the latest)
+func (s *fileStorage) files() []string {
+	files := []string{}
+	for _, seg := range s.l.segments() {
+		files = append(files, seg.name)
+	}
+	return append(files, s.l.logFile+".1", s.l.logFile)
+}
+
+func (s *fileStorage) export(p exportParams, write func(ent *logEntry) error) error {
+	for _, fn := range s.files() {
+		err := exportFile(fn, p, write)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) rotate() error {
+	return s.l.rotate()
+}
+
+func (s *fileStorage) clear() error {
+	s.l.index.clear()
+	for _, fn := range s.files() {
+		err := os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("file remove: %s: %s", fn, err)
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) close() {
+}
@@ -0,0 +1,257 @@
+// ClickHouse storage backend (via HTTP interface)
+
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const clickhouseTimeout = 60 * time.Second
+
+// A row of querylog table
+type clickhouseRow struct {
+	Time        int64  `json:"time"`
+	Client      string `json:"client"`
+	QHost       string `json:"qhost"`
+	QType       string `json:"qtype"`
+	QClass      string `json:"qclass"`
+	Answer      []byte `json:"answer"` // base64
+	OrigAnswer  []byte `json:"orig_answer"`
+	IsFiltered  uint8  `json:"is_filtered"`
+	Reason      int    `json:"reason"`
+	Rule        string `json:"rule"`
+	FilterID    int64  `json:"filter_id"`
+	ServiceName string `json:"service_name"`
+	Upstream    string `json:"upstream"`
+	Elapsed     int64  `json:"elapsed"`
+}
+
+func (r *clickhouseRow) entry() *logEntry {
+	e := &logEntry{
+		IP:         r.Client,
+		Time:       time.Unix(0, r.Time),
+		QHost:      r.QHost,
+		QType:      r.QType,
+		QClass:     r.QClass,
+		Answer:     r.Answer,
+		OrigAnswer: r.OrigAnswer,
+		Elapsed:    time.Duration(r.Elapsed),
+		Upstream:   r.Upstream,
+	}
+	e.Result.IsFiltered = r.IsFiltered != 0
+	e.Result.Reason = dnsfilter.Reason(r.Reason)
+	e.Result.Rule = r.Rule
+	e.Result.FilterID = r.FilterID
+	e.Result.ServiceName = r.ServiceName
+	return e
+}
+
+// clickhouseStorage stores the entries in ClickHouse database
+type clickhouseStorage struct {
+	url      string
+	client   *http.Client
+	interval uint32 // in days
+}
+
+func newClickHouseStorage(u string, interval uint32) (*clickhouseStorage, error) {
+	_, err := url.Parse(u)
+	if err != nil || len(u) == 0 {
+		return nil, fmt.Errorf("clickhouse: invalid URL: %s", u)
+	}
+
+	s := &clickhouseStorage{
+		url:      u,
+		client:   &http.Client{Timeout: clickhouseTimeout},
+		interval: interval,
+	}
+	err = s.exec(`CREATE TABLE IF NOT EXISTS querylog (
+		time Int64,
+		client String,
+		qhost String,
+		qtype String,
+		qclass String,
+		answer String,
+		orig_answer String,
+		is_filtered UInt8,
+		reason Int32,
+		rule String,
+		filter_id Int64,
+		service_name String,
+		upstream String,
+		elapsed Int64
+	) ENGINE = MergeTree ORDER BY time`, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse: %s", err)
+	}
+	return s, nil
+}
+
+// Send a request to ClickHouse server and pass the response body to the callback function (may be nil)
+func (s *clickhouseStorage) exec(query string, params url.Values, body io.Reader, read func(r io.Reader) error) error {
+	u, _ := url.Parse(s.url)
+	q := u.Query()
+	q.Set("query", query)
+	q.Set("output_format_json_quote_64bit_integers", "0")
+	for k, v := range params {
+		q["param_"+k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	resp, err := s.client.Post(u.String(), "text/plain", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("got status code %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if read != nil {
+		return read(resp.Body)
+	}
+	return nil
+}
+
+func (s *clickhouseStorage) write(entries []*logEntry) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, e := range entries {
+		r := clickhouseRow{
+			Time:        e.Time.UnixNano(),
+			Client:      e.IP,
+			QHost:       e.QHost,
+			QType:       e.QType,
+			QClass:      e.QClass,
+			Answer:      e.Answer,
+			OrigAnswer:  e.OrigAnswer,
+			Reason:      int(e.Result.Reason),
+			Rule:        e.Result.Rule,
+			FilterID:    e.Result.FilterID,
+			ServiceName: e.Result.ServiceName,
+			Upstream:    e.Upstream,
+			Elapsed:     int64(e.Elapsed),
+		}
+		if e.Result.IsFiltered {
+			r.IsFiltered = 1
+		}
+		err := enc.Encode(r)
+		if err != nil {
+			return err
+		}
+	}
+	return s.exec("INSERT INTO querylog FORMAT JSONEachRow", nil, buf, nil)
+}
+
+// Make a query with the search conditions
+func (s *clickhouseStorage) newQuery() (*sqlQuery, url.Values) {
+	params := url.Values{}
+	q := &sqlQuery{
+		param: func(i int, arg interface{}) string {
+			name := fmt.Sprintf("p%d", i)
+			typ := "String"
+			switch v := arg.(type) {
+			case int64:
+				typ = "Int64"
+				params.Set(name, strconv.FormatInt(v, 10))
+			default:
+				params.Set(name, fmt.Sprint(v))
+			}
+			return fmt.Sprintf("{%s:%s}", name, typ)
+		},
+		contains: func(col, arg string) string { return fmt.Sprintf("position(%s, %s) > 0", col, arg) },
+		rcode: func(arg string) string {
+			return fmt.Sprintf("length(base64Decode(answer)) >= 4 AND "+
+				"bitAnd(reinterpretAsUInt8(substring(base64Decode(answer), 4, 1)), 15) = %s", arg)
+		},
+	}
+	return q, params
+}
+
+// Run SELECT request and pass the entries to the callback function
+func (s *clickhouseStorage) selectEntries(query string, params url.Values, fn func(ent *logEntry) error) error {
+	return s.exec(query+" FORMAT JSONEachRow", params, nil, func(r io.Reader) error {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) != 0 {
+				row := clickhouseRow{}
+				jerr := json.Unmarshal(line, &row)
+				if jerr != nil {
+					return jerr
+				}
+				ferr := fn(row.entry())
+				if ferr != nil {
+					return ferr
+				}
+			}
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func (s *clickhouseStorage) read(params getDataParams) ([]*logEntry, time.Time, int) {
+	now := time.Now()
+	to := params.OlderThan
+	if to.IsZero() {
+		to = now
+	}
+	q, qparams := s.newQuery()
+	q.search(params, validFrom(s.interval, now), to)
+
+	entries := []*logEntry{}
+	err := s.selectEntries(fmt.Sprintf("SELECT %s FROM querylog WHERE %s ORDER BY time DESC LIMIT %d",
+		sqlColumns, q.where(), getDataLimit), qparams, func(ent *logEntry) error {
+		entries = append(entries, ent)
+		return nil
+	})
+	if err != nil {
+		log.Error("QueryLog: clickhouse: SELECT: %s", err)
+	}
+
+	// from the oldest to the latest
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, time.Time{}, len(entries)
+}
+
+func (s *clickhouseStorage) export(p exportParams, write func(ent *logEntry) error) error {
+	from, to := exportRange(p, s.interval)
+	q, qparams := s.newQuery()
+	q.search(p.Search, from, to)
+
+	return s.selectEntries(fmt.Sprintf("SELECT %s FROM querylog WHERE %s ORDER BY time",
+		sqlColumns, q.where()), qparams, write)
+}
+
+func (s *clickhouseStorage) rotate() error {
+	return s.exec(fmt.Sprintf("ALTER TABLE querylog DELETE WHERE time < %d",
+		validFrom(s.interval, time.Now()).UnixNano()), nil, nil, nil)
+}
+
+func (s *clickhouseStorage) clear() error {
+	return s.exec("TRUNCATE TABLE querylog", nil, nil, nil)
+}
+
+func (s *clickhouseStorage) close() {
+}
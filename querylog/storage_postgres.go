@@ -0,0 +1,6 @@
+// +build postgres
+
+package querylog
+
+// PostgreSQL driver for "postgres" query log backend
+import _ "github.com/lib/pq"
@@ -0,0 +1,313 @@
+// SQL database storage backend (SQLite, PostgreSQL)
+
+package querylog
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const sqlColumns = "time, client, qhost, qtype, qclass, answer, orig_answer, " +
+	"is_filtered, reason, rule, filter_id, service_name, upstream, elapsed"
+
+// SQL syntax differences
+type sqlDialect struct {
+	driver   string                       // database/sql driver name
+	blobType string                       // binary data column type
+	boolType string                       // boolean column type
+	param    func(i int) string           // placeholder for the i-th (from 1) argument
+	contains func(col, arg string) string // substring search condition
+	rcode    func(arg string) string      // response code condition (the code is in the header of the packed answer)
+}
+
+var sqlDialects = map[string]sqlDialect{
+	backendSQLite: {
+		driver:   "sqlite3",
+		blobType: "BLOB",
+		boolType: "INTEGER",
+		param:    func(i int) string { return "?" },
+		contains: func(col, arg string) string { return fmt.Sprintf("instr(%s, %s) > 0", col, arg) },
+		rcode: func(arg string) string {
+			return fmt.Sprintf("length(answer) >= 4 AND instr('0123456789ABCDEF', substr(hex(answer), 8, 1)) - 1 = %s", arg)
+		},
+	},
+	backendPostgreSQL: {
+		driver:   "postgres",
+		blobType: "BYTEA",
+		boolType: "BOOLEAN",
+		param:    func(i int) string { return fmt.Sprintf("$%d", i) },
+		contains: func(col, arg string) string { return fmt.Sprintf("strpos(%s, %s) > 0", col, arg) },
+		rcode: func(arg string) string {
+			return fmt.Sprintf("length(answer) >= 4 AND (get_byte(answer, 3) & 15) = %s", arg)
+		},
+	},
+}
+
+// Conditions of a search request
+type sqlQuery struct {
+	conds []string
+	args  []interface{}
+
+	param    func(i int, arg interface{}) string
+	contains func(col, arg string) string
+	rcode    func(arg string) string
+}
+
+// Add "col = arg" condition or the substring search condition
+func (q *sqlQuery) match(col string, val string, strict bool) {
+	q.args = append(q.args, val)
+	arg := q.param(len(q.args), val)
+	if strict {
+		q.conds = append(q.conds, col+" = "+arg)
+	} else {
+		q.conds = append(q.conds, q.contains(col, arg))
+	}
+}
+
+// Add "col op arg" condition
+func (q *sqlQuery) cmp(col string, op string, val interface{}) {
+	q.args = append(q.args, val)
+	q.conds = append(q.conds, col+" "+op+" "+q.param(len(q.args), val))
+}
+
+// Add the conditions for the search parameters and the time range [from..to)
+func (q *sqlQuery) search(params getDataParams, from, to time.Time) {
+	if params.NewerThan.After(from) {
+		from = params.NewerThan
+	}
+	q.cmp("time", ">=", from.UnixNano())
+	if !to.IsZero() {
+		q.cmp("time", "<", to.UnixNano())
+	}
+	if params.ResponseStatus == responseStatusFiltered {
+		q.conds = append(q.conds, "is_filtered")
+	}
+	if len(params.QuestionType) != 0 {
+		q.match("qtype", params.QuestionType, true)
+	}
+	if len(params.Domain) != 0 {
+		q.match("qhost", params.Domain, params.StrictMatchDomain)
+	}
+	if len(params.Client) != 0 {
+		q.match("client", params.Client, params.StrictMatchClient)
+	}
+	if reason, ok := reasonByName(params.Reason); ok {
+		q.cmp("reason", "=", int64(reason))
+	}
+	if rcode, ok := dns.StringToRcode[params.Rcode]; ok {
+		q.args = append(q.args, int64(rcode))
+		q.conds = append(q.conds, q.rcode(q.param(len(q.args), int64(rcode))))
+	}
+	if len(params.Rule) != 0 {
+		q.match("rule", params.Rule, false)
+	}
+}
+
+func (q *sqlQuery) where() string {
+	return strings.Join(q.conds, " AND ")
+}
+
+// The time range of export request
+func exportRange(p exportParams, interval uint32) (time.Time, time.Time) {
+	from := validFrom(interval, time.Now())
+	if p.From.After(from) {
+		from = p.From
+	}
+	return from, p.To
+}
+
+// Return an error if the database driver for the backend isn't compiled in
+func checkSQLDriver(backend string) error {
+	driver := sqlDialects[backend].driver
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: the database driver isn't compiled in (build with \"-tags %s\")",
+		backend, backend)
+}
+
+// sqlStorage stores the entries in SQL database
+type sqlStorage struct {
+	db       *sql.DB
+	dialect  sqlDialect
+	interval uint32 // in days
+}
+
+func newSQLStorage(backend, dsn string, interval uint32) (*sqlStorage, error) {
+	s := &sqlStorage{
+		dialect:  sqlDialects[backend],
+		interval: interval,
+	}
+
+	err := checkSQLDriver(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	s.db, err = sql.Open(s.dialect.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", backend, err)
+	}
+
+	err = s.createTable()
+	if err != nil {
+		_ = s.db.Close()
+		return nil, fmt.Errorf("%s: %s", backend, err)
+	}
+	return s, nil
+}
+
+func (s *sqlStorage) createTable() error {
+	_, err := s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS querylog (
+		time BIGINT NOT NULL,
+		client TEXT NOT NULL,
+		qhost TEXT NOT NULL,
+		qtype TEXT NOT NULL,
+		qclass TEXT NOT NULL,
+		answer %s,
+		orig_answer %s,
+		is_filtered %s NOT NULL,
+		reason INTEGER NOT NULL,
+		rule TEXT NOT NULL,
+		filter_id BIGINT NOT NULL,
+		service_name TEXT NOT NULL,
+		upstream TEXT NOT NULL,
+		elapsed BIGINT NOT NULL
+	)`, s.dialect.blobType, s.dialect.blobType, s.dialect.boolType))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("CREATE INDEX IF NOT EXISTS querylog_time ON querylog (time)")
+	return err
+}
+
+func (s *sqlStorage) write(entries []*logEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	params := []string{}
+	for i := 1; i <= 14; i++ {
+		params = append(params, s.dialect.param(i))
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO querylog (%s) VALUES (%s)",
+		sqlColumns, strings.Join(params, ", ")))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		_, err = stmt.Exec(e.Time.UnixNano(), e.IP, e.QHost, e.QType, e.QClass, e.Answer, e.OrigAnswer,
+			e.Result.IsFiltered, int(e.Result.Reason), e.Result.Rule, e.Result.FilterID, e.Result.ServiceName,
+			e.Upstream, int64(e.Elapsed))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get the entries from the result of SELECT request
+func scanSQLEntries(rows *sql.Rows, fn func(ent *logEntry) error) error {
+	defer rows.Close()
+	for rows.Next() {
+		e := logEntry{}
+		var t, elapsed int64
+		var reason int
+		err := rows.Scan(&t, &e.IP, &e.QHost, &e.QType, &e.QClass, &e.Answer, &e.OrigAnswer,
+			&e.Result.IsFiltered, &reason, &e.Result.Rule, &e.Result.FilterID, &e.Result.ServiceName,
+			&e.Upstream, &elapsed)
+		if err != nil {
+			return err
+		}
+		e.Time = time.Unix(0, t)
+		e.Result.Reason = dnsfilter.Reason(reason)
+		e.Elapsed = time.Duration(elapsed)
+
+		err = fn(&e)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStorage) newQuery() *sqlQuery {
+	return &sqlQuery{
+		param:    func(i int, arg interface{}) string { return s.dialect.param(i) },
+		contains: s.dialect.contains,
+		rcode:    s.dialect.rcode,
+	}
+}
+
+func (s *sqlStorage) read(params getDataParams) ([]*logEntry, time.Time, int) {
+	now := time.Now()
+	to := params.OlderThan
+	if to.IsZero() {
+		to = now
+	}
+	q := s.newQuery()
+	q.search(params, validFrom(s.interval, now), to)
+
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s FROM querylog WHERE %s ORDER BY time DESC LIMIT %d",
+		sqlColumns, q.where(), getDataLimit), q.args...)
+	if err != nil {
+		log.Error("QueryLog: SELECT: %s", err)
+		return []*logEntry{}, time.Time{}, 0
+	}
+
+	entries := []*logEntry{}
+	err = scanSQLEntries(rows, func(ent *logEntry) error {
+		entries = append(entries, ent)
+		return nil
+	})
+	if err != nil {
+		log.Error("QueryLog: SELECT: %s", err)
+	}
+
+	// from the oldest to the latest
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, time.Time{}, len(entries)
+}
+
+func (s *sqlStorage) export(p exportParams, write func(ent *logEntry) error) error {
+	from, to := exportRange(p, s.interval)
+	q := s.newQuery()
+	q.search(p.Search, from, to)
+
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s FROM querylog WHERE %s ORDER BY time",
+		sqlColumns, q.where()), q.args...)
+	if err != nil {
+		return err
+	}
+	return scanSQLEntries(rows, write)
+}
+
+func (s *sqlStorage) rotate() error {
+	_, err := s.db.Exec("DELETE FROM querylog WHERE time < "+s.dialect.param(1),
+		validFrom(s.interval, time.Now()).UnixNano())
+	return err
+}
+
+func (s *sqlStorage) clear() error {
+	_, err := s.db.Exec("DELETE FROM querylog")
+	return err
+}
+
+func (s *sqlStorage) close() {
+	_ = s.db.Close()
+}
@@ -0,0 +1,6 @@
+// +build sqlite
+
+package querylog
+
+// SQLite driver for "sqlite" query log backend
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,46 @@
+// +build sqlite
+
+package querylog
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	assert.Nil(t, CheckBackend(backendSQLite))
+
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+		Backend:  backendSQLite,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+	defer l.Close()
+	_, ok := l.storage.(*sqlStorage)
+	assert.True(t, ok)
+
+	addEntry(l, "example.org", "1.2.3.4", "0.1.2.3")
+	addEntry(l, "test.example.org", "2.2.3.4", "0.1.2.4")
+	l.flushLogBuffer(true)
+
+	d := l.getData(getDataParams{})
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 2, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "test.example.org", "2.2.3.4", "0.1.2.4"))
+	assert.True(t, checkEntry(t, mdata[1], "example.org", "1.2.3.4", "0.1.2.3"))
+
+	d = l.getData(getDataParams{Domain: "test.example.org", StrictMatchDomain: true, Rcode: "NOERROR"})
+	mdata = d["data"].([]map[string]interface{})
+	assert.Equal(t, 1, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "test.example.org", "2.2.3.4", "0.1.2.4"))
+
+	d = l.getData(getDataParams{Rcode: "NXDOMAIN"})
+	mdata = d["data"].([]map[string]interface{})
+	assert.Equal(t, 0, len(mdata))
+}
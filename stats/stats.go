@@ -11,7 +11,13 @@ type unitIDCallback func() uint32
 
 // DiskConfig - configuration settings that are stored on disk
 type DiskConfig struct {
-	Interval uint32 `yaml:"statistics_interval"` // time interval for statistics (in days)
+	Interval         uint32 `yaml:"statistics_interval"`          // time interval for statistics (in days)
+	DailyRetention   uint32 `yaml:"statistics_daily_retention"`   // time to keep daily rollups for (in days)
+	MonthlyRetention uint32 `yaml:"statistics_monthly_retention"` // time to keep monthly rollups for (in months)
+
+	PushURL         string `yaml:"statistics_push_url"`         // InfluxDB write URL or Graphite server address
+	PushInterval    uint32 `yaml:"statistics_push_interval"`    // in seconds
+	PushMeasurement string `yaml:"statistics_push_measurement"` // InfluxDB measurement name or Graphite metric prefix
 }
 
 // Config - module configuration
@@ -20,6 +26,20 @@ type Config struct {
 	LimitDays uint32         // time limit (in days)
 	UnitID    unitIDCallback // user function to get the current unit ID.  If nil, the current time hour is used.
 
+	// Time to keep the daily (in days) and monthly (in months) rollups of the hourly data for.
+	// 0: rollups of this type are disabled.
+	DailyRetention   uint32
+	MonthlyRetention uint32
+
+	// Periodically push the counters to InfluxDB (HTTP write URL: "http://host:8086/write?db=adguard")
+	// or to Graphite ("tcp://host:2003" or "udp://host:2003").
+	PushURL         string
+	PushInterval    uint32 // in seconds.  Default: 60
+	PushMeasurement string // InfluxDB measurement name or Graphite metric prefix.  Default: "adguardhome"
+
+	// Return TRUE if the client's requests mustn't be counted (optional)
+	IgnoredClient func(ip net.IP) bool
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
 
@@ -51,6 +71,10 @@ type Stats interface {
 
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(dc *DiskConfig)
+
+	// SetDiskConfig - apply the settings which may be changed at runtime (the same as via HTTP API): interval.
+	// The settings must be checked with CheckDiskConfig().
+	SetDiskConfig(dc *DiskConfig)
 }
 
 // TimeUnit - time unit
@@ -72,13 +96,22 @@ const (
 	RSafeBrowsing
 	RSafeSearch
 	RParental
+	RRatelimited // the request was throttled by rate limiting
 	rLast
 )
 
 // Entry - data to add
 type Entry struct {
-	Domain string
-	Client net.IP
-	Result Result
-	Time   uint32 // processing time (msec)
+	Domain   string
+	Client   net.IP
+	ClientID string // client ID (from DoH path or DoT server name).  If set, it's used instead of IP address
+	Result   Result
+	Time     uint32 // processing time (msec)
+
+	// ID of the filter list whose rule blocked the request.  It's used if FilterMatched is true.
+	FilterID      int64
+	FilterMatched bool
+
+	Service  string // name of the blocked service
+	Category string // category of the request blocked by safebrowsing, parental control or external verdict provider
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -19,10 +20,54 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 	http.Error(w, text, code)
 }
 
-// Return data
+// Return data.
+// Granularity "hour" (default) returns the data for the configured interval,
+// "day" and "month" return the data for the last 'count' days or months from the rollups.
 func (s *statsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	granularity := q.Get("granularity")
+	var count, maxCount uint32
+	switch granularity {
+	case "", granularityHour:
+		// the hourly units
+	case granularityDay:
+		count = defaultDaysCount
+		maxCount = s.conf.DailyRetention
+
+	case granularityMonth:
+		count = defaultMonthsCount
+		maxCount = s.conf.MonthlyRetention
+
+	default:
+		httpError(r, w, http.StatusBadRequest, "Unsupported granularity: %s", granularity)
+		return
+	}
+
+	if count != 0 {
+		if maxCount == 0 {
+			httpError(r, w, http.StatusBadRequest, "Statistics with granularity '%s' are disabled", granularity)
+			return
+		}
+		if len(q.Get("count")) != 0 {
+			n, err := strconv.ParseUint(q.Get("count"), 10, 32)
+			if err != nil || n == 0 {
+				httpError(r, w, http.StatusBadRequest, "Invalid count: %s", q.Get("count"))
+				return
+			}
+			count = uint32(n)
+		}
+		if count > maxCount {
+			count = maxCount
+		}
+	}
+
 	start := time.Now()
-	d := s.getData()
+	var d map[string]interface{}
+	if count != 0 {
+		d = s.getRollupData(granularity, count)
+	} else {
+		d = s.getData()
+	}
 	log.Debug("Stats: prepared data in %v", time.Since(start))
 
 	if d == nil {
@@ -0,0 +1,278 @@
+// Pushing the statistics counters to InfluxDB or Graphite
+
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	defaultPushInterval    = 60 // in seconds
+	defaultPushMeasurement = "adguardhome"
+	pushTimeout            = 10 * time.Second
+)
+
+// pushCounters are the counters since the start of the process
+type pushCounters struct {
+	nTotal  uint64
+	nResult []uint64
+	timeSum uint64 // usec
+}
+
+// metric is a named value which is sent to TSDB
+type metric struct {
+	name  string
+	value interface{} // uint64 or float64
+}
+
+// A destination for the metrics
+type pushTarget interface {
+	send(t time.Time, metrics []metric) error
+	close()
+}
+
+// pusher periodically sends the counters to the target
+type pusher struct {
+	target   pushTarget
+	interval time.Duration
+	stop     chan bool
+	done     chan bool
+}
+
+// Create the pusher for the configured target.  Return nil if it isn't configured.
+func newPusher(conf *Config) (*pusher, error) {
+	if len(conf.PushURL) == 0 {
+		return nil, nil
+	}
+
+	measurement := conf.PushMeasurement
+	if len(measurement) == 0 {
+		measurement = defaultPushMeasurement
+	}
+	interval := conf.PushInterval
+	if interval == 0 {
+		interval = defaultPushInterval
+	}
+
+	u, err := url.Parse(conf.PushURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid push URL: %s", err)
+	}
+	hostname, _ := os.Hostname()
+
+	p := &pusher{
+		interval: time.Duration(interval) * time.Second,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+	switch u.Scheme {
+	case "http", "https":
+		p.target = &influxTarget{
+			url:         conf.PushURL,
+			measurement: measurement,
+			hostname:    hostname,
+			client:      &http.Client{Timeout: pushTimeout},
+		}
+
+	case "tcp", "udp":
+		if len(u.Port()) == 0 {
+			return nil, fmt.Errorf("invalid push URL: no port")
+		}
+		p.target = &graphiteTarget{
+			network: u.Scheme,
+			addr:    u.Host,
+			prefix:  measurement + "." + graphiteName(hostname),
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid push URL: unsupported scheme: %s", u.Scheme)
+	}
+	return p, nil
+}
+
+func (p *pusher) start(s *statsCtx) {
+	if p != nil {
+		go p.run(s)
+	}
+}
+
+// Send the last values and stop
+func (p *pusher) close() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.target.close()
+}
+
+func (p *pusher) run(s *statsCtx) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	// the counters are zero at the start of the process,
+	// so the first push covers the requests processed before the pusher was started
+	prev := pushCounters{}
+	push := func() {
+		cur := s.getPushCounters()
+		err := p.target.send(time.Now(), makeMetrics(prev, cur))
+		if err != nil {
+			log.Debug("Stats: push: %s", err)
+		}
+		prev = cur
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			push()
+
+		case <-p.stop:
+			push()
+			close(p.done)
+			return
+		}
+	}
+}
+
+// Get the copy of the counters
+func (s *statsCtx) getPushCounters() pushCounters {
+	s.unitLock.Lock()
+	c := s.counters
+	c.nResult = append([]uint64{}, s.counters.nResult...)
+	s.unitLock.Unlock()
+	return c
+}
+
+// Get the metrics: the counters since the start of the process
+// and the average processing time (in seconds) of the requests since the last push.
+func makeMetrics(prev, cur pushCounters) []metric {
+	avgTime := float64(0)
+	if cur.nTotal > prev.nTotal && cur.timeSum >= prev.timeSum {
+		avgTime = float64(cur.timeSum-prev.timeSum) / float64(cur.nTotal-prev.nTotal) / 1000000
+	}
+	return []metric{
+		{"dns_queries", cur.nTotal},
+		{"blocked_filtering", cur.nResult[RFiltered]},
+		{"replaced_safebrowsing", cur.nResult[RSafeBrowsing]},
+		{"replaced_safesearch", cur.nResult[RSafeSearch]},
+		{"replaced_parental", cur.nResult[RParental]},
+		{"avg_processing_time", avgTime},
+	}
+}
+
+// influxTarget sends the metrics to InfluxDB HTTP API in line protocol
+type influxTarget struct {
+	url         string // write endpoint ("http://host:8086/write?db=adguard")
+	measurement string
+	hostname    string
+	client      *http.Client
+}
+
+// Escape the tag value (or measurement name) for line protocol
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// Format the metrics as a single line:
+// MEASUREMENT,host=HOST FIELD=VALUE,... TIMESTAMP
+func (t *influxTarget) format(tm time.Time, metrics []metric) []byte {
+	var b bytes.Buffer
+	b.WriteString(influxEscape(t.measurement))
+	if len(t.hostname) != 0 {
+		b.WriteString(",host=" + influxEscape(t.hostname))
+	}
+	for i, m := range metrics {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		switch v := m.value.(type) {
+		case uint64:
+			fmt.Fprintf(&b, "%s=%di", m.name, v)
+		case float64:
+			fmt.Fprintf(&b, "%s=%g", m.name, v)
+		}
+	}
+	fmt.Fprintf(&b, " %d\n", tm.UnixNano())
+	return b.Bytes()
+}
+
+func (t *influxTarget) send(tm time.Time, metrics []metric) error {
+	resp, err := t.client.Post(t.url, "text/plain; charset=utf-8", bytes.NewReader(t.format(tm, metrics)))
+	if err != nil {
+		return fmt.Errorf("influxdb: %s", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influxdb: %s: got status code %d", t.url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *influxTarget) close() {
+}
+
+// graphiteTarget sends the metrics to Graphite server in plaintext protocol
+type graphiteTarget struct {
+	network string // "tcp" or "udp"
+	addr    string
+	prefix  string // "MEASUREMENT.HOST"
+	conn    net.Conn
+}
+
+// Replace the characters which have special meaning in Graphite metric path
+func graphiteName(s string) string {
+	if len(s) == 0 {
+		return "unknown"
+	}
+	return strings.NewReplacer(".", "_", " ", "_").Replace(s)
+}
+
+// Format the metrics, one per line:
+// PREFIX.NAME VALUE TIMESTAMP
+func (t *graphiteTarget) format(tm time.Time, metrics []metric) []byte {
+	var b bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "%s.%s %v %d\n", t.prefix, m.name, m.value, tm.Unix())
+	}
+	return b.Bytes()
+}
+
+func (t *graphiteTarget) send(tm time.Time, metrics []metric) error {
+	if t.conn == nil {
+		var err error
+		t.conn, err = net.DialTimeout(t.network, t.addr, pushTimeout)
+		if err != nil {
+			return fmt.Errorf("graphite: %s", err)
+		}
+	}
+	_ = t.conn.SetWriteDeadline(time.Now().Add(pushTimeout))
+
+	_, err := t.conn.Write(t.format(tm, metrics))
+	if err != nil {
+		t.close() // reconnect next time
+		return fmt.Errorf("graphite: %s", err)
+	}
+	return nil
+}
+
+func (t *graphiteTarget) close() {
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+}
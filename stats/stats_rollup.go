@@ -0,0 +1,285 @@
+// Long-term statistics: per-day and per-month rollups of hourly units
+
+package stats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// Time units of rollups
+const (
+	granularityHour  = "hour"
+	granularityDay   = "day"
+	granularityMonth = "month"
+)
+
+// Default number of time units returned by API
+const (
+	defaultDaysCount   = 30
+	defaultMonthsCount = 12
+)
+
+var (
+	rollupBucket  = []byte("rollup") // all rollups are stored in this bucket
+	rollupLastKey = []byte("last")   // ID of the last hourly unit which was added to rollups
+)
+
+const (
+	rollupDayPrefix   = 'd'
+	rollupMonthPrefix = 'm'
+)
+
+// Return TRUE if it's the name of the hourly unit's bucket (the other buckets are sorted after units)
+func isUnitName(name []byte) bool {
+	return len(name) == 8 && name[0] == 0
+}
+
+// Get day ID by hourly unit ID
+func dayID(id uint32) uint32 {
+	return id / 24
+}
+
+// Get month ID (the number of months since year 0) by hourly unit ID
+func monthID(id uint32) uint32 {
+	t := time.Unix(int64(id)*60*60, 0).UTC()
+	return uint32(t.Year()*12 + int(t.Month()) - 1)
+}
+
+func rollupKey(prefix byte, id uint32) []byte {
+	return append([]byte{prefix}, itob(uint64(id))...)
+}
+
+// Add top counters, keeping the pairs with the highest numbers
+func mergeTop(a []countPair, b []countPair, max int) []countPair {
+	m := convertArrayToMap(a)
+	for _, it := range b {
+		m[it.Name] += it.Count
+	}
+	return convertMapToArray(m, max)
+}
+
+// Add unit's data to the rollup.
+// Note that only top domains and clients of every unit are stored, so the top counters of a rollup are approximate.
+func mergeUnit(dst *unitDB, src *unitDB) {
+	total := dst.NTotal + src.NTotal
+	if total != 0 {
+		dst.TimeAvg = uint32((uint64(dst.TimeAvg)*dst.NTotal + uint64(src.TimeAvg)*src.NTotal) / total)
+	}
+	dst.NTotal = total
+
+	for len(dst.NResult) < len(src.NResult) {
+		dst.NResult = append(dst.NResult, 0)
+	}
+	for i, n := range src.NResult {
+		dst.NResult[i] += n
+	}
+
+	dst.Domains = mergeTop(dst.Domains, src.Domains, maxDomains)
+	dst.BlockedDomains = mergeTop(dst.BlockedDomains, src.BlockedDomains, maxDomains)
+	dst.Clients = mergeTop(dst.Clients, src.Clients, maxClients)
+	dst.Filters = mergeTop(dst.Filters, src.Filters, maxFilters)
+	dst.Services = mergeTop(dst.Services, src.Services, maxServices)
+	dst.Categories = mergeTop(dst.Categories, src.Categories, maxServices)
+	dst.ClientServices = mergeTop(dst.ClientServices, src.ClientServices, maxClientServices)
+}
+
+func newUnitDB() *unitDB {
+	return &unitDB{NResult: make([]uint64, rLast)}
+}
+
+func decodeUnit(data []byte) *unitDB {
+	if data == nil {
+		return nil
+	}
+	udb := unitDB{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&udb)
+	if err != nil {
+		log.Error("gob Decode: %s", err)
+		return nil
+	}
+	return &udb
+}
+
+func encodeUnit(udb *unitDB) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(udb)
+	return buf.Bytes(), err
+}
+
+// Get the rollup.  Return an empty object if it doesn't exist.
+func loadRollup(b *bolt.Bucket, prefix byte, id uint32) *unitDB {
+	if b == nil {
+		return newUnitDB()
+	}
+	udb := decodeUnit(b.Get(rollupKey(prefix, id)))
+	if udb == nil {
+		return newUnitDB()
+	}
+	return udb
+}
+
+// Add the hourly units older than curID (which aren't added yet) to the rollups,
+// and remove the rollups older than the retention period.
+// If the retention period is 0, the rollups of this type aren't created and the existing ones are removed.
+// Return TRUE if DB was modified.
+func (s *statsCtx) rollup(tx *bolt.Tx, curID uint32) bool {
+	conf := s.conf
+	b, err := tx.CreateBucketIfNotExists(rollupBucket)
+	if err != nil {
+		log.Error("tx.CreateBucketIfNotExists: %s", err)
+		return false
+	}
+
+	// older units are already removed from DB
+	first := uint32(0)
+	if curID > conf.limit+1 {
+		first = curID - conf.limit - 1
+	}
+	last := b.Get(rollupLastKey)
+	if len(last) == 8 && uint32(btoi(last))+1 > first {
+		first = uint32(btoi(last)) + 1
+	}
+	if first >= curID {
+		return false
+	}
+
+	days := map[uint32]*unitDB{}
+	months := map[uint32]*unitDB{}
+	for id := first; id != curID; id++ {
+		udb := s.loadUnitFromDB(tx, id)
+		if udb == nil {
+			continue
+		}
+
+		if conf.DailyRetention != 0 {
+			d, ok := days[dayID(id)]
+			if !ok {
+				d = loadRollup(b, rollupDayPrefix, dayID(id))
+				days[dayID(id)] = d
+			}
+			mergeUnit(d, udb)
+		}
+
+		if conf.MonthlyRetention != 0 {
+			m, ok := months[monthID(id)]
+			if !ok {
+				m = loadRollup(b, rollupMonthPrefix, monthID(id))
+				months[monthID(id)] = m
+			}
+			mergeUnit(m, udb)
+		}
+	}
+
+	put := func(prefix byte, list map[uint32]*unitDB) {
+		for id, udb := range list {
+			data, err := encodeUnit(udb)
+			if err != nil {
+				log.Error("gob.Encode: %s", err)
+				continue
+			}
+			err = b.Put(rollupKey(prefix, id), data)
+			if err != nil {
+				log.Error("bkt.Put: %s", err)
+			}
+		}
+	}
+	put(rollupDayPrefix, days)
+	put(rollupMonthPrefix, months)
+	_ = b.Put(rollupLastKey, itob(uint64(curID-1)))
+
+	s.purgeRollups(b, rollupDayPrefix, dayID(curID), conf.DailyRetention)
+	s.purgeRollups(b, rollupMonthPrefix, monthID(curID), conf.MonthlyRetention)
+
+	log.Debug("Stats: added units [%d..%d] to rollups", first, curID-1)
+	return true
+}
+
+// Remove the rollups older than the retention period (in days or months).  0: remove all.
+func (s *statsCtx) purgeRollups(b *bolt.Bucket, prefix byte, curID uint32, retention uint32) {
+	minKey := []byte{prefix}
+	if retention != 0 && curID >= retention {
+		minKey = rollupKey(prefix, curID-retention+1)
+	}
+
+	keys := [][]byte{}
+	c := b.Cursor()
+	for k, _ := c.Seek([]byte{prefix}); k != nil && k[0] == prefix && bytes.Compare(k, minKey) < 0; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		err := b.Delete(k)
+		if err != nil {
+			log.Error("bkt.Delete: %s", err)
+		}
+	}
+	if len(keys) != 0 {
+		log.Debug("Stats: removed %d rollups", len(keys))
+	}
+}
+
+// Get rollups for the last 'count' days or months.  The current hourly unit is added to the last element.
+func (s *statsCtx) loadRollups(granularity string, count uint32) []*unitDB {
+	tx := s.beginTxn(false)
+	if tx == nil {
+		return nil
+	}
+
+	s.unitLock.Lock()
+	curUnit := serialize(s.unit)
+	curID := s.unit.id
+	s.unitLock.Unlock()
+
+	prefix := byte(rollupDayPrefix)
+	last := dayID(curID)
+	if granularity == granularityMonth {
+		prefix = rollupMonthPrefix
+		last = monthID(curID)
+	}
+
+	if count > last+1 {
+		count = last + 1
+	}
+	b := tx.Bucket(rollupBucket)
+	units := []*unitDB{}
+	for id := last - count + 1; id != last+1; id++ {
+		units = append(units, loadRollup(b, prefix, id))
+	}
+	_ = tx.Rollback()
+
+	mergeUnit(units[len(units)-1], curUnit)
+	return units
+}
+
+// Get data for the last 'count' days or months
+func (s *statsCtx) getRollupData(granularity string, count uint32) map[string]interface{} {
+	units := s.loadRollups(granularity, count)
+	if units == nil {
+		return nil
+	}
+
+	d := map[string]interface{}{}
+	series := func(get func(u *unitDB) uint64) []uint64 {
+		a := []uint64{}
+		for _, u := range units {
+			a = append(a, get(u))
+		}
+		return a
+	}
+	d["dns_queries"] = series(func(u *unitDB) uint64 { return u.NTotal })
+	d["blocked_filtering"] = series(func(u *unitDB) uint64 { return u.NResult[RFiltered] })
+	d["replaced_safebrowsing"] = series(func(u *unitDB) uint64 { return u.NResult[RSafeBrowsing] })
+	d["replaced_parental"] = series(func(u *unitDB) uint64 { return u.NResult[RParental] })
+
+	addTopsAndTotals(d, units)
+
+	d["time_units"] = "days"
+	if granularity == granularityMonth {
+		d["time_units"] = "months"
+	}
+	return d
+}
@@ -2,10 +2,15 @@ package stats
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -37,12 +42,15 @@ func TestStats(t *testing.T) {
 	e.Client = net.ParseIP("127.0.0.1")
 	e.Result = RFiltered
 	e.Time = 123456
+	e.FilterID = 1
+	e.FilterMatched = true
 	s.Update(e)
 
 	e.Domain = "domain"
 	e.Client = net.ParseIP("127.0.0.1")
 	e.Result = RNotFiltered
 	e.Time = 123456
+	e.FilterMatched = false
 	s.Update(e)
 
 	d := s.getData()
@@ -67,6 +75,10 @@ func TestStats(t *testing.T) {
 	m = d["top_clients"].([]map[string]uint64)
 	assert.True(t, m[0]["127.0.0.1"] == 2)
 
+	m = d["blocked_filters"].([]map[string]uint64)
+	assert.Equal(t, 1, len(m))
+	assert.True(t, m[0]["1"] == 1)
+
 	assert.True(t, d["num_dns_queries"].(uint64) == 2)
 	assert.True(t, d["num_blocked_filtering"].(uint64) == 1)
 	assert.True(t, d["num_replaced_safebrowsing"].(uint64) == 0)
@@ -150,3 +162,192 @@ func TestAggregateDataPerTimeUnit(t *testing.T) {
 		assert.True(t, alen == 30, "i=%d", i)
 	}
 }
+
+func TestStatsIgnoredClient(t *testing.T) {
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+		IgnoredClient: func(ip net.IP) bool {
+			return ip.Equal(net.ParseIP("127.0.0.2"))
+		},
+	}
+	s, _ := createObject(conf)
+
+	e := Entry{
+		Domain: "domain",
+		Client: net.ParseIP("127.0.0.1"),
+		Result: RNotFiltered,
+	}
+	s.Update(e)
+	e.Client = net.ParseIP("127.0.0.2")
+	s.Update(e)
+
+	d := s.getData()
+	assert.Equal(t, uint64(1), d["num_dns_queries"].(uint64))
+	topClients := s.GetTopClientsIP(2)
+	assert.Equal(t, []string{"127.0.0.1"}, topClients)
+
+	s.clear()
+	s.Close()
+	os.Remove(conf.Filename)
+}
+
+func TestStatsRollup(t *testing.T) {
+	var hour int32 = 24 * 100 // 11 Apr 1970
+	newID := func() uint32 {
+		return uint32(atomic.LoadInt32(&hour))
+	}
+	conf := Config{
+		Filename:         "./stats.db",
+		LimitDays:        1,
+		UnitID:           newID,
+		DailyRetention:   2,
+		MonthlyRetention: 12,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	// the same as periodicFlush() does
+	flush := func() {
+		id := newID()
+		tx := s.beginTxn(true)
+		nu := unit{}
+		s.initUnit(&nu, id)
+		u := s.swapUnit(&nu)
+		s.flushUnitToDB(tx, u.id, serialize(u))
+		s.rollup(tx, id)
+		s.commitTxn(tx)
+	}
+
+	e := Entry{
+		Domain: "domain",
+		Client: net.ParseIP("127.0.0.1"),
+		Result: RFiltered,
+		Time:   1000,
+	}
+	for h := 0; h != 48; h++ {
+		s.Update(e)
+		atomic.AddInt32(&hour, 1)
+		flush()
+	}
+
+	// the first day is removed
+	d := s.getRollupData(granularityDay, 3)
+	assert.Equal(t, []uint64{0, 24, 0}, d["dns_queries"])
+	assert.Equal(t, []uint64{0, 24, 0}, d["blocked_filtering"])
+	assert.Equal(t, "days", d["time_units"])
+
+	d = s.getRollupData(granularityMonth, 2)
+	assert.Equal(t, []uint64{0, 48}, d["dns_queries"])
+	assert.Equal(t, uint64(48), d["num_dns_queries"])
+	m := d["top_blocked_domains"].([]map[string]uint64)
+	assert.Equal(t, uint64(48), m[0]["domain"])
+	assert.Equal(t, "months", d["time_units"])
+
+	// the current unit is added to the last element
+	s.Update(e)
+	d = s.getRollupData(granularityDay, 1)
+	assert.Equal(t, []uint64{1}, d["dns_queries"])
+
+	// the rollups and the current unit are kept after restart
+	s.Close()
+	s, _ = createObject(conf)
+	d = s.getRollupData(granularityMonth, 1)
+	assert.Equal(t, []uint64{49}, d["dns_queries"])
+
+	s.Close()
+	os.Remove(conf.Filename)
+}
+
+func TestStatsBlockedServices(t *testing.T) {
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	e := Entry{
+		Domain:  "youtube.com",
+		Client:  net.ParseIP("127.0.0.1"),
+		Result:  RFiltered,
+		Service: "youtube",
+	}
+	s.Update(e)
+	s.Update(e)
+	e.Domain = "tiktok.com"
+	e.Service = "tiktok"
+	s.Update(e)
+	e.Client = net.ParseIP("::1")
+	s.Update(e)
+	e = Entry{
+		Domain:   "adult.example",
+		Client:   net.ParseIP("127.0.0.1"),
+		Result:   RParental,
+		Category: "parental CATEGORY_BLACKLISTED",
+	}
+	s.Update(e)
+
+	d := s.getData()
+	m := d["top_blocked_services"].([]map[string]uint64)
+	assert.Equal(t, 2, len(m))
+	assert.Equal(t, uint64(2), m[0]["youtube"]+m[0]["tiktok"])
+
+	m = d["top_blocked_categories"].([]map[string]uint64)
+	assert.Equal(t, []map[string]uint64{{"parental CATEGORY_BLACKLISTED": 1}}, m)
+
+	c := d["top_blocked_services_by_client"].(map[string][]map[string]uint64)
+	assert.Equal(t, 2, len(c))
+	assert.Equal(t, []map[string]uint64{{"youtube": 2}, {"tiktok": 1}}, c["127.0.0.1"])
+	assert.Equal(t, []map[string]uint64{{"tiktok": 1}}, c["::1"])
+
+	s.Close()
+	os.Remove(conf.Filename)
+}
+
+func TestStatsPush(t *testing.T) {
+	received := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		received <- data
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	conf := Config{
+		Filename:        "./stats.db",
+		LimitDays:       1,
+		PushURL:         srv.URL + "/write?db=adguard",
+		PushMeasurement: "dns stats",
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+	assert.NotNil(t, s.pusher)
+	s.pusher.target.(*influxTarget).hostname = "host"
+
+	e := Entry{
+		Domain: "domain",
+		Client: net.ParseIP("127.0.0.1"),
+		Result: RFiltered,
+		Time:   2000,
+	}
+	s.Update(e)
+	e.Result = RNotFiltered
+	s.Update(e)
+
+	s.pusher.start(s)
+	s.Close() // the counters are sent when the pusher is stopped
+	os.Remove(conf.Filename)
+
+	assert.True(t, strings.HasPrefix(string(<-received),
+		`dns\ stats,host=host dns_queries=2i,blocked_filtering=1i,replaced_safebrowsing=0i,replaced_safesearch=0i,replaced_parental=0i,avg_processing_time=0.002 `))
+
+	g := graphiteTarget{prefix: "adguardhome." + graphiteName("my.host")}
+	data := g.format(time.Unix(1000, 0), []metric{{"dns_queries", uint64(2)}, {"avg_processing_time", 0.5}})
+	assert.Equal(t, "adguardhome.my_host.dns_queries 2 1000\nadguardhome.my_host.avg_processing_time 0.5 1000\n", string(data))
+
+	_, err := newPusher(&Config{PushURL: "tcp://host"})
+	assert.NotNil(t, err)
+	_, err = newPusher(&Config{PushURL: "ftp://host:21"})
+	assert.NotNil(t, err)
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +19,11 @@ import (
 const (
 	maxDomains = 100 // max number of top domains to store in file or return via Get()
 	maxClients = 100 // max number of top clients to store in file or return via Get()
+	maxFilters = 500 // max number of filter lists to store in file or return via Get()
+
+	maxServices       = 100  // max number of top blocked services and categories to store in file or return via Get()
+	maxClientServices = 1000 // max number of top client-service pairs to store in file
+	maxServicesClient = 10   // max number of top blocked services per client to return via Get()
 )
 
 // statsCtx - global context
@@ -25,7 +32,10 @@ type statsCtx struct {
 	conf *Config
 
 	unit     *unit      // the current unit
-	unitLock sync.Mutex // protect 'unit'
+	unitLock sync.Mutex // protect 'unit' and 'counters'
+
+	counters pushCounters // the counters since the start of the process
+	pusher   *pusher      // sends the counters to TSDB (optional)
 }
 
 // data for 1 time unit
@@ -40,6 +50,10 @@ type unit struct {
 	domains        map[string]uint64 // number of requests per domain
 	blockedDomains map[string]uint64 // number of blocked requests per domain
 	clients        map[string]uint64 // number of requests per client
+	filters        map[string]uint64 // number of blocked requests per filter list ID
+	services       map[string]uint64 // number of blocked requests per service
+	categories     map[string]uint64 // number of blocked requests per safebrowsing/parental category
+	clientServices map[string]uint64 // number of blocked requests per client and service: "client service"
 }
 
 // name-count pair
@@ -56,6 +70,10 @@ type unitDB struct {
 	Domains        []countPair
 	BlockedDomains []countPair
 	Clients        []countPair
+	Filters        []countPair
+	Services       []countPair
+	Categories     []countPair
+	ClientServices []countPair
 
 	TimeAvg uint32 // usec
 }
@@ -80,10 +98,16 @@ func createObject(conf Config) (*statsCtx, error) {
 	tx := s.beginTxn(true)
 	var udb *unitDB
 	if tx != nil {
+		// the units which weren't added to rollups before the last shutdown
+		rolled := s.rollup(tx, id)
+
 		log.Tracef("Deleting old units...")
 		firstID := id - s.conf.limit - 1
 		unitDel := 0
 		forEachBkt := func(name []byte, b *bolt.Bucket) error {
+			if !isUnitName(name) {
+				return fmt.Errorf("")
+			}
 			id := uint32(btoi(name))
 			if id < firstID {
 				err := tx.DeleteBucket(name)
@@ -100,7 +124,7 @@ func createObject(conf Config) (*statsCtx, error) {
 
 		udb = s.loadUnitFromDB(tx, id)
 
-		if unitDel != 0 {
+		if unitDel != 0 || rolled {
 			s.commitTxn(tx)
 		} else {
 			_ = tx.Rollback()
@@ -114,6 +138,13 @@ func createObject(conf Config) (*statsCtx, error) {
 	}
 	s.unit = &u
 
+	s.counters.nResult = make([]uint64, rLast)
+	var err error
+	s.pusher, err = newPusher(s.conf)
+	if err != nil {
+		log.Error("Stats: %s", err)
+	}
+
 	log.Debug("Stats: initialized")
 	return &s, nil
 }
@@ -121,6 +152,7 @@ func createObject(conf Config) (*statsCtx, error) {
 func (s *statsCtx) Start() {
 	s.initWeb()
 	go s.periodicFlush()
+	s.pusher.start(s)
 }
 
 func checkInterval(days uint32) bool {
@@ -164,6 +196,10 @@ func (s *statsCtx) initUnit(u *unit, id uint32) {
 	u.domains = make(map[string]uint64)
 	u.blockedDomains = make(map[string]uint64)
 	u.clients = make(map[string]uint64)
+	u.filters = make(map[string]uint64)
+	u.services = make(map[string]uint64)
+	u.categories = make(map[string]uint64)
+	u.clientServices = make(map[string]uint64)
 }
 
 // Open a DB transaction
@@ -215,6 +251,7 @@ func btoi(b []byte) uint64 {
 // . atomically set a new empty unit as the current one and get the old unit
 //   This is important to do it inside DB lock, so the reader won't get inconsistent results.
 // . write the unit to DB
+// . add the complete units to the daily and monthly rollups
 // . remove the stale unit from DB
 // . unlock DB
 func (s *statsCtx) periodicFlush() {
@@ -243,8 +280,9 @@ func (s *statsCtx) periodicFlush() {
 			continue
 		}
 		ok1 := s.flushUnitToDB(tx, u.id, udb)
-		ok2 := s.deleteUnit(tx, id-s.conf.limit)
-		if ok1 || ok2 {
+		ok2 := s.rollup(tx, id)
+		ok3 := s.deleteUnit(tx, id-s.conf.limit)
+		if ok1 || ok2 || ok3 {
 			s.commitTxn(tx)
 		} else {
 			_ = tx.Rollback()
@@ -305,6 +343,10 @@ func serialize(u *unit) *unitDB {
 	udb.Domains = convertMapToArray(u.domains, maxDomains)
 	udb.BlockedDomains = convertMapToArray(u.blockedDomains, maxDomains)
 	udb.Clients = convertMapToArray(u.clients, maxClients)
+	udb.Filters = convertMapToArray(u.filters, maxFilters)
+	udb.Services = convertMapToArray(u.services, maxServices)
+	udb.Categories = convertMapToArray(u.categories, maxServices)
+	udb.ClientServices = convertMapToArray(u.clientServices, maxClientServices)
 	return &udb
 }
 
@@ -322,6 +364,10 @@ func deserialize(u *unit, udb *unitDB) {
 	u.domains = convertArrayToMap(udb.Domains)
 	u.blockedDomains = convertArrayToMap(udb.BlockedDomains)
 	u.clients = convertArrayToMap(udb.Clients)
+	u.filters = convertArrayToMap(udb.Filters)
+	u.services = convertArrayToMap(udb.Services)
+	u.categories = convertArrayToMap(udb.Categories)
+	u.clientServices = convertArrayToMap(udb.ClientServices)
 	u.timeSum = uint64(udb.TimeAvg) * u.nTotal
 }
 
@@ -382,6 +428,24 @@ func convertTopArray(a []countPair) []map[string]uint64 {
 	return m
 }
 
+// Group the pairs "client service" by client.
+// The services of every client are sorted in descending order.
+func convertClientServices(a []countPair) map[string][]map[string]uint64 {
+	m := map[string][]map[string]uint64{}
+	for _, it := range a {
+		i := strings.IndexByte(it.Name, ' ')
+		if i < 0 {
+			continue
+		}
+		client := it.Name[:i]
+		if len(m[client]) == maxServicesClient {
+			continue
+		}
+		m[client] = append(m[client], map[string]uint64{it.Name[i+1:]: it.Count})
+	}
+	return m
+}
+
 func (s *statsCtx) setLimit(limitDays int) {
 	conf := *s.conf
 	conf.limit = uint32(limitDays) * 24
@@ -391,9 +455,28 @@ func (s *statsCtx) setLimit(limitDays int) {
 
 func (s *statsCtx) WriteDiskConfig(dc *DiskConfig) {
 	dc.Interval = s.conf.limit / 24
+	dc.DailyRetention = s.conf.DailyRetention
+	dc.MonthlyRetention = s.conf.MonthlyRetention
+	dc.PushURL = s.conf.PushURL
+	dc.PushInterval = s.conf.PushInterval
+	dc.PushMeasurement = s.conf.PushMeasurement
+}
+
+func (s *statsCtx) SetDiskConfig(dc *DiskConfig) {
+	s.setLimit(int(dc.Interval))
+}
+
+// CheckDiskConfig - check the settings which may be changed at runtime
+func CheckDiskConfig(dc *DiskConfig) error {
+	if !checkInterval(dc.Interval) {
+		return fmt.Errorf("unsupported interval: %d", dc.Interval)
+	}
+	return nil
 }
 
 func (s *statsCtx) Close() {
+	s.pusher.close()
+
 	u := s.swapUnit(nil)
 	udb := serialize(u)
 	tx := s.beginTxn(true)
@@ -449,7 +532,13 @@ func (s *statsCtx) Update(e Entry) {
 		!(len(e.Client) == 4 || len(e.Client) == 16) {
 		return
 	}
+	if s.conf.IgnoredClient != nil && s.conf.IgnoredClient(e.Client) {
+		return
+	}
 	client := e.Client.String()
+	if len(e.ClientID) != 0 {
+		client = e.ClientID
+	}
 
 	s.unitLock.Lock()
 	u := s.unit
@@ -458,13 +547,27 @@ func (s *statsCtx) Update(e Entry) {
 
 	if e.Result == RNotFiltered {
 		u.domains[e.Domain]++
-	} else {
+	} else if e.Result != RRatelimited {
 		u.blockedDomains[e.Domain]++
 	}
+	if e.Result == RFiltered && e.FilterMatched {
+		u.filters[strconv.FormatInt(e.FilterID, 10)]++
+	}
+	if len(e.Service) != 0 {
+		u.services[e.Service]++
+		u.clientServices[client+" "+e.Service]++
+	}
+	if len(e.Category) != 0 {
+		u.categories[e.Category]++
+	}
 
 	u.clients[client]++
 	u.timeSum += uint64(e.Time)
 	u.nTotal++
+
+	s.counters.nResult[e.Result]++
+	s.counters.timeSum += uint64(e.Time)
+	s.counters.nTotal++
 	s.unitLock.Unlock()
 }
 
@@ -647,6 +750,18 @@ func (s *statsCtx) getData() map[string]interface{} {
 	}
 	d["replaced_parental"] = a
 
+	addTopsAndTotals(d, units)
+
+	d["time_units"] = "hours"
+	if timeUnit == Days {
+		d["time_units"] = "days"
+	}
+
+	return d
+}
+
+// Get top and total counters from the units
+func addTopsAndTotals(d map[string]interface{}, units []*unitDB) {
 	// top counters:
 
 	m := map[string]uint64{}
@@ -676,6 +791,41 @@ func (s *statsCtx) getData() map[string]interface{} {
 	a2 = convertMapToArray(m, maxClients)
 	d["top_clients"] = convertTopArray(a2)
 
+	m = map[string]uint64{}
+	for _, u := range units {
+		for _, it := range u.Filters {
+			m[it.Name] += it.Count
+		}
+	}
+	a2 = convertMapToArray(m, maxFilters)
+	d["blocked_filters"] = convertTopArray(a2)
+
+	m = map[string]uint64{}
+	for _, u := range units {
+		for _, it := range u.Services {
+			m[it.Name] += it.Count
+		}
+	}
+	a2 = convertMapToArray(m, maxServices)
+	d["top_blocked_services"] = convertTopArray(a2)
+
+	m = map[string]uint64{}
+	for _, u := range units {
+		for _, it := range u.Categories {
+			m[it.Name] += it.Count
+		}
+	}
+	a2 = convertMapToArray(m, maxServices)
+	d["top_blocked_categories"] = convertTopArray(a2)
+
+	m = map[string]uint64{}
+	for _, u := range units {
+		for _, it := range u.ClientServices {
+			m[it.Name] += it.Count
+		}
+	}
+	d["top_blocked_services_by_client"] = convertClientServices(convertMapToArray(m, maxClientServices))
+
 	// total counters:
 
 	sum := unitDB{}
@@ -691,6 +841,9 @@ func (s *statsCtx) getData() map[string]interface{} {
 		sum.NResult[RSafeBrowsing] += u.NResult[RSafeBrowsing]
 		sum.NResult[RSafeSearch] += u.NResult[RSafeSearch]
 		sum.NResult[RParental] += u.NResult[RParental]
+		if len(u.NResult) > int(RRatelimited) {
+			sum.NResult[RRatelimited] += u.NResult[RRatelimited]
+		}
 	}
 
 	d["num_dns_queries"] = sum.NTotal
@@ -698,19 +851,13 @@ func (s *statsCtx) getData() map[string]interface{} {
 	d["num_replaced_safebrowsing"] = sum.NResult[RSafeBrowsing]
 	d["num_replaced_safesearch"] = sum.NResult[RSafeSearch]
 	d["num_replaced_parental"] = sum.NResult[RParental]
+	d["num_ratelimited"] = sum.NResult[RRatelimited]
 
 	avgTime := float64(0)
 	if timeN != 0 {
 		avgTime = float64(sum.TimeAvg/uint32(timeN)) / 1000000
 	}
 	d["avg_processing_time"] = avgTime
-
-	d["time_units"] = "hours"
-	if timeUnit == Days {
-		d["time_units"] = "days"
-	}
-
-	return d
 }
 
 func (s *statsCtx) GetTopClientsIP(maxCount uint) []string {
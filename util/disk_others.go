@@ -0,0 +1,13 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!windows
+
+package util
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// DiskFreeSpace returns the number of bytes available to a non-root user on the file system containing path
+func DiskFreeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
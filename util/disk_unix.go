@@ -0,0 +1,15 @@
+// +build darwin dragonfly freebsd linux
+
+package util
+
+import "syscall"
+
+// DiskFreeSpace returns the number of bytes available to a non-root user on the file system containing path
+func DiskFreeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,17 @@
+package util
+
+import "golang.org/x/sys/windows"
+
+// DiskFreeSpace returns the number of bytes available to the current user on the disk containing path
+func DiskFreeSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree)
+	if err != nil {
+		return 0, err
+	}
+	return free, nil
+}
@@ -0,0 +1,20 @@
+// +build !windows
+
+package util
+
+import (
+	"syscall"
+)
+
+// SetInheritable sets whether the file descriptor is inherited by the processes started via exec
+func SetInheritable(fd uintptr, inherit bool) error {
+	flags := 0
+	if !inherit {
+		flags = syscall.FD_CLOEXEC
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonLogWriter converts the messages written by the standard logger to JSON objects
+// ({"time":"...","level":"info","msg":"..."}).
+// If the message itself is a JSON object, its fields are added to the record instead of "msg".
+type jsonLogWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+	now  func() time.Time
+}
+
+// ConfigureJSONLog makes the standard logger write JSON objects to the current output
+func ConfigureJSONLog() {
+	log.SetOutput(&jsonLogWriter{w: log.Writer(), now: time.Now})
+	log.SetFlags(0) // the time is added by jsonLogWriter
+}
+
+// Split "[level] message" line
+func parseLogLine(line string) (string, string) {
+	if strings.HasPrefix(line, "[") {
+		i := strings.Index(line, "] ")
+		if i > 0 && strings.IndexByte(line[1:i], ' ') == -1 {
+			return strings.ToLower(line[1:i]), line[i+2:]
+		}
+	}
+	return "info", line
+}
+
+// Make a JSON record from a log line
+func jsonLogRecord(line string, now time.Time) []byte {
+	level, msg := parseLogLine(line)
+
+	rec := map[string]interface{}{}
+	if !strings.HasPrefix(msg, "{") || json.Unmarshal([]byte(msg), &rec) != nil {
+		rec = map[string]interface{}{"msg": msg}
+	}
+	rec["time"] = now.Format(time.RFC3339Nano)
+	rec["level"] = level
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil
+	}
+	return append(data, '\n')
+}
+
+// Write a message.  The standard logger calls it once for every message (which may consist of several lines).
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	rec := jsonLogRecord(strings.TrimSuffix(string(p), "\n"), j.now())
+
+	j.lock.Lock()
+	_, err := j.w.Write(rec)
+	j.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	now := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	w := &jsonLogWriter{w: buf, now: func() time.Time { return now }}
+
+	rec := map[string]interface{}{}
+
+	_, _ = w.Write([]byte("[debug] Filtering: matched rule\n"))
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, "debug", rec["level"])
+	assert.Equal(t, "Filtering: matched rule", rec["msg"])
+	assert.Equal(t, "2020-05-20T12:00:00Z", rec["time"])
+
+	// no level
+	buf.Reset()
+	rec = map[string]interface{}{}
+	_, _ = w.Write([]byte("[not a level] message\n"))
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, "info", rec["level"])
+	assert.Equal(t, "[not a level] message", rec["msg"])
+
+	// the message is a JSON object
+	buf.Reset()
+	rec = map[string]interface{}{}
+	_, _ = w.Write([]byte("[info] {\"qname\":\"example.org\",\"elapsed\":1.5}\n"))
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, "info", rec["level"])
+	assert.Equal(t, "example.org", rec["qname"])
+	assert.Equal(t, 1.5, rec["elapsed"])
+	_, ok := rec["msg"]
+	assert.False(t, ok)
+}